@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// accessLogWriter writes access log entries (one per closed connection) to a
+// file, either as JSON objects or as key=value pairs, one entry per line.
+type accessLogWriter struct {
+	mu   sync.Mutex
+	path string
+	out  io.WriteCloser
+	json bool
+}
+
+func openAccessLog(path string, json bool) (*accessLogWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogWriter{path: path, out: file, json: json}, nil
+}
+
+// Reopen reopens the access log file, e.g. after it was moved away for log
+// rotation. If reopening fails, we keep writing to the old file.
+func (w *accessLogWriter) Reopen() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	old := w.out
+	w.out = file
+	w.mu.Unlock()
+	return old.Close()
+}
+
+func (w *accessLogWriter) LogAccess(fields map[string]interface{}) {
+	var line []byte
+	if w.json {
+		var err error
+		line, err = json.Marshal(fields)
+		if err != nil {
+			logger.Printf("error formatting access log entry: %s", err)
+			return
+		}
+	} else {
+		line = formatKeyValues(fields)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.out.Write(append(line, '\n'))
+	if err != nil {
+		logger.Printf("error writing access log entry: %s", err)
+	}
+}
+
+func (w *accessLogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.out.Close()
+}
+
+// formatKeyValues formats fields as key=value pairs, sorted by key. Values
+// with spaces or quotes are quoted.
+func formatKeyValues(fields map[string]interface{}) []byte {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		value := fmt.Sprint(fields[k])
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(value)
+	}
+	return buf.Bytes()
+}
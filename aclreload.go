@@ -0,0 +1,288 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/square/ghostunnel/auth"
+	"github.com/square/ghostunnel/wildcard"
+)
+
+// aclSettings maps names of server access control flags (and their hidden
+// aliases) to the flag they set. These flags are applied again when the
+// config file is reloaded.
+var aclSettings = map[string]string{
+	"allow-all":     "allow-all",
+	"allow-cn":      "allow-cn",
+	"allow-ou":      "allow-ou",
+	"allow-dns":     "allow-dns",
+	"allow-dns-san": "allow-dns",
+	"allow-ip":      "allow-ip",
+	"allow-ip-san":  "allow-ip",
+	"allow-uri":     "allow-uri",
+	"allow-uri-san": "allow-uri",
+	"deny-cn":       "deny-cn",
+	"deny-ou":       "deny-ou",
+	"deny-dns":      "deny-dns",
+	"deny-uri":      "deny-uri",
+}
+
+// aclFlags are the values of server access control flags.
+type aclFlags struct {
+	allowAll    bool
+	allowedCNs  []string
+	allowedOUs  []string
+	allowedDNSs []string
+	allowedIPs  []net.IP
+	allowedURIs []string
+	deniedCNs   []string
+	deniedOUs   []string
+	deniedDNSs  []string
+	deniedURIs  []string
+}
+
+// serverACLFlags returns the access control flags we were started with.
+func serverACLFlags() aclFlags {
+	return aclFlags{
+		allowAll:    *serverAllowAll,
+		allowedCNs:  *serverAllowedCNs,
+		allowedOUs:  *serverAllowedOUs,
+		allowedDNSs: *serverAllowedDNSs,
+		allowedIPs:  *serverAllowedIPs,
+		allowedURIs: *serverAllowedURIs,
+		deniedCNs:   *serverDeniedCNs,
+		deniedOUs:   *serverDeniedOUs,
+		deniedDNSs:  *serverDeniedDNSs,
+		deniedURIs:  *serverDeniedURIs,
+	}
+}
+
+// allowsAny returns true if at least one allow flag is set.
+func (f aclFlags) allowsAny() bool {
+	return f.allowAll || f.allowsPrincipals()
+}
+
+// allowsPrincipals returns true if at least one allow flag besides allow-all
+// is set.
+func (f aclFlags) allowsPrincipals() bool {
+	return len(f.allowedCNs) > 0 || len(f.allowedOUs) > 0 || len(f.allowedDNSs) > 0 ||
+		len(f.allowedIPs) > 0 || len(f.allowedURIs) > 0
+}
+
+// validate checks that the flags allow some clients, and that allow-all isn't
+// combined with other ways to allow clients. This applies at startup as well
+// as to settings from the config file on reload. If others is set, clients
+// can also be allowed by options that aren't reloaded (access policy file,
+// peer keys or PSK identities).
+func (f aclFlags) validate(others bool) error {
+	if !f.allowsAny() && !others {
+		return errors.New("at least one access control flag (--allow-{all,cn,ou,dns-san,ip-san,uri-san,psk-identity}, --access-policy-file, --peer-key or --disable-authentication) is required")
+	}
+	if f.allowAll && (f.allowsPrincipals() || others) {
+		return errors.New("--allow-all is mutually exclusive with other access control flags")
+	}
+	return nil
+}
+
+// withSettings returns the flags with values from a config file applied,
+// except for flags given on the command line (which take precedence). Flags
+// that aren't in the config file (or on the command line) are cleared.
+func (f aclFlags) withSettings(settings map[string]interface{}, given map[string]bool) (aclFlags, error) {
+	values := map[string][]string{}
+	for name, value := range settings {
+		flag, ok := aclSettings[name]
+		if !ok {
+			continue
+		}
+		args, err := configArgs(name, value)
+		if err != nil {
+			return f, fmt.Errorf("invalid setting '%s': %s", name, err)
+		}
+		for _, arg := range args {
+			switch {
+			case arg == "--"+name:
+				values[flag] = append(values[flag], "true")
+			case arg == "--no-"+name:
+				values[flag] = append(values[flag], "false")
+			default:
+				values[flag] = append(values[flag], arg[len("--"+name+"="):])
+			}
+		}
+	}
+
+	fromFile := func(flag string, current *[]string) {
+		if !givenFlag(flag, given) {
+			*current = values[flag]
+		}
+	}
+	fromFile("allow-cn", &f.allowedCNs)
+	fromFile("allow-ou", &f.allowedOUs)
+	fromFile("allow-dns", &f.allowedDNSs)
+	fromFile("allow-uri", &f.allowedURIs)
+	fromFile("deny-cn", &f.deniedCNs)
+	fromFile("deny-ou", &f.deniedOUs)
+	fromFile("deny-dns", &f.deniedDNSs)
+	fromFile("deny-uri", &f.deniedURIs)
+
+	if !givenFlag("allow-all", given) {
+		f.allowAll = false
+		for _, value := range values["allow-all"] {
+			f.allowAll = value == "true"
+		}
+	}
+	if !givenFlag("allow-ip", given) {
+		f.allowedIPs = nil
+		for _, value := range values["allow-ip"] {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return f, fmt.Errorf("invalid IP address '%s' in setting 'allow-ip'", value)
+			}
+			f.allowedIPs = append(f.allowedIPs, ip)
+		}
+	}
+	return f, nil
+}
+
+// givenFlag returns true if the given access control flag (or one of its
+// aliases) was given on the command line.
+func givenFlag(flag string, given map[string]bool) bool {
+	for name, target := range aclSettings {
+		if target == flag && given[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// newServerACL builds the server ACL from access control flags.
+func newServerACL(flags aclFlags) (*auth.ACL, error) {
+	allowedURIs, err := wildcard.CompileList(flags.allowedURIs)
+	if err != nil {
+		logger.Printf("invalid URI pattern in --allow-uri flag (%s)", err)
+		return nil, err
+	}
+	allowedCNs, allowedCNPatterns, err := auth.SplitPatterns(flags.allowedCNs, '.')
+	if err != nil {
+		logger.Printf("invalid CN pattern in --allow-cn flag (%s)", err)
+		return nil, err
+	}
+	allowedDNSs, allowedDNSPatterns, err := auth.SplitPatternsFold(flags.allowedDNSs, '.')
+	if err != nil {
+		logger.Printf("invalid DNS pattern in --allow-dns flag (%s)", err)
+		return nil, err
+	}
+	deniedURIs, err := wildcard.CompileList(flags.deniedURIs)
+	if err != nil {
+		logger.Printf("invalid URI pattern in --deny-uri flag (%s)", err)
+		return nil, err
+	}
+	deniedCNs, deniedCNPatterns, err := auth.SplitPatternsFold(flags.deniedCNs, '.')
+	if err != nil {
+		logger.Printf("invalid CN pattern in --deny-cn flag (%s)", err)
+		return nil, err
+	}
+	deniedDNSs, deniedDNSPatterns, err := auth.SplitPatternsFold(flags.deniedDNSs, '.')
+	if err != nil {
+		logger.Printf("invalid DNS pattern in --deny-dns flag (%s)", err)
+		return nil, err
+	}
+
+	return &auth.ACL{
+		AllowAll:           flags.allowAll,
+		AllowedCNs:         allowedCNs,
+		AllowedCNPatterns:  allowedCNPatterns,
+		AllowedOUs:         flags.allowedOUs,
+		AllowedDNSs:        allowedDNSs,
+		AllowedDNSPatterns: allowedDNSPatterns,
+		AllowedIPs:         flags.allowedIPs,
+		AllowedURIs:        allowedURIs,
+		DeniedCNs:          deniedCNs,
+		DeniedCNPatterns:   deniedCNPatterns,
+		DeniedOUs:          flags.deniedOUs,
+		DeniedDNSs:         deniedDNSs,
+		DeniedDNSPatterns:  deniedDNSPatterns,
+		DeniedURIs:         deniedURIs,
+		Logger:             logger,
+	}, nil
+}
+
+// reloadableACL is the server ACL built from access control flags. When the
+// config file is reloaded, a new ACL is built from the flags we were started
+// with and the settings in the file, and replaces the current one for new
+// connections. Connections check against either the old or the new ACL,
+// never a mix of both.
+type reloadableACL struct {
+	// Flags we were started with
+	flags aclFlags
+	// Whether clients can also be allowed by other options (access policy
+	// file or PSK identities), see aclFlags.validate
+	others bool
+	acl    atomic.Value
+}
+
+func newReloadableACL(flags aclFlags, others bool) (*reloadableACL, error) {
+	if err := flags.validate(others); err != nil {
+		return nil, err
+	}
+	acl, err := newServerACL(flags)
+	if err != nil {
+		return nil, err
+	}
+	r := &reloadableACL{flags: flags, others: others}
+	r.acl.Store(acl)
+	return r, nil
+}
+
+func (r *reloadableACL) current() *auth.ACL {
+	return r.acl.Load().(*auth.ACL)
+}
+
+// update builds a new ACL from the settings in a config file, and replaces
+// the current one. If the settings are invalid (with the same checks as for
+// flags at startup), the current ACL is kept.
+func (r *reloadableACL) update(settings map[string]interface{}, given map[string]bool) error {
+	flags, err := r.flags.withSettings(settings, given)
+	if err != nil {
+		return err
+	}
+	if err := flags.validate(r.others); err != nil {
+		return err
+	}
+	acl, err := newServerACL(flags)
+	if err != nil {
+		return err
+	}
+	r.acl.Store(acl)
+	return nil
+}
+
+// VerifyPeerCertificateServer checks a client against the current ACL, see
+// auth.ACL.VerifyPeerCertificateServer.
+func (r *reloadableACL) VerifyPeerCertificateServer(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return r.current().VerifyPeerCertificateServer(rawCerts, verifiedChains)
+}
+
+// VerifyPeerCertificateDenied checks a client against the deny flags of the
+// current ACL, see auth.ACL.VerifyPeerCertificateDenied.
+func (r *reloadableACL) VerifyPeerCertificateDenied(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return r.current().VerifyPeerCertificateDenied(rawCerts, verifiedChains)
+}
@@ -0,0 +1,120 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func verifyCN(acl *reloadableACL, cn string) error {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+	return acl.VerifyPeerCertificateServer(nil, [][]*x509.Certificate{{cert}})
+}
+
+func TestReloadableACL(t *testing.T) {
+	acl, err := newReloadableACL(aclFlags{allowedCNs: []string{"client1"}}, false)
+	assert.Nil(t, err, "should build ACL")
+	assert.Nil(t, verifyCN(acl, "client1"), "should allow client1")
+	assert.NotNil(t, verifyCN(acl, "client2"), "should not allow client2")
+
+	err = acl.update(map[string]interface{}{"allow-cn": []interface{}{"client1", "client2"}, "deny-cn": "client1"}, nil)
+	assert.Nil(t, err, "should update ACL")
+	assert.NotNil(t, verifyCN(acl, "client1"), "should deny client1 after update")
+	assert.Nil(t, verifyCN(acl, "client2"), "should allow client2 after update")
+
+	err = acl.update(map[string]interface{}{"allow-cn": "**.example.com"}, nil)
+	assert.NotNil(t, err, "should reject invalid pattern")
+	err = acl.update(map[string]interface{}{"deny-cn": "client2"}, nil)
+	assert.NotNil(t, err, "should reject settings that don't allow any client")
+	assert.Nil(t, verifyCN(acl, "client2"), "should keep current ACL if update fails")
+}
+
+func TestReloadableACLGivenFlags(t *testing.T) {
+	acl, err := newReloadableACL(aclFlags{allowedCNs: []string{"client1"}}, false)
+	assert.Nil(t, err, "should build ACL")
+
+	// Flags given on the command line take precedence over the config file
+	err = acl.update(map[string]interface{}{"allow-cn": "client2", "allow-ip-san": "127.0.0.1"}, map[string]bool{"allow-cn": true})
+	assert.Nil(t, err, "should update ACL")
+	assert.Nil(t, verifyCN(acl, "client1"), "should keep allow-cn from command line")
+	assert.NotNil(t, verifyCN(acl, "client2"), "should ignore allow-cn from config file")
+	assert.Equal(t, "127.0.0.1", acl.current().AllowedIPs[0].String(), "should apply aliases")
+
+	err = acl.update(map[string]interface{}{"allow-ip": "invalid"}, nil)
+	assert.NotNil(t, err, "should reject invalid IP")
+}
+
+func TestReloadableACLPolicy(t *testing.T) {
+	acl, err := newReloadableACL(aclFlags{allowedCNs: []string{"client1"}}, true)
+	assert.Nil(t, err, "should build ACL")
+	err = acl.update(map[string]interface{}{"allow-all": false}, nil)
+	assert.Nil(t, err, "should allow empty allow flags with a policy file")
+	assert.NotNil(t, verifyCN(acl, "client1"), "should not allow clients after update")
+	err = acl.update(map[string]interface{}{"allow-all": true}, nil)
+	assert.NotNil(t, err, "should reject allow-all with a policy file")
+}
+
+func TestReloadableACLMutuallyExclusive(t *testing.T) {
+	_, err := newReloadableACL(aclFlags{allowAll: true, allowedCNs: []string{"client1"}}, false)
+	assert.NotNil(t, err, "should reject allow-all with other allow flags")
+
+	acl, err := newReloadableACL(aclFlags{allowedCNs: []string{"client1"}}, false)
+	assert.Nil(t, err, "should build ACL")
+	err = acl.update(map[string]interface{}{"allow-all": true, "allow-cn": "client2"}, nil)
+	assert.NotNil(t, err, "should reject allow-all with other allow flags on reload")
+	err = acl.update(map[string]interface{}{"allow-all": true}, map[string]bool{"allow-cn": true})
+	assert.NotNil(t, err, "should reject allow-all from config file with allow-cn from command line")
+	assert.Nil(t, verifyCN(acl, "client1"), "should keep current ACL if update fails")
+	assert.NotNil(t, verifyCN(acl, "client2"), "should keep current ACL if update fails")
+
+	err = acl.update(map[string]interface{}{"allow-all": true}, nil)
+	assert.Nil(t, err, "should accept allow-all on its own")
+	assert.Nil(t, verifyCN(acl, "client2"), "should apply allow-all")
+}
+
+func TestConfigFileReloadACL(t *testing.T) {
+	path := writeConfigFile(t, "listen: localhost:8443\nallow-cn: [client1]\n")
+	defer os.Remove(path)
+
+	settings, err := loadConfigFile(path)
+	assert.Nil(t, err, "should load config file")
+	acl, err := newReloadableACL(aclFlags{allowedCNs: []string{"client1"}}, false)
+	assert.Nil(t, err, "should build ACL")
+	config := &configFile{path: path, settings: settings, given: map[string]bool{}, acl: acl}
+
+	ioutil.WriteFile(path, []byte("listen: localhost:9443\nallow-cn: [client2]\n"), 0600)
+	assert.Nil(t, config.Reload(), "should reload changed config file")
+	assert.Nil(t, verifyCN(acl, "client2"), "should apply allow-cn")
+	assert.NotNil(t, verifyCN(acl, "client1"), "should apply allow-cn")
+	assert.Equal(t, []string{"listen"}, changedSettings(config.settings, mustLoadConfigFile(t, path)), "should only keep unapplied settings as changed")
+
+	ioutil.WriteFile(path, []byte("listen: localhost:9443\n"), 0600)
+	assert.NotNil(t, config.Reload(), "should fail to apply settings that don't allow any client")
+	assert.Nil(t, verifyCN(acl, "client2"), "should keep current ACL")
+}
+
+func mustLoadConfigFile(t *testing.T, path string) map[string]interface{} {
+	settings, err := loadConfigFile(path)
+	assert.Nil(t, err, "should load config file")
+	return settings
+}
@@ -0,0 +1,239 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/square/ghostunnel/certloader"
+	"github.com/square/ghostunnel/proxy"
+)
+
+// adminHandler serves the admin API on the status port (if --enable-admin is
+// set), for inspecting and managing a running instance:
+//
+//	GET    /_connections     list open connections
+//	DELETE /_connections/ID  close the connection with the given ID
+//	GET    /_certificate     show details of the current certificate
+//	POST   /_reload          reload certificates and access policies
+//	POST   /_reopen-logs     reopen log files
+//
+// Requests must send the token as bearer token. Without a token, no
+// endpoints are registered, since they expose connection details and allow
+// closing connections or reloading.
+type adminHandler struct {
+	proxy       *proxy.Proxy
+	certificate func() (*tls.Certificate, error)
+	reload      func()
+	reopenLogs  func() error
+	token       []byte
+}
+
+type certificateResponse struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	URIs        []string  `json:"uris,omitempty"`
+	SHA256      string    `json:"sha256_fingerprint"`
+	ChainLength int       `json:"chain_length"`
+}
+
+func (h *adminHandler) register(mux *http.ServeMux) {
+	if len(h.token) == 0 {
+		return
+	}
+	mux.Handle("/_connections", h.authenticated(h.serveConnections))
+	mux.Handle("/_connections/", h.authenticated(h.serveCloseConnection))
+	mux.Handle("/_certificate", h.authenticated(h.serveCertificate))
+	mux.Handle("/_reload", h.authenticated(h.serveReload))
+	mux.Handle("/_reopen-logs", h.authenticated(h.serveReopenLogs))
+}
+
+// authenticated checks the bearer token on requests.
+func (h *adminHandler) authenticated(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), h.token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func (h *adminHandler) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	logger.Printf("reload requested via admin API from %s", r.RemoteAddr)
+	h.reload()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) serveReopenLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.reopenLogs(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readAdminToken reads the admin API token from a file.
+func readAdminToken(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	token := bytes.TrimSpace(data)
+	if len(token) == 0 {
+		return nil, fmt.Errorf("admin token file '%s' is empty", path)
+	}
+	return token, nil
+}
+
+func (h *adminHandler) serveConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, h.proxy.Connections())
+}
+
+func (h *adminHandler) serveCloseConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/_connections/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+	if !h.proxy.CloseConnection(id) {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	logger.Printf("closed connection %d (requested via admin API from %s)", id, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) serveCertificate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cert, err := h.certificate()
+	if err == nil && (cert == nil || len(cert.Certificate) == 0) {
+		err = errors.New("no certificate loaded")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	resp := certificateResponse{
+		Subject:     leaf.Subject.String(),
+		Issuer:      leaf.Issuer.String(),
+		Serial:      leaf.SerialNumber.String(),
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+		DNSNames:    leaf.DNSNames,
+		SHA256:      hex.EncodeToString(fingerprint[:]),
+		ChainLength: len(cert.Certificate),
+	}
+	for _, ip := range leaf.IPAddresses {
+		resp.IPAddresses = append(resp.IPAddresses, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		resp.URIs = append(resp.URIs, uri.String())
+	}
+	writeJSON(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	out, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// currentCertificate returns a function that gets the current certificate
+// from the TLS config source (the one served in server mode, or presented to
+// the server in client mode).
+func currentCertificate(source certloader.TLSConfigSource) func() (*tls.Certificate, error) {
+	return func() (*tls.Certificate, error) {
+		if source.CanServe() {
+			config, err := source.GetServerConfig(&tls.Config{})
+			if err != nil {
+				return nil, err
+			}
+			serverConfig := config.GetServerConfig()
+			if serverConfig.GetCertificate != nil {
+				return serverConfig.GetCertificate(&tls.ClientHelloInfo{})
+			}
+			if len(serverConfig.Certificates) > 0 {
+				return &serverConfig.Certificates[0], nil
+			}
+			return nil, nil
+		}
+
+		config, err := source.GetClientConfig(&tls.Config{})
+		if err != nil {
+			return nil, err
+		}
+		clientConfig := config.GetClientConfig()
+		if clientConfig.GetClientCertificate != nil {
+			return clientConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+		}
+		if len(clientConfig.Certificates) > 0 {
+			return &clientConfig.Certificates[0], nil
+		}
+		return nil, nil
+	}
+}
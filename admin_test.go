@@ -0,0 +1,189 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/ghostunnel/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdminServer(t *testing.T, certificate func() (*tls.Certificate, error)) (*httptest.Server, *proxy.Proxy) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	p := proxy.New([]net.Listener{listener}, time.Second, dummyDial, logger, 0, false)
+
+	mux := http.NewServeMux()
+	admin := &adminHandler{proxy: p, certificate: certificate, token: []byte("secret")}
+	admin.register(mux)
+	return httptest.NewServer(mux), p
+}
+
+func adminRequest(t *testing.T, method, url string) *http.Response {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err, "should make request")
+	return resp
+}
+
+func TestAdminConnections(t *testing.T) {
+	server, p := newTestAdminServer(t, nil)
+	defer server.Close()
+	defer p.Shutdown()
+
+	resp := adminRequest(t, http.MethodGet, server.URL+"/_connections")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "should list connections")
+	conns := []map[string]interface{}{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&conns), "should return JSON")
+	assert.Empty(t, conns, "should list no connections")
+
+	resp = adminRequest(t, http.MethodPost, server.URL+"/_connections")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, "should only allow GET")
+
+	for path, status := range map[string]int{"/_connections/1": http.StatusNotFound, "/_connections/foo": http.StatusBadRequest} {
+		resp = adminRequest(t, http.MethodDelete, server.URL+path)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, "unexpected status for %s", path)
+	}
+
+	resp = adminRequest(t, http.MethodGet, server.URL+"/_connections/1")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, "should only allow DELETE")
+}
+
+func TestAdminCertificate(t *testing.T) {
+	block, _ := pem.Decode([]byte(testCertificate))
+	server, p := newTestAdminServer(t, func() (*tls.Certificate, error) {
+		return &tls.Certificate{Certificate: [][]byte{block.Bytes}}, nil
+	})
+	defer server.Close()
+	defer p.Shutdown()
+
+	resp := adminRequest(t, http.MethodGet, server.URL+"/_certificate")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "should show certificate")
+	cert := certificateResponse{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&cert), "should return JSON")
+	assert.NotEmpty(t, cert.Subject, "should include subject")
+	assert.Len(t, cert.SHA256, 64, "should include fingerprint")
+	assert.Equal(t, 1, cert.ChainLength, "should include chain length")
+
+	failing, p := newTestAdminServer(t, func() (*tls.Certificate, error) {
+		return nil, errors.New("no certificate for test")
+	})
+	defer failing.Close()
+	defer p.Shutdown()
+	resp = adminRequest(t, http.MethodGet, failing.URL+"/_certificate")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "should fail without certificate")
+}
+
+func TestAdminToken(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	p := proxy.New([]net.Listener{listener}, time.Second, dummyDial, logger, 0, false)
+	defer p.Shutdown()
+
+	reloads := 0
+	mux := http.NewServeMux()
+	admin := &adminHandler{
+		proxy:      p,
+		reload:     func() { reloads++ },
+		reopenLogs: func() error { return nil },
+		token:      []byte("secret"),
+	}
+	admin.register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	request := func(method, path, token string) int {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err, "should make request")
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/_reload", ""), "should require token")
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/_reload", "wrong"), "should reject wrong token")
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/_connections", ""), "should require token for all endpoints")
+	assert.Equal(t, 0, reloads, "should not reload without token")
+
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPost, "/_reload", "secret"), "should reload with token")
+	assert.Equal(t, 1, reloads, "should reload with token")
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodGet, "/_reload", "secret"), "should only allow POST")
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPost, "/_reopen-logs", "secret"), "should reopen logs with token")
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/_connections", "secret"), "should list connections with token")
+}
+
+func TestAdminWithoutToken(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	p := proxy.New([]net.Listener{listener}, time.Second, dummyDial, logger, 0, false)
+	defer p.Shutdown()
+
+	mux := http.NewServeMux()
+	admin := &adminHandler{proxy: p, reload: func() {}}
+	admin.register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, path := range []string{"/_connections", "/_connections/1", "/_certificate", "/_reload", "/_reopen-logs"} {
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+			req, _ := http.NewRequest(method, server.URL+path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err, "should make request")
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode, "should not serve %s %s without token", method, path)
+		}
+	}
+}
+
+func TestReadAdminToken(t *testing.T) {
+	file, err := ioutil.TempFile("", "ghostunnel-token")
+	assert.Nil(t, err, "should create temp file")
+	defer os.Remove(file.Name())
+	file.WriteString("secret\n")
+	file.Close()
+
+	token, err := readAdminToken(file.Name())
+	assert.Nil(t, err, "should read token")
+	assert.Equal(t, "secret", string(token), "should trim whitespace")
+
+	ioutil.WriteFile(file.Name(), []byte("\n"), 0600)
+	_, err = readAdminToken(file.Name())
+	assert.NotNil(t, err, "should reject empty token")
+	_, err = readAdminToken("/does-not-exist")
+	assert.NotNil(t, err, "should fail for missing file")
+}
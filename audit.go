@@ -0,0 +1,332 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/ghostunnel/certloader"
+)
+
+// Hash of the entry before the first one in a new audit log.
+var auditGenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// auditLog writes a record of authentication decisions in server mode
+// (--audit-log), one JSON object per line for each connection, with the peer
+// identity, the presented certificate chain, the access rule that matched
+// and the result. Entries are hash-chained so tampering is evident: each
+// entry has the hash of the previous one (prev_hash) and its own hash
+// (hash), the hex SHA-256 of the line without the trailing hash field.
+// Entries can't be modified, removed or reordered without breaking the
+// chain, which continues across restarts and reopened (rotated) files.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	out  io.WriteCloser
+	seq  uint64
+	prev string
+	// Returns the access rule (e.g. allow-cn) that matched a client
+	// certificate (nil if none was presented), or "" if none did.
+	rule func(cert *x509.Certificate) string
+}
+
+// auditEntry is the part of an audit log line needed to continue the chain.
+type auditEntry struct {
+	Seq      uint64 `json:"seq"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// openAuditLog opens the audit log for appending, continuing the chain from
+// the last entry if the file already exists. The file is created readable
+// only by the current user.
+func openAuditLog(path string, rule func(*x509.Certificate) string) (*auditLog, error) {
+	seq, prev, err := lastAuditEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, out: file, seq: seq, prev: prev, rule: rule}, nil
+}
+
+// lastAuditEntry returns the sequence number and hash of the last entry in
+// an existing audit log, for continuing the chain.
+func lastAuditEntry(path string) (uint64, string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, auditGenesisHash, nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, "", err
+	}
+	if last == nil {
+		return 0, auditGenesisHash, nil
+	}
+
+	var entry auditEntry
+	if err := json.Unmarshal(last, &entry); err != nil || len(entry.Hash) != len(auditGenesisHash) {
+		return 0, "", fmt.Errorf("audit log %s doesn't end with a valid entry, can't continue the chain", path)
+	}
+	return entry.Seq, entry.Hash, nil
+}
+
+// Reopen reopens the audit log file, e.g. after it was moved away for log
+// rotation. The chain continues in the new file. If reopening fails, we keep
+// writing to the old file.
+func (a *auditLog) Reopen() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	old := a.out
+	a.out = file
+	a.mu.Unlock()
+	return old.Close()
+}
+
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.out.Close()
+}
+
+// Audit records the outcome of the handshake and access checks for a
+// connection (see proxy.Auditor).
+func (a *auditLog) Audit(conn net.Conn, err error) {
+	fields := map[string]interface{}{
+		"client_addr": conn.RemoteAddr().String(),
+		"listen_addr": conn.LocalAddr().String(),
+		"result":      "allow",
+	}
+	if err != nil {
+		fields["result"] = "deny"
+		fields["error"] = err.Error()
+	}
+
+	var certs []*x509.Certificate
+	if tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := tlsConn.ConnectionState()
+		certs = state.PeerCertificates
+		if state.DidResume {
+			fields["tls_resumed"] = true
+		}
+	}
+	if len(certs) == 0 {
+		// Certificates are only in the connection state after a successful
+		// handshake, otherwise use the ones we saw during verification.
+		if audited, ok := conn.(*auditedConn); ok {
+			certs = audited.peerCertificates()
+		}
+	}
+	if len(certs) > 0 {
+		cert := certs[0]
+		fields["peer_cn"] = cert.Subject.CommonName
+		if len(cert.DNSNames) > 0 {
+			fields["peer_dns_sans"] = cert.DNSNames
+		}
+		if len(cert.URIs) > 0 {
+			uris := []string{}
+			for _, uri := range cert.URIs {
+				uris = append(uris, uri.String())
+			}
+			fields["peer_uri_sans"] = uris
+		}
+		chain := []string{}
+		for _, cert := range certs {
+			sum := sha256.Sum256(cert.Raw)
+			chain = append(chain, hex.EncodeToString(sum[:]))
+		}
+		fields["peer_chain_sha256"] = chain
+	}
+
+	if psk, ok := conn.(interface{ PSKIdentity() string }); ok && psk.PSKIdentity() != "" {
+		fields["psk_identity"] = psk.PSKIdentity()
+		fields["rule"] = "allow-psk-identity"
+	} else {
+		var leaf *x509.Certificate
+		if len(certs) > 0 {
+			leaf = certs[0]
+		}
+		if rule := a.rule(leaf); rule != "" {
+			fields["rule"] = rule
+		}
+	}
+
+	if err := a.write(fields); err != nil {
+		logger.Printf("error writing audit log entry: %s", err)
+	}
+}
+
+// write appends an entry to the chain.
+func (a *auditLog) write(fields map[string]interface{}) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fields["seq"] = a.seq + 1
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	fields["prev_hash"] = a.prev
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	hash := auditHash(body)
+	line := append(body[:len(body)-1], fmt.Sprintf(`,"hash":"%s"}`+"\n", hash)...)
+	if _, err := a.out.Write(line); err != nil {
+		return err
+	}
+	a.seq++
+	a.prev = hash
+	return nil
+}
+
+func auditHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyAuditChain checks that entries in an audit log are intact and
+// chained, starting from the first entry of a new log.
+func verifyAuditChain(r io.Reader) error {
+	prev := auditGenesisHash
+	seq := uint64(0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var entry auditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("invalid entry after seq %d: %s", seq, err)
+		}
+		suffix := fmt.Sprintf(`,"hash":"%s"}`, entry.Hash)
+		if !strings.HasSuffix(string(line), suffix) {
+			return fmt.Errorf("entry %d: hash must be the last field", entry.Seq)
+		}
+		body := append([]byte(strings.TrimSuffix(string(line), suffix)), '}')
+		if auditHash(body) != entry.Hash {
+			return fmt.Errorf("entry %d: hash doesn't match contents", entry.Seq)
+		}
+		if entry.Seq != seq+1 || entry.PrevHash != prev {
+			return fmt.Errorf("entry %d: doesn't follow entry %d", entry.Seq, seq)
+		}
+		seq, prev = entry.Seq, entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if seq == 0 {
+		return errors.New("no entries")
+	}
+	return nil
+}
+
+// auditListener accepts TLS connections like certloader.Listener, but keeps
+// the certificates presented by clients during verification, so failed
+// handshakes can be audited with the chain that was rejected.
+type auditListener struct {
+	net.Listener
+	config certloader.TLSServerConfig
+}
+
+func (l *auditListener) Accept() (net.Conn, error) {
+	raw, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn := &auditedConn{}
+	config := conn.capture(l.config.GetServerConfig())
+	if getConfigForClient := config.GetConfigForClient; getConfigForClient != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			forClient, err := getConfigForClient(hello)
+			if err != nil || forClient == nil {
+				return forClient, err
+			}
+			return conn.capture(forClient), nil
+		}
+	}
+	conn.Conn = tls.Server(raw, config)
+	return conn, nil
+}
+
+// auditedConn is a TLS connection from an auditListener.
+type auditedConn struct {
+	*tls.Conn
+	mu       sync.Mutex
+	rawCerts [][]byte
+}
+
+// capture returns a copy of the config which keeps the certificates passed
+// to VerifyPeerCertificate. Chains rejected by crypto/tls itself (e.g.
+// signed by an unknown CA) are never passed to it, so they aren't captured.
+func (c *auditedConn) capture(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	verify := config.VerifyPeerCertificate
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		c.mu.Lock()
+		c.rawCerts = rawCerts
+		c.mu.Unlock()
+		if verify != nil {
+			return verify(rawCerts, chains)
+		}
+		return nil
+	}
+	return config
+}
+
+func (c *auditedConn) peerCertificates() []*x509.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	certs := []*x509.Certificate{}
+	for _, raw := range c.rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
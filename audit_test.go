@@ -0,0 +1,132 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAuditEntries(t *testing.T, path string) []map[string]interface{} {
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err, "should read audit log")
+	entries := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		entry := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry), "should be JSON")
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rule := func(cert *x509.Certificate) string {
+		if cert == nil {
+			return ""
+		}
+		return "allow-cn"
+	}
+	audit, err := openAuditLog(path, rule)
+	assert.Nil(t, err, "should open audit log")
+
+	serverCert, _ := newTestProbeCertificate(t, time.Now().Add(time.Hour))()
+	allowedCert, _ := newTestProbeCertificate(t, time.Now().Add(time.Hour))()
+	deniedCert, _ := newTestProbeCertificate(t, time.Now().Add(time.Hour))()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if bytes.Equal(rawCerts[0], deniedCert.Certificate[0]) {
+				return errors.New("access denied")
+			}
+			return nil
+		},
+	}
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	listener := &auditListener{Listener: raw, config: staticServerConfig{config}}
+	defer listener.Close()
+
+	for _, cert := range []*tls.Certificate{allowedCert, deniedCert} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			conn, err := listener.Accept()
+			assert.Nil(t, err, "should accept")
+			defer conn.Close()
+			audit.Audit(conn, conn.(*auditedConn).Handshake())
+		}()
+		client, err := tls.Dial("tcp", raw.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{*cert},
+		})
+		assert.Nil(t, err, "should connect")
+		<-done
+		client.Close()
+	}
+
+	entries := readAuditEntries(t, path)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "allow", entries[0]["result"])
+	assert.Equal(t, "allow-cn", entries[0]["rule"])
+	assert.Equal(t, "deny", entries[1]["result"])
+	assert.Contains(t, entries[1]["error"], "access denied")
+	sum := sha256.Sum256(deniedCert.Certificate[0])
+	assert.Equal(t, []interface{}{hex.EncodeToString(sum[:])}, entries[1]["peer_chain_sha256"], "should record rejected chain")
+
+	// The chain continues after reopening the file
+	assert.Nil(t, audit.Close(), "should close audit log")
+	audit, err = openAuditLog(path, rule)
+	assert.Nil(t, err, "should reopen audit log")
+	assert.Nil(t, audit.write(map[string]interface{}{"result": "allow"}), "should write entry")
+	assert.Nil(t, audit.Close(), "should close audit log")
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err, "should read audit log")
+	assert.Nil(t, verifyAuditChain(bytes.NewReader(data)), "chain should be intact")
+	assert.Equal(t, float64(3), readAuditEntries(t, path)[2]["seq"])
+
+	lines := strings.SplitAfter(string(data), "\n")
+	tampered := strings.Replace(lines[1], `"result":"deny"`, `"result":"allow"`, 1)
+	assert.NotNil(t, verifyAuditChain(strings.NewReader(lines[0]+tampered+lines[2])), "should detect modified entry")
+	assert.NotNil(t, verifyAuditChain(strings.NewReader(lines[0]+lines[2])), "should detect removed entry")
+	assert.NotNil(t, verifyAuditChain(strings.NewReader(lines[1]+lines[0]+lines[2])), "should detect reordered entries")
+}
+
+func TestOpenAuditLogInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("not an audit log\n"), 0600))
+	_, err := openAuditLog(path, func(*x509.Certificate) string { return "" })
+	assert.NotNil(t, err, "should not continue chain from invalid entry")
+
+	_, err = openAuditLog(filepath.Join(path, "missing", "audit.log"), func(*x509.Certificate) string { return "" })
+	assert.NotNil(t, err, "should fail to open file in missing directory")
+}
@@ -19,8 +19,10 @@ package auth
 import (
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
+	"strings"
 
 	"github.com/square/ghostunnel/wildcard"
 )
@@ -40,22 +42,48 @@ type ACL struct {
 	// AllowCNs lists common names that should be allowed access. If a principal
 	// has a valid certificate with at least one of these CNs, we grant access.
 	AllowedCNs []string
+	// AllowedCNPatterns lists wildcard patterns for common names that should
+	// be allowed access, see SplitPatterns.
+	AllowedCNPatterns []wildcard.Matcher
 	// AllowOUs lists organizational units that should be allowed access. If a
 	// principal has a valid certificate with at least one of these OUs, we grant
 	// access.
 	AllowedOUs []string
 	// AllowDNSs lists DNS SANs that should be allowed access. If a principal
 	// has a valid certificate with at least one of these DNS SANs, we grant
-	// access.
+	// access. DNS names are compared ignoring case.
 	AllowedDNSs []string
+	// AllowedDNSPatterns lists wildcard patterns for DNS SANs that should be
+	// allowed access, see SplitPatternsFold (must be lowercase).
+	AllowedDNSPatterns []wildcard.Matcher
 	// AllowIPs lists IP SANs that should be allowed access. If a principal
 	// has a valid certificate with at least one of these IP SANs, we grant
 	// access.
 	AllowedIPs []net.IP
+	// AllowIPNets lists IP ranges that should be allowed access. If a
+	// principal has a valid certificate with at least one IP SAN in one of
+	// these ranges, we grant access.
+	AllowedIPNets []*net.IPNet
 	// AllowURIs lists URI SANs that should be allowed access. If a principal
 	// has a valid certificate with at least one of these URI SANs, we grant
 	// access.
 	AllowedURIs []wildcard.Matcher
+	// DeniedCNs, DeniedOUs, DeniedDNSs and DeniedURIs (and the pattern
+	// variants) list principals that should be denied access. They take
+	// precedence over all allow options, including AllowAll: if a principal
+	// matches at least one of them, access is denied. Deny options only apply
+	// on the server side. Denied CNs and DNS names are compared ignoring
+	// case, so patterns must be lowercase (see SplitPatternsFold).
+	DeniedCNs         []string
+	DeniedCNPatterns  []wildcard.Matcher
+	DeniedOUs         []string
+	DeniedDNSs        []string
+	DeniedDNSPatterns []wildcard.Matcher
+	DeniedURIs        []wildcard.Matcher
+	// AllowedPSKIdentities lists identities of pre-shared keys that should be
+	// allowed access, for DTLS sessions authenticated with PSKs (see
+	// VerifyPSKIdentity).
+	AllowedPSKIdentities []string
 	// Logger is used to log authorization decisions.
 	Logger Logger
 }
@@ -69,39 +97,99 @@ func (a ACL) VerifyPeerCertificateServer(rawCerts [][]byte, verifiedChains [][]*
 		return errors.New("unauthorized: invalid principal, or principal not allowed")
 	}
 
-	// If --allow-all has been set, a valid cert is sufficient to connect.
-	if a.AllowAll {
+	cert := verifiedChains[0][0]
+
+	// Deny rules take precedence over everything else.
+	if err := a.denied(cert); err != nil {
+		return err
+	}
+	if a.allowedBy(cert) != "" {
 		return nil
 	}
 
-	cert := verifiedChains[0][0]
+	return errors.New("unauthorized: invalid principal, or principal not allowed")
+}
 
-	// Check CN against --allow-cn flag(s).
-	if contains(a.AllowedCNs, cert.Subject.CommonName) {
-		return nil
+// MatchedRule returns the option of the ACL that decides access for the given
+// certificate in server mode, named like the corresponding flag (e.g.
+// "deny-ou" or "allow-cn"), for audit logs. Returns an empty string if no
+// option matches.
+func (a ACL) MatchedRule(cert *x509.Certificate) string {
+	if rule := a.deniedBy(cert); rule != "" {
+		return rule
 	}
+	return a.allowedBy(cert)
+}
 
+// allowedBy returns the first allow option the certificate matches.
+func (a ACL) allowedBy(cert *x509.Certificate) string {
+	switch {
+	// If --allow-all has been set, a valid cert is sufficient to connect.
+	case a.AllowAll:
+		return "allow-all"
+	// Check CN against --allow-cn flag(s).
+	case contains(a.AllowedCNs, cert.Subject.CommonName) || matchesAny(a.AllowedCNPatterns, cert.Subject.CommonName):
+		return "allow-cn"
 	// Check OUs against --allow-ou flag(s).
-	if intersects(a.AllowedOUs, cert.Subject.OrganizationalUnit) {
-		return nil
+	case intersects(a.AllowedOUs, cert.Subject.OrganizationalUnit):
+		return "allow-ou"
+	// Check DNS SANs against --allow-dns-san flag(s).
+	case intersectsFold(a.AllowedDNSs, cert.DNSNames) || intersectsPatternFold(a.AllowedDNSPatterns, cert.DNSNames):
+		return "allow-dns"
+	// Check IP SANs against --allow-ip-san flag(s) and allowed IP ranges.
+	case intersectsIP(a.AllowedIPs, cert.IPAddresses) || intersectsIPNet(a.AllowedIPNets, cert.IPAddresses):
+		return "allow-ip"
+	// Check URI SANs against --allow-uri-san flag(s).
+	case intersectsURI(a.AllowedURIs, cert.URIs):
+		return "allow-uri"
 	}
+	return ""
+}
 
-	// Check DNS SANs against --allow-dns-san flag(s).
-	if intersects(a.AllowedDNSs, cert.DNSNames) {
+// VerifyPeerCertificateDenied is an implementation of VerifyPeerCertificate
+// for crypto/tls.Config that only checks the deny options of the ACL, and
+// rejects principals matching them. This is useful to enforce deny options
+// when allow decisions are combined from multiple sources.
+func (a ACL) VerifyPeerCertificateDenied(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
 		return nil
 	}
+	return a.denied(verifiedChains[0][0])
+}
 
-	// Check IP SANs against --allow-dns-san flag(s).
-	if intersectsIP(a.AllowedIPs, cert.IPAddresses) {
-		return nil
+// denied returns an error if the certificate matches a deny option.
+func (a ACL) denied(cert *x509.Certificate) error {
+	if a.deniedBy(cert) != "" {
+		return errors.New("unauthorized: principal explicitly denied")
 	}
+	return nil
+}
 
-	// Check URI SANs against --allow-uri-san flag(s).
-	if intersectsURI(a.AllowedURIs, cert.URIs) {
-		return nil
+// deniedBy returns the first deny option the certificate matches.
+func (a ACL) deniedBy(cert *x509.Certificate) string {
+	// Check against --deny-cn, --deny-ou, --deny-dns and --deny-uri flag(s).
+	switch {
+	case containsFold(a.DeniedCNs, cert.Subject.CommonName) || matchesAny(a.DeniedCNPatterns, strings.ToLower(cert.Subject.CommonName)):
+		return "deny-cn"
+	case intersects(a.DeniedOUs, cert.Subject.OrganizationalUnit):
+		return "deny-ou"
+	case intersectsFold(a.DeniedDNSs, cert.DNSNames) || intersectsPatternFold(a.DeniedDNSPatterns, cert.DNSNames):
+		return "deny-dns"
+	case intersectsURI(a.DeniedURIs, cert.URIs):
+		return "deny-uri"
 	}
+	return ""
+}
 
-	return errors.New("unauthorized: invalid principal, or principal not allowed")
+// VerifyPSKIdentity checks the identity of the pre-shared key a client
+// authenticated with against AllowAll and AllowedPSKIdentities. Other options
+// only apply to certificates, if none of the two is set no clients will be
+// allowed (fails closed).
+func (a ACL) VerifyPSKIdentity(identity string) error {
+	if a.AllowAll || contains(a.AllowedPSKIdentities, identity) {
+		return nil
+	}
+	return errors.New("unauthorized: PSK identity not allowed")
 }
 
 // VerifyPeerCertificateClient is an implementation of VerifyPeerCertificate
@@ -116,14 +204,14 @@ func (a ACL) VerifyPeerCertificateClient(rawCerts [][]byte, verifiedChains [][]*
 
 	// If the ACL is empty, only hostname verification is performed. The hostname
 	// verification happens in crypto/tls itself, so we can skip our checks here.
-	if len(a.AllowedCNs) == 0 && len(a.AllowedOUs) == 0 && len(a.AllowedDNSs) == 0 && len(a.AllowedURIs) == 0 && len(a.AllowedIPs) == 0 {
+	if len(a.AllowedCNs) == 0 && len(a.AllowedCNPatterns) == 0 && len(a.AllowedOUs) == 0 && len(a.AllowedDNSs) == 0 && len(a.AllowedDNSPatterns) == 0 && len(a.AllowedURIs) == 0 && len(a.AllowedIPs) == 0 {
 		return nil
 	}
 
 	cert := verifiedChains[0][0]
 
 	// Check CN against --verify-cn flag(s).
-	if contains(a.AllowedCNs, cert.Subject.CommonName) {
+	if contains(a.AllowedCNs, cert.Subject.CommonName) || matchesAny(a.AllowedCNPatterns, cert.Subject.CommonName) {
 		return nil
 	}
 
@@ -133,7 +221,7 @@ func (a ACL) VerifyPeerCertificateClient(rawCerts [][]byte, verifiedChains [][]*
 	}
 
 	// Check DNS SANs against --verify-dns-san flag(s).
-	if intersects(a.AllowedDNSs, cert.DNSNames) {
+	if intersectsFold(a.AllowedDNSs, cert.DNSNames) || intersectsPatternFold(a.AllowedDNSPatterns, cert.DNSNames) {
 		return nil
 	}
 
@@ -150,6 +238,38 @@ func (a ACL) VerifyPeerCertificateClient(rawCerts [][]byte, verifiedChains [][]*
 	return errors.New("unauthorized: invalid principal, or principal not allowed")
 }
 
+// SplitPatterns splits a list of values into exact values, and wildcard
+// patterns (values containing '*'). Patterns are compiled with the given
+// separator, e.g. '.' for DNS names: "*.example.com" matches "foo.example.com"
+// but not "example.com" or "foo.bar.example.com". See the wildcard package
+// for details.
+func SplitPatterns(values []string, separator rune) ([]string, []wildcard.Matcher, error) {
+	exact := []string{}
+	patterns := []wildcard.Matcher{}
+	for _, value := range values {
+		if !strings.Contains(value, "*") {
+			exact = append(exact, value)
+			continue
+		}
+		pattern, err := wildcard.CompileWithSeparator(value, separator)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid pattern '%s': %s", value, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return exact, patterns, nil
+}
+
+// SplitPatternsFold is like SplitPatterns, but lowercases values first, for
+// options that are matched ignoring case (DNS names, and denied CNs).
+func SplitPatternsFold(values []string, separator rune) ([]string, []wildcard.Matcher, error) {
+	lower := make([]string, len(values))
+	for i, value := range values {
+		lower[i] = strings.ToLower(value)
+	}
+	return SplitPatterns(lower, separator)
+}
+
 // Returns true if item is contained in set.
 func contains(set []string, item string) bool {
 	for _, c := range set {
@@ -170,6 +290,27 @@ func intersects(left, right []string) bool {
 	return false
 }
 
+// Returns true if set contains item, ignoring case.
+func containsFold(set []string, item string) bool {
+	for _, c := range set {
+		if strings.EqualFold(c, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if at least one item from left is also contained in right,
+// ignoring case.
+func intersectsFold(left, right []string) bool {
+	for _, item := range left {
+		if containsFold(right, item) {
+			return true
+		}
+	}
+	return false
+}
+
 // Returns true if at least one item from left is also contained in right.
 func intersectsIP(left, right []net.IP) bool {
 	for _, l := range left {
@@ -182,6 +323,18 @@ func intersectsIP(left, right []net.IP) bool {
 	return false
 }
 
+// Returns true if at least one IP from right is contained in a range from left.
+func intersectsIPNet(left []*net.IPNet, right []net.IP) bool {
+	for _, l := range left {
+		for _, r := range right {
+			if l.Contains(r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Returns true if at least one item from left is also contained in right.
 func intersectsURI(left []wildcard.Matcher, right []*url.URL) bool {
 	for _, l := range left {
@@ -193,3 +346,24 @@ func intersectsURI(left []wildcard.Matcher, right []*url.URL) bool {
 	}
 	return false
 }
+
+// Returns true if item matches at least one pattern.
+func matchesAny(patterns []wildcard.Matcher, item string) bool {
+	for _, pattern := range patterns {
+		if pattern.Matches(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if at least one item from right matches a pattern from left,
+// ignoring case (patterns must be lowercase).
+func intersectsPatternFold(left []wildcard.Matcher, right []string) bool {
+	for _, item := range right {
+		if matchesAny(left, strings.ToLower(item)) {
+			return true
+		}
+	}
+	return false
+}
@@ -212,3 +212,141 @@ func TestVerifyNoVerifiedChains(t *testing.T) {
 
 	assert.NotNil(t, testACL.VerifyPeerCertificateClient(nil, nil), "should reject if no verified chains")
 }
+
+var fakeHierarchicalChains = [][]*x509.Certificate{
+	{
+		{
+			Subject:  pkix.Name{CommonName: "frontend.prod.example.com"},
+			DNSNames: []string{"web.internal.example.com"},
+		},
+	},
+}
+
+func TestAuthorizeAllowPatterns(t *testing.T) {
+	cns, cnPatterns, err := SplitPatterns([]string{"gopher", "*.prod.example.com"}, '.')
+	assert.Nil(t, err, "should compile CN patterns")
+	assert.Equal(t, []string{"gopher"}, cns, "should keep exact values")
+	assert.Len(t, cnPatterns, 1, "should compile patterns")
+
+	testACL := ACL{AllowedCNPatterns: cnPatterns}
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, fakeHierarchicalChains), "allow-cn pattern should allow clients with matching CN")
+	assert.Nil(t, testACL.VerifyPeerCertificateClient(nil, fakeHierarchicalChains), "verify-cn pattern should allow servers with matching CN")
+
+	_, dnsPatterns, err := SplitPatterns([]string{"*.internal.example.com"}, '.')
+	assert.Nil(t, err, "should compile DNS patterns")
+	testACL = ACL{AllowedDNSPatterns: dnsPatterns}
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, fakeHierarchicalChains), "allow-dns pattern should allow clients with matching DNS SAN")
+	assert.Nil(t, testACL.VerifyPeerCertificateClient(nil, fakeHierarchicalChains), "verify-dns pattern should allow servers with matching DNS SAN")
+}
+
+func TestAuthorizeRejectPatterns(t *testing.T) {
+	// '*' matches exactly one label
+	_, patterns, err := SplitPatterns([]string{"*.example.com"}, '.')
+	assert.Nil(t, err, "should compile patterns")
+
+	testACL := ACL{AllowedCNPatterns: patterns, AllowedDNSPatterns: patterns}
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, fakeHierarchicalChains), "should reject cert w/o matching CN/DNS SAN")
+	assert.NotNil(t, testACL.VerifyPeerCertificateClient(nil, fakeHierarchicalChains), "should reject cert w/o matching CN/DNS SAN")
+
+	_, _, err = SplitPatterns([]string{"web-*.example.com"}, '.')
+	assert.NotNil(t, err, "should reject wildcard within label")
+}
+
+func TestAuthorizeDenyTakesPrecedence(t *testing.T) {
+	for _, testACL := range []ACL{
+		{AllowAll: true, DeniedCNs: []string{"gopher"}},
+		{AllowedOUs: []string{"circle"}, DeniedOUs: []string{"triangle"}},
+		{AllowedCNs: []string{"gopher"}, DeniedDNSs: []string{"circle"}},
+		{AllowedCNs: []string{"gopher"}, DeniedURIs: []wildcard.Matcher{wildcard.MustCompile("scheme://valid/*")}},
+	} {
+		assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, fakeChains), "deny rules should take precedence over allow rules")
+		assert.NotNil(t, testACL.VerifyPeerCertificateDenied(nil, fakeChains), "deny rules should reject matching cert")
+	}
+
+	_, patterns, err := SplitPatterns([]string{"*.prod.example.com"}, '.')
+	assert.Nil(t, err, "should compile patterns")
+	testACL := ACL{AllowAll: true, DeniedCNPatterns: patterns}
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, fakeHierarchicalChains), "deny-cn pattern should reject matching cert")
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, fakeChains), "deny-cn pattern should not reject other certs")
+}
+
+func TestAuthorizeIgnoresCase(t *testing.T) {
+	mixedCase := [][]*x509.Certificate{
+		{
+			{
+				Subject:  pkix.Name{CommonName: "Frontend.Prod.Example.com"},
+				DNSNames: []string{"Web.Internal.EXAMPLE.com"},
+			},
+		},
+	}
+
+	dnss, dnsPatterns, err := SplitPatternsFold([]string{"WEB.internal.example.com", "*.Internal.Example.COM"}, '.')
+	assert.Nil(t, err, "should compile DNS patterns")
+	for _, testACL := range []ACL{
+		{AllowAll: true, DeniedDNSs: dnss},
+		{AllowAll: true, DeniedDNSPatterns: dnsPatterns},
+		{AllowAll: true, DeniedCNs: []string{"frontend.prod.example.com"}},
+	} {
+		assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, mixedCase), "deny rules should match regardless of case")
+		assert.NotNil(t, testACL.VerifyPeerCertificateDenied(nil, mixedCase), "deny rules should match regardless of case")
+	}
+
+	_, cnPatterns, err := SplitPatternsFold([]string{"*.PROD.example.com"}, '.')
+	assert.Nil(t, err, "should compile CN patterns")
+	testACL := ACL{AllowAll: true, DeniedCNPatterns: cnPatterns}
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, mixedCase), "deny-cn pattern should match regardless of case")
+
+	for _, testACL := range []ACL{
+		{AllowedDNSs: dnss},
+		{AllowedDNSPatterns: dnsPatterns},
+	} {
+		assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, mixedCase), "allow-dns should match regardless of case")
+		assert.Nil(t, testACL.VerifyPeerCertificateClient(nil, mixedCase), "verify-dns should match regardless of case")
+	}
+}
+
+func TestAuthorizeDenyNoMatch(t *testing.T) {
+	testACL := ACL{
+		AllowAll:   true,
+		DeniedCNs:  []string{"test"},
+		DeniedOUs:  []string{"test"},
+		DeniedDNSs: []string{"test"},
+		DeniedURIs: []wildcard.Matcher{wildcard.MustCompile("scheme://invalid/path")},
+	}
+
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, fakeChains), "should allow cert not matching deny rules")
+	assert.Nil(t, testACL.VerifyPeerCertificateDenied(nil, fakeChains), "should allow cert not matching deny rules")
+	assert.Nil(t, testACL.VerifyPeerCertificateDenied(nil, nil), "should ignore empty chains")
+}
+
+func TestVerifyPSKIdentity(t *testing.T) {
+	testACL := ACL{
+		AllowedCNs:           []string{"gopher"},
+		AllowedPSKIdentities: []string{"sensor-1"},
+	}
+	assert.Nil(t, testACL.VerifyPSKIdentity("sensor-1"), "should allow listed PSK identity")
+	assert.NotNil(t, testACL.VerifyPSKIdentity("sensor-2"), "should reject other PSK identity")
+	assert.NotNil(t, testACL.VerifyPSKIdentity("gopher"), "should not check PSK identities against CNs")
+
+	testACL = ACL{AllowAll: true}
+	assert.Nil(t, testACL.VerifyPSKIdentity("sensor-2"), "allow-all should allow any PSK identity")
+}
+
+func TestMatchedRule(t *testing.T) {
+	cert := fakeChains[0][0]
+	for expected, testACL := range map[string]ACL{
+		"allow-all": {AllowAll: true},
+		"allow-cn":  {AllowedCNs: []string{"gopher"}, AllowedOUs: []string{"circle"}},
+		"allow-ou":  {AllowedCNs: []string{"test"}, AllowedOUs: []string{"circle"}},
+		"allow-dns": {AllowedDNSs: []string{"circle"}},
+		"allow-ip":  {AllowedIPs: []net.IP{net.IPv4(192, 168, 99, 100)}},
+		"allow-uri": {AllowedURIs: []wildcard.Matcher{wildcard.MustCompile("scheme://valid/path")}},
+		"deny-cn":   {AllowAll: true, DeniedCNs: []string{"gopher"}},
+		"deny-ou":   {AllowedCNs: []string{"gopher"}, DeniedOUs: []string{"triangle"}},
+		"deny-dns":  {AllowedCNs: []string{"gopher"}, DeniedDNSs: []string{"circle"}},
+		"deny-uri":  {AllowedCNs: []string{"gopher"}, DeniedURIs: []wildcard.Matcher{wildcard.MustCompile("scheme://valid/*")}},
+		"":          {AllowedCNs: []string{"test"}},
+	} {
+		assert.Equal(t, expected, testACL.MatchedRule(cert))
+	}
+}
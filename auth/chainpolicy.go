@@ -0,0 +1,209 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ExtKeyUsages maps names of extended key usages (as used in OpenSSL
+// configs) for ChainPolicy.RequiredEKUs.
+var ExtKeyUsages = map[string]x509.ExtKeyUsage{
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"OCSPSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// ChainPolicy enforces stricter rules on verified certificate chains than
+// the Go verifier does. A peer is accepted if at least one of its verified
+// chains satisfies all rules.
+type ChainPolicy struct {
+	// RequiredEKUs lists extended key usages that the peer certificate must
+	// explicitly include. The Go verifier also accepts certificates without
+	// extended key usages, or with "any".
+	RequiredEKUs []x509.ExtKeyUsage
+	// MaxChainDepth limits the number of intermediate CA certificates between
+	// the peer certificate and the root, like verify_depth in OpenSSL: zero
+	// means the peer certificate must be issued by a root directly. Negative
+	// means no limit.
+	MaxChainDepth int
+	// EnforceNameConstraints checks DNS name constraints of CA certificates
+	// against the common name of the peer certificate, in addition to its
+	// subject alternative names. The Go verifier only checks SANs, so a CA
+	// constrained to a domain could otherwise issue certificates with any
+	// common name. Common names that aren't DNS names are rejected if a CA
+	// in the chain has DNS name constraints. DNS and IP SANs are checked
+	// again as well.
+	EnforceNameConstraints bool
+}
+
+// VerifyPeerCertificate is an implementation of VerifyPeerCertificate for
+// crypto/tls.Config, which checks verified chains against the policy.
+func (p ChainPolicy) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return errors.New("unauthorized: no verified certificate chain")
+	}
+	var err error
+	for _, chain := range verifiedChains {
+		if err = p.check(chain); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("unauthorized: certificate chain not allowed by policy: %s", err)
+}
+
+func (p ChainPolicy) check(chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return errors.New("empty chain")
+	}
+	leaf := chain[0]
+
+	for _, required := range p.RequiredEKUs {
+		if !hasExtKeyUsage(leaf, required) {
+			return errors.New("peer certificate is missing a required extended key usage")
+		}
+	}
+
+	if intermediates := len(chain) - 2; p.MaxChainDepth >= 0 && intermediates > p.MaxChainDepth {
+		return fmt.Errorf("chain has %d intermediate certificates, at most %d allowed", intermediates, p.MaxChainDepth)
+	}
+
+	if p.EnforceNameConstraints {
+		for _, ca := range chain[1:] {
+			if err := checkNameConstraints(ca, leaf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNameConstraints checks the names of the leaf certificate against the
+// DNS and IP name constraints of the given CA certificate.
+func checkNameConstraints(ca, leaf *x509.Certificate) error {
+	if len(ca.PermittedDNSDomains) > 0 || len(ca.ExcludedDNSDomains) > 0 {
+		names := append([]string{}, leaf.DNSNames...)
+		if cn := leaf.Subject.CommonName; cn != "" {
+			if !isDNSName(cn) {
+				return fmt.Errorf("common name '%s' is not a DNS name, but CA '%s' has DNS name constraints", cn, ca.Subject.CommonName)
+			}
+			names = append(names, cn)
+		}
+		for _, name := range names {
+			if !dnsNameAllowed(name, ca.PermittedDNSDomains, ca.ExcludedDNSDomains) {
+				return fmt.Errorf("name '%s' is not allowed by name constraints of CA '%s'", name, ca.Subject.CommonName)
+			}
+		}
+	}
+
+	if len(ca.PermittedIPRanges) > 0 || len(ca.ExcludedIPRanges) > 0 {
+		for _, ip := range leaf.IPAddresses {
+			if !ipAllowed(ip, ca.PermittedIPRanges, ca.ExcludedIPRanges) {
+				return fmt.Errorf("IP address '%s' is not allowed by name constraints of CA '%s'", ip, ca.Subject.CommonName)
+			}
+		}
+	}
+	return nil
+}
+
+// isDNSName returns true if the name consists of labels of letters, digits,
+// hyphens and underscores (a leading wildcard label is allowed).
+func isDNSName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// dnsNameAllowed checks a DNS name against permitted and excluded domains
+// (RFC 5280, section 4.2.1.10): it must match at least one permitted domain
+// (if any) and none of the excluded ones.
+func dnsNameAllowed(name string, permitted, excluded []string) bool {
+	for _, domain := range excluded {
+		if matchDomainConstraint(name, domain) {
+			return false
+		}
+	}
+	if len(permitted) == 0 {
+		return true
+	}
+	for _, domain := range permitted {
+		if matchDomainConstraint(name, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomainConstraint returns true if the name is within the domain of the
+// constraint. Like the Go verifier, a constraint with a leading period only
+// matches subdomains, otherwise it matches the domain and its subdomains.
+func matchDomainConstraint(name, constraint string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	constraint = strings.ToLower(constraint)
+	if constraint == "" {
+		return true
+	}
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+func ipAllowed(ip net.IP, permitted, excluded []*net.IPNet) bool {
+	for _, network := range excluded {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(permitted) == 0 {
+		return true
+	}
+	for _, network := range permitted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPolicyChain(leaf *x509.Certificate, cas ...*x509.Certificate) [][]*x509.Certificate {
+	return [][]*x509.Certificate{append([]*x509.Certificate{leaf}, cas...)}
+}
+
+func TestChainPolicyNotVerified(t *testing.T) {
+	policy := ChainPolicy{MaxChainDepth: -1}
+	assert.NotNil(t, policy.VerifyPeerCertificate(nil, nil), "conn w/o verified chain should be rejected")
+}
+
+func TestChainPolicyRequiredEKUs(t *testing.T) {
+	policy := ChainPolicy{RequiredEKUs: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, MaxChainDepth: -1}
+	root := &x509.Certificate{Subject: pkix.Name{CommonName: "root"}}
+
+	client := &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}}
+	assert.Nil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(client, root)), "should allow cert with required EKU")
+
+	server := &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	assert.NotNil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(server, root)), "should reject cert without required EKU")
+
+	anyEKU := &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+	assert.NotNil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(anyEKU, root)), "should reject cert with any EKU")
+
+	assert.NotNil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(&x509.Certificate{}, root)), "should reject cert without EKUs")
+}
+
+func TestChainPolicyMaxChainDepth(t *testing.T) {
+	leaf := &x509.Certificate{}
+	intermediate := &x509.Certificate{Subject: pkix.Name{CommonName: "intermediate"}}
+	root := &x509.Certificate{Subject: pkix.Name{CommonName: "root"}}
+
+	policy := ChainPolicy{MaxChainDepth: 0}
+	assert.Nil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, root)), "should allow cert issued by root")
+	assert.NotNil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, intermediate, root)), "should reject chain with too many intermediates")
+
+	policy = ChainPolicy{MaxChainDepth: 1}
+	assert.Nil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, intermediate, root)), "should allow chain with one intermediate")
+
+	// Accepted if any of the chains is allowed
+	chains := append(testPolicyChain(leaf, intermediate, intermediate, root), testPolicyChain(leaf, root)...)
+	assert.Nil(t, policy.VerifyPeerCertificate(nil, chains), "should allow if one of the chains is allowed")
+
+	policy = ChainPolicy{MaxChainDepth: -1}
+	assert.Nil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, intermediate, intermediate, root)), "negative depth should not limit chains")
+}
+
+func TestChainPolicyNameConstraints(t *testing.T) {
+	policy := ChainPolicy{MaxChainDepth: -1, EnforceNameConstraints: true}
+	root := &x509.Certificate{Subject: pkix.Name{CommonName: "root"}}
+	ca := &x509.Certificate{
+		Subject:             pkix.Name{CommonName: "constrained"},
+		PermittedDNSDomains: []string{"example.com"},
+		ExcludedDNSDomains:  []string{"internal.example.com"},
+	}
+
+	for _, cn := range []string{"example.com", "gopher.example.com", "*.example.com", "GOPHER.EXAMPLE.COM"} {
+		leaf := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		assert.Nil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, ca, root)), "should allow CN '%s' in permitted domain", cn)
+	}
+	for _, cn := range []string{"gopher.example.org", "notexample.com", "db.internal.example.com", "gopher", "gopher!"} {
+		leaf := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		assert.NotNil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, ca, root)), "should reject CN '%s'", cn)
+	}
+
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: "gopher.example.com"}, DNSNames: []string{"gopher.example.org"}}
+	assert.NotNil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, ca, root)), "should reject DNS SAN outside permitted domain")
+
+	// Leading period only matches subdomains
+	ca.PermittedDNSDomains = []string{".example.com"}
+	ca.ExcludedDNSDomains = nil
+	leaf = &x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}}
+	assert.NotNil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, ca, root)), "should reject domain itself with leading period constraint")
+
+	// CNs are not checked without DNS name constraints
+	leaf = &x509.Certificate{Subject: pkix.Name{CommonName: "gopher!"}}
+	assert.Nil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, root)), "should allow any CN without name constraints")
+
+	policy.EnforceNameConstraints = false
+	leaf = &x509.Certificate{Subject: pkix.Name{CommonName: "gopher.example.org"}}
+	assert.Nil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, ca, root)), "should not check CN unless enforced")
+}
+
+func TestChainPolicyIPConstraints(t *testing.T) {
+	policy := ChainPolicy{MaxChainDepth: -1, EnforceNameConstraints: true}
+	_, permitted, _ := net.ParseCIDR("10.0.0.0/8")
+	_, excluded, _ := net.ParseCIDR("10.1.0.0/16")
+	ca := &x509.Certificate{
+		Subject:           pkix.Name{CommonName: "constrained"},
+		PermittedIPRanges: []*net.IPNet{permitted},
+		ExcludedIPRanges:  []*net.IPNet{excluded},
+	}
+
+	leaf := &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.2.3.4")}}
+	assert.Nil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, ca)), "should allow IP in permitted range")
+
+	leaf = &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.1.3.4")}}
+	assert.NotNil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, ca)), "should reject IP in excluded range")
+
+	leaf = &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("192.168.0.1")}}
+	assert.NotNil(t, policy.VerifyPeerCertificate(nil, testPolicyChain(leaf, ca)), "should reject IP outside permitted range")
+}
@@ -0,0 +1,134 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"time"
+)
+
+// Input describes a connection for external authorization (policy engines,
+// webhooks). It is serialized to JSON.
+type Input struct {
+	Certificate *CertificateInput `json:"certificate,omitempty"`
+	Connection  ConnectionInput   `json:"connection"`
+}
+
+// CertificateInput describes the peer (leaf) certificate.
+type CertificateInput struct {
+	Subject        NameInput        `json:"subject"`
+	Issuer         NameInput        `json:"issuer"`
+	SerialNumber   string           `json:"serial_number"`
+	NotBefore      time.Time        `json:"not_before"`
+	NotAfter       time.Time        `json:"not_after"`
+	DNSNames       []string         `json:"dns_names"`
+	IPAddresses    []string         `json:"ip_addresses"`
+	URIs           []string         `json:"uris"`
+	EmailAddresses []string         `json:"email_addresses"`
+	Extensions     []ExtensionInput `json:"extensions"`
+}
+
+// NameInput describes a certificate subject or issuer.
+type NameInput struct {
+	String             string   `json:"string"`
+	CommonName         string   `json:"common_name"`
+	Organization       []string `json:"organization"`
+	OrganizationalUnit []string `json:"organizational_unit"`
+	Country            []string `json:"country"`
+	Locality           []string `json:"locality"`
+	Province           []string `json:"province"`
+}
+
+// ExtensionInput describes a certificate extension. The value is the raw
+// DER-encoded extension value (base64 in JSON).
+type ExtensionInput struct {
+	ID       string `json:"id"`
+	Critical bool   `json:"critical"`
+	Value    []byte `json:"value"`
+}
+
+// ConnectionInput describes connection metadata.
+type ConnectionInput struct {
+	RemoteAddr         string `json:"remote_addr"`
+	LocalAddr          string `json:"local_addr"`
+	ServerName         string `json:"server_name"`
+	NegotiatedProtocol string `json:"negotiated_protocol"`
+	TLSVersion         uint16 `json:"tls_version"`
+	CipherSuite        uint16 `json:"cipher_suite"`
+}
+
+// NewInput builds an Input document for the given connection.
+func NewInput(conn net.Conn, state tls.ConnectionState) *Input {
+	input := &Input{
+		Connection: ConnectionInput{
+			RemoteAddr:         conn.RemoteAddr().String(),
+			LocalAddr:          conn.LocalAddr().String(),
+			ServerName:         state.ServerName,
+			NegotiatedProtocol: state.NegotiatedProtocol,
+			TLSVersion:         state.Version,
+			CipherSuite:        state.CipherSuite,
+		},
+	}
+	if len(state.PeerCertificates) > 0 {
+		input.Certificate = newCertificateInput(state.PeerCertificates[0])
+	}
+	return input
+}
+
+func newCertificateInput(cert *x509.Certificate) *CertificateInput {
+	input := &CertificateInput{
+		Subject:        newNameInput(cert.Subject),
+		Issuer:         newNameInput(cert.Issuer),
+		SerialNumber:   cert.SerialNumber.String(),
+		NotBefore:      cert.NotBefore,
+		NotAfter:       cert.NotAfter,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    []string{},
+		URIs:           []string{},
+		Extensions:     []ExtensionInput{},
+	}
+	for _, ip := range cert.IPAddresses {
+		input.IPAddresses = append(input.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		input.URIs = append(input.URIs, uri.String())
+	}
+	for _, ext := range cert.Extensions {
+		input.Extensions = append(input.Extensions, ExtensionInput{
+			ID:       ext.Id.String(),
+			Critical: ext.Critical,
+			Value:    ext.Value,
+		})
+	}
+	return input
+}
+
+func newNameInput(name pkix.Name) NameInput {
+	return NameInput{
+		String:             name.String(),
+		CommonName:         name.CommonName,
+		Organization:       name.Organization,
+		OrganizationalUnit: name.OrganizationalUnit,
+		Country:            name.Country,
+		Locality:           name.Locality,
+		Province:           name.Province,
+	}
+}
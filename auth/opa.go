@@ -0,0 +1,111 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OPA makes access decisions by evaluating a query against an Open Policy
+// Agent server, using its REST data API. The query is evaluated with an
+// Input document describing the connection, and must evaluate to true for
+// access to be granted. Errors (server unavailable, undefined query) deny
+// access (fails closed).
+type OPA struct {
+	client   *http.Client
+	endpoint string
+}
+
+// NewOPA creates a new OPA authorizer. The server is the base URL of the OPA
+// server (e.g. http://localhost:8181), the query is a reference to a rule
+// (e.g. data.ghostunnel.allow).
+func NewOPA(server, query string, client *http.Client) (*OPA, error) {
+	server = strings.TrimSuffix(server, "/")
+	if _, err := url.Parse(server); err != nil {
+		return nil, err
+	}
+
+	path, err := opaQueryPath(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &OPA{
+		client:   client,
+		endpoint: server + "/v1/data/" + path,
+	}, nil
+}
+
+// opaQueryPath converts a query like data.ghostunnel.allow into a path for the
+// data API (ghostunnel/allow).
+func opaQueryPath(query string) (string, error) {
+	parts := strings.Split(query, ".")
+	if len(parts) < 2 || parts[0] != "data" {
+		return "", fmt.Errorf("invalid policy query '%s', must be a reference to a rule (e.g. data.ghostunnel.allow)", query)
+	}
+	for i, part := range parts[1:] {
+		if part == "" {
+			return "", fmt.Errorf("invalid policy query '%s'", query)
+		}
+		parts[i+1] = url.PathEscape(part)
+	}
+	return strings.Join(parts[1:], "/"), nil
+}
+
+// Authorize evaluates the query for the given connection, and returns an error
+// unless it evaluated to true.
+func (o *OPA) Authorize(conn net.Conn, state tls.ConnectionState) error {
+	body, err := json.Marshal(map[string]interface{}{"input": NewInput(conn, state)})
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.client.Post(o.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to query policy: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to query policy: server returned %s", resp.Status)
+	}
+
+	var result struct {
+		Result *bool `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unable to query policy: invalid response: %s", err)
+	}
+	if result.Result == nil {
+		return errors.New("policy query is undefined or not a boolean")
+	}
+	if !*result.Result {
+		return errors.New("denied by policy")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOPA serves the given response, and records the input it received.
+func fakeOPA(t *testing.T, status int, response string, input *Input) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/data/ghostunnel/allow", r.URL.Path, "should query rule path")
+		var body struct {
+			Input *Input `json:"input"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body), "should send JSON body")
+		if input != nil && body.Input != nil {
+			*input = *body.Input
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+}
+
+func testConn() (net.Conn, tls.ConnectionState) {
+	conn, _ := net.Pipe()
+	return conn, tls.ConnectionState{
+		ServerName:       "server.example.com",
+		PeerCertificates: fakeChains[0],
+	}
+}
+
+func TestOPAAllow(t *testing.T) {
+	var input Input
+	server := fakeOPA(t, http.StatusOK, `{"result": true}`, &input)
+	defer server.Close()
+
+	opa, err := NewOPA(server.URL+"/", "data.ghostunnel.allow", nil)
+	assert.Nil(t, err, "should create OPA authorizer")
+
+	conn, state := testConn()
+	defer conn.Close()
+	assert.Nil(t, opa.Authorize(conn, state), "should allow if query evaluates to true")
+
+	assert.Equal(t, "gopher", input.Certificate.Subject.CommonName, "should send subject")
+	assert.Equal(t, []string{"triangle", "circle"}, input.Certificate.Subject.OrganizationalUnit, "should send subject")
+	assert.Equal(t, []string{"circle"}, input.Certificate.DNSNames, "should send DNS SANs")
+	assert.Equal(t, []string{"192.168.99.100"}, input.Certificate.IPAddresses, "should send IP SANs")
+	assert.Equal(t, []string{"scheme://valid/path"}, input.Certificate.URIs, "should send URI SANs")
+	assert.Equal(t, "server.example.com", input.Connection.ServerName, "should send connection metadata")
+}
+
+func TestOPADeny(t *testing.T) {
+	conn, state := testConn()
+	defer conn.Close()
+
+	for _, tc := range []struct {
+		status   int
+		response string
+	}{
+		{http.StatusOK, `{"result": false}`},
+		{http.StatusOK, `{}`},
+		{http.StatusOK, `{"result": "yes"}`},
+		{http.StatusInternalServerError, `{"result": true}`},
+	} {
+		server := fakeOPA(t, tc.status, tc.response, nil)
+		opa, err := NewOPA(server.URL, "data.ghostunnel.allow", nil)
+		assert.Nil(t, err, "should create OPA authorizer")
+		assert.NotNil(t, opa.Authorize(conn, state), "should deny for response %d %s", tc.status, tc.response)
+		server.Close()
+	}
+
+	// Server unavailable
+	opa, err := NewOPA("http://127.0.0.1:0", "data.ghostunnel.allow", nil)
+	assert.Nil(t, err, "should create OPA authorizer")
+	assert.NotNil(t, opa.Authorize(conn, state), "should deny if server is unavailable")
+}
+
+func TestOPAInvalidQuery(t *testing.T) {
+	for _, query := range []string{"", "allow", "data", "data..allow", "ghostunnel.allow"} {
+		_, err := NewOPA("http://localhost:8181", query, nil)
+		assert.NotNil(t, err, "should reject invalid query '%s'", query)
+	}
+}
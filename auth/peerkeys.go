@@ -0,0 +1,115 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// PeerKeys authenticates peers by their public key instead of their
+// certificate chain, with keys loaded from files that can be reloaded at
+// runtime. Peers present a certificate with one of the keys, which may be
+// self-signed; the rest of the certificate is ignored.
+//
+// This is the closest crypto/tls gets to raw public keys (RFC 7250): the
+// certificate type extensions aren't supported, so keys are always carried
+// in certificates on the wire.
+type PeerKeys struct {
+	paths []string
+	// Cached SPKIPins
+	cachedPins atomic.Value
+}
+
+// LoadPeerKeys loads public keys from the given PEM files, which may contain
+// any number of "PUBLIC KEY" or "CERTIFICATE" blocks (for certificates, the
+// public key is used).
+func LoadPeerKeys(paths []string) (*PeerKeys, error) {
+	k := &PeerKeys{paths: paths}
+	err := k.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reloads all keys from disk. If reloading fails, the old keys are
+// kept.
+func (k *PeerKeys) Reload() error {
+	pins := SPKIPins{}
+	for _, path := range k.paths {
+		keys, err := readPublicKeys(path)
+		if err != nil {
+			return fmt.Errorf("unable to load peer keys from '%s': %s", path, err)
+		}
+		for _, key := range keys {
+			hash := sha256.Sum256(key)
+			pins = append(pins, hash[:])
+		}
+	}
+
+	k.cachedPins.Store(pins)
+	return nil
+}
+
+// VerifyPeerCertificate is an implementation of VerifyPeerCertificate for
+// crypto/tls.Config, instead of CA verification (with InsecureSkipVerify in
+// clients, or RequireAnyClientCert in servers). The public key of the peer
+// certificate must be one of the loaded keys.
+func (k *PeerKeys) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	pins := k.cachedPins.Load().(SPKIPins)
+	return pins.VerifyPeerCertificateLeaf(rawCerts, verifiedChains)
+}
+
+// readPublicKeys reads DER encoded subject public key infos from a PEM file.
+func readPublicKeys(path string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := [][]byte{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+				return nil, err
+			}
+			keys = append(keys, block.Bytes)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, cert.RawSubjectPublicKeyInfo)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PUBLIC KEY or CERTIFICATE blocks found")
+	}
+	return keys, nil
+}
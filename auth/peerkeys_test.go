@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-peer-keys")
+	assert.Nil(t, err, "should be able to create temp dir")
+	defer os.RemoveAll(dir)
+
+	first, second, other := newTestPinCertificate(t), newTestPinCertificate(t), newTestPinCertificate(t)
+
+	// Keys as PUBLIC KEY and CERTIFICATE blocks
+	keys := append(
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: first.RawSubjectPublicKeyInfo}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: second.Raw})...)
+	path := filepath.Join(dir, "keys.pem")
+	assert.Nil(t, ioutil.WriteFile(path, keys, 0644))
+
+	peerKeys, err := LoadPeerKeys([]string{path})
+	assert.Nil(t, err, "should be able to load peer keys")
+	assert.Nil(t, peerKeys.VerifyPeerCertificate([][]byte{first.Raw}, nil), "should allow peer with key from PUBLIC KEY block")
+	assert.Nil(t, peerKeys.VerifyPeerCertificate([][]byte{second.Raw}, nil), "should allow peer with key from CERTIFICATE block")
+	assert.NotNil(t, peerKeys.VerifyPeerCertificate([][]byte{other.Raw}, nil), "should reject peer with other key")
+	assert.NotNil(t, peerKeys.VerifyPeerCertificate([][]byte{other.Raw, first.Raw}, nil), "should only check key of peer certificate")
+	assert.NotNil(t, peerKeys.VerifyPeerCertificate(nil, nil), "should reject peer without certificate")
+
+	// Reload picks up changes, failed reload keeps old keys
+	assert.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Raw}), 0644))
+	assert.Nil(t, peerKeys.Reload(), "should be able to reload peer keys")
+	assert.Nil(t, peerKeys.VerifyPeerCertificate([][]byte{other.Raw}, nil), "should allow peer with key added on reload")
+	assert.NotNil(t, peerKeys.VerifyPeerCertificate([][]byte{first.Raw}, nil), "should reject peer with key removed on reload")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("invalid"), 0644))
+	assert.NotNil(t, peerKeys.Reload(), "should fail to reload invalid peer keys")
+	assert.Nil(t, peerKeys.VerifyPeerCertificate([][]byte{other.Raw}, nil), "should keep old keys on failed reload")
+}
+
+func TestPeerKeysInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-peer-keys")
+	assert.Nil(t, err, "should be able to create temp dir")
+	defer os.RemoveAll(dir)
+
+	_, err = LoadPeerKeys([]string{filepath.Join(dir, "missing.pem")})
+	assert.NotNil(t, err, "should fail to load missing file")
+
+	path := filepath.Join(dir, "invalid.pem")
+	assert.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")}), 0644))
+	_, err = LoadPeerKeys([]string{path})
+	assert.NotNil(t, err, "should fail to load invalid key")
+
+	cert := newTestPinCertificate(t)
+	key, _ := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	assert.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0644))
+	_, err = LoadPeerKeys([]string{path})
+	assert.NotNil(t, err, "should fail to load file without public keys")
+}
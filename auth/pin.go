@@ -0,0 +1,103 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const spkiPinPrefix = "sha256//"
+
+// SPKIPins is a set of pinned public keys, as SHA-256 hashes of the DER
+// encoded subject public key info of certificates.
+type SPKIPins [][]byte
+
+// ParseSPKIPins parses pins in the form sha256//BASE64 (as used by HPKP and
+// curl's --pinnedpubkey).
+func ParseSPKIPins(pins []string) (SPKIPins, error) {
+	parsed := SPKIPins{}
+	for _, pin := range pins {
+		if !strings.HasPrefix(pin, spkiPinPrefix) {
+			return nil, fmt.Errorf("invalid pin '%s': must start with %s", pin, spkiPinPrefix)
+		}
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, spkiPinPrefix))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin '%s': must be a base64 encoded SHA-256 hash", pin)
+		}
+		parsed = append(parsed, hash)
+	}
+	return parsed, nil
+}
+
+// SPKIPin returns the pin of the public key of the given certificate, in the
+// form sha256//BASE64.
+func SPKIPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return spkiPinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func (p SPKIPins) contains(cert *x509.Certificate) bool {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range p {
+		if bytes.Equal(pin, hash[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyPeerCertificate is an implementation of VerifyPeerCertificate for
+// crypto/tls.Config, in addition to CA verification. The peer is allowed if
+// the public key of any certificate in a verified chain is pinned, so pins
+// can be for the peer certificate itself or one of its CAs.
+func (p SPKIPins) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return errors.New("unauthorized: no verified certificate chain")
+	}
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if p.contains(cert) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("unauthorized: public keys in certificate chain not pinned (peer certificate: %s)", SPKIPin(verifiedChains[0][0]))
+}
+
+// VerifyPeerCertificateLeaf is an implementation of VerifyPeerCertificate for
+// crypto/tls.Config, instead of CA verification (with InsecureSkipVerify).
+// Since the chain isn't verified, the public key of the peer certificate
+// itself must be pinned.
+func (p SPKIPins) VerifyPeerCertificateLeaf(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("unauthorized: no peer certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("unauthorized: invalid peer certificate: %s", err)
+	}
+	if !p.contains(cert) {
+		return fmt.Errorf("unauthorized: public key of peer certificate not pinned (%s)", SPKIPin(cert))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPinCertificate(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should generate key")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gopher"},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should create certificate")
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err, "should parse certificate")
+	return cert
+}
+
+func TestParseSPKIPins(t *testing.T) {
+	cert := newTestPinCertificate(t)
+	pins, err := ParseSPKIPins([]string{SPKIPin(cert)})
+	assert.Nil(t, err, "should parse valid pin")
+	assert.Len(t, pins, 1)
+
+	for _, pin := range []string{"", "sha1//AAAA", "sha256//not-base64!", "sha256//AAAA"} {
+		_, err := ParseSPKIPins([]string{pin})
+		assert.NotNil(t, err, "should reject invalid pin '%s'", pin)
+	}
+}
+
+func TestSPKIPinsVerifyPeerCertificate(t *testing.T) {
+	leaf := newTestPinCertificate(t)
+	ca := newTestPinCertificate(t)
+	other := newTestPinCertificate(t)
+	chains := [][]*x509.Certificate{{leaf, ca}}
+
+	pins, _ := ParseSPKIPins([]string{SPKIPin(leaf)})
+	assert.Nil(t, pins.VerifyPeerCertificate(nil, chains), "should allow pinned peer certificate")
+
+	pins, _ = ParseSPKIPins([]string{SPKIPin(other), SPKIPin(ca)})
+	assert.Nil(t, pins.VerifyPeerCertificate(nil, chains), "should allow pinned CA")
+
+	pins, _ = ParseSPKIPins([]string{SPKIPin(other)})
+	assert.NotNil(t, pins.VerifyPeerCertificate(nil, chains), "should reject chain without pinned keys")
+	assert.NotNil(t, pins.VerifyPeerCertificate(nil, nil), "should reject without verified chain")
+}
+
+func TestSPKIPinsVerifyPeerCertificateLeaf(t *testing.T) {
+	leaf := newTestPinCertificate(t)
+	ca := newTestPinCertificate(t)
+	rawCerts := [][]byte{leaf.Raw, ca.Raw}
+
+	pins, _ := ParseSPKIPins([]string{SPKIPin(leaf)})
+	assert.Nil(t, pins.VerifyPeerCertificateLeaf(rawCerts, nil), "should allow pinned peer certificate")
+
+	pins, _ = ParseSPKIPins([]string{SPKIPin(ca)})
+	assert.NotNil(t, pins.VerifyPeerCertificateLeaf(rawCerts, nil), "should only check peer certificate without verified chain")
+	assert.NotNil(t, pins.VerifyPeerCertificateLeaf(nil, nil), "should reject without peer certificate")
+	assert.NotNil(t, pins.VerifyPeerCertificateLeaf([][]byte{[]byte("garbage")}, nil), "should reject invalid peer certificate")
+}
@@ -0,0 +1,156 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/square/ghostunnel/wildcard"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// policyRules is the format of access policy files (YAML or JSON). Rules
+// have the same semantics as the corresponding flags.
+type policyRules struct {
+	AllowAll bool     `json:"allow-all" yaml:"allow-all"`
+	AllowCN  []string `json:"allow-cn" yaml:"allow-cn"`
+	AllowOU  []string `json:"allow-ou" yaml:"allow-ou"`
+	AllowDNS []string `json:"allow-dns" yaml:"allow-dns"`
+	AllowURI []string `json:"allow-uri" yaml:"allow-uri"`
+	// IP SANs, as IP addresses or CIDR ranges
+	AllowIP []string `json:"allow-ip" yaml:"allow-ip"`
+}
+
+// PolicyFile is an ACL that is loaded from a file, and can be reloaded at
+// runtime. An example policy file:
+//
+//	allow-cn: [client1, client2]
+//	allow-ou: [frontend]
+//	allow-uri: ["spiffe://example.com/*"]
+//	allow-ip: [10.0.0.0/8]
+//
+// JSON is accepted as well, with the same keys.
+type PolicyFile struct {
+	path   string
+	logger Logger
+	// Cached *ACL
+	cachedACL unsafe.Pointer
+}
+
+// LoadPolicyFile loads an access policy from the given file.
+func LoadPolicyFile(path string, logger Logger) (*PolicyFile, error) {
+	p := &PolicyFile{
+		path:   path,
+		logger: logger,
+	}
+	err := p.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reloads the policy from disk. If reloading fails, the old policy is
+// kept.
+func (p *PolicyFile) Reload() error {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	acl, err := parsePolicy(data)
+	if err != nil {
+		return fmt.Errorf("invalid access policy in '%s': %s", p.path, err)
+	}
+	acl.Logger = p.logger
+
+	atomic.StorePointer(&p.cachedACL, unsafe.Pointer(acl))
+	return nil
+}
+
+// ACL returns the current ACL.
+func (p *PolicyFile) ACL() *ACL {
+	return (*ACL)(atomic.LoadPointer(&p.cachedACL))
+}
+
+// VerifyPeerCertificateServer checks the peer certificate against the current
+// policy, see ACL.VerifyPeerCertificateServer.
+func (p *PolicyFile) VerifyPeerCertificateServer(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return p.ACL().VerifyPeerCertificateServer(rawCerts, verifiedChains)
+}
+
+func parsePolicy(data []byte) (*ACL, error) {
+	var rules policyRules
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&rules)
+	} else {
+		err = yaml.UnmarshalStrict(data, &rules)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	uris, err := wildcard.CompileList(rules.AllowURI)
+	if err != nil {
+		return nil, err
+	}
+	cns, cnPatterns, err := SplitPatterns(rules.AllowCN, '.')
+	if err != nil {
+		return nil, err
+	}
+	dnss, dnsPatterns, err := SplitPatternsFold(rules.AllowDNS, '.')
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &ACL{
+		AllowAll:           rules.AllowAll,
+		AllowedCNs:         cns,
+		AllowedCNPatterns:  cnPatterns,
+		AllowedOUs:         rules.AllowOU,
+		AllowedDNSs:        dnss,
+		AllowedDNSPatterns: dnsPatterns,
+		AllowedURIs:        uris,
+	}
+	for _, ip := range rules.AllowIP {
+		if !strings.Contains(ip, "/") {
+			parsed := net.ParseIP(ip)
+			if parsed == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", ip)
+			}
+			acl.AllowedIPs = append(acl.AllowedIPs, parsed)
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(ip)
+		if err != nil {
+			return nil, err
+		}
+		acl.AllowedIPNets = append(acl.AllowedIPNets, ipNet)
+	}
+	return acl, nil
+}
@@ -0,0 +1,94 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePolicyFile(t *testing.T, data string) string {
+	file, err := ioutil.TempFile("", "ghostunnel-policy")
+	assert.Nil(t, err, "should be able to create temp file")
+	_, err = file.WriteString(data)
+	assert.Nil(t, err, "should be able to write policy file")
+	file.Close()
+	return file.Name()
+}
+
+func TestPolicyFileYAML(t *testing.T) {
+	path := writePolicyFile(t, "allow-cn: [nobody]\nallow-ou:\n  - circle\n")
+	defer os.Remove(path)
+
+	policy, err := LoadPolicyFile(path, nil)
+	assert.Nil(t, err, "should load YAML policy")
+	assert.Nil(t, policy.VerifyPeerCertificateServer(nil, fakeChains), "should allow client with matching OU")
+}
+
+func TestPolicyFileJSON(t *testing.T) {
+	path := writePolicyFile(t, `{"allow-uri": ["scheme://valid/*"]}`)
+	defer os.Remove(path)
+
+	policy, err := LoadPolicyFile(path, nil)
+	assert.Nil(t, err, "should load JSON policy")
+	assert.Nil(t, policy.VerifyPeerCertificateServer(nil, fakeChains), "should allow client with matching URI SAN")
+}
+
+func TestPolicyFileIP(t *testing.T) {
+	path := writePolicyFile(t, "allow-ip: [10.0.0.1, 192.168.0.0/16]\n")
+	defer os.Remove(path)
+
+	policy, err := LoadPolicyFile(path, nil)
+	assert.Nil(t, err, "should load policy with IPs and CIDRs")
+	assert.Nil(t, policy.VerifyPeerCertificateServer(nil, fakeChains), "should allow client with IP SAN in CIDR range")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("allow-ip: [10.0.0.0/8]\n"), 0644))
+	assert.Nil(t, policy.Reload(), "should reload policy")
+	assert.NotNil(t, policy.VerifyPeerCertificateServer(nil, fakeChains), "should reject client with IP SAN outside CIDR range")
+}
+
+func TestPolicyFileReload(t *testing.T) {
+	path := writePolicyFile(t, "allow-cn: [gopher]\n")
+	defer os.Remove(path)
+
+	policy, err := LoadPolicyFile(path, nil)
+	assert.Nil(t, err, "should load policy")
+	assert.Nil(t, policy.VerifyPeerCertificateServer(nil, fakeChains), "should allow client with matching CN")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("allow-cn: [other]\n"), 0644))
+	assert.Nil(t, policy.Reload(), "should reload policy")
+	assert.NotNil(t, policy.VerifyPeerCertificateServer(nil, fakeChains), "should reject client after policy change")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("allow-cn: [gopher]\nunknown: true\n"), 0644))
+	assert.NotNil(t, policy.Reload(), "should reject policy with unknown keys")
+	assert.Equal(t, []string{"other"}, policy.ACL().AllowedCNs, "should keep old policy on failed reload")
+}
+
+func TestPolicyFileInvalid(t *testing.T) {
+	_, err := LoadPolicyFile("/does-not-exist", nil)
+	assert.NotNil(t, err, "should fail to load missing policy file")
+
+	for _, data := range []string{"allow-ip: [not-an-ip]\n", "allow-ip: [10.0.0.0/99]\n", "allow-uri: ['***']\n", "{invalid"} {
+		path := writePolicyFile(t, data)
+		_, err = LoadPolicyFile(path, nil)
+		assert.NotNil(t, err, "should fail to load invalid policy: %s", data)
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,162 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Maximum number of cached decisions, expired entries are dropped once the
+// cache is full.
+const webhookCacheSize = 10000
+
+var errWebhookDenied = errors.New("denied by authorization webhook")
+
+// Webhook makes access decisions by POSTing an Input document describing the
+// connection to an HTTP endpoint. A 2xx response allows the connection, a 401
+// or 403 response denies it. Other responses and errors deny access (fails
+// closed). Decisions (but not errors) are cached for the given TTL, keyed by
+// client certificate, remote IP and server name.
+type Webhook struct {
+	url    string
+	client *http.Client
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[webhookCacheKey]webhookDecision
+	// For tests
+	now func() time.Time
+}
+
+type webhookCacheKey struct {
+	cert       [sha256.Size]byte
+	remoteIP   string
+	serverName string
+}
+
+type webhookDecision struct {
+	err     error
+	expires time.Time
+}
+
+// NewWebhook creates a new webhook authorizer for the given URL. If ttl is
+// zero, decisions are not cached.
+func NewWebhook(url string, client *http.Client, ttl time.Duration) *Webhook {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Webhook{
+		url:    url,
+		client: client,
+		ttl:    ttl,
+		cache:  map[webhookCacheKey]webhookDecision{},
+		now:    time.Now,
+	}
+}
+
+// Authorize asks the webhook (or the cache) for a decision for the given
+// connection, and returns an error if access was denied.
+func (w *Webhook) Authorize(conn net.Conn, state tls.ConnectionState) error {
+	key := newWebhookCacheKey(conn, state)
+	if w.ttl > 0 {
+		w.mu.Lock()
+		decision, ok := w.cache[key]
+		w.mu.Unlock()
+		if ok && w.now().Before(decision.expires) {
+			return decision.err
+		}
+	}
+
+	denied, err := w.query(NewInput(conn, state))
+	if err != nil {
+		return err
+	}
+
+	if w.ttl > 0 {
+		w.mu.Lock()
+		if len(w.cache) >= webhookCacheSize {
+			w.pruneLocked()
+		}
+		w.cache[key] = webhookDecision{err: denied, expires: w.now().Add(w.ttl)}
+		w.mu.Unlock()
+	}
+	return denied
+}
+
+// query sends the input to the webhook. It returns the decision (nil if
+// allowed, errWebhookDenied if denied), or an error if the webhook did not
+// return a decision.
+func (w *Webhook) query(input *Input) (denied error, err error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("unable to query authorization webhook: %s", err)
+	}
+	defer resp.Body.Close()
+	// Drain body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return errWebhookDenied, nil
+	default:
+		return nil, fmt.Errorf("unable to query authorization webhook: server returned %s", resp.Status)
+	}
+}
+
+// pruneLocked drops expired entries from the cache, or all entries if none
+// have expired. Must be called with the lock held.
+func (w *Webhook) pruneLocked() {
+	now := w.now()
+	for key, decision := range w.cache {
+		if !now.Before(decision.expires) {
+			delete(w.cache, key)
+		}
+	}
+	if len(w.cache) >= webhookCacheSize {
+		w.cache = map[webhookCacheKey]webhookDecision{}
+	}
+}
+
+func newWebhookCacheKey(conn net.Conn, state tls.ConnectionState) webhookCacheKey {
+	key := webhookCacheKey{serverName: state.ServerName}
+	if len(state.PeerCertificates) > 0 {
+		key.cert = sha256.Sum256(state.PeerCertificates[0].Raw)
+	}
+	key.remoteIP = conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(key.remoteIP); err == nil {
+		key.remoteIP = host
+	}
+	return key
+}
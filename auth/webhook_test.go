@@ -0,0 +1,103 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeWebhook responds with the given status, and counts requests.
+func fakeWebhook(t *testing.T, status *int32, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		var input Input
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&input), "should send JSON input")
+		assert.Equal(t, "gopher", input.Certificate.Subject.CommonName, "should send certificate details")
+		w.WriteHeader(int(atomic.LoadInt32(status)))
+	}))
+}
+
+func TestWebhookAllowDeny(t *testing.T) {
+	var requests int32
+	status := int32(http.StatusOK)
+	server := fakeWebhook(t, &status, &requests)
+	defer server.Close()
+
+	conn, state := testConn()
+	defer conn.Close()
+
+	webhook := NewWebhook(server.URL, nil, 0)
+	assert.Nil(t, webhook.Authorize(conn, state), "should allow on 200 response")
+
+	atomic.StoreInt32(&status, http.StatusForbidden)
+	assert.NotNil(t, webhook.Authorize(conn, state), "should deny on 403 response")
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	assert.NotNil(t, webhook.Authorize(conn, state), "should deny on 500 response")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "should not cache with zero TTL")
+
+	webhook = NewWebhook("http://127.0.0.1:0", nil, time.Minute)
+	assert.NotNil(t, webhook.Authorize(conn, state), "should deny if webhook is unavailable")
+}
+
+func TestWebhookCache(t *testing.T) {
+	var requests int32
+	status := int32(http.StatusForbidden)
+	server := fakeWebhook(t, &status, &requests)
+	defer server.Close()
+
+	conn, state := testConn()
+	defer conn.Close()
+
+	webhook := NewWebhook(server.URL, nil, time.Minute)
+	assert.NotNil(t, webhook.Authorize(conn, state), "should deny on 403 response")
+	atomic.StoreInt32(&status, http.StatusOK)
+	assert.NotNil(t, webhook.Authorize(conn, state), "should use cached decision")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "should cache decisions")
+
+	// Different server name is a different cache entry
+	state.ServerName = "other.example.com"
+	assert.Nil(t, webhook.Authorize(conn, state), "should query webhook for new cache key")
+
+	// Entries expire after TTL
+	state.ServerName = "server.example.com"
+	webhook.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	assert.Nil(t, webhook.Authorize(conn, state), "should query webhook after cache entry expired")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "should query webhook after cache entry expired")
+}
+
+func TestWebhookErrorsNotCached(t *testing.T) {
+	var requests int32
+	status := int32(http.StatusServiceUnavailable)
+	server := fakeWebhook(t, &status, &requests)
+	defer server.Close()
+
+	conn, state := testConn()
+	defer conn.Close()
+
+	webhook := NewWebhook(server.URL, nil, time.Minute)
+	assert.NotNil(t, webhook.Authorize(conn, state), "should deny on 503 response")
+	atomic.StoreInt32(&status, http.StatusNoContent)
+	assert.Nil(t, webhook.Authorize(conn, state), "should not cache errors")
+}
@@ -0,0 +1,59 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/square/ghostunnel/proxy"
+)
+
+// caBundleMetrics counts handshakes by the CA bundle that verified the peer
+// (see proxy.CABundleMetrics), labeled by path, for the CA bundles used to
+// verify peers. Bundles are read again on reload.
+type caBundleMetrics struct {
+	*proxy.CABundleMetrics
+	paths []string
+}
+
+func newCABundleMetrics(paths []string) (*caBundleMetrics, error) {
+	counter, err := proxy.NewCABundleMetrics(*metricsPrefix, prometheus.DefaultRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	m := &caBundleMetrics{CABundleMetrics: counter, paths: paths}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload reads the CA bundles again. If a bundle can't be read, the ones
+// from the last successful reload are kept.
+func (m *caBundleMetrics) Reload() error {
+	bundles := map[string][]*x509.Certificate{}
+	for _, path := range m.paths {
+		certs, err := readCABundle(path)
+		if err != nil {
+			return err
+		}
+		bundles[path] = certs
+	}
+	m.SetBundles(bundles)
+	return nil
+}
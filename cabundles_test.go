@@ -0,0 +1,78 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/square/ghostunnel/certloader"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerCABundles(t *testing.T) {
+	defer func() {
+		*caBundlePath = ""
+		*serverClientCA = ""
+		*caBundleExtra = nil
+	}()
+
+	assert.Empty(t, peerCABundles(), "should use system trust store by default")
+
+	*caBundlePath = "ca.pem"
+	*caBundleExtra = []string{"new-ca.pem"}
+	assert.Equal(t, []string{"ca.pem", "new-ca.pem"}, peerCABundles(), "should add extra CA bundles")
+
+	*serverClientCA = "client-ca.pem"
+	assert.Equal(t, []string{"client-ca.pem", "new-ca.pem"}, peerCABundles(), "should prefer --cacert-client")
+	assert.Equal(t, []string{"client-ca.pem", "new-ca.pem"}, certloader.SplitCABundlePaths(clientCABundlePath()), "should pass all CA bundles to certificates")
+}
+
+func TestCABundleMetricsReload(t *testing.T) {
+	oldCA := writeTestCABundle(t, time.Now().Add(time.Hour))
+	defer os.Remove(oldCA)
+	newCA := writeTestCABundle(t, time.Now().Add(time.Hour))
+	defer os.Remove(newCA)
+
+	m, err := newCABundleMetrics([]string{oldCA, newCA})
+	assert.Nil(t, err, "should read CA bundles")
+	assert.Nil(t, m.Reload(), "should reload CA bundles")
+
+	os.Remove(newCA)
+	assert.NotNil(t, m.Reload(), "should fail to reload missing CA bundle")
+
+	_, err = newCABundleMetrics([]string{newCA})
+	assert.NotNil(t, err, "should fail for missing CA bundle")
+}
+
+func TestWithSystemTrust(t *testing.T) {
+	defer func() {
+		*systemTrust = "auto"
+		*caBundlePath = ""
+	}()
+
+	*systemTrust = "auto"
+	assert.Equal(t, "ca.pem", withSystemTrust("ca.pem"), "should only use CA bundle by default")
+
+	*systemTrust = "include"
+	assert.Equal(t, []string{certloader.SystemCABundle, "ca.pem"}, certloader.SplitCABundlePaths(withSystemTrust("ca.pem")), "should add system trust store")
+	assert.Equal(t, "", withSystemTrust(""), "should use system trust store without CA bundle")
+
+	*caBundlePath = "ca.pem"
+	assert.Equal(t, []string{certloader.SystemCABundle, "ca.pem"}, certloader.SplitCABundlePaths(clientCABundlePath()), "should add system trust store for peers")
+}
@@ -0,0 +1,182 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// How often expiry of certificates is checked
+var expiryCheckInterval = time.Minute
+
+var (
+	certExpiryGauge          = metrics.GetOrRegisterGauge("cert.expiry", metrics.DefaultRegistry)
+	certDaysRemainingGauge   = metrics.GetOrRegisterGaugeFloat64("cert.days_remaining", metrics.DefaultRegistry)
+	cacertExpiryGauge        = metrics.GetOrRegisterGauge("cacert.expiry", metrics.DefaultRegistry)
+	cacertDaysRemainingGauge = metrics.GetOrRegisterGaugeFloat64("cacert.days_remaining", metrics.DefaultRegistry)
+)
+
+// expiryMonitor keeps track of when our certificate and CA certificates
+// expire, exporting metrics with the expiry time (as Unix timestamp) and days
+// remaining, and warning once expiry is closer than the warning period. For
+// CA bundles, the certificate in any bundle that expires first counts.
+type expiryMonitor struct {
+	certificate func() (*tls.Certificate, error)
+	caBundles   []string
+	// Warn if expiry is closer than this (0 to never warn)
+	warning time.Duration
+
+	mu           sync.Mutex
+	certExpiry   time.Time
+	cacertExpiry time.Time
+	expiring     bool
+}
+
+func newExpiryMonitor(certificate func() (*tls.Certificate, error), caBundles []string, warning time.Duration) *expiryMonitor {
+	bundles := []string{}
+	for _, path := range caBundles {
+		if path != "" {
+			bundles = append(bundles, path)
+		}
+	}
+	return &expiryMonitor{certificate: certificate, caBundles: bundles, warning: warning}
+}
+
+// run checks expiry every interval, forever.
+func (m *expiryMonitor) run(interval time.Duration) {
+	m.check(time.Now())
+	for range time.Tick(interval) {
+		m.check(time.Now())
+	}
+}
+
+// check updates expiry times and metrics, as of the given time.
+func (m *expiryMonitor) check(now time.Time) {
+	certExpiry := m.loadCertExpiry()
+	cacertExpiry := m.loadCACertExpiry()
+	updateExpiryGauges(certExpiryGauge, certDaysRemainingGauge, certExpiry, now)
+	updateExpiryGauges(cacertExpiryGauge, cacertDaysRemainingGauge, cacertExpiry, now)
+
+	certExpiring := m.isExpiring(certExpiry, now)
+	cacertExpiring := m.isExpiring(cacertExpiry, now)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if certExpiring && (!m.expiring || !certExpiry.Equal(m.certExpiry)) {
+		logger.Printf("warning: certificate expires in %s (at %s)", certExpiry.Sub(now).Truncate(time.Second), certExpiry.Format(time.RFC3339))
+	}
+	if cacertExpiring && (!m.expiring || !cacertExpiry.Equal(m.cacertExpiry)) {
+		logger.Printf("warning: CA certificate expires in %s (at %s)", cacertExpiry.Sub(now).Truncate(time.Second), cacertExpiry.Format(time.RFC3339))
+	}
+	m.certExpiry = certExpiry
+	m.cacertExpiry = cacertExpiry
+	m.expiring = certExpiring || cacertExpiring
+}
+
+// Expiring returns true if the certificate or a CA certificate expires within
+// the warning period (as of the last check).
+func (m *expiryMonitor) Expiring() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.expiring
+}
+
+// CertificateExpiry returns when the certificate expires (zero if unknown).
+func (m *expiryMonitor) CertificateExpiry() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.certExpiry
+}
+
+func (m *expiryMonitor) isExpiring(expiry, now time.Time) bool {
+	return m.warning > 0 && !expiry.IsZero() && expiry.Sub(now) < m.warning
+}
+
+func (m *expiryMonitor) loadCertExpiry() time.Time {
+	if m.certificate == nil {
+		return time.Time{}
+	}
+	cert, err := m.certificate()
+	if err != nil || cert == nil || len(cert.Certificate) == 0 {
+		return time.Time{}
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return time.Time{}
+		}
+	}
+	return leaf.NotAfter
+}
+
+func (m *expiryMonitor) loadCACertExpiry() time.Time {
+	var expiry time.Time
+	for _, path := range m.caBundles {
+		certs, err := readCABundle(path)
+		if err != nil {
+			logger.Printf("error reading CA bundle to check expiry: %s", err)
+			continue
+		}
+		for _, cert := range certs {
+			if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+				expiry = cert.NotAfter
+			}
+		}
+	}
+	return expiry
+}
+
+// readCABundle reads the certificates in a CA bundle (PEM), skipping blocks
+// that aren't valid certificates.
+func readCABundle(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+func updateExpiryGauges(expiryGauge metrics.Gauge, daysGauge metrics.GaugeFloat64, expiry, now time.Time) {
+	if expiry.IsZero() {
+		return
+	}
+	expiryGauge.Update(expiry.Unix())
+	daysGauge.Update(expiry.Sub(now).Hours() / 24)
+}
@@ -0,0 +1,98 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestCABundle(t *testing.T, notAfters ...time.Time) string {
+	file, err := ioutil.TempFile("", "ghostunnel-test-ca")
+	assert.Nil(t, err, "should create temp file")
+	defer file.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should generate key")
+	for i, notAfter := range notAfters {
+		template := &x509.Certificate{SerialNumber: big.NewInt(int64(i + 1)), NotBefore: notAfter.Add(-24 * time.Hour), NotAfter: notAfter, IsCA: true, BasicConstraintsValid: true}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		assert.Nil(t, err, "should create certificate")
+		assert.Nil(t, pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: der}), "should write certificate")
+	}
+	return file.Name()
+}
+
+func TestExpiryMonitor(t *testing.T) {
+	now := time.Now()
+	certExpiry := now.Add(30 * 24 * time.Hour).Truncate(time.Second)
+	caExpiry := now.Add(90 * 24 * time.Hour).Truncate(time.Second)
+	bundle := writeTestCABundle(t, now.Add(365*24*time.Hour), caExpiry)
+	defer os.Remove(bundle)
+
+	monitor := newExpiryMonitor(newTestProbeCertificate(t, certExpiry), []string{"", bundle}, 7*24*time.Hour)
+	monitor.check(now)
+
+	assert.False(t, monitor.Expiring(), "should not warn if expiry is further away than warning period")
+	assert.True(t, certExpiry.Equal(monitor.CertificateExpiry()), "should track certificate expiry")
+	assert.Equal(t, certExpiry.Unix(), certExpiryGauge.Value(), "should export certificate expiry")
+	assert.InDelta(t, 30, certDaysRemainingGauge.Value(), 0.01, "should export days remaining")
+	assert.Equal(t, caExpiry.Unix(), cacertExpiryGauge.Value(), "should export first CA certificate expiry")
+	assert.InDelta(t, 90, cacertDaysRemainingGauge.Value(), 0.01, "should export CA days remaining")
+
+	monitor.check(now.Add(25 * 24 * time.Hour))
+	assert.True(t, monitor.Expiring(), "should warn once certificate expires within warning period")
+	assert.InDelta(t, 5, certDaysRemainingGauge.Value(), 0.01, "should update days remaining")
+}
+
+func TestExpiryMonitorCACertificate(t *testing.T) {
+	now := time.Now()
+	bundle := writeTestCABundle(t, now.Add(24*time.Hour))
+	defer os.Remove(bundle)
+
+	monitor := newExpiryMonitor(nil, []string{bundle}, 7*24*time.Hour)
+	monitor.check(now)
+	assert.True(t, monitor.Expiring(), "should warn if CA certificate expires within warning period")
+	assert.True(t, monitor.CertificateExpiry().IsZero(), "should not have certificate expiry without certificate")
+
+	disabled := newExpiryMonitor(nil, []string{bundle}, 0)
+	disabled.check(now)
+	assert.False(t, disabled.Expiring(), "should not warn if warnings are disabled")
+}
+
+func TestStatusHandlerExpiring(t *testing.T) {
+	now := time.Now()
+	handler := newStatusHandler(dummyDial)
+	handler.Listening()
+	handler.expiry = newExpiryMonitor(newTestProbeCertificate(t, now.Add(time.Hour)), nil, 24*time.Hour)
+	handler.expiry.check(now)
+
+	resp := handler.check()
+	assert.True(t, resp.Ok, "should still be ok with expiring certificate")
+	assert.True(t, resp.CertificateExpiring, "should report expiring certificate")
+	assert.Equal(t, "warning", resp.Status, "should warn about expiring certificate")
+	assert.NotNil(t, resp.CertificateExpiry, "should report certificate expiry")
+}
@@ -0,0 +1,124 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig describes how to obtain server certificates via ACME.
+type ACMEConfig struct {
+	// Domains to obtain certificates for
+	Domains []string
+	// ACME directory URL (uses Let's Encrypt if empty)
+	DirectoryURL string
+	// Contact email address for the ACME account (optional)
+	Email string
+	// Directory for caching account keys and certificates (optional)
+	CacheDir string
+}
+
+type acmeTLSConfigSource struct {
+	manager *autocert.Manager
+	// Trust bundle for verifying client certificates
+	trust Certificate
+}
+
+// TLSConfigSourceFromACME creates a TLS config source that obtains and renews
+// server certificates via ACME. Challenges are answered with TLS-ALPN-01 on the
+// listening port, so the port must be reachable by the ACME server. Calling
+// this implies acceptance of the terms of service of the ACME server.
+func TLSConfigSourceFromACME(config ACMEConfig, caBundlePath string) (TLSConfigSource, error) {
+	if len(config.Domains) == 0 {
+		return nil, errors.New("at least one domain is required for ACME")
+	}
+
+	trust, err := NoCertificate(caBundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.Domains...),
+		Email:      config.Email,
+		Client:     &acme.Client{DirectoryURL: config.DirectoryURL},
+	}
+	if config.CacheDir != "" {
+		manager.Cache = autocert.DirCache(config.CacheDir)
+	}
+
+	return &acmeTLSConfigSource{
+		manager: manager,
+		trust:   trust,
+	}, nil
+}
+
+func (s *acmeTLSConfigSource) Reload() error {
+	// Certificates are renewed by the ACME manager, we only reload the trust
+	// bundle here.
+	return s.trust.Reload()
+}
+
+func (s *acmeTLSConfigSource) CanServe() bool {
+	return true
+}
+
+func (s *acmeTLSConfigSource) GetClientConfig(base *tls.Config) (TLSClientConfig, error) {
+	return nil, errors.New("ACME certificates can only be used in server mode")
+}
+
+func (s *acmeTLSConfigSource) GetServerConfig(base *tls.Config) (TLSServerConfig, error) {
+	if base == nil {
+		base = new(tls.Config)
+	}
+	return &acmeTLSConfig{
+		source: s,
+		base:   base,
+	}, nil
+}
+
+type acmeTLSConfig struct {
+	source *acmeTLSConfigSource
+	base   *tls.Config
+}
+
+func (c *acmeTLSConfig) GetServerConfig() *tls.Config {
+	config := c.base.Clone()
+	config.GetCertificate = c.source.manager.GetCertificate
+	config.ClientCAs = c.source.trust.GetTrustStore()
+
+	// The ACME server will not present a client certificate when validating
+	// a TLS-ALPN-01 challenge, so we can't require one for those handshakes.
+	// Connections that negotiated the ACME protocol are never proxied.
+	challenge := config.Clone()
+	challenge.ClientAuth = tls.NoClientCert
+	challenge.VerifyPeerCertificate = nil
+	challenge.NextProtos = []string{acme.ALPNProto}
+
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+			return challenge, nil
+		}
+		return nil, nil
+	}
+	return config
+}
@@ -0,0 +1,53 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMETLSConfigSource(t *testing.T) {
+	_, err := TLSConfigSourceFromACME(ACMEConfig{}, "")
+	assert.NotNil(t, err, "should require at least one domain")
+
+	source, err := TLSConfigSourceFromACME(ACMEConfig{Domains: []string{"example.com"}}, "")
+	assert.Nil(t, err, "should create ACME source")
+	assert.True(t, source.CanServe(), "ACME source should be able to serve")
+	assert.Nil(t, source.Reload(), "should be able to reload")
+
+	_, err = source.GetClientConfig(nil)
+	assert.NotNil(t, err, "ACME source should not be usable in client mode")
+
+	serverConfig, err := source.GetServerConfig(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert})
+	assert.Nil(t, err, "should get server config")
+	config := serverConfig.GetServerConfig()
+	assert.NotNil(t, config.GetCertificate, "should get certificates from ACME manager")
+	assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth, "should keep client auth settings")
+
+	normal, err := config.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{"h2", acme.ALPNProto}})
+	assert.Nil(t, err, "should not fail for regular handshakes")
+	assert.Nil(t, normal, "should use default config for regular handshakes")
+
+	challenge, err := config.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}})
+	assert.Nil(t, err, "should not fail for challenge handshakes")
+	assert.Equal(t, tls.NoClientCert, challenge.ClientAuth, "should not require client cert for challenges")
+	assert.Equal(t, []string{acme.ALPNProto}, challenge.NextProtos, "should negotiate ACME protocol for challenges")
+}
@@ -19,10 +19,11 @@ package certloader
 import (
 	"crypto/x509"
 	"encoding/pem"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	certigo "github.com/square/certigo/lib"
 )
@@ -76,21 +77,64 @@ func readX509(path string) ([]*x509.Certificate, error) {
 	return out, nil
 }
 
+// SystemCABundle can be given as one of the paths to LoadTrustStore, to
+// trust the system trust store in addition to the CA bundle files.
+const SystemCABundle = "[system]"
+
+// LoadTrustStore loads the CA bundle at the given path, or the system trust
+// store if the path is empty. The path may list several CA bundles separated
+// by os.PathListSeparator (see JoinCABundlePaths), in which case
+// certificates from all of them are trusted.
 func LoadTrustStore(caBundlePath string) (*x509.CertPool, error) {
-	if caBundlePath == "" {
+	paths := SplitCABundlePaths(caBundlePath)
+	if len(paths) == 0 {
 		return x509.SystemCertPool()
 	}
 
-	caBundleBytes, err := ioutil.ReadFile(caBundlePath)
-	if err != nil {
-		return nil, err
+	bundle := x509.NewCertPool()
+	for _, path := range paths {
+		if path == SystemCABundle {
+			// Returns a copy, so bundle files can be added to it
+			system, err := x509.SystemCertPool()
+			if err != nil {
+				return nil, err
+			}
+			bundle = system
+			break
+		}
 	}
+	for _, path := range paths {
+		if path == SystemCABundle {
+			continue
+		}
+		caBundleBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
 
-	bundle := x509.NewCertPool()
-	ok := bundle.AppendCertsFromPEM(caBundleBytes)
-	if !ok {
-		return nil, errors.New("unable to read certificates from CA bundle")
+		ok := bundle.AppendCertsFromPEM(caBundleBytes)
+		if !ok {
+			return nil, fmt.Errorf("unable to read certificates from CA bundle '%s'", path)
+		}
 	}
 
 	return bundle, nil
 }
+
+// JoinCABundlePaths combines paths of CA bundles into a single path for
+// LoadTrustStore (and certificates that take a CA bundle path), like PATH.
+func JoinCABundlePaths(paths ...string) string {
+	return strings.Join(paths, string(os.PathListSeparator))
+}
+
+// SplitCABundlePaths returns the paths of CA bundles in a path given to
+// LoadTrustStore, skipping empty ones.
+func SplitCABundlePaths(caBundlePath string) []string {
+	paths := []string{}
+	for _, path := range filepath.SplitList(caBundlePath) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -158,3 +158,45 @@ func TestLoadTrustStoreInvalid(t *testing.T) {
 	_, err = LoadTrustStore(cert.Name())
 	assert.NotNil(t, err, "should not read non-existent file")
 }
+
+func TestLoadTrustStoreMultiple(t *testing.T) {
+	cert, err := ioutil.TempFile("", "ghostunnel-test")
+	assert.Nil(t, err, "temp file error")
+	defer os.Remove(cert.Name())
+
+	_, err = cert.Write([]byte(testCertificate))
+	assert.Nil(t, err, "temp file error")
+
+	paths := JoinCABundlePaths(cert.Name(), "", cert.Name())
+	assert.Equal(t, []string{cert.Name(), cert.Name()}, SplitCABundlePaths(paths), "should split paths, skipping empty ones")
+
+	_, err = LoadTrustStore(paths)
+	assert.Nil(t, err, "should read all CA bundles")
+
+	_, err = LoadTrustStore(JoinCABundlePaths(cert.Name(), "file-that-does-not-exist"))
+	assert.NotNil(t, err, "should fail if any CA bundle can't be read")
+}
+
+func TestLoadTrustStoreWithSystemRoots(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// System roots are not supported on Windows
+		t.SkipNow()
+		return
+	}
+
+	cert, err := ioutil.TempFile("", "ghostunnel-test")
+	assert.Nil(t, err, "temp file error")
+	defer os.Remove(cert.Name())
+
+	_, err = cert.Write([]byte(testCertificate))
+	assert.Nil(t, err, "temp file error")
+
+	withSystem, err := LoadTrustStore(JoinCABundlePaths(SystemCABundle, cert.Name()))
+	assert.Nil(t, err, "should load system trust store and CA bundle")
+	withoutSystem, err := LoadTrustStore(cert.Name())
+	assert.Nil(t, err, "should load CA bundle")
+	assert.True(t, len(withSystem.Subjects()) >= len(withoutSystem.Subjects()), "should include CA bundle with system trust store")
+
+	_, err = LoadTrustStore(SystemCABundle)
+	assert.Nil(t, err, "should load system trust store only")
+}
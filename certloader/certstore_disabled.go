@@ -1,3 +1,4 @@
+//go:build !certstore
 // +build !certstore
 
 /*-
@@ -31,3 +32,9 @@ func SupportsKeychain() bool {
 func CertificateFromKeychainIdentity(commonName string, caBundlePath string) (Certificate, error) {
 	return nil, errors.New("not supported")
 }
+
+// CertificateFromIdentity creates a reloadable certificate from a system
+// keychain/certificate store identity matching the selector.
+func CertificateFromIdentity(selector IdentitySelector, caBundlePath string) (Certificate, error) {
+	return nil, errors.New("not supported")
+}
@@ -1,3 +1,4 @@
+//go:build certstore
 // +build certstore
 
 /*-
@@ -30,8 +31,8 @@ import (
 )
 
 type certstoreCertificate struct {
-	// Common name of keychain identity
-	commonName string
+	// Selects keychain identity
+	selector IdentitySelector
 	// Root CA bundle path
 	caBundlePath string
 	// Cached *tls.Certificate
@@ -49,8 +50,15 @@ func SupportsKeychain() bool {
 
 // CertificateFromKeychainIdentity creates a reloadable certificate from a system keychain identity.
 func CertificateFromKeychainIdentity(commonName string, caBundlePath string) (Certificate, error) {
+	return CertificateFromIdentity(IdentitySelector{CommonName: commonName}, caBundlePath)
+}
+
+// CertificateFromIdentity creates a reloadable certificate from a system
+// keychain/certificate store identity matching the selector. The private key
+// stays in the keychain, signatures are computed via platform APIs.
+func CertificateFromIdentity(selector IdentitySelector, caBundlePath string) (Certificate, error) {
 	c := certstoreCertificate{
-		commonName:   commonName,
+		selector:     selector,
 		caBundlePath: caBundlePath,
 	}
 	err := c.Reload()
@@ -72,7 +80,7 @@ func (c *certstoreCertificate) Reload() error {
 		return err
 	}
 
-	// filter any certificates with the matching name, as the keychain allows
+	// filter any certificates matching the selector, as the keychain allows
 	// multiple certificates with the same name
 	var candidates []certstore.Identity
 	for _, identity := range identities {
@@ -81,13 +89,13 @@ func (c *certstoreCertificate) Reload() error {
 			continue
 		}
 
-		if chain[0].Subject.CommonName == c.commonName {
+		if c.selector.Matches(chain[0]) {
 			candidates = append(candidates, identity)
 		}
 	}
 
 	if len(candidates) == 0 {
-		return fmt.Errorf("unable to find identity with common name '%s' in keychain", c.commonName)
+		return fmt.Errorf("unable to find identity with %s in keychain", c.selector)
 	}
 
 	// sort the candidates by descending NotAfter
@@ -110,11 +118,11 @@ func (c *certstoreCertificate) Reload() error {
 	chosenIdentity := candidates[0]
 	chain, err := chosenIdentity.CertificateChain()
 	if err != nil {
-		return fmt.Errorf("unable to find identity with common name '%s' in keychain", c.commonName)
+		return fmt.Errorf("unable to find identity with %s in keychain", c.selector)
 	}
 	signer, err := chosenIdentity.Signer()
 	if err != nil {
-		return fmt.Errorf("unable to find identity with common name '%s' in keychain", c.commonName)
+		return fmt.Errorf("unable to find identity with %s in keychain", c.selector)
 	}
 
 	certAndKey := &tls.Certificate{
@@ -0,0 +1,171 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// CRLSet holds CRLs loaded from files, for checking peer certificates against
+// them. CRLs can be reloaded at runtime.
+type CRLSet struct {
+	paths  []string
+	logger Logger
+	// Cached *crlList
+	cachedCRLs unsafe.Pointer
+}
+
+type crlList struct {
+	crls []*loadedCRL
+}
+
+type loadedCRL struct {
+	path string
+	crl  *pkix.CertificateList
+	// Issuer name, for matching against certificates
+	issuer string
+
+	// Issuers (by hash of raw certificate) we checked the signature against
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// LoadCRLSet loads CRLs from the given files. Files may be in DER format, or
+// contain one or more PEM blocks of type "X509 CRL".
+func LoadCRLSet(paths []string, logger Logger) (*CRLSet, error) {
+	s := &CRLSet{
+		paths:  paths,
+		logger: logger,
+	}
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reloads all CRLs from disk. If reloading fails, the old CRLs are kept.
+func (s *CRLSet) Reload() error {
+	list := &crlList{}
+	for _, path := range s.paths {
+		crls, err := readCRLs(path)
+		if err != nil {
+			return fmt.Errorf("unable to load CRL from '%s': %s", path, err)
+		}
+		for _, crl := range crls {
+			if crl.HasExpired(time.Now()) {
+				s.logger.Printf("warning: CRL from '%s' (issuer '%s') has expired", path, crl.TBSCertList.Issuer)
+			}
+			list.crls = append(list.crls, &loadedCRL{
+				path:     path,
+				crl:      crl,
+				issuer:   crl.TBSCertList.Issuer.String(),
+				verified: map[[sha256.Size]byte]bool{},
+			})
+		}
+	}
+
+	atomic.StorePointer(&s.cachedCRLs, unsafe.Pointer(list))
+	return nil
+}
+
+// VerifyPeerCertificate is an implementation of VerifyPeerCertificate for
+// crypto/tls.Config that rejects certificates revoked by one of the CRLs.
+// Certificates in the verified chain (except for the root) are checked
+// against all CRLs that were issued (and signed) by their issuer.
+func (s *CRLSet) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return nil
+	}
+
+	list := (*crlList)(atomic.LoadPointer(&s.cachedCRLs))
+	chain := verifiedChains[0]
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+		issuerName := issuer.Subject.ToRDNSequence().String()
+		for _, crl := range list.crls {
+			if crl.issuer != issuerName || !crl.signedBy(issuer) {
+				continue
+			}
+			if crlContains(crl.crl, cert.SerialNumber) {
+				return fmt.Errorf("certificate '%s' (serial %s) has been revoked (per CRL from '%s')", cert.Subject, cert.SerialNumber, crl.path)
+			}
+		}
+	}
+	return nil
+}
+
+// signedBy checks if the CRL was signed by the given issuer. Results are
+// cached, to avoid verifying signatures on every handshake.
+func (c *loadedCRL) signedBy(issuer *x509.Certificate) bool {
+	hash := sha256.Sum256(issuer.Raw)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	verified, ok := c.verified[hash]
+	if !ok {
+		verified = issuer.CheckCRLSignature(c.crl) == nil
+		c.verified[hash] = verified
+	}
+	return verified
+}
+
+// readCRLs reads one or more CRLs from a PEM or DER file.
+func readCRLs(path string) ([]*pkix.CertificateList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	crls := []*pkix.CertificateList{}
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+
+	if len(crls) == 0 {
+		// Not PEM, try DER
+		crl, err := x509.ParseDERCRL(data)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
@@ -0,0 +1,93 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCRLFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644), "should be able to write CRL file")
+	return path
+}
+
+func TestCRLSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-crl")
+	assert.Nil(t, err, "should be able to create temp dir")
+	defer os.RemoveAll(dir)
+
+	pki := newTestPKI(t)
+	other := newTestPKI(t)
+	revoked := pki.issue(t, "revoked", "", "").Leaf
+	good := pki.issue(t, "good", "", "").Leaf
+	otherRevoked := other.issue(t, "other", "", "").Leaf
+
+	// PEM file with multiple CRLs, and a DER file
+	pemCRLs := append(
+		pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: pki.createCRL(t, revoked)}),
+		pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: newTestPKI(t).createCRL(t)})...)
+	pemPath := writeCRLFile(t, dir, "crls.pem", pemCRLs)
+	derPath := writeCRLFile(t, dir, "other.crl", other.createCRL(t, otherRevoked))
+
+	crls, err := LoadCRLSet([]string{pemPath, derPath}, newTestLogger(t))
+	assert.Nil(t, err, "should be able to load CRLs")
+
+	assert.NotNil(t, crls.VerifyPeerCertificate(nil, verifiedChain(revoked, pki.cert)), "should reject revoked certificate (PEM)")
+	assert.NotNil(t, crls.VerifyPeerCertificate(nil, verifiedChain(otherRevoked, other.cert)), "should reject revoked certificate (DER)")
+	assert.Nil(t, crls.VerifyPeerCertificate(nil, verifiedChain(good, pki.cert)), "should accept good certificate")
+	assert.Nil(t, crls.VerifyPeerCertificate(nil, nil), "should accept empty chains")
+
+	// Reload picks up changes
+	writeCRLFile(t, dir, "crls.pem", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: pki.createCRL(t, good)}))
+	assert.Nil(t, crls.Reload(), "should be able to reload CRLs")
+	assert.Nil(t, crls.VerifyPeerCertificate(nil, verifiedChain(revoked, pki.cert)), "should accept certificate removed from CRL")
+	assert.NotNil(t, crls.VerifyPeerCertificate(nil, verifiedChain(good, pki.cert)), "should reject certificate added to CRL")
+
+	// Failed reload keeps old CRLs
+	writeCRLFile(t, dir, "crls.pem", []byte("invalid"))
+	assert.NotNil(t, crls.Reload(), "should fail to reload invalid CRL")
+	assert.NotNil(t, crls.VerifyPeerCertificate(nil, verifiedChain(good, pki.cert)), "should keep old CRLs on failed reload")
+}
+
+func TestCRLSetIgnoresForgedCRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-crl")
+	assert.Nil(t, err, "should be able to create temp dir")
+	defer os.RemoveAll(dir)
+
+	pki := newTestPKI(t)
+	cert := pki.issue(t, "client", "", "").Leaf
+
+	// CRL with the same issuer name, but signed by a different key
+	forger := newTestPKI(t)
+	path := writeCRLFile(t, dir, "forged.crl", forger.createCRL(t, cert))
+
+	crls, err := LoadCRLSet([]string{path}, newTestLogger(t))
+	assert.Nil(t, err, "should be able to load CRLs")
+	assert.Nil(t, crls.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "should ignore CRL not signed by issuer")
+}
+
+func TestCRLSetInvalid(t *testing.T) {
+	_, err := LoadCRLSet([]string{"/does-not-exist"}, newTestLogger(t))
+	assert.NotNil(t, err, "should fail to load missing CRL file")
+}
@@ -0,0 +1,409 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// OID of the X.509 extension with embedded SCTs (RFC 6962, section 3.3).
+var oidExtensionSCT = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+const (
+	sctVersionV1         = 0
+	sctSignatureTypeCert = 0
+	sctEntryX509         = 0
+	sctEntryPrecert      = 1
+	sctHashSHA256        = 4
+	sctSignatureRSA      = 1
+	sctSignatureECDSA    = 3
+)
+
+// CTLogList holds Certificate Transparency logs from a log list file, for
+// checking that peer certificates come with enough valid signed certificate
+// timestamps (SCTs). The log list can be reloaded at runtime.
+type CTLogList struct {
+	path    string
+	minSCTs int
+	logger  Logger
+	// Cached *ctLogs
+	cachedLogs unsafe.Pointer
+}
+
+type ctLogs struct {
+	// Logs by log ID (hash of the public key)
+	logs map[[sha256.Size]byte]*ctLog
+}
+
+type ctLog struct {
+	description string
+	operator    string
+	key         crypto.PublicKey
+	// Time the log was retired, SCTs issued later aren't accepted
+	retired time.Time
+	// Interval for the expiry of certificates accepted by sharded logs
+	start, end time.Time
+}
+
+// Log list in the format published by Google (version 3), see
+// https://www.gstatic.com/ct/log_list/v3/log_list_schema.json.
+type ctLogListFile struct {
+	Operators []struct {
+		Name      string           `json:"name"`
+		Logs      []ctLogListEntry `json:"logs"`
+		TiledLogs []ctLogListEntry `json:"tiled_logs"`
+	} `json:"operators"`
+}
+
+type ctLogListEntry struct {
+	Description string `json:"description"`
+	LogID       []byte `json:"log_id"`
+	Key         []byte `json:"key"`
+	State       map[string]struct {
+		Timestamp time.Time `json:"timestamp"`
+	} `json:"state"`
+	TemporalInterval *struct {
+		StartInclusive time.Time `json:"start_inclusive"`
+		EndExclusive   time.Time `json:"end_exclusive"`
+	} `json:"temporal_interval"`
+}
+
+// LoadCTLogList loads CT logs from a log list file (JSON, version 3 format).
+// Peer certificates must have SCTs from at least minSCTs different logs to be
+// accepted, from at least two different log operators if minSCTs is two or
+// more. Logs that are pending or rejected are ignored.
+func LoadCTLogList(path string, minSCTs int, logger Logger) (*CTLogList, error) {
+	l := &CTLogList{
+		path:    path,
+		minSCTs: minSCTs,
+		logger:  logger,
+	}
+	err := l.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload reloads the log list from disk. If reloading fails, the old log list
+// is kept.
+func (l *CTLogList) Reload() error {
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("unable to read CT log list from '%s': %s", l.path, err)
+	}
+	var file ctLogListFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("unable to parse CT log list from '%s': %s", l.path, err)
+	}
+
+	logs := &ctLogs{logs: map[[sha256.Size]byte]*ctLog{}}
+	for _, operator := range file.Operators {
+		for _, entry := range append(operator.Logs, operator.TiledLogs...) {
+			if _, ok := entry.State["pending"]; ok {
+				continue
+			}
+			if _, ok := entry.State["rejected"]; ok {
+				continue
+			}
+			key, err := x509.ParsePKIXPublicKey(entry.Key)
+			if err != nil {
+				return fmt.Errorf("invalid key for CT log '%s' in '%s': %s", entry.Description, l.path, err)
+			}
+			id := sha256.Sum256(entry.Key)
+			if len(entry.LogID) > 0 && !bytes.Equal(entry.LogID, id[:]) {
+				return fmt.Errorf("log ID of CT log '%s' in '%s' doesn't match its key", entry.Description, l.path)
+			}
+			log := &ctLog{
+				description: entry.Description,
+				operator:    operator.Name,
+				key:         key,
+				retired:     entry.State["retired"].Timestamp,
+			}
+			if entry.TemporalInterval != nil {
+				log.start, log.end = entry.TemporalInterval.StartInclusive, entry.TemporalInterval.EndExclusive
+			}
+			logs.logs[id] = log
+		}
+	}
+	if len(logs.logs) == 0 {
+		return fmt.Errorf("no usable CT logs in log list '%s'", l.path)
+	}
+
+	atomic.StorePointer(&l.cachedLogs, unsafe.Pointer(logs))
+	return nil
+}
+
+// VerifyConnection is an implementation of VerifyConnection for
+// crypto/tls.Config that rejects peer certificates without enough valid SCTs,
+// embedded in the certificate or sent in the TLS handshake.
+func (l *CTLogList) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return errors.New("no verified certificate chain to check SCTs for")
+	}
+	chain := state.VerifiedChains[0]
+	leaf := chain[0]
+
+	type signedEntry struct {
+		sct   []byte
+		entry []byte
+	}
+	entries := []signedEntry{}
+	for _, sct := range state.SignedCertificateTimestamps {
+		entries = append(entries, signedEntry{sct, x509Entry(leaf)})
+	}
+	if len(chain) > 1 {
+		embedded, err := embeddedSCTs(leaf)
+		if err != nil {
+			return fmt.Errorf("certificate '%s' has invalid embedded SCTs: %s", leaf.Subject, err)
+		}
+		if len(embedded) > 0 {
+			entry, err := precertEntry(leaf, chain[1])
+			if err != nil {
+				return fmt.Errorf("unable to check embedded SCTs of certificate '%s': %s", leaf.Subject, err)
+			}
+			for _, sct := range embedded {
+				entries = append(entries, signedEntry{sct, entry})
+			}
+		}
+	}
+
+	logs := (*ctLogs)(atomic.LoadPointer(&l.cachedLogs))
+	validLogs := map[*ctLog]bool{}
+	operators := map[string]bool{}
+	for _, e := range entries {
+		log, err := logs.verify(e.sct, e.entry, leaf)
+		if err != nil {
+			l.logger.Printf("ignoring SCT for certificate '%s': %s", leaf.Subject, err)
+			continue
+		}
+		validLogs[log] = true
+		operators[log.operator] = true
+	}
+
+	if len(validLogs) < l.minSCTs {
+		return fmt.Errorf("certificate '%s' has valid SCTs from %d CT logs, at least %d required", leaf.Subject, len(validLogs), l.minSCTs)
+	}
+	if l.minSCTs >= 2 && len(operators) < 2 {
+		return fmt.Errorf("certificate '%s' has valid SCTs from %d CT log operators, at least 2 required", leaf.Subject, len(operators))
+	}
+	return nil
+}
+
+// verify parses the SCT and checks its signature over the given entry
+// (timestamped_entry from RFC 6962, section 3.2, without the timestamp).
+func (logs *ctLogs) verify(sct, entry []byte, leaf *x509.Certificate) (*ctLog, error) {
+	s := cryptobyte.String(sct)
+	var version uint8
+	var logID []byte
+	var timestampHigh, timestampLow uint32
+	var extensions cryptobyte.String
+	var hashAlg, sigAlg uint8
+	var signature cryptobyte.String
+	if !s.ReadUint8(&version) || !s.ReadBytes(&logID, sha256.Size) || !s.ReadUint32(&timestampHigh) || !s.ReadUint32(&timestampLow) ||
+		!s.ReadUint16LengthPrefixed(&extensions) || !s.ReadUint8(&hashAlg) || !s.ReadUint8(&sigAlg) ||
+		!s.ReadUint16LengthPrefixed(&signature) || !s.Empty() {
+		return nil, errors.New("malformed SCT")
+	}
+	if version != sctVersionV1 {
+		return nil, fmt.Errorf("unsupported SCT version %d", version)
+	}
+
+	var id [sha256.Size]byte
+	copy(id[:], logID)
+	log, ok := logs.logs[id]
+	if !ok {
+		return nil, errors.New("SCT from unknown CT log")
+	}
+
+	timestamp := uint64(timestampHigh)<<32 | uint64(timestampLow)
+	issued := time.Unix(0, int64(timestamp)*int64(time.Millisecond))
+	if issued.After(time.Now()) {
+		return nil, fmt.Errorf("SCT from CT log '%s' is issued in the future", log.description)
+	}
+	if !log.retired.IsZero() && !issued.Before(log.retired) {
+		return nil, fmt.Errorf("SCT from CT log '%s' was issued after the log was retired", log.description)
+	}
+	if !log.start.IsZero() && (leaf.NotAfter.Before(log.start) || !leaf.NotAfter.Before(log.end)) {
+		return nil, fmt.Errorf("certificate expiry is outside of the interval accepted by CT log '%s'", log.description)
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(sctVersionV1)
+	b.AddUint8(sctSignatureTypeCert)
+	b.AddUint32(timestampHigh)
+	b.AddUint32(timestampLow)
+	b.AddBytes(entry)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(extensions)
+	})
+	signed, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	if hashAlg != sctHashSHA256 {
+		return nil, fmt.Errorf("unsupported hash algorithm %d in SCT from CT log '%s'", hashAlg, log.description)
+	}
+	hash := sha256.Sum256(signed)
+	switch key := log.key.(type) {
+	case *ecdsa.PublicKey:
+		if sigAlg != sctSignatureECDSA || !ecdsa.VerifyASN1(key, hash[:], signature) {
+			return nil, fmt.Errorf("invalid signature on SCT from CT log '%s'", log.description)
+		}
+	case *rsa.PublicKey:
+		if sigAlg != sctSignatureRSA || rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) != nil {
+			return nil, fmt.Errorf("invalid signature on SCT from CT log '%s'", log.description)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type for CT log '%s'", log.description)
+	}
+	return log, nil
+}
+
+// x509Entry returns the signed entry for SCTs over the final certificate,
+// as sent in the TLS handshake.
+func x509Entry(leaf *x509.Certificate) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(sctEntryX509)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(leaf.Raw)
+	})
+	return b.BytesOrPanic()
+}
+
+// precertEntry returns the signed entry for SCTs embedded in the certificate,
+// which were issued over the precertificate: the TBS certificate without the
+// SCT extension, and the hash of the issuer's public key.
+func precertEntry(leaf, issuer *x509.Certificate) ([]byte, error) {
+	tbs, err := removeSCTExtension(leaf.RawTBSCertificate)
+	if err != nil {
+		return nil, err
+	}
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+
+	var b cryptobyte.Builder
+	b.AddUint16(sctEntryPrecert)
+	b.AddBytes(issuerKeyHash[:])
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(tbs)
+	})
+	return b.Bytes()
+}
+
+// embeddedSCTs returns the SCTs from the SCT list extension of the
+// certificate (RFC 6962, section 3.3), if any.
+func embeddedSCTs(cert *x509.Certificate) ([][]byte, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidExtensionSCT) {
+			continue
+		}
+		var list []byte
+		if rest, err := asn1.Unmarshal(ext.Value, &list); err != nil || len(rest) > 0 {
+			return nil, errors.New("malformed SCT list extension")
+		}
+		s := cryptobyte.String(list)
+		var scts cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&scts) || !s.Empty() {
+			return nil, errors.New("malformed SCT list")
+		}
+		result := [][]byte{}
+		for !scts.Empty() {
+			var sct cryptobyte.String
+			if !scts.ReadUint16LengthPrefixed(&sct) {
+				return nil, errors.New("malformed SCT list")
+			}
+			result = append(result, sct)
+		}
+		return result, nil
+	}
+	return nil, nil
+}
+
+// removeSCTExtension re-encodes a DER TBS certificate without the SCT list
+// extension, leaving all other fields unchanged.
+func removeSCTExtension(rawTBS []byte) ([]byte, error) {
+	input := cryptobyte.String(rawTBS)
+	var tbs cryptobyte.String
+	if !input.ReadASN1(&tbs, cbasn1.SEQUENCE) || !input.Empty() {
+		return nil, errors.New("malformed TBS certificate")
+	}
+
+	var b cryptobyte.Builder
+	var err error
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !tbs.Empty() {
+			var field cryptobyte.String
+			var tag cbasn1.Tag
+			if !tbs.ReadAnyASN1Element(&field, &tag) {
+				err = errors.New("malformed TBS certificate")
+				return
+			}
+			extensionsTag := cbasn1.Tag(3).Constructed().ContextSpecific()
+			if tag != extensionsTag {
+				b.AddBytes(field)
+				continue
+			}
+			var wrapper, extensions cryptobyte.String
+			if !field.ReadASN1(&wrapper, extensionsTag) || !wrapper.ReadASN1(&extensions, cbasn1.SEQUENCE) {
+				err = errors.New("malformed extensions in TBS certificate")
+				return
+			}
+			b.AddASN1(extensionsTag, func(b *cryptobyte.Builder) {
+				b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					for !extensions.Empty() {
+						var ext, fields cryptobyte.String
+						var oid asn1.ObjectIdentifier
+						if !extensions.ReadASN1Element(&ext, cbasn1.SEQUENCE) {
+							err = errors.New("malformed extension in TBS certificate")
+							return
+						}
+						element := ext
+						if !element.ReadASN1(&fields, cbasn1.SEQUENCE) || !fields.ReadASN1ObjectIdentifier(&oid) {
+							err = errors.New("malformed extension in TBS certificate")
+							return
+						}
+						if !oid.Equal(oidExtensionSCT) {
+							b.AddBytes(ext)
+						}
+					}
+				})
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,243 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+type testCTLog struct {
+	key      *ecdsa.PrivateKey
+	id       [sha256.Size]byte
+	operator string
+}
+
+func newTestCTLog(t *testing.T, operator string) *testCTLog {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err, "should be able to marshal key")
+	return &testCTLog{key: key, id: sha256.Sum256(der), operator: operator}
+}
+
+// sign returns an SCT over the given entry, issued at the given time.
+func (l *testCTLog) sign(t *testing.T, entry []byte, issued time.Time) []byte {
+	timestamp := uint64(issued.UnixNano() / int64(time.Millisecond))
+	var signed cryptobyte.Builder
+	signed.AddUint8(sctVersionV1)
+	signed.AddUint8(sctSignatureTypeCert)
+	signed.AddUint32(uint32(timestamp >> 32))
+	signed.AddUint32(uint32(timestamp))
+	signed.AddBytes(entry)
+	signed.AddUint16(0)
+	hash := sha256.Sum256(signed.BytesOrPanic())
+	signature, err := ecdsa.SignASN1(rand.Reader, l.key, hash[:])
+	assert.Nil(t, err, "should be able to sign SCT")
+
+	var sct cryptobyte.Builder
+	sct.AddUint8(sctVersionV1)
+	sct.AddBytes(l.id[:])
+	sct.AddUint32(uint32(timestamp >> 32))
+	sct.AddUint32(uint32(timestamp))
+	sct.AddUint16(0)
+	sct.AddUint8(sctHashSHA256)
+	sct.AddUint8(sctSignatureECDSA)
+	sct.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(signature)
+	})
+	return sct.BytesOrPanic()
+}
+
+func writeTestCTLogList(t *testing.T, path string, logs ...*testCTLog) {
+	type entry struct {
+		Description string                       `json:"description"`
+		LogID       []byte                       `json:"log_id"`
+		Key         []byte                       `json:"key"`
+		State       map[string]map[string]string `json:"state"`
+	}
+	type operator struct {
+		Name string  `json:"name"`
+		Logs []entry `json:"logs"`
+	}
+	operators := []operator{}
+	for i, log := range logs {
+		key, _ := x509.MarshalPKIXPublicKey(&log.key.PublicKey)
+		operators = append(operators, operator{
+			Name: log.operator,
+			Logs: []entry{{
+				Description: "test log " + string(rune('a'+i)),
+				LogID:       log.id[:],
+				Key:         key,
+				State:       map[string]map[string]string{"usable": {"timestamp": "2020-01-01T00:00:00Z"}},
+			}},
+		})
+	}
+	data, err := json.Marshal(map[string]interface{}{"version": "1", "operators": operators})
+	assert.Nil(t, err, "should be able to marshal log list")
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644), "should be able to write log list")
+}
+
+// issueWithSCTs creates a certificate signed by the CA, with SCTs from the
+// given logs embedded.
+func (p *testPKI) issueWithSCTs(t *testing.T, logs ...*testCTLog) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.cert, &key.PublicKey, p.key)
+	assert.Nil(t, err, "should be able to create precertificate")
+	precert, _ := x509.ParseCertificate(der)
+	entry, err := precertEntry(precert, p.cert)
+	assert.Nil(t, err, "should be able to build precertificate entry")
+
+	var list cryptobyte.Builder
+	list.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, log := range logs {
+			sct := log.sign(t, entry, time.Now().Add(-time.Minute))
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(sct)
+			})
+		}
+	})
+	value, _ := asn1.Marshal(list.BytesOrPanic())
+	template.ExtraExtensions = []pkix.Extension{{Id: oidExtensionSCT, Value: value}}
+	der, err = x509.CreateCertificate(rand.Reader, template, p.cert, &key.PublicKey, p.key)
+	assert.Nil(t, err, "should be able to create certificate")
+	cert, _ := x509.ParseCertificate(der)
+
+	tbs, err := removeSCTExtension(cert.RawTBSCertificate)
+	assert.Nil(t, err, "should be able to remove SCT extension")
+	assert.Equal(t, precert.RawTBSCertificate, tbs, "TBS certificate without SCT extension should match precertificate")
+	return cert
+}
+
+func TestCTLogListTLSExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-ct")
+	assert.Nil(t, err, "should be able to create temp dir")
+	defer os.RemoveAll(dir)
+
+	first, second, unknown := newTestCTLog(t, "first"), newTestCTLog(t, "second"), newTestCTLog(t, "unknown")
+	path := filepath.Join(dir, "log_list.json")
+	writeTestCTLogList(t, path, first, second)
+
+	logs, err := LoadCTLogList(path, 2, newTestLogger(t))
+	assert.Nil(t, err, "should be able to load log list")
+
+	pki := newTestPKI(t)
+	leaf := pki.issue(t, "server", "", "").Leaf
+	state := func(scts ...[]byte) tls.ConnectionState {
+		return tls.ConnectionState{
+			VerifiedChains:              verifiedChain(leaf, pki.cert),
+			SignedCertificateTimestamps: scts,
+		}
+	}
+	issued := time.Now().Add(-time.Minute)
+
+	assert.Nil(t, logs.VerifyConnection(state(first.sign(t, x509Entry(leaf), issued), second.sign(t, x509Entry(leaf), issued))), "should accept SCTs from two operators")
+	assert.NotNil(t, logs.VerifyConnection(state(first.sign(t, x509Entry(leaf), issued))), "should reject single SCT")
+	assert.NotNil(t, logs.VerifyConnection(state(first.sign(t, x509Entry(leaf), issued), first.sign(t, x509Entry(leaf), issued))), "should count SCTs from the same log once")
+	assert.NotNil(t, logs.VerifyConnection(state(first.sign(t, x509Entry(leaf), issued), unknown.sign(t, x509Entry(leaf), issued))), "should ignore SCTs from unknown logs")
+	assert.NotNil(t, logs.VerifyConnection(state(first.sign(t, x509Entry(leaf), issued), second.sign(t, x509Entry(leaf), time.Now().Add(time.Hour)))), "should ignore SCTs issued in the future")
+	assert.NotNil(t, logs.VerifyConnection(state()), "should reject certificate without SCTs")
+	assert.NotNil(t, logs.VerifyConnection(tls.ConnectionState{}), "should reject without verified chain")
+
+	// SCTs must be for the certificate
+	other := pki.issue(t, "other", "", "").Leaf
+	assert.NotNil(t, logs.VerifyConnection(state(first.sign(t, x509Entry(other), issued), second.sign(t, x509Entry(other), issued))), "should reject SCTs for other certificate")
+	assert.NotNil(t, logs.VerifyConnection(state([]byte("garbage"), second.sign(t, x509Entry(leaf), issued))), "should ignore malformed SCTs")
+
+	// Reload picks up changes, failed reload keeps old log list
+	writeTestCTLogList(t, path, first, unknown)
+	assert.Nil(t, logs.Reload(), "should be able to reload log list")
+	assert.Nil(t, logs.VerifyConnection(state(first.sign(t, x509Entry(leaf), issued), unknown.sign(t, x509Entry(leaf), issued))), "should accept SCTs from logs added on reload")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("invalid"), 0644))
+	assert.NotNil(t, logs.Reload(), "should fail to reload invalid log list")
+	assert.Nil(t, logs.VerifyConnection(state(first.sign(t, x509Entry(leaf), issued), unknown.sign(t, x509Entry(leaf), issued))), "should keep old log list on failed reload")
+}
+
+func TestCTLogListEmbedded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-ct")
+	assert.Nil(t, err, "should be able to create temp dir")
+	defer os.RemoveAll(dir)
+
+	first, second := newTestCTLog(t, "first"), newTestCTLog(t, "second")
+	path := filepath.Join(dir, "log_list.json")
+	writeTestCTLogList(t, path, first, second)
+
+	logs, err := LoadCTLogList(path, 2, newTestLogger(t))
+	assert.Nil(t, err, "should be able to load log list")
+
+	pki := newTestPKI(t)
+	leaf := pki.issueWithSCTs(t, first, second)
+	assert.Nil(t, logs.VerifyConnection(tls.ConnectionState{VerifiedChains: verifiedChain(leaf, pki.cert)}), "should accept embedded SCTs")
+
+	// Embedded SCTs are bound to the issuer key
+	other := newTestPKI(t)
+	assert.NotNil(t, logs.VerifyConnection(tls.ConnectionState{VerifiedChains: verifiedChain(leaf, other.cert)}), "should reject embedded SCTs with other issuer")
+
+	leaf = pki.issueWithSCTs(t, first)
+	assert.NotNil(t, logs.VerifyConnection(tls.ConnectionState{VerifiedChains: verifiedChain(leaf, pki.cert)}), "should reject single embedded SCT")
+
+	logs, err = LoadCTLogList(path, 1, newTestLogger(t))
+	assert.Nil(t, err, "should be able to load log list")
+	assert.Nil(t, logs.VerifyConnection(tls.ConnectionState{VerifiedChains: verifiedChain(leaf, pki.cert)}), "should accept single embedded SCT if only one is required")
+}
+
+func TestCTLogListInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-ct")
+	assert.Nil(t, err, "should be able to create temp dir")
+	defer os.RemoveAll(dir)
+
+	_, err = LoadCTLogList(filepath.Join(dir, "missing.json"), 2, newTestLogger(t))
+	assert.NotNil(t, err, "should fail to load missing log list")
+
+	path := filepath.Join(dir, "empty.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"operators": []}`), 0644))
+	_, err = LoadCTLogList(path, 2, newTestLogger(t))
+	assert.NotNil(t, err, "should fail to load log list without logs")
+
+	path = filepath.Join(dir, "mismatch.json")
+	log := newTestCTLog(t, "test")
+	log.id[0] ^= 0xff
+	writeTestCTLogList(t, path, log)
+	_, err = LoadCTLogList(path, 2, newTestLogger(t))
+	assert.NotNil(t, err, "should fail to load log list with log ID not matching key")
+}
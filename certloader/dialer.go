@@ -66,6 +66,14 @@ func dialWithDialer(dialer Dialer, timeout time.Duration, network, addr string,
 		return nil, err
 	}
 
+	// If no ServerName is set, infer it from the address (as tls.DialWithDialer does)
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+
 	conn := tls.Client(rawConn, config)
 	go func() {
 		errChannel <- conn.Handshake()
@@ -0,0 +1,373 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+)
+
+// DTLSListener wraps a datagram listener (see the socket package for UDP),
+// wrapping incoming sessions in DTLS. Like Listener, it fetches the current
+// server configuration on each new session to pick up reloaded certificates.
+type DTLSListener struct {
+	net.Listener
+
+	config TLSServerConfig
+	psk    PSKCallback
+	keyLog io.Writer
+}
+
+// PSKCallback returns the pre-shared key for the identity sent by the peer,
+// or an error if the identity is unknown or not allowed.
+type PSKCallback func(identity []byte) ([]byte, error)
+
+// NewDTLSListener creates a new DTLS listener on top of the given listener.
+func NewDTLSListener(listener net.Listener, config TLSServerConfig) *DTLSListener {
+	return &DTLSListener{
+		Listener: listener,
+		config:   config,
+	}
+}
+
+// NewPSKDTLSListener creates a new DTLS listener on top of the given listener,
+// which authenticates clients with pre-shared keys instead of certificates
+// (only PSK cipher suites are enabled). Session secrets are written to keyLog
+// if not nil, like with KeyLogWriter in tls.Config.
+func NewPSKDTLSListener(listener net.Listener, psk PSKCallback, keyLog io.Writer) *DTLSListener {
+	return &DTLSListener{
+		Listener: listener,
+		psk:      psk,
+		keyLog:   keyLog,
+	}
+}
+
+// Accept returns the next session. The DTLS handshake is performed on first
+// use (or via Handshake), so that a slow client can't block the accept loop.
+func (l *DTLSListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.psk != nil {
+		return &DTLSConn{inner: c, psk: l.psk, keyLog: l.keyLog}, nil
+	}
+	return &DTLSConn{inner: c, config: l.config.GetServerConfig()}, nil
+}
+
+type dtlsDialer struct {
+	config      TLSClientConfig
+	psk         PSKCallback
+	pskIdentity []byte
+	keyLog      io.Writer
+	timeout     time.Duration
+}
+
+// DTLSDialerWithCertificate creates a dialer that wraps UDP sessions in DTLS,
+// using the current client configuration for each new session.
+func DTLSDialerWithCertificate(config TLSClientConfig, timeout time.Duration) Dialer {
+	return &dtlsDialer{
+		config:  config,
+		timeout: timeout,
+	}
+}
+
+// DTLSDialerWithPSK creates a dialer that wraps UDP sessions in DTLS,
+// authenticated with the pre-shared key for the given identity (from psk)
+// instead of certificates. Session secrets are written to keyLog if not nil.
+func DTLSDialerWithPSK(identity string, psk PSKCallback, keyLog io.Writer, timeout time.Duration) Dialer {
+	return &dtlsDialer{
+		psk:         psk,
+		pskIdentity: []byte(identity),
+		keyLog:      keyLog,
+		timeout:     timeout,
+	}
+}
+
+func (d *dtlsDialer) Dial(network, address string) (net.Conn, error) {
+	rawConn, err := net.DialTimeout(network, address, d.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &DTLSConn{inner: rawConn, psk: d.psk, pskIdentity: d.pskIdentity, keyLog: d.keyLog, isClient: true}
+	if d.psk == nil {
+		conn.config = d.config.GetClientConfig()
+	}
+	conn.SetDeadline(time.Now().Add(d.timeout))
+	err = conn.Handshake()
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// DTLSConn is a DTLS session over a datagram connection.
+type DTLSConn struct {
+	inner    net.Conn
+	config   *tls.Config
+	isClient bool
+	// Pre-shared key callback and identity (clients only), if sessions are
+	// authenticated with PSKs instead of config
+	psk         PSKCallback
+	pskIdentity []byte
+	keyLog      io.Writer
+
+	mu       sync.Mutex
+	deadline time.Time
+	once     sync.Once
+	conn     *dtls.Conn
+	err      error
+}
+
+// Handshake runs the DTLS handshake if it has not been run yet. Deadlines set
+// before calling Handshake apply to the handshake.
+func (c *DTLSConn) Handshake() error {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+
+		var config *dtls.Config
+		var err error
+		if c.psk != nil {
+			config = dtlsPSKConfig(c.psk, c.pskIdentity, c.keyLog)
+		} else {
+			config, err = dtlsConfig(c.config, c.isClient)
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+		config.ConnectContextMaker = func() (context.Context, func()) {
+			if deadline.IsZero() {
+				return context.WithCancel(context.Background())
+			}
+			return context.WithDeadline(context.Background(), deadline)
+		}
+
+		var conn *dtls.Conn
+		if c.isClient {
+			conn, err = dtls.Client(c.inner, config)
+		} else {
+			conn, err = dtls.Server(c.inner, config)
+		}
+
+		if err == nil {
+			// The handshake deadline must not carry over to the session, the
+			// DTLS library keeps reading from the underlying connection.
+			err = c.inner.SetDeadline(time.Time{})
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.conn, c.err = conn, err
+	})
+	return c.err
+}
+
+// ConnectionState returns basic information about the DTLS session, in the
+// same format as for TLS connections.
+func (c *DTLSConn) ConnectionState() tls.ConnectionState {
+	state := tls.ConnectionState{}
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return state
+	}
+
+	state.HandshakeComplete = true
+	for _, raw := range conn.ConnectionState().PeerCertificates {
+		cert, err := x509.ParseCertificate(raw)
+		if err == nil {
+			state.PeerCertificates = append(state.PeerCertificates, cert)
+		}
+	}
+	return state
+}
+
+// ExportKeyingMaterial exports keying material from the DTLS session, as
+// defined in RFC 5705 (extended master secrets are always required, so this
+// is safe to use for channel bindings).
+func (c *DTLSConn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil, errors.New("handshake not completed")
+	}
+	state := conn.ConnectionState()
+	return state.ExportKeyingMaterial(label, context, length)
+}
+
+// PSKIdentity returns the identity of the pre-shared key the client
+// authenticated with, on sessions accepted by a PSK listener (empty
+// otherwise).
+func (c *DTLSConn) PSKIdentity() string {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil || c.psk == nil || c.isClient {
+		return ""
+	}
+	return string(conn.ConnectionState().IdentityHint)
+}
+
+func (c *DTLSConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.conn.Read(b)
+}
+
+func (c *DTLSConn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.conn.Write(b)
+}
+
+func (c *DTLSConn) Close() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		return conn.Close()
+	}
+	return c.inner.Close()
+}
+
+func (c *DTLSConn) LocalAddr() net.Addr {
+	return c.inner.LocalAddr()
+}
+
+func (c *DTLSConn) RemoteAddr() net.Addr {
+	return c.inner.RemoteAddr()
+}
+
+func (c *DTLSConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	}
+	c.deadline = t
+	return c.inner.SetDeadline(t)
+}
+
+func (c *DTLSConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return c.inner.SetReadDeadline(t)
+}
+
+func (c *DTLSConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return c.inner.SetWriteDeadline(t)
+}
+
+// dtlsConfig converts a TLS configuration into an equivalent DTLS configuration.
+// Only DTLS 1.2 is supported and cipher suite settings are not carried over,
+// the DTLS library only implements a small set of modern cipher suites.
+func dtlsConfig(config *tls.Config, isClient bool) (*dtls.Config, error) {
+	var cert *tls.Certificate
+	var err error
+	switch {
+	case len(config.Certificates) > 0:
+		cert = &config.Certificates[0]
+	case isClient && config.GetClientCertificate != nil:
+		cert, err = config.GetClientCertificate(&tls.CertificateRequestInfo{})
+	case !isClient && config.GetCertificate != nil:
+		cert, err = config.GetCertificate(&tls.ClientHelloInfo{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &dtls.Config{
+		RootCAs:               config.RootCAs,
+		ClientCAs:             config.ClientCAs,
+		ServerName:            config.ServerName,
+		InsecureSkipVerify:    config.InsecureSkipVerify,
+		VerifyPeerCertificate: config.VerifyPeerCertificate,
+		ExtendedMasterSecret:  dtls.RequireExtendedMasterSecret,
+		KeyLogWriter:          config.KeyLogWriter,
+	}
+	if cert != nil && len(cert.Certificate) > 0 {
+		result.Certificates = []tls.Certificate{*cert}
+	}
+
+	switch config.ClientAuth {
+	case tls.NoClientCert:
+		result.ClientAuth = dtls.NoClientCert
+	case tls.RequestClientCert:
+		result.ClientAuth = dtls.RequestClientCert
+	case tls.RequireAnyClientCert:
+		result.ClientAuth = dtls.RequireAnyClientCert
+	case tls.VerifyClientCertIfGiven:
+		result.ClientAuth = dtls.VerifyClientCertIfGiven
+	case tls.RequireAndVerifyClientCert:
+		result.ClientAuth = dtls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.New("unsupported client auth type for DTLS")
+	}
+
+	return result, nil
+}
+
+// dtlsPSKConfig returns a DTLS configuration for sessions authenticated with
+// pre-shared keys. Clients send the given identity, and look up the key for it
+// (the library passes the server's identity hint instead). The DTLS library
+// only implements plain PSK cipher suites (without ECDHE), CCM_8 is included
+// for constrained devices (e.g. CoAP).
+func dtlsPSKConfig(psk PSKCallback, identity []byte, keyLog io.Writer) *dtls.Config {
+	callback := dtls.PSKCallback(psk)
+	if identity != nil {
+		callback = func([]byte) ([]byte, error) {
+			return psk(identity)
+		}
+	}
+	return &dtls.Config{
+		PSK:             callback,
+		PSKIdentityHint: identity,
+		CipherSuites: []dtls.CipherSuiteID{
+			dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+			dtls.TLS_PSK_WITH_AES_128_CCM,
+			dtls.TLS_PSK_WITH_AES_128_CCM_8,
+		},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		KeyLogWriter:         keyLog,
+	}
+}
@@ -0,0 +1,173 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pion/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDTLSRoundTrip(t *testing.T) {
+	file, err := ioutil.TempFile("", "ghostunnel-test")
+	assert.Nil(t, err, "temp file error")
+	defer os.Remove(file.Name())
+
+	_, err = file.Write([]byte(testCombinedCertificateAndKey))
+	assert.Nil(t, err, "temp file error")
+
+	cert, err := CertificateFromPEMFiles(file.Name(), file.Name(), "")
+	assert.Nil(t, err, "should read PEM file with certificate & private key")
+	source := TLSConfigSourceFromCertificate(cert)
+
+	// Test cert is not self-signed, so we only check that certs are exchanged.
+	serverConfig, err := source.GetServerConfig(&tls.Config{ClientAuth: tls.RequireAnyClientCert})
+	assert.Nil(t, err, "should get server config")
+	clientConfig, err := source.GetClientConfig(&tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "should get client config")
+
+	raw, err := udp.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err, "should listen on UDP")
+	listener := NewDTLSListener(raw, serverConfig)
+	defer listener.Close()
+
+	result := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		state := conn.(*DTLSConn).ConnectionState()
+		if len(state.PeerCertificates) == 0 {
+			result <- "no peer certificates"
+			return
+		}
+		conn.Write(buf[:n])
+		result <- state.PeerCertificates[0].Subject.CommonName
+	}()
+
+	dialer := DTLSDialerWithCertificate(clientConfig, 5*time.Second)
+	conn, err := dialer.Dial("udp", listener.Addr().String())
+	assert.Nil(t, err, "should complete DTLS handshake")
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err, "should write datagram")
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	assert.Nil(t, err, "should read echoed datagram")
+	assert.Equal(t, "hello", string(buf[:n]), "should preserve datagram")
+	assert.Equal(t, "server", <-result, "server should see client certificate")
+}
+
+func TestDTLSDialNoServer(t *testing.T) {
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen on UDP")
+	defer raw.Close()
+
+	cert, err := NoCertificate("")
+	assert.Nil(t, err, "should create empty certificate")
+	clientConfig, err := TLSConfigSourceFromCertificate(cert).GetClientConfig(&tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "should get client config")
+
+	dialer := DTLSDialerWithCertificate(clientConfig, 100*time.Millisecond)
+	_, err = dialer.Dial("udp", raw.LocalAddr().String())
+	assert.NotNil(t, err, "handshake should time out if nobody answers")
+}
+
+func TestDTLSPSKRoundTrip(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	psk := func(identity []byte) ([]byte, error) {
+		if string(identity) != "device" {
+			return nil, errors.New("unknown identity")
+		}
+		return key, nil
+	}
+
+	raw, err := udp.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err, "should listen on UDP")
+	listener := NewPSKDTLSListener(raw, psk, nil)
+	defer listener.Close()
+
+	result := make(chan string, 1)
+	exported := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				conn.Write(buf[:n])
+				result <- conn.(*DTLSConn).PSKIdentity()
+				ekm, _ := conn.(*DTLSConn).ExportKeyingMaterial("EXPORTER-Test", nil, 32)
+				exported <- ekm
+			}()
+		}
+	}()
+
+	dialer := DTLSDialerWithPSK("device", psk, nil, 5*time.Second)
+	conn, err := dialer.Dial("udp", listener.Addr().String())
+	assert.Nil(t, err, "should complete DTLS handshake with PSK")
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err, "should write datagram")
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	assert.Nil(t, err, "should read echoed datagram")
+	assert.Equal(t, "hello", string(buf[:n]), "should preserve datagram")
+	assert.Equal(t, "device", <-result, "server should see PSK identity")
+	ekm, err := conn.(*DTLSConn).ExportKeyingMaterial("EXPORTER-Test", nil, 32)
+	assert.Nil(t, err, "should export keying material")
+	assert.Len(t, ekm, 32)
+	assert.Equal(t, ekm, <-exported, "both sides should export the same keying material")
+
+	// Unknown identity or wrong key fail the handshake
+	dialer = DTLSDialerWithPSK("other", func([]byte) ([]byte, error) { return key, nil }, nil, time.Second)
+	_, err = dialer.Dial("udp", listener.Addr().String())
+	assert.NotNil(t, err, "should reject unknown PSK identity")
+
+	dialer = DTLSDialerWithPSK("device", func([]byte) ([]byte, error) { return []byte("fedcba9876543210"), nil }, nil, time.Second)
+	_, err = dialer.Dial("udp", listener.Addr().String())
+	assert.NotNil(t, err, "should reject wrong PSK")
+}
@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+type fallbackCertificate struct {
+	// Default certificate, also used for the trust store and server certificates
+	defaultCert Certificate
+	fallbacks   []Certificate
+}
+
+// CertificateWithFallbacks returns a Certificate that presents one of the
+// given certificates as a client certificate, depending on the CAs the server
+// advertises as acceptable in its certificate request. Certificates are tried
+// in order (default first), and the first one issued by an acceptable CA is
+// used. If none match, or the server doesn't advertise CAs, the default
+// certificate is used. The trust store always comes from the default
+// certificate.
+func CertificateWithFallbacks(defaultCert Certificate, fallbacks []Certificate) Certificate {
+	return &fallbackCertificate{
+		defaultCert: defaultCert,
+		fallbacks:   fallbacks,
+	}
+}
+
+// Reload reloads all certificates. Certificates that fail to reload keep their
+// old state, the first error is returned.
+func (c *fallbackCertificate) Reload() error {
+	err := c.defaultCert.Reload()
+	for _, fallback := range c.fallbacks {
+		if fallbackErr := fallback.Reload(); err == nil {
+			err = fallbackErr
+		}
+	}
+	return err
+}
+
+// GetCertificate returns the default certificate.
+func (c *fallbackCertificate) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.defaultCert.GetCertificate(clientHello)
+}
+
+// GetClientCertificate returns the first certificate acceptable to the server.
+func (c *fallbackCertificate) GetClientCertificate(certInfo *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if certInfo == nil || len(certInfo.AcceptableCAs) == 0 {
+		return c.defaultCert.GetClientCertificate(certInfo)
+	}
+	for _, candidate := range append([]Certificate{c.defaultCert}, c.fallbacks...) {
+		cert, err := candidate.GetClientCertificate(certInfo)
+		if err != nil || cert == nil || len(cert.Certificate) == 0 {
+			continue
+		}
+		if certInfo.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return c.defaultCert.GetClientCertificate(certInfo)
+}
+
+// GetTrustStore returns the trust store of the default certificate.
+func (c *fallbackCertificate) GetTrustStore() *x509.CertPool {
+	return c.defaultCert.GetTrustStore()
+}
@@ -0,0 +1,75 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertificateWithFallbacks(t *testing.T) {
+	defaultPKI := newNamedTestPKI(t, "default ca")
+	fooPKI := newNamedTestPKI(t, "foo ca")
+	barPKI := newNamedTestPKI(t, "bar ca")
+	otherPKI := newNamedTestPKI(t, "other ca")
+
+	defaultCert := &staticCertificate{cert: defaultPKI.issue(t, "default", "", "")}
+	fooCert := &staticCertificate{cert: fooPKI.issue(t, "foo", "", "")}
+	barCert := &staticCertificate{cert: barPKI.issue(t, "bar", "", "")}
+	cert := CertificateWithFallbacks(defaultCert, []Certificate{fooCert, barCert})
+
+	request := func(cas ...*testPKI) *tls.CertificateRequestInfo {
+		info := &tls.CertificateRequestInfo{
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			Version:          tls.VersionTLS13,
+		}
+		for _, ca := range cas {
+			info.AcceptableCAs = append(info.AcceptableCAs, ca.cert.RawSubject)
+		}
+		return info
+	}
+
+	for expected, info := range map[string]*tls.CertificateRequestInfo{
+		"foo":     request(fooPKI),
+		"bar":     request(otherPKI, barPKI),
+		"default": request(defaultPKI, fooPKI),
+	} {
+		client, err := cert.GetClientCertificate(info)
+		assert.Nil(t, err, "should get client certificate")
+		assert.Equal(t, expected, client.Leaf.Subject.CommonName, "should present %s certificate", expected)
+	}
+
+	for name, info := range map[string]*tls.CertificateRequestInfo{
+		"no acceptable CAs":      request(),
+		"no matching CAs":        request(otherPKI),
+		"no certificate request": nil,
+	} {
+		client, err := cert.GetClientCertificate(info)
+		assert.Nil(t, err, "should get client certificate")
+		assert.Equal(t, "default", client.Leaf.Subject.CommonName, "should present default certificate with %s", name)
+	}
+
+	served, err := cert.GetCertificate(nil)
+	assert.Nil(t, err, "should get certificate")
+	assert.Equal(t, "default", served.Leaf.Subject.CommonName, "should serve default certificate")
+
+	assert.Nil(t, cert.Reload(), "should reload")
+	assert.Equal(t, 1, defaultCert.reloads, "should reload default certificate")
+	assert.Equal(t, 1, barCert.reloads, "should reload fallback certificates")
+}
@@ -0,0 +1,124 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Prefixes for keystore paths that refer to the OS certificate store instead
+// of a file: keychain:NAME on macOS, certstore:STORE/SELECTOR on Windows.
+const (
+	keychainPrefix  = "keychain:"
+	certstorePrefix = "certstore:"
+)
+
+// The only Windows certificate store we can open (the current user's
+// personal store).
+const certstoreDefaultStore = "My"
+
+// IdentitySelector selects an identity (certificate and private key) from
+// the OS certificate store, by common name or by certificate fingerprint.
+type IdentitySelector struct {
+	// Common name of the leaf certificate
+	CommonName string
+	// SHA-1 (thumbprint) or SHA-256 hash of the leaf certificate
+	Fingerprint []byte
+}
+
+// IsIdentityKeystore returns true if the keystore path refers to the OS
+// certificate store (keychain:... or certstore:...) instead of a file.
+func IsIdentityKeystore(keystore string) bool {
+	return strings.HasPrefix(keystore, keychainPrefix) || strings.HasPrefix(keystore, certstorePrefix)
+}
+
+// ParseIdentitySelector parses a keystore path referring to the OS
+// certificate store. Supported forms are:
+//
+//	keychain:NAME              identity with common name NAME
+//	keychain:CN=NAME           same as above
+//	keychain:SHA256=HEX        identity with the given fingerprint
+//	certstore:My/CN=NAME       identity in the My store with common name NAME
+//	certstore:My/SHA1=HEX      identity in the My store with given thumbprint
+//	certstore:CN=NAME          same as certstore:My/CN=NAME
+func ParseIdentitySelector(keystore string) (IdentitySelector, error) {
+	var selector string
+	switch {
+	case strings.HasPrefix(keystore, keychainPrefix):
+		selector = strings.TrimPrefix(keystore, keychainPrefix)
+		if !strings.Contains(selector, "=") {
+			selector = "CN=" + selector
+		}
+	case strings.HasPrefix(keystore, certstorePrefix):
+		selector = strings.TrimPrefix(keystore, certstorePrefix)
+		if i := strings.Index(selector, "/"); i >= 0 && !strings.Contains(selector[:i], "=") {
+			if !strings.EqualFold(selector[:i], certstoreDefaultStore) {
+				return IdentitySelector{}, fmt.Errorf("unsupported certificate store '%s' (only %s is supported)", selector[:i], certstoreDefaultStore)
+			}
+			selector = selector[i+1:]
+		}
+	default:
+		return IdentitySelector{}, fmt.Errorf("invalid identity '%s', must start with %s or %s", keystore, keychainPrefix, certstorePrefix)
+	}
+
+	parts := strings.SplitN(selector, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return IdentitySelector{}, fmt.Errorf("invalid identity selector '%s'", selector)
+	}
+	switch strings.ToUpper(parts[0]) {
+	case "CN":
+		return IdentitySelector{CommonName: parts[1]}, nil
+	case "SHA1", "SHA256":
+		// Allow colons/spaces, as in fingerprints copied from cert viewers
+		fingerprint, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(parts[1]))
+		size := sha1.Size
+		if strings.ToUpper(parts[0]) == "SHA256" {
+			size = sha256.Size
+		}
+		if err != nil || len(fingerprint) != size {
+			return IdentitySelector{}, fmt.Errorf("invalid %s fingerprint '%s'", parts[0], parts[1])
+		}
+		return IdentitySelector{Fingerprint: fingerprint}, nil
+	}
+	return IdentitySelector{}, fmt.Errorf("invalid identity selector '%s', must be CN=, SHA1= or SHA256=", selector)
+}
+
+// Matches returns true if the given leaf certificate matches the selector.
+func (s IdentitySelector) Matches(cert *x509.Certificate) bool {
+	switch len(s.Fingerprint) {
+	case sha1.Size:
+		hash := sha1.Sum(cert.Raw)
+		return bytes.Equal(hash[:], s.Fingerprint)
+	case sha256.Size:
+		hash := sha256.Sum256(cert.Raw)
+		return bytes.Equal(hash[:], s.Fingerprint)
+	}
+	return cert.Subject.CommonName == s.CommonName
+}
+
+func (s IdentitySelector) String() string {
+	if len(s.Fingerprint) > 0 {
+		return fmt.Sprintf("fingerprint %x", s.Fingerprint)
+	}
+	return fmt.Sprintf("common name '%s'", s.CommonName)
+}
@@ -0,0 +1,68 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIdentitySelector(t *testing.T) {
+	cert := newTestPKI(t).issue(t, "My Identity", "", "").Leaf
+	sha1Hash := sha1.Sum(cert.Raw)
+	sha256Hash := sha256.Sum256(cert.Raw)
+
+	matching := []string{
+		"keychain:My Identity",
+		"keychain:CN=My Identity",
+		fmt.Sprintf("keychain:SHA256=%x", sha256Hash),
+		"certstore:My/CN=My Identity",
+		"certstore:my/cn=My Identity",
+		"certstore:CN=My Identity",
+		fmt.Sprintf("certstore:My/SHA1=%x", sha1Hash),
+		fmt.Sprintf("certstore:My/SHA1=% x", sha1Hash),
+	}
+	for _, keystore := range matching {
+		assert.True(t, IsIdentityKeystore(keystore), "should be identity keystore: %s", keystore)
+		selector, err := ParseIdentitySelector(keystore)
+		assert.Nil(t, err, "should parse %s", keystore)
+		assert.True(t, selector.Matches(cert), "should match %s", keystore)
+	}
+
+	selector, err := ParseIdentitySelector("keychain:Other")
+	assert.Nil(t, err, "should parse selector")
+	assert.False(t, selector.Matches(cert), "should not match other common name")
+
+	invalid := []string{
+		"keychain:",
+		"certstore:My/",
+		"certstore:Root/CN=foo",
+		"certstore:My/OU=foo",
+		"certstore:My/SHA1=abcd",
+		"keychain:SHA256=zz",
+		"/path/to/keystore.p12",
+	}
+	for _, keystore := range invalid {
+		_, err := ParseIdentitySelector(keystore)
+		assert.NotNil(t, err, "should reject %s", keystore)
+	}
+	assert.False(t, IsIdentityKeystore("/path/to/keystore.p12"), "file should not be identity keystore")
+}
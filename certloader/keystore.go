@@ -41,10 +41,18 @@ type keystoreCertificate struct {
 
 // CertificateFromPEMFiles creates a reloadable certificate from a set of PEM files.
 func CertificateFromPEMFiles(certificatePath, keyPath, caBundlePath string) (Certificate, error) {
+	return CertificateFromPEMFilesWithPassword(certificatePath, keyPath, "", caBundlePath)
+}
+
+// CertificateFromPEMFilesWithPassword creates a reloadable certificate from a
+// set of PEM files, where the private key may be encrypted with the given
+// passphrase.
+func CertificateFromPEMFilesWithPassword(certificatePath, keyPath, keyPassword, caBundlePath string) (Certificate, error) {
 	c := keystoreCertificate{
-		keystorePaths: []string{certificatePath, keyPath},
-		caBundlePath:  caBundlePath,
-		format:        "PEM",
+		keystorePaths:    []string{certificatePath, keyPath},
+		keystorePassword: keyPassword,
+		caBundlePath:     caBundlePath,
+		format:           "PEM",
 	}
 	err := c.Reload()
 	if err != nil {
@@ -53,7 +61,9 @@ func CertificateFromPEMFiles(certificatePath, keyPath, caBundlePath string) (Cer
 	return &c, nil
 }
 
-// CertificateFromKeystore creates a reloadable certificate from a PKCS#12 keystore.
+// CertificateFromKeystore creates a reloadable certificate from a PKCS#12
+// keystore, or a PEM file with certificate chain and (possibly encrypted)
+// private key.
 func CertificateFromKeystore(keystorePath, keystorePassword, caBundlePath string) (Certificate, error) {
 	c := keystoreCertificate{
 		keystorePaths:    []string{keystorePath},
@@ -81,6 +91,10 @@ func (c *keystoreCertificate) Reload() error {
 
 	var pemBytes []byte
 	for _, block := range pemBlocks {
+		block, err := decryptPEMBlock(block, c.keystorePassword)
+		if err != nil {
+			return err
+		}
 		pemBytes = append(pemBytes, pem.EncodeToMemory(block)...)
 	}
 
@@ -0,0 +1,196 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// KMSConfig describes a private key stored in a cloud key management service.
+type KMSConfig struct {
+	// Key URI, one of:
+	//   awskms:///KEY (key ID, ARN or alias, e.g. awskms:///alias/ghostunnel)
+	//   awskms://ENDPOINT/KEY (custom endpoint, e.g. for VPC endpoints)
+	//   gcpkms://projects/P/locations/L/keyRings/R/cryptoKeys/K/cryptoKeyVersions/V
+	Key string
+	// HTTP client for talking to the KMS (optional)
+	Client *http.Client
+}
+
+// kmsBackend is a private key in a KMS.
+type kmsBackend interface {
+	// publicKey fetches the public key from the KMS.
+	publicKey() (crypto.PublicKey, error)
+	// sign signs a digest with the private key, returning the signature in
+	// the format expected by crypto/tls (ASN.1 for ECDSA).
+	sign(digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+type kmsCertificate struct {
+	// Certificate chain corresponding to key
+	certificatePath string
+	// Root CA bundle path
+	caBundlePath string
+	// Key in the KMS
+	signer *kmsSigner
+	// Cached *tls.Certificate
+	cachedCertificate unsafe.Pointer
+	// Cached *x509.CertPool
+	cachedCertPool unsafe.Pointer
+}
+
+// IsKMSKey returns true if the given string is a KMS key URI.
+func IsKMSKey(key string) bool {
+	return strings.HasPrefix(key, "awskms://") || strings.HasPrefix(key, "gcpkms://")
+}
+
+// CertificateFromKMS creates a reloadable certificate with the certificate
+// chain read from a file, and the private key kept in AWS KMS or Google Cloud
+// KMS. Handshake signatures are computed remotely by the KMS. The public key
+// is fetched once, to check that the certificate matches. Reloading re-reads
+// the certificate chain; the key must stay the same.
+func CertificateFromKMS(certificatePath, caBundlePath string, config KMSConfig, logger Logger) (Certificate, error) {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	backend, err := newKMSBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	return newKMSCertificate(certificatePath, caBundlePath, backend, logger)
+}
+
+func newKMSCertificate(certificatePath, caBundlePath string, backend kmsBackend, logger Logger) (Certificate, error) {
+	public, err := backend.publicKey()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get public key from KMS: %s", err)
+	}
+
+	c := &kmsCertificate{
+		certificatePath: certificatePath,
+		caBundlePath:    caBundlePath,
+		signer:          &kmsSigner{public: public, backend: backend, logger: logger},
+	}
+	err = c.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newKMSBackend(config KMSConfig) (kmsBackend, error) {
+	parsed, err := url.Parse(config.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KMS key '%s': %s", config.Key, err)
+	}
+	switch parsed.Scheme {
+	case "awskms":
+		return newAWSKMS(parsed.Host, strings.TrimPrefix(parsed.Path, "/"), config.Client)
+	case "gcpkms":
+		return newGCPKMS(parsed.Host+parsed.Path, config.Client)
+	}
+	return nil, fmt.Errorf("invalid KMS key '%s', must start with awskms:// or gcpkms://", config.Key)
+}
+
+// Reload transparently reloads the certificate.
+func (c *kmsCertificate) Reload() error {
+	certs, err := readX509(c.certificatePath)
+	if err != nil {
+		return err
+	}
+
+	leafKey, err := x509.MarshalPKIXPublicKey(certs[0].PublicKey)
+	if err != nil {
+		return err
+	}
+	kmsKey, err := x509.MarshalPKIXPublicKey(c.signer.public)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(leafKey, kmsKey) {
+		return errors.New("certificate doesn't match public key of key in KMS")
+	}
+
+	certAndKey := tls.Certificate{
+		Leaf:       certs[0],
+		PrivateKey: c.signer,
+	}
+	for _, cert := range certs {
+		certAndKey.Certificate = append(certAndKey.Certificate, cert.Raw)
+	}
+
+	bundle, err := LoadTrustStore(c.caBundlePath)
+	if err != nil {
+		return err
+	}
+
+	atomic.StorePointer(&c.cachedCertificate, unsafe.Pointer(&certAndKey))
+	atomic.StorePointer(&c.cachedCertPool, unsafe.Pointer(bundle))
+
+	return nil
+}
+
+// GetCertificate retrieves the actual underlying tls.Certificate.
+func (c *kmsCertificate) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return (*tls.Certificate)(atomic.LoadPointer(&c.cachedCertificate)), nil
+}
+
+// GetClientCertificate retrieves the actual underlying tls.Certificate.
+func (c *kmsCertificate) GetClientCertificate(certInfo *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return (*tls.Certificate)(atomic.LoadPointer(&c.cachedCertificate)), nil
+}
+
+// GetTrustStore returns the most up-to-date version of the trust store / CA bundle.
+func (c *kmsCertificate) GetTrustStore() *x509.CertPool {
+	return (*x509.CertPool)(atomic.LoadPointer(&c.cachedCertPool))
+}
+
+// kmsSigner is a crypto.Signer for a key in a KMS.
+type kmsSigner struct {
+	public  crypto.PublicKey
+	backend kmsBackend
+	logger  Logger
+}
+
+// Public returns the public key.
+func (s *kmsSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs the digest with the key in the KMS.
+func (s *kmsSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() == 0 || len(digest) != opts.HashFunc().Size() {
+		return nil, errors.New("digest length doesn't match hash function")
+	}
+	signature, err := s.backend.sign(digest, opts)
+	if err != nil {
+		s.logger.Printf("error signing with key in KMS: %s", err)
+		return nil, err
+	}
+	return signature, nil
+}
@@ -0,0 +1,339 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default endpoint of the EC2 instance metadata service, for fetching
+// credentials of the instance role.
+const awsMetadataEndpoint = "http://169.254.169.254"
+
+// Refresh temporary credentials this long before they expire.
+const kmsCredentialRefreshMargin = 5 * time.Minute
+
+// awsKMS is a key in AWS KMS, used via the KMS JSON API with requests signed
+// with AWS Signature Version 4.
+type awsKMS struct {
+	keyID    string
+	region   string
+	endpoint string
+	client   *http.Client
+	// Instance metadata service, if no credentials are set in the environment
+	metadataEndpoint string
+	now              func() time.Time
+	// Public key, see publicKey()
+	public crypto.PublicKey
+
+	mu          sync.Mutex
+	credentials *awsCredentials
+}
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+type awsKMSError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// newAWSKMS creates an AWS KMS key. The region is taken from the key ARN, or
+// from AWS_REGION/AWS_DEFAULT_REGION. If endpoint is empty, the public
+// regional endpoint is used.
+func newAWSKMS(endpoint, keyID string, client *http.Client) (*awsKMS, error) {
+	if keyID == "" {
+		return nil, errors.New("invalid AWS KMS key, missing key ID")
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if parts := strings.Split(keyID, ":"); len(parts) >= 6 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("unable to determine region for AWS KMS key '%s' (use a key ARN, or set AWS_REGION)", keyID)
+	}
+
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("kms.%s.amazonaws.com", region)
+	}
+	metadata := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if metadata == "" {
+		metadata = awsMetadataEndpoint
+	}
+
+	return &awsKMS{
+		keyID:            keyID,
+		region:           region,
+		endpoint:         "https://" + endpoint,
+		client:           client,
+		metadataEndpoint: strings.TrimRight(metadata, "/"),
+		now:              time.Now,
+	}, nil
+}
+
+func (k *awsKMS) publicKey() (crypto.PublicKey, error) {
+	var resp struct {
+		PublicKey []byte
+		KeyUsage  string
+	}
+	err := k.call("TrentService.GetPublicKey", map[string]string{"KeyId": k.keyID}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.KeyUsage != "SIGN_VERIFY" {
+		return nil, fmt.Errorf("AWS KMS key '%s' is not a signing key (key usage %s)", k.keyID, resp.KeyUsage)
+	}
+	k.public, err = x509.ParsePKIXPublicKey(resp.PublicKey)
+	return k.public, err
+}
+
+func (k *awsKMS) sign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := k.signingAlgorithm(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Signature []byte
+	}
+	err = k.call("TrentService.Sign", map[string]interface{}{
+		"KeyId":            k.keyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": algorithm,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+// signingAlgorithm picks the KMS signing algorithm for the given options.
+// Signatures for ECDSA keys are ASN.1 encoded, as expected by crypto/tls.
+func (k *awsKMS) signingAlgorithm(opts crypto.SignerOpts) (string, error) {
+	hash := map[crypto.Hash]string{
+		crypto.SHA256: "SHA_256",
+		crypto.SHA384: "SHA_384",
+		crypto.SHA512: "SHA_512",
+	}[opts.HashFunc()]
+	if hash == "" {
+		return "", fmt.Errorf("unsupported hash function %s for AWS KMS", opts.HashFunc())
+	}
+
+	switch k.public.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA_" + hash, nil
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return "RSASSA_PSS_" + hash, nil
+		}
+		return "RSASSA_PKCS1_V1_5_" + hash, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T for AWS KMS", k.public)
+}
+
+// call sends a request to the KMS API, and decodes the JSON response.
+func (k *awsKMS) call(target string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	credentials, err := k.getCredentials()
+	if err != nil {
+		return fmt.Errorf("unable to get AWS credentials: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, k.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	signAWSRequest(req, body, credentials, k.region, "kms", k.now())
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr awsKMSError
+		json.Unmarshal(data, &kmsErr)
+		return fmt.Errorf("error from AWS KMS (status %d): %s %s", resp.StatusCode, kmsErr.Type, kmsErr.Message)
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("invalid response from AWS KMS: %s", err)
+	}
+	return nil
+}
+
+// getCredentials returns AWS credentials from the environment, or temporary
+// credentials for the instance role from the instance metadata service.
+func (k *awsKMS) getCredentials() (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.credentials != nil && k.now().Add(kmsCredentialRefreshMargin).Before(k.credentials.Expiration) {
+		return k.credentials, nil
+	}
+
+	// IMDSv2: get a session token first
+	req, err := http.NewRequest(http.MethodPut, k.metadataEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := k.metadata(req)
+	if err != nil {
+		return nil, err
+	}
+
+	path := k.metadataEndpoint + "/latest/meta-data/iam/security-credentials/"
+	req, _ = http.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	role, err := k.metadata(req)
+	if err != nil {
+		return nil, err
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, path+url.PathEscape(strings.TrimSpace(string(role))), nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	data, err := k.metadata(req)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := &awsCredentials{}
+	if err := json.Unmarshal(data, credentials); err != nil {
+		return nil, fmt.Errorf("invalid credentials from instance metadata: %s", err)
+	}
+	k.credentials = credentials
+	return credentials, nil
+}
+
+func (k *awsKMS) metadata(req *http.Request) ([]byte, error) {
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error from instance metadata service (status %d)", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 to the request.
+func signAWSRequest(req *http.Request, body []byte, credentials *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.Token)
+	}
+
+	// Sign all headers we set (sorted, lower-case)
+	names := []string{"content-type", "host", "x-amz-date"}
+	if credentials.Token != "" {
+		names = append(names, "x-amz-security-token")
+	}
+	if req.Header.Get("X-Amz-Target") != "" {
+		names = append(names, "x-amz-target")
+	}
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	bodyHash := sha256.Sum256(body)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := awsSigningKey(credentials.SecretAccessKey, date, region, service)
+	signature := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func awsSigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	key = hmacSHA256(key, []byte(region))
+	key = hmacSHA256(key, []byte(service))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
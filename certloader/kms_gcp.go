@@ -0,0 +1,215 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcpKMSEndpoint      = "https://cloudkms.googleapis.com"
+	gcpMetadataEndpoint = "http://metadata.google.internal"
+)
+
+// gcpKMS is a key version in Google Cloud KMS, used via the Cloud KMS REST
+// API. Access tokens are taken from GOOGLE_OAUTH_ACCESS_TOKEN, or requested
+// for the default service account from the GCE metadata server.
+type gcpKMS struct {
+	name     string
+	endpoint string
+	client   *http.Client
+	// Metadata server, if no token is set in the environment
+	metadataEndpoint string
+	now              func() time.Time
+	// Algorithm of the key (e.g. EC_SIGN_P256_SHA256), see publicKey()
+	algorithm string
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+type gcpKMSError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// newGCPKMS creates a Google Cloud KMS key, given the resource name of the
+// key version.
+func newGCPKMS(name string, client *http.Client) (*gcpKMS, error) {
+	if !strings.HasPrefix(name, "projects/") || !strings.Contains(name, "/cryptoKeyVersions/") {
+		return nil, fmt.Errorf("invalid Google Cloud KMS key '%s', must be projects/.../cryptoKeys/KEY/cryptoKeyVersions/VERSION", name)
+	}
+	metadata := gcpMetadataEndpoint
+	if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+		metadata = "http://" + host
+	}
+	return &gcpKMS{
+		name:             name,
+		endpoint:         gcpKMSEndpoint,
+		client:           client,
+		metadataEndpoint: metadata,
+		now:              time.Now,
+	}, nil
+}
+
+func (k *gcpKMS) publicKey() (crypto.PublicKey, error) {
+	var resp struct {
+		PEM       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	err := k.call(http.MethodGet, "/publicKey", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(resp.PEM))
+	if block == nil {
+		return nil, errors.New("invalid public key from Google Cloud KMS")
+	}
+	k.algorithm = resp.Algorithm
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// sign signs a digest. Cloud KMS keys have a fixed algorithm (hash and
+// padding), so we can only sign if the options match it.
+func (k *gcpKMS) sign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := map[crypto.Hash]string{
+		crypto.SHA256: "sha256",
+		crypto.SHA384: "sha384",
+		crypto.SHA512: "sha512",
+	}[opts.HashFunc()]
+	if hash == "" || !strings.HasSuffix(k.algorithm, "_"+strings.ToUpper(hash)) {
+		return nil, fmt.Errorf("hash function %s doesn't match algorithm %s of Google Cloud KMS key", opts.HashFunc(), k.algorithm)
+	}
+	_, pss := opts.(*rsa.PSSOptions)
+	if strings.HasPrefix(k.algorithm, "RSA_SIGN_") && pss != strings.HasPrefix(k.algorithm, "RSA_SIGN_PSS_") {
+		return nil, fmt.Errorf("signature padding doesn't match algorithm %s of Google Cloud KMS key", k.algorithm)
+	}
+
+	var resp struct {
+		Signature []byte `json:"signature"`
+	}
+	err := k.call(http.MethodPost, ":asymmetricSign", map[string]interface{}{
+		"digest": map[string][]byte{hash: digest},
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+// call sends a request for the key version to the Cloud KMS API, and decodes
+// the JSON response.
+func (k *gcpKMS) call(method, suffix string, request, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	token, err := k.getToken()
+	if err != nil {
+		return fmt.Errorf("unable to get Google Cloud access token: %s", err)
+	}
+
+	req, err := http.NewRequest(method, k.endpoint+"/v1/"+k.name+suffix, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr gcpKMSError
+		json.Unmarshal(data, &kmsErr)
+		return fmt.Errorf("error from Google Cloud KMS (status %d): %s", resp.StatusCode, kmsErr.Error.Message)
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return fmt.Errorf("invalid response from Google Cloud KMS: %s", err)
+	}
+	return nil
+}
+
+// getToken returns an access token, from the environment or the metadata
+// server. Tokens from the metadata server are cached until shortly before
+// they expire.
+func (k *gcpKMS) getToken() (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.token != "" && k.now().Add(kmsCredentialRefreshMargin).Before(k.tokenExpiry) {
+		return k.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, k.metadataEndpoint+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error from metadata server (status %d)", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("invalid token from metadata server: %s", err)
+	}
+	k.token = token.AccessToken
+	k.tokenExpiry = k.now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return k.token, nil
+}
@@ -0,0 +1,250 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAWSSigningKey(t *testing.T) {
+	// Example from AWS documentation for deriving a signing key
+	key := awsSigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	assert.Equal(t, "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d", hex.EncodeToString(key))
+}
+
+// newFakeAWSKMS serves GetPublicKey and Sign for the given key, and checks
+// that requests are signed with the given session token.
+func newFakeAWSKMS(t *testing.T, key crypto.Signer, token string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			r.Header.Get("X-Amz-Security-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"__type":"AccessDeniedException","message":"denied"}`))
+			return
+		}
+
+		var req struct {
+			Message          []byte
+			MessageType      string
+			SigningAlgorithm string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GetPublicKey":
+			der, _ := x509.MarshalPKIXPublicKey(key.Public())
+			json.NewEncoder(w).Encode(map[string]interface{}{"PublicKey": der, "KeyUsage": "SIGN_VERIFY"})
+		case "TrentService.Sign":
+			var opts crypto.SignerOpts = crypto.SHA256
+			switch req.SigningAlgorithm {
+			case "ECDSA_SHA_256", "RSASSA_PKCS1_V1_5_SHA_256":
+			case "RSASSA_PSS_SHA_256":
+				opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			assert.Equal(t, "DIGEST", req.MessageType)
+			signature, _ := key.Sign(rand.Reader, req.Message, opts)
+			json.NewEncoder(w).Encode(map[string]interface{}{"Signature": signature})
+		}
+	}))
+}
+
+// newFakeAWSMetadata serves instance role credentials via IMDSv2.
+func newFakeAWSMetadata(requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.URL.Path == "/latest/api/token" {
+			w.Write([]byte("imds-token"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("ghostunnel-role"))
+		case "/latest/meta-data/iam/security-credentials/ghostunnel-role":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"AccessKeyId":     "AKID",
+				"SecretAccessKey": "secret",
+				"Token":           "session-token",
+				"Expiration":      time.Now().Add(time.Hour),
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestAWSKMSCertificate(t *testing.T) {
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+
+	dir, err := ioutil.TempDir("", "ghostunnel-kms")
+	assert.Nil(t, err, "should create temp dir")
+	defer os.RemoveAll(dir)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	for _, key := range []crypto.Signer{ecKey, rsaKey} {
+		var requests int32
+		metadata := newFakeAWSMetadata(&requests)
+		defer metadata.Close()
+		server := newFakeAWSKMS(t, key, "session-token")
+		defer server.Close()
+
+		backend, err := newAWSKMS(strings.TrimPrefix(server.URL, "https://"), "arn:aws:kms:us-west-2:111122223333:key/1234", server.Client())
+		assert.Nil(t, err, "should create AWS KMS key")
+		assert.Equal(t, "us-west-2", backend.region, "should take region from ARN")
+		backend.metadataEndpoint = metadata.URL
+
+		cert, err := newKMSCertificate(writeSelfSignedCert(t, dir, key), "", backend, newTestLogger(t))
+		assert.Nil(t, err, "should load certificate with key in KMS")
+		tlsCert, _ := cert.GetCertificate(nil)
+		signer := tlsCert.PrivateKey.(crypto.Signer)
+
+		digest := sha256.Sum256([]byte("test"))
+		switch key := key.(type) {
+		case *ecdsa.PrivateKey:
+			signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+			assert.Nil(t, err, "should sign with KMS")
+			assert.True(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature), "should produce valid signature")
+		case *rsa.PrivateKey:
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			signature, err := signer.Sign(rand.Reader, digest[:], opts)
+			assert.Nil(t, err, "should sign with KMS")
+			assert.Nil(t, rsa.VerifyPSS(&key.PublicKey, crypto.SHA256, digest[:], signature, opts), "should produce valid PSS signature")
+			signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+			assert.Nil(t, err, "should sign with KMS")
+			assert.Nil(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature), "should produce valid PKCS#1 v1.5 signature")
+		}
+		assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "should cache instance credentials")
+
+		// Certificate for another key
+		other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		_, err = newKMSCertificate(writeSelfSignedCert(t, dir, other), "", backend, newTestLogger(t))
+		assert.NotNil(t, err, "should reject certificate that doesn't match key")
+	}
+}
+
+func TestAWSKMSInvalidCredentials(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := newFakeAWSKMS(t, key, "session-token")
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+
+	backend, err := newAWSKMS(strings.TrimPrefix(server.URL, "https://"), "arn:aws:kms:us-west-2:111122223333:key/1234", server.Client())
+	assert.Nil(t, err, "should create AWS KMS key")
+	_, err = backend.publicKey()
+	assert.NotNil(t, err, "should fail with invalid credentials")
+}
+
+func TestGCPKMSCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-kms")
+	assert.Nil(t, err, "should create temp dir")
+	defer os.RemoveAll(dir)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	name := "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"code":401,"message":"unauthenticated"}}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/" + name + "/publicKey":
+			der, _ := x509.MarshalPKIXPublicKey(key.Public())
+			json.NewEncoder(w).Encode(map[string]string{
+				"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+				"algorithm": "EC_SIGN_P256_SHA256",
+			})
+		case "/v1/" + name + ":asymmetricSign":
+			var req struct {
+				Digest struct {
+					SHA256 []byte `json:"sha256"`
+				} `json:"digest"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			signature, _ := key.Sign(rand.Reader, req.Digest.SHA256, crypto.SHA256)
+			json.NewEncoder(w).Encode(map[string][]byte{"signature": signature})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	backend, err := newGCPKMS(name, server.Client())
+	assert.Nil(t, err, "should create Google Cloud KMS key")
+	backend.endpoint = server.URL
+	backend.metadataEndpoint = server.URL
+
+	cert, err := newKMSCertificate(writeSelfSignedCert(t, dir, key), "", backend, newTestLogger(t))
+	assert.Nil(t, err, "should load certificate with key in KMS")
+	tlsCert, _ := cert.GetCertificate(nil)
+	signer := tlsCert.PrivateKey.(crypto.Signer)
+
+	digest := sha256.Sum256([]byte("test"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Nil(t, err, "should sign with KMS")
+	assert.True(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature), "should produce valid signature")
+
+	digest384 := make([]byte, crypto.SHA384.Size())
+	_, err = signer.Sign(rand.Reader, digest384, crypto.SHA384)
+	assert.NotNil(t, err, "should reject hash that doesn't match key algorithm")
+}
+
+func TestKMSInvalidKey(t *testing.T) {
+	for _, key := range []string{"awskms:///", "gcpkms://projects/p", "kms://foo", "gcpkms://foo/cryptoKeyVersions/1"} {
+		_, err := CertificateFromKMS("", "", KMSConfig{Key: key}, newTestLogger(t))
+		assert.NotNil(t, err, "should reject invalid key %s", key)
+	}
+	assert.True(t, IsKMSKey("awskms:///alias/test"))
+	assert.True(t, IsKMSKey("gcpkms://projects/p"))
+	assert.False(t, IsKMSKey("/path/to/key.pem"))
+}
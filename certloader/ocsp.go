@@ -0,0 +1,217 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// Interval for checking whether the OCSP staple needs to be refreshed.
+	ocspCheckInterval = time.Minute
+	// Interval for refreshing staples if the response has no next update time.
+	ocspDefaultRefreshInterval = time.Hour
+	// Maximum size of OCSP responses we accept.
+	ocspMaxResponseSize = 1 << 20
+)
+
+// fetchOCSP queries the OCSP responder of the given certificate.
+func fetchOCSP(client *http.Client, leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("certificate does not have an OCSP responder URL")
+	}
+
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	httpResp, err := client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder %s returned status %d", leaf.OCSPServer[0], httpResp.StatusCode)
+	}
+
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(nil, httpResp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, resp, nil
+}
+
+// ocspStaple is a certificate with a stapled OCSP response.
+type ocspStaple struct {
+	// Certificate the staple was fetched for
+	source *tls.Certificate
+	// Copy of the certificate with OCSPStaple set
+	stapled *tls.Certificate
+	// Time at which the staple should be refreshed
+	refreshAt time.Time
+	// Time at which the staple expires
+	expiresAt time.Time
+}
+
+type staplingCertificate struct {
+	Certificate
+	client *http.Client
+	logger Logger
+	// Cached *ocspStaple
+	cachedStaple unsafe.Pointer
+}
+
+// CertificateWithOCSPStapling wraps a certificate to staple OCSP responses
+// for it during handshakes. Responses are fetched from the OCSP responder
+// listed in the certificate, and refreshed halfway through their validity
+// period. The certificate chain must include the issuer of the leaf.
+func CertificateWithOCSPStapling(cert Certificate, client *http.Client, logger Logger) Certificate {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	c := &staplingCertificate{
+		Certificate: cert,
+		client:      client,
+		logger:      logger,
+	}
+	c.refresh()
+	go c.refreshPeriodically()
+	return c
+}
+
+// Reload reloads the underlying certificate and fetches a new staple.
+func (c *staplingCertificate) Reload() error {
+	err := c.Certificate.Reload()
+	if err != nil {
+		return err
+	}
+	c.refresh()
+	return nil
+}
+
+// GetCertificate returns the underlying certificate, with an OCSP staple if
+// we have a valid one.
+func (c *staplingCertificate) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := c.Certificate.GetCertificate(clientHello)
+	if err != nil || cert == nil {
+		return cert, err
+	}
+
+	staple := (*ocspStaple)(atomic.LoadPointer(&c.cachedStaple))
+	if staple != nil && staple.source == cert && time.Now().Before(staple.expiresAt) {
+		return staple.stapled, nil
+	}
+	return cert, nil
+}
+
+func (c *staplingCertificate) refreshPeriodically() {
+	for range time.Tick(ocspCheckInterval) {
+		c.refresh()
+	}
+}
+
+// refresh fetches a new staple if the current one is missing, outdated or
+// was fetched for a different certificate.
+func (c *staplingCertificate) refresh() {
+	cert, err := c.Certificate.GetCertificate(nil)
+	if err != nil || cert == nil {
+		return
+	}
+
+	staple := (*ocspStaple)(atomic.LoadPointer(&c.cachedStaple))
+	if staple != nil && staple.source == cert && time.Now().Before(staple.refreshAt) {
+		return
+	}
+
+	staple, err = c.fetch(cert)
+	if err != nil {
+		c.logger.Printf("error: unable to refresh OCSP staple: %s", err)
+		return
+	}
+	atomic.StorePointer(&c.cachedStaple, unsafe.Pointer(staple))
+}
+
+func (c *staplingCertificate) fetch(cert *tls.Certificate) (*ocspStaple, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("certificate chain does not include issuer")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+
+	raw, resp, err := fetchOCSP(c.client, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, fmt.Errorf("OCSP responder returned status %s for certificate", ocspStatusName(resp.Status))
+	}
+
+	now := time.Now()
+	staple := &ocspStaple{
+		source:    cert,
+		refreshAt: now.Add(ocspDefaultRefreshInterval),
+		expiresAt: now.Add(ocspDefaultRefreshInterval),
+	}
+	if !resp.NextUpdate.IsZero() {
+		staple.refreshAt = resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+		staple.expiresAt = resp.NextUpdate
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = raw
+	staple.stapled = &stapled
+	return staple, nil
+}
+
+func ocspStatusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
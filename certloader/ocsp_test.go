@@ -0,0 +1,241 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testPKI is a CA for tests that need certificates with OCSP/CRL extensions.
+type testPKI struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	return newNamedTestPKI(t, "test ca")
+}
+
+// newNamedTestPKI creates a test CA with the given common name.
+func newNamedTestPKI(t *testing.T, name string) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create CA certificate")
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err, "should be able to parse CA certificate")
+
+	return &testPKI{cert: cert, key: key, serial: 1}
+}
+
+// issue creates a certificate signed by the CA, with the given OCSP server
+// and CRL distribution point URLs (may be empty).
+func (p *testPKI) issue(t *testing.T, cn, ocspURL, crlURL string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	if ocspURL != "" {
+		template.OCSPServer = []string{ocspURL}
+	}
+	if crlURL != "" {
+		template.CRLDistributionPoints = []string{crlURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.cert, &key.PublicKey, p.key)
+	assert.Nil(t, err, "should be able to create certificate")
+	leaf, err := x509.ParseCertificate(der)
+	assert.Nil(t, err, "should be able to parse certificate")
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, p.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// newFakeOCSPResponder returns an OCSP responder for the test CA which
+// answers with the given status, and counts the requests it receives.
+func newFakeOCSPResponder(t *testing.T, p *testPKI, status int, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if !assert.Nil(t, err, "should send valid OCSP request") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		template := ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if status == ocsp.Revoked {
+			template.RevokedAt = time.Now().Add(-time.Minute)
+		}
+		resp, err := ocsp.CreateResponse(p.cert, p.cert, template, p.key)
+		assert.Nil(t, err, "should be able to create OCSP response")
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+}
+
+// staticCertificate is a Certificate that always returns the same certificate.
+type staticCertificate struct {
+	cert    *tls.Certificate
+	reloads int
+}
+
+func (c *staticCertificate) Reload() error {
+	c.reloads++
+	return nil
+}
+
+func (c *staticCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert, nil
+}
+
+func (c *staticCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.cert, nil
+}
+
+func (c *staticCertificate) GetTrustStore() *x509.CertPool {
+	return x509.NewCertPool()
+}
+
+func TestOCSPStapling(t *testing.T) {
+	pki := newTestPKI(t)
+	var requests int32
+	responder := newFakeOCSPResponder(t, pki, ocsp.Good, &requests)
+	defer responder.Close()
+
+	underlying := &staticCertificate{cert: pki.issue(t, "server", responder.URL, "")}
+	cert := CertificateWithOCSPStapling(underlying, nil, newTestLogger(t))
+
+	stapled, err := cert.GetCertificate(nil)
+	assert.Nil(t, err, "should be able to get certificate")
+	assert.NotEmpty(t, stapled.OCSPStaple, "certificate should have OCSP staple")
+	assert.Empty(t, underlying.cert.OCSPStaple, "should not modify underlying certificate")
+
+	resp, err := ocsp.ParseResponseForCert(stapled.OCSPStaple, underlying.cert.Leaf, pki.cert)
+	assert.Nil(t, err, "staple should be a valid OCSP response")
+	assert.Equal(t, ocsp.Good, resp.Status, "staple should have good status")
+
+	// Staple is cached until it has to be refreshed
+	cert.(*staplingCertificate).refresh()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "should cache OCSP response")
+
+	// Reload with new certificate fetches a new staple
+	underlying.cert = pki.issue(t, "server", responder.URL, "")
+	assert.Nil(t, cert.Reload(), "should be able to reload")
+	assert.Equal(t, 1, underlying.reloads, "should reload underlying certificate")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests), "should fetch new OCSP response on reload")
+
+	stapled, err = cert.GetCertificate(nil)
+	assert.Nil(t, err, "should be able to get certificate")
+	_, err = ocsp.ParseResponseForCert(stapled.OCSPStaple, underlying.cert.Leaf, pki.cert)
+	assert.Nil(t, err, "staple should be for new certificate")
+}
+
+func TestOCSPStaplingRevoked(t *testing.T) {
+	pki := newTestPKI(t)
+	var requests int32
+	responder := newFakeOCSPResponder(t, pki, ocsp.Revoked, &requests)
+	defer responder.Close()
+
+	underlying := &staticCertificate{cert: pki.issue(t, "server", responder.URL, "")}
+	cert := CertificateWithOCSPStapling(underlying, nil, newTestLogger(t))
+
+	stapled, err := cert.GetCertificate(nil)
+	assert.Nil(t, err, "should be able to get certificate")
+	assert.Empty(t, stapled.OCSPStaple, "should not staple non-good response")
+}
+
+func TestOCSPStaplingNoResponder(t *testing.T) {
+	pki := newTestPKI(t)
+	underlying := &staticCertificate{cert: pki.issue(t, "server", "", "")}
+	cert := CertificateWithOCSPStapling(underlying, nil, newTestLogger(t))
+
+	stapled, err := cert.GetCertificate(nil)
+	assert.Nil(t, err, "should be able to get certificate without staple")
+	assert.Equal(t, underlying.cert, stapled, "should return underlying certificate")
+}
+
+func TestOCSPStaplingHandshake(t *testing.T) {
+	pki := newTestPKI(t)
+	var requests int32
+	responder := newFakeOCSPResponder(t, pki, ocsp.Good, &requests)
+	defer responder.Close()
+
+	cert := CertificateWithOCSPStapling(&staticCertificate{cert: pki.issue(t, "server", responder.URL, "")}, nil, newTestLogger(t))
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: cert.GetCertificate})
+	assert.Nil(t, err, "should be able to listen")
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.cert)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	assert.Nil(t, err, "should be able to connect")
+	defer conn.Close()
+
+	assert.NotEmpty(t, conn.OCSPResponse(), "client should receive stapled OCSP response")
+}
@@ -0,0 +1,176 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// Supported PBKDF2 functions and ciphers (with their key length)
+var (
+	pbkdf2Functions = map[string]func() hash.Hash{
+		oidHMACWithSHA1.String():   sha1.New,
+		oidHMACWithSHA256.String(): sha256.New,
+		oidHMACWithSHA512.String(): sha512.New,
+	}
+	pbes2KeyLengths = map[string]int{
+		oidAES128CBC.String(): 16,
+		oidAES192CBC.String(): 24,
+		oidAES256CBC.String(): 32,
+	}
+)
+
+var (
+	errNoPassphrase  = errors.New("private key is encrypted, but no passphrase was given")
+	errBadPassphrase = errors.New("unable to decrypt private key, wrong passphrase?")
+)
+
+// PKCS#8 EncryptedPrivateKeyInfo, with PBES2 parameters (RFC 8018)
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPEMBlock decrypts an encrypted private key, either in PKCS#8 format
+// ("ENCRYPTED PRIVATE KEY", as written by openssl pkcs8/genpkey) or in the
+// legacy OpenSSL format (with "Proc-Type: 4,ENCRYPTED" header). Other blocks
+// are returned as-is.
+func decryptPEMBlock(block *pem.Block, passphrase string) (*pem.Block, error) {
+	// Legacy format is deprecated (insecure), but still common
+	legacy := x509.IsEncryptedPEMBlock(block)
+	if block.Type != "ENCRYPTED PRIVATE KEY" && !legacy {
+		return block, nil
+	}
+	if passphrase == "" {
+		return nil, errNoPassphrase
+	}
+
+	if legacy {
+		der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+		if err != nil {
+			return nil, errBadPassphrase
+		}
+		return &pem.Block{Type: block.Type, Bytes: der}, nil
+	}
+
+	der, err := decryptPKCS8(block.Bytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+}
+
+// decryptPKCS8 decrypts a PKCS#8 EncryptedPrivateKeyInfo, encrypted with
+// PBES2 (PBKDF2 and AES-CBC).
+func decryptPKCS8(data []byte, passphrase string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid encrypted private key: %s", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption %s (only PBES2 is supported)", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("invalid PBES2 parameters: %s", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function %s (only PBKDF2 is supported)", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("invalid PBKDF2 parameters: %s", err)
+	}
+
+	prf := sha1.New
+	if len(kdf.PRF.Algorithm) > 0 {
+		var ok bool
+		if prf, ok = pbkdf2Functions[kdf.PRF.Algorithm.String()]; !ok {
+			return nil, fmt.Errorf("unsupported PBKDF2 function %s", kdf.PRF.Algorithm)
+		}
+	}
+	keyLength, ok := pbes2KeyLengths[params.EncryptionScheme.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher %s (only AES-CBC is supported)", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid AES-CBC parameters")
+	}
+
+	key := pbkdf2.Key([]byte(passphrase), kdf.Salt, kdf.IterationCount, keyLength, prf)
+	block, _ := aes.NewCipher(key)
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted private key length")
+	}
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+
+	// Check and remove PKCS#7 padding. A wrong passphrase almost always
+	// results in invalid padding, or in garbage that doesn't parse.
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errBadPassphrase
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, errBadPassphrase
+		}
+	}
+	plaintext = plaintext[:len(plaintext)-padding]
+	if _, err := x509.ParsePKCS8PrivateKey(plaintext); err != nil {
+		return nil, errBadPassphrase
+	}
+	return plaintext, nil
+}
@@ -1,3 +1,4 @@
+//go:build !cgo || nopkcs11
 // +build !cgo nopkcs11
 
 /*-
@@ -27,6 +28,6 @@ func SupportsPKCS11() bool {
 }
 
 // CertificateFromPKCS11Module creates a reloadable certificate from a PKCS#11 module.
-func CertificateFromPKCS11Module(certificatePath, caBundlePath, modulePath, tokenLabel, pin string) (Certificate, error) {
+func CertificateFromPKCS11Module(certificatePath, caBundlePath, modulePath, tokenLabel, keyLabel, pin string, logger Logger) (Certificate, error) {
 	return nil, errors.New("not supported")
 }
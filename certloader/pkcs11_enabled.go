@@ -1,3 +1,4 @@
+//go:build cgo && !nopkcs11
 // +build cgo,!nopkcs11
 
 /*-
@@ -19,21 +20,31 @@
 package certloader
 
 import (
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
 	pkcs11key "github.com/letsencrypt/pkcs11key/v4"
+	"github.com/miekg/pkcs11"
 )
 
 type pkcs11Certificate struct {
-	// Certificate chain corresponding to key
+	// Certificate chain corresponding to key (if empty, the certificate is
+	// read from the token, see keyLabel)
 	certificatePath string
 	// Root CA bundle path
 	caBundlePath string
 	// Params for loading key from a PKCS#11 module
 	modulePath, tokenLabel, pin string
+	// Label of certificate object in the token (optional)
+	keyLabel string
+	logger   Logger
 	// Cached *tls.Certificate
 	cachedCertificate unsafe.Pointer
 	// Cached *x509.CertPool
@@ -46,14 +57,19 @@ func SupportsPKCS11() bool {
 	return true
 }
 
-// CertificateFromPKCS11Module creates a reloadable certificate from a PKCS#11 module.
-func CertificateFromPKCS11Module(certificatePath, caBundlePath, modulePath, tokenLabel, pin string) (Certificate, error) {
+// CertificateFromPKCS11Module creates a reloadable certificate from a PKCS#11
+// module. The slot is selected by token label. If no certificate path is
+// given, the certificate with the given object label is read from the token.
+// The private key is the one matching the certificate's public key.
+func CertificateFromPKCS11Module(certificatePath, caBundlePath, modulePath, tokenLabel, keyLabel, pin string, logger Logger) (Certificate, error) {
 	c := &pkcs11Certificate{
 		certificatePath: certificatePath,
 		caBundlePath:    caBundlePath,
 		modulePath:      modulePath,
 		tokenLabel:      tokenLabel,
 		pin:             pin,
+		keyLabel:        keyLabel,
+		logger:          logger,
 	}
 	err := c.Reload()
 	if err != nil {
@@ -66,7 +82,13 @@ func CertificateFromPKCS11Module(certificatePath, caBundlePath, modulePath, toke
 func (c *pkcs11Certificate) Reload() error {
 	// Expecting certificate file to only have certificate chain,
 	// with the (fixed) private key being in an HSM/PKCS11 module.
-	certs, err := readX509(c.certificatePath)
+	var certs []*x509.Certificate
+	var err error
+	if c.certificatePath != "" {
+		certs, err = readX509(c.certificatePath)
+	} else {
+		certs, err = readPKCS11Certificate(c.modulePath, c.tokenLabel, c.keyLabel, c.pin)
+	}
 	if err != nil {
 		return err
 	}
@@ -85,7 +107,10 @@ func (c *pkcs11Certificate) Reload() error {
 		old, _ := c.GetCertificate(nil)
 		certAndKey.PrivateKey = old.PrivateKey
 	} else {
-		privateKey, err := pkcs11key.New(c.modulePath, c.tokenLabel, c.pin, certAndKey.Leaf.PublicKey)
+		publicKey := certAndKey.Leaf.PublicKey
+		privateKey, err := newPKCS11Signer(publicKey, func() (pkcs11Key, error) {
+			return pkcs11key.New(c.modulePath, c.tokenLabel, c.pin, publicKey)
+		}, c.logger)
 		if err != nil {
 			return err
 		}
@@ -117,3 +142,159 @@ func (c *pkcs11Certificate) GetClientCertificate(certInfo *tls.CertificateReques
 func (c *pkcs11Certificate) GetTrustStore() *x509.CertPool {
 	return (*x509.CertPool)(atomic.LoadPointer(&c.cachedCertPool))
 }
+
+// pkcs11Key is a private key in a PKCS#11 module (see pkcs11key.Key).
+type pkcs11Key interface {
+	crypto.Signer
+	Destroy() error
+}
+
+// pkcs11Signer is a private key in a PKCS#11 module that re-opens its session
+// if signing fails, e.g. because the HSM (or its daemon) was restarted and
+// the session is no longer valid.
+type pkcs11Signer struct {
+	public crypto.PublicKey
+	open   func() (pkcs11Key, error)
+	logger Logger
+
+	mu  sync.Mutex
+	key pkcs11Key
+}
+
+func newPKCS11Signer(public crypto.PublicKey, open func() (pkcs11Key, error), logger Logger) (*pkcs11Signer, error) {
+	key, err := open()
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Signer{public: public, open: open, logger: logger, key: key}, nil
+}
+
+// Public returns the public key.
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs with the key in the PKCS#11 module. If signing fails, the session
+// is re-opened and signing is retried once.
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.mu.Lock()
+	key := s.key
+	s.mu.Unlock()
+
+	var err error
+	if key != nil {
+		var signature []byte
+		signature, err = key.Sign(rand, digest, opts)
+		if err == nil {
+			return signature, nil
+		}
+	}
+
+	key, reopenErr := s.reopen(key, err)
+	if reopenErr != nil {
+		return nil, reopenErr
+	}
+	return key.Sign(rand, digest, opts)
+}
+
+// reopen replaces the failed key with a new one, unless another caller has
+// already done so.
+func (s *pkcs11Signer) reopen(failed pkcs11Key, cause error) (pkcs11Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.key != failed && s.key != nil {
+		return s.key, nil
+	}
+	if failed != nil {
+		s.logger.Printf("signing with PKCS#11 key failed (%s), re-opening session", cause)
+		failed.Destroy()
+		s.key = nil
+	}
+
+	key, err := s.open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to re-open PKCS#11 session: %s", err)
+	}
+	s.key = key
+	return key, nil
+}
+
+// readPKCS11Certificate reads the certificate with the given object label
+// from the token with the given label.
+func readPKCS11Certificate(modulePath, tokenLabel, keyLabel, pin string) ([]*x509.Certificate, error) {
+	if keyLabel == "" {
+		return nil, errors.New("no certificate path or object label given")
+	}
+
+	module := pkcs11.New(modulePath)
+	if module == nil {
+		return nil, fmt.Errorf("failed to load module '%s'", modulePath)
+	}
+	err := module.Initialize()
+	if err == nil {
+		// We were first to initialize the module, finalize it again so the
+		// key can be initialized later. Otherwise it's already in use.
+		defer module.Finalize()
+	} else if err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		return nil, fmt.Errorf("failed to initialize module: %s", err)
+	}
+
+	slots, err := module.GetSlotList(true)
+	if err != nil {
+		return nil, err
+	}
+	for _, slot := range slots {
+		info, err := module.GetTokenInfo(slot)
+		if err != nil {
+			return nil, err
+		}
+		if info.Label != tokenLabel {
+			continue
+		}
+
+		session, err := module.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+		if err != nil {
+			return nil, err
+		}
+		// Note: the session is closed, but we don't log out since the login
+		// state is shared with other sessions (see pkcs11key).
+		defer module.CloseSession(session)
+		err = module.Login(session, pkcs11.CKU_USER, pin)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return nil, err
+		}
+
+		err = module.FindObjectsInit(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+		})
+		if err != nil {
+			return nil, err
+		}
+		handles, _, err := module.FindObjects(session, 2)
+		module.FindObjectsFinal(session)
+		if err != nil {
+			return nil, err
+		}
+		if len(handles) != 1 {
+			return nil, fmt.Errorf("expected one certificate with label %q in token, found %d", keyLabel, len(handles))
+		}
+
+		attrs, err := module.GetAttributeValue(session, handles[0], []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(attrs) == 0 {
+			return nil, errors.New("invalid result from GetAttributeValue")
+		}
+		cert, err := x509.ParseCertificate(attrs[0].Value)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+	return nil, fmt.Errorf("no slot found matching token label %q", tokenLabel)
+}
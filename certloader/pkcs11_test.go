@@ -1,3 +1,4 @@
+//go:build cgo
 // +build cgo
 
 /*-
@@ -19,7 +20,14 @@
 package certloader
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"errors"
+	"io"
 	"testing"
 	"unsafe"
 
@@ -27,7 +35,7 @@ import (
 )
 
 func TestInvalidPKCS11Module(t *testing.T) {
-	_, err := CertificateFromPKCS11Module("", "", "", "", "")
+	_, err := CertificateFromPKCS11Module("", "", "", "", "", "", newTestLogger(t))
 	assert.NotNil(t, err, "should not load invalid PKCS11 certificate/key")
 }
 
@@ -45,3 +53,73 @@ func TestGetCachedCertificatePKCS11(t *testing.T) {
 	assert.Nil(t, err, "should be able to read certificate")
 	assert.Equal(t, tlscert, c)
 }
+
+// fakePKCS11Key is a software key that can be made to fail, like a PKCS#11
+// key with an invalid session.
+type fakePKCS11Key struct {
+	*ecdsa.PrivateKey
+	failing   bool
+	destroyed bool
+}
+
+func (k *fakePKCS11Key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if k.failing {
+		return nil, errors.New("CKR_SESSION_HANDLE_INVALID")
+	}
+	return k.PrivateKey.Sign(rand, digest, opts)
+}
+
+func (k *fakePKCS11Key) Destroy() error {
+	k.destroyed = true
+	return nil
+}
+
+func TestPKCS11SignerReopensSession(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should generate key")
+
+	opened := []*fakePKCS11Key{}
+	openErr := error(nil)
+	signer, err := newPKCS11Signer(priv.Public(), func() (pkcs11Key, error) {
+		if openErr != nil {
+			return nil, openErr
+		}
+		key := &fakePKCS11Key{PrivateKey: priv}
+		opened = append(opened, key)
+		return key, nil
+	}, newTestLogger(t))
+	assert.Nil(t, err, "should open key")
+	assert.Equal(t, priv.Public(), signer.Public(), "should return public key")
+
+	digest := sha256.Sum256([]byte("test"))
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Nil(t, err, "should sign")
+	assert.Equal(t, 1, len(opened), "should not re-open session when signing works")
+
+	// Session becomes invalid (e.g. HSM restarted)
+	opened[0].failing = true
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Nil(t, err, "should sign after re-opening session")
+	assert.True(t, ecdsa.VerifyASN1(&priv.PublicKey, digest[:], signature), "should produce valid signature")
+	assert.Equal(t, 2, len(opened), "should re-open session")
+	assert.True(t, opened[0].destroyed, "should destroy failed key")
+
+	// HSM unavailable
+	opened[1].failing = true
+	openErr = errors.New("no slot found")
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NotNil(t, err, "should fail if session can't be re-opened")
+
+	// HSM is back
+	openErr = nil
+	_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.Nil(t, err, "should sign once HSM is back")
+	assert.Equal(t, 3, len(opened), "should re-open session")
+}
+
+func TestReadPKCS11CertificateInvalid(t *testing.T) {
+	_, err := readPKCS11Certificate("/does-not-exist.so", "token", "", "1234")
+	assert.NotNil(t, err, "should fail without object label")
+	_, err = readPKCS11Certificate("/does-not-exist.so", "token", "label", "1234")
+	assert.NotNil(t, err, "should fail with invalid module")
+}
@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Minimum length of pre-shared keys, in bytes.
+const pskMinLength = 16
+
+// PSKFile holds pre-shared keys for DTLS sessions, by identity, loaded from
+// a file that can be reloaded at runtime. Each line of the file has an
+// identity and a hex encoded key, separated by a colon (IDENTITY:KEY); empty
+// lines and lines starting with # are ignored.
+type PSKFile struct {
+	path string
+	// Cached *map[string][]byte
+	cachedKeys unsafe.Pointer
+}
+
+// LoadPSKFile loads pre-shared keys from the given file.
+func LoadPSKFile(path string) (*PSKFile, error) {
+	f := &PSKFile{path: path}
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reloads the keys from disk. If reloading fails, the old keys are
+// kept.
+func (f *PSKFile) Reload() error {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		sep := strings.LastIndex(text, ":")
+		if sep <= 0 {
+			return fmt.Errorf("invalid PSK in '%s' on line %d: must be IDENTITY:KEY", f.path, line)
+		}
+		identity := text[:sep]
+		key, err := hex.DecodeString(text[sep+1:])
+		if err != nil {
+			return fmt.Errorf("invalid PSK in '%s' on line %d: key must be hex encoded", f.path, line)
+		}
+		if len(key) < pskMinLength {
+			return fmt.Errorf("invalid PSK in '%s' on line %d: key must be at least %d bytes", f.path, line, pskMinLength)
+		}
+		if _, ok := keys[identity]; ok {
+			return fmt.Errorf("invalid PSK in '%s' on line %d: duplicate identity '%s'", f.path, line, identity)
+		}
+		keys[identity] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no PSKs in '%s'", f.path)
+	}
+
+	atomic.StorePointer(&f.cachedKeys, unsafe.Pointer(&keys))
+	return nil
+}
+
+// Key returns the key for the given identity.
+func (f *PSKFile) Key(identity string) ([]byte, error) {
+	keys := *(*map[string][]byte)(atomic.LoadPointer(&f.cachedKeys))
+	key, ok := keys[identity]
+	if !ok {
+		return nil, fmt.Errorf("unknown PSK identity '%s'", identity)
+	}
+	return key, nil
+}
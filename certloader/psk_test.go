@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPSKFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-psk")
+	assert.Nil(t, err, "should be able to create temp dir")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "psk.txt")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("# devices\nsensor-1:000102030405060708090a0b0c0d0e0f\n\nurn:dev:2:0f0e0d0c0b0a09080706050403020100\n"), 0644))
+
+	psks, err := LoadPSKFile(path)
+	assert.Nil(t, err, "should be able to load PSK file")
+	key, err := psks.Key("sensor-1")
+	assert.Nil(t, err, "should find key for identity")
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, key)
+	_, err = psks.Key("urn:dev:2")
+	assert.Nil(t, err, "should allow colons in identity")
+	_, err = psks.Key("sensor-2")
+	assert.NotNil(t, err, "should fail for unknown identity")
+
+	// Reload picks up changes, failed reload keeps old keys
+	assert.Nil(t, ioutil.WriteFile(path, []byte("sensor-2:000102030405060708090a0b0c0d0e0f\n"), 0644))
+	assert.Nil(t, psks.Reload(), "should be able to reload PSK file")
+	_, err = psks.Key("sensor-2")
+	assert.Nil(t, err, "should find identity added on reload")
+	_, err = psks.Key("sensor-1")
+	assert.NotNil(t, err, "should not find identity removed on reload")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("invalid"), 0644))
+	assert.NotNil(t, psks.Reload(), "should fail to reload invalid PSK file")
+	_, err = psks.Key("sensor-2")
+	assert.Nil(t, err, "should keep old keys on failed reload")
+}
+
+func TestPSKFileInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-psk")
+	assert.Nil(t, err, "should be able to create temp dir")
+	defer os.RemoveAll(dir)
+
+	_, err = LoadPSKFile(filepath.Join(dir, "missing.txt"))
+	assert.NotNil(t, err, "should fail to load missing file")
+
+	for _, content := range []string{
+		"",
+		"no-separator",
+		":000102030405060708090a0b0c0d0e0f",
+		"sensor:not-hex",
+		"sensor:0001020304",
+		"sensor:000102030405060708090a0b0c0d0e0f\nsensor:000102030405060708090a0b0c0d0e0f",
+	} {
+		path := filepath.Join(dir, "psk.txt")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+		_, err = LoadPSKFile(path)
+		assert.NotNil(t, err, "should reject invalid PSK file %q", content)
+	}
+}
@@ -0,0 +1,253 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// Time for which we cache revocation information without a next update time.
+	revocationDefaultCacheTime = time.Hour
+	// Time for which we cache failures to fetch revocation information, to
+	// avoid querying unavailable responders on every connection.
+	revocationFailureCacheTime = time.Minute
+	// Maximum number of cached OCSP responses and CRLs.
+	revocationCacheSize = 10000
+	// Maximum size of CRLs we accept.
+	crlMaxSize = 32 << 20
+)
+
+// ErrRevoked is returned by the revocation checker for revoked certificates.
+var ErrRevoked = errors.New("certificate has been revoked")
+
+// RevocationChecker checks whether peer certificates have been revoked, by
+// querying the OCSP responder listed in the certificate or fetching CRLs from
+// its CRL distribution points. Results are cached until the next update time
+// given by the responder or CRL.
+//
+// If the revocation status of a certificate can't be determined (e.g. because
+// the responder is unreachable), the certificate is accepted unless HardFail
+// is set. Certificates without OCSP responder or CRL distribution point are
+// always accepted.
+type RevocationChecker struct {
+	client   *http.Client
+	hardFail bool
+	logger   Logger
+	now      func() time.Time
+
+	mu   sync.Mutex
+	ocsp map[string]*ocspCacheEntry
+	crls map[string]*crlCacheEntry
+}
+
+type ocspCacheEntry struct {
+	status  int
+	err     error
+	expires time.Time
+}
+
+type crlCacheEntry struct {
+	crl     *pkix.CertificateList
+	err     error
+	expires time.Time
+}
+
+// NewRevocationChecker creates a revocation checker. If hardFail is set,
+// certificates are rejected if their revocation status can't be determined.
+func NewRevocationChecker(client *http.Client, hardFail bool, logger Logger) *RevocationChecker {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RevocationChecker{
+		client:   client,
+		hardFail: hardFail,
+		logger:   logger,
+		now:      time.Now,
+		ocsp:     map[string]*ocspCacheEntry{},
+		crls:     map[string]*crlCacheEntry{},
+	}
+}
+
+// VerifyPeerCertificate is an implementation of VerifyPeerCertificate for
+// crypto/tls.Config that checks the revocation status of all certificates in
+// the verified chain (except for the root).
+func (r *RevocationChecker) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return nil
+	}
+
+	chain := verifiedChains[0]
+	for i := 0; i < len(chain)-1; i++ {
+		err := r.check(chain[i], chain[i+1])
+		if err == ErrRevoked {
+			return fmt.Errorf("certificate '%s' (serial %s) has been revoked", chain[i].Subject, chain[i].SerialNumber)
+		}
+		if err != nil {
+			if r.hardFail {
+				return fmt.Errorf("unable to check revocation status of certificate '%s': %s", chain[i].Subject, err)
+			}
+			r.logger.Printf("warning: unable to check revocation status of certificate '%s', accepting: %s", chain[i].Subject, err)
+		}
+	}
+	return nil
+}
+
+// check returns ErrRevoked if cert has been revoked, another error if its
+// status can't be determined, or nil otherwise.
+func (r *RevocationChecker) check(cert, issuer *x509.Certificate) error {
+	if len(cert.OCSPServer) > 0 {
+		status, err := r.checkOCSP(cert, issuer)
+		if err == nil {
+			if status == ocsp.Revoked {
+				return ErrRevoked
+			}
+			if status == ocsp.Good {
+				return nil
+			}
+			err = errors.New("OCSP responder returned status unknown")
+		}
+		// Fall back to CRLs, if any
+		if len(cert.CRLDistributionPoints) == 0 {
+			return err
+		}
+	}
+
+	var lastErr error
+	for _, url := range cert.CRLDistributionPoints {
+		crl, err := r.fetchCRL(url, issuer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if crlContains(crl, cert.SerialNumber) {
+			return ErrRevoked
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func (r *RevocationChecker) checkOCSP(cert, issuer *x509.Certificate) (int, error) {
+	hash := sha256.Sum256(issuer.Raw)
+	key := string(hash[:]) + cert.SerialNumber.String()
+
+	r.mu.Lock()
+	entry, ok := r.ocsp[key]
+	r.mu.Unlock()
+	if ok && r.now().Before(entry.expires) {
+		return entry.status, entry.err
+	}
+
+	_, resp, err := fetchOCSP(r.client, cert, issuer)
+	entry = &ocspCacheEntry{err: err, expires: r.now().Add(revocationFailureCacheTime)}
+	if err == nil {
+		entry.status = resp.Status
+		entry.expires = r.expiry(resp.NextUpdate)
+	}
+
+	r.mu.Lock()
+	r.ocsp[key] = entry
+	if len(r.ocsp) > revocationCacheSize {
+		r.ocsp = map[string]*ocspCacheEntry{key: entry}
+	}
+	r.mu.Unlock()
+
+	return entry.status, entry.err
+}
+
+func (r *RevocationChecker) fetchCRL(url string, issuer *x509.Certificate) (*pkix.CertificateList, error) {
+	r.mu.Lock()
+	entry, ok := r.crls[url]
+	r.mu.Unlock()
+	if ok && r.now().Before(entry.expires) {
+		return entry.crl, entry.err
+	}
+
+	crl, err := r.downloadCRL(url, issuer)
+	entry = &crlCacheEntry{crl: crl, err: err, expires: r.now().Add(revocationFailureCacheTime)}
+	if err == nil {
+		entry.expires = r.expiry(crl.TBSCertList.NextUpdate)
+	}
+
+	r.mu.Lock()
+	r.crls[url] = entry
+	if len(r.crls) > revocationCacheSize {
+		r.crls = map[string]*crlCacheEntry{url: entry}
+	}
+	r.mu.Unlock()
+
+	return entry.crl, entry.err
+}
+
+func (r *RevocationChecker) downloadCRL(url string, issuer *x509.Certificate) (*pkix.CertificateList, error) {
+	resp, err := r.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CRL distribution point %s returned status %d", url, resp.StatusCode)
+	}
+
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, crlMaxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := x509.ParseCRL(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := issuer.CheckCRLSignature(crl); err != nil {
+		return nil, fmt.Errorf("invalid signature on CRL from %s: %s", url, err)
+	}
+	if crl.HasExpired(r.now()) {
+		return nil, fmt.Errorf("CRL from %s has expired", url)
+	}
+	return crl, nil
+}
+
+// expiry returns the time until which revocation information with the given
+// next update time should be cached.
+func (r *RevocationChecker) expiry(nextUpdate time.Time) time.Time {
+	if nextUpdate.IsZero() {
+		return r.now().Add(revocationDefaultCacheTime)
+	}
+	return nextUpdate
+}
+
+func crlContains(crl *pkix.CertificateList, serial *big.Int) bool {
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		if revoked.SerialNumber.Cmp(serial) == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// createCRL creates a CRL signed by the test CA, revoking the given certificates.
+func (p *testPKI) createCRL(t *testing.T, revoked ...*x509.Certificate) []byte {
+	entries := []pkix.RevokedCertificate{}
+	for _, cert := range revoked {
+		entries = append(entries, pkix.RevokedCertificate{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	crl, err := p.cert.CreateCRL(rand.Reader, p.key, entries, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+	assert.Nil(t, err, "should be able to create CRL")
+	return crl
+}
+
+// newFakeCRLServer serves the given CRL, and counts the requests it receives.
+func newFakeCRLServer(crl []byte, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.Write(crl)
+	}))
+}
+
+func verifiedChain(cert, issuer *x509.Certificate) [][]*x509.Certificate {
+	return [][]*x509.Certificate{{cert, issuer}}
+}
+
+func TestRevocationCheckOCSP(t *testing.T) {
+	pki := newTestPKI(t)
+	var requests int32
+
+	good := newFakeOCSPResponder(t, pki, ocsp.Good, &requests)
+	defer good.Close()
+	revoked := newFakeOCSPResponder(t, pki, ocsp.Revoked, &requests)
+	defer revoked.Close()
+
+	checker := NewRevocationChecker(nil, true, newTestLogger(t))
+
+	cert := pki.issue(t, "good", good.URL, "").Leaf
+	assert.Nil(t, checker.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "should accept good certificate")
+	assert.Nil(t, checker.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "should accept good certificate")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "should cache OCSP responses")
+
+	cert = pki.issue(t, "revoked", revoked.URL, "").Leaf
+	assert.NotNil(t, checker.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "should reject revoked certificate")
+}
+
+func TestRevocationCheckCRL(t *testing.T) {
+	pki := newTestPKI(t)
+	var requests int32
+
+	revokedCert := pki.issue(t, "revoked", "", "").Leaf
+	crl := newFakeCRLServer(pki.createCRL(t, revokedCert), &requests)
+	defer crl.Close()
+
+	checker := NewRevocationChecker(nil, true, newTestLogger(t))
+
+	cert := pki.issue(t, "good", "", crl.URL).Leaf
+	assert.Nil(t, checker.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "should accept good certificate")
+
+	revokedCert.CRLDistributionPoints = []string{crl.URL}
+	assert.NotNil(t, checker.VerifyPeerCertificate(nil, verifiedChain(revokedCert, pki.cert)), "should reject revoked certificate")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "should cache CRLs")
+}
+
+func TestRevocationCheckCRLInvalidSignature(t *testing.T) {
+	pki := newTestPKI(t)
+	other := newTestPKI(t)
+	var requests int32
+
+	crl := newFakeCRLServer(other.createCRL(t), &requests)
+	defer crl.Close()
+
+	cert := pki.issue(t, "good", "", crl.URL).Leaf
+	checker := NewRevocationChecker(nil, true, newTestLogger(t))
+	assert.NotNil(t, checker.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "should reject CRL signed by other CA")
+}
+
+func TestRevocationCheckUnavailable(t *testing.T) {
+	pki := newTestPKI(t)
+	var requests int32
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	cert := pki.issue(t, "client", unavailable.URL, "").Leaf
+
+	softFail := NewRevocationChecker(nil, false, newTestLogger(t))
+	assert.Nil(t, softFail.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "soft-fail should accept certificate if responder is unavailable")
+	assert.Nil(t, softFail.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "soft-fail should accept certificate if responder is unavailable")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "should cache failures")
+
+	hardFail := NewRevocationChecker(nil, true, newTestLogger(t))
+	assert.NotNil(t, hardFail.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "hard-fail should reject certificate if responder is unavailable")
+
+	// Failures are retried once cache entry expires
+	hardFail.now = func() time.Time { return time.Now().Add(2 * revocationFailureCacheTime) }
+	assert.NotNil(t, hardFail.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "hard-fail should reject certificate if responder is unavailable")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "should retry after failure cache time")
+}
+
+func TestRevocationCheckNoRevocationInfo(t *testing.T) {
+	pki := newTestPKI(t)
+	cert := pki.issue(t, "client", "", "").Leaf
+
+	checker := NewRevocationChecker(nil, true, newTestLogger(t))
+	assert.Nil(t, checker.VerifyPeerCertificate(nil, verifiedChain(cert, pki.cert)), "should accept certificate without revocation info")
+	assert.Nil(t, checker.VerifyPeerCertificate(nil, nil), "should accept empty chains")
+}
@@ -0,0 +1,86 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+
+	"github.com/square/ghostunnel/wildcard"
+)
+
+// SNICertificate is a certificate to serve to clients requesting a matching
+// server name (SNI).
+type SNICertificate struct {
+	// ServerName is matched against the (lower-cased) SNI value.
+	ServerName wildcard.Matcher
+	// Certificate to serve for matching server names.
+	Certificate Certificate
+}
+
+type sniCertificate struct {
+	// Default certificate, also used for the trust store and client certificates
+	defaultCert Certificate
+	sniCerts    []SNICertificate
+}
+
+// CertificateWithSNI returns a Certificate that serves one of the given
+// certificates, depending on the server name (SNI) requested by the client.
+// The first matching certificate is used, and the default certificate if none
+// match. The trust store (CA bundle) always comes from the default certificate.
+func CertificateWithSNI(defaultCert Certificate, sniCerts []SNICertificate) Certificate {
+	return &sniCertificate{
+		defaultCert: defaultCert,
+		sniCerts:    sniCerts,
+	}
+}
+
+// Reload reloads all certificates. Certificates that fail to reload keep their
+// old state, the first error is returned.
+func (c *sniCertificate) Reload() error {
+	err := c.defaultCert.Reload()
+	for _, sniCert := range c.sniCerts {
+		if sniErr := sniCert.Certificate.Reload(); err == nil {
+			err = sniErr
+		}
+	}
+	return err
+}
+
+// GetCertificate returns the certificate matching the requested server name.
+func (c *sniCertificate) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if clientHello != nil && clientHello.ServerName != "" {
+		serverName := strings.ToLower(clientHello.ServerName)
+		for _, sniCert := range c.sniCerts {
+			if sniCert.ServerName.Matches(serverName) {
+				return sniCert.Certificate.GetCertificate(clientHello)
+			}
+		}
+	}
+	return c.defaultCert.GetCertificate(clientHello)
+}
+
+// GetClientCertificate returns the default certificate.
+func (c *sniCertificate) GetClientCertificate(certInfo *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.defaultCert.GetClientCertificate(certInfo)
+}
+
+// GetTrustStore returns the trust store of the default certificate.
+func (c *sniCertificate) GetTrustStore() *x509.CertPool {
+	return c.defaultCert.GetTrustStore()
+}
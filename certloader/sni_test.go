@@ -0,0 +1,65 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/square/ghostunnel/wildcard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertificateWithSNI(t *testing.T) {
+	pki := newTestPKI(t)
+	defaultCert := &staticCertificate{cert: pki.issue(t, "default", "", "")}
+	fooCert := &staticCertificate{cert: pki.issue(t, "foo", "", "")}
+	wildcardCert := &staticCertificate{cert: pki.issue(t, "wildcard", "", "")}
+
+	pattern, err := wildcard.CompileWithSeparator("*.example.com", '.')
+	assert.Nil(t, err, "should compile pattern")
+
+	cert := CertificateWithSNI(defaultCert, []SNICertificate{
+		{ServerName: wildcard.MustCompile("foo.example.com"), Certificate: fooCert},
+		{ServerName: pattern, Certificate: wildcardCert},
+	})
+
+	for serverName, expected := range map[string]string{
+		"foo.example.com": "foo",
+		"FOO.example.com": "foo",
+		"bar.example.com": "wildcard",
+		"example.org":     "default",
+		"":                "default",
+	} {
+		served, err := cert.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		assert.Nil(t, err, "should get certificate")
+		assert.Equal(t, expected, served.Leaf.Subject.CommonName, "should serve %s certificate for sni '%s'", expected, serverName)
+	}
+
+	served, err := cert.GetCertificate(nil)
+	assert.Nil(t, err, "should get certificate")
+	assert.Equal(t, "default", served.Leaf.Subject.CommonName, "should serve default certificate without client hello")
+
+	client, err := cert.GetClientCertificate(nil)
+	assert.Nil(t, err, "should get client certificate")
+	assert.Equal(t, "default", client.Leaf.Subject.CommonName, "should use default certificate as client certificate")
+
+	assert.Nil(t, cert.Reload(), "should reload")
+	assert.Equal(t, 1, defaultCert.reloads, "should reload default certificate")
+	assert.Equal(t, 1, fooCert.reloads, "should reload sni certificates")
+	assert.Equal(t, 1, wildcardCert.reloads, "should reload sni certificates")
+}
@@ -57,7 +57,6 @@ func TLSConfigSourceFromWorkloadAPI(addr string, log Logger) (TLSConfigSource, e
 	if err != nil {
 		return nil, err
 	}
-	// TODO: provide a way to close the peer on graceful shutdown
 	return &spiffeTLSConfigSource{
 		peer: peer,
 		log:  log,
@@ -82,6 +81,7 @@ func (s *spiffeTLSConfigSource) GetServerConfig(base *tls.Config) (TLSServerConf
 	return s.newConfig(base)
 }
 
+// Close stops watching the Workload API for SVID and trust bundle updates.
 func (s *spiffeTLSConfigSource) Close() error {
 	return s.peer.Close()
 }
@@ -0,0 +1,412 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// DefaultTPMDevice is the TPM 2.0 device used if none is given. It's the
+// kernel's resource manager, which allows sharing the TPM between processes.
+const DefaultTPMDevice = "/dev/tpmrm0"
+
+// TPM 2.0 constants (see TPM 2.0 Library, Part 2: Structures)
+const (
+	tpmSTSessions  uint16 = 0x8002
+	tpmSTHashCheck uint16 = 0x8024
+	tpmCCSign      uint32 = 0x0000015d
+	tpmRSPassword  uint32 = 0x40000009
+	tpmRHNull      uint32 = 0x40000007
+	tpmRCSuccess   uint32 = 0x00000000
+
+	tpmAlgSHA1   uint16 = 0x0004
+	tpmAlgSHA256 uint16 = 0x000b
+	tpmAlgSHA384 uint16 = 0x000c
+	tpmAlgSHA512 uint16 = 0x000d
+	tpmAlgRSASSA uint16 = 0x0014
+	tpmAlgRSAPSS uint16 = 0x0016
+	tpmAlgECDSA  uint16 = 0x0018
+)
+
+// Maximum size of a TPM response we expect to read.
+const tpmMaxResponseSize = 4096
+
+type tpmCertificate struct {
+	// Certificate chain corresponding to key
+	certificatePath string
+	// Root CA bundle path
+	caBundlePath string
+	// Key in the TPM
+	signer *tpmSigner
+	// Cached *tls.Certificate
+	cachedCertificate unsafe.Pointer
+	// Cached *x509.CertPool
+	cachedCertPool unsafe.Pointer
+}
+
+// ParseTPMHandle parses a persistent TPM handle, in hex (e.g. 0x81000001) or
+// decimal.
+func ParseTPMHandle(handle string) (uint32, error) {
+	parsed, err := strconv.ParseUint(handle, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TPM handle '%s'", handle)
+	}
+	if parsed>>24 != 0x81 {
+		return 0, fmt.Errorf("invalid TPM handle '%s': not a persistent handle (0x81xxxxxx)", handle)
+	}
+	return uint32(parsed), nil
+}
+
+// CertificateFromTPM creates a reloadable certificate with the certificate
+// chain read from a file, and the private key stored in a TPM 2.0 device
+// under the given persistent handle. The password authorizes use of the key
+// (may be empty). Reloading re-reads the certificate chain; the key must stay
+// the same.
+func CertificateFromTPM(certificatePath, caBundlePath, device string, handle uint32, password string, logger Logger) (Certificate, error) {
+	c := &tpmCertificate{
+		certificatePath: certificatePath,
+		caBundlePath:    caBundlePath,
+		signer: &tpmSigner{
+			handle:   handle,
+			password: []byte(password),
+			logger:   logger,
+			open: func() (io.ReadWriteCloser, error) {
+				return os.OpenFile(device, os.O_RDWR, 0)
+			},
+		},
+	}
+	err := c.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload transparently reloads the certificate.
+func (c *tpmCertificate) Reload() error {
+	certs, err := readX509(c.certificatePath)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the certificate matches the key in the TPM, by checking a
+	// signature. Otherwise we'd only find out during handshakes.
+	err = c.signer.check(certs[0].PublicKey)
+	if err != nil {
+		return err
+	}
+
+	certAndKey := tls.Certificate{
+		Leaf:       certs[0],
+		PrivateKey: c.signer,
+	}
+	for _, cert := range certs {
+		certAndKey.Certificate = append(certAndKey.Certificate, cert.Raw)
+	}
+
+	bundle, err := LoadTrustStore(c.caBundlePath)
+	if err != nil {
+		return err
+	}
+
+	atomic.StorePointer(&c.cachedCertificate, unsafe.Pointer(&certAndKey))
+	atomic.StorePointer(&c.cachedCertPool, unsafe.Pointer(bundle))
+
+	return nil
+}
+
+// GetCertificate retrieves the actual underlying tls.Certificate.
+func (c *tpmCertificate) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return (*tls.Certificate)(atomic.LoadPointer(&c.cachedCertificate)), nil
+}
+
+// GetClientCertificate retrieves the actual underlying tls.Certificate.
+func (c *tpmCertificate) GetClientCertificate(certInfo *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return (*tls.Certificate)(atomic.LoadPointer(&c.cachedCertificate)), nil
+}
+
+// GetTrustStore returns the most up-to-date version of the trust store / CA bundle.
+func (c *tpmCertificate) GetTrustStore() *x509.CertPool {
+	return (*x509.CertPool)(atomic.LoadPointer(&c.cachedCertPool))
+}
+
+// tpmSigner is a crypto.Signer for a key in a TPM 2.0 device. It sends
+// TPM2_Sign commands to the device, authorized with the key's password.
+// Commands are serialized, and the device is re-opened if a command fails.
+type tpmSigner struct {
+	handle   uint32
+	password []byte
+	logger   Logger
+	open     func() (io.ReadWriteCloser, error)
+
+	mu     sync.Mutex
+	public crypto.PublicKey
+	device io.ReadWriteCloser
+}
+
+// check verifies that the key in the TPM corresponds to the given public key.
+func (s *tpmSigner) check(public crypto.PublicKey) error {
+	digest := sha256.Sum256([]byte("ghostunnel tpm key check"))
+
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := public.(*rsa.PublicKey); ok {
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	}
+
+	signature, err := s.sign(public, digest[:], opts)
+	if err != nil {
+		return err
+	}
+
+	switch key := public.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			err = errors.New("signature verification failed")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, opts.(*rsa.PSSOptions))
+	}
+	if err != nil {
+		return fmt.Errorf("certificate doesn't match key in TPM (handle 0x%08x): %s", s.handle, err)
+	}
+
+	s.mu.Lock()
+	s.public = public
+	s.mu.Unlock()
+	return nil
+}
+
+// Public returns the public key.
+func (s *tpmSigner) Public() crypto.PublicKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.public
+}
+
+// Sign signs the digest with the key in the TPM. RSA keys use PSS if opts
+// are *rsa.PSSOptions (only with salt length equal to the hash length), and
+// PKCS#1 v1.5 otherwise.
+func (s *tpmSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.sign(s.Public(), digest, opts)
+}
+
+func (s *tpmSigner) sign(public crypto.PublicKey, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hashAlg, err := tpmHashAlg(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, errors.New("digest length doesn't match hash function")
+	}
+
+	var scheme uint16
+	switch public.(type) {
+	case *ecdsa.PublicKey:
+		scheme = tpmAlgECDSA
+	case *rsa.PublicKey:
+		scheme = tpmAlgRSASSA
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			if pss.SaltLength != rsa.PSSSaltLengthEqualsHash && pss.SaltLength != opts.HashFunc().Size() {
+				return nil, errors.New("TPM only supports PSS with salt length equal to hash length")
+			}
+			scheme = tpmAlgRSAPSS
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+
+	response, err := s.run(tpmSignCommand(s.handle, s.password, digest, scheme, hashAlg))
+	if err != nil {
+		return nil, err
+	}
+	return parseTPMSignResponse(response)
+}
+
+// run sends a command to the TPM and returns the response parameters. The
+// device is (re-)opened as needed.
+func (s *tpmSigner) run(command []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if s.device == nil {
+			device, err := s.open()
+			if err != nil {
+				return nil, fmt.Errorf("unable to open TPM device: %s", err)
+			}
+			s.device = device
+		}
+
+		response, err := tpmTransmit(s.device, command)
+		if err == nil {
+			return response, nil
+		}
+		if _, ok := err.(tpmError); ok || attempt > 0 {
+			// Error reported by the TPM itself, re-opening won't help
+			return nil, err
+		}
+		s.logger.Printf("error talking to TPM, re-opening device: %s", err)
+		s.device.Close()
+		s.device = nil
+	}
+}
+
+// tpmError is an error response code from the TPM.
+type tpmError uint32
+
+func (e tpmError) Error() string {
+	return fmt.Sprintf("TPM error: response code 0x%03x", uint32(e))
+}
+
+// tpmTransmit writes a command and reads the response. It returns the
+// response body (after the header), or an error if the command failed.
+func tpmTransmit(device io.ReadWriter, command []byte) ([]byte, error) {
+	if _, err := device.Write(command); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, tpmMaxResponseSize)
+	n, err := device.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	response = response[:n]
+
+	if len(response) < 10 {
+		return nil, errors.New("short response from TPM")
+	}
+	size := binary.BigEndian.Uint32(response[2:6])
+	if int(size) != len(response) {
+		return nil, errors.New("invalid response size from TPM")
+	}
+	if code := binary.BigEndian.Uint32(response[6:10]); code != tpmRCSuccess {
+		return nil, tpmError(code)
+	}
+	return response[10:], nil
+}
+
+// tpmSignCommand builds a TPM2_Sign command, with password authorization.
+func tpmSignCommand(handle uint32, password, digest []byte, scheme, hashAlg uint16) []byte {
+	auth := &bytes.Buffer{}
+	binary.Write(auth, binary.BigEndian, tpmRSPassword)
+	writeTPM2B(auth, nil) // nonce
+	auth.WriteByte(0)     // session attributes
+	writeTPM2B(auth, password)
+
+	params := &bytes.Buffer{}
+	writeTPM2B(params, digest)
+	binary.Write(params, binary.BigEndian, scheme)
+	binary.Write(params, binary.BigEndian, hashAlg)
+	// Null ticket, as the digest wasn't computed by the TPM
+	binary.Write(params, binary.BigEndian, tpmSTHashCheck)
+	binary.Write(params, binary.BigEndian, tpmRHNull)
+	writeTPM2B(params, nil)
+
+	command := &bytes.Buffer{}
+	binary.Write(command, binary.BigEndian, tpmSTSessions)
+	binary.Write(command, binary.BigEndian, uint32(10+4+4+auth.Len()+params.Len()))
+	binary.Write(command, binary.BigEndian, tpmCCSign)
+	binary.Write(command, binary.BigEndian, handle)
+	binary.Write(command, binary.BigEndian, uint32(auth.Len()))
+	command.Write(auth.Bytes())
+	command.Write(params.Bytes())
+	return command.Bytes()
+}
+
+// parseTPMSignResponse parses the signature from a TPM2_Sign response body.
+// ECDSA signatures are converted to ASN.1, as expected by crypto/tls.
+func parseTPMSignResponse(body []byte) ([]byte, error) {
+	r := bytes.NewReader(body)
+	var paramSize uint32
+	var sigAlg, hashAlg uint16
+	if err := binary.Read(r, binary.BigEndian, &paramSize); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &sigAlg); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &hashAlg); err != nil {
+		return nil, err
+	}
+
+	switch sigAlg {
+	case tpmAlgRSASSA, tpmAlgRSAPSS:
+		return readTPM2B(r)
+	case tpmAlgECDSA:
+		sigR, err := readTPM2B(r)
+		if err != nil {
+			return nil, err
+		}
+		sigS, err := readTPM2B(r)
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sigR),
+			new(big.Int).SetBytes(sigS),
+		})
+	}
+	return nil, fmt.Errorf("unexpected signature algorithm 0x%04x from TPM", sigAlg)
+}
+
+func tpmHashAlg(hash crypto.Hash) (uint16, error) {
+	switch hash {
+	case crypto.SHA1:
+		return tpmAlgSHA1, nil
+	case crypto.SHA256:
+		return tpmAlgSHA256, nil
+	case crypto.SHA384:
+		return tpmAlgSHA384, nil
+	case crypto.SHA512:
+		return tpmAlgSHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported hash function %s", hash)
+}
+
+func writeTPM2B(buf *bytes.Buffer, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(data)))
+	buf.Write(data)
+}
+
+func readTPM2B(r *bytes.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,219 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTPM implements TPM2_Sign with password authorization for a software key.
+type fakeTPM struct {
+	key      crypto.Signer
+	handle   uint32
+	password []byte
+	response []byte
+	// Fail the next write (e.g. device was reset)
+	broken bool
+	closed bool
+}
+
+func (f *fakeTPM) Write(command []byte) (int, error) {
+	if f.broken {
+		f.broken = false
+		return 0, errors.New("device reset")
+	}
+	f.response = f.process(command)
+	return len(command), nil
+}
+
+func (f *fakeTPM) Read(p []byte) (int, error) {
+	return copy(p, f.response), nil
+}
+
+func (f *fakeTPM) Close() error {
+	f.closed = true
+	return nil
+}
+
+func tpmResponse(code uint32, body []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, tpmSTSessions)
+	binary.Write(buf, binary.BigEndian, uint32(10+len(body)))
+	binary.Write(buf, binary.BigEndian, code)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func (f *fakeTPM) process(command []byte) []byte {
+	r := bytes.NewReader(command[10:])
+	var handle, authSize, session uint32
+	binary.Read(r, binary.BigEndian, &handle)
+	binary.Read(r, binary.BigEndian, &authSize)
+	binary.Read(r, binary.BigEndian, &session)
+	readTPM2B(r) // nonce
+	r.ReadByte() // attributes
+	password, _ := readTPM2B(r)
+	digest, _ := readTPM2B(r)
+	var scheme, hashAlg uint16
+	binary.Read(r, binary.BigEndian, &scheme)
+	binary.Read(r, binary.BigEndian, &hashAlg)
+
+	if handle != f.handle {
+		return tpmResponse(0x18b, nil) // TPM_RC_HANDLE
+	}
+	if session != tpmRSPassword || !bytes.Equal(password, f.password) {
+		return tpmResponse(0x98e, nil) // TPM_RC_AUTH_FAIL
+	}
+
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, uint32(0))
+	binary.Write(body, binary.BigEndian, scheme)
+	binary.Write(body, binary.BigEndian, hashAlg)
+	switch scheme {
+	case tpmAlgECDSA:
+		der, _ := f.key.Sign(rand.Reader, digest, crypto.SHA256)
+		var sig struct{ R, S *big.Int }
+		asn1.Unmarshal(der, &sig)
+		writeTPM2B(body, sig.R.Bytes())
+		writeTPM2B(body, sig.S.Bytes())
+	case tpmAlgRSAPSS:
+		sig, _ := f.key.Sign(rand.Reader, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+		writeTPM2B(body, sig)
+	case tpmAlgRSASSA:
+		sig, _ := f.key.Sign(rand.Reader, digest, crypto.SHA256)
+		writeTPM2B(body, sig)
+	}
+	return tpmResponse(tpmRCSuccess, body.Bytes())
+}
+
+func newFakeTPMCertificate(t *testing.T, tpm *fakeTPM, certPath string) *tpmCertificate {
+	return &tpmCertificate{
+		certificatePath: certPath,
+		signer: &tpmSigner{
+			handle:   0x81000001,
+			password: []byte("secret"),
+			logger:   newTestLogger(t),
+			open: func() (io.ReadWriteCloser, error) {
+				return tpm, nil
+			},
+		},
+	}
+}
+
+func writeSelfSignedCert(t *testing.T, dir string, key crypto.Signer) string {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tpm"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.Nil(t, err, "should create cert")
+	path := filepath.Join(dir, "cert.pem")
+	assert.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), "should write cert")
+	return path
+}
+
+func TestTPMCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-tpm")
+	assert.Nil(t, err, "should create temp dir")
+	defer os.RemoveAll(dir)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	for _, key := range []crypto.Signer{ecKey, rsaKey} {
+		tpm := &fakeTPM{key: key, handle: 0x81000001, password: []byte("secret")}
+		c := newFakeTPMCertificate(t, tpm, writeSelfSignedCert(t, dir, key))
+		assert.Nil(t, c.Reload(), "should load certificate")
+
+		cert, _ := c.GetCertificate(nil)
+		signer := cert.PrivateKey.(crypto.Signer)
+		assert.Equal(t, key.Public(), signer.Public(), "should have public key of certificate")
+
+		digest := sha256.Sum256([]byte("test"))
+		if _, ok := key.(*rsa.PrivateKey); ok {
+			sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+			assert.Nil(t, err, "should sign with PKCS#1 v1.5")
+			assert.Nil(t, rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig), "should produce valid signature")
+		}
+
+		// Device is re-opened after errors
+		tpm.broken = true
+		_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		assert.Nil(t, err, "should sign after re-opening device")
+		assert.True(t, tpm.closed, "should close broken device")
+	}
+}
+
+func TestTPMCertificateInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-tpm")
+	assert.Nil(t, err, "should create temp dir")
+	defer os.RemoveAll(dir)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certPath := writeSelfSignedCert(t, dir, key)
+
+	// Wrong password
+	c := newFakeTPMCertificate(t, &fakeTPM{key: key, handle: 0x81000001, password: []byte("other")}, certPath)
+	assert.NotNil(t, c.Reload(), "should fail with wrong password")
+
+	// Wrong handle
+	c = newFakeTPMCertificate(t, &fakeTPM{key: key, handle: 0x81000002, password: []byte("secret")}, certPath)
+	assert.NotNil(t, c.Reload(), "should fail with wrong handle")
+
+	// Key doesn't match certificate
+	c = newFakeTPMCertificate(t, &fakeTPM{key: other, handle: 0x81000001, password: []byte("secret")}, certPath)
+	assert.NotNil(t, c.Reload(), "should fail if key doesn't match certificate")
+
+	// Device doesn't exist
+	_, err = CertificateFromTPM(certPath, "", filepath.Join(dir, "tpm0"), 0x81000001, "", newTestLogger(t))
+	assert.NotNil(t, err, "should fail without TPM device")
+}
+
+func TestParseTPMHandle(t *testing.T) {
+	handle, err := ParseTPMHandle("0x81000001")
+	assert.Nil(t, err, "should parse hex handle")
+	assert.Equal(t, uint32(0x81000001), handle)
+
+	_, err = ParseTPMHandle("0x40000001")
+	assert.NotNil(t, err, "should reject non-persistent handle")
+	_, err = ParseTPMHandle("foo")
+	assert.NotNil(t, err, "should reject invalid handle")
+}
@@ -0,0 +1,249 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Interval to wait before retrying if renewing a certificate from Vault failed.
+const vaultRetryInterval = 30 * time.Second
+
+// VaultConfig describes how to request certificates from a Vault PKI secrets engine.
+type VaultConfig struct {
+	// Vault server address (e.g. https://vault.example.com:8200)
+	Addr string
+	// Path of the PKI issue endpoint (e.g. pki/issue/my-role)
+	Path string
+	// Common name and alternative names (DNS names, IPs) to request
+	CommonName string
+	AltNames   []string
+	// Requested TTL for certificates (optional, uses role default if zero)
+	TTL time.Duration
+	// Token used to authenticate to Vault
+	Token string
+	// AppRole credentials, used to log in if no token is given
+	RoleID   string
+	SecretID string
+	// HTTP client for talking to Vault (optional)
+	Client *http.Client
+}
+
+type vaultCertificate struct {
+	config VaultConfig
+	// Root CA bundle path
+	caBundlePath string
+	logger       Logger
+	// Cached *tls.Certificate
+	cachedCertificate unsafe.Pointer
+	// Cached *x509.CertPool
+	cachedCertPool unsafe.Pointer
+}
+
+type vaultResponse struct {
+	Errors []string `json:"errors"`
+	Auth   struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Data struct {
+		Certificate string   `json:"certificate"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+		PrivateKey  string   `json:"private_key"`
+	} `json:"data"`
+}
+
+// CertificateFromVault creates a certificate that is issued by a Vault PKI
+// secrets engine. Certificates are renewed automatically once two thirds of
+// their lifetime have passed, reloading will issue a new certificate.
+func CertificateFromVault(config VaultConfig, caBundlePath string, logger Logger) (Certificate, error) {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	c := vaultCertificate{
+		config:       config,
+		caBundlePath: caBundlePath,
+		logger:       logger,
+	}
+	err := c.Reload()
+	if err != nil {
+		return nil, err
+	}
+	go c.renewBeforeExpiry()
+	return &c, nil
+}
+
+// Reload requests a new certificate from Vault.
+func (c *vaultCertificate) Reload() error {
+	token := c.config.Token
+	if token == "" {
+		var err error
+		token, err = c.login()
+		if err != nil {
+			return err
+		}
+	}
+
+	request := map[string]string{"common_name": c.config.CommonName}
+	if len(c.config.AltNames) > 0 {
+		var dnsNames, ipSANs []string
+		for _, name := range c.config.AltNames {
+			if net.ParseIP(name) != nil {
+				ipSANs = append(ipSANs, name)
+			} else {
+				dnsNames = append(dnsNames, name)
+			}
+		}
+		if len(dnsNames) > 0 {
+			request["alt_names"] = strings.Join(dnsNames, ",")
+		}
+		if len(ipSANs) > 0 {
+			request["ip_sans"] = strings.Join(ipSANs, ",")
+		}
+	}
+	if c.config.TTL > 0 {
+		request["ttl"] = c.config.TTL.String()
+	}
+
+	resp, err := c.call(c.config.Path, token, request)
+	if err != nil {
+		return err
+	}
+
+	chain := resp.Data.Certificate + "\n"
+	if len(resp.Data.CAChain) > 0 {
+		chain += strings.Join(resp.Data.CAChain, "\n")
+	} else {
+		chain += resp.Data.IssuingCA
+	}
+
+	certAndKey, err := tls.X509KeyPair([]byte(chain), []byte(resp.Data.PrivateKey))
+	if err != nil {
+		return err
+	}
+
+	certAndKey.Leaf, err = x509.ParseCertificate(certAndKey.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	bundle, err := LoadTrustStore(c.caBundlePath)
+	if err != nil {
+		return err
+	}
+
+	atomic.StorePointer(&c.cachedCertificate, unsafe.Pointer(&certAndKey))
+	atomic.StorePointer(&c.cachedCertPool, unsafe.Pointer(bundle))
+
+	return nil
+}
+
+// login authenticates to Vault using AppRole credentials, returns a token.
+func (c *vaultCertificate) login() (string, error) {
+	if c.config.RoleID == "" {
+		return "", errors.New("no Vault token or AppRole credentials given")
+	}
+	resp, err := c.call("auth/approle/login", "", map[string]string{
+		"role_id":   c.config.RoleID,
+		"secret_id": c.config.SecretID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", errors.New("vault AppRole login did not return a token")
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+func (c *vaultCertificate) call(path, token string, request interface{}) (*vaultResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimRight(c.config.Addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	httpResp, err := c.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var resp vaultResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid response from vault (status %d): %s", httpResp.StatusCode, err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error from vault (status %d): %s", httpResp.StatusCode, strings.Join(resp.Errors, ", "))
+	}
+	return &resp, nil
+}
+
+// renewBeforeExpiry issues a new certificate once two thirds of the lifetime
+// of the current one have passed.
+func (c *vaultCertificate) renewBeforeExpiry() {
+	for {
+		leaf := (*tls.Certificate)(atomic.LoadPointer(&c.cachedCertificate)).Leaf
+		lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+		time.Sleep(time.Until(leaf.NotBefore.Add(lifetime * 2 / 3)))
+
+		for {
+			err := c.Reload()
+			if err == nil {
+				c.logger.Printf("renewed certificate from vault")
+				break
+			}
+			c.logger.Printf("error renewing certificate from vault: %s", err)
+			time.Sleep(vaultRetryInterval)
+		}
+	}
+}
+
+// GetCertificate retrieves the actual underlying tls.Certificate.
+func (c *vaultCertificate) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return (*tls.Certificate)(atomic.LoadPointer(&c.cachedCertificate)), nil
+}
+
+// GetClientCertificate retrieves the actual underlying tls.Certificate.
+func (c *vaultCertificate) GetClientCertificate(certInfo *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return (*tls.Certificate)(atomic.LoadPointer(&c.cachedCertificate)), nil
+}
+
+// GetTrustStore returns the most up-to-date version of the trust store / CA bundle.
+func (c *vaultCertificate) GetTrustStore() *x509.CertPool {
+	return (*x509.CertPool)(atomic.LoadPointer(&c.cachedCertPool))
+}
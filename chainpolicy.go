@@ -0,0 +1,49 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sort"
+
+	"github.com/square/ghostunnel/auth"
+)
+
+// extKeyUsageNames returns the names accepted by --require-eku, sorted.
+func extKeyUsageNames() []string {
+	names := []string{}
+	for name := range auth.ExtKeyUsages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// chainPolicy returns the chain policy from --require-eku, --max-chain-depth
+// and --enforce-name-constraints, or nil if none of them are set.
+func chainPolicy() *auth.ChainPolicy {
+	if len(*requireEKUs) == 0 && *maxChainDepth < 0 && !*enforceNameConst {
+		return nil
+	}
+	policy := &auth.ChainPolicy{
+		MaxChainDepth:          *maxChainDepth,
+		EnforceNameConstraints: *enforceNameConst,
+	}
+	for _, name := range *requireEKUs {
+		policy.RequiredEKUs = append(policy.RequiredEKUs, auth.ExtKeyUsages[name])
+	}
+	return policy
+}
@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Delay before restarting a child process that exited, so a command that
+// fails right away doesn't spin.
+const childRestartDelay = 1 * time.Second
+
+// childProcess supervises a command that ghostunnel runs once it's
+// listening, to wrap an application and its tunnel in a single process
+// (e.g. as a container entrypoint). The child inherits stdin, stdout and
+// stderr, and is restarted according to --child-restart.
+type childProcess struct {
+	args    []string
+	restart string
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stopping bool
+	// Exit status of the last run, closed done once we stopped supervising
+	status int
+	done   chan struct{}
+}
+
+// childExitError is returned from listening if the child process exited on
+// its own with a non-zero status, which ghostunnel exits with as well.
+type childExitError struct {
+	status int
+}
+
+func (e *childExitError) Error() string {
+	return fmt.Sprintf("child process exited with status %d", e.status)
+}
+
+// newChildProcess returns a supervisor for the given command, or nil if
+// there is no command.
+func newChildProcess(args []string, restart string) *childProcess {
+	if len(args) == 0 {
+		return nil
+	}
+	return &childProcess{args: args, restart: restart, done: make(chan struct{})}
+}
+
+func validateChild(args []string) error {
+	if len(args) == 0 && (*childRestart == "on-failure" || *childRestart == "always") {
+		return errors.New("--child-restart requires a command to run (given after --)")
+	}
+	return nil
+}
+
+// start launches the child process, and supervises it in the background.
+func (c *childProcess) start() error {
+	if c == nil {
+		return nil
+	}
+	cmd, err := c.launch()
+	if err != nil {
+		logger.Printf("error: unable to start child process: %s", err)
+		return err
+	}
+	go c.supervise(cmd)
+	return nil
+}
+
+func (c *childProcess) launch() (*exec.Cmd, error) {
+	cmd := exec.Command(c.args[0], c.args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c.cmd = cmd
+	logger.Printf("started child process %s (pid %d)", c.args[0], cmd.Process.Pid)
+	return cmd, nil
+}
+
+// supervise waits for the child process to exit, and restarts it as
+// configured unless we're shutting down.
+func (c *childProcess) supervise(cmd *exec.Cmd) {
+	defer close(c.done)
+	for {
+		err := cmd.Wait()
+		status := 0
+		if err != nil {
+			status = 1
+			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+				status = exitErr.ExitCode()
+			}
+			logger.Printf("child process exited: %s", err)
+		} else {
+			logger.Printf("child process exited")
+		}
+
+		c.mu.Lock()
+		c.status = status
+		stopping := c.stopping
+		c.mu.Unlock()
+		if stopping || !c.shouldRestart(status) {
+			return
+		}
+
+		time.Sleep(childRestartDelay)
+		if c.isStopping() {
+			return
+		}
+		cmd, err = c.launch()
+		if err != nil {
+			logger.Printf("error: unable to restart child process: %s", err)
+			return
+		}
+	}
+}
+
+func (c *childProcess) shouldRestart(status int) bool {
+	return c.restart == "always" || (c.restart == "on-failure" && status != 0)
+}
+
+func (c *childProcess) isStopping() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopping
+}
+
+// stop forwards a (shutdown) signal to the child process, and stops
+// restarting it.
+func (c *childProcess) stop(sig os.Signal) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopping = true
+	if err := c.cmd.Process.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		// Not all signals can be sent on all platforms (e.g. windows)
+		c.cmd.Process.Kill()
+	}
+}
+
+// exited returns a channel that's closed once the child process exited and
+// won't be restarted (nil if there is no child, which blocks forever).
+func (c *childProcess) exited() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.done
+}
+
+// wait waits for the child process to exit. Returns a *childExitError if it
+// exited on its own with a non-zero status.
+func (c *childProcess) wait() error {
+	if c == nil {
+		return nil
+	}
+	<-c.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.stopping && c.status != 0 {
+		return &childExitError{status: c.status}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateChild(t *testing.T) {
+	defer func() { *childRestart = "never" }()
+
+	*childRestart = "always"
+	assert.NotNil(t, validateChild(nil), "--child-restart should require a command")
+	assert.Nil(t, validateChild([]string{"true"}), "--child-restart should be accepted with a command")
+	*childRestart = "never"
+	assert.Nil(t, validateChild(nil), "no command should be accepted")
+	assert.Nil(t, newChildProcess(nil, "never"), "should not supervise without command")
+}
+
+func TestChildExitStatus(t *testing.T) {
+	child := newChildProcess([]string{"sh", "-c", "exit 3"}, "never")
+	assert.Nil(t, child.start(), "should start child")
+	<-child.exited()
+	err := child.wait()
+	assert.Equal(t, &childExitError{status: 3}, err, "should report exit status of child")
+}
+
+func TestChildRestartOnFailure(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "started")
+	// Fails the first time, succeeds once restarted
+	child := newChildProcess([]string{"sh", "-c", "test -f " + marker + " && exit 0; touch " + marker + "; exit 1"}, "on-failure")
+	assert.Nil(t, child.start(), "should start child")
+	assert.Nil(t, child.wait(), "should restart child until it succeeds")
+}
+
+func TestChildStop(t *testing.T) {
+	child := newChildProcess([]string{"sleep", "10"}, "always")
+	assert.Nil(t, child.start(), "should start child")
+	child.stop(syscall.SIGTERM)
+	select {
+	case <-child.exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("child should exit after forwarding signal")
+	}
+	assert.Nil(t, child.wait(), "should not report exit status after shutdown")
+}
+
+func TestChildStartError(t *testing.T) {
+	child := newChildProcess([]string{filepath.Join(os.TempDir(), "does-not-exist")}, "never")
+	assert.NotNil(t, child.start(), "should fail to start missing command")
+}
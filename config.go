@@ -0,0 +1,247 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configFileArg returns the path given with --config in the arguments, if any.
+func configFileArg(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, "--config=") {
+			return arg[len("--config="):]
+		}
+		if arg == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// loadConfigFile reads a config file. Config files are YAML (or JSON)
+// documents mapping flag names (without dashes) to values, e.g.
+//
+//	listen: localhost:8443
+//	target: localhost:8080
+//	keystore: server.p12
+//	allow-cn: [client1, client2]
+//	unsafe-target: false
+//
+// Files with a .toml extension are read as TOML instead, with the same keys.
+// Lists are passed as repeated flags, booleans as --flag or --no-flag.
+func loadConfigFile(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]interface{}{}
+	unmarshal := yaml.Unmarshal
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		unmarshal = toml.Unmarshal
+	}
+	if err := unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config file '%s': %s", path, err)
+	}
+	for name, value := range config {
+		if app.GetFlag(name) == nil && serverCommand.GetFlag(name) == nil && clientCommand.GetFlag(name) == nil {
+			return nil, fmt.Errorf("unknown setting '%s' in config file '%s'", name, path)
+		}
+		if name == "config" {
+			return nil, fmt.Errorf("config file '%s' can't include other config files", path)
+		}
+		if _, err := configArgs(name, value); err != nil {
+			return nil, fmt.Errorf("invalid setting '%s' in config file '%s': %s", name, path, err)
+		}
+	}
+	return config, nil
+}
+
+// configArgs converts a setting from a config file to flags.
+func configArgs(name string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if v {
+			return []string{"--" + name}, nil
+		}
+		return []string{"--no-" + name}, nil
+	case []interface{}:
+		args := []string{}
+		for _, item := range v {
+			if !isScalar(item) {
+				return nil, fmt.Errorf("expected list of values")
+			}
+			args = append(args, fmt.Sprintf("--%s=%v", name, item))
+		}
+		return args, nil
+	}
+	if !isScalar(value) {
+		return nil, fmt.Errorf("expected value or list of values")
+	}
+	return []string{fmt.Sprintf("--%s=%v", name, value)}, nil
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, int, int64, uint64, float64, bool:
+		return true
+	}
+	return false
+}
+
+// givenFlags returns the names of flags given in the arguments.
+func givenFlags(args []string) map[string]bool {
+	given := map[string]bool{}
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "--") {
+			continue
+		}
+		name := strings.SplitN(arg[2:], "=", 2)[0]
+		given[name] = true
+		given[strings.TrimPrefix(name, "no-")] = true
+	}
+	return given
+}
+
+// withConfigFile adds the settings from the config file given with --config
+// (if any) to the arguments. Flags given on the command line take precedence
+// over (and replace, for repeatable flags) settings in the config file.
+func withConfigFile(args []string) ([]string, map[string]interface{}, error) {
+	path := configFileArg(args)
+	if path == "" {
+		return args, nil, nil
+	}
+	config, err := loadConfigFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	given := givenFlags(args)
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Flags from the config file go before any "--" terminator
+	end := len(args)
+	for i, arg := range args {
+		if arg == "--" {
+			end = i
+			break
+		}
+	}
+	expanded := append([]string{}, args[:end]...)
+	for _, name := range names {
+		if given[name] {
+			continue
+		}
+		flags, _ := configArgs(name, config[name])
+		expanded = append(expanded, flags...)
+	}
+	return append(expanded, args[end:]...), config, nil
+}
+
+// configFile is a config file that was loaded at startup. On reload, the
+// file is read again to check that it's still valid. Server access control
+// flags (allow-* and deny-*) that weren't given on the command line are
+// applied right away. Other flags can't be changed at runtime, so changed
+// settings are logged and take effect on restart (or on upgrade via SIGUSR2,
+// which hands off listening sockets to a new process).
+type configFile struct {
+	path string
+	// Settings we are running with
+	settings map[string]interface{}
+	// Flags given on the command line, which take precedence over the file
+	given map[string]bool
+	// Server ACL to update on reload (nil if none)
+	acl *reloadableACL
+}
+
+// Reload reads the config file again, applies changed access control
+// settings, and logs other settings that differ from the ones we are running
+// with. If the access control settings are invalid, the current ones are
+// kept and an error is returned.
+func (c *configFile) Reload() error {
+	settings, err := loadConfigFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	changed := changedSettings(c.settings, settings)
+	restart := []string{}
+	applied := []string{}
+	for _, name := range changed {
+		if flag, ok := aclSettings[name]; ok && c.acl != nil && !givenFlag(flag, c.given) {
+			applied = append(applied, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+
+	if len(applied) > 0 {
+		if err := c.acl.update(settings, c.given); err != nil {
+			return fmt.Errorf("access control settings in config file '%s' not applied: %s", c.path, err)
+		}
+		for _, name := range applied {
+			if value, ok := settings[name]; ok {
+				c.settings[name] = value
+			} else {
+				delete(c.settings, name)
+			}
+		}
+		logger.Printf("applied access control settings from config file '%s': %s", c.path, strings.Join(applied, ", "))
+	}
+	if len(restart) > 0 {
+		logger.Printf("settings in config file '%s' have changed (restart to apply, only allow-* and deny-* settings in server mode are applied on reload): %s", c.path, strings.Join(restart, ", "))
+	}
+	return nil
+}
+
+// changedSettings returns the names of settings that differ between two
+// versions of a config file.
+func changedSettings(old, new map[string]interface{}) []string {
+	changed := []string{}
+	for name, value := range new {
+		if !reflect.DeepEqual(old[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,150 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "ghostunnel-config")
+	assert.Nil(t, err, "should create temp file")
+	file.WriteString(contents)
+	file.Close()
+	return file.Name()
+}
+
+func TestConfigFileArg(t *testing.T) {
+	assert.Equal(t, "a.yaml", configFileArg([]string{"server", "--config=a.yaml"}))
+	assert.Equal(t, "b.yaml", configFileArg([]string{"--config", "b.yaml", "server"}))
+	assert.Equal(t, "", configFileArg([]string{"server", "--", "--config=a.yaml"}))
+	assert.Equal(t, "", configFileArg([]string{"server", "--config"}))
+}
+
+func TestWithConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+listen: localhost:8443
+target: localhost:8080
+keystore: server.p12
+allow-cn: [client1, client2]
+max-concurrent-conns: 100
+connect-timeout: 5s
+unsafe-target: false
+enable-pprof: true
+`)
+	defer os.Remove(path)
+
+	args, settings, err := withConfigFile([]string{"server", "--config=" + path, "--allow-cn=other", "--enable-pprof=false"})
+	assert.Nil(t, err, "should load config file")
+	assert.Equal(t, 8, len(settings), "should return settings")
+	assert.Equal(t, []string{
+		"server", "--config=" + path, "--allow-cn=other", "--enable-pprof=false",
+		"--connect-timeout=5s",
+		"--keystore=server.p12",
+		"--listen=localhost:8443",
+		"--max-concurrent-conns=100",
+		"--target=localhost:8080",
+		"--no-unsafe-target",
+	}, args, "command line flags should take precedence")
+
+	// No config file
+	args, settings, err = withConfigFile([]string{"server", "--listen=localhost:8443"})
+	assert.Nil(t, err, "should work without config file")
+	assert.Nil(t, settings, "should not return settings without config file")
+	assert.Equal(t, []string{"server", "--listen=localhost:8443"}, args, "should not change args")
+
+	// Flags go before "--"
+	args, _, err = withConfigFile([]string{"--config", path, "server", "--enable-pprof", "--", "x"})
+	assert.Nil(t, err, "should load config file")
+	assert.Equal(t, "x", args[len(args)-1], "should keep args after terminator")
+	assert.Equal(t, "--", args[len(args)-2], "should keep terminator")
+}
+
+func TestWithConfigFileTOML(t *testing.T) {
+	file, err := ioutil.TempFile("", "ghostunnel-config*.toml")
+	assert.Nil(t, err, "should create temp file")
+	file.WriteString(`
+listen = "localhost:8443"
+allow-cn = ["client1", "client2"]
+max-concurrent-conns = 100
+connect-timeout = "5s"
+unsafe-target = false
+`)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	args, settings, err := withConfigFile([]string{"server", "--config=" + file.Name()})
+	assert.Nil(t, err, "should load TOML config file")
+	assert.Equal(t, 5, len(settings), "should return settings")
+	assert.Equal(t, []string{
+		"server", "--config=" + file.Name(),
+		"--allow-cn=client1",
+		"--allow-cn=client2",
+		"--connect-timeout=5s",
+		"--listen=localhost:8443",
+		"--max-concurrent-conns=100",
+		"--no-unsafe-target",
+	}, args, "should pass TOML settings as flags")
+
+	file, err = ioutil.TempFile("", "ghostunnel-config*.toml")
+	assert.Nil(t, err, "should create temp file")
+	file.WriteString("listen: localhost:8443\n")
+	file.Close()
+	defer os.Remove(file.Name())
+	_, _, err = withConfigFile([]string{"server", "--config=" + file.Name()})
+	assert.NotNil(t, err, "should parse .toml files as TOML")
+}
+
+func TestConfigFileInvalid(t *testing.T) {
+	for _, contents := range []string{
+		"not-a-flag: true",
+		"config: other.yaml",
+		"listen: {nested: true}",
+		"allow-cn: [[nested]]",
+		"[list]",
+	} {
+		path := writeConfigFile(t, contents)
+		_, _, err := withConfigFile([]string{"server", "--config", path})
+		assert.NotNil(t, err, "should reject config file: %s", contents)
+		os.Remove(path)
+	}
+
+	_, _, err := withConfigFile([]string{"server", "--config=/does-not-exist"})
+	assert.NotNil(t, err, "should fail for missing config file")
+}
+
+func TestConfigFileReload(t *testing.T) {
+	path := writeConfigFile(t, "listen: localhost:8443\nallow-cn: [client]\n")
+	defer os.Remove(path)
+
+	settings, err := loadConfigFile(path)
+	assert.Nil(t, err, "should load config file")
+	config := &configFile{path: path, settings: settings}
+	assert.Nil(t, config.Reload(), "should reload unchanged config file")
+
+	ioutil.WriteFile(path, []byte("listen: localhost:9443\nunsafe-target: true\n"), 0600)
+	assert.Nil(t, config.Reload(), "should reload changed config file")
+	newSettings, _ := loadConfigFile(path)
+	assert.Equal(t, []string{"allow-cn", "listen", "unsafe-target"}, changedSettings(settings, newSettings), "should detect changed settings")
+
+	ioutil.WriteFile(path, []byte("invalid: [\n"), 0600)
+	assert.NotNil(t, config.Reload(), "should fail to reload invalid config file")
+}
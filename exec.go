@@ -0,0 +1,235 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/square/ghostunnel/proxy"
+)
+
+// Prefix for --target in server mode to run a command for each connection
+// (inetd-style) instead of dialing a target.
+const execTargetPrefix = "exec:"
+
+// How long a command may keep running after its connection is closed, before
+// it's killed.
+const execKillTimeout = 5 * time.Second
+
+func isExecTarget(address string) bool {
+	return strings.HasPrefix(address, execTargetPrefix)
+}
+
+// execCommand splits an exec: target into the command and its arguments
+// (separated by whitespace, quoting isn't supported).
+func execCommand(address string) []string {
+	return strings.Fields(strings.TrimPrefix(address, execTargetPrefix))
+}
+
+// validateExecTarget checks flags that can't be used with an exec: target.
+func validateExecTarget() error {
+	if !isExecTarget(*serverForwardAddress) {
+		return nil
+	}
+	if len(execCommand(*serverForwardAddress)) == 0 {
+		return errors.New("--target with exec: prefix must include a command (e.g. exec:/usr/bin/rsync --server --daemon .)")
+	}
+	if *serverTargetBackup != "" || len(*serverRoutes) > 0 || (*serverHealthCheck != "" && *serverHealthCheck != "off") {
+		return errors.New("--target-backup, --route and --target-health-check can't be used with --target exec:")
+	}
+	if *serverTargetTLS || *serverProxyProtocol {
+		return errors.New("--target-tls and --target-proxy-protocol can't be used with --target exec:")
+	}
+	return nil
+}
+
+// execDialer returns a function that runs the command for a connection, with
+// the connection attached to its stdin/stdout, and information about the
+// client in environment variables (see execEnvironment).
+func execDialer(args []string) func(conn net.Conn) (net.Conn, error) {
+	return func(conn net.Conn) (net.Conn, error) {
+		stdinReader, stdinWriter, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		stdoutReader, stdoutWriter, err := os.Pipe()
+		if err != nil {
+			stdinReader.Close()
+			stdinWriter.Close()
+			return nil, err
+		}
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = stdinReader, stdoutWriter, os.Stderr
+		cmd.Env = append(os.Environ(), execEnvironment(conn)...)
+		err = cmd.Start()
+		// The child has its own copies of these now
+		stdinReader.Close()
+		stdoutWriter.Close()
+		if err != nil {
+			stdinWriter.Close()
+			stdoutReader.Close()
+			return nil, err
+		}
+
+		c := &execConn{
+			stdin:  stdinWriter,
+			stdout: stdoutReader,
+			cmd:    cmd,
+			addr:   execAddr(args[0]),
+			exited: make(chan struct{}),
+		}
+		go func() {
+			if err := cmd.Wait(); err != nil {
+				logger.Printf("command %s for %s exited: %s", args[0], conn.RemoteAddr(), err)
+			}
+			close(c.exited)
+		}()
+		return c, nil
+	}
+}
+
+// execEnvironment returns environment variables describing the client of a
+// connection, for commands run with --target exec:. Variables with several
+// values (e.g. SANs) are comma-separated. With --channel-binding, the
+// tls-exporter channel binding is passed too (if the session has one).
+func execEnvironment(conn net.Conn) []string {
+	env := []string{"GHOSTUNNEL_CLIENT_ADDR=" + conn.RemoteAddr().String()}
+	tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return env
+	}
+	state := tlsConn.ConnectionState()
+	env = append(env, "GHOSTUNNEL_TLS_SERVER_NAME="+state.ServerName)
+	if *serverChannelBinding {
+		if binding, err := proxy.ChannelBinding(conn); err == nil {
+			env = append(env, "GHOSTUNNEL_TLS_CHANNEL_BINDING="+binding)
+		}
+	}
+	if len(state.PeerCertificates) == 0 {
+		return env
+	}
+
+	cert := state.PeerCertificates[0]
+	uris := []string{}
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	ips := []string{}
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	return append(env,
+		"GHOSTUNNEL_CLIENT_CN="+cert.Subject.CommonName,
+		"GHOSTUNNEL_CLIENT_OU="+strings.Join(cert.Subject.OrganizationalUnit, ","),
+		"GHOSTUNNEL_CLIENT_DNS_SAN="+strings.Join(cert.DNSNames, ","),
+		"GHOSTUNNEL_CLIENT_IP_SAN="+strings.Join(ips, ","),
+		"GHOSTUNNEL_CLIENT_URI_SAN="+strings.Join(uris, ","),
+		"GHOSTUNNEL_CLIENT_SERIAL="+fmt.Sprintf("%x", cert.SerialNumber),
+	)
+}
+
+// execAddr is the address of a command run for a connection (its path).
+type execAddr string
+
+func (a execAddr) Network() string { return "exec" }
+func (a execAddr) String() string  { return string(a) }
+
+// execConn is a connection to the stdin/stdout of a command.
+type execConn struct {
+	stdin  *os.File
+	stdout *os.File
+	cmd    *exec.Cmd
+	addr   execAddr
+	exited chan struct{}
+
+	closeOnce sync.Once
+	closed    int32
+}
+
+// Read reads from stdout of the command. Errors are mapped to network errors,
+// so timeouts and reads after Close are handled like on other connections.
+func (c *execConn) Read(b []byte) (int, error) {
+	n, err := c.stdout.Read(b)
+	return n, c.mapError("read", err)
+}
+
+// Write writes to stdin of the command.
+func (c *execConn) Write(b []byte) (int, error) {
+	n, err := c.stdin.Write(b)
+	return n, c.mapError("write", err)
+}
+
+func (c *execConn) mapError(op string, err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return os.ErrDeadlineExceeded
+	}
+	if err != nil && atomic.LoadInt32(&c.closed) == 1 {
+		return &net.OpError{Op: op, Net: "exec", Err: net.ErrClosed}
+	}
+	return err
+}
+
+// Close closes stdin/stdout of the command, and kills it if it doesn't exit
+// on its own within execKillTimeout.
+func (c *execConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		c.stdin.Close()
+		c.stdout.Close()
+		go func() {
+			select {
+			case <-c.exited:
+			case <-time.After(execKillTimeout):
+				c.cmd.Process.Kill()
+			}
+		}()
+	})
+	return nil
+}
+
+func (c *execConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *execConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *execConn) SetDeadline(t time.Time) error {
+	if err := c.stdout.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.stdin.SetWriteDeadline(t)
+}
+
+func (c *execConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *execConn) SetWriteDeadline(t time.Time) error {
+	return c.stdin.SetWriteDeadline(t)
+}
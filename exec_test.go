@@ -0,0 +1,134 @@
+//go:build !windows
+// +build !windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecDialer(t *testing.T) {
+	client, _ := net.Pipe()
+	backend, err := execDialer([]string{"cat"})(client)
+	assert.Nil(t, err, "should start command")
+	assert.Equal(t, "exec", backend.RemoteAddr().Network())
+
+	_, err = backend.Write([]byte("hello"))
+	assert.Nil(t, err, "should write to stdin of command")
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(backend, buf)
+	assert.Nil(t, err, "should read from stdout of command")
+	assert.Equal(t, "hello", string(buf))
+
+	backend.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = backend.Read(buf)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "should time out reading")
+
+	backend.Close()
+	_, err = backend.Read(buf)
+	assert.Contains(t, err.Error(), "closed network connection", "should fail reading after close")
+}
+
+func TestExecDialerExit(t *testing.T) {
+	client, _ := net.Pipe()
+	backend, err := execDialer([]string{"sh", "-c", "echo $GHOSTUNNEL_CLIENT_ADDR"})(client)
+	assert.Nil(t, err, "should start command")
+	data, err := ioutil.ReadAll(backend)
+	assert.Nil(t, err, "should read until command exits")
+	assert.Equal(t, client.RemoteAddr().String()+"\n", string(data), "should pass client address in environment")
+	backend.Close()
+
+	_, err = execDialer([]string{"/does/not/exist"})(client)
+	assert.NotNil(t, err, "should fail if command can't be started")
+}
+
+// fakeTLSConn is a connection with a fixed TLS connection state.
+type fakeTLSConn struct {
+	net.Conn
+	state tls.ConnectionState
+}
+
+func (c *fakeTLSConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+func TestExecEnvironment(t *testing.T) {
+	client, _ := net.Pipe()
+	uri, _ := url.Parse("spiffe://example.com/client")
+	conn := &fakeTLSConn{Conn: client, state: tls.ConnectionState{
+		ServerName: "server.example.com",
+		PeerCertificates: []*x509.Certificate{{
+			Subject:      pkix.Name{CommonName: "client", OrganizationalUnit: []string{"a", "b"}},
+			DNSNames:     []string{"client.example.com"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			URIs:         []*url.URL{uri},
+			SerialNumber: big.NewInt(255),
+		}},
+	}}
+
+	env := execEnvironment(conn)
+	assert.Contains(t, env, "GHOSTUNNEL_TLS_SERVER_NAME=server.example.com")
+	assert.Contains(t, env, "GHOSTUNNEL_CLIENT_CN=client")
+	assert.Contains(t, env, "GHOSTUNNEL_CLIENT_OU=a,b")
+	assert.Contains(t, env, "GHOSTUNNEL_CLIENT_DNS_SAN=client.example.com")
+	assert.Contains(t, env, "GHOSTUNNEL_CLIENT_IP_SAN=127.0.0.1")
+	assert.Contains(t, env, "GHOSTUNNEL_CLIENT_URI_SAN=spiffe://example.com/client")
+	assert.Contains(t, env, "GHOSTUNNEL_CLIENT_SERIAL=ff")
+
+	assert.Equal(t, []string{"GHOSTUNNEL_CLIENT_ADDR=pipe"}, execEnvironment(client), "should only pass address without TLS")
+
+	*serverChannelBinding = true
+	assert.NotContains(t, strings.Join(execEnvironment(conn), "\n"), "GHOSTUNNEL_TLS_CHANNEL_BINDING", "should not pass channel binding before handshake")
+	*serverChannelBinding = false
+}
+
+func TestValidateExecTarget(t *testing.T) {
+	defer func() {
+		*serverForwardAddress = ""
+		*serverRoutes = nil
+		*serverTargetTLS = false
+	}()
+
+	*serverForwardAddress = "127.0.0.1:8080"
+	assert.Nil(t, validateExecTarget(), "should ignore other targets")
+	*serverForwardAddress = "exec:"
+	assert.NotNil(t, validateExecTarget(), "should require a command")
+	*serverForwardAddress = "exec:/usr/bin/rsync --server --daemon ."
+	assert.Nil(t, validateExecTarget(), "should accept command")
+	assert.Equal(t, []string{"/usr/bin/rsync", "--server", "--daemon", "."}, execCommand(*serverForwardAddress))
+	assert.Equal(t, []string{*serverForwardAddress}, serverTargets(), "should not split command")
+	*serverRoutes = []string{"sni=a.example.com,target=localhost:8081"}
+	assert.NotNil(t, validateExecTarget(), "should reject routes")
+	*serverRoutes = nil
+	*serverTargetTLS = true
+	assert.NotNil(t, validateExecTarget(), "should reject --target-tls")
+}
@@ -0,0 +1,43 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/square/ghostunnel/certloader"
+)
+
+// withFallbackCertificates wraps the default certificate to present client
+// certificates from --keystore-fallback flags to servers that don't accept
+// the default certificate, if any are set.
+func withFallbackCertificates(cert certloader.Certificate) (certloader.Certificate, error) {
+	if len(*clientKeystores) == 0 {
+		return cert, nil
+	}
+
+	fallbacks := []certloader.Certificate{}
+	for _, path := range *clientKeystores {
+		fallback, err := buildKeystore(path, *keystorePass, *caBundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load fallback keystore %s: %s", path, err)
+		}
+		logger.Printf("using fallback client certificate from %s", path)
+		fallbacks = append(fallbacks, fallback)
+	}
+	return certloader.CertificateWithFallbacks(cert, fallbacks), nil
+}
@@ -0,0 +1,30 @@
+//go:build go1.24 && !boringcrypto
+// +build go1.24,!boringcrypto
+
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import "crypto/fips140"
+
+// fipsModule returns the name of the FIPS 140 crypto module in use, if any.
+// The Go Cryptographic Module is enabled with GODEBUG=fips140=on (or only).
+func fipsModule() string {
+	if fips140.Enabled() {
+		return "go"
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// firstByteListener wraps a listener to close connections that don't send
+// anything within the given timeout after being accepted, e.g. scanners that
+// open a connection but never start a TLS handshake. Applies until the first
+// byte arrives, read deadlines set later (e.g. for the handshake) still apply
+// but can't extend it.
+type firstByteListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l *firstByteListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &firstByteConn{Conn: conn, firstByteDeadline: time.Now().Add(l.timeout)}
+	if err := conn.SetReadDeadline(c.firstByteDeadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+type firstByteConn struct {
+	net.Conn
+	firstByteDeadline time.Time
+
+	mu       sync.Mutex
+	received bool
+	// Read deadline set by the user of the connection
+	readDeadline time.Time
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		if !c.received {
+			c.received = true
+			c.Conn.SetReadDeadline(c.readDeadline)
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *firstByteConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *firstByteConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if !c.received && (t.IsZero() || t.After(c.firstByteDeadline)) {
+		t = c.firstByteDeadline
+	}
+	return c.Conn.SetReadDeadline(t)
+}
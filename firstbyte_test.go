@@ -0,0 +1,78 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFirstByteListener(t *testing.T, timeout time.Duration) (net.Listener, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	return &firstByteListener{Listener: listener, timeout: timeout}, listener.Addr().String()
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	listener, addr := newTestFirstByteListener(t, 50*time.Millisecond)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", addr)
+	assert.Nil(t, err, "should connect")
+	defer client.Close()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept")
+	defer conn.Close()
+
+	// Longer deadline (e.g. for the handshake) doesn't extend the timeout
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "should time out without first byte")
+	assert.True(t, time.Since(start) < time.Second, "should time out after first byte timeout")
+}
+
+func TestFirstByteReceived(t *testing.T) {
+	listener, addr := newTestFirstByteListener(t, 50*time.Millisecond)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", addr)
+	assert.Nil(t, err, "should connect")
+	defer client.Close()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept")
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("x"))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Nil(t, err, "should read first byte")
+
+	// Deadline set by the user applies once the first byte arrived
+	time.Sleep(100 * time.Millisecond)
+	client.Write([]byte("y"))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Nil(t, err, "should not time out after first byte")
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "should apply user deadline")
+}
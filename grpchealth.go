@@ -0,0 +1,94 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// How often status is re-checked for clients watching it
+var grpcHealthWatchInterval = 5 * time.Second
+
+// grpcHealthServer implements the gRPC health checking protocol
+// (grpc.health.v1.Health) on top of the status handler. The only known
+// service is the empty name, for the overall status of ghostunnel.
+type grpcHealthServer struct {
+	status *statusHandler
+}
+
+func (h *grpcHealthServer) servingStatus() healthpb.HealthCheckResponse_ServingStatus {
+	if h.status.check().Ok {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
+func (h *grpcHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if req.Service != "" {
+		return nil, grpcstatus.Error(codes.NotFound, "unknown service")
+	}
+	return &healthpb.HealthCheckResponse{Status: h.servingStatus()}, nil
+}
+
+func (h *grpcHealthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if req.Service != "" {
+		return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVICE_UNKNOWN})
+	}
+
+	ticker := time.NewTicker(grpcHealthWatchInterval)
+	defer ticker.Stop()
+
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		if current := h.servingStatus(); current != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: current}); err != nil {
+				return err
+			}
+			last = current
+		}
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// withGRPCHealth serves gRPC health checks for the given status handler, and
+// passes other requests on to next. gRPC needs HTTP/2, which is also accepted
+// without TLS (h2c), as used by most probes.
+func withGRPCHealth(status *statusHandler, next http.Handler) http.Handler {
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, &grpcHealthServer{status: status})
+
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			server.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), &http2.Server{})
+}
@@ -0,0 +1,111 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+func newTestGRPCHealthClient(t *testing.T, status *statusHandler) (healthpb.HealthClient, func()) {
+	server := httptest.NewServer(withGRPCHealth(status, status))
+	conn, err := grpc.Dial(strings.TrimPrefix(server.URL, "http://"), grpc.WithInsecure())
+	assert.Nil(t, err, "should dial status port")
+	return healthpb.NewHealthClient(conn), func() {
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	status := newStatusHandler(dummyDial)
+	client, cleanup := newTestGRPCHealthClient(t, status)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err, "should check health")
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status, "should not be serving before listening")
+
+	status.Listening()
+	resp, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err, "should check health")
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status, "should be serving once listening")
+
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "other"})
+	assert.Equal(t, codes.NotFound, grpcstatus.Code(err), "should reject unknown services")
+}
+
+func TestGRPCHealthCheckBackendDown(t *testing.T) {
+	status := newStatusHandler(dummyDialError)
+	status.Listening()
+	client, cleanup := newTestGRPCHealthClient(t, status)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err, "should check health")
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status, "should not be serving if backend is down")
+}
+
+func TestGRPCHealthWatch(t *testing.T) {
+	defer func(interval time.Duration) { grpcHealthWatchInterval = interval }(grpcHealthWatchInterval)
+	grpcHealthWatchInterval = 10 * time.Millisecond
+
+	status := newStatusHandler(dummyDial)
+	client, cleanup := newTestGRPCHealthClient(t, status)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err, "should watch health")
+	resp, err := stream.Recv()
+	assert.Nil(t, err, "should receive status")
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status, "should not be serving before listening")
+
+	status.Listening()
+	resp, err = stream.Recv()
+	assert.Nil(t, err, "should receive status change")
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status, "should be serving once listening")
+}
+
+func TestGRPCHealthPassThrough(t *testing.T) {
+	status := newStatusHandler(dummyDial)
+	status.Listening()
+	server := httptest.NewServer(withGRPCHealth(status, status))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/_status")
+	assert.Nil(t, err, "should serve HTTP/1.1 requests")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
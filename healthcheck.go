@@ -0,0 +1,103 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/square/ghostunnel/certloader"
+	"github.com/square/ghostunnel/proxy"
+)
+
+// targetHealthCheck builds a health check for targets with the given mode:
+// tcp (connect), tls (connect and complete a handshake) or http (GET request
+// to path, expecting a 2xx response). For tls checks, the certificate of the
+// target is only verified if a trust store is given.
+func targetHealthCheck(mode, path string, timeout time.Duration, trust certloader.Certificate) proxy.HealthCheck {
+	switch mode {
+	case "tcp":
+		return func(backend *proxy.Backend) error {
+			conn, err := backend.Dial()
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+	case "tls":
+		return func(backend *proxy.Backend) error {
+			conn, err := backend.Dial()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(timeout))
+			config := &tls.Config{ServerName: targetHost(backend.Name)}
+			if trust != nil {
+				config.RootCAs = trust.GetTrustStore()
+			} else {
+				// Only checking liveness here
+				config.InsecureSkipVerify = true
+			}
+			return tls.Client(conn, config).Handshake()
+		}
+	case "http":
+		return func(backend *proxy.Backend) error {
+			client := &http.Client{
+				Timeout: timeout,
+				Transport: &http.Transport{
+					DialContext: func(context.Context, string, string) (net.Conn, error) {
+						return backend.Dial()
+					},
+					DisableKeepAlives: true,
+				},
+			}
+			resp, err := client.Get("http://" + targetHost(backend.Name) + path)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				return fmt.Errorf("unexpected status %s", resp.Status)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// targetHost returns the host name of a target address (for SNI and HTTP
+// Host headers), or localhost for UNIX sockets.
+func targetHost(target string) string {
+	if strings.HasPrefix(target, "unix:") {
+		return "localhost"
+	}
+	host, _, err := net.SplitHostPort(strings.TrimPrefix(target, "udp:"))
+	if err != nil || host == "" {
+		return "localhost"
+	}
+	return host
+}
@@ -0,0 +1,117 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/ghostunnel/certloader"
+	"github.com/square/ghostunnel/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func testBackend(t *testing.T, address string) *proxy.Backend {
+	dial, err := backendDialer(address)
+	assert.Nil(t, err, "should build backend dialer")
+	return proxy.NewBackend(address, dial)
+}
+
+func TestTargetHealthCheckTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	check := targetHealthCheck("tcp", "/", time.Second, nil)
+	assert.Nil(t, check(testBackend(t, ln.Addr().String())), "should pass when target accepts connections")
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	closed.Close()
+	assert.NotNil(t, check(testBackend(t, closed.Addr().String())), "should fail when target refuses connections")
+}
+
+func TestTargetHealthCheckTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	check := targetHealthCheck("tls", "/", time.Second, nil)
+	assert.Nil(t, check(testBackend(t, server.Listener.Addr().String())), "should pass when handshake succeeds")
+
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	assert.NotNil(t, check(testBackend(t, plain.Listener.Addr().String())), "should fail when handshake fails")
+}
+
+func TestTargetHealthCheckTLSVerify(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "ghostunnel-target-ca")
+	assert.Nil(t, err, "should create temp file")
+	defer os.Remove(file.Name())
+	pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	file.Close()
+
+	trusted, err := certloader.NoCertificate(file.Name())
+	assert.Nil(t, err, "should load target CA bundle")
+	check := targetHealthCheck("tls", "/", time.Second, trusted)
+	assert.Nil(t, check(testBackend(t, server.Listener.Addr().String())), "should pass when target certificate is trusted")
+
+	untrusted, err := certloader.NoCertificate("test-keys/cacert.pem")
+	assert.Nil(t, err, "should load CA bundle")
+	check = targetHealthCheck("tls", "/", time.Second, untrusted)
+	assert.NotNil(t, check(testBackend(t, server.Listener.Addr().String())), "should fail when target certificate isn't trusted")
+}
+
+func TestTargetHealthCheckHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthy" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	assert.Nil(t, targetHealthCheck("http", "/healthy", time.Second, nil)(testBackend(t, address)), "should pass on 2xx response")
+	assert.NotNil(t, targetHealthCheck("http", "/", time.Second, nil)(testBackend(t, address)), "should fail on non-2xx response")
+}
+
+func TestTargetHost(t *testing.T) {
+	assert.Equal(t, "backend.example.com", targetHost("backend.example.com:8443"), "should use host of target")
+	assert.Equal(t, "localhost", targetHost("unix:/tmp/backend"), "should use localhost for unix sockets")
+	assert.Nil(t, targetHealthCheck("off", "/", time.Second, nil), "should not build check if disabled")
+}
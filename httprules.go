@@ -0,0 +1,111 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/square/ghostunnel/auth"
+	"github.com/square/ghostunnel/proxy"
+	"github.com/square/ghostunnel/wildcard"
+)
+
+var errNoClientCertificate = errors.New("unauthorized: no client certificate")
+
+// parseHTTPRule parses an --http-allow flag value, of the form
+// path=PREFIX,cn=CN (with one path, and at least one of cn, ou, dns or uri;
+// those can be repeated, and clients matching any of them are allowed).
+func parseHTTPRule(value string) (*proxy.HTTPRule, error) {
+	var path string
+	var cns, ous, dnss, uris []string
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid http rule '%s', expected key=value pairs (e.g. path=/admin,cn=admin)", value)
+		}
+		switch kv[0] {
+		case "path":
+			if path != "" {
+				return nil, fmt.Errorf("invalid http rule '%s', path given more than once", value)
+			}
+			path = kv[1]
+		case "cn":
+			cns = append(cns, kv[1])
+		case "ou":
+			ous = append(ous, kv[1])
+		case "dns":
+			dnss = append(dnss, kv[1])
+		case "uri":
+			uris = append(uris, kv[1])
+		default:
+			return nil, fmt.Errorf("invalid http rule '%s', unknown key '%s'", value, kv[0])
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid http rule '%s', path must start with '/'", value)
+	}
+	if len(cns) == 0 && len(ous) == 0 && len(dnss) == 0 && len(uris) == 0 {
+		return nil, fmt.Errorf("invalid http rule '%s', missing cn, ou, dns or uri", value)
+	}
+
+	allowedCNs, allowedCNPatterns, err := auth.SplitPatterns(cns, '.')
+	if err != nil {
+		return nil, fmt.Errorf("invalid http rule '%s', bad cn pattern: %s", value, err)
+	}
+	allowedDNSs, allowedDNSPatterns, err := auth.SplitPatternsFold(dnss, '.')
+	if err != nil {
+		return nil, fmt.Errorf("invalid http rule '%s', bad dns pattern: %s", value, err)
+	}
+	allowedURIs, err := wildcard.CompileList(uris)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http rule '%s', bad uri pattern: %s", value, err)
+	}
+	acl := auth.ACL{
+		AllowedCNs:         allowedCNs,
+		AllowedCNPatterns:  allowedCNPatterns,
+		AllowedOUs:         ous,
+		AllowedDNSs:        allowedDNSs,
+		AllowedDNSPatterns: allowedDNSPatterns,
+		AllowedURIs:        allowedURIs,
+	}
+
+	return &proxy.HTTPRule{
+		PathPrefix: path,
+		Verify: func(state *tls.ConnectionState) error {
+			if state == nil || len(state.PeerCertificates) == 0 {
+				return errNoClientCertificate
+			}
+			return acl.VerifyPeerCertificateServer(nil, [][]*x509.Certificate{state.PeerCertificates})
+		},
+	}, nil
+}
+
+// serverHTTPRules builds rules from the --http-allow flags.
+func serverHTTPRules() ([]proxy.HTTPRule, error) {
+	rules := []proxy.HTTPRule{}
+	for _, value := range *serverHTTPAllow {
+		rule, err := parseHTTPRule(value)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,67 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHTTPRule(t *testing.T) {
+	rule, err := parseHTTPRule("path=/admin,cn=admin,uri=spiffe://example.com/ops/*")
+	assert.Nil(t, err, "should parse rule")
+	assert.Equal(t, "/admin", rule.PathPrefix)
+
+	admin := &x509.Certificate{Subject: pkix.Name{CommonName: "admin"}}
+	ops, _ := url.Parse("spiffe://example.com/ops/deploy")
+	operator := &x509.Certificate{Subject: pkix.Name{CommonName: "deploy"}, URIs: []*url.URL{ops}}
+	other := &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}
+
+	assert.Nil(t, rule.Verify(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{admin}}), "should allow matching cn")
+	assert.Nil(t, rule.Verify(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{operator}}), "should allow matching uri")
+	assert.NotNil(t, rule.Verify(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}}), "should deny other clients")
+	assert.NotNil(t, rule.Verify(&tls.ConnectionState{}), "should deny clients without certificate")
+	assert.NotNil(t, rule.Verify(nil), "should deny connections without TLS state")
+
+	for _, invalid := range []string{
+		"",
+		"path=/admin",
+		"cn=admin",
+		"path=admin,cn=admin",
+		"path=/a,path=/b,cn=admin",
+		"path=/admin,cn=",
+		"path=/admin,ip=127.0.0.1",
+		"path=/admin,uri=spiffe://**/a/**",
+	} {
+		_, err := parseHTTPRule(invalid)
+		assert.NotNil(t, err, "should reject invalid rule '%s'", invalid)
+	}
+}
+
+func TestServerHTTPRules(t *testing.T) {
+	*serverHTTPAllow = []string{"path=/admin,cn=admin", "path=/metrics,ou=monitoring"}
+	defer func() { *serverHTTPAllow = nil }()
+
+	rules, err := serverHTTPRules()
+	assert.Nil(t, err, "should parse rules")
+	assert.Len(t, rules, 2)
+	assert.Equal(t, "/metrics", rules[1].PathPrefix)
+}
@@ -0,0 +1,100 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/ghostunnel/proxy"
+)
+
+// jsonLogWriter formats each log line as a JSON object, for use with --log-format=json.
+type jsonLogWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+	pid int
+	now func() time.Time
+}
+
+func newJSONLogWriter(out io.Writer) *jsonLogWriter {
+	return &jsonLogWriter{
+		out: out,
+		pid: os.Getpid(),
+		now: time.Now,
+	}
+}
+
+// Write logs a free-form message (as written by log.Logger).
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	err := w.LogFields(strings.TrimSpace(string(p)), nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// LogFields logs a message with additional structured fields.
+func (w *jsonLogWriter) LogFields(msg string, fields map[string]interface{}) error {
+	entry := map[string]interface{}{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = w.now().Format(time.RFC3339Nano)
+	entry["pid"] = w.pid
+	entry["message"] = msg
+
+	out, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.out.Write(append(out, '\n'))
+	return err
+}
+
+// fieldWriter is implemented by log writers that support structured fields
+// (the JSON and syslog writers).
+type fieldWriter interface {
+	LogFields(msg string, fields map[string]interface{}) error
+}
+
+// fieldLogger passes structured fields from the proxy to the log writer.
+type fieldLogger struct {
+	*log.Logger
+	writer fieldWriter
+}
+
+func (l *fieldLogger) LogFields(msg string, fields map[string]interface{}) {
+	_ = l.writer.LogFields(msg, fields)
+}
+
+// proxyLogger returns the logger for the proxy, with support for structured
+// fields if we're logging JSON or to a syslog server.
+func proxyLogger() proxy.Logger {
+	if w, ok := logger.Writer().(fieldWriter); ok {
+		return &fieldLogger{logger, w}
+	}
+	return logger
+}
@@ -0,0 +1,57 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// keyLog is where TLS (and DTLS) session secrets are written with
+// --keylog-file, in NSS key log format. Nil otherwise.
+var keyLog io.Writer
+
+// openKeyLog opens the --keylog-file (if set) for appending. The file is
+// created readable only by the current user, since anyone with it can
+// decrypt captured traffic.
+func openKeyLog() error {
+	if *keyLogPath == "" {
+		return nil
+	}
+	file, err := os.OpenFile(*keyLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	keyLog = &lockedWriter{writer: file}
+	logger.Printf("warning: writing TLS session secrets to %s (--keylog-file), sessions can be decrypted by anyone with this file", *keyLogPath)
+	return nil
+}
+
+// lockedWriter serializes writes from concurrent handshakes, so lines in the
+// key log don't get interleaved (crypto/tls does this itself, the DTLS library
+// doesn't).
+type lockedWriter struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func (w *lockedWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writer.Write(b)
+}
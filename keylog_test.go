@@ -0,0 +1,61 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenKeyLog(t *testing.T) {
+	*keyLogPath = filepath.Join(t.TempDir(), "keys.log")
+	defer func() {
+		*keyLogPath = ""
+		keyLog = nil
+	}()
+
+	err := openKeyLog()
+	assert.Nil(t, err, "should open key log")
+	info, err := os.Stat(*keyLogPath)
+	assert.Nil(t, err, "should create key log")
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "key log should only be readable by owner")
+	}
+
+	config, err := buildConfig("AES")
+	assert.Nil(t, err, "should build config")
+	assert.Equal(t, keyLog, config.KeyLogWriter, "should set key log on config")
+
+	keyLog.Write([]byte("CLIENT_RANDOM 00 00\n"))
+	keyLog.Write([]byte("CLIENT_RANDOM 01 01\n"))
+	data, _ := ioutil.ReadFile(*keyLogPath)
+	assert.Equal(t, 2, strings.Count(string(data), "CLIENT_RANDOM"), "should append lines to key log")
+}
+
+func TestOpenKeyLogError(t *testing.T) {
+	*keyLogPath = filepath.Join(t.TempDir(), "missing", "keys.log")
+	defer func() { *keyLogPath = "" }()
+	err := openKeyLog()
+	assert.NotNil(t, err, "should fail if key log can't be created")
+	assert.Nil(t, keyLog)
+}
@@ -0,0 +1,54 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/square/ghostunnel/certloader"
+)
+
+// buildListenerCertificate loads the certificate for accepting TLS from local
+// callers in client mode (--listen-keystore), with the CA bundle for verifying
+// their certificates (--listen-cacert). Returns nil if --listen-keystore
+// isn't set, in which case the listener is plaintext.
+func buildListenerCertificate() (certloader.Certificate, error) {
+	if *clientListenKeystore == "" {
+		return nil, nil
+	}
+	return buildKeystore(*clientListenKeystore, *keystorePass, *clientListenCA)
+}
+
+// wrapListenerTLS wraps the client mode listener in TLS, using the given
+// certificate. Callers have to present a certificate signed by a CA from
+// --listen-cacert, if set.
+func wrapListenerTLS(listener net.Listener, cert certloader.Certificate) (net.Listener, error) {
+	config, err := buildServerConfig(*enabledCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	if *clientListenCA == "" {
+		config.ClientAuth = tls.NoClientCert
+	}
+
+	serverConfig, err := certloader.TLSConfigSourceFromCertificate(cert).GetServerConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return certloader.NewListener(listener, serverConfig), nil
+}
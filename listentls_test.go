@@ -0,0 +1,88 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenerTLS(t *testing.T) {
+	*clientListenKeystore = "test-keys/server-combined.pem"
+	*clientListenCA = "test-keys/cacert.pem"
+	*enabledCipherSuites = "AES,CHACHA"
+	defer func() {
+		*clientListenKeystore = ""
+		*clientListenCA = ""
+		*enabledCipherSuites = ""
+	}()
+
+	cert, err := buildListenerCertificate()
+	assert.Nil(t, err, "should load listener certificate")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	listener, err := wrapListenerTLS(ln, cert)
+	assert.Nil(t, err, "should wrap listener in TLS")
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	caCert, _ := ioutil.ReadFile("test-keys/cacert.pem")
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caCert)
+	clientCert, err := tls.LoadX509KeyPair("test-keys/client-cert.pem", "test-keys/client-key.pem")
+	assert.Nil(t, err, "should load client certificate")
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{clientCert},
+	})
+	assert.Nil(t, err, "should accept caller with client certificate")
+	if conn != nil {
+		conn.Close()
+	}
+
+	conn, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err == nil {
+		// With TLS 1.3, client certificate errors show up on first read
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	assert.NotNil(t, err, "should reject caller without client certificate")
+}
+
+func TestListenerTLSDisabled(t *testing.T) {
+	cert, err := buildListenerCertificate()
+	assert.Nil(t, err)
+	assert.Nil(t, cert, "should not load certificate without --listen-keystore")
+}
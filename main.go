@@ -18,13 +18,16 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
 	"runtime"
 	"strings"
@@ -37,10 +40,16 @@ import (
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/square/ghostunnel/auth"
 	"github.com/square/ghostunnel/certloader"
+	"github.com/square/ghostunnel/mux"
 	"github.com/square/ghostunnel/proxy"
 	"github.com/square/ghostunnel/socket"
+	"github.com/square/ghostunnel/tracing"
+	"github.com/square/ghostunnel/transport"
 	"github.com/square/ghostunnel/wildcard"
 	sqmetrics "github.com/square/go-sq-metrics"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http/httpproxy"
+	netproxy "golang.org/x/net/proxy"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
 	prometheusmetrics "github.com/deathowl/go-metrics-prometheus"
@@ -57,6 +66,7 @@ var (
 	keychainIdentity *string
 	pkcs11Module     *string
 	pkcs11TokenLabel *string
+	pkcs11KeyLabel   *string
 	pkcs11PIN        *string
 )
 
@@ -65,58 +75,236 @@ var (
 	app = kingpin.New("ghostunnel", "A simple SSL/TLS proxy with mutual authentication for securing non-TLS services.")
 
 	serverCommand        = app.Command("server", "Server mode (TLS listener -> plain TCP/UNIX target).")
-	serverListenAddress  = serverCommand.Flag("listen", "Address and port to listen on (can be HOST:PORT, unix:PATH, systemd:NAME or launchd:NAME).").PlaceHolder("ADDR").Required().String()
-	serverForwardAddress = serverCommand.Flag("target", "Address to forward connections to (can be HOST:PORT or unix:PATH).").PlaceHolder("ADDR").Required().String()
-	serverProxyProtocol  = serverCommand.Flag("proxy-protocol", "Enable PROXY protocol v2 to signal connection info to backend").Bool()
+	serverListenAddress  = serverCommand.Flag("listen", "Address and port to listen on (can be HOST:PORT, udp:HOST:PORT, unix:PATH, unix:@NAME for abstract sockets, npipe:\\\\.\\pipe\\NAME, systemd:NAME or launchd:NAME; can be repeated).").PlaceHolder("ADDR").Required().Strings()
+	serverForwardAddress = serverCommand.Flag("target", "Address to forward connections to (can be HOST:PORT, udp:HOST:PORT, unix:PATH, unix:@NAME for abstract sockets, npipe:\\\\.\\pipe\\NAME, srv:NAME to discover targets from DNS SRV records, exec:COMMAND to run a command for each connection with the connection on stdin/stdout, or a comma-separated list of addresses to balance connections across).").PlaceHolder("ADDR").Required().String()
+	serverTargetBackup   = serverCommand.Flag("target-backup", "Backup address (or comma-separated list of addresses) to forward connections to if no --target is healthy.").PlaceHolder("ADDR").String()
+	serverHealthCheck    = serverCommand.Flag("target-health-check", "Periodically check health of targets, and stop forwarding connections to unhealthy ones: off, tcp (connect), tls (handshake) or http (GET request).").Default("off").Enum("off", "tcp", "tls", "http")
+	serverHealthPath     = serverCommand.Flag("target-health-check-path", "Path to request for http health checks (2xx responses are healthy).").Default("/").String()
+	serverHealthInterval = serverCommand.Flag("target-health-check-interval", "Interval between target health checks.").Default("10s").Duration()
+	serverTargetRefresh  = serverCommand.Flag("target-dns-refresh", "Cache addresses of target host names for the given duration, re-resolving them when it expires or dialing fails (default: resolve on every connection).").PlaceHolder("DURATION").Duration()
+	serverTargetBalance  = serverCommand.Flag("target-balance", "Strategy for balancing connections across multiple targets: round-robin or least-conn.").Default(proxy.RoundRobin).Enum(proxy.RoundRobin, proxy.LeastConnections)
+	serverTargetTLS      = serverCommand.Flag("target-tls", "Connect to targets over TLS, verifying their certificate against --cacert-target (or --cacert).").Bool()
+	serverTargetKeystore = serverCommand.Flag("target-keystore", "Keystore (combined PEM with cert/key, or PKCS12 keystore, using --storepass) with client certificate to present to targets with --target-tls (optional).").PlaceHolder("PATH").String()
+	serverTargetName     = serverCommand.Flag("target-server-name", "Server name for SNI and hostname verification of targets with --target-tls (default: host of target address).").PlaceHolder("NAME").String()
+	serverTargetCNs      = serverCommand.Flag("target-verify-cn", "With --target-tls, only allow targets with given common name, may contain '*' wildcards (can be repeated).").PlaceHolder("CN").Strings()
+	serverTargetDNSs     = serverCommand.Flag("target-verify-dns", "With --target-tls, only allow targets with given DNS subject alternative name, may contain '*' wildcards (can be repeated).").PlaceHolder("DNS").Strings()
+	serverTargetURIs     = serverCommand.Flag("target-verify-uri", "With --target-tls, only allow targets with given URI subject alternative name (can be repeated).").PlaceHolder("URI").Strings()
+	serverProxyProtocol  = serverCommand.Flag("target-proxy-protocol", "Enable PROXY protocol v2 to signal connection info (client address, TLS SNI/ALPN) to backend.").Bool()
+	serverHandshakeTime  = serverCommand.Flag("handshake-timeout", "Timeout for completing the TLS handshake with clients (default: --connect-timeout).").PlaceHolder("DURATION").Duration()
+	serverFirstByteTime  = serverCommand.Flag("first-byte-timeout", "Close connections from clients that don't send anything within the given duration after connecting, e.g. before the handshake starts (default: only --handshake-timeout applies).").PlaceHolder("DURATION").Duration()
+	serverMaxHandshakes  = serverCommand.Flag("max-handshakes", "Maximum number of TLS handshakes in progress at a time, further connections are reset before the handshake (default: no limit).").PlaceHolder("NUM").Int()
+	serverMaxHandshakeIP = serverCommand.Flag("max-handshakes-per-ip", "Maximum number of TLS handshakes in progress at a time from a single source IP (default: no limit).").PlaceHolder("NUM").Int()
+	serverTarpit         = serverCommand.Flag("tarpit-threshold", "Delay new connections from source IPs after the given number of failed handshakes or access denials, before the handshake (default: don't delay).").PlaceHolder("NUM").Int()
+	serverTarpitDelay    = serverCommand.Flag("tarpit-delay", "Delay for connections from source IPs over --tarpit-threshold, doubled with each further failure.").Default("1s").Duration()
+	serverTarpitMaxDelay = serverCommand.Flag("tarpit-max-delay", "Maximum delay for connections with --tarpit-threshold.").Default("30s").Duration()
+	serverTarpitWindow   = serverCommand.Flag("tarpit-window", "Forget failures from source IPs after the given duration without new failures.").Default("10m").Duration()
+	serverListenProxy    = serverCommand.Flag("listen-proxy-protocol", "Parse PROXY protocol (v1/v2) headers on incoming connections to learn original client addresses (only use behind a trusted load balancer). Headers must arrive within --connect-timeout.").Bool()
+	serverRoutes         = serverCommand.Flag("route", "Forward connections matching the given route to a different target, with route given as sni=NAME,target=ADDR or alpn=PROTO,target=ADDR (or both sni and alpn; can be repeated, first match wins).").PlaceHolder("ROUTE").Strings()
+	serverMultiplex      = serverCommand.Flag("multiplex", "Accept multiplexed connections from clients with --multiplex, forwarding each stream to the target as a separate connection (negotiated with ALPN).").Bool()
+	serverTransport      = serverCommand.Flag("transport", "Also accept tunnels from clients with the given --transport, in addition to plain TLS (one of: tls, h2, websocket, quic; h2 accepts HTTP/2 CONNECT streams, websocket accepts WebSocket upgrade requests, both negotiated with ALPN, quic accepts QUIC connections on UDP, on the same ports as the TCP listen addresses).").Default("tls").Enum("tls", "h2", "websocket", "quic")
+	serverHTTP           = serverCommand.Flag("http", "Parse HTTP/1.1 and HTTP/2 requests on connections (negotiated with ALPN), forwarding them to the target with per-request logs and metrics, instead of proxying raw bytes.").Bool()
+	serverHTTPAllow      = serverCommand.Flag("http-allow", "With --http, only allow requests for paths under the given prefix from matching clients, with rule given as path=PREFIX,cn=CN (keys: path, cn, ou, dns, uri; can be repeated, longest matching path prefix wins).").PlaceHolder("RULE").Strings()
+	serverIdentityHeader = serverCommand.Flag("identity-headers", "Add headers with the client identity (X-Client-CN, X-Client-URI-SAN, X-Client-DNS-SAN, X-Forwarded-Client-Cert) to requests forwarded to the target, replacing any sent by clients (implies --http).").Bool()
+	serverChannelBinding = serverCommand.Flag("channel-binding", "Pass the tls-exporter channel binding (RFC 9266) of client connections to the target, for backends that bind their own authentication to the TLS session: in the X-TLS-Channel-Binding header with --http, or in GHOSTUNNEL_TLS_CHANNEL_BINDING with --target exec:.").Bool()
+	serverWebSocketPath  = serverCommand.Flag("websocket-path", "With --transport websocket, request path to accept WebSocket tunnels on.").Default("/").String()
 	serverUnsafeTarget   = serverCommand.Flag("unsafe-target", "If set, does not limit target to localhost, 127.0.0.1, [::1], or UNIX sockets.").Bool()
 	serverAllowAll       = serverCommand.Flag("allow-all", "Allow all clients, do not check client cert subject.").Bool()
-	serverAllowedCNs     = serverCommand.Flag("allow-cn", "Allow clients with given common name (can be repeated).").PlaceHolder("CN").Strings()
+	serverAllowedCNs     = serverCommand.Flag("allow-cn", "Allow clients with given common name, may contain '*' wildcards (can be repeated).").PlaceHolder("CN").Strings()
 	serverAllowedOUs     = serverCommand.Flag("allow-ou", "Allow clients with given organizational unit name (can be repeated).").PlaceHolder("OU").Strings()
-	serverAllowedDNSs    = serverCommand.Flag("allow-dns", "Allow clients with given DNS subject alternative name (can be repeated).").PlaceHolder("DNS").Strings()
+	serverAllowedDNSs    = serverCommand.Flag("allow-dns", "Allow clients with given DNS subject alternative name, may contain '*' wildcards (can be repeated).").PlaceHolder("DNS").Strings()
 	serverAllowedIPs     = serverCommand.Flag("allow-ip", "").Hidden().PlaceHolder("SAN").IPList()
-	serverAllowedURIs    = serverCommand.Flag("allow-uri", "Allow clients with given URI subject alternative name (can be repeated).").PlaceHolder("URI").Strings()
+	serverAllowedURIs    = serverCommand.Flag("allow-uri", "Allow clients with given URI subject alternative name, may contain '*' wildcards (can be repeated).").PlaceHolder("URI").Strings()
+	serverDeniedCNs      = serverCommand.Flag("deny-cn", "Deny clients with given common name, may contain '*' wildcards, takes precedence over allow flags (can be repeated).").PlaceHolder("CN").Strings()
+	serverDeniedOUs      = serverCommand.Flag("deny-ou", "Deny clients with given organizational unit name, takes precedence over allow flags (can be repeated).").PlaceHolder("OU").Strings()
+	serverDeniedDNSs     = serverCommand.Flag("deny-dns", "Deny clients with given DNS subject alternative name, may contain '*' wildcards, takes precedence over allow flags (can be repeated).").PlaceHolder("DNS").Strings()
+	serverDeniedURIs     = serverCommand.Flag("deny-uri", "Deny clients with given URI subject alternative name, may contain '*' wildcards, takes precedence over allow flags (can be repeated).").PlaceHolder("URI").Strings()
+	serverAllowedPSKs    = serverCommand.Flag("allow-psk-identity", "Allow clients of UDP listeners authenticated with the pre-shared key for the given identity from --psk-file, DTLS only (can be repeated).").PlaceHolder("ID").Strings()
+	serverAllowedCIDRs   = serverCommand.Flag("allow-cidr", "Only accept connections from source addresses in the given network, checked before the handshake (can be repeated).").PlaceHolder("CIDR").Strings()
+	serverDeniedCIDRs    = serverCommand.Flag("deny-cidr", "Reject connections from source addresses in the given network, checked before the handshake and before --allow-cidr (can be repeated).").PlaceHolder("CIDR").Strings()
+	serverPolicyFile     = serverCommand.Flag("access-policy-file", "Allow clients matching rules in the given YAML/JSON policy file, reloaded on SIGHUP/SIGUSR1 or when the file changes (see docs/ACCESS-FLAGS.md).").PlaceHolder("PATH").String()
 	serverDisableAuth    = serverCommand.Flag("disable-authentication", "Disable client authentication, no client certificate will be required.").Default("false").Bool()
+	serverEnforceExpiry  = serverCommand.Flag("enforce-cert-expiry", "Close connections once the client certificate they were authorized with expires, instead of only checking it during the handshake.").Bool()
+	serverReenforce      = serverCommand.Flag("reenforce-on-reload", "After each reload, check open connections against the new CA bundle, CRLs and access control settings, and close the ones that are no longer allowed.").Bool()
+	serverACMEDomains    = serverCommand.Flag("acme-domain", "Obtain server certificate for given domain via ACME, answering TLS-ALPN-01 challenges on the listening port (can be repeated).").PlaceHolder("DOMAIN").Strings()
+	serverACMEDirectory  = serverCommand.Flag("acme-directory-url", "Directory URL of the ACME server to obtain certificates from.").PlaceHolder("URL").Default(acme.LetsEncryptURL).String()
+	serverACMEEmail      = serverCommand.Flag("acme-email", "Contact email address for the ACME account (optional).").PlaceHolder("EMAIL").String()
+	serverACMECacheDir   = serverCommand.Flag("acme-cache-dir", "Directory for caching ACME account keys and certificates across restarts (recommended).").PlaceHolder("PATH").String()
+	serverACMEAcceptTOS  = serverCommand.Flag("acme-accept-tos", "Accept the terms of service of the ACME server (required for --acme-domain).").Bool()
+	serverRevocation     = serverCommand.Flag("revocation-check", "Check client certificates for revocation via OCSP or CRL distribution points: off, soft-fail (accept if status can't be determined) or hard-fail.").Default("off").Enum("off", "soft-fail", "hard-fail")
+	serverOPAServer      = serverCommand.Flag("policy", "Check connections against an Open Policy Agent server at the given URL (e.g. http://localhost:8181), in addition to access control flags (see docs/ACCESS-FLAGS.md).").PlaceHolder("URL").String()
+	serverOPAQuery       = serverCommand.Flag("policy-query", "Rule to query on the Open Policy Agent server, must evaluate to true to allow a connection.").Default("data.ghostunnel.allow").String()
+	serverAuthURL        = serverCommand.Flag("auth-url", "Check connections against an external authorization webhook, by POSTing connection details to the given URL, in addition to access control flags (see docs/ACCESS-FLAGS.md).").PlaceHolder("URL").String()
+	serverAuthTimeout    = serverCommand.Flag("auth-timeout", "Timeout for requests to the authorization webhook.").Default("5s").Duration()
+	serverAuthCacheTTL   = serverCommand.Flag("auth-cache-ttl", "How long to cache decisions from the authorization webhook (zero disables caching).").Default("1m").Duration()
+	serverAuditLog       = serverCommand.Flag("audit-log", "Write an entry for each authentication decision (peer identity, certificate chain fingerprints, matched access rule and result) to the given file, as hash-chained JSON lines so tampering is evident.").PlaceHolder("PATH").String()
+	serverCRLs           = serverCommand.Flag("crl", "Path to CRL file (PEM or DER) for checking client certificates, reloaded with the keystore (can be repeated).").PlaceHolder("PATH").Strings()
+	serverSNIKeystores   = serverCommand.Flag("keystore-for-sni", "Serve certificate from the given keystore to clients requesting a matching server name (SNI), given as name=NAME,keystore=PATH (can be repeated, first match wins).").PlaceHolder("NAME=KEYSTORE").Strings()
+	serverClientCA       = serverCommand.Flag("cacert-client", "Path to CA bundle file (PEM/X509) for verifying client certificates, instead of --cacert.").PlaceHolder("PATH").String()
+	serverTargetCA       = serverCommand.Flag("cacert-target", "Path to CA bundle file (PEM/X509) for verifying the certificate of targets with --target-tls or in tls health checks, instead of --cacert.").PlaceHolder("PATH").String()
+	serverOCSPStapling   = serverCommand.Flag("ocsp-stapling", "Fetch OCSP responses for the server certificate and staple them during handshakes (certificate chain must include the issuer).").Bool()
+	serverChildArgs      = serverCommand.Arg("command", "Command to run as a child process once listening (given after --), ghostunnel exits when it exits.").Strings()
 
 	clientCommand       = app.Command("client", "Client mode (plain TCP/UNIX listener -> TLS target).")
-	clientListenAddress = clientCommand.Flag("listen", "Address and port to listen on (can be HOST:PORT, unix:PATH, systemd:NAME or launchd:NAME).").PlaceHolder("ADDR").Required().String()
+	clientListenAddress = clientCommand.Flag("listen", "Address and port to listen on (can be HOST:PORT, udp:HOST:PORT, unix:PATH, unix:@NAME for abstract sockets, npipe:\\\\.\\pipe\\NAME, systemd:NAME or launchd:NAME).").PlaceHolder("ADDR").Required().String()
 	// Note: can't use .TCP() for clientForwardAddress because we need to set the original string in tls.Config.ServerName.
-	clientForwardAddress = clientCommand.Flag("target", "Address to forward connections to (must be HOST:PORT).").PlaceHolder("ADDR").Required().String()
+	clientForwardAddress = clientCommand.Flag("target", "Address to forward connections to (must be HOST:PORT, udp:HOST:PORT, or original-dst to forward redirected connections to their original destination on linux).").PlaceHolder("ADDR").Required().String()
+	clientListenKeystore = clientCommand.Flag("listen-keystore", "Accept TLS from local callers on the listening socket, with certificate from the given keystore (combined PEM with cert/key, or PKCS12 keystore, using --storepass).").PlaceHolder("PATH").String()
+	clientListenCA       = clientCommand.Flag("listen-cacert", "Require local callers to present a client certificate signed by a CA from the given bundle (PEM/X509), with --listen-keystore.").PlaceHolder("PATH").String()
+	clientAllowedUIDs    = clientCommand.Flag("allow-uid", "Only accept connections on a UNIX socket from processes running as the given user (name or numeric ID, checked via SO_PEERCRED; can be repeated).").PlaceHolder("USER").Strings()
+	clientAllowedGIDs    = clientCommand.Flag("allow-gid", "Only accept connections on a UNIX socket from processes running with the given primary group (name or numeric ID, checked via SO_PEERCRED; can be repeated).").PlaceHolder("GROUP").Strings()
 	clientUnsafeListen   = clientCommand.Flag("unsafe-listen", "If set, does not limit listen to localhost, 127.0.0.1, [::1], or UNIX sockets.").Bool()
+	clientTransparent    = clientCommand.Flag("transparent", "Accept connections redirected with iptables TPROXY, by setting IP_TRANSPARENT on the listening socket (linux only, requires CAP_NET_ADMIN). Use with --target original-dst.").Bool()
+	clientPortMap        = clientCommand.Flag("original-dst-port-map", "With --target original-dst, connect to a different port on the original destination, e.g. 80=8443 to forward connections to port 80 over TLS to port 8443 (can be repeated; other ports are kept as-is).").PlaceHolder("PORT=PORT").Strings()
+	clientMultiplex      = clientCommand.Flag("multiplex", "Multiplex connections to the target over a pool of up to N persistent TLS connections, to save handshakes for short-lived connections (requires --multiplex in server mode).").PlaceHolder("N").Int()
+	clientTransport      = clientCommand.Flag("transport", "Carry connections to the target over the given transport (one of: tls, h2, websocket, quic). With h2, connections are tunneled as HTTP/2 CONNECT streams over a persistent connection, with websocket each connection is wrapped in a WebSocket, to traverse HTTP-aware middleboxes and load balancers. With quic, connections are tunneled as streams of a QUIC connection over UDP, avoiding head-of-line blocking between them (requires the same --transport in server mode).").Default("tls").Enum("tls", "h2", "websocket", "quic")
+	clientWebSocketPath  = clientCommand.Flag("websocket-path", "With --transport websocket, request path for WebSocket tunnels.").Default("/").String()
+	clientWebSocketHost  = clientCommand.Flag("websocket-host", "With --transport websocket, Host header for WebSocket tunnels (defaults to the target address).").PlaceHolder("HOST").String()
 	clientServerName     = clientCommand.Flag("override-server-name", "If set, overrides the server name used for hostname verification.").PlaceHolder("NAME").String()
-	clientConnectProxy   = clientCommand.Flag("connect-proxy", "If set, connect to target over given HTTP CONNECT proxy. Must be HTTP/HTTPS URL.").PlaceHolder("URL").URL()
-	clientAllowedCNs     = clientCommand.Flag("verify-cn", "Allow servers with given common name (can be repeated).").PlaceHolder("CN").Strings()
+	clientConnectProxy   = clientCommand.Flag("connect-proxy", "If set, connect to target over given HTTP CONNECT proxy. Must be HTTP/HTTPS URL, may include credentials (user:pass@) for proxy authentication.").PlaceHolder("URL").URL()
+	clientProxyFromEnv   = clientCommand.Flag("connect-proxy-from-env", "Connect to target over the HTTP CONNECT proxy from the HTTPS_PROXY environment variable, unless the target matches NO_PROXY.").Bool()
+	clientSocks5Proxy    = clientCommand.Flag("socks5-proxy", "If set, connect to target over given SOCKS5 proxy (must be HOST:PORT).").PlaceHolder("ADDR").String()
+	clientSocks5User     = clientCommand.Flag("socks5-proxy-user", "Username for authenticating to the SOCKS5 proxy (optional).").PlaceHolder("USER").Envar("SOCKS5_PROXY_USER").String()
+	clientSocks5Pass     = clientCommand.Flag("socks5-proxy-pass", "Password for authenticating to the SOCKS5 proxy (optional).").PlaceHolder("PASS").Envar("SOCKS5_PROXY_PASS").String()
+	clientAllowedCNs     = clientCommand.Flag("verify-cn", "Allow servers with given common name, may contain '*' wildcards (can be repeated).").PlaceHolder("CN").Strings()
 	clientAllowedOUs     = clientCommand.Flag("verify-ou", "Allow servers with given organizational unit name (can be repeated).").PlaceHolder("OU").Strings()
-	clientAllowedDNSs    = clientCommand.Flag("verify-dns", "Allow servers with given DNS subject alternative name (can be repeated).").PlaceHolder("DNS").Strings()
+	clientAllowedDNSs    = clientCommand.Flag("verify-dns", "Allow servers with given DNS subject alternative name, may contain '*' wildcards (can be repeated).").PlaceHolder("DNS").Strings()
 	clientAllowedIPs     = clientCommand.Flag("verify-ip", "").Hidden().PlaceHolder("SAN").IPList()
 	clientAllowedURIs    = clientCommand.Flag("verify-uri", "Allow servers with given URI subject alternative name (can be repeated).").PlaceHolder("URI").Strings()
+	clientSPKIPins       = clientCommand.Flag("verify-spki-pin", "Require the public key of the server certificate (or one of its CAs) to match the given pin, a base64 encoded SHA-256 hash of the subject public key info, as sha256//BASE64 (can be repeated).").PlaceHolder("PIN").Strings()
+	clientSPKIPinOnly    = clientCommand.Flag("verify-spki-pin-only", "Verify the server certificate against --verify-spki-pin only, instead of against CAs and the server name (the public key of the server certificate itself must be pinned).").Bool()
+	clientCTLogList      = clientCommand.Flag("verify-sct", "Require the server certificate to have valid signed certificate timestamps (SCTs, embedded or sent in the handshake) from Certificate Transparency logs in the given log list (JSON, v3 format), reloaded with the keystore.").PlaceHolder("PATH").String()
+	clientCTMinSCTs      = clientCommand.Flag("verify-sct-min", "Minimum number of CT logs with valid SCTs for --verify-sct (at least two log operators if two or more).").Default("2").PlaceHolder("NUM").Int()
+	clientPSKIdentity    = clientCommand.Flag("psk-identity", "Authenticate DTLS sessions to UDP targets with the pre-shared key for the given identity from --psk-file, instead of with certificates (DTLS only).").PlaceHolder("ID").String()
 	clientDisableAuth    = clientCommand.Flag("disable-authentication", "Disable client authentication, no certificate will be provided to the server.").Default("false").Bool()
+	clientKeystores      = clientCommand.Flag("keystore-fallback", "Additional keystore to present a client certificate from if the server doesn't accept the one from --keystore, selected by the CAs the server accepts (can be repeated, tried in order).").PlaceHolder("PATH").Strings()
+	clientChildArgs      = clientCommand.Arg("command", "Command to run as a child process once listening (given after --), ghostunnel exits when it exits.").Strings()
+
+	// Config file
+	configPath = app.Flag("config", "Read flags from the given YAML (or JSON) file, or TOML file with a .toml extension, mapping flag names (without dashes) to values. Flags given on the command line take precedence. On reload, only access control settings (allow-*, deny-*) are applied, in server mode.").PlaceHolder("PATH").String()
 
 	// TLS options
 	keystorePath            = app.Flag("keystore", "Path to keystore (combined PEM with cert/key, or PKCS12 keystore).").PlaceHolder("PATH").Envar("KEYSTORE_PATH").String()
 	certPath                = app.Flag("cert", "Path to certificate (PEM with certificate chain).").PlaceHolder("PATH").Envar("CERT_PATH").String()
 	keyPath                 = app.Flag("key", "Path to certificate private key (PEM with private key).").PlaceHolder("PATH").Envar("KEY_PATH").String()
-	keystorePass            = app.Flag("storepass", "Password for keystore (if using PKCS keystore, optional).").PlaceHolder("PASS").Envar("KEYSTORE_PASS").String()
+	keystorePass            = app.Flag("storepass", "Password for keystore or encrypted private key (if using PKCS12 keystore or encrypted PEM key, optional).").PlaceHolder("PASS").Envar("KEYSTORE_PASS").String()
+	keystorePassFile        = app.Flag("storepass-file", "Read password for keystore or encrypted private key from file (instead of --storepass).").PlaceHolder("PATH").String()
+	keystorePassPrompt      = app.Flag("storepass-prompt", "Prompt for password for keystore or encrypted private key on the terminal at startup, unless given with --storepass.").Bool()
+	keystoreTPM             = app.Flag("keystore-tpm", "Use private key from TPM 2.0 device, stored under the given persistent handle (e.g. 0x81000001), with the certificate chain from --cert.").PlaceHolder("HANDLE").String()
+	tpmDevice               = app.Flag("tpm-device", "Path to TPM 2.0 device for --keystore-tpm.").Default(certloader.DefaultTPMDevice).PlaceHolder("PATH").String()
+	tpmKeyPassword          = app.Flag("tpm-key-password", "Password authorizing use of the key in the TPM (optional).").PlaceHolder("PASS").Envar("TPM_KEY_PASSWORD").String()
+	keystoreKMS             = app.Flag("keystore-kms", "Use private key from AWS KMS (awskms:///KEY-ID-OR-ARN) or Google Cloud KMS (gcpkms://projects/.../cryptoKeyVersions/N), with the certificate chain from --cert.").PlaceHolder("KEY").String()
 	caBundlePath            = app.Flag("cacert", "Path to CA bundle file (PEM/X509). Uses system trust store by default.").Envar("CACERT_PATH").String()
-	enabledCipherSuites     = app.Flag("cipher-suites", "Set of cipher suites to enable, comma-separated, in order of preference (AES, CHACHA).").Default("AES,CHACHA").String()
+	systemTrust             = app.Flag("system-trust", "Whether to trust the system trust store for verifying peers: auto (only if no --cacert is given), include (in addition to --cacert and --cacert-client), or exclude (never, requires --cacert).").Default("auto").Enum("auto", "include", "exclude")
+	caBundleExtra           = app.Flag("cacert-extra", "Path to an additional CA bundle file (PEM/X509) for verifying peers, trusted together with --cacert (or --cacert-client), e.g. the old and new root during CA rotation (can be repeated).").PlaceHolder("PATH").Strings()
+	requireEKUs             = app.Flag("require-eku", "Require peer certificates to explicitly include the given extended key usage, e.g. clientAuth in server mode (can be repeated).").PlaceHolder("EKU").Enums(extKeyUsageNames()...)
+	maxChainDepth           = app.Flag("max-chain-depth", "Maximum number of intermediate CA certificates in verified peer certificate chains (default: no limit).").Default("-1").PlaceHolder("NUM").Int()
+	enforceNameConst        = app.Flag("enforce-name-constraints", "Also check DNS name constraints of CA certificates against the common name of peer certificates, not only against their subject alternative names.").Bool()
+	peerKeyPaths            = app.Flag("peer-key", "Authenticate peers by their public key instead of their certificate chain: peers must present a certificate (may be self-signed) with a public key from the given PEM file, with PUBLIC KEY or CERTIFICATE blocks, reloaded with the keystore (can be repeated).").PlaceHolder("PATH").Strings()
+	pskFile                 = app.Flag("psk-file", "Pre-shared keys for DTLS sessions (UDP only, not supported for TLS over TCP), one IDENTITY:KEY per line with hex encoded keys, reloaded with the keystore. In server mode, UDP listeners then only accept clients with pre-shared keys (see --allow-psk-identity).").PlaceHolder("PATH").String()
+	enabledCipherSuites     = app.Flag("cipher-suites", "Set of cipher suites to enable, comma-separated, in order of preference (AES, CHACHA, or individual TLS 1.2 cipher suite names, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256).").Default("AES,CHACHA").String()
+	enabledCurves           = app.Flag("curves", "Set of curves to enable for key exchange, comma-separated, in order of preference (X25519, P256, P384, P521; default: X25519,P256 in server mode).").PlaceHolder("CURVES").String()
+	keyLogPath              = app.Flag("keylog-file", "Write TLS session secrets to the given file (NSS key log format), for decrypting captured traffic with e.g. Wireshark. Anyone with the file can decrypt sessions, only use for debugging in test environments (requires --unsafe-keylog).").PlaceHolder("PATH").String()
+	unsafeKeyLog            = app.Flag("unsafe-keylog", "Allow writing TLS session secrets with --keylog-file.").Bool()
+	fipsMode                = app.Flag("fips", "Only allow FIPS 140-approved cipher suites and curves, and refuse to start unless a FIPS 140 crypto module is in use (built with GOEXPERIMENT=boringcrypto, or running with GODEBUG=fips140=on).").Bool()
+	postQuantum             = app.Flag("post-quantum", "Enable hybrid post-quantum key exchange (X25519MLKEM768) for TLS 1.3, preferred over the curves from --curves (requires Go 1.24+).").Bool()
 	useWorkloadAPI          = app.Flag("use-workload-api", "If true, certificate and root CAs are retrieved via the SPIFFE Workload API").Bool()
 	useWorkloadAPIAddr      = app.Flag("use-workload-api-addr", "If set, certificates and root CAs are retrieved via the SPIFFE Workload API at the specified address (implies --use-workload-api)").PlaceHolder("ADDR").String()
+	vaultPath               = app.Flag("cert-vault-path", "If set, certificates are issued by the Vault PKI secrets engine at the given path (e.g. pki/issue/ROLE).").PlaceHolder("PATH").String()
+	vaultAddr               = app.Flag("vault-addr", "Address of the Vault server to request certificates from.").PlaceHolder("URL").Envar("VAULT_ADDR").String()
+	vaultToken              = app.Flag("vault-token", "Token for authenticating to Vault.").PlaceHolder("TOKEN").Envar("VAULT_TOKEN").String()
+	vaultRoleID             = app.Flag("vault-role-id", "AppRole role ID for authenticating to Vault (if no token is given).").PlaceHolder("ID").Envar("VAULT_ROLE_ID").String()
+	vaultSecretID           = app.Flag("vault-secret-id", "AppRole secret ID for authenticating to Vault (if no token is given).").PlaceHolder("ID").Envar("VAULT_SECRET_ID").String()
+	vaultCommonName         = app.Flag("vault-common-name", "Common name to request in certificates issued by Vault.").PlaceHolder("CN").String()
+	vaultAltNames           = app.Flag("vault-alt-name", "Subject alternative name (DNS name or IP) to request in certificates issued by Vault (can be repeated).").PlaceHolder("SAN").Strings()
+	vaultTTL                = app.Flag("vault-ttl", "TTL to request for certificates issued by Vault (uses role default if unset).").PlaceHolder("DURATION").Duration()
+	vaultCACert             = app.Flag("vault-cacert", "Path to CA bundle for verifying the Vault server. Uses system trust store by default.").PlaceHolder("PATH").Envar("VAULT_CACERT").String()
 	allowUnsafeCipherSuites = app.Flag("allow-unsafe-cipher-suites", "Allow cipher suites deemed to be unsafe to be enabled via the cipher-suites flag.").Hidden().Default("false").Bool()
+	sessionTickets          = app.Flag("session-tickets", "Enable TLS session resumption via session tickets (use --no-session-tickets to disable).").Default("true").Bool()
+	sessionTicketKeyCount   = app.Flag("session-ticket-keys", "Number of session ticket keys to keep (server mode). The newest key encrypts new tickets, older keys can still be used to resume sessions.").Default("3").Int()
+	sessionTicketRotation   = app.Flag("session-ticket-rotation", "Rotate session ticket keys, or re-read the key file, every given interval (server mode, zero disables rotation).").Default("1h").Duration()
+	sessionTicketKeyFile    = app.Flag("session-ticket-key-file", "Read session ticket keys from the given file to share them across instances, with one 32-byte key per line in hex or base64 (server mode, first key encrypts new tickets).").PlaceHolder("PATH").String()
 
 	// Reloading and timeouts
 	timedReload     = app.Flag("timed-reload", "Reload keystores every given interval (e.g. 300s), refresh listener/client on changes.").PlaceHolder("DURATION").Duration()
-	shutdownTimeout = app.Flag("shutdown-timeout", "Graceful shutdown timeout. Terminates after timeout even if connections still open.").Default("5m").Duration()
+	autoReload      = app.Flag("auto-reload-on-change", "Watch keystore, certificate and CA bundle files, reload automatically when they change on disk.").Bool()
+	shutdownTimeout = app.Flag("shutdown-timeout", "Graceful shutdown timeout. On shutdown, stops accepting new connections and waits for open connections to finish, terminating after timeout even if connections are still open.").Default("5m").Duration()
 	timeoutDuration = app.Flag("connect-timeout", "Timeout for establishing connections, handshakes.").Default("10s").Duration()
+	dialRetries     = app.Flag("target-dial-retries", "Retry failed dials to the target the given number of times before dropping the connection (e.g. while the target restarts).").PlaceHolder("N").Int()
+	dialBackoff     = app.Flag("target-dial-backoff", "Wait before the first retry with --target-dial-retries, doubled for each further retry.").Default("100ms").Duration()
+	dialMaxBackoff  = app.Flag("target-dial-max-backoff", "Maximum wait between retries with --target-dial-retries.").Default("1s").Duration()
+	holdTimeout     = app.Flag("target-hold-timeout", "If the target is unavailable, hold new connections for up to the given duration (e.g. 5s) until it's back, instead of dropping them (default: don't hold).").PlaceHolder("DURATION").Duration()
+	holdMaxConns    = app.Flag("target-hold-max-conns", "Maximum number of connections to hold at a time with --target-hold-timeout (0 for no limit).").Default("100").Int()
+	idleTimeout     = app.Flag("idle-timeout", "Close connections without data in either direction for the given duration (default: no timeout).").PlaceHolder("DURATION").Duration()
+	maxLifetime     = app.Flag("max-conn-lifetime", "Close connections after the given duration, regardless of activity (default: no limit).").PlaceHolder("DURATION").Duration()
+	maxLifetimeJit  = app.Flag("max-conn-lifetime-jitter", "Close connections up to the given duration earlier than --max-conn-lifetime (chosen at random for each connection), to spread out reconnects.").PlaceHolder("DURATION").Duration()
+	childRestart    = app.Flag("child-restart", "Restart the child command when it exits (one of: never, on-failure, always). Shutdown signals are forwarded to the child, and it's not restarted after shutdown.").Default("never").Enum("never", "on-failure", "always")
+
+	// UNIX sockets
+	unixSocketMode  = app.Flag("unix-socket-mode", "File mode for UNIX socket files we listen on (octal, e.g. 0660; default: from umask).").PlaceHolder("MODE").String()
+	unixSocketOwner = app.Flag("unix-socket-owner", "Owner (user name or numeric ID) for UNIX socket files we listen on.").PlaceHolder("USER").String()
+	unixSocketGroup = app.Flag("unix-socket-group", "Group (name or numeric ID) for UNIX socket files we listen on.").PlaceHolder("GROUP").String()
+	pipeSecurity    = app.Flag("pipe-security-descriptor", "Security descriptor (SDDL) for named pipes we listen on (windows only; default: security descriptor of the process).").PlaceHolder("SDDL").String()
+
+	// Socket options
+	reusePort         = app.Flag("reuseport", "Set SO_REUSEPORT on TCP sockets we listen on (use --no-reuseport to disable).").Default("true").Bool()
+	tcpKeepAlive      = app.Flag("tcp-keepalive", "Enable TCP keepalives (SO_KEEPALIVE) on connections (use --no-tcp-keepalive to disable).").Default("true").Bool()
+	tcpNoDelay        = app.Flag("tcp-nodelay", "Disable Nagle's algorithm (TCP_NODELAY) on connections (use --no-tcp-nodelay to enable Nagle's algorithm).").Default("true").Bool()
+	socketRcvBuf      = app.Flag("socket-rcvbuf", "Receive buffer size (SO_RCVBUF) for TCP sockets, e.g. 4MB (default: chosen by the kernel).").PlaceHolder("BYTES").Bytes()
+	socketSndBuf      = app.Flag("socket-sndbuf", "Send buffer size (SO_SNDBUF) for TCP sockets, e.g. 4MB (default: chosen by the kernel).").PlaceHolder("BYTES").Bytes()
+	ipFreeBind        = app.Flag("ip-freebind", "Set IP_FREEBIND on TCP sockets, to allow listening on addresses not (yet) assigned to this host (linux only).").Bool()
+	keepAliveIdle     = app.Flag("keepalive-idle", "Idle time before sending TCP keepalive probes on connections (default: 15s).").PlaceHolder("DURATION").Duration()
+	keepAliveInterval = app.Flag("keepalive-interval", "Interval between TCP keepalive probes on connections (default: 15s).").PlaceHolder("DURATION").Duration()
+	keepAliveCount    = app.Flag("keepalive-count", "Number of unanswered TCP keepalive probes before dropping a connection (default: from kernel; not supported on windows).").PlaceHolder("COUNT").Int()
+	listenFamily      = app.Flag("listen-family", "Address family for TCP/UDP sockets we listen on: any (IPv4 and IPv6 on wildcard addresses), ipv4 or ipv6.").Default("any").Enum("any", "ipv4", "ipv6")
+	dialFallbackDelay = app.Flag("dial-fallback-delay", "When connecting to targets with both IPv6 and IPv4 addresses, delay before also trying the other address family in parallel (Happy Eyeballs; negative to disable).").Default("300ms").Duration()
+
+	// Connection limits
+	maxConnRate          = app.Flag("max-conn-rate", "Maximum number of new connections to accept per second (default: no limit).").PlaceHolder("RATE").Float64()
+	maxConnRatePerClient = app.Flag("max-conn-rate-per-client", "Maximum number of new connections to accept per second from a single client, identified by certificate URI SAN/CN or IP address (default: no limit).").PlaceHolder("RATE").Float64()
+	maxConcurrentConns   = app.Flag("max-concurrent-conns", "Maximum number of open connections (default: no limit).").PlaceHolder("NUM").Int()
+	maxConnsPerClient    = app.Flag("max-conns-per-client", "Maximum number of open connections from a single client, identified by certificate URI SAN/CN or IP address (default: no limit).").PlaceHolder("NUM").Int()
+	rateLimitRead        = app.Flag("rate-limit-read", "Limit bandwidth for data read from the client on each connection, in bytes per second (e.g. 512KB, default: no limit).").PlaceHolder("BYTES").Bytes()
+	rateLimitWrite       = app.Flag("rate-limit-write", "Limit bandwidth for data written to the client on each connection, in bytes per second (e.g. 512KB, default: no limit).").PlaceHolder("BYTES").Bytes()
+	rateLimitBurst       = app.Flag("rate-limit-burst", "Maximum burst size for --rate-limit-read/--rate-limit-write, in bytes (default: one second worth of data).").PlaceHolder("BYTES").Bytes()
 
 	// Metrics options
-	metricsGraphite = app.Flag("metrics-graphite", "Collect metrics and report them to the given graphite instance (raw TCP).").PlaceHolder("ADDR").TCP()
-	metricsURL      = app.Flag("metrics-url", "Collect metrics and POST them periodically to the given URL (via HTTP/JSON).").PlaceHolder("URL").String()
-	metricsPrefix   = app.Flag("metrics-prefix", fmt.Sprintf("Set prefix string for all reported metrics (default: %s).", defaultMetricsPrefix)).PlaceHolder("PREFIX").Default(defaultMetricsPrefix).String()
-	metricsInterval = app.Flag("metrics-interval", "Collect (and post/send) metrics every specified interval.").Default("30s").Duration()
+	metricsGraphite    = app.Flag("metrics-graphite", "Collect metrics and report them to the given graphite instance (raw TCP).").PlaceHolder("ADDR").TCP()
+	metricsURL         = app.Flag("metrics-url", "Collect metrics and POST them periodically to the given URL (via HTTP/JSON).").PlaceHolder("URL").String()
+	metricsPerIdentity = app.Flag("metrics-per-identity", "Label connection and byte counters (Prometheus only) by client identity (SPIFFE ID/URI SAN or CN), for up to the given number of distinct identities. Additional identities are counted as 'other'.").Default("0").PlaceHolder("MAX").Int()
+	statsdAddr         = app.Flag("statsd-addr", "Collect metrics and push them periodically to the given StatsD/DogStatsD instance (via UDP).").PlaceHolder("ADDR").String()
+	statsdTags         = app.Flag("statsd-tag", "Tag to add to metrics sent via --statsd-addr, in KEY:VALUE form (DogStatsD only, can be repeated).").PlaceHolder("TAG").Strings()
+	metricsPrefix      = app.Flag("metrics-prefix", fmt.Sprintf("Set prefix string for all reported metrics (default: %s).", defaultMetricsPrefix)).PlaceHolder("PREFIX").Default(defaultMetricsPrefix).String()
+	metricsInterval    = app.Flag("metrics-interval", "Collect (and post/send) metrics every specified interval.").Default("30s").Duration()
+
+	// Tracing options
+	otelEndpoint    = app.Flag("otel-endpoint", "Record traces for connections and export them to the given OpenTelemetry collector via OTLP/HTTP (e.g. http://localhost:4318).").PlaceHolder("URL").String()
+	otelServiceName = app.Flag("otel-service-name", "Service name to report in exported traces.").Default("ghostunnel").String()
 
 	// Status & logging
 	statusAddress = app.Flag("status", "Enable serving /_status and /_metrics on given HOST:PORT (or unix:SOCKET).").PlaceHolder("ADDR").String()
 	enableProf    = app.Flag("enable-pprof", "Enable serving /debug/pprof endpoints alongside /_status (for profiling).").Bool()
+	probeInterval = app.Flag("target-probe-interval", "Check if the target can be reached in the background at the given interval, independent of client traffic, and report the last result on /_status and in the target.up metric (instead of connecting to the target on each status request).").PlaceHolder("DURATION").Duration()
+	probeTimeout  = app.Flag("target-probe-timeout", "Timeout for connecting to the target in background checks (with --target-probe-interval).").Default("5s").Duration()
+	expiryWarning = app.Flag("cert-expiry-warning", "Log a warning and report certificate_expiring on /_status once the certificate or a CA certificate expires within the given duration (e.g. 720h for 30 days).").PlaceHolder("DURATION").Duration()
+	statusReady   = app.Flag("status-ready-check", "Checks for /readyz on the status port, one of: listening, certificate (loaded and not expired), backend (target can be dialed). Can be repeated, replaces the default checks.").Default(probeListening, probeCertificate).Enums(probeChecks...)
+	enableAdmin   = app.Flag("enable-admin", "Enable serving admin API alongside /_status, to list (/_connections) and close open connections, show the current certificate (/_certificate), reload (/_reload) and reopen log files (/_reopen-logs). Requires --admin-token-file.").Bool()
+	adminToken    = app.Flag("admin-token-file", "Require admin API requests to send the bearer token from the given file.").PlaceHolder("PATH").String()
 	quiet         = app.Flag("quiet", "Silence log messages (can be all, conns, conn-errs, handshake-errs; repeat flag for more than one)").Default("").Enums("", "all", "conns", "handshake-errs", "conn-errs")
+	logFormat     = app.Flag("log-format", "Format of log messages (can be text or json).").Default("text").Enum("text", "json")
+	syslogAddr    = app.Flag("syslog-addr", "Send log messages to the syslog server at the given address (HOST:PORT for TCP, udp:HOST:PORT or unix:PATH) instead of stderr, with connection fields as structured data.").PlaceHolder("ADDR").String()
+	syslogFormat  = app.Flag("syslog-format", "Format of messages sent with --syslog-addr (can be rfc5424 or rfc3164).").Default("rfc5424").Enum("rfc5424", "rfc3164")
+	logRateLimit  = app.Flag("log-rate-limit", "Maximum number of log messages per second about connections, connection errors and handshake errors each, further messages are dropped and summarized periodically (default: no limit).").PlaceHolder("RATE").Float64()
+	accessLogPath = app.Flag("access-log", "Write an access log entry for each closed connection (with transfer statistics) to the given file.").PlaceHolder("PATH").String()
+
+	// Traffic mirroring
+	mirrorTarget    = app.Flag("mirror-target", "Mirror decrypted data of proxied connections to the given address (HOST:PORT or unix:PATH, one connection for each direction of each proxied connection), or to a pcap file (pcap:PATH). Mirroring is asynchronous, data is dropped if the mirror can't keep up.").PlaceHolder("ADDR").String()
+	mirrorDirection = app.Flag("mirror-direction", "Direction of data to mirror with --mirror-target (one of: both, client, target).").Default("both").Enum("both", "client", "target")
+
+	// Client certificate requirements for the status port
+	statusAllowedCNs  = app.Flag("status-allow-cn", "Require clients of the status port to present a certificate with the given common name, may contain '*' wildcards (can be repeated).").PlaceHolder("CN").Strings()
+	statusAllowedOUs  = app.Flag("status-allow-ou", "Require clients of the status port to present a certificate with the given organizational unit name (can be repeated).").PlaceHolder("OU").Strings()
+	statusAllowedDNSs = app.Flag("status-allow-dns", "Require clients of the status port to present a certificate with the given DNS subject alternative name, may contain '*' wildcards (can be repeated).").PlaceHolder("DNS").Strings()
+	statusAllowedURIs = app.Flag("status-allow-uri", "Require clients of the status port to present a certificate with the given URI subject alternative name, may contain '*' wildcards (can be repeated).").PlaceHolder("URI").Strings()
 
 	// Man page /help
 	helpMan = app.Flag("help-custom-man", "Generate a man page.").Hidden().PreAction(generateManPage).Bool()
@@ -132,10 +320,12 @@ func init() {
 	if certloader.SupportsPKCS11() {
 		pkcs11Module = app.Flag("pkcs11-module", "Path to PKCS11 module (SO) file (optional).").Envar("PKCS11_MODULE").PlaceHolder("PATH").ExistingFile()
 		pkcs11TokenLabel = app.Flag("pkcs11-token-label", "Token label for slot/key in PKCS11 module (optional).").Envar("PKCS11_TOKEN_LABEL").PlaceHolder("LABEL").String()
+		pkcs11KeyLabel = app.Flag("pkcs11-key-label", "Label of certificate in PKCS11 module, to read the certificate from the token instead of --cert (optional).").Envar("PKCS11_KEY_LABEL").PlaceHolder("LABEL").String()
 		pkcs11PIN = app.Flag("pkcs11-pin", "PIN code for slot/key in PKCS11 module (optional).").Envar("PKCS11_PIN").PlaceHolder("PIN").String()
 	}
 
 	// Aliases for flags that were renamed to be backwards-compatible
+	serverCommand.Flag("proxy-protocol", "").Hidden().BoolVar(serverProxyProtocol)
 	serverCommand.Flag("allow-dns-san", "").Hidden().StringsVar(serverAllowedDNSs)
 	serverCommand.Flag("allow-ip-san", "").Hidden().IPListVar(serverAllowedIPs)
 	serverCommand.Flag("allow-uri-san", "").Hidden().StringsVar(serverAllowedURIs)
@@ -154,6 +344,33 @@ type Context struct {
 	dial            func() (net.Conn, error)
 	metrics         *sqmetrics.SquareMetrics
 	tlsConfigSource certloader.TLSConfigSource
+	tracer          *tracing.Tracer
+	histograms      *proxy.Histograms
+	identityMetrics *proxy.IdentityMetrics
+	caMetrics       *caBundleMetrics
+	crls            *certloader.CRLSet
+	peerKeys        *auth.PeerKeys
+	psks            *certloader.PSKFile
+	ctLogs          *certloader.CTLogList
+	policy          *auth.PolicyFile
+	routes          []proxy.Route
+	accessLog       *accessLogWriter
+	auditLog        *auditLog
+	mirror          *proxy.Mirror
+	config          *configFile
+	ticketKeys      *sessionTicketKeys
+	targetTrust     certloader.Certificate
+	listenerCert    certloader.Certificate
+	// TLS dialer for --target original-dst (nil otherwise), and mapping of
+	// original ports to ports to connect to
+	originalDst certloader.Dialer
+	portMap     map[int]int
+	// Command run as a child process once listening (nil if none)
+	child *childProcess
+	// Expiry of certificates, for metrics and warnings
+	expiry *expiryMonitor
+	// Checks open connections again after a reload (nil if disabled)
+	reenforce func()
 }
 
 // Dialer is an interface for dialers (either net.Dialer, or http_dialer.HttpTunnel)
@@ -194,27 +411,230 @@ func panicOnError(err error) {
 
 // Validate flags for both, server and client mode
 func validateFlags(app *kingpin.Application) error {
+	if *keystorePassFile != "" && (*keystorePass != "" || *keystorePassPrompt) {
+		return fmt.Errorf("--storepass-file is mutually exclusive with --storepass and --storepass-prompt")
+	}
 	if *enableProf && *statusAddress == "" {
 		return fmt.Errorf("--enable-pprof requires --status to be set")
 	}
+	if *enableAdmin && *statusAddress == "" {
+		return fmt.Errorf("--enable-admin requires --status to be set")
+	}
+	if *dialRetries < 0 {
+		return fmt.Errorf("--target-dial-retries can't be negative")
+	}
+	if *dialRetries > 0 && (*dialBackoff < 0 || *dialMaxBackoff < *dialBackoff) {
+		return fmt.Errorf("--target-dial-backoff can't be negative, or larger than --target-dial-max-backoff")
+	}
+	if *holdTimeout < 0 || *holdMaxConns < 0 {
+		return fmt.Errorf("--target-hold-timeout and --target-hold-max-conns can't be negative")
+	}
+	if *probeInterval < 0 || (*probeInterval > 0 && *probeTimeout <= 0) {
+		return fmt.Errorf("--target-probe-interval and --target-probe-timeout must be positive")
+	}
+	if *keyLogPath != "" && !*unsafeKeyLog {
+		return fmt.Errorf("--keylog-file writes secrets that allow decrypting traffic, and requires --unsafe-keylog to be set")
+	}
+	if *keyLogPath != "" && *fipsMode {
+		return fmt.Errorf("--keylog-file can't be used with --fips")
+	}
+	if *logRateLimit < 0 {
+		return fmt.Errorf("--log-rate-limit can't be negative")
+	}
+	if *syslogAddr != "" && (useSyslog() || *logFormat == "json") {
+		return fmt.Errorf("--syslog-addr can't be used with --syslog or --log-format=json")
+	}
+	if *adminToken != "" && !*enableAdmin {
+		return fmt.Errorf("--admin-token-file requires --enable-admin to be set")
+	}
+	if *enableAdmin && *adminToken == "" {
+		return fmt.Errorf("--enable-admin requires --admin-token-file to be set")
+	}
+	if hasStatusAccessFlags() {
+		if *statusAddress == "" || strings.HasPrefix(*statusAddress, "unix:") {
+			return fmt.Errorf("--status-allow-* flags require --status to be set to a TCP address")
+		}
+	}
 	if *metricsURL != "" && !strings.HasPrefix(*metricsURL, "http://") && !strings.HasPrefix(*metricsURL, "https://") {
 		return fmt.Errorf("--metrics-url should start with http:// or https://")
 	}
+	if *statsdAddr != "" {
+		if _, _, err := net.SplitHostPort(*statsdAddr); err != nil {
+			return fmt.Errorf("invalid --statsd-addr: %s", err)
+		}
+	}
+	if *metricsPerIdentity < 0 {
+		return fmt.Errorf("--metrics-per-identity must not be negative")
+	}
+	if len(*statsdTags) > 0 && *statsdAddr == "" {
+		return fmt.Errorf("--statsd-tag requires --statsd-addr to be set")
+	}
+	for _, tag := range *statsdTags {
+		if tag == "" || strings.ContainsAny(tag, ",|#\n") {
+			return fmt.Errorf("invalid --statsd-tag '%s'", tag)
+		}
+	}
+	if *otelEndpoint != "" && !strings.HasPrefix(*otelEndpoint, "http://") && !strings.HasPrefix(*otelEndpoint, "https://") {
+		return fmt.Errorf("--otel-endpoint should start with http:// or https://")
+	}
 	if *timeoutDuration == 0 {
 		return fmt.Errorf("--connect-timeout duration must not be zero")
 	}
+	if *idleTimeout < 0 {
+		return fmt.Errorf("--idle-timeout duration must not be negative")
+	}
+	if *maxLifetime < 0 || *maxLifetimeJit < 0 {
+		return fmt.Errorf("--max-conn-lifetime and --max-conn-lifetime-jitter durations must not be negative")
+	}
+	if *maxLifetimeJit > 0 && *maxLifetimeJit >= *maxLifetime {
+		return fmt.Errorf("--max-conn-lifetime-jitter must be shorter than --max-conn-lifetime")
+	}
+	if len(*caBundleExtra) > 0 && *caBundlePath == "" && *serverClientCA == "" {
+		return fmt.Errorf("--cacert-extra requires --cacert or --cacert-client")
+	}
+	if len(*caBundleExtra) > 0 && *useWorkloadAPI {
+		return fmt.Errorf("--cacert-extra can't be used with --use-workload-api")
+	}
+	if *systemTrust == "exclude" && *caBundlePath == "" {
+		return fmt.Errorf("--system-trust=exclude requires --cacert")
+	}
+	if (*systemTrust == "include" || *systemTrust == "exclude") && *useWorkloadAPI {
+		return fmt.Errorf("--system-trust can't be used with --use-workload-api")
+	}
+	if *clientSPKIPinOnly && len(*clientSPKIPins) == 0 {
+		return fmt.Errorf("--verify-spki-pin-only requires --verify-spki-pin")
+	}
+	if *clientSPKIPinOnly && (len(*clientAllowedCNs) > 0 || len(*clientAllowedOUs) > 0 || len(*clientAllowedDNSs) > 0 || len(*clientAllowedIPs) > 0 || len(*clientAllowedURIs) > 0) {
+		return fmt.Errorf("--verify-spki-pin-only can't be used with --verify-cn, --verify-ou, --verify-dns, --verify-ip or --verify-uri")
+	}
+	if *clientSPKIPinOnly && (len(*requireEKUs) > 0 || *maxChainDepth >= 0 || *enforceNameConst) {
+		return fmt.Errorf("--verify-spki-pin-only can't be used with --require-eku, --max-chain-depth or --enforce-name-constraints")
+	}
+	if *clientCTLogList != "" && *clientCTMinSCTs < 1 {
+		return fmt.Errorf("--verify-sct-min must be at least 1")
+	}
+	if *clientCTLogList != "" && (*clientSPKIPinOnly || *useWorkloadAPI) {
+		return fmt.Errorf("--verify-sct can't be used with --verify-spki-pin-only or --use-workload-api")
+	}
+	if len(*peerKeyPaths) > 0 && (len(*requireEKUs) > 0 || *maxChainDepth >= 0 || *enforceNameConst || *useWorkloadAPI) {
+		return fmt.Errorf("--peer-key can't be used with --require-eku, --max-chain-depth, --enforce-name-constraints or --use-workload-api")
+	}
+	if len(*peerKeyPaths) > 0 && (len(*clientAllowedCNs) > 0 || len(*clientAllowedOUs) > 0 || len(*clientAllowedDNSs) > 0 || len(*clientAllowedIPs) > 0 || len(*clientAllowedURIs) > 0 || len(*clientSPKIPins) > 0 || *clientCTLogList != "") {
+		return fmt.Errorf("--peer-key can't be used with --verify-{cn,ou,dns,ip,uri}, --verify-spki-pin or --verify-sct")
+	}
+	if len(*clientSPKIPins) > 0 && *useWorkloadAPI {
+		return fmt.Errorf("--verify-spki-pin can't be used with --use-workload-api")
+	}
+	if (len(*requireEKUs) > 0 || *maxChainDepth >= 0 || *enforceNameConst) && *useWorkloadAPI {
+		return fmt.Errorf("--require-eku, --max-chain-depth and --enforce-name-constraints can't be used with --use-workload-api")
+	}
+	if *vaultPath != "" && (*vaultAddr == "" || *vaultCommonName == "") {
+		return fmt.Errorf("--cert-vault-path requires --vault-addr and --vault-common-name to be set")
+	}
+	if *vaultPath != "" && *vaultToken == "" && *vaultRoleID == "" {
+		return fmt.Errorf("--cert-vault-path requires one of --vault-token or --vault-role-id to be set")
+	}
+	for _, keystore := range append([]string{*keystorePath}, append(sniKeystorePaths(), *clientKeystores...)...) {
+		if !certloader.IsIdentityKeystore(keystore) {
+			continue
+		}
+		if !certloader.SupportsKeychain() {
+			return fmt.Errorf("keystore '%s' requires keychain/certstore support, which isn't available in this build", keystore)
+		}
+		if _, err := certloader.ParseIdentitySelector(keystore); err != nil {
+			return fmt.Errorf("invalid keystore: %s", err)
+		}
+	}
+	if *keystoreKMS != "" && !certloader.IsKMSKey(*keystoreKMS) {
+		return fmt.Errorf("invalid --keystore-kms flag, must start with awskms:// or gcpkms://")
+	}
+	if *keystoreTPM != "" {
+		if _, err := certloader.ParseTPMHandle(*keystoreTPM); err != nil {
+			return fmt.Errorf("invalid --keystore-tpm flag: %s", err)
+		}
+	}
+	if *maxConnRate < 0 || *maxConnRatePerClient < 0 {
+		return fmt.Errorf("--max-conn-rate and --max-conn-rate-per-client must not be negative")
+	}
+	if *maxConcurrentConns < 0 || *maxConnsPerClient < 0 {
+		return fmt.Errorf("--max-concurrent-conns and --max-conns-per-client must not be negative")
+	}
+	if *rateLimitRead < 0 || *rateLimitWrite < 0 || *rateLimitBurst < 0 {
+		return fmt.Errorf("--rate-limit-read, --rate-limit-write and --rate-limit-burst must not be negative")
+	}
+	if *fipsMode && fipsModule() == "" {
+		return fmt.Errorf("--fips requires a FIPS 140 crypto module (build with GOEXPERIMENT=boringcrypto, or run with GODEBUG=fips140=on)")
+	}
+	if *postQuantum && len(postQuantumCurves) == 0 {
+		return fmt.Errorf("--post-quantum requires ghostunnel to be built with Go 1.24 or later")
+	}
+	if *postQuantum && *fipsMode {
+		return fmt.Errorf("--post-quantum can't be used with --fips")
+	}
+	if *sessionTickets && *sessionTicketKeyCount < 1 {
+		return fmt.Errorf("--session-ticket-keys must be at least 1")
+	}
+	if *sessionTicketRotation < 0 {
+		return fmt.Errorf("--session-ticket-rotation must not be negative")
+	}
+	if *sessionTicketKeyFile != "" && !*sessionTickets {
+		return fmt.Errorf("--session-ticket-key-file can't be used with --no-session-tickets")
+	}
+	if *rateLimitBurst != 0 && *rateLimitRead == 0 && *rateLimitWrite == 0 {
+		return fmt.Errorf("--rate-limit-burst requires --rate-limit-read or --rate-limit-write to be set")
+	}
+	if *autoReload && len(watchedFiles()) == 0 {
+		return fmt.Errorf("--auto-reload-on-change requires a keystore, certificate or CA bundle file to watch")
+	}
 	return nil
 }
 
+// watchedFiles returns the list of files that --auto-reload-on-change watches.
+func watchedFiles() []string {
+	files := []string{}
+	for _, path := range append([]string{*keystorePath, *certPath, *keyPath, *caBundlePath, *serverClientCA, *serverTargetCA, *serverTargetKeystore, *clientListenKeystore, *clientListenCA}, *caBundleExtra...) {
+		if path != "" && !certloader.IsIdentityKeystore(path) {
+			files = append(files, path)
+		}
+	}
+	if *serverPolicyFile != "" {
+		files = append(files, *serverPolicyFile)
+	}
+	if *configPath != "" {
+		files = append(files, *configPath)
+	}
+	if *sessionTicketKeyFile != "" {
+		files = append(files, *sessionTicketKeyFile)
+	}
+	for _, path := range append(sniKeystorePaths(), *clientKeystores...) {
+		// Identities in the OS certificate store aren't files
+		if !certloader.IsIdentityKeystore(path) {
+			files = append(files, path)
+		}
+	}
+	if *clientCTLogList != "" {
+		files = append(files, *clientCTLogList)
+	}
+	if *pskFile != "" {
+		files = append(files, *pskFile)
+	}
+	files = append(files, *peerKeyPaths...)
+	return append(files, *serverCRLs...)
+}
+
 // Validates that addr is "safe" and does not need --unsafe-listen (or --unsafe-target).
 func consideredSafe(addr string) bool {
 	safePrefixes := []string{
 		"unix:",
 		"systemd:",
 		"launchd:",
+		`npipe:\\.\pipe\`,
 		"127.0.0.1:",
 		"[::1]:",
 		"localhost:",
+		"udp:127.0.0.1:",
+		"udp:[::1]:",
+		"udp:localhost:",
 	}
 	for _, prefix := range safePrefixes {
 		if strings.HasPrefix(addr, prefix) {
@@ -224,6 +644,37 @@ func consideredSafe(addr string) bool {
 	return false
 }
 
+// parseCIDRs parses a list of networks in CIDR notation. Plain IP addresses
+// are accepted as well, and treated as single-address networks.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isUDPAddress returns true if addr is a udp:HOST:PORT address.
+func isUDPAddress(addr string) bool {
+	return strings.HasPrefix(addr, "udp:")
+}
+
 func validateCredentials(creds []bool) int {
 	count := 0
 	for _, cred := range creds {
@@ -235,27 +686,22 @@ func validateCredentials(creds []bool) int {
 }
 
 func validateCipherSuites() error {
-	for _, suite := range strings.Split(*enabledCipherSuites, ",") {
-		name := strings.TrimSpace(suite)
-		_, ok := cipherSuites[name]
-		if !ok && *allowUnsafeCipherSuites {
-			_, ok = unsafeCipherSuites[name]
-		}
-		if !ok {
-			return fmt.Errorf("invalid cipher suite option: %s", suite)
-		}
+	if _, err := parseCipherSuites(*enabledCipherSuites); err != nil {
+		return fmt.Errorf("invalid --cipher-suites option: %s", err)
+	}
+	if _, err := parseCurves(*enabledCurves); err != nil {
+		return fmt.Errorf("invalid --curves option: %s", err)
 	}
 	return nil
 }
 
 // Validate flags for server mode
 func serverValidateFlags() error {
-	// hasAccessFlags is true if access control flags (besides allow-all) were specified
-	hasAccessFlags := len(*serverAllowedCNs) > 0 ||
-		len(*serverAllowedOUs) > 0 ||
-		len(*serverAllowedDNSs) > 0 ||
-		len(*serverAllowedIPs) > 0 ||
-		len(*serverAllowedURIs) > 0
+	// otherAccess is true if clients can be allowed by options besides
+	// access control flags
+	otherAccess := *serverPolicyFile != "" ||
+		len(*peerKeyPaths) > 0 ||
+		len(*serverAllowedPSKs) > 0
 
 	hasValidCredentials := validateCredentials([]bool{
 		// Standard keystore
@@ -266,30 +712,195 @@ func serverValidateFlags() error {
 		(*certPath != "" && *keyPath != ""),
 		// A certificate, with the key in a PKCS#11 module
 		(*certPath != "" && hasPKCS11()),
+		// A certificate, with the key in a TPM
+		(*certPath != "" && *keystoreTPM != ""),
+		// A certificate, with the key in a cloud KMS
+		(*certPath != "" && *keystoreKMS != ""),
+		// A certificate and key in a PKCS#11 module, selected by label
+		(*certPath == "" && *keystorePath == "" && hasPKCS11KeyLabel()),
 		// SPIFFE Workload API
 		*useWorkloadAPI,
+		// Vault PKI secrets engine
+		*vaultPath != "",
+		// ACME
+		len(*serverACMEDomains) > 0,
 	})
 
 	if hasValidCredentials == 0 {
 		return errors.New("at least one of --keystore, --cert/--key or --keychain-identity (if supported) flags is required")
 	}
+	if len(*serverACMEDomains) > 0 && !*serverACMEAcceptTOS {
+		return errors.New("--acme-domain requires accepting the ACME server's terms of service with --acme-accept-tos")
+	}
 	if hasValidCredentials > 1 {
 		return errors.New("--keystore, --cert/--key and --keychain-identity flags are mutually exclusive")
 	}
-	if (*keyPath != "" && *certPath == "") || (*certPath != "" && *keyPath == "" && !hasPKCS11()) {
-		return errors.New("--cert/--key must be set together, unless using PKCS11 for private key")
+	if (*keyPath != "" && *certPath == "") || (*certPath != "" && *keyPath == "" && !hasPKCS11() && *keystoreTPM == "" && *keystoreKMS == "") {
+		return errors.New("--cert/--key must be set together, unless using PKCS11, a TPM or a KMS for private key")
+	}
+	if *serverDisableAuth && (serverACLFlags().allowsAny() || otherAccess) {
+		return errors.New("--disable-authentication is mutually exclusive with other access control flags")
 	}
-	if !(*serverDisableAuth) && !(*serverAllowAll) && !hasAccessFlags {
-		return errors.New("at least one access control flag (--allow-{all,cn,ou,dns-san,ip-san,uri-san} or --disable-authentication) is required")
+	if !*serverDisableAuth {
+		if err := serverACLFlags().validate(otherAccess); err != nil {
+			return err
+		}
 	}
-	if !(*serverDisableAuth) && *serverAllowAll && hasAccessFlags {
-		return errors.New("--allow-all is mutually exclusive with other access control flags")
+	if len(*serverAllowedPSKs) > 0 && *pskFile == "" {
+		return errors.New("--allow-psk-identity requires --psk-file")
 	}
-	if *serverDisableAuth && (*serverAllowAll || hasAccessFlags) {
-		return errors.New("--disable-authentication is mutually exclusive with other access control flags")
+	if len(*peerKeyPaths) > 0 && (len(*serverAllowedCNs) > 0 || len(*serverAllowedOUs) > 0 || len(*serverAllowedDNSs) > 0 || len(*serverAllowedIPs) > 0 || len(*serverAllowedURIs) > 0 || *serverPolicyFile != "") {
+		return errors.New("--peer-key is mutually exclusive with other access control flags")
+	}
+	if len(*peerKeyPaths) > 0 && (len(*serverDeniedCNs) > 0 || len(*serverDeniedOUs) > 0 || len(*serverDeniedDNSs) > 0 || len(*serverDeniedURIs) > 0 || len(*serverCRLs) > 0 || *serverRevocation != "off") {
+		// Certificates are self-signed and not verified, so names and
+		// revocation status in them can't be trusted
+		return errors.New("--peer-key can't be used with --deny-{cn,ou,dns,uri}, --crl or --revocation-check")
+	}
+	if err := validateExecTarget(); err != nil {
+		return err
+	}
+	for _, target := range append(serverTargets(), splitTargets(*serverTargetBackup)...) {
+		if !*serverUnsafeTarget && !*serverTargetTLS && !consideredSafe(target) && !isExecTarget(target) {
+			return errors.New("--target must be unix:PATH or localhost:PORT (unless --unsafe-target or --target-tls is set)")
+		}
+		if isUDPAddress(target) != isUDPAddress(*serverForwardAddress) {
+			return errors.New("--target addresses must either all be UDP (udp:HOST:PORT) or all be stream sockets")
+		}
+		if isSRVAddress(target) && len(target) == len("srv:") {
+			return errors.New("--target with srv: prefix must include a name (e.g. srv:_service._tcp.example.com)")
+		}
+	}
+	if *serverTargetRefresh < 0 {
+		return errors.New("--target-dns-refresh must not be negative")
+	}
+	if *serverHealthCheck != "" && *serverHealthCheck != "off" {
+		if isUDPAddress(*serverForwardAddress) {
+			return errors.New("--target-health-check is not supported for UDP targets")
+		}
+		if *serverHealthInterval <= 0 {
+			return errors.New("--target-health-check-interval must be positive")
+		}
+		if *serverHealthCheck == "http" && !strings.HasPrefix(*serverHealthPath, "/") {
+			return errors.New("--target-health-check-path must start with '/'")
+		}
+	}
+	for _, address := range *serverListenAddress {
+		if isUDPAddress(address) != isUDPAddress(*serverForwardAddress) {
+			return errors.New("--listen and --target must either both be UDP (udp:HOST:PORT) or both be stream sockets")
+		}
+	}
+	for _, value := range *serverRoutes {
+		route, err := parseRoute(value)
+		if err != nil {
+			return err
+		}
+		if !*serverUnsafeTarget && !*serverTargetTLS && !consideredSafe(route.target) {
+			return errors.New("--route targets must be unix:PATH or localhost:PORT (unless --unsafe-target or --target-tls is set)")
+		}
+		if isUDPAddress(route.target) != isUDPAddress(*serverForwardAddress) {
+			return errors.New("--route targets and --target must either both be UDP (udp:HOST:PORT) or both be stream sockets")
+		}
+		if (*serverTransport == "h2" && route.protocol == transport.HTTP2Protocol) || (*serverTransport == "websocket" && route.protocol == transport.WebSocketProtocol) {
+			return fmt.Errorf("--route with alpn=%s can't be used with --transport %s", route.protocol, *serverTransport)
+		}
+	}
+	if isUDPAddress(*serverForwardAddress) && (*serverProxyProtocol || *serverListenProxy) {
+		return errors.New("PROXY protocol flags can't be used with UDP")
+	}
+	if isUDPAddress(*serverForwardAddress) && *serverMultiplex {
+		return errors.New("--multiplex can't be used with UDP")
+	}
+	if isUDPAddress(*serverForwardAddress) && *serverTransport != "tls" {
+		return fmt.Errorf("--transport %s can't be used with UDP", *serverTransport)
+	}
+	if *serverTransport == "quic" && *serverListenProxy {
+		return errors.New("--transport quic can't be used with --listen-proxy-protocol")
+	}
+	if serverHTTPMode() && (isUDPAddress(*serverForwardAddress) || *serverProxyProtocol) {
+		return errors.New("--http and --identity-headers can't be used with UDP or --target-proxy-protocol")
+	}
+	if serverHTTPMode() && *mirrorTarget != "" {
+		return errors.New("--http and --identity-headers can't be used with --mirror-target")
+	}
+	if serverHTTPMode() && (*serverMultiplex || *serverTransport != "tls") {
+		return errors.New("--http and --identity-headers can't be used with --multiplex or --transport")
+	}
+	if len(*serverHTTPAllow) > 0 && !serverHTTPMode() {
+		return errors.New("--http-allow requires --http")
+	}
+	if *serverChannelBinding && !serverHTTPMode() && !isExecTarget(*serverForwardAddress) {
+		return errors.New("--channel-binding requires --http or --target exec:")
+	}
+	if _, err := serverHTTPRules(); err != nil {
+		return err
+	}
+	if *serverTarpit < 0 {
+		return errors.New("--tarpit-threshold can't be negative")
+	}
+	if *serverTarpit > 0 && (*serverTarpitDelay <= 0 || *serverTarpitMaxDelay < *serverTarpitDelay || *serverTarpitWindow <= 0) {
+		return errors.New("--tarpit-delay and --tarpit-window must be positive, and --tarpit-max-delay at least --tarpit-delay")
+	}
+	if *serverHandshakeTime < 0 || *serverFirstByteTime < 0 {
+		return errors.New("--handshake-timeout and --first-byte-timeout can't be negative")
+	}
+	if *serverTransport == "websocket" && !strings.HasPrefix(*serverWebSocketPath, "/") {
+		return errors.New("--websocket-path must start with '/'")
+	}
+	if *serverDisableAuth && *serverRevocation != "off" {
+		return errors.New("--revocation-check can't be used with --disable-authentication")
+	}
+	if *serverDisableAuth && len(*serverCRLs) > 0 {
+		return errors.New("--crl can't be used with --disable-authentication")
+	}
+	if *serverDisableAuth && (len(*serverDeniedCNs) > 0 || len(*serverDeniedOUs) > 0 || len(*serverDeniedDNSs) > 0 || len(*serverDeniedURIs) > 0) {
+		return errors.New("--deny-{cn,ou,dns,uri} can't be used with --disable-authentication")
+	}
+	if _, err := parseCIDRs(*serverAllowedCIDRs); err != nil {
+		return fmt.Errorf("invalid --allow-cidr flag: %s", err)
 	}
-	if !*serverUnsafeTarget && !consideredSafe(*serverForwardAddress) {
-		return errors.New("--target must be unix:PATH or localhost:PORT (unless --unsafe-target is set)")
+	if _, err := parseCIDRs(*serverDeniedCIDRs); err != nil {
+		return fmt.Errorf("invalid --deny-cidr flag: %s", err)
+	}
+	if *serverOPAServer != "" && !strings.HasPrefix(*serverOPAServer, "http://") && !strings.HasPrefix(*serverOPAServer, "https://") {
+		return errors.New("--policy must be an http:// or https:// URL")
+	}
+	if *serverAuthURL != "" && !strings.HasPrefix(*serverAuthURL, "http://") && !strings.HasPrefix(*serverAuthURL, "https://") {
+		return errors.New("--auth-url must be an http:// or https:// URL")
+	}
+	if *serverAuthURL != "" && *serverOPAServer != "" {
+		return errors.New("--auth-url and --policy are mutually exclusive")
+	}
+	if *serverAuthURL != "" && (*serverAuthTimeout <= 0 || *serverAuthCacheTTL < 0) {
+		return errors.New("--auth-timeout must be positive, --auth-cache-ttl must not be negative")
+	}
+	for _, value := range *serverSNIKeystores {
+		if _, err := parseSNIKeystore(value); err != nil {
+			return err
+		}
+	}
+	if len(*serverSNIKeystores) > 0 && (*useWorkloadAPI || len(*serverACMEDomains) > 0) {
+		return errors.New("--keystore-for-sni can't be used with --use-workload-api or --acme-domain")
+	}
+	if *serverOCSPStapling && (*useWorkloadAPI || len(*serverACMEDomains) > 0) {
+		return errors.New("--ocsp-stapling can't be used with --use-workload-api or --acme-domain")
+	}
+	if *serverClientCA != "" && (*useWorkloadAPI || *serverDisableAuth) {
+		return errors.New("--cacert-client can't be used with --use-workload-api or --disable-authentication")
+	}
+	if *serverTargetCA != "" && !*serverTargetTLS && *serverHealthCheck != "tls" {
+		return errors.New("--cacert-target requires --target-tls or --target-health-check=tls")
+	}
+	hasTargetTLSFlags := *serverTargetKeystore != "" || *serverTargetName != "" ||
+		len(*serverTargetCNs) > 0 || len(*serverTargetDNSs) > 0 || len(*serverTargetURIs) > 0
+	if hasTargetTLSFlags && !*serverTargetTLS {
+		return errors.New("--target-keystore, --target-server-name and --target-verify-* flags require --target-tls")
+	}
+	if *serverTargetTLS && (*serverProxyProtocol || isUDPAddress(*serverForwardAddress)) {
+		return errors.New("--target-tls can't be used with --target-proxy-protocol or UDP targets")
+	}
+	if err := validateChild(*serverChildArgs); err != nil {
+		return err
 	}
 	if err := validateCipherSuites(); err != nil {
 		return err
@@ -309,8 +920,18 @@ func clientValidateFlags() error {
 		(*certPath != "" && *keyPath != ""),
 		// A certificate, with the key in a PKCS#11 module
 		(*certPath != "" && hasPKCS11()),
+		// A certificate, with the key in a TPM
+		(*certPath != "" && *keystoreTPM != ""),
+		// A certificate, with the key in a cloud KMS
+		(*certPath != "" && *keystoreKMS != ""),
+		// A certificate and key in a PKCS#11 module, selected by label
+		(*certPath == "" && *keystorePath == "" && hasPKCS11KeyLabel()),
 		// SPIFFE Workload API
 		*useWorkloadAPI,
+		// Vault PKI secrets engine
+		*vaultPath != "",
+		// Pre-shared key, for UDP targets
+		*clientPSKIdentity != "",
 		// No credentials needed if auth is disabled
 		*clientDisableAuth,
 	})
@@ -321,14 +942,86 @@ func clientValidateFlags() error {
 	if hasValidCredentials > 1 {
 		return errors.New("--keystore, --cert/--key, --keychain-identity and --disable-authentication flags are mutually exclusive")
 	}
-	if (*keyPath != "" && *certPath == "") || (*certPath != "" && *keyPath == "" && !hasPKCS11()) {
-		return errors.New("--cert/--key must be set together, unless using PKCS11 for private key")
+	if (*keyPath != "" && *certPath == "") || (*certPath != "" && *keyPath == "" && !hasPKCS11() && *keystoreTPM == "" && *keystoreKMS == "") {
+		return errors.New("--cert/--key must be set together, unless using PKCS11, a TPM or a KMS for private key")
+	}
+	if (*clientPSKIdentity != "") != (*pskFile != "") {
+		return errors.New("--psk-identity and --psk-file must be set together in client mode")
+	}
+	if *clientPSKIdentity != "" && !strings.HasPrefix(*clientForwardAddress, "udp:") {
+		return errors.New("--psk-identity requires a udp: target, pre-shared keys aren't supported for TLS over TCP")
+	}
+	if len(*clientKeystores) > 0 && (*clientDisableAuth || *useWorkloadAPI) {
+		return errors.New("--keystore-fallback can't be used with --disable-authentication or --use-workload-api")
 	}
 	if !*clientUnsafeListen && !consideredSafe(*clientListenAddress) {
 		return fmt.Errorf("--listen must be unix:PATH, localhost:PORT, systemd:NAME or launchd:NAME (unless --unsafe-listen is set)")
 	}
 	if *clientConnectProxy != nil && (*clientConnectProxy).Scheme != "http" && (*clientConnectProxy).Scheme != "https" {
-		return fmt.Errorf("invalid CONNECT proxy %s, must have HTTP or HTTPS connection scheme", (*clientConnectProxy).String())
+		return fmt.Errorf("invalid CONNECT proxy %s, must have HTTP or HTTPS connection scheme", redactURL(*clientConnectProxy))
+	}
+	if isUDPAddress(*clientListenAddress) != isUDPAddress(*clientForwardAddress) {
+		return errors.New("--listen and --target must either both be UDP (udp:HOST:PORT) or both be stream sockets")
+	}
+	if strings.HasPrefix(*clientForwardAddress, "npipe:") {
+		return errors.New("--target can't be a named pipe in client mode")
+	}
+	if isUDPAddress(*clientForwardAddress) && (*clientConnectProxy != nil || *clientSocks5Proxy != "" || *clientProxyFromEnv) {
+		return errors.New("proxy flags can't be used with UDP")
+	}
+	if err := validateOriginalDst(); err != nil {
+		return err
+	}
+	if *clientMultiplex < 0 {
+		return fmt.Errorf("invalid --multiplex %d, must be number of connections", *clientMultiplex)
+	}
+	if *clientMultiplex > 0 && (isUDPAddress(*clientForwardAddress) || *clientForwardAddress == originalDstTarget) {
+		return errors.New("--multiplex can't be used with UDP or --target original-dst")
+	}
+	if *clientTransport != "tls" && (isUDPAddress(*clientForwardAddress) || *clientForwardAddress == originalDstTarget) {
+		return fmt.Errorf("--transport %s can't be used with UDP or --target original-dst", *clientTransport)
+	}
+	if *clientTransport != "tls" && *clientMultiplex > 0 {
+		return fmt.Errorf("--transport %s can't be used with --multiplex", *clientTransport)
+	}
+	if *clientTransport == "quic" && (*clientConnectProxy != nil || *clientSocks5Proxy != "" || *clientProxyFromEnv) {
+		return errors.New("--transport quic can't be used with proxy flags")
+	}
+	if *clientTransport == "websocket" && !strings.HasPrefix(*clientWebSocketPath, "/") {
+		return errors.New("--websocket-path must start with '/'")
+	}
+	if len(*clientAllowedUIDs) > 0 || len(*clientAllowedGIDs) > 0 {
+		if !socket.SupportsPeerCredentials {
+			return errors.New("--allow-uid/--allow-gid are only supported on linux")
+		}
+		if network, _, _, _ := socket.ParseAddress(*clientListenAddress); network != "unix" && network != "systemd" && network != "launchd" {
+			return errors.New("--allow-uid/--allow-gid require --listen to be a UNIX socket")
+		}
+	}
+	if *clientListenCA != "" && *clientListenKeystore == "" {
+		return errors.New("--listen-cacert requires --listen-keystore to be set")
+	}
+	if *clientListenKeystore != "" && isUDPAddress(*clientListenAddress) {
+		return errors.New("--listen-keystore can't be used with UDP")
+	}
+	if *clientSocks5Proxy != "" {
+		if *clientConnectProxy != nil {
+			return errors.New("--connect-proxy and --socks5-proxy flags are mutually exclusive")
+		}
+		if *clientProxyFromEnv {
+			return errors.New("--connect-proxy-from-env and --socks5-proxy flags are mutually exclusive")
+		}
+		if _, _, err := net.SplitHostPort(*clientSocks5Proxy); err != nil {
+			return fmt.Errorf("invalid SOCKS5 proxy %s, must be HOST:PORT", *clientSocks5Proxy)
+		}
+	} else if *clientSocks5User != "" || *clientSocks5Pass != "" {
+		return errors.New("--socks5-proxy-user/--socks5-proxy-pass require --socks5-proxy to be set")
+	}
+	if *clientProxyFromEnv && *clientConnectProxy != nil {
+		return errors.New("--connect-proxy and --connect-proxy-from-env flags are mutually exclusive")
+	}
+	if err := validateChild(*clientChildArgs); err != nil {
+		return err
 	}
 	if err := validateCipherSuites(); err != nil {
 		return err
@@ -339,6 +1032,10 @@ func clientValidateFlags() error {
 
 func main() {
 	err := run(os.Args[1:])
+	if exitErr, ok := err.(*childExitError); ok {
+		exitFunc(exitErr.status)
+		return
+	}
 	if err != nil {
 		exitFunc(1)
 	}
@@ -351,7 +1048,19 @@ func run(args []string) error {
 	app.Version(fmt.Sprintf("rev %s built with %s", version, runtime.Version()))
 	app.Validate(validateFlags)
 	app.UsageTemplate(kingpin.LongHelpTemplate)
+
+	// Settings from config file (if any) are passed as flags
+	given := givenFlags(args)
+	args, settings, err := withConfigFile(args)
+	if err != nil {
+		logger.Printf("error: %s\n", err)
+		return err
+	}
 	command := kingpin.MustParse(app.Parse(args))
+	var config *configFile
+	if settings != nil {
+		config = &configFile{path: *configPath, settings: settings, given: given}
+	}
 
 	// use-workload-api-addr implies use-workload-api
 	if *useWorkloadAPIAddr != "" {
@@ -359,15 +1068,33 @@ func run(args []string) error {
 	}
 
 	// Logger
-	err := initLogger(useSyslog(), *quiet)
+	err = initLogger(useSyslog(), *quiet)
 	if err != nil {
 		logger.Printf("error initializing logger: %s\n", err)
 		os.Exit(1)
 	}
 
-	logger.SetPrefix(fmt.Sprintf("[%d] ", os.Getpid()))
+	if *syslogAddr != "" && logger.Writer() != ioutil.Discard {
+		// PID and timestamp are part of the syslog header.
+		writer, err := newSyslogWriter(*syslogAddr, *syslogFormat)
+		if err != nil {
+			logger.Printf("error: unable to connect to syslog server: %s\n", err)
+			return err
+		}
+		logger = log.New(writer, "", 0)
+	} else if *logFormat == "json" {
+		// PID and timestamp are added as fields by the JSON writer.
+		logger = log.New(newJSONLogWriter(logger.Writer()), "", 0)
+	} else {
+		logger.SetPrefix(fmt.Sprintf("[%d] ", os.Getpid()))
+	}
 	logger.Printf("starting ghostunnel in %s mode", command)
 
+	if err := openKeyLog(); err != nil {
+		logger.Printf("error: unable to open key log: %s\n", err)
+		return err
+	}
+
 	// Metrics
 	if *metricsGraphite != nil {
 		logger.Printf("metrics enabled; reporting metrics via TCP to %s", *metricsGraphite)
@@ -376,13 +1103,30 @@ func run(args []string) error {
 	if *metricsURL != "" {
 		logger.Printf("metrics enabled; reporting metrics via POST to %s", *metricsURL)
 	}
+	if *statsdAddr != "" {
+		logger.Printf("metrics enabled; reporting metrics via StatsD to %s", *statsdAddr)
+		go reportStatsd(metrics.DefaultRegistry, *metricsInterval, *metricsPrefix, *statsdAddr, *statsdTags)
+	}
 	// Always enable prometheus registry. The overhead should be quite minimal as an in-mem map is updated
 	// with the values.
 	pClient := prometheusmetrics.NewPrometheusProvider(metrics.DefaultRegistry, *metricsPrefix, "", prometheus.DefaultRegisterer, 1*time.Second)
 	go pClient.UpdatePrometheusMetrics()
+	histograms, err := proxy.NewHistograms(*metricsPrefix, prometheus.DefaultRegisterer)
+	if err != nil {
+		logger.Printf("error: unable to register histograms: %s\n", err)
+		return err
+	}
+	var identityMetrics *proxy.IdentityMetrics
+	if *metricsPerIdentity > 0 {
+		identityMetrics, err = proxy.NewIdentityMetrics(*metricsPrefix, *metricsPerIdentity, prometheus.DefaultRegisterer)
+		if err != nil {
+			logger.Printf("error: unable to register per-identity metrics: %s\n", err)
+			return err
+		}
+	}
 
 	// Read CA bundle for passing to metrics library
-	ca, err := certloader.LoadTrustStore(*caBundlePath)
+	ca, err := certloader.LoadTrustStore(withSystemTrust(*caBundlePath))
 	if err != nil {
 		logger.Printf("error: unable to build TLS config: %s\n", err)
 		return err
@@ -398,10 +1142,41 @@ func run(args []string) error {
 	}
 	metrics := sqmetrics.NewMetrics(*metricsURL, *metricsPrefix, client, *metricsInterval, metrics.DefaultRegistry, logger)
 
+	// Tracing
+	var tracer *tracing.Tracer
+	if *otelEndpoint != "" {
+		logger.Printf("tracing enabled; exporting spans via OTLP to %s", *otelEndpoint)
+		tracer = tracing.NewTracer(*otelEndpoint, *otelServiceName, nil, logger)
+		defer tracer.Close()
+	}
+
+	err = resolveKeystorePassword()
+	if err != nil {
+		logger.Printf("error: %s\n", err)
+		return err
+	}
+
+	err = configureUnixSockets()
+	if err != nil {
+		logger.Printf("error: %s\n", err)
+		return err
+	}
+
+	err = configureSocketOptions()
+	if err != nil {
+		logger.Printf("error: %s\n", err)
+		return err
+	}
+
 	tlsConfigSource, err := getTLSConfigSource()
 	if err != nil {
 		return err
 	}
+	// Sources like the SPIFFE Workload API hold open a stream for receiving
+	// rotated certificates, make sure to close it once we're done.
+	if closer, ok := tlsConfigSource.(io.Closer); ok {
+		defer closer.Close()
+	}
 
 	switch command {
 	case serverCommand.FullCommand():
@@ -410,13 +1185,75 @@ func run(args []string) error {
 			return err
 		}
 
-		dial, err := serverBackendDialer()
+		targetTrust, err := buildTargetCertificate()
+		if err != nil {
+			logger.Printf("error: unable to load target certificates: %s\n", err)
+			return err
+		}
+		targetTLS, err := buildTargetTLS(targetTrust)
+		if err != nil {
+			logger.Printf("error: unable to build target TLS config: %s\n", err)
+			return err
+		}
+
+		dial, err := serverBackendDialer(targetTrust, targetTLS)
 		if err != nil {
 			logger.Printf("error: invalid target address: %s\n", err)
 			return err
 		}
 		logger.Printf("using target address %s", *serverForwardAddress)
 
+		routes, err := serverBackendRoutes(targetTLS)
+		if err != nil {
+			logger.Printf("error: invalid route: %s\n", err)
+			return err
+		}
+
+		var policy *auth.PolicyFile
+		if *serverPolicyFile != "" {
+			policy, err = auth.LoadPolicyFile(*serverPolicyFile, logger)
+			if err != nil {
+				logger.Printf("error: unable to load access policy: %s\n", err)
+				return err
+			}
+		}
+
+		var crls *certloader.CRLSet
+		if len(*serverCRLs) > 0 {
+			crls, err = certloader.LoadCRLSet(*serverCRLs, logger)
+			if err != nil {
+				logger.Printf("error: %s\n", err)
+				return err
+			}
+		}
+
+		var peerKeys *auth.PeerKeys
+		if len(*peerKeyPaths) > 0 {
+			peerKeys, err = auth.LoadPeerKeys(*peerKeyPaths)
+			if err != nil {
+				logger.Printf("error: %s\n", err)
+				return err
+			}
+		}
+
+		var psks *certloader.PSKFile
+		if *pskFile != "" {
+			psks, err = certloader.LoadPSKFile(*pskFile)
+			if err != nil {
+				logger.Printf("error: unable to load pre-shared keys: %s\n", err)
+				return err
+			}
+		}
+
+		var caMetrics *caBundleMetrics
+		if bundles := peerCABundles(); len(bundles) > 0 && !*serverDisableAuth && !*useWorkloadAPI && peerKeys == nil {
+			caMetrics, err = newCABundleMetrics(bundles)
+			if err != nil {
+				logger.Printf("error: unable to set up CA bundle metrics: %s\n", err)
+				return err
+			}
+		}
+
 		status := newStatusHandler(dial)
 		context := &Context{
 			status:          status,
@@ -424,8 +1261,32 @@ func run(args []string) error {
 			dial:            dial,
 			metrics:         metrics,
 			tlsConfigSource: tlsConfigSource,
+			tracer:          tracer,
+			histograms:      histograms,
+			identityMetrics: identityMetrics,
+			caMetrics:       caMetrics,
+			crls:            crls,
+			peerKeys:        peerKeys,
+			psks:            psks,
+			policy:          policy,
+			routes:          routes,
+			config:          config,
+			targetTrust:     targetTrust,
+			child:           newChildProcess(*serverChildArgs, *childRestart),
 		}
 		go context.reloadHandler(*timedReload)
+		if *autoReload {
+			if _, err := context.reloadOnChangeHandler(watchedFiles()); err != nil {
+				logger.Printf("error: unable to watch files for changes: %s\n", err)
+				return err
+			}
+		} else if policy != nil {
+			// Access policy is always reloaded on change
+			if _, err := context.reloadOnChangeHandler([]string{*serverPolicyFile}); err != nil {
+				logger.Printf("error: unable to watch access policy for changes: %s\n", err)
+				return err
+			}
+		}
 
 		// Start listening
 		err = serverListen(context)
@@ -440,16 +1301,62 @@ func run(args []string) error {
 			return err
 		}
 
-		network, address, host, err := socket.ParseAddress(*clientForwardAddress)
-		if err != nil {
-			logger.Printf("error: invalid target address: %s\n", err)
-			return err
+		verifiers := targetVerifiers{}
+		if *clientCTLogList != "" {
+			verifiers.ctLogs, err = certloader.LoadCTLogList(*clientCTLogList, *clientCTMinSCTs, logger)
+			if err != nil {
+				logger.Printf("error: %s\n", err)
+				return err
+			}
+		}
+		if *pskFile != "" {
+			verifiers.psks, err = certloader.LoadPSKFile(*pskFile)
+			if err != nil {
+				logger.Printf("error: unable to load pre-shared keys: %s\n", err)
+				return err
+			}
+		}
+		if len(*peerKeyPaths) > 0 {
+			verifiers.peerKeys, err = auth.LoadPeerKeys(*peerKeyPaths)
+			if err != nil {
+				logger.Printf("error: %s\n", err)
+				return err
+			}
+		}
+
+		var dial func() (net.Conn, error)
+		var originalDst certloader.Dialer
+		var portMap map[int]int
+		if *clientForwardAddress == originalDstTarget {
+			logger.Printf("forwarding connections to their original destination")
+			portMap, err = parsePortMap(*clientPortMap)
+			if err != nil {
+				logger.Printf("error: %s\n", err)
+				return err
+			}
+			originalDst, err = clientTLSDialer(tlsConfigSource, verifiers, "tcp", "", "")
+			if err != nil {
+				logger.Printf("error: unable to build dialer: %s\n", err)
+				return err
+			}
+		} else {
+			network, address, host, err := socket.ParseAddress(*clientForwardAddress)
+			if err != nil {
+				logger.Printf("error: invalid target address: %s\n", err)
+				return err
+			}
+			logger.Printf("using target address %s", *clientForwardAddress)
+
+			dial, err = clientBackendDialer(tlsConfigSource, verifiers, network, address, host)
+			if err != nil {
+				logger.Printf("error: unable to build dialer: %s\n", err)
+				return err
+			}
 		}
-		logger.Printf("using target address %s", *clientForwardAddress)
 
-		dial, err := clientBackendDialer(tlsConfigSource, network, address, host)
+		listenerCert, err := buildListenerCertificate()
 		if err != nil {
-			logger.Printf("error: unable to build dialer: %s\n", err)
+			logger.Printf("error: unable to load listener certificates: %s\n", err)
 			return err
 		}
 
@@ -460,8 +1367,25 @@ func run(args []string) error {
 			dial:            dial,
 			metrics:         metrics,
 			tlsConfigSource: tlsConfigSource,
+			tracer:          tracer,
+			histograms:      histograms,
+			identityMetrics: identityMetrics,
+			config:          config,
+			peerKeys:        verifiers.peerKeys,
+			psks:            verifiers.psks,
+			ctLogs:          verifiers.ctLogs,
+			listenerCert:    listenerCert,
+			originalDst:     originalDst,
+			portMap:         portMap,
+			child:           newChildProcess(*clientChildArgs, *childRestart),
 		}
 		go context.reloadHandler(*timedReload)
+		if *autoReload {
+			if _, err := context.reloadOnChangeHandler(watchedFiles()); err != nil {
+				logger.Printf("error: unable to watch files for changes: %s\n", err)
+				return err
+			}
+		}
 
 		// Start listening
 		err = clientListen(context)
@@ -486,61 +1410,355 @@ func serverListen(context *Context) error {
 		return err
 	}
 
-	allowedURIs, err := wildcard.CompileList(*serverAllowedURIs)
-	if err != nil {
-		logger.Printf("invalid URI pattern in --allow-uri flag (%s)", err)
-		return err
-	}
-
-	serverACL := auth.ACL{
-		AllowAll:    *serverAllowAll,
-		AllowedCNs:  *serverAllowedCNs,
-		AllowedOUs:  *serverAllowedOUs,
-		AllowedDNSs: *serverAllowedDNSs,
-		AllowedIPs:  *serverAllowedIPs,
-		AllowedURIs: allowedURIs,
-		Logger:      logger,
-	}
-
+	// Access rule that matched a client certificate, for the audit log
+	auditRule := func(*x509.Certificate) string { return "" }
 	if *serverDisableAuth {
 		config.ClientAuth = tls.NoClientCert
+		auditRule = func(*x509.Certificate) string { return "disable-authentication" }
+	} else if context.peerKeys != nil {
+		// Chains aren't verified, clients are authenticated by their key
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.VerifyPeerCertificate = context.peerKeys.VerifyPeerCertificate
+		auditRule = func(cert *x509.Certificate) string {
+			if cert == nil {
+				return ""
+			}
+			return "peer-key"
+		}
+	} else if pskOnly(context) {
+		config.VerifyPeerCertificate = rejectCertificates
 	} else {
+		serverACL, err := newReloadableACL(serverACLFlags(), context.policy != nil || len(*serverAllowedPSKs) > 0)
+		if err != nil {
+			return err
+		}
+		if context.config != nil {
+			// Access control settings in the config file are applied on reload
+			context.config.acl = serverACL
+		}
 		config.VerifyPeerCertificate = serverACL.VerifyPeerCertificateServer
+		if context.policy != nil {
+			// Deny flags also apply to clients allowed by the policy file
+			config.VerifyPeerCertificate = chainVerifyPeerCertificate(
+				serverACL.VerifyPeerCertificateDenied,
+				anyVerifyPeerCertificate(serverACL.VerifyPeerCertificateServer, context.policy.VerifyPeerCertificateServer))
+		}
+		if policy := chainPolicy(); policy != nil {
+			config.VerifyPeerCertificate = chainVerifyPeerCertificate(policy.VerifyPeerCertificate, config.VerifyPeerCertificate)
+		}
+		auditRule = func(cert *x509.Certificate) string {
+			if cert == nil {
+				return ""
+			}
+			if rule := serverACL.current().MatchedRule(cert); rule != "" {
+				return rule
+			}
+			if context.policy != nil {
+				return "access-policy-file"
+			}
+			return ""
+		}
+	}
+
+	if *sessionTickets {
+		context.ticketKeys, err = newSessionTicketKeys(config, *sessionTicketKeyCount, *sessionTicketKeyFile)
+		if err != nil {
+			logger.Printf("error: %s", err)
+			return err
+		}
+		if *sessionTicketRotation > 0 {
+			go context.ticketKeys.rotateEvery(*sessionTicketRotation)
+		}
+	} else {
+		config.SessionTicketsDisabled = true
+	}
+
+	// Advertise ALPN protocols used in routes, so they can be negotiated
+	config.NextProtos = routeProtocols(context.routes)
+	if *serverMultiplex {
+		config.NextProtos = append(config.NextProtos, mux.Protocol)
+	}
+	if *serverTransport == "h2" {
+		config.NextProtos = append(config.NextProtos, transport.HTTP2Protocol)
+	}
+	if *serverTransport == "websocket" {
+		config.NextProtos = append(config.NextProtos, transport.WebSocketProtocol)
+	}
+	if serverHTTPMode() {
+		config.NextProtos = append(config.NextProtos, "h2", "http/1.1")
+	}
+
+	if context.caMetrics != nil {
+		// Counted before access checks, so denied peers are counted as well
+		config.VerifyPeerCertificate = chainVerifyPeerCertificate(context.caMetrics.VerifyPeerCertificate, config.VerifyPeerCertificate)
+	}
+	if context.crls != nil {
+		config.VerifyPeerCertificate = chainVerifyPeerCertificate(config.VerifyPeerCertificate, context.crls.VerifyPeerCertificate)
+	}
+
+	if *serverRevocation != "off" {
+		client := &http.Client{
+			Timeout:   *timeoutDuration,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		}
+		checker := certloader.NewRevocationChecker(client, *serverRevocation == "hard-fail", logger)
+		config.VerifyPeerCertificate = chainVerifyPeerCertificate(config.VerifyPeerCertificate, checker.VerifyPeerCertificate)
+	}
+
+	listeners, err := socket.ParseAndOpenAll(*serverListenAddress)
+	if err != nil {
+		logger.Printf("error trying to listen: %s", err)
+		return err
+	}
+
+	if *serverFirstByteTime > 0 {
+		for i, listener := range listeners {
+			if listener.Addr().Network() != "udp" {
+				listeners[i] = &firstByteListener{Listener: listener, timeout: *serverFirstByteTime}
+			}
+		}
+	}
+
+	if *serverListenProxy {
+		// Recover original client addresses from PROXY protocol headers, so
+		// logs and ACL checks see the real client instead of the load balancer.
+		for i, listener := range listeners {
+			listeners[i] = &proxyHeaderListener{Listener: listener, timeout: *timeoutDuration}
+		}
+	}
+
+	var serverConfig certloader.TLSServerConfig
+	if !config.SessionTicketsDisabled {
+		// Re-check resumed sessions, they skip VerifyPeerCertificate
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyResumedConnection(serverConfig, state)
+		}
+	}
+	serverConfig = mustGetServerConfig(context.tlsConfigSource, config)
+
+	if *serverAuditLog != "" {
+		context.auditLog, err = openAuditLog(*serverAuditLog, auditRule)
+		if err != nil {
+			logger.Printf("error opening audit log: %s", err)
+			return err
+		}
+	}
+
+	tlsListeners := []net.Listener{}
+	pskListeners := false
+	for _, listener := range listeners {
+		if listener.Addr().Network() == "udp" && context.psks != nil {
+			tlsListeners = append(tlsListeners, certloader.NewPSKDTLSListener(listener, serverPSKCallback(context.psks), keyLog))
+			pskListeners = true
+			continue
+		}
+		if listener.Addr().Network() == "udp" {
+			tlsListeners = append(tlsListeners, certloader.NewDTLSListener(listener, serverConfig))
+			continue
+		}
+		if pskOnly(context) {
+			err := fmt.Errorf("--allow-psk-identity only applies to UDP listeners, %s needs other access control flags (pre-shared keys aren't supported for TLS over TCP)", listener.Addr())
+			logger.Printf("error: %s", err)
+			return err
+		}
+		if context.auditLog != nil {
+			tlsListeners = append(tlsListeners, &auditListener{Listener: listener, config: serverConfig})
+			continue
+		}
+		tlsListeners = append(tlsListeners, certloader.NewListener(listener, serverConfig))
+	}
+	if context.psks != nil && !pskListeners {
+		err := errors.New("--psk-file requires a udp: listen address in server mode")
+		logger.Printf("error: %s", err)
+		return err
+	}
+	if *serverTransport == "quic" {
+		quicListeners, err := openQUICListeners(listeners, serverConfig)
+		if err != nil {
+			return err
+		}
+		tlsListeners = append(tlsListeners, quicListeners...)
 	}
 
-	listener, err := socket.ParseAndOpen(*serverListenAddress)
-	if err != nil {
-		logger.Printf("error trying to listen: %s", err)
-		return err
-	}
-
-	serverConfig := mustGetServerConfig(context.tlsConfigSource, config)
-
 	p := proxy.New(
-		certloader.NewListener(listener, serverConfig),
+		tlsListeners,
 		*timeoutDuration,
 		context.dial,
-		logger,
+		proxyLogger(),
 		proxyLoggerFlags(*quiet),
 		*serverProxyProtocol,
 	)
+	err = context.configureProxy(p)
+	if err != nil {
+		return err
+	}
+	p.HandshakeTimeout = *serverHandshakeTime
+	p.MaxHandshakes = *serverMaxHandshakes
+	p.MaxHandshakesPerIP = *serverMaxHandshakeIP
+	p.EnforceCertExpiry = *serverEnforceExpiry
+	if context.auditLog != nil {
+		p.Auditor = context.auditLog
+	}
+	if *serverTarpit > 0 {
+		p.Tarpit = proxy.NewTarpit(*serverTarpit, *serverTarpitDelay, *serverTarpitMaxDelay, *serverTarpitWindow)
+	}
+	p.Multiplex = *serverMultiplex
+	if isExecTarget(*serverForwardAddress) {
+		p.DialConn = execDialer(execCommand(*serverForwardAddress))
+	}
+	if serverHTTPMode() {
+		// Already validated in serverValidateFlags
+		rules, _ := serverHTTPRules()
+		p.HTTP = &proxy.HTTPConfig{IdentityHeaders: *serverIdentityHeader, ChannelBinding: *serverChannelBinding, Rules: rules}
+	}
+	p.HTTP2 = *serverTransport == "h2"
+	if *serverTransport == "websocket" {
+		p.WebSocketPath = *serverWebSocketPath
+	}
+
+	if len(*serverAllowedCIDRs) > 0 || len(*serverDeniedCIDRs) > 0 {
+		// Already validated in serverValidateFlags
+		allowed, _ := parseCIDRs(*serverAllowedCIDRs)
+		denied, _ := parseCIDRs(*serverDeniedCIDRs)
+		p.SourceFilter = &proxy.SourceFilter{Allowed: allowed, Denied: denied}
+	}
+
+	if *serverOPAServer != "" {
+		client := &http.Client{
+			Timeout:   *timeoutDuration,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		}
+		p.Authorizer, err = auth.NewOPA(*serverOPAServer, *serverOPAQuery, client)
+		if err != nil {
+			logger.Printf("error: %s", err)
+			return err
+		}
+	}
+
+	if *serverAuthURL != "" {
+		client := &http.Client{
+			Timeout:   *serverAuthTimeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		}
+		p.Authorizer = auth.NewWebhook(*serverAuthURL, client, *serverAuthCacheTTL)
+	}
 
+	if *serverReenforce {
+		context.reenforce = func() {
+			if closed := p.Reenforce(reverifyConnection(serverConfig, p.Authorizer)); closed > 0 {
+				logger.Printf("closed %d connections no longer allowed after reload", closed)
+			}
+		}
+	}
+
+	context.startExpiryMonitor()
+	context.startTargetProber()
 	if *statusAddress != "" {
-		err := context.serveStatus()
+		err := context.serveStatus(p)
 		if err != nil {
 			logger.Printf("error serving /_status: %s", err)
 			return err
 		}
 	}
 
-	logger.Printf("listening for connections on %s", *serverListenAddress)
+	logger.Printf("listening for connections on %s", strings.Join(*serverListenAddress, ", "))
 
 	go p.Accept()
 
 	context.status.Listening()
+	if err := socket.Ready(); err != nil {
+		logger.Printf("error: unable to notify parent process of upgrade: %s", err)
+	}
+	if err := context.child.start(); err != nil {
+		return err
+	}
 	context.signalHandler(p)
 	p.Wait()
+	if context.mirror != nil {
+		context.mirror.Close()
+	}
+
+	return context.child.wait()
+}
 
+// openQUICListeners opens a QUIC listener on UDP for each TCP listener, on the
+// same address. QUIC requires TLS 1.3, and has its own ALPN protocol.
+func openQUICListeners(listeners []net.Listener, serverConfig certloader.TLSServerConfig) ([]net.Listener, error) {
+	handshakeTimeout := *serverHandshakeTime
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = *timeoutDuration
+	}
+	quicListeners := []net.Listener{}
+	for _, listener := range listeners {
+		if listener.Addr().Network() == "udp" {
+			continue
+		}
+		addr, ok := listener.Addr().(*net.TCPAddr)
+		if !ok {
+			err := fmt.Errorf("--transport quic requires HOST:PORT listen addresses, can't be used with %s", listener.Addr())
+			logger.Printf("error: %s", err)
+			return nil, err
+		}
+		conn, err := socket.ListenPacket(addr.String())
+		if err != nil {
+			logger.Printf("error trying to listen for QUIC connections: %s", err)
+			return nil, err
+		}
+		quicListener, err := transport.ListenQUIC(conn, serverConfig.GetServerConfig, handshakeTimeout)
+		if err != nil {
+			conn.Close()
+			logger.Printf("error trying to listen for QUIC connections: %s", err)
+			return nil, err
+		}
+		logger.Printf("listening for QUIC connections on udp:%s", addr)
+		quicListeners = append(quicListeners, quicListener)
+	}
+	return quicListeners, nil
+}
+
+// configureProxy applies options shared by server and client mode to the proxy.
+func (context *Context) configureProxy(p *proxy.Proxy) error {
+	p.Routes = context.routes
+	p.Tracer = context.tracer
+	p.Histograms = context.histograms
+	p.IdentityMetrics = context.identityMetrics
+	p.MaxLogRate = *logRateLimit
+	p.MaxConnRate = *maxConnRate
+	p.MaxConnRatePerClient = *maxConnRatePerClient
+	p.MaxConcurrentConns = *maxConcurrentConns
+	p.MaxConnsPerClient = *maxConnsPerClient
+	p.RateLimitRead = int64(*rateLimitRead)
+	p.RateLimitWrite = int64(*rateLimitWrite)
+	p.RateLimitBurst = int64(*rateLimitBurst)
+	p.IdleTimeout = *idleTimeout
+	p.MaxConnLifetime = *maxLifetime
+	p.MaxConnLifetimeJitter = *maxLifetimeJit
+	p.DialRetries = *dialRetries
+	p.DialBackoff = *dialBackoff
+	p.DialMaxBackoff = *dialMaxBackoff
+	p.HoldTimeout = *holdTimeout
+	p.MaxHeldConns = *holdMaxConns
+
+	if *accessLogPath != "" {
+		accessLog, err := openAccessLog(*accessLogPath, *logFormat == "json")
+		if err != nil {
+			logger.Printf("error opening access log: %s", err)
+			return err
+		}
+		p.AccessLog = accessLog
+		context.accessLog = accessLog
+	}
+
+	mirror, err := newMirror()
+	if err != nil {
+		logger.Printf("error: unable to set up --mirror-target: %s", err)
+		return err
+	}
+	if mirror != nil {
+		logger.Printf("mirroring proxied data to %s", *mirrorTarget)
+		p.Mirror = mirror
+		context.mirror = mirror
+	}
 	return nil
 }
 
@@ -557,17 +1775,42 @@ func clientListen(context *Context) error {
 		ul.SetUnlinkOnClose(true)
 	}
 
+	if len(*clientAllowedUIDs) > 0 || len(*clientAllowedGIDs) > 0 {
+		listener, err = newPeerCredListener(listener, *clientAllowedUIDs, *clientAllowedGIDs)
+		if err != nil {
+			logger.Printf("error: %s", err)
+			return err
+		}
+	}
+
+	if context.listenerCert != nil {
+		listener, err = wrapListenerTLS(listener, context.listenerCert)
+		if err != nil {
+			logger.Printf("error: unable to build listener TLS config: %s", err)
+			return err
+		}
+	}
+
 	p := proxy.New(
-		listener,
+		[]net.Listener{listener},
 		*timeoutDuration,
 		context.dial,
-		logger,
+		proxyLogger(),
 		proxyLoggerFlags(*quiet),
 		false,
 	)
+	err = context.configureProxy(p)
+	if err != nil {
+		return err
+	}
+	if context.originalDst != nil {
+		p.DialConn = originalDstDialer(context.originalDst, listener.Addr(), *clientTransparent, context.portMap)
+	}
 
+	context.startExpiryMonitor()
+	context.startTargetProber()
 	if *statusAddress != "" {
-		err := context.serveStatus()
+		err := context.serveStatus(p)
 		if err != nil {
 			logger.Printf("error serving /_status: %s", err)
 			return err
@@ -579,14 +1822,23 @@ func clientListen(context *Context) error {
 	go p.Accept()
 
 	context.status.Listening()
+	if err := socket.Ready(); err != nil {
+		logger.Printf("error: unable to notify parent process of upgrade: %s", err)
+	}
+	if err := context.child.start(); err != nil {
+		return err
+	}
 	context.signalHandler(p)
 	p.Wait()
+	if context.mirror != nil {
+		context.mirror.Close()
+	}
 
-	return nil
+	return context.child.wait()
 }
 
 // Serve /_status (if configured)
-func (context *Context) serveStatus() error {
+func (context *Context) serveStatus(p *proxy.Proxy) error {
 	promHandler := promhttp.Handler()
 
 	mux := http.NewServeMux()
@@ -615,6 +1867,29 @@ func (context *Context) serveStatus() error {
 		mux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
 	}
 
+	probes := &probeHandler{
+		status:      context.status,
+		certificate: currentCertificate(context.tlsConfigSource),
+		ready:       *statusReady,
+	}
+	probes.register(mux)
+
+	if *enableAdmin {
+		admin := &adminHandler{
+			proxy:       p,
+			certificate: currentCertificate(context.tlsConfigSource),
+			reload:      context.reload,
+			reopenLogs:  context.reopenLogs,
+		}
+		token, err := readAdminToken(*adminToken)
+		if err != nil {
+			logger.Printf("error: unable to read admin token: %s", err)
+			return err
+		}
+		admin.token = token
+		admin.register(mux)
+	}
+
 	network, address, _, err := socket.ParseAddress(*statusAddress)
 	if err != nil {
 		return err
@@ -626,19 +1901,33 @@ func (context *Context) serveStatus() error {
 		return err
 	}
 
-	if network != "unix" && context.tlsConfigSource.CanServe() {
+	if hasStatusAccessFlags() && !context.tlsConfigSource.CanServe() {
+		return errors.New("--status-allow-* flags require a certificate to serve the status port with")
+	}
+
+	if network != "unix" && network != "npipe" && context.tlsConfigSource.CanServe() {
 		config, err := buildServerConfig(*enabledCipherSuites)
 		if err != nil {
 			return err
 		}
 		config.ClientAuth = tls.NoClientCert
+		// Negotiate HTTP/2, for gRPC health checks
+		config.NextProtos = []string{"h2", "http/1.1"}
+		if hasStatusAccessFlags() {
+			acl, err := statusACL()
+			if err != nil {
+				return err
+			}
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+			config.VerifyPeerCertificate = acl.VerifyPeerCertificateServer
+		}
 
 		serverConfig := mustGetServerConfig(context.tlsConfigSource, config)
 		listener = certloader.NewListener(listener, serverConfig)
 	}
 
 	context.statusHTTP = &http.Server{
-		Handler:  mux,
+		Handler:  withGRPCHealth(context.status, mux),
 		ErrorLog: logger,
 	}
 
@@ -652,20 +1941,225 @@ func (context *Context) serveStatus() error {
 	return nil
 }
 
-// Get backend dialer function in server mode (connecting to a unix socket or tcp port)
-func serverBackendDialer() (func() (net.Conn, error), error) {
-	backendNet, backendAddr, _, err := socket.ParseAddress(*serverForwardAddress)
+// startExpiryMonitor starts checking expiry of our certificate and the CA
+// bundles used to verify peers.
+func (context *Context) startExpiryMonitor() {
+	caBundles := append([]string{*caBundlePath, *serverClientCA, *serverTargetCA}, *caBundleExtra...)
+	context.expiry = newExpiryMonitor(currentCertificate(context.tlsConfigSource), caBundles, *expiryWarning)
+	context.status.expiry = context.expiry
+	go context.expiry.run(expiryCheckInterval)
+}
+
+// startTargetProber starts checking if the target can be reached in the
+// background, if enabled (and if there's a fixed target to check).
+func (context *Context) startTargetProber() {
+	if *probeInterval == 0 || context.dial == nil {
+		return
+	}
+	context.status.prober = newTargetProber(context.dial, *probeTimeout)
+	context.status.prober.start(*probeInterval)
+}
+
+// serverHTTPMode returns true if requests on connections should be parsed
+// as HTTP (--http, or implied by --identity-headers).
+func serverHTTPMode() bool {
+	return *serverHTTP || *serverIdentityHeader
+}
+
+// hasStatusAccessFlags returns true if client certificates are required on
+// the status port.
+func hasStatusAccessFlags() bool {
+	return len(*statusAllowedCNs) > 0 || len(*statusAllowedOUs) > 0 || len(*statusAllowedDNSs) > 0 || len(*statusAllowedURIs) > 0
+}
+
+// statusACL builds the ACL for clients of the status port.
+func statusACL() (*auth.ACL, error) {
+	allowedURIs, err := wildcard.CompileList(*statusAllowedURIs)
 	if err != nil {
+		logger.Printf("invalid URI pattern in --status-allow-uri flag (%s)", err)
 		return nil, err
 	}
+	allowedCNs, allowedCNPatterns, err := auth.SplitPatterns(*statusAllowedCNs, '.')
+	if err != nil {
+		logger.Printf("invalid CN pattern in --status-allow-cn flag (%s)", err)
+		return nil, err
+	}
+	allowedDNSs, allowedDNSPatterns, err := auth.SplitPatternsFold(*statusAllowedDNSs, '.')
+	if err != nil {
+		logger.Printf("invalid DNS pattern in --status-allow-dns flag (%s)", err)
+		return nil, err
+	}
+	return &auth.ACL{
+		AllowedCNs:         allowedCNs,
+		AllowedCNPatterns:  allowedCNPatterns,
+		AllowedOUs:         *statusAllowedOUs,
+		AllowedDNSs:        allowedDNSs,
+		AllowedDNSPatterns: allowedDNSPatterns,
+		AllowedURIs:        allowedURIs,
+		Logger:             logger,
+	}, nil
+}
+
+// serverTargets returns the list of addresses given in --target (exec:
+// targets aren't split, commands may contain commas).
+func serverTargets() []string {
+	if isExecTarget(*serverForwardAddress) {
+		return []string{*serverForwardAddress}
+	}
+	return splitTargets(*serverForwardAddress)
+}
 
+// splitTargets splits a comma-separated list of target addresses.
+func splitTargets(value string) []string {
+	targets := []string{}
+	for _, target := range strings.Split(value, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// Get backend dialer function in server mode (connecting to a unix socket or
+// tcp port). If multiple targets (or backup targets, or health checks) are
+// given, connections are balanced across (healthy) targets.
+//
+// If targetTLS is set, connections to targets use TLS. If targetTrust is set,
+// tls health checks verify the certificate of targets against it.
+func serverBackendDialer(targetTrust certloader.Certificate, targetTLS *targetTLS) (func() (net.Conn, error), error) {
+	if isExecTarget(*serverForwardAddress) {
+		// Commands are run per connection, see execDialer
+		return nil, nil
+	}
+	targets := serverTargets()
+	backups := splitTargets(*serverTargetBackup)
+	healthCheck := *serverHealthCheck != "" && *serverHealthCheck != "off"
+	if len(targets) == 1 && len(backups) == 0 && !healthCheck && !isSRVAddress(targets[0]) {
+		dial, err := backendDialer(targets[0])
+		if err != nil {
+			return nil, err
+		}
+		return targetTLS.wrap(targets[0], dial), nil
+	}
+
+	static := []*proxy.Backend{}
+	srvTargets := []*srvTarget{}
+	for i, target := range append(targets, backups...) {
+		if isSRVAddress(target) {
+			srv := &srvTarget{name: target[4:], backup: i >= len(targets), tls: targetTLS}
+			if _, err := srv.resolve(); err != nil {
+				return nil, err
+			}
+			srvTargets = append(srvTargets, srv)
+			continue
+		}
+		dial, err := backendDialer(target)
+		if err != nil {
+			return nil, err
+		}
+		backend := proxy.NewBackend(target, targetTLS.wrap(target, dial))
+		backend.Backup = i >= len(targets)
+		static = append(static, backend)
+	}
+	backends := func() []*proxy.Backend {
+		all := append([]*proxy.Backend{}, static...)
+		for _, srv := range srvTargets {
+			all = append(all, srv.Backends()...)
+		}
+		return all
+	}
+
+	balancer, err := proxy.NewBalancer(backends(), *serverTargetBalance)
+	if err != nil {
+		return nil, err
+	}
+	for _, srv := range srvTargets {
+		go srv.refresh(func() { balancer.SetBackends(backends()) })
+	}
+	if healthCheck {
+		mode := *serverHealthCheck
+		if targetTLS != nil && mode == "tls" {
+			// Dialing targets already completes a handshake
+			mode = "tcp"
+		}
+		balancer.CheckHealth(targetHealthCheck(mode, *serverHealthPath, *timeoutDuration, targetTrust), *serverHealthInterval, logger)
+	}
+	return balancer.Dial, nil
+}
+
+// Get dialer function for the given backend address (unix socket or tcp port)
+func backendDialer(address string) (func() (net.Conn, error), error) {
+	backendNet, backendAddr, _, err := socket.ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if backendNet == "tcp" || backendNet == "udp" {
+		return hostDialer(backendNet, backendAddr), nil
+	}
 	return func() (net.Conn, error) {
-		return net.DialTimeout(backendNet, backendAddr, *timeoutDuration)
+		return socket.Dial(backendNet, backendAddr, *timeoutDuration)
 	}, nil
 }
 
 // Get backend dialer function in client mode (connecting to a TLS port)
-func clientBackendDialer(tlsConfigSource certloader.TLSConfigSource, network, address, host string) (func() (net.Conn, error), error) {
+func clientBackendDialer(tlsConfigSource certloader.TLSConfigSource, verifiers targetVerifiers, network, address, host string) (func() (net.Conn, error), error) {
+	d, err := clientTLSDialer(tlsConfigSource, verifiers, network, address, host)
+	if err != nil {
+		return nil, err
+	}
+	dial := func() (net.Conn, error) { return d.Dial(network, address) }
+	if *clientMultiplex > 0 {
+		logger.Printf("multiplexing connections over up to %d connections to target", *clientMultiplex)
+		return mux.NewPool(*clientMultiplex, dial).Dial, nil
+	}
+	if *clientTransport == "h2" {
+		logger.Printf("tunneling connections as HTTP/2 streams to target")
+		return transport.NewHTTP2Dialer(address, dial).Dial, nil
+	}
+	if *clientTransport == "websocket" {
+		logger.Printf("tunneling connections as WebSockets to target")
+		return webSocketDialer(dial, address), nil
+	}
+	if *clientTransport == "quic" {
+		logger.Printf("tunneling connections as QUIC streams to target")
+	}
+	return dial, nil
+}
+
+// Wrap connections from dial in WebSockets, with the Host header set to the
+// target address unless overridden.
+func webSocketDialer(dial func() (net.Conn, error), address string) func() (net.Conn, error) {
+	host := *clientWebSocketHost
+	if host == "" {
+		host = address
+	}
+	return func() (net.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		tunnel, err := transport.DialWebSocket(conn, host, *clientWebSocketPath)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tunnel, nil
+	}
+}
+
+// targetVerifiers holds files loaded for authenticating targets in client
+// mode (nil if not used), reloaded with the keystore.
+type targetVerifiers struct {
+	ctLogs   *certloader.CTLogList
+	peerKeys *auth.PeerKeys
+	psks     *certloader.PSKFile
+}
+
+// Get TLS (or DTLS) dialer in client mode. If address is empty (with --target
+// original-dst), no proxy from the environment is used, and the server name is
+// taken from each dialed address unless overridden.
+func clientTLSDialer(tlsConfigSource certloader.TLSConfigSource, verifiers targetVerifiers, network, address, host string) (certloader.Dialer, error) {
 	config, err := buildClientConfig(*enabledCipherSuites)
 	if err != nil {
 		return nil, err
@@ -682,22 +2176,104 @@ func clientBackendDialer(tlsConfigSource certloader.TLSConfigSource, network, ad
 		logger.Printf("invalid URI pattern in --verify-uri flag (%s)", err)
 		return nil, err
 	}
+	allowedCNs, allowedCNPatterns, err := auth.SplitPatterns(*clientAllowedCNs, '.')
+	if err != nil {
+		logger.Printf("invalid CN pattern in --verify-cn flag (%s)", err)
+		return nil, err
+	}
+	allowedDNSs, allowedDNSPatterns, err := auth.SplitPatternsFold(*clientAllowedDNSs, '.')
+	if err != nil {
+		logger.Printf("invalid DNS pattern in --verify-dns flag (%s)", err)
+		return nil, err
+	}
 
 	clientACL := auth.ACL{
-		AllowedCNs:  *clientAllowedCNs,
-		AllowedOUs:  *clientAllowedOUs,
-		AllowedDNSs: *clientAllowedDNSs,
-		AllowedIPs:  *clientAllowedIPs,
-		AllowedURIs: allowedURIs,
-		Logger:      logger,
+		AllowedCNs:         allowedCNs,
+		AllowedCNPatterns:  allowedCNPatterns,
+		AllowedOUs:         *clientAllowedOUs,
+		AllowedDNSs:        allowedDNSs,
+		AllowedDNSPatterns: allowedDNSPatterns,
+		AllowedIPs:         *clientAllowedIPs,
+		AllowedURIs:        allowedURIs,
+		Logger:             logger,
+	}
+
+	pins, err := auth.ParseSPKIPins(*clientSPKIPins)
+	if err != nil {
+		logger.Printf("invalid --verify-spki-pin flag (%s)", err)
+		return nil, err
 	}
 
 	config.VerifyPeerCertificate = clientACL.VerifyPeerCertificateClient
+	if policy := chainPolicy(); policy != nil {
+		config.VerifyPeerCertificate = chainVerifyPeerCertificate(policy.VerifyPeerCertificate, config.VerifyPeerCertificate)
+	}
+	if len(pins) > 0 {
+		config.VerifyPeerCertificate = chainVerifyPeerCertificate(config.VerifyPeerCertificate, pins.VerifyPeerCertificate)
+	}
+	if *clientSPKIPinOnly {
+		// Pins replace CA and server name verification
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = pins.VerifyPeerCertificateLeaf
+	}
+	if verifiers.peerKeys != nil {
+		// Chains aren't verified, servers are authenticated by their key
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifiers.peerKeys.VerifyPeerCertificate
+	}
+	if *clientMultiplex > 0 {
+		config.NextProtos = []string{mux.Protocol}
+	}
+	if *clientTransport == "h2" {
+		config.NextProtos = []string{transport.HTTP2Protocol}
+	}
+	if *clientTransport == "websocket" {
+		config.NextProtos = []string{transport.WebSocketProtocol}
+	}
+	if *clientTransport == "quic" {
+		config.NextProtos = []string{transport.QUICProtocol}
+	}
 
-	var dialer Dialer = &net.Dialer{Timeout: *timeoutDuration}
+	if verifiers.ctLogs != nil {
+		if network == "udp" {
+			err := errors.New("--verify-sct is not supported for UDP targets")
+			logger.Printf("error: %s", err)
+			return nil, err
+		}
+		config.VerifyConnection = verifiers.ctLogs.VerifyConnection
+	}
 
-	if *clientConnectProxy != nil {
-		logger.Printf("using HTTP(S) CONNECT proxy %s", (*clientConnectProxy).String())
+	if network == "udp" && verifiers.psks != nil {
+		psks := verifiers.psks
+		return certloader.DTLSDialerWithPSK(*clientPSKIdentity, func(identity []byte) ([]byte, error) {
+			return psks.Key(string(identity))
+		}, keyLog, *timeoutDuration), nil
+	}
+
+	if network == "udp" {
+		clientConfig := mustGetClientConfig(tlsConfigSource, config)
+		return certloader.DTLSDialerWithCertificate(clientConfig, *timeoutDuration), nil
+	}
+
+	if *clientTransport == "quic" {
+		clientConfig := mustGetClientConfig(tlsConfigSource, config)
+		return transport.NewQUICDialer(clientConfig.GetClientConfig, *timeoutDuration), nil
+	}
+
+	var dialer Dialer = socket.NewDialer(*timeoutDuration)
+
+	connectProxy := *clientConnectProxy
+	if *clientProxyFromEnv && address != "" {
+		// Honor HTTPS_PROXY/NO_PROXY environment variables, only if asked to.
+		connectProxy, err = connectProxyFromEnvironment(address)
+		if err != nil {
+			logger.Printf("error: invalid proxy in environment: %s\n", err)
+			return nil, err
+		}
+	}
+
+	if connectProxy != nil {
+		logger.Printf("using HTTP(S) CONNECT proxy %s", redactURL(connectProxy))
 
 		// Use HTTP CONNECT proxy to connect to target.
 		proxyConfig, err := buildClientConfig(*enabledCipherSuites)
@@ -707,22 +2283,69 @@ func clientBackendDialer(tlsConfigSource certloader.TLSConfigSource, network, ad
 		config.ClientAuth = tls.NoClientCert
 
 		// Read CA bundle for passing to proxy library
-		ca, err := certloader.LoadTrustStore(*caBundlePath)
+		ca, err := certloader.LoadTrustStore(withSystemTrust(*caBundlePath))
 		if err != nil {
 			logger.Printf("error: unable to build TLS config: %s\n", err)
 			return nil, err
 		}
 		config.RootCAs = ca
 
+		// Use basic auth if credentials are given in the proxy URL.
+		var auth http_dialer.ProxyAuthorization
+		if connectProxy.User != nil {
+			password, _ := connectProxy.User.Password()
+			auth = http_dialer.AuthBasic(connectProxy.User.Username(), password)
+		}
+
 		dialer = http_dialer.New(
-			*clientConnectProxy,
+			connectProxy,
 			http_dialer.WithDialer(dialer.(*net.Dialer)),
-			http_dialer.WithTls(proxyConfig))
+			http_dialer.WithTls(proxyConfig),
+			http_dialer.WithProxyAuth(auth))
+	}
+
+	if *clientSocks5Proxy != "" {
+		logger.Printf("using SOCKS5 proxy %s", *clientSocks5Proxy)
+
+		var auth *netproxy.Auth
+		if *clientSocks5User != "" || *clientSocks5Pass != "" {
+			auth = &netproxy.Auth{User: *clientSocks5User, Password: *clientSocks5Pass}
+		}
+
+		// Use SOCKS5 proxy to connect to target.
+		dialer, err = netproxy.SOCKS5("tcp", *clientSocks5Proxy, auth, dialer.(*net.Dialer))
+		if err != nil {
+			logger.Printf("error: unable to build SOCKS5 dialer: %s\n", err)
+			return nil, err
+		}
 	}
 
 	clientConfig := mustGetClientConfig(tlsConfigSource, config)
-	d := certloader.DialerWithCertificate(clientConfig, *timeoutDuration, dialer)
-	return func() (net.Conn, error) { return d.Dial(network, address) }, nil
+	return certloader.DialerWithCertificate(clientConfig, *timeoutDuration, socket.WrapDialer(dialer)), nil
+}
+
+// connectProxyFromEnvironment returns the HTTP(S) CONNECT proxy to use for the
+// given target address based on the HTTPS_PROXY and NO_PROXY environment
+// variables, or nil if no proxy should be used.
+func connectProxyFromEnvironment(address string) (*url.URL, error) {
+	proxyURL, err := httpproxy.FromEnvironment().ProxyFunc()(&url.URL{Scheme: "https", Host: address})
+	if err != nil || proxyURL == nil {
+		return nil, err
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid CONNECT proxy %s, must have HTTP or HTTPS connection scheme", redactURL(proxyURL))
+	}
+	return proxyURL, nil
+}
+
+// redactURL formats a URL for logging, hiding the password (if any).
+func redactURL(u *url.URL) string {
+	if _, ok := u.User.Password(); !ok {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return redacted.String()
 }
 
 func proxyLoggerFlags(flags []string) int {
@@ -756,14 +2379,75 @@ func getTLSConfigSource() (certloader.TLSConfigSource, error) {
 		return source, nil
 	}
 
-	cert, err := buildCertificate(*keystorePath, *certPath, *keyPath, *keystorePass, *caBundlePath)
+	if len(*serverACMEDomains) > 0 {
+		source, err := certloader.TLSConfigSourceFromACME(certloader.ACMEConfig{
+			Domains:      *serverACMEDomains,
+			DirectoryURL: *serverACMEDirectory,
+			Email:        *serverACMEEmail,
+			CacheDir:     *serverACMECacheDir,
+		}, clientCABundlePath())
+		if err != nil {
+			logger.Printf("error: unable to create ACME TLS source: %s\n", err)
+			return nil, err
+		}
+		return source, nil
+	}
+
+	cert, err := buildCertificate(*keystorePath, *certPath, *keyPath, *keystorePass, clientCABundlePath())
 	if err != nil {
 		logger.Printf("error: unable to load certificates: %s\n", err)
 		return nil, err
 	}
+	var ocspClient *http.Client
+	if *serverOCSPStapling {
+		ocspClient = &http.Client{
+			Timeout:   *timeoutDuration,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		}
+		cert = certloader.CertificateWithOCSPStapling(cert, ocspClient, logger)
+	}
+	cert, err = withSNICertificates(cert, ocspClient)
+	if err != nil {
+		logger.Printf("error: %s\n", err)
+		return nil, err
+	}
+	cert, err = withFallbackCertificates(cert)
+	if err != nil {
+		logger.Printf("error: %s\n", err)
+		return nil, err
+	}
 	return certloader.TLSConfigSourceFromCertificate(cert), nil
 }
 
+// clientCABundlePath returns the CA bundles to load with our certificates,
+// used for verifying peers, as a single path (see peerCABundles).
+func clientCABundlePath() string {
+	return withSystemTrust(certloader.JoinCABundlePaths(peerCABundles()...))
+}
+
+// withSystemTrust adds the system trust store to the given CA bundle path
+// with --system-trust=include. An empty path already means the system trust
+// store.
+func withSystemTrust(path string) string {
+	if *systemTrust == "include" && path != "" {
+		return certloader.JoinCABundlePaths(certloader.SystemCABundle, path)
+	}
+	return path
+}
+
+// peerCABundles returns the CA bundles for verifying peers: --cacert-client
+// in server mode (if set), otherwise --cacert, plus any --cacert-extra
+// bundles. Empty if peers are verified with the system trust store.
+func peerCABundles() []string {
+	paths := []string{}
+	if *serverClientCA != "" {
+		paths = append(paths, *serverClientCA)
+	} else if *caBundlePath != "" {
+		paths = append(paths, *caBundlePath)
+	}
+	return append(paths, *caBundleExtra...)
+}
+
 func mustGetServerConfig(source certloader.TLSConfigSource, config *tls.Config) certloader.TLSServerConfig {
 	serverConfig, err := source.GetServerConfig(config)
 	if err != nil {
@@ -0,0 +1,64 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/square/ghostunnel/proxy"
+)
+
+// Prefix for --mirror-target to write mirrored data to a pcap file instead
+// of a connection.
+const pcapMirrorPrefix = "pcap:"
+
+// Values for --mirror-direction.
+var mirrorDirections = map[string]int{
+	"both":   proxy.MirrorBoth,
+	"client": proxy.MirrorFromClient,
+	"target": proxy.MirrorFromTarget,
+}
+
+// newMirror sets up the mirror for --mirror-target (nil if not set). The pcap
+// file is created readable only by the current user, since it contains
+// decrypted traffic.
+func newMirror() (*proxy.Mirror, error) {
+	if *mirrorTarget == "" {
+		return nil, nil
+	}
+	directions := mirrorDirections[*mirrorDirection]
+
+	if strings.HasPrefix(*mirrorTarget, pcapMirrorPrefix) {
+		file, err := os.OpenFile(strings.TrimPrefix(*mirrorTarget, pcapMirrorPrefix), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+		mirror, err := proxy.NewPcapMirror(file, directions)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return mirror, nil
+	}
+
+	dial, err := backendDialer(*mirrorTarget)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.NewMirrorDialer(dial, directions), nil
+}
@@ -0,0 +1,55 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMirror(t *testing.T) {
+	defer func() { *mirrorTarget = "" }()
+
+	mirror, err := newMirror()
+	assert.Nil(t, err, "should not fail without --mirror-target")
+	assert.Nil(t, mirror, "should not mirror without --mirror-target")
+
+	*mirrorTarget = "localhost:9000"
+	mirror, err = newMirror()
+	assert.Nil(t, err, "should accept mirror address")
+	assert.NotNil(t, mirror)
+
+	*mirrorTarget = "invalid:address:"
+	_, err = newMirror()
+	assert.NotNil(t, err, "should reject invalid mirror address")
+
+	path := filepath.Join(t.TempDir(), "mirror.pcap")
+	*mirrorTarget = "pcap:" + path
+	mirror, err = newMirror()
+	assert.Nil(t, err, "should create pcap file")
+	mirror.Close()
+	info, err := os.Stat(path)
+	assert.Nil(t, err, "should create pcap file")
+	assert.Equal(t, int64(24), info.Size(), "should write pcap header")
+
+	*mirrorTarget = "pcap:" + filepath.Join(t.TempDir(), "missing", "mirror.pcap")
+	_, err = newMirror()
+	assert.NotNil(t, err, "should fail if pcap file can't be created")
+}
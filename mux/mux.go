@@ -0,0 +1,83 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mux implements a minimal stream multiplexing protocol, for carrying
+// many proxied connections over a single (TLS) connection between ghostunnel
+// in client and server mode.
+//
+// The protocol is negotiated with ALPN (see Protocol). Each frame has an
+// 8-byte header: type (1 byte), reserved (1 byte), payload length (2 bytes)
+// and stream ID (4 bytes), in network byte order, followed by the payload.
+// Streams are opened by the client, and flow controlled with a fixed receive
+// window per stream, which is extended with window frames as data is read.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Protocol is the ALPN protocol name for multiplexed connections.
+const Protocol = "ghostunnel-mux/1"
+
+const (
+	// Opens a new stream (client to server), without payload.
+	frameOpen = 0
+	// Data on a stream.
+	frameData = 1
+	// Extends the send window of a stream by the 4-byte payload.
+	frameWindow = 2
+	// Closes a stream. Each side sends it once, after which it won't send
+	// data on the stream and ignores data received for it.
+	frameClose = 3
+	// Tells the client not to open new streams on the connection (stream
+	// ID is zero), e.g. on shutdown.
+	frameGoAway = 4
+)
+
+const (
+	headerSize = 8
+	// Maximum payload of a data frame
+	maxPayload = 16 * 1024
+	// Receive window of each stream
+	initialWindow = 256 * 1024
+	// Maximum number of opened streams waiting to be accepted
+	acceptBacklog = 256
+)
+
+var (
+	errGoAway        = errors.New("multiplexed connection is shutting down")
+	errSessionClosed = errors.New("multiplexed connection closed")
+	errStreamClosed  = errors.New("stream closed by peer")
+	errProtocol      = errors.New("multiplexing protocol error")
+)
+
+func encodeHeader(buf []byte, frameType byte, length int, id uint32) {
+	buf[0] = frameType
+	buf[1] = 0
+	binary.BigEndian.PutUint16(buf[2:], uint16(length))
+	binary.BigEndian.PutUint32(buf[4:], id)
+}
+
+func decodeHeader(buf []byte) (frameType byte, length int, id uint32) {
+	return buf[0], int(binary.BigEndian.Uint16(buf[2:])), binary.BigEndian.Uint32(buf[4:])
+}
+
+// opError wraps errors on streams like errors on regular connections.
+func opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "mux", Err: err}
+}
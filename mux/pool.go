@@ -0,0 +1,99 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+)
+
+var errNotNegotiated = errors.New("server doesn't support multiplexing (needs --multiplex in server mode)")
+
+// Pool opens streams over a pool of persistent sessions. Sessions are
+// established lazily, up to the pool size, and replaced once they are closed
+// or the server asks us to go away.
+type Pool struct {
+	size int
+	dial func() (net.Conn, error)
+
+	mu       sync.Mutex
+	sessions []*Session
+}
+
+// NewPool creates a pool of up to size sessions, established over
+// connections from the given dial function. If connections are TLS, they
+// must have negotiated Protocol with ALPN.
+func NewPool(size int, dial func() (net.Conn, error)) *Pool {
+	return &Pool{size: size, dial: dial}
+}
+
+// Dial opens a new stream, on the session with the fewest open streams. New
+// sessions are established as long as all sessions are in use and the pool
+// isn't full yet.
+func (p *Pool) Dial() (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *Session
+	usable := p.sessions[:0]
+	for _, session := range p.sessions {
+		if !session.Usable() {
+			continue
+		}
+		usable = append(usable, session)
+		if best == nil || session.NumStreams() < best.NumStreams() {
+			best = session
+		}
+	}
+	p.sessions = usable
+
+	if best == nil || (best.NumStreams() > 0 && len(p.sessions) < p.size) {
+		session, err := p.connect()
+		if err != nil && best == nil {
+			return nil, err
+		}
+		if err == nil {
+			p.sessions = append(p.sessions, session)
+			best = session
+		}
+	}
+	return best.Open()
+}
+
+func (p *Pool) connect() (*Session, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok && tlsConn.ConnectionState().NegotiatedProtocol != Protocol {
+		conn.Close()
+		return nil, errNotNegotiated
+	}
+	return Client(conn), nil
+}
+
+// Close closes all sessions in the pool.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, session := range p.sessions {
+		session.Close()
+	}
+	p.sessions = nil
+}
@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	var servers []*Session
+	pool := NewPool(2, func() (net.Conn, error) {
+		client, server := net.Pipe()
+		session := Server(server)
+		go echo(session)
+		servers = append(servers, session)
+		return client, nil
+	})
+	defer pool.Close()
+
+	first, err := pool.Dial()
+	assert.Nil(t, err, "should open stream")
+	assert.Len(t, servers, 1, "should establish first session")
+
+	second, err := pool.Dial()
+	assert.Nil(t, err, "should open stream")
+	assert.Len(t, servers, 2, "should establish second session while first is in use")
+
+	third, err := pool.Dial()
+	assert.Nil(t, err, "should open stream")
+	assert.Len(t, servers, 2, "should not establish more sessions than pool size")
+
+	for _, stream := range []net.Conn{first, second, third} {
+		_, err := stream.Write([]byte("ping"))
+		assert.Nil(t, err, "should write to stream")
+		buf := make([]byte, 4)
+		_, err = stream.Read(buf)
+		assert.Nil(t, err, "should read from stream")
+		assert.Equal(t, "ping", string(buf))
+		stream.Close()
+	}
+
+	// Sessions are replaced once the server goes away
+	servers[0].GoAway()
+	servers[1].Close()
+	assert.Eventually(t, func() bool {
+		stream, err := pool.Dial()
+		if err != nil {
+			return false
+		}
+		stream.Close()
+		return len(servers) == 3
+	}, time.Second, 10*time.Millisecond, "should establish new session")
+}
+
+func TestPoolDialError(t *testing.T) {
+	pool := NewPool(1, func() (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	})
+	_, err := pool.Dial()
+	assert.NotNil(t, err, "should fail if no session can be established")
+}
+
+func TestPoolNotNegotiated(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	pool := NewPool(1, func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go io.Copy(ioutil.Discard, tls.Server(server, serverConfig))
+		conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{Protocol}})
+		return conn, conn.Handshake()
+	})
+	_, err := pool.Dial()
+	assert.Equal(t, errNotNegotiated, err, "should fail if server didn't negotiate multiplexing")
+}
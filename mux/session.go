@@ -0,0 +1,298 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// Session is a multiplexed connection, carrying streams.
+type Session struct {
+	conn   net.Conn
+	client bool
+
+	// Serializes writes of frames to conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	// Set once we sent (server) or received (client) a go away frame
+	goAway bool
+	err    error
+
+	accept     chan *Stream
+	goAwayCh   chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+	goAwayOnce sync.Once
+}
+
+// Client starts a session on the given connection, for opening streams.
+func Client(conn net.Conn) *Session {
+	return newSession(conn, true)
+}
+
+// Server starts a session on the given connection, for accepting streams.
+func Server(conn net.Conn) *Session {
+	return newSession(conn, false)
+}
+
+func newSession(conn net.Conn, client bool) *Session {
+	s := &Session{
+		conn:     conn,
+		client:   client,
+		streams:  map[uint32]*Stream{},
+		nextID:   1,
+		accept:   make(chan *Stream, acceptBacklog),
+		goAwayCh: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// Open opens a new stream (client only). Opening doesn't wait for the server,
+// if it can't handle the stream, it's closed right away.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	if s.goAway {
+		s.mu.Unlock()
+		return nil, errGoAway
+	}
+	stream := newStream(s, s.nextID)
+	s.streams[stream.id] = stream
+	s.nextID++
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, stream.id, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the next stream opened by the client (server only). After
+// GoAway, streams opened before are still returned, then Accept fails.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	default:
+	}
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.goAwayCh:
+		select {
+		case stream := <-s.accept:
+			return stream, nil
+		default:
+			return nil, errGoAway
+		}
+	case <-s.done:
+		return nil, s.closeErr()
+	}
+}
+
+// GoAway tells the client not to open new streams (server only). Open
+// streams are not affected.
+func (s *Session) GoAway() {
+	s.goAwayOnce.Do(func() {
+		s.mu.Lock()
+		s.goAway = true
+		s.mu.Unlock()
+		close(s.goAwayCh)
+		s.writeFrame(frameGoAway, 0, nil)
+	})
+}
+
+// Usable returns false once the session is closed, or the server asked us to
+// stop opening new streams.
+func (s *Session) Usable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err == nil && !s.goAway
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Done is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close closes the session and the underlying connection. Open streams fail.
+func (s *Session) Close() error {
+	s.closeWithError(errSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) writeFrame(frameType byte, id uint32, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	encodeHeader(buf, frameType, len(payload), id)
+	copy(buf[headerSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.done:
+		return s.closeErr()
+	default:
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	drained := s.client && s.goAway && len(s.streams) == 0
+	s.mu.Unlock()
+
+	// Nothing left to do on a connection the server is shutting down
+	if drained {
+		s.Close()
+	}
+}
+
+func (s *Session) readLoop() {
+	header := make([]byte, headerSize)
+	payload := make([]byte, maxPayload)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		frameType, length, id := decodeHeader(header)
+		if length > maxPayload {
+			s.closeWithError(errProtocol)
+			return
+		}
+		if _, err := io.ReadFull(s.conn, payload[:length]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if err := s.handleFrame(frameType, id, payload[:length]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(frameType byte, id uint32, payload []byte) error {
+	switch frameType {
+	case frameOpen:
+		if s.client {
+			return errProtocol
+		}
+		return s.handleOpen(id)
+	case frameGoAway:
+		if !s.client {
+			return errProtocol
+		}
+		s.mu.Lock()
+		s.goAway = true
+		drained := len(s.streams) == 0
+		s.mu.Unlock()
+		if drained {
+			s.Close()
+		}
+		return nil
+	}
+
+	s.mu.Lock()
+	stream := s.streams[id]
+	s.mu.Unlock()
+	if stream == nil {
+		// Stream was closed on our side already
+		return nil
+	}
+
+	switch frameType {
+	case frameData:
+		return stream.receive(payload)
+	case frameWindow:
+		if len(payload) != 4 {
+			return errProtocol
+		}
+		stream.extendWindow(binary.BigEndian.Uint32(payload))
+	case frameClose:
+		stream.remoteClose()
+	default:
+		return errProtocol
+	}
+	return nil
+}
+
+func (s *Session) handleOpen(id uint32) error {
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		return errProtocol
+	}
+	if s.goAway {
+		s.mu.Unlock()
+		// Written asynchronously, so we keep reading while the peer writes
+		go s.writeFrame(frameClose, id, nil)
+		return nil
+	}
+	stream := newStream(s, id)
+	s.streams[id] = stream
+
+	// Queued under the lock, so streams are either queued before GoAway, or
+	// rejected after it.
+	select {
+	case s.accept <- stream:
+		s.mu.Unlock()
+	default:
+		// Too many streams waiting to be accepted
+		s.mu.Unlock()
+		go stream.Close()
+	}
+	return nil
+}
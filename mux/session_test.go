@@ -0,0 +1,175 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSessions(t *testing.T) (*Session, *Session) {
+	clientConn, serverConn := net.Pipe()
+	return Client(clientConn), Server(serverConn)
+}
+
+// echo accepts streams and echoes data back until the stream is closed.
+func echo(server *Session) {
+	for {
+		stream, err := server.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			io.Copy(stream, stream)
+		}()
+	}
+}
+
+func TestStreams(t *testing.T) {
+	client, server := newTestSessions(t)
+	defer client.Close()
+	defer server.Close()
+	go echo(server)
+
+	// Several streams in parallel, each with more data than fits in the window
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.Open()
+			assert.Nil(t, err, "should open stream")
+
+			data := make([]byte, 3*initialWindow+123)
+			rand.Read(data)
+			go func() {
+				stream.Write(data)
+			}()
+			received := make([]byte, len(data))
+			_, err = io.ReadFull(stream, received)
+			assert.Nil(t, err, "should read echoed data")
+			assert.True(t, bytes.Equal(data, received), "should echo data")
+			stream.Close()
+		}()
+	}
+	wg.Wait()
+
+	assert.Eventually(t, func() bool { return client.NumStreams() == 0 && server.NumStreams() == 0 }, time.Second, 10*time.Millisecond, "should clean up closed streams")
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := newTestSessions(t)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+	_, err = stream.Write([]byte("hello"))
+	assert.Nil(t, err, "should write to stream")
+	stream.Close()
+
+	accepted, err := server.Accept()
+	assert.Nil(t, err, "should accept stream")
+	data, err := ioutil.ReadAll(accepted)
+	assert.Nil(t, err, "should read until peer closed stream")
+	assert.Equal(t, "hello", string(data))
+
+	_, err = accepted.Write([]byte("bye"))
+	assert.NotNil(t, err, "should not write to stream closed by peer")
+	accepted.Close()
+
+	_, err = stream.Read(make([]byte, 1))
+	assert.NotNil(t, err, "should not read from closed stream")
+}
+
+func TestStreamDeadline(t *testing.T) {
+	client, server := newTestSessions(t)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+
+	stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = stream.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "should time out reading")
+
+	stream.SetReadDeadline(time.Time{})
+	accepted, err := server.Accept()
+	assert.Nil(t, err, "should accept stream")
+	accepted.Write([]byte("x"))
+	_, err = stream.Read(make([]byte, 1))
+	assert.Nil(t, err, "should read after clearing deadline")
+}
+
+func TestGoAway(t *testing.T) {
+	client, server := newTestSessions(t)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+	accepted, err := server.Accept()
+	assert.Nil(t, err, "should accept stream")
+
+	server.GoAway()
+	_, err = server.Accept()
+	assert.Equal(t, errGoAway, err, "should stop accepting streams")
+	assert.Eventually(t, func() bool { return !client.Usable() }, time.Second, 10*time.Millisecond, "client should get go away")
+	_, err = client.Open()
+	assert.NotNil(t, err, "should not open streams after go away")
+
+	// Existing streams keep working
+	go accepted.Write([]byte("still here"))
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(stream, buf)
+	assert.Nil(t, err, "should read from existing stream")
+	assert.Equal(t, "still here", string(buf))
+
+	// Client closes the session once the last stream is done
+	stream.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Error("client session should be closed after last stream")
+	}
+}
+
+func TestSessionClosed(t *testing.T) {
+	client, server := newTestSessions(t)
+	defer client.Close()
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+	server.Close()
+
+	_, err = stream.Read(make([]byte, 1))
+	assert.NotNil(t, err, "should fail reading once session is closed")
+	<-client.Done()
+	_, err = client.Open()
+	assert.NotNil(t, err, "should not open streams on closed session")
+}
@@ -0,0 +1,271 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a connection multiplexed over a session. Streams over TLS
+// sessions expose the connection state of the session, like a *tls.Conn.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	// Bytes the peer may still send us, and bytes read since we last
+	// extended the window
+	recvWindow uint32
+	consumed   uint32
+	// Bytes we may still send
+	sendWindow    uint32
+	localClosed   bool
+	remoteClosed  bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// Signaled when there's something new to read, or more send window
+	// (and when deadlines change)
+	readReady  chan struct{}
+	writeReady chan struct{}
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is signaled, the deadline expires or the session is
+// closed.
+func (s *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-s.session.done:
+		return s.session.closeErr()
+	}
+}
+
+// Read reads data from the stream. Returns io.EOF once the peer closed the
+// stream and all data has been read.
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.localClosed {
+			s.mu.Unlock()
+			return 0, opError("read", net.ErrClosed)
+		}
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(b)
+			s.consumed += uint32(n)
+			// Extend the window once half of it has been used up
+			var update uint32
+			if s.consumed >= initialWindow/2 && !s.remoteClosed {
+				update = s.consumed
+				s.recvWindow += update
+				s.consumed = 0
+			}
+			s.mu.Unlock()
+			if update > 0 {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, update)
+				s.session.writeFrame(frameWindow, s.id, payload)
+			}
+			return n, nil
+		}
+		if s.remoteClosed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		if err := s.wait(s.readReady, deadline); err != nil {
+			return 0, opError("read", err)
+		}
+	}
+}
+
+// Write writes data to the stream, blocking while the peer's receive window
+// is full.
+func (s *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		s.mu.Lock()
+		if s.localClosed {
+			s.mu.Unlock()
+			return written, opError("write", net.ErrClosed)
+		}
+		if s.remoteClosed {
+			s.mu.Unlock()
+			return written, opError("write", errStreamClosed)
+		}
+		if s.sendWindow == 0 {
+			deadline := s.writeDeadline
+			s.mu.Unlock()
+			if err := s.wait(s.writeReady, deadline); err != nil {
+				return written, opError("write", err)
+			}
+			continue
+		}
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		if uint32(n) > s.sendWindow {
+			n = int(s.sendWindow)
+		}
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		if err := s.session.writeFrame(frameData, s.id, b[:n]); err != nil {
+			return written, opError("write", err)
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the stream. Data received for it afterwards is discarded.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.localClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	s.mu.Unlock()
+	notify(s.readReady)
+	notify(s.writeReady)
+
+	s.session.removeStream(s.id)
+	s.session.writeFrame(frameClose, s.id, nil)
+	return nil
+}
+
+// receive queues data from the peer, called from the session's read loop.
+func (s *Stream) receive(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localClosed || s.remoteClosed {
+		return nil
+	}
+	if uint32(len(data)) > s.recvWindow {
+		return errProtocol
+	}
+	s.recvWindow -= uint32(len(data))
+	s.buf.Write(data)
+	notify(s.readReady)
+	return nil
+}
+
+func (s *Stream) extendWindow(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+	notify(s.writeReady)
+}
+
+func (s *Stream) remoteClose() {
+	s.mu.Lock()
+	s.remoteClosed = true
+	s.mu.Unlock()
+	notify(s.readReady)
+	notify(s.writeReady)
+}
+
+// LocalAddr returns the local address of the session.
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session.
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for reads.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readReady)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writes blocked on the send window.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writeReady)
+	return nil
+}
+
+// Handshake is a no-op, the session is established before streams are opened.
+func (s *Stream) Handshake() error {
+	return nil
+}
+
+// ConnectionState returns the TLS connection state of the session (empty if
+// the session isn't over TLS).
+func (s *Stream) ConnectionState() tls.ConnectionState {
+	if conn, ok := s.session.conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
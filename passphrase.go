@@ -0,0 +1,94 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// resolveKeystorePassword fills in the keystore password from
+// --storepass-file, or by prompting on the terminal with --storepass-prompt.
+// The password is kept in memory and used again whenever certificates are
+// reloaded. After prompting, the password is also put into the environment
+// (KEYSTORE_PASS), so a new process started on upgrade doesn't prompt again.
+func resolveKeystorePassword() error {
+	if *keystorePassFile != "" {
+		data, err := ioutil.ReadFile(*keystorePassFile)
+		if err != nil {
+			return fmt.Errorf("unable to read keystore password: %s", err)
+		}
+		*keystorePass = strings.TrimRight(string(data), "\r\n")
+		return nil
+	}
+
+	if *keystorePassPrompt && *keystorePass == "" {
+		pass, err := promptPassphrase(os.Stdin, os.Stderr)
+		if err != nil {
+			return err
+		}
+		*keystorePass = pass
+		os.Setenv("KEYSTORE_PASS", pass)
+	}
+	return nil
+}
+
+// promptPassphrase reads a passphrase from the terminal, with echo disabled.
+func promptPassphrase(terminal *os.File, out io.Writer) (string, error) {
+	restore, err := disableEcho(terminal.Fd())
+	if err != nil {
+		return "", fmt.Errorf("--storepass-prompt requires a terminal: %s", err)
+	}
+	defer restore()
+	return readConfirmedPassphrase(bufio.NewReader(terminal), out)
+}
+
+// readConfirmedPassphrase reads a passphrase twice, and checks that both
+// entries match.
+func readConfirmedPassphrase(in *bufio.Reader, out io.Writer) (string, error) {
+	pass, err := readPassphrase(in, out, "Keystore password: ")
+	if err != nil {
+		return "", err
+	}
+	if pass == "" {
+		return "", errors.New("empty keystore password")
+	}
+	confirm, err := readPassphrase(in, out, "Confirm keystore password: ")
+	if err != nil {
+		return "", err
+	}
+	if pass != confirm {
+		return "", errors.New("keystore passwords don't match")
+	}
+	return pass, nil
+}
+
+func readPassphrase(in *bufio.Reader, out io.Writer, prompt string) (string, error) {
+	fmt.Fprint(out, prompt)
+	line, err := in.ReadString('\n')
+	// Echo is off, so the newline typed by the user isn't shown
+	fmt.Fprintln(out)
+	if err != nil && !(err == io.EOF && line != "") {
+		return "", fmt.Errorf("unable to read keystore password: %s", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,66 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveKeystorePasswordFromFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "ghostunnel-storepass")
+	assert.Nil(t, err, "should create temp file")
+	defer os.Remove(file.Name())
+	file.WriteString("secret\n")
+	file.Close()
+
+	*keystorePassFile = file.Name()
+	defer func() {
+		*keystorePassFile = ""
+		*keystorePass = ""
+	}()
+	err = resolveKeystorePassword()
+	assert.Nil(t, err, "should read password from file")
+	assert.Equal(t, "secret", *keystorePass, "should strip trailing newline")
+
+	*keystorePassFile = file.Name() + ".missing"
+	err = resolveKeystorePassword()
+	assert.NotNil(t, err, "should fail on missing password file")
+}
+
+func TestReadConfirmedPassphrase(t *testing.T) {
+	var out bytes.Buffer
+	pass, err := readConfirmedPassphrase(bufio.NewReader(strings.NewReader("secret\nsecret\n")), &out)
+	assert.Nil(t, err, "should accept matching passwords")
+	assert.Equal(t, "secret", pass)
+	assert.Contains(t, out.String(), "Confirm keystore password: ")
+
+	_, err = readConfirmedPassphrase(bufio.NewReader(strings.NewReader("secret\nother\n")), &out)
+	assert.NotNil(t, err, "should reject mismatched passwords")
+
+	_, err = readConfirmedPassphrase(bufio.NewReader(strings.NewReader("\n\n")), &out)
+	assert.NotNil(t, err, "should reject empty password")
+
+	_, err = readConfirmedPassphrase(bufio.NewReader(strings.NewReader("secret\n")), &out)
+	assert.NotNil(t, err, "should fail if input ends before confirmation")
+}
@@ -0,0 +1,78 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/square/ghostunnel/socket"
+)
+
+// peerCredListener only accepts connections from UNIX socket peers with one
+// of the allowed user or group IDs (the effective IDs of the connecting
+// process, as recorded by the kernel). Other connections are closed right
+// away.
+type peerCredListener struct {
+	net.Listener
+	uids map[uint32]bool
+	gids map[uint32]bool
+}
+
+// newPeerCredListener wraps a listener to check --allow-uid/--allow-gid.
+// Users and groups can be given by name or numeric ID.
+func newPeerCredListener(listener net.Listener, users, groups []string) (*peerCredListener, error) {
+	l := &peerCredListener{Listener: listener, uids: map[uint32]bool{}, gids: map[uint32]bool{}}
+	for _, name := range users {
+		uid, err := lookupUID(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user '%s' in --allow-uid: %s", name, err)
+		}
+		l.uids[uid] = true
+	}
+	for _, name := range groups {
+		gid, err := lookupGID(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group '%s' in --allow-gid: %s", name, err)
+		}
+		l.gids[gid] = true
+	}
+	return l, nil
+}
+
+// Accept waits for the next connection from an allowed peer.
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		creds, err := socket.GetPeerCredentials(conn)
+		if err != nil {
+			logger.Printf("rejecting connection: unable to get peer credentials: %s", err)
+			conn.Close()
+			continue
+		}
+		if !l.uids[creds.UID] && !l.gids[creds.GID] {
+			logger.Printf("rejecting connection from pid %d: uid %d/gid %d not allowed", creds.PID, creds.UID, creds.GID)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
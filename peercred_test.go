@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerCredListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-peercred")
+	assert.Nil(t, err, "should create temp dir")
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		users, groups []string
+		allowed       bool
+	}{
+		{[]string{strconv.Itoa(os.Getuid())}, nil, true},
+		{nil, []string{strconv.Itoa(os.Getgid())}, true},
+		{[]string{strconv.Itoa(os.Getuid() + 1)}, []string{strconv.Itoa(os.Getgid() + 1)}, false},
+	} {
+		ln, err := net.Listen("unix", filepath.Join(dir, "socket"))
+		assert.Nil(t, err, "should listen")
+		listener, err := newPeerCredListener(ln, test.users, test.groups)
+		assert.Nil(t, err, "should create listener")
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		client, err := net.Dial("unix", ln.Addr().String())
+		assert.Nil(t, err, "should connect")
+		select {
+		case conn := <-accepted:
+			assert.True(t, test.allowed, "should reject peer not in %v/%v", test.users, test.groups)
+			conn.Close()
+		case <-time.After(200 * time.Millisecond):
+			assert.False(t, test.allowed, "should accept peer in %v/%v", test.users, test.groups)
+			// Rejected connections are closed
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := client.Read(make([]byte, 1))
+			assert.NotNil(t, err, "should close rejected connection")
+		}
+		client.Close()
+		listener.Close()
+	}
+}
+
+func TestPeerCredListenerInvalidUser(t *testing.T) {
+	_, err := newPeerCredListener(nil, []string{"no-such-user-ghostunnel"}, nil)
+	assert.NotNil(t, err, "should reject unknown user")
+	_, err = newPeerCredListener(nil, nil, []string{"no-such-group-ghostunnel"})
+	assert.NotNil(t, err, "should reject unknown group")
+
+	l, err := newPeerCredListener(nil, []string{"root"}, nil)
+	assert.Nil(t, err, "should look up user by name")
+	assert.True(t, l.uids[0], "should resolve root to uid 0")
+}
@@ -0,0 +1,28 @@
+//go:build go1.24
+// +build go1.24
+
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import "crypto/tls"
+
+// Hybrid post-quantum key exchanges, see --post-quantum.
+var postQuantumCurves = []tls.CurveID{tls.X25519MLKEM768}
+
+func init() {
+	curveNames["X25519MLKEM768"] = tls.X25519MLKEM768
+}
@@ -0,0 +1,135 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Checks available for probe endpoints
+const (
+	probeListening   = "listening"
+	probeCertificate = "certificate"
+	probeBackend     = "backend"
+)
+
+var probeChecks = []string{probeListening, probeCertificate, probeBackend}
+
+// probeHandler serves Kubernetes-style health endpoints on the status port,
+// which (unlike /_status) tell apart why an instance isn't healthy:
+//
+//	/livez     process is up (always ok while we can serve requests)
+//	/startupz  listening for connections
+//	/readyz    configured checks (--status-ready-check)
+//	/healthz   all checks
+//
+// Endpoints return 200 with "ok" if all checks pass, or 503 with a line for
+// each check otherwise (also returned on success with ?verbose).
+type probeHandler struct {
+	status      *statusHandler
+	certificate func() (*tls.Certificate, error)
+	ready       []string
+}
+
+func (h *probeHandler) register(mux *http.ServeMux) {
+	mux.Handle("/livez", h.serve("livez", nil))
+	mux.Handle("/startupz", h.serve("startupz", []string{probeListening}))
+	mux.Handle("/readyz", h.serve("readyz", h.ready))
+	mux.Handle("/healthz", h.serve("healthz", probeChecks))
+}
+
+func (h *probeHandler) check(name string) error {
+	switch name {
+	case probeListening:
+		h.status.mu.Lock()
+		defer h.status.mu.Unlock()
+		if !h.status.listening {
+			return errors.New("initializing")
+		}
+		return nil
+	case probeCertificate:
+		return h.checkCertificate(time.Now())
+	case probeBackend:
+		_, err := h.status.checkBackend()
+		return err
+	}
+	return fmt.Errorf("unknown check %s", name)
+}
+
+// checkCertificate checks that the current certificate (if any) is valid at
+// the given time.
+func (h *probeHandler) checkCertificate(now time.Time) error {
+	if h.certificate == nil {
+		return nil
+	}
+	cert, err := h.certificate()
+	if err != nil {
+		return err
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (h *probeHandler) serve(endpoint string, checks []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok := true
+		out := &strings.Builder{}
+		for _, name := range checks {
+			if err := h.check(name); err != nil {
+				ok = false
+				fmt.Fprintf(out, "[-]%s failed: %s\n", name, err)
+				continue
+			}
+			fmt.Fprintf(out, "[+]%s ok\n", name)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(out, "%s check failed\n", endpoint)
+			_, _ = w.Write([]byte(out.String()))
+			return
+		}
+		if _, verbose := r.URL.Query()["verbose"]; verbose {
+			fmt.Fprintf(out, "%s check passed\n", endpoint)
+			_, _ = w.Write([]byte(out.String()))
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+}
@@ -0,0 +1,114 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProbeCertificate(t *testing.T, notAfter time.Time) func() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should generate key")
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: notAfter.Add(-24 * time.Hour), NotAfter: notAfter}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should create certificate")
+	return func() (*tls.Certificate, error) {
+		return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+	}
+}
+
+func getProbe(t *testing.T, server *httptest.Server, path string) (int, string) {
+	resp, err := http.Get(server.URL + path)
+	assert.Nil(t, err, "should make request")
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func newTestProbeServer(status *statusHandler, certificate func() (*tls.Certificate, error), ready []string) *httptest.Server {
+	mux := http.NewServeMux()
+	probes := &probeHandler{status: status, certificate: certificate, ready: ready}
+	probes.register(mux)
+	return httptest.NewServer(mux)
+}
+
+func TestProbesStartup(t *testing.T) {
+	status := newStatusHandler(dummyDial)
+	server := newTestProbeServer(status, newTestProbeCertificate(t, time.Now().Add(time.Hour)), []string{probeListening, probeCertificate})
+	defer server.Close()
+
+	code, _ := getProbe(t, server, "/livez")
+	assert.Equal(t, http.StatusOK, code, "should be live before listening")
+	code, body := getProbe(t, server, "/startupz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "should not be started before listening")
+	assert.Contains(t, body, "[-]listening failed: initializing")
+	code, _ = getProbe(t, server, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "should not be ready before listening")
+
+	status.Listening()
+	code, body = getProbe(t, server, "/startupz")
+	assert.Equal(t, http.StatusOK, code, "should be started once listening")
+	assert.Equal(t, "ok", body)
+	code, body = getProbe(t, server, "/readyz?verbose")
+	assert.Equal(t, http.StatusOK, code, "should be ready once listening")
+	assert.Contains(t, body, "[+]listening ok")
+	assert.Contains(t, body, "[+]certificate ok")
+	assert.Contains(t, body, "readyz check passed")
+}
+
+func TestProbesCertificateExpired(t *testing.T) {
+	status := newStatusHandler(dummyDial)
+	status.Listening()
+	server := newTestProbeServer(status, newTestProbeCertificate(t, time.Now().Add(-time.Hour)), []string{probeListening, probeCertificate})
+	defer server.Close()
+
+	code, body := getProbe(t, server, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "should not be ready with expired certificate")
+	assert.Contains(t, body, "[+]listening ok")
+	assert.Contains(t, body, "[-]certificate failed: expired at")
+	code, _ = getProbe(t, server, "/livez")
+	assert.Equal(t, http.StatusOK, code, "should still be live with expired certificate")
+}
+
+func TestProbesBackendDown(t *testing.T) {
+	status := newStatusHandler(dummyDialError)
+	status.Listening()
+	server := newTestProbeServer(status, nil, []string{probeListening, probeCertificate})
+	defer server.Close()
+
+	code, _ := getProbe(t, server, "/readyz")
+	assert.Equal(t, http.StatusOK, code, "should be ready if backend isn't checked")
+	code, body := getProbe(t, server, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "should not be healthy if backend is down")
+	assert.Contains(t, body, "[-]backend failed: fail")
+
+	withBackend := newTestProbeServer(status, nil, []string{probeBackend})
+	defer withBackend.Close()
+	code, _ = getProbe(t, withBackend, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "should not be ready if backend is checked and down")
+}
@@ -0,0 +1,264 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategies for choosing backends in a Balancer.
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-conn"
+)
+
+// How long a backend is considered unhealthy after a failed dial.
+const backendDialFailureCooldown = 5 * time.Second
+
+var (
+	errNoBackends        = errors.New("no backends available")
+	errNoHealthyBackends = errors.New("no healthy backends available")
+)
+
+// Backend is a single backend in a Balancer.
+type Backend struct {
+	// Name of the backend (e.g. its address), for logging.
+	Name string
+	// Dial function to reach the backend.
+	Dial Dialer
+
+	// Backup backends are only used if no primary backend is healthy.
+	Backup bool
+	// Backends with lower priority values are preferred over ones with
+	// higher values (e.g. from SRV records), if healthy.
+	Priority int
+	// Relative weight for choosing among backends of the same priority (e.g.
+	// from SRV records). If all weights are zero, backends are used equally.
+	Weight int
+
+	// Number of open connections
+	active int64
+	// Unhealthy until the given time (in unix nanoseconds) after a failed dial
+	failedUntil int64
+	// Set (to 1) if the backend failed its last health check
+	ejected int32
+}
+
+// NewBackend creates a new backend.
+func NewBackend(name string, dial Dialer) *Backend {
+	return &Backend{Name: name, Dial: dial}
+}
+
+// Healthy returns true if the backend is considered healthy, i.e. it passed
+// its last health check (if any) and the last dial didn't fail recently.
+func (b *Backend) Healthy() bool {
+	return !b.Ejected() && time.Now().UnixNano() >= atomic.LoadInt64(&b.failedUntil)
+}
+
+// Ejected returns true if the backend failed its last health check.
+func (b *Backend) Ejected() bool {
+	return atomic.LoadInt32(&b.ejected) == 1
+}
+
+// Active returns the number of open connections to the backend.
+func (b *Backend) Active() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// Balancer distributes connections across multiple backends. Backends that
+// fail to dial are skipped for a short cooldown period, and the next backend is
+// tried instead. Backends that fail active health checks (see CheckHealth) are
+// not used until they pass again.
+type Balancer struct {
+	// Current []*Backend
+	backends atomic.Value
+	strategy string
+	next     uint64
+}
+
+// NewBalancer creates a balancer for the given backends, with the given
+// strategy (RoundRobin or LeastConnections).
+func NewBalancer(backends []*Backend, strategy string) (*Balancer, error) {
+	if len(backends) == 0 {
+		return nil, errNoBackends
+	}
+	if strategy != RoundRobin && strategy != LeastConnections {
+		return nil, fmt.Errorf("unknown balancing strategy '%s'", strategy)
+	}
+	balancer := &Balancer{strategy: strategy}
+	balancer.backends.Store(backends)
+	return balancer, nil
+}
+
+// Backends returns the backends of the balancer.
+func (b *Balancer) Backends() []*Backend {
+	return b.backends.Load().([]*Backend)
+}
+
+// SetBackends replaces the backends of the balancer (e.g. after re-resolving
+// a target). Open connections to removed backends are not affected.
+func (b *Balancer) SetBackends(backends []*Backend) error {
+	if len(backends) == 0 {
+		return errNoBackends
+	}
+	b.backends.Store(backends)
+	return nil
+}
+
+// Dial connects to a backend. Healthy backends are tried first (in the order
+// given by the strategy, primary before backup backends, and by priority and
+// weight), then ones that
+// recently failed to dial as a last resort. Returns the last error if all
+// backends fail.
+func (b *Balancer) Dial() (net.Conn, error) {
+	err := errNoHealthyBackends
+	for _, backend := range b.candidates() {
+		var conn net.Conn
+		conn, err = backend.Dial()
+		if err != nil {
+			atomic.StoreInt64(&backend.failedUntil, time.Now().Add(backendDialFailureCooldown).UnixNano())
+			continue
+		}
+		atomic.StoreInt64(&backend.failedUntil, 0)
+		atomic.AddInt64(&backend.active, 1)
+		return &backendConn{Conn: conn, backend: backend}, nil
+	}
+	return nil, err
+}
+
+// candidates returns all backends in the order they should be tried.
+func (b *Balancer) candidates() []*Backend {
+	type candidate struct {
+		backend *Backend
+		healthy bool
+		active  int64
+	}
+
+	// Rotate starting point, so that ties are broken round-robin
+	backends := b.Backends()
+	n := len(backends)
+	start := int((atomic.AddUint64(&b.next, 1) - 1) % uint64(n))
+	snapshot := make([]candidate, 0, n)
+	for i := 0; i < n; i++ {
+		backend := backends[(start+i)%n]
+		if backend.Ejected() {
+			continue
+		}
+		snapshot = append(snapshot, candidate{backend, backend.Healthy(), backend.Active()})
+	}
+
+	tier := func(i, j int) int {
+		switch {
+		case snapshot[i].healthy != snapshot[j].healthy:
+			return boolOrder(snapshot[i].healthy)
+		case snapshot[i].backend.Backup != snapshot[j].backend.Backup:
+			return boolOrder(!snapshot[i].backend.Backup)
+		case snapshot[i].backend.Priority != snapshot[j].backend.Priority:
+			return boolOrder(snapshot[i].backend.Priority < snapshot[j].backend.Priority)
+		case b.strategy == LeastConnections && snapshot[i].active != snapshot[j].active:
+			return boolOrder(snapshot[i].active < snapshot[j].active)
+		}
+		return 0
+	}
+	sort.SliceStable(snapshot, func(i, j int) bool { return tier(i, j) < 0 })
+
+	// Pick the first backend among the best ones by weight, if weights are set
+	total, best := 0, 0
+	for best < len(snapshot) && tier(0, best) == 0 {
+		total += snapshot[best].backend.Weight
+		best++
+	}
+	if total > 0 {
+		pick := rand.Intn(total)
+		for i := 0; i < best; i++ {
+			if pick < snapshot[i].backend.Weight {
+				snapshot[0], snapshot[i] = snapshot[i], snapshot[0]
+				break
+			}
+			pick -= snapshot[i].backend.Weight
+		}
+	}
+
+	ordered := make([]*Backend, len(snapshot))
+	for i, c := range snapshot {
+		ordered[i] = c.backend
+	}
+	return ordered
+}
+
+// boolOrder returns a sort order: -1 if first is true, 1 otherwise.
+func boolOrder(first bool) int {
+	if first {
+		return -1
+	}
+	return 1
+}
+
+// HealthCheck checks if a backend is healthy, returning an error if not.
+type HealthCheck func(backend *Backend) error
+
+// CheckHealth runs the given health check against all backends periodically,
+// ejecting backends that fail it until they pass again. The first round of
+// checks runs right away. Changes in health are logged.
+func (b *Balancer) CheckHealth(check HealthCheck, interval time.Duration, logger Logger) {
+	b.checkHealthOnce(check, logger)
+	go func() {
+		for range time.Tick(interval) {
+			b.checkHealthOnce(check, logger)
+		}
+	}()
+}
+
+func (b *Balancer) checkHealthOnce(check HealthCheck, logger Logger) {
+	wg := &sync.WaitGroup{}
+	for _, backend := range b.Backends() {
+		wg.Add(1)
+		go func(backend *Backend) {
+			defer wg.Done()
+			err := check(backend)
+			if err != nil {
+				if atomic.SwapInt32(&backend.ejected, 1) == 0 {
+					logger.Printf("target %s failed health check, marking as unhealthy: %s", backend.Name, err)
+				}
+				return
+			}
+			if atomic.SwapInt32(&backend.ejected, 0) == 1 {
+				logger.Printf("target %s passed health check, marking as healthy", backend.Name)
+			}
+		}(backend)
+	}
+	wg.Wait()
+}
+
+// backendConn tracks open connections to a backend.
+type backendConn struct {
+	net.Conn
+	backend *Backend
+	once    sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&c.backend.active, -1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,244 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pipeDialer returns a dialer that records its name, and returns one end of
+// a pipe (or an error, if failing is set).
+func pipeDialer(name string, dialed *[]string, failing *bool) Dialer {
+	return func() (net.Conn, error) {
+		*dialed = append(*dialed, name)
+		if failing != nil && *failing {
+			return nil, errors.New("dial failed for test")
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	dialed := []string{}
+	balancer, err := NewBalancer([]*Backend{
+		NewBackend("a", pipeDialer("a", &dialed, nil)),
+		NewBackend("b", pipeDialer("b", &dialed, nil)),
+		NewBackend("c", pipeDialer("c", &dialed, nil)),
+	}, RoundRobin)
+	assert.Nil(t, err, "should create balancer")
+
+	for i := 0; i < 6; i++ {
+		conn, err := balancer.Dial()
+		assert.Nil(t, err, "should dial backend")
+		defer conn.Close()
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, dialed, "should dial backends in turn")
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	dialed := []string{}
+	a := NewBackend("a", pipeDialer("a", &dialed, nil))
+	b := NewBackend("b", pipeDialer("b", &dialed, nil))
+	balancer, err := NewBalancer([]*Backend{a, b}, LeastConnections)
+	assert.Nil(t, err, "should create balancer")
+
+	first, err := balancer.Dial()
+	assert.Nil(t, err, "should dial backend")
+	second, err := balancer.Dial()
+	assert.Nil(t, err, "should dial backend")
+	assert.Equal(t, int64(1), a.Active(), "should track open connections")
+	assert.Equal(t, int64(1), b.Active(), "should track open connections")
+
+	// Close connection to a, next dials should prefer a
+	first.Close()
+	first.Close()
+	assert.Equal(t, int64(0), a.Active(), "should track closed connections (once)")
+	for i := 0; i < 2; i++ {
+		conn, err := balancer.Dial()
+		assert.Nil(t, err, "should dial backend")
+		defer conn.Close()
+	}
+	assert.Equal(t, []string{"a", "b", "a", "b"}, dialed, "should prefer backends with fewer connections")
+	second.Close()
+}
+
+func TestBalancerFailover(t *testing.T) {
+	dialed := []string{}
+	failing := true
+	a := NewBackend("a", pipeDialer("a", &dialed, &failing))
+	b := NewBackend("b", pipeDialer("b", &dialed, nil))
+	balancer, err := NewBalancer([]*Backend{a, b}, RoundRobin)
+	assert.Nil(t, err, "should create balancer")
+
+	conn, err := balancer.Dial()
+	assert.Nil(t, err, "should fail over to healthy backend")
+	conn.Close()
+	assert.Equal(t, []string{"a", "b"}, dialed, "should try next backend after failure")
+	assert.False(t, a.Healthy(), "failed backend should be unhealthy")
+
+	// Unhealthy backends are skipped
+	dialed = nil
+	for i := 0; i < 2; i++ {
+		conn, err := balancer.Dial()
+		assert.Nil(t, err, "should dial healthy backend")
+		conn.Close()
+	}
+	assert.Equal(t, []string{"b", "b"}, dialed, "should skip unhealthy backend")
+
+	// If all backends fail, return error
+	failing = true
+	b.Dial = pipeDialer("b", &dialed, &failing)
+	_, err = balancer.Dial()
+	assert.NotNil(t, err, "should fail if all backends fail")
+
+	// Unhealthy backends are still tried as a last resort
+	failing = false
+	dialed = nil
+	conn, err = balancer.Dial()
+	assert.Nil(t, err, "should dial unhealthy backend as last resort")
+	conn.Close()
+	assert.True(t, a.Healthy() || b.Healthy(), "successful dial should mark backend healthy")
+}
+
+func TestBalancerInvalid(t *testing.T) {
+	_, err := NewBalancer(nil, RoundRobin)
+	assert.NotNil(t, err, "should reject empty backends")
+	_, err = NewBalancer([]*Backend{NewBackend("a", nil)}, "random")
+	assert.NotNil(t, err, "should reject unknown strategy")
+}
+
+func TestBalancerHealthCheck(t *testing.T) {
+	dialed := []string{}
+	a := NewBackend("a", pipeDialer("a", &dialed, nil))
+	b := NewBackend("b", pipeDialer("b", &dialed, nil))
+	balancer, err := NewBalancer([]*Backend{a, b}, RoundRobin)
+	assert.Nil(t, err, "should create balancer")
+
+	unhealthy := map[string]bool{"a": true}
+	check := func(backend *Backend) error {
+		if unhealthy[backend.Name] {
+			return errors.New("unhealthy for test")
+		}
+		return nil
+	}
+
+	balancer.checkHealthOnce(check, &testLogger{})
+	assert.True(t, a.Ejected(), "failed health check should eject backend")
+	assert.False(t, b.Ejected(), "passed health check should not eject backend")
+
+	for i := 0; i < 2; i++ {
+		conn, err := balancer.Dial()
+		assert.Nil(t, err, "should dial healthy backend")
+		conn.Close()
+	}
+	assert.Equal(t, []string{"b", "b"}, dialed, "should not dial ejected backend")
+
+	// All backends ejected
+	unhealthy["b"] = true
+	balancer.checkHealthOnce(check, &testLogger{})
+	_, err = balancer.Dial()
+	assert.NotNil(t, err, "should fail if all backends are ejected")
+
+	// Recovered backends are used again
+	unhealthy = map[string]bool{}
+	balancer.checkHealthOnce(check, &testLogger{})
+	assert.False(t, a.Ejected(), "passed health check should restore backend")
+	dialed = nil
+	conn, err := balancer.Dial()
+	assert.Nil(t, err, "should dial recovered backend")
+	conn.Close()
+}
+
+func TestBalancerBackup(t *testing.T) {
+	dialed := []string{}
+	failing := false
+	primary := NewBackend("primary", pipeDialer("primary", &dialed, &failing))
+	backup := NewBackend("backup", pipeDialer("backup", &dialed, nil))
+	backup.Backup = true
+	balancer, err := NewBalancer([]*Backend{primary, backup}, RoundRobin)
+	assert.Nil(t, err, "should create balancer")
+
+	for i := 0; i < 2; i++ {
+		conn, err := balancer.Dial()
+		assert.Nil(t, err, "should dial primary backend")
+		conn.Close()
+	}
+	assert.Equal(t, []string{"primary", "primary"}, dialed, "should not use backup while primary is healthy")
+
+	// Fail over to backup if primary is down
+	failing = true
+	dialed = nil
+	conn, err := balancer.Dial()
+	assert.Nil(t, err, "should fail over to backup backend")
+	conn.Close()
+	assert.Equal(t, []string{"primary", "backup"}, dialed, "should fail over to backup backend")
+
+	dialed = nil
+	conn, err = balancer.Dial()
+	assert.Nil(t, err, "should dial backup backend")
+	conn.Close()
+	assert.Equal(t, []string{"backup"}, dialed, "should use backup while primary is unhealthy")
+}
+
+func TestBalancerPriorityAndWeight(t *testing.T) {
+	dialed := []string{}
+	a := NewBackend("a", pipeDialer("a", &dialed, nil))
+	a.Weight = 3
+	b := NewBackend("b", pipeDialer("b", &dialed, nil))
+	b.Weight = 1
+	c := NewBackend("c", pipeDialer("c", &dialed, nil))
+	c.Weight = 0
+	lowPriority := NewBackend("low", pipeDialer("low", &dialed, nil))
+	lowPriority.Priority = 10
+	lowPriority.Weight = 100
+	balancer, err := NewBalancer([]*Backend{a, b, c, lowPriority}, RoundRobin)
+	assert.Nil(t, err, "should create balancer")
+
+	for i := 0; i < 1000; i++ {
+		conn, err := balancer.Dial()
+		assert.Nil(t, err, "should dial backend")
+		conn.Close()
+	}
+	counts := map[string]int{}
+	for _, name := range dialed {
+		counts[name]++
+	}
+	assert.Equal(t, 0, counts["low"], "should prefer backends with lower priority value")
+	assert.Equal(t, 0, counts["c"], "should not pick zero-weight backend if others have weight")
+	assert.InDelta(t, 750, counts["a"], 100, "should pick backends proportionally to weight")
+	assert.InDelta(t, 250, counts["b"], 100, "should pick backends proportionally to weight")
+}
+
+func TestBalancerSetBackends(t *testing.T) {
+	dialed := []string{}
+	balancer, err := NewBalancer([]*Backend{NewBackend("a", pipeDialer("a", &dialed, nil))}, RoundRobin)
+	assert.Nil(t, err, "should create balancer")
+
+	assert.NotNil(t, balancer.SetBackends(nil), "should reject empty backends")
+	assert.Nil(t, balancer.SetBackends([]*Backend{NewBackend("b", pipeDialer("b", &dialed, nil))}), "should replace backends")
+	assert.Equal(t, "b", balancer.Backends()[0].Name, "should replace backends")
+
+	conn, err := balancer.Dial()
+	assert.Nil(t, err, "should dial new backend")
+	conn.Close()
+	assert.Equal(t, []string{"b"}, dialed, "should dial new backend")
+}
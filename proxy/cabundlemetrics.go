@@ -0,0 +1,96 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/x509"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CABundleMetrics holds a Prometheus counter for verified handshakes, labeled
+// by the CA bundle that contains the root of the verified chain. With the old
+// and new CA bundle configured during a CA rotation, this shows when no more
+// peers use certificates issued by the old root, so it's safe to drop.
+type CABundleMetrics struct {
+	mu sync.Mutex
+	// Names of bundles that contain each CA certificate (by raw DER)
+	bundles map[string][]string
+
+	verified *prometheus.CounterVec
+}
+
+// NewCABundleMetrics creates the counter and registers it with the given
+// registerer. Metric names are prefixed with the given namespace.
+func NewCABundleMetrics(namespace string, registerer prometheus.Registerer) (*CABundleMetrics, error) {
+	verified := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace(namespace),
+		Name:      "cacert_verified_handshakes_total",
+		Help:      "Number of handshakes with a peer certificate chain verified by the CA bundle.",
+	}, []string{"bundle"})
+	c, err := register(registerer, verified)
+	if err != nil {
+		return nil, err
+	}
+	return &CABundleMetrics{
+		bundles:  map[string][]string{},
+		verified: c.(*prometheus.CounterVec),
+	}, nil
+}
+
+// SetBundles replaces the CA bundles to count handshakes for, given as the
+// certificates in each bundle by name (e.g. the file path). Counters for
+// bundles start at zero, so they are exported before the first handshake.
+func (m *CABundleMetrics) SetBundles(bundles map[string][]*x509.Certificate) {
+	byCert := map[string][]string{}
+	for name, certs := range bundles {
+		m.verified.WithLabelValues(name)
+		for _, cert := range certs {
+			byCert[string(cert.Raw)] = append(byCert[string(cert.Raw)], name)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bundles = byCert
+}
+
+// VerifyPeerCertificate counts the handshake for each bundle that contains
+// the root of a verified chain. It never rejects, so it can be chained with
+// other VerifyPeerCertificate callbacks.
+func (m *CABundleMetrics) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	counted := map[string]bool{}
+	for _, chain := range verifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		for _, name := range m.bundles[string(chain[len(chain)-1].Raw)] {
+			counted[name] = true
+		}
+	}
+	m.mu.Unlock()
+
+	for name := range counted {
+		m.verified.WithLabelValues(name).Inc()
+	}
+	return nil
+}
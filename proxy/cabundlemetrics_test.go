@@ -0,0 +1,53 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCABundleMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := NewCABundleMetrics("test", registry)
+	assert.Nil(t, err, "should be able to register metrics")
+
+	oldRoot := &x509.Certificate{Raw: []byte("old root")}
+	newRoot := &x509.Certificate{Raw: []byte("new root")}
+	leaf := &x509.Certificate{Raw: []byte("leaf")}
+	m.SetBundles(map[string][]*x509.Certificate{
+		"old.pem": {oldRoot},
+		"new.pem": {newRoot},
+	})
+	assert.Equal(t, map[string]float64{"old.pem": 0, "new.pem": 0}, labeledCounterValues(t, registry, "test_cacert_verified_handshakes_total", "bundle"), "should export counters before first handshake")
+
+	m.VerifyPeerCertificate(nil, [][]*x509.Certificate{{leaf, oldRoot}})
+	m.VerifyPeerCertificate(nil, [][]*x509.Certificate{{leaf, newRoot}})
+	m.VerifyPeerCertificate(nil, [][]*x509.Certificate{{leaf, newRoot}, {leaf, newRoot}})
+	m.VerifyPeerCertificate(nil, [][]*x509.Certificate{{leaf, &x509.Certificate{Raw: []byte("other root")}}})
+	assert.Equal(t, map[string]float64{"old.pem": 1, "new.pem": 2}, labeledCounterValues(t, registry, "test_cacert_verified_handshakes_total", "bundle"), "should count handshakes once per bundle")
+
+	// Cross-signed chains may lead to both roots
+	m.VerifyPeerCertificate(nil, [][]*x509.Certificate{{leaf, oldRoot}, {leaf, newRoot}})
+	assert.Equal(t, map[string]float64{"old.pem": 2, "new.pem": 3}, labeledCounterValues(t, registry, "test_cacert_verified_handshakes_total", "bundle"), "should count each bundle with a verified chain")
+
+	var disabled *CABundleMetrics
+	assert.Nil(t, disabled.VerifyPeerCertificate(nil, nil), "nil metrics should not fail")
+}
@@ -0,0 +1,47 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var certExpiredCounter = metrics.GetOrRegisterCounter("conn.certexpired", metrics.DefaultRegistry)
+
+// enforceCertExpiry closes a TLS connection once the client certificate
+// expires, if EnforceCertExpiry is set. Call the returned function once the
+// connection is done, to stop the timer.
+func (p *Proxy) enforceCertExpiry(conn net.Conn, identity string) (stop func()) {
+	tlsConn, ok := conn.(secureConn)
+	if !p.EnforceCertExpiry || !ok {
+		return func() {}
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return func() {}
+	}
+	notAfter := certs[0].NotAfter
+	timer := time.AfterFunc(time.Until(notAfter), func() {
+		certExpiredCounter.Inc(1)
+		p.logConditional(LogConnections, "closing connection from %s (%s): client certificate expired at %s", conn.RemoteAddr(), identity, notAfter.Format(time.RFC3339))
+		conn.Close()
+	})
+	return func() { timer.Stop() }
+}
@@ -0,0 +1,70 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforceCertExpiry(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{ClientAuth: tls.RequireAnyClientCert})
+	backend := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go echoConn(server)
+		return client, nil
+	}
+	p := New([]net.Listener{incoming}, 10*time.Second, backend, &testLogger{}, LogEverything, false)
+	p.EnforceCertExpiry = true
+	go p.Accept()
+	defer p.Shutdown()
+
+	// Certificate times have a resolution of one second
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should generate key")
+	notAfter := time.Now().Add(1500 * time.Millisecond)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: notAfter}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should create certificate")
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	assert.Nil(t, err, "should connect")
+	defer conn.Close()
+
+	conn.Write([]byte("x"))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Nil(t, err, "should proxy data before certificate expires")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err, "should close connection")
+	assert.True(t, time.Now().After(notAfter.Add(-time.Second)), "should close connection once certificate expires")
+	netErr, ok := err.(net.Error)
+	assert.False(t, ok && netErr.Timeout(), "should not time out reading")
+}
@@ -0,0 +1,72 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+)
+
+// HeaderChannelBinding is set on requests in HTTP mode with ChannelBinding,
+// to the tls-exporter channel binding of the client connection (see
+// ChannelBinding). Values sent by clients are removed.
+const HeaderChannelBinding = "X-TLS-Channel-Binding"
+
+// Exporter label and length for tls-exporter channel bindings (RFC 9266).
+const (
+	channelBindingLabel  = "EXPORTER-Channel-Binding"
+	channelBindingLength = 32
+)
+
+var errNoChannelBinding = errors.New("connection has no TLS session to export keying material from")
+
+// keyingMaterialExporter is implemented by connections that export keying
+// material themselves, instead of through their connection state (e.g. DTLS
+// sessions).
+type keyingMaterialExporter interface {
+	ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error)
+}
+
+// ChannelBinding returns the tls-exporter channel binding (RFC 9266) of a
+// connection, base64 encoded, so backends can bind their own authentication
+// to the TLS session between the client and ghostunnel. Fails if the
+// connection isn't TLS, or if keying material can't be exported safely (TLS
+// 1.2 without extended master secret).
+func ChannelBinding(conn net.Conn) (string, error) {
+	var (
+		ekm []byte
+		err error
+	)
+	switch c := conn.(type) {
+	case keyingMaterialExporter:
+		ekm, err = c.ExportKeyingMaterial(channelBindingLabel, nil, channelBindingLength)
+	case secureConn:
+		state := c.ConnectionState()
+		if !state.HandshakeComplete {
+			// Tunnels over connections without TLS have an empty state
+			return "", errNoChannelBinding
+		}
+		ekm, err = state.ExportKeyingMaterial(channelBindingLabel, nil, channelBindingLength)
+	default:
+		return "", errNoChannelBinding
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ekm), nil
+}
@@ -0,0 +1,110 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// emptyStateConn is a connection with an empty TLS connection state, like
+// tunnels over connections without TLS.
+type emptyStateConn struct {
+	net.Conn
+}
+
+func (c emptyStateConn) Handshake() error                     { return nil }
+func (c emptyStateConn) ConnectionState() tls.ConnectionState { return tls.ConnectionState{} }
+
+func TestChannelBinding(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+	defer incoming.Close()
+
+	server := make(chan string, 1)
+	go func() {
+		conn, err := incoming.Accept()
+		if err != nil {
+			server <- ""
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+		binding, _ := ChannelBinding(conn)
+		server <- binding
+	}()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "should connect")
+	defer conn.Close()
+	binding, err := ChannelBinding(conn)
+	assert.Nil(t, err, "should export channel binding")
+	raw, _ := base64.StdEncoding.DecodeString(binding)
+	assert.Len(t, raw, channelBindingLength)
+	assert.Equal(t, binding, <-server, "both sides should have the same channel binding")
+
+	plain, other := net.Pipe()
+	defer plain.Close()
+	defer other.Close()
+	_, err = ChannelBinding(plain)
+	assert.NotNil(t, err, "should fail without TLS")
+	_, err = ChannelBinding(emptyStateConn{plain})
+	assert.NotNil(t, err, "should fail without completed handshake")
+}
+
+func TestHTTPChannelBinding(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Backend-Binding", r.Header.Get(HeaderChannelBinding))
+	}))
+	defer backend.Close()
+
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	}
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.HTTP = &HTTPConfig{ChannelBinding: true}
+	go p.Accept()
+	defer p.Shutdown()
+
+	var conn *tls.Conn
+	client := &http.Client{Transport: &http.Transport{
+		DialTLS: func(network, address string) (net.Conn, error) {
+			var err error
+			conn, err = tls.Dial(network, address, &tls.Config{InsecureSkipVerify: true})
+			return conn, err
+		},
+	}}
+	req, _ := http.NewRequest("GET", "https://"+addr+"/", nil)
+	req.Header.Set(HeaderChannelBinding, "spoofed")
+	resp, err := client.Do(req)
+	assert.Nil(t, err, "should forward request")
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	expected, err := ChannelBinding(conn)
+	assert.Nil(t, err, "should export channel binding")
+	assert.Equal(t, expected, resp.Header.Get("Backend-Binding"), "should set channel binding header (replacing spoofed value)")
+}
@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// activeConns tracks open proxied connections, so they can be listed and
+// closed at runtime (e.g. via the admin API).
+type activeConns struct {
+	mu    sync.Mutex
+	conns map[uint64]*activeConn
+}
+
+type activeConn struct {
+	client   net.Conn
+	backend  net.Conn
+	identity string
+	info     *connInfo
+}
+
+func (a *activeConns) add(conn *activeConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conns == nil {
+		a.conns = map[uint64]*activeConn{}
+	}
+	a.conns[conn.info.id] = conn
+}
+
+func (a *activeConns) remove(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.conns, id)
+}
+
+// Connections returns information about all open proxied connections, with
+// the same fields as structured connection messages (see FieldLogger), plus
+// the client identity and transfer statistics so far. Connections are sorted
+// by ID (i.e. oldest first).
+func (p *Proxy) Connections() []map[string]interface{} {
+	p.active.mu.Lock()
+	conns := make([]*activeConn, 0, len(p.active.conns))
+	for _, conn := range p.active.conns {
+		conns = append(conns, conn)
+	}
+	p.active.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].info.id < conns[j].info.id })
+
+	result := make([]map[string]interface{}, 0, len(conns))
+	for _, conn := range conns {
+		// Statistics are added below, info may still change concurrently
+		fields := connFields(conn.client, conn.backend, &connInfo{id: conn.info.id})
+		if conn.identity != "" {
+			fields["identity"] = conn.identity
+		}
+		fields["start_time"] = conn.info.start.Format(time.RFC3339Nano)
+		fields["bytes_in"] = atomic.LoadInt64(&conn.info.bytesIn)
+		fields["bytes_out"] = atomic.LoadInt64(&conn.info.bytesOut)
+		fields["duration_ms"] = time.Since(conn.info.start).Nanoseconds() / int64(time.Millisecond)
+		result = append(result, fields)
+	}
+	return result
+}
+
+// CloseConnection closes the open proxied connection with the given ID (see
+// Connections). Returns false if there is no such connection.
+func (p *Proxy) CloseConnection(id uint64) bool {
+	p.active.mu.Lock()
+	conn, ok := p.active.conns[id]
+	p.active.mu.Unlock()
+	if !ok {
+		return false
+	}
+	conn.client.Close()
+	conn.backend.Close()
+	return true
+}
+
+// countingReader counts bytes read, so transfer statistics of open
+// connections can be reported.
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
@@ -0,0 +1,74 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyConnections(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	src.Write([]byte("hello"))
+	received := make([]byte, 5)
+	_, err = io.ReadFull(dst, received)
+	assert.Nil(t, err, "should forward data")
+
+	var conns []map[string]interface{}
+	for i := 0; i < 100 && len(conns) == 0; i++ {
+		conns = p.Connections()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Len(t, conns, 1, "should list open connection")
+	assert.Equal(t, src.LocalAddr().String(), conns[0]["client_addr"], "should include client address")
+	assert.Equal(t, int64(5), conns[0]["bytes_in"], "should include bytes transferred so far")
+
+	id := conns[0]["conn_id"].(uint64)
+	assert.False(t, p.CloseConnection(id+1000), "should not close unknown connection")
+	assert.True(t, p.CloseConnection(id), "should close connection")
+
+	_, err = io.ReadFull(src, make([]byte, 1))
+	assert.NotNil(t, err, "closed connection should be closed on client side")
+	for i := 0; i < 100 && len(p.Connections()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(t, p.Connections(), "should remove closed connection")
+}
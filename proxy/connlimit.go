@@ -0,0 +1,74 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"sync"
+)
+
+// connLimiter keeps track of the number of live connections per key, and
+// limits them to a maximum. A nil connLimiter allows everything.
+type connLimiter struct {
+	max int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// newConnLimiter creates a limiter allowing the given number of concurrent
+// connections for each key. Returns nil if max is not positive.
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{
+		max:    max,
+		counts: map[string]int{},
+	}
+}
+
+// acquire registers a new connection for key, returns false (without
+// registering) if the key is already at the limit.
+func (l *connLimiter) acquire(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts[key] >= l.max {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
+
+// release unregisters a connection for key, previously registered with acquire.
+func (l *connLimiter) release(key string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.counts[key]--
+	if l.counts[key] <= 0 {
+		delete(l.counts, key)
+	}
+}
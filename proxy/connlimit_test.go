@@ -0,0 +1,105 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimiter(t *testing.T) {
+	limiter := newConnLimiter(2)
+
+	assert.True(t, limiter.acquire("a"), "should allow up to limit")
+	assert.True(t, limiter.acquire("a"), "should allow up to limit")
+	assert.False(t, limiter.acquire("a"), "should reject past limit")
+	assert.True(t, limiter.acquire("b"), "should track keys independently")
+
+	limiter.release("a")
+	assert.True(t, limiter.acquire("a"), "should allow again after release")
+
+	limiter.release("a")
+	limiter.release("a")
+	limiter.release("b")
+	assert.Len(t, limiter.counts, 0, "should remove keys without connections")
+}
+
+func TestConnLimiterDisabled(t *testing.T) {
+	limiter := newConnLimiter(0)
+	assert.Nil(t, limiter, "zero limit should disable limiter")
+	for i := 0; i < 100; i++ {
+		assert.True(t, limiter.acquire("a"), "disabled limiter should allow everything")
+	}
+	limiter.release("a")
+}
+
+func TestProxyMaxConcurrentConns(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.MaxConcurrentConns = 1
+	go p.Accept()
+	defer p.Shutdown()
+
+	// First connection should be forwarded, and stays open
+	first, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+
+	// Second connection should be closed while first is open
+	second, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer second.Close()
+
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.NotNil(t, err, "connection over limit should be closed")
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "connection over limit should be closed")
+	}
+
+	// Once first connection is closed, new connections should be accepted
+	first.Close()
+	dst.Close()
+
+	for i := 0; i < 50; i++ {
+		third, err := net.Dial("tcp", incoming.Addr().String())
+		assert.Nil(t, err, "should be able to dial into proxy")
+		third.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = third.Read(make([]byte, 1))
+		third.Close()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// still open, so it was accepted
+			return
+		}
+	}
+	t.Error("connections should be accepted again after other connection closed")
+}
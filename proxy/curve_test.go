@@ -0,0 +1,47 @@
+//go:build go1.25
+// +build go1.25
+
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsesPostQuantum(t *testing.T) {
+	for _, curve := range []tls.CurveID{tls.X25519MLKEM768, tls.X25519} {
+		listener, addr := newTestTLSListener(t, &tls.Config{CurvePreferences: []tls.CurveID{curve}})
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, CurvePreferences: []tls.CurveID{curve}})
+		assert.Nil(t, err, "should connect")
+		assert.Equal(t, curve == tls.X25519MLKEM768, usesPostQuantum(conn), "should detect post-quantum key exchange for %s", curve)
+		assert.Equal(t, curve.String(), connFields(conn, conn, &connInfo{})["tls_key_exchange"], "should log key exchange")
+		conn.Close()
+		listener.Close()
+	}
+}
@@ -0,0 +1,128 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// FieldLogger is implemented by loggers that support structured logging. If
+// the Logger given to the proxy implements it, connection messages are logged
+// with fields describing the connection instead of as free-form text.
+type FieldLogger interface {
+	Logger
+	LogFields(msg string, fields map[string]interface{})
+}
+
+// AccessLogger receives an entry for each proxied connection once it has been
+// closed. Entries have the same fields as structured connection messages (see
+// FieldLogger), and always include transfer statistics and the close reason.
+type AccessLogger interface {
+	LogAccess(fields map[string]interface{})
+}
+
+// Counter for assigning connection IDs.
+var connIDCounter uint64
+
+// connInfo holds information about a proxied connection for logging.
+type connInfo struct {
+	id       uint64
+	start    time.Time
+	bytesIn  int64
+	bytesOut int64
+	// Set once both directions are closed
+	closed      bool
+	closeReason string
+}
+
+// connFields returns structured fields describing a proxied connection.
+// Certificate and TLS fields are taken from whichever side uses TLS.
+func connFields(client, backend net.Conn, info *connInfo) map[string]interface{} {
+	fields := map[string]interface{}{
+		"conn_id":        info.id,
+		"client_network": client.RemoteAddr().Network(),
+		"client_addr":    client.RemoteAddr().String(),
+		"target_network": backend.RemoteAddr().Network(),
+		"target_addr":    backend.RemoteAddr().String(),
+	}
+
+	for _, conn := range []net.Conn{client, backend} {
+		tlsConn, ok := conn.(secureConn)
+		if !ok {
+			continue
+		}
+
+		state := tlsConn.ConnectionState()
+		if state.Version != 0 {
+			fields["tls_version"] = tlsVersionName(state.Version)
+			fields["tls_cipher_suite"] = tls.CipherSuiteName(state.CipherSuite)
+		}
+		if curve := negotiatedCurve(state); curve != 0 {
+			fields["tls_key_exchange"] = curve.String()
+		}
+		if state.ServerName != "" {
+			fields["tls_server_name"] = state.ServerName
+		}
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			fields["peer_cn"] = cert.Subject.CommonName
+			if len(cert.DNSNames) > 0 {
+				fields["peer_dns_sans"] = cert.DNSNames
+			}
+			if len(cert.IPAddresses) > 0 {
+				fields["peer_ip_sans"] = cert.IPAddresses
+			}
+			if len(cert.URIs) > 0 {
+				uris := []string{}
+				for _, uri := range cert.URIs {
+					uris = append(uris, uri.String())
+					if uri.Scheme == "spiffe" {
+						fields["peer_spiffe_id"] = uri.String()
+					}
+				}
+				fields["peer_uri_sans"] = uris
+			}
+		}
+	}
+
+	if info.closed {
+		fields["start_time"] = info.start.Format(time.RFC3339Nano)
+		fields["close_reason"] = info.closeReason
+		fields["bytes_in"] = info.bytesIn
+		fields["bytes_out"] = info.bytesOut
+		fields["duration_ms"] = time.Since(info.start).Nanoseconds() / int64(time.Millisecond)
+	}
+
+	return fields
+}
+
+// Hybrid post-quantum key exchanges (X25519MLKEM768, SecP256r1MLKEM768 and
+// SecP384r1MLKEM1024), by ID since older Go versions don't define them.
+var postQuantumCurves = map[tls.CurveID]bool{
+	0x11ec: true,
+	0x11eb: true,
+	0x11ed: true,
+}
+
+// usesPostQuantum returns true if the connection negotiated a hybrid
+// post-quantum key exchange in its TLS handshake.
+func usesPostQuantum(conn net.Conn) bool {
+	tlsConn, ok := conn.(secureConn)
+	return ok && postQuantumCurves[negotiatedCurve(tlsConn.ConnectionState())]
+}
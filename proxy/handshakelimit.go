@@ -0,0 +1,75 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package proxy
+
+import (
+	"errors"
+	"net"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var handshakeLimitedCounter = metrics.GetOrRegisterCounter("accept.handshakelimited", metrics.DefaultRegistry)
+
+var errTooManyHandshakes = errors.New("too many handshakes in progress")
+
+// acquireHandshake registers a handshake in flight from the given source IP,
+// returns false (without registering) if MaxHandshakes or MaxHandshakesPerIP
+// would be exceeded.
+func (p *Proxy) acquireHandshake(ip string) bool {
+	if !p.handshakes.acquire("") {
+		return false
+	}
+	if !p.ipHandshakes.acquire(ip) {
+		p.handshakes.release("")
+		return false
+	}
+	return true
+}
+
+// releaseHandshake unregisters a handshake, once it's done.
+func (p *Proxy) releaseHandshake(ip string) {
+	p.handshakes.release("")
+	p.ipHandshakes.release(ip)
+}
+
+// sourceIP returns the IP of a remote address (or the address itself if it
+// has no port, e.g. for UNIX sockets).
+func sourceIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// resetConn closes a connection with a TCP reset instead of the usual
+// shutdown, if it's a TCP connection (or a TLS connection over one), so
+// rejected peers don't keep waiting.
+func resetConn(conn net.Conn) {
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		if tcpConn, ok := tlsConn.NetConn().(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
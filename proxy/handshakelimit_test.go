@@ -0,0 +1,75 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rejected returns true if a new connection to addr is closed right away,
+// before we start a handshake.
+func rejected(addr string) bool {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	return err != nil && !(ok && netErr.Timeout())
+}
+
+func TestHandshakeLimitPerIP(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+	unreachable := func() (net.Conn, error) { return nil, errors.New("unreachable") }
+	p := New([]net.Listener{incoming}, 10*time.Second, unreachable, &testLogger{}, LogEverything, false)
+	p.MaxHandshakes = 10
+	p.MaxHandshakesPerIP = 1
+	go p.Accept()
+	defer p.Shutdown()
+
+	// First connection holds a handshake slot without sending anything, so
+	// further connections from the same IP are rejected
+	first, err := net.Dial("tcp", addr)
+	assert.Nil(t, err, "should connect")
+	defer first.Close()
+	assert.Eventually(t, func() bool { return rejected(addr) }, 5*time.Second, 10*time.Millisecond, "should reject second handshake from same IP")
+
+	// Slot is released once the first handshake is done
+	first.Close()
+	assert.Eventually(t, func() bool {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "should complete handshake once slot is free")
+}
+
+func TestSourceIP(t *testing.T) {
+	assert.Equal(t, "10.0.0.1", sourceIP(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}))
+	assert.Equal(t, "::1", sourceIP(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234}))
+	assert.Equal(t, "/tmp/socket", sourceIP(&net.UnixAddr{Name: "/tmp/socket", Net: "unix"}))
+	assert.Equal(t, "", sourceIP(nil))
+}
@@ -0,0 +1,155 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values for the result label on histograms.
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+	resultTimeout = "timeout"
+)
+
+// Histograms holds Prometheus latency histograms for handshakes, backend
+// dials and connection lifetimes, labeled by listener and result (and for
+// requests in HTTP mode, labeled by listener and status code class). The
+// go-metrics timers we export only give us summaries, which can't be
+// aggregated across instances or used to alert on latency regressions.
+type Histograms struct {
+	handshake *prometheus.HistogramVec
+	dial      *prometheus.HistogramVec
+	lifetime  *prometheus.HistogramVec
+	request   *prometheus.HistogramVec
+}
+
+// NewHistograms creates histograms and registers them with the given
+// registerer. Metric names are prefixed with the given namespace.
+func NewHistograms(namespace string, registerer prometheus.Registerer) (*Histograms, error) {
+	namespace = metricNamespace(namespace)
+	labels := []string{"listener", "result"}
+
+	h := &Histograms{
+		handshake: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handshake_duration_seconds",
+			Help:      "Duration of TLS handshakes on incoming connections.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		dial: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dial_duration_seconds",
+			Help:      "Duration of dials to the backend (including TLS handshake in client mode).",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		lifetime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "connection_lifetime_seconds",
+			Help:      "Lifetime of proxied connections, from accept until both sides are closed.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 12),
+		}, labels),
+		request: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of requests in HTTP mode, until the response is done.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"listener", "code"}),
+	}
+
+	for _, vec := range []**prometheus.HistogramVec{&h.handshake, &h.dial, &h.lifetime, &h.request} {
+		c, err := register(registerer, *vec)
+		if err != nil {
+			return nil, err
+		}
+		*vec = c.(*prometheus.HistogramVec)
+	}
+	return h, nil
+}
+
+func (h *Histograms) observeHandshake(listener string, start time.Time, err error) {
+	if h == nil {
+		return
+	}
+	if err == errACMEChallenge {
+		err = nil
+	}
+	h.handshake.WithLabelValues(listener, resultLabel(err)).Observe(time.Since(start).Seconds())
+}
+
+func (h *Histograms) observeDial(listener string, start time.Time, err error) {
+	if h == nil {
+		return
+	}
+	h.dial.WithLabelValues(listener, resultLabel(err)).Observe(time.Since(start).Seconds())
+}
+
+func (h *Histograms) observeLifetime(listener string, start time.Time, closeReason string) {
+	if h == nil {
+		return
+	}
+	result := resultSuccess
+	switch {
+	case closeReason == "idle_timeout":
+		result = resultTimeout
+	case strings.HasSuffix(closeReason, "_error"):
+		result = resultError
+	}
+	h.lifetime.WithLabelValues(listener, result).Observe(time.Since(start).Seconds())
+}
+
+func (h *Histograms) observeRequest(listener string, start time.Time, status int) {
+	if h == nil {
+		return
+	}
+	h.request.WithLabelValues(listener, fmt.Sprintf("%dxx", status/100)).Observe(time.Since(start).Seconds())
+}
+
+// metricNamespace turns a metrics prefix into a valid Prometheus namespace.
+func metricNamespace(prefix string) string {
+	return strings.NewReplacer(" ", "_", ".", "_", "-", "_", "=", "_").Replace(prefix)
+}
+
+// register registers a collector, or returns the existing collector if an
+// identical one was already registered (e.g. by a previous proxy).
+func register(registerer prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	err := registerer.Register(c)
+	if existing, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return existing.ExistingCollector, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// resultLabel maps an error to a value for the result label.
+func resultLabel(err error) string {
+	if err == nil {
+		return resultSuccess
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return resultTimeout
+	}
+	return resultError
+}
@@ -0,0 +1,120 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// histogramCounts returns the sample count for each result label of the
+// given histogram.
+func histogramCounts(t *testing.T, registry *prometheus.Registry, name string) map[string]uint64 {
+	families, err := registry.Gather()
+	assert.Nil(t, err, "should be able to gather metrics")
+
+	counts := map[string]uint64{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "result" {
+					counts[label.GetValue()] = metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return counts
+}
+
+func TestHistograms(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	h, err := NewHistograms("ghost.tunnel", registry)
+	assert.Nil(t, err, "should be able to register histograms")
+
+	start := time.Now()
+	h.observeHandshake("l", start, nil)
+	h.observeHandshake("l", start, errACMEChallenge)
+	h.observeHandshake("l", start, errors.New("bad certificate"))
+	h.observeDial("l", start, &net.OpError{Op: "dial", Err: timeoutError{}})
+	h.observeLifetime("l", start, "client_closed")
+	h.observeLifetime("l", start, "idle_timeout")
+	h.observeLifetime("l", start, "target_error")
+
+	assert.Equal(t, map[string]uint64{"success": 2, "error": 1}, histogramCounts(t, registry, "ghost_tunnel_handshake_duration_seconds"))
+	assert.Equal(t, map[string]uint64{"timeout": 1}, histogramCounts(t, registry, "ghost_tunnel_dial_duration_seconds"))
+	assert.Equal(t, map[string]uint64{"success": 1, "timeout": 1, "error": 1}, histogramCounts(t, registry, "ghost_tunnel_connection_lifetime_seconds"))
+
+	// Registering again should reuse the existing histograms
+	h2, err := NewHistograms("ghost.tunnel", registry)
+	assert.Nil(t, err, "should be able to register histograms twice")
+	h2.observeDial("l", start, nil)
+	assert.Equal(t, map[string]uint64{"timeout": 1, "success": 1}, histogramCounts(t, registry, "ghost_tunnel_dial_duration_seconds"))
+}
+
+func TestHistogramsDisabled(t *testing.T) {
+	var h *Histograms
+
+	// Should not panic
+	h.observeHandshake("l", time.Now(), nil)
+	h.observeDial("l", time.Now(), nil)
+	h.observeLifetime("l", time.Now(), "closed")
+}
+
+func TestProxyDialHistogram(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	h, err := NewHistograms("test", registry)
+	assert.Nil(t, err, "should be able to register histograms")
+
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	dialed := make(chan struct{}, 1)
+	dialer := func() (net.Conn, error) {
+		dialed <- struct{}{}
+		return nil, errors.New("failure")
+	}
+
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, 0, false)
+	p.Histograms = h
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+
+	<-dialed
+	deadline := time.Now().Add(5 * time.Second)
+	for len(histogramCounts(t, registry, "test_dial_duration_seconds")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[string]uint64{"error": 1}, histogramCounts(t, registry, "test_dial_duration_seconds"), "should record failed dial")
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,71 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// How often the backend is dialed while connections are held.
+var holdPollInterval = 100 * time.Millisecond
+
+var (
+	heldCounter        = metrics.GetOrRegisterCounter("conn.held", metrics.DefaultRegistry)
+	heldTimeoutCounter = metrics.GetOrRegisterCounter("conn.held.timeout", metrics.DefaultRegistry)
+)
+
+// withHold wraps a dialer to hold connections while the backend is
+// unavailable (see HoldTimeout). Connections aren't held anymore once we're
+// shutting down.
+func (p *Proxy) withHold(dial Dialer) Dialer {
+	if p.HoldTimeout <= 0 {
+		return dial
+	}
+	return func() (net.Conn, error) {
+		conn, err := dial()
+		if err == nil || atomic.LoadInt32(&p.quit) == 1 {
+			return conn, err
+		}
+
+		held := atomic.AddInt64(&p.held, 1)
+		defer atomic.AddInt64(&p.held, -1)
+		if p.MaxHeldConns > 0 && held > int64(p.MaxHeldConns) {
+			return nil, err
+		}
+
+		heldCounter.Inc(1)
+		p.logConditional(LogConnectionErrors, "error on dial, holding connection for up to %s until backend is available: %s", p.HoldTimeout, err)
+		deadline := time.Now().Add(p.HoldTimeout)
+		for time.Now().Before(deadline) && atomic.LoadInt32(&p.quit) == 0 {
+			wait := holdPollInterval
+			if remaining := time.Until(deadline); remaining < wait {
+				wait = remaining
+			}
+			time.Sleep(wait)
+
+			conn, err = dial()
+			if err == nil {
+				return conn, nil
+			}
+		}
+		heldTimeoutCounter.Inc(1)
+		return nil, err
+	}
+}
@@ -0,0 +1,91 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// switchDialer fails while up is 0.
+func switchDialer(up *int32) Dialer {
+	return func() (net.Conn, error) {
+		if atomic.LoadInt32(up) == 0 {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		go server.Close()
+		return client, nil
+	}
+}
+
+func TestHoldUntilBackendAvailable(t *testing.T) {
+	p := New(nil, time.Second, nil, &testLogger{}, LogEverything, false)
+	p.HoldTimeout = 5 * time.Second
+	p.MaxHeldConns = 1
+
+	var up int32
+	dial := p.withHold(switchDialer(&up))
+
+	result := make(chan error, 1)
+	go func() {
+		conn, err := dial()
+		if err == nil {
+			conn.Close()
+		}
+		result <- err
+	}()
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&p.held) == 1 }, time.Second, time.Millisecond, "should hold connection")
+
+	start := time.Now()
+	_, err := dial()
+	assert.NotNil(t, err, "should not hold more than MaxHeldConns connections")
+	assert.True(t, time.Since(start) < time.Second, "should fail right away over the limit")
+
+	atomic.StoreInt32(&up, 1)
+	select {
+	case err := <-result:
+		assert.Nil(t, err, "should connect once backend is available")
+	case <-time.After(time.Second):
+		t.Error("held connection should connect once backend is available")
+	}
+	assert.Equal(t, int64(0), atomic.LoadInt64(&p.held), "should release held connection")
+}
+
+func TestHoldTimeout(t *testing.T) {
+	p := New(nil, time.Second, nil, &testLogger{}, LogEverything, false)
+	p.HoldTimeout = 50 * time.Millisecond
+
+	var up int32
+	start := time.Now()
+	_, err := p.withHold(switchDialer(&up))()
+	assert.NotNil(t, err, "should fail if backend doesn't come back in time")
+	assert.True(t, time.Since(start) >= p.HoldTimeout, "should hold connection until timeout")
+}
+
+func TestHoldDisabled(t *testing.T) {
+	p := New(nil, time.Second, nil, &testLogger{}, LogEverything, false)
+
+	var up int32
+	_, err := p.withHold(switchDialer(&up))()
+	assert.NotNil(t, err, "should not hold connections by default")
+	assert.Equal(t, int64(0), atomic.LoadInt64(&p.held))
+}
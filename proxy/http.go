@@ -0,0 +1,426 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/square/ghostunnel/tracing"
+	"golang.org/x/net/http2"
+)
+
+var (
+	httpRequestCounter = metrics.GetOrRegisterCounter("http.requests", metrics.DefaultRegistry)
+	httpDeniedCounter  = metrics.GetOrRegisterCounter("http.denied", metrics.DefaultRegistry)
+	httpErrorCounter   = metrics.GetOrRegisterCounter("http.errors", metrics.DefaultRegistry)
+	httpRequestTimer   = metrics.GetOrRegisterTimer("http.request", metrics.DefaultRegistry)
+)
+
+// Headers with information about the client certificate, set on requests in
+// HTTP mode with IdentityHeaders. Clients can't set these themselves, any
+// values sent by clients are removed.
+const (
+	HeaderClientCN      = "X-Client-CN"
+	HeaderClientURISAN  = "X-Client-URI-SAN"
+	HeaderClientDNSSAN  = "X-Client-DNS-SAN"
+	HeaderForwardedCert = "X-Forwarded-Client-Cert"
+)
+
+// HTTPConfig enables parsing HTTP requests on connections (HTTP/1.1, or
+// HTTP/2 if negotiated with ALPN), and forwarding them to the backend with a
+// reverse proxy instead of as opaque streams. Each request is logged (with
+// LogConnections) and counted in metrics.
+type HTTPConfig struct {
+	// IdentityHeaders adds headers with the identity of the client to
+	// requests (see HeaderClientCN etc.).
+	IdentityHeaders bool
+	// ChannelBinding adds the tls-exporter channel binding of the client
+	// connection to requests (see HeaderChannelBinding).
+	ChannelBinding bool
+	// Rules restrict access to paths. For each request, the rule with the
+	// longest matching path prefix applies, requests for paths without
+	// matching rules are allowed. Prefixes match on segment boundaries, so
+	// /admin covers /admin and /admin/x, but not /administrator. Requests
+	// for paths that aren't canonical (with dot segments or doubled slashes)
+	// are rejected if there are rules, since backends may resolve them to
+	// other paths.
+	Rules []HTTPRule
+}
+
+// HTTPRule restricts access to requests for paths starting with PathPrefix
+// to clients that Verify accepts.
+type HTTPRule struct {
+	PathPrefix string
+	// Verify returns an error if the client with the given TLS connection
+	// state (nil if not TLS) isn't allowed access.
+	Verify func(state *tls.ConnectionState) error
+}
+
+// authorize checks the rule with the longest matching path prefix.
+func (c *HTTPConfig) authorize(path string, state *tls.ConnectionState) error {
+	var match *HTTPRule
+	for i, rule := range c.Rules {
+		if matchesPathPrefix(path, rule.PathPrefix) && (match == nil || len(rule.PathPrefix) > len(match.PathPrefix)) {
+			match = &c.Rules[i]
+		}
+	}
+	if match == nil {
+		return nil
+	}
+	return match.Verify(state)
+}
+
+// matchesPathPrefix checks if the path is the prefix, or below it.
+func matchesPathPrefix(p, prefix string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	return len(p) == len(prefix) || strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/'
+}
+
+// canonicalPath checks if the path is absolute and already clean, i.e.
+// without dot segments or doubled slashes (a trailing slash is kept).
+func canonicalPath(p string) bool {
+	if !strings.HasPrefix(p, "/") {
+		return false
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean == p
+}
+
+// serveHTTP serves HTTP requests on a connection, and forwards them to the
+// backend. Returns once the connection is closed.
+func (p *Proxy) serveHTTP(conn net.Conn, identity, listenerName string, span *tracing.Span) {
+	dial := p.dialerFor(conn)
+	backend := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialSpan := p.Tracer.Start("dial-backend", tracing.KindClient, span)
+			defer dialSpan.End()
+			dialStart := time.Now()
+			conn, err := dial()
+			p.Histograms.observeDial(listenerName, dialStart, err)
+			dialSpan.SetError(err)
+			return conn, err
+		},
+		MaxIdleConnsPerHost: httpMaxIdleBackendConns,
+		IdleConnTimeout:     p.ConnectTimeout,
+	}
+	defer backend.CloseIdleConnections()
+
+	var state *tls.ConnectionState
+	if tlsConn, ok := conn.(secureConn); ok {
+		cs := tlsConn.ConnectionState()
+		state = &cs
+	}
+	var binding string
+	if p.HTTP.ChannelBinding {
+		var err error
+		binding, err = ChannelBinding(conn)
+		if err != nil {
+			p.logConditional(LogConnectionErrors, "no channel binding for connection from %s: %s", conn.RemoteAddr(), err)
+		}
+	}
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = req.Host
+			if req.URL.Host == "" {
+				// HTTP/1.0 requests may not have a Host header
+				req.URL.Host = "localhost"
+			}
+			if p.HTTP.IdentityHeaders {
+				setIdentityHeaders(req.Header, state)
+			}
+			if p.HTTP.ChannelBinding {
+				req.Header.Del(HeaderChannelBinding)
+				if binding != "" {
+					req.Header.Set(HeaderChannelBinding, binding)
+				}
+			}
+		},
+		Transport: backend,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			httpErrorCounter.Inc(1)
+			span.SetError(err)
+			p.logConditional(LogConnectionErrors, "error forwarding request from %s: %s", conn.RemoteAddr(), err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		if len(p.HTTP.Rules) > 0 && !canonicalPath(req.URL.Path) && !(req.Method == http.MethodOptions && req.URL.Path == "*") {
+			httpDeniedCounter.Inc(1)
+			p.logConditional(LogHandshakeErrors, "rejecting request from %s: non-canonical path %q", conn.RemoteAddr(), req.URL.Path)
+			http.Error(recorder, "bad request", http.StatusBadRequest)
+		} else if err := p.HTTP.authorize(req.URL.Path, state); err != nil {
+			httpDeniedCounter.Inc(1)
+			p.logConditional(LogHandshakeErrors, "rejecting request from %s: access denied for %s to %s: %s", conn.RemoteAddr(), identity, req.URL.Path, err)
+			http.Error(recorder, "forbidden", http.StatusForbidden)
+		} else {
+			reverseProxy.ServeHTTP(recorder, req)
+		}
+		httpRequestCounter.Inc(1)
+		httpRequestTimer.UpdateSince(start)
+		p.Histograms.observeRequest(listenerName, start, recorder.status)
+		p.logRequest(conn, identity, req, recorder.status, start)
+	})
+
+	successCounter.Inc(1)
+	p.IdentityMetrics.observeConnection(identity)
+
+	server := &http.Server{
+		Handler:  handler,
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	if state != nil && state.NegotiatedProtocol == http2.NextProtoTLS {
+		h2 := &http2.Server{}
+		http2.ConfigureServer(server, h2)
+		if !p.addHTTPServer(server) {
+			return
+		}
+		defer p.removeHTTPServer(server)
+		h2.ServeConn(conn, &http2.ServeConnOpts{BaseConfig: server, Handler: handler})
+		return
+	}
+
+	// Serve only this connection, and wait until it's closed (Serve returns
+	// early if the server is shut down)
+	listener := newConnListener(conn)
+	done := make(chan struct{})
+	once := &sync.Once{}
+	server.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			once.Do(func() { close(done) })
+			listener.Close()
+		}
+	}
+	if !p.addHTTPServer(server) {
+		return
+	}
+	defer p.removeHTTPServer(server)
+	server.Serve(listener)
+	if listener.accepted() {
+		<-done
+	}
+}
+
+// Idle connections to the backend to keep per client connection, for
+// requests from HTTP/2 clients that send several requests at once.
+const httpMaxIdleBackendConns = 4
+
+// logRequest logs a request in HTTP mode (with LogConnections), and sends it
+// to the access log.
+func (p *Proxy) logRequest(conn net.Conn, identity string, req *http.Request, status int, start time.Time) {
+	fields := map[string]interface{}{
+		"client_addr":  conn.RemoteAddr().String(),
+		"identity":     identity,
+		"method":       req.Method,
+		"path":         req.URL.Path,
+		"proto":        req.Proto,
+		"host":         req.Host,
+		"status":       status,
+		"start_time":   start.Format(time.RFC3339Nano),
+		"duration_ms":  time.Since(start).Nanoseconds() / int64(time.Millisecond),
+		"request_type": "http",
+	}
+	if p.AccessLog != nil {
+		p.AccessLog.LogAccess(fields)
+	}
+	if (p.loggerFlags&LogConnections) == 0 || !p.logLimiter.allow(LogConnections) {
+		return
+	}
+	if fieldLogger, ok := p.Logger.(FieldLogger); ok {
+		fieldLogger.LogFields("request", fields)
+		return
+	}
+	p.Logger.Printf("request from %s [%s]: %s %s %s -> %d (%s)", conn.RemoteAddr(), identity, req.Method, req.URL.Path, req.Proto, status, time.Since(start))
+}
+
+// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush supports streaming responses.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack supports protocol upgrades (e.g. WebSockets) on HTTP/1.1.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return hijacker.Hijack()
+}
+
+// addHTTPServer tracks a server for an HTTP connection, unless the proxy is
+// shutting down.
+func (p *Proxy) addHTTPServer(server *http.Server) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.LoadInt32(&p.quit) == 1 {
+		return false
+	}
+	if p.httpServers == nil {
+		p.httpServers = map[*http.Server]bool{}
+	}
+	p.httpServers[server] = true
+	return true
+}
+
+func (p *Proxy) removeHTTPServer(server *http.Server) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.httpServers, server)
+}
+
+// shutdownHTTPServers closes idle HTTP connections, and closes others once
+// their current request is done (or sends GOAWAY on HTTP/2). Called with
+// p.mu held.
+func (p *Proxy) shutdownHTTPServers() {
+	for server := range p.httpServers {
+		go server.Shutdown(context.Background())
+	}
+}
+
+// setIdentityHeaders sets headers with the identity of the client from the
+// TLS connection state (if any), replacing values sent by the client.
+func setIdentityHeaders(header http.Header, state *tls.ConnectionState) {
+	for _, name := range []string{HeaderClientCN, HeaderClientURISAN, HeaderClientDNSSAN, HeaderForwardedCert} {
+		header.Del(name)
+	}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	uris := []string{}
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	if cert.Subject.CommonName != "" {
+		header.Set(HeaderClientCN, cert.Subject.CommonName)
+	}
+	if len(uris) > 0 {
+		header.Set(HeaderClientURISAN, strings.Join(uris, ","))
+	}
+	if len(cert.DNSNames) > 0 {
+		header.Set(HeaderClientDNSSAN, strings.Join(cert.DNSNames, ","))
+	}
+	header.Set(HeaderForwardedCert, forwardedClientCert(cert, uris))
+}
+
+// forwardedClientCert formats a client certificate like Envoy's
+// x-forwarded-client-cert header: Hash, Cert (URL-encoded PEM), Subject,
+// URI and DNS elements, separated by semicolons.
+func forwardedClientCert(cert *x509.Certificate, uris []string) string {
+	hash := sha256.Sum256(cert.Raw)
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	parts := []string{
+		"Hash=" + hex.EncodeToString(hash[:]),
+		"Cert=" + fmt.Sprintf("%q", url.QueryEscape(string(pemCert))),
+		"Subject=" + fmt.Sprintf("%q", cert.Subject.String()),
+	}
+	for _, uri := range uris {
+		parts = append(parts, "URI="+uri)
+	}
+	for _, name := range cert.DNSNames {
+		parts = append(parts, "DNS="+name)
+	}
+	return strings.Join(parts, ";")
+}
+
+// connListener is a listener that returns a single connection, for serving
+// one connection with an http.Server.
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+	mu     sync.Mutex
+	used   bool
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan struct{})}
+}
+
+// Accept returns the connection on the first call, and blocks until the
+// listener is closed afterwards.
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if !l.used {
+		l.used = true
+		l.mu.Unlock()
+		return l.conn, nil
+	}
+	l.mu.Unlock()
+	<-l.closed
+	return nil, &net.OpError{Op: "accept", Net: l.conn.LocalAddr().Network(), Err: net.ErrClosed}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// accepted returns true if the connection was returned from Accept.
+func (l *connListener) accepted() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used
+}
@@ -0,0 +1,65 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/square/ghostunnel/tracing"
+	"github.com/square/ghostunnel/transport"
+	"golang.org/x/net/http2"
+)
+
+// serveHTTP2 serves HTTP/2 CONNECT tunnels on a connection, and forwards
+// each of them to the backend. Returns once the connection is closed, or
+// after shutdown once all tunnels are done.
+func (p *Proxy) serveHTTP2(conn net.Conn, identity, listenerName string, span *tracing.Span) {
+	p.mu.Lock()
+	if atomic.LoadInt32(&p.quit) == 1 {
+		p.mu.Unlock()
+		return
+	}
+	if p.http2Server == nil {
+		// The base server is only used to tell connections to go away on
+		// shutdown (see goAway).
+		p.http2Base = &http.Server{}
+		p.http2Server = &http2.Server{}
+		http2.ConfigureServer(p.http2Base, p.http2Server)
+	}
+	server, base := p.http2Server, p.http2Base
+	p.mu.Unlock()
+
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		BaseConfig: base,
+		Handler: transport.HTTP2Handler(conn, func(tunnel net.Conn) {
+			streamSpan := p.Tracer.Start("http2-stream", tracing.KindServer, span)
+			defer streamSpan.End()
+			p.forward(tunnel, identity, listenerName, streamSpan, time.Now())
+		}),
+	})
+}
+
+// shutdownHTTP2 sends GOAWAY on HTTP/2 connections, called with p.mu held.
+func (p *Proxy) shutdownHTTP2() {
+	if p.http2Base != nil {
+		go p.http2Base.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,249 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClientCert creates a self-signed client certificate.
+func newTestClientCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+	uri, _ := url.Parse("spiffe://example.com/client")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		DNSNames:     []string{"client.example.com"},
+		URIs:         []*url.URL{uri},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHTTPIdentityHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Backend-CN", r.Header.Get(HeaderClientCN))
+		w.Header().Set("Backend-URI", r.Header.Get(HeaderClientURISAN))
+		w.Header().Set("Backend-DNS", r.Header.Get(HeaderClientDNSSAN))
+		w.Header().Set("Backend-XFCC", r.Header.Get(HeaderForwardedCert))
+		w.Header().Set("Backend-Path", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	incoming, addr := newTestTLSListener(t, &tls.Config{ClientAuth: tls.RequireAnyClientCert})
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	}
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.HTTP = &HTTPConfig{IdentityHeaders: true}
+	go p.Accept()
+
+	dials := 0
+	client := &http.Client{Transport: &http.Transport{
+		DialTLS: func(network, address string) (net.Conn, error) {
+			dials++
+			return tls.Dial(network, address, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{newTestClientCert(t)}})
+		},
+	}}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "https://"+addr+"/path", nil)
+		req.Header.Set(HeaderClientCN, "spoofed")
+		resp, err := client.Do(req)
+		assert.Nil(t, err, "should forward request")
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, "client", resp.Header.Get("Backend-CN"), "should set CN header (replacing spoofed value)")
+		assert.Equal(t, "spiffe://example.com/client", resp.Header.Get("Backend-URI"))
+		assert.Equal(t, "client.example.com", resp.Header.Get("Backend-DNS"))
+		assert.Contains(t, resp.Header.Get("Backend-XFCC"), "Subject=\"CN=client\"")
+		assert.Contains(t, resp.Header.Get("Backend-XFCC"), "URI=spiffe://example.com/client")
+		assert.Equal(t, "/path", resp.Header.Get("Backend-Path"))
+	}
+	assert.Equal(t, 1, dials, "should keep connection alive across requests")
+
+	// Shutdown closes idle HTTP connections
+	p.Shutdown()
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("proxy should shut down once requests are done")
+	}
+}
+
+func TestHTTPBackendError(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+	dialer := func() (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Err: errTooManyConns}
+	}
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.HTTP = &HTTPConfig{}
+	go p.Accept()
+	defer p.Shutdown()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + addr + "/")
+	assert.Nil(t, err, "should get response")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "should return bad gateway if backend is unreachable")
+}
+
+func TestSetIdentityHeadersNoCert(t *testing.T) {
+	header := http.Header{}
+	header.Set(HeaderClientCN, "spoofed")
+	header.Set(HeaderForwardedCert, "spoofed")
+	setIdentityHeaders(header, &tls.ConnectionState{})
+	assert.Empty(t, header.Get(HeaderClientCN), "should remove spoofed headers")
+	assert.Empty(t, header.Get(HeaderForwardedCert), "should remove spoofed headers")
+}
+
+// newTestHTTPBackend starts a backend that responds with the request path
+// and protocol, and returns a dialer for it.
+func newTestHTTPBackend(t *testing.T) (*httptest.Server, Dialer) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Backend-Path", r.URL.Path)
+	}))
+	return backend, func() (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	}
+}
+
+func TestHTTPRules(t *testing.T) {
+	backend, dialer := newTestHTTPBackend(t)
+	defer backend.Close()
+
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+	accessLog := &testAccessLogger{entries: make(chan map[string]interface{}, 10)}
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.AccessLog = accessLog
+	p.HTTP = &HTTPConfig{Rules: []HTTPRule{
+		{PathPrefix: "/admin/", Verify: func(state *tls.ConnectionState) error { return errors.New("denied") }},
+		{PathPrefix: "/admin/public/", Verify: func(state *tls.ConnectionState) error { return nil }},
+	}}
+	go p.Accept()
+	defer p.Shutdown()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for path, status := range map[string]int{
+		"/admin/secret":    http.StatusForbidden,
+		"/admin/public/ok": http.StatusOK,
+		"/other":           http.StatusOK,
+	} {
+		resp, err := client.Get("https://" + addr + path)
+		assert.Nil(t, err, "should get response")
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, "unexpected status for %s", path)
+
+		entry := <-accessLog.entries
+		assert.Equal(t, path, entry["path"], "should log request path")
+		assert.Equal(t, status, entry["status"], "should log response status")
+	}
+
+	// Paths backends may resolve to /admin/... are rejected (sent raw, as
+	// clients may clean them)
+	for _, path := range []string{"/admin/public/../secret", "/./admin/secret", "//admin/secret", "/admin//secret"} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		assert.Nil(t, err, "should connect")
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", path)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		assert.Nil(t, err, "should get response")
+		resp.Body.Close()
+		conn.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "should reject non-canonical path %s", path)
+		<-accessLog.entries
+	}
+}
+
+func TestHTTPRulePrefixes(t *testing.T) {
+	denied := errors.New("denied")
+	config := &HTTPConfig{Rules: []HTTPRule{
+		{PathPrefix: "/admin", Verify: func(state *tls.ConnectionState) error { return denied }},
+		{PathPrefix: "/public/", Verify: func(state *tls.ConnectionState) error { return nil }},
+	}}
+	assert.Equal(t, denied, config.authorize("/admin", nil), "should match prefix")
+	assert.Equal(t, denied, config.authorize("/admin/", nil), "should match below prefix")
+	assert.Equal(t, denied, config.authorize("/admin/x", nil), "should match below prefix")
+	assert.Nil(t, config.authorize("/administrator", nil), "should not match sibling path")
+	assert.Nil(t, config.authorize("/public/x", nil), "should match prefix with slash")
+
+	assert.True(t, canonicalPath("/"))
+	assert.True(t, canonicalPath("/admin/"))
+	assert.True(t, canonicalPath("/admin/x.y"))
+	for _, path := range []string{"", "admin", "/public/../admin", "/./admin", "//admin", "/admin/.", "/admin/..", "/admin//"} {
+		assert.False(t, canonicalPath(path), "should not be canonical: %s", path)
+	}
+}
+
+func TestHTTP2Requests(t *testing.T) {
+	backend, dialer := newTestHTTPBackend(t)
+	defer backend.Close()
+
+	incoming, addr := newTestTLSListener(t, &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}})
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.HTTP = &HTTPConfig{}
+	go p.Accept()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + addr + "/h2")
+	assert.Nil(t, err, "should get response")
+	resp.Body.Close()
+	assert.Equal(t, "HTTP/2.0", resp.Proto, "should serve HTTP/2")
+	assert.Equal(t, "/h2", resp.Header.Get("Backend-Path"), "should forward request to backend")
+
+	// Shutdown sends GOAWAY on HTTP/2 connections
+	p.Shutdown()
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("proxy should shut down once requests are done")
+	}
+}
@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Label value for identities beyond the cardinality cap.
+const otherIdentity = "other"
+
+// IdentityMetrics holds Prometheus counters for connections and bytes
+// transferred, labeled by client identity (see clientIdentity). To bound the
+// number of time series, only the first maxIdentities distinct identities get
+// their own label, all others are counted under "other".
+type IdentityMetrics struct {
+	maxIdentities int
+
+	mu         sync.Mutex
+	identities map[string]bool
+
+	conns    *prometheus.CounterVec
+	bytesIn  *prometheus.CounterVec
+	bytesOut *prometheus.CounterVec
+}
+
+// NewIdentityMetrics creates per-identity counters and registers them with
+// the given registerer. Metric names are prefixed with the given namespace.
+func NewIdentityMetrics(namespace string, maxIdentities int, registerer prometheus.Registerer) (*IdentityMetrics, error) {
+	namespace = metricNamespace(namespace)
+	labels := []string{"identity"}
+
+	m := &IdentityMetrics{
+		maxIdentities: maxIdentities,
+		identities:    map[string]bool{},
+		conns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_connections_total",
+			Help:      "Number of proxied connections, by client identity.",
+		}, labels),
+		bytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_received_bytes_total",
+			Help:      "Bytes received from clients on closed connections, by client identity.",
+		}, labels),
+		bytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_sent_bytes_total",
+			Help:      "Bytes sent to clients on closed connections, by client identity.",
+		}, labels),
+	}
+
+	for _, vec := range []**prometheus.CounterVec{&m.conns, &m.bytesIn, &m.bytesOut} {
+		c, err := register(registerer, *vec)
+		if err != nil {
+			return nil, err
+		}
+		*vec = c.(*prometheus.CounterVec)
+	}
+	return m, nil
+}
+
+// label returns the label value to use for the given identity.
+func (m *IdentityMetrics) label(identity string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.identities[identity] {
+		return identity
+	}
+	if len(m.identities) < m.maxIdentities {
+		m.identities[identity] = true
+		return identity
+	}
+	return otherIdentity
+}
+
+func (m *IdentityMetrics) observeConnection(identity string) {
+	if m == nil {
+		return
+	}
+	m.conns.WithLabelValues(m.label(identity)).Inc()
+}
+
+func (m *IdentityMetrics) observeTransfer(identity string, info *connInfo) {
+	if m == nil {
+		return
+	}
+	label := m.label(identity)
+	m.bytesIn.WithLabelValues(label).Add(float64(info.bytesIn))
+	m.bytesOut.WithLabelValues(label).Add(float64(info.bytesOut))
+}
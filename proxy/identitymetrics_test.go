@@ -0,0 +1,86 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// counterValues returns the value for each identity label of the given counter.
+func counterValues(t *testing.T, registry *prometheus.Registry, name string) map[string]float64 {
+	return labeledCounterValues(t, registry, name, "identity")
+}
+
+// labeledCounterValues returns the value for each value of the given label of
+// the given counter.
+func labeledCounterValues(t *testing.T, registry *prometheus.Registry, name, labelName string) map[string]float64 {
+	families, err := registry.Gather()
+	assert.Nil(t, err, "should be able to gather metrics")
+
+	values := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == labelName {
+					values[label.GetValue()] = metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return values
+}
+
+func TestIdentityMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := NewIdentityMetrics("test", 2, registry)
+	assert.Nil(t, err, "should be able to register metrics")
+
+	m.observeConnection("spiffe://example.com/a")
+	m.observeConnection("spiffe://example.com/b")
+	m.observeConnection("spiffe://example.com/a")
+	m.observeConnection("spiffe://example.com/c")
+	m.observeTransfer("spiffe://example.com/a", &connInfo{bytesIn: 10, bytesOut: 20})
+	m.observeTransfer("spiffe://example.com/c", &connInfo{bytesIn: 1, bytesOut: 2})
+
+	assert.Equal(t, map[string]float64{
+		"spiffe://example.com/a": 2,
+		"spiffe://example.com/b": 1,
+		"other":                  1,
+	}, counterValues(t, registry, "test_client_connections_total"), "should cap number of identities")
+	assert.Equal(t, map[string]float64{
+		"spiffe://example.com/a": 10,
+		"other":                  1,
+	}, counterValues(t, registry, "test_client_received_bytes_total"))
+	assert.Equal(t, map[string]float64{
+		"spiffe://example.com/a": 20,
+		"other":                  2,
+	}, counterValues(t, registry, "test_client_sent_bytes_total"))
+}
+
+func TestIdentityMetricsDisabled(t *testing.T) {
+	var m *IdentityMetrics
+
+	// Should not panic
+	m.observeConnection("client")
+	m.observeTransfer("client", &connInfo{})
+}
@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var errIdleTimeout = errors.New("connection idle timeout")
+
+// idleTracker keeps track of the last time data was read in either direction
+// of a proxied connection. A nil idleTracker never expires.
+type idleTracker struct {
+	timeout time.Duration
+	// Time of last activity (unix nanos)
+	last int64
+	// Set to 1 once the connection has expired
+	done int32
+}
+
+// newIdleTracker creates a tracker that expires connections after timeout
+// without activity. Returns nil if timeout is not positive.
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	if timeout <= 0 {
+		return nil
+	}
+	return &idleTracker{
+		timeout: timeout,
+		last:    time.Now().UnixNano(),
+	}
+}
+
+func (t *idleTracker) touch() {
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+func (t *idleTracker) deadline() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.last)).Add(t.timeout)
+}
+
+// expired returns true if a connection was closed due to the idle timeout.
+func (t *idleTracker) expired() bool {
+	return t != nil && atomic.LoadInt32(&t.done) == 1
+}
+
+// idleReader reads from a connection, returning errIdleTimeout if there has
+// been no activity on the tracker for the timeout duration.
+type idleReader struct {
+	conn    net.Conn
+	tracker *idleTracker
+}
+
+func (t *idleTracker) reader(conn net.Conn) *idleReader {
+	return &idleReader{conn: conn, tracker: t}
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	for {
+		err := r.conn.SetReadDeadline(r.tracker.deadline())
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := r.conn.Read(b)
+		if n > 0 {
+			r.tracker.touch()
+		}
+
+		netErr, ok := err.(net.Error)
+		if n == 0 && ok && netErr.Timeout() {
+			// Other direction may have seen activity in the meantime.
+			if time.Now().Before(r.tracker.deadline()) {
+				continue
+			}
+			atomic.StoreInt32(&r.tracker.done, 1)
+			return 0, errIdleTimeout
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,69 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyIdleTimeout(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.IdleTimeout = 300 * time.Millisecond
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	// Data in one direction only should keep the connection open
+	buf := make([]byte, 1)
+	for i := 0; i < 6; i++ {
+		_, err = src.Write([]byte("A"))
+		assert.Nil(t, err, "should be able to write to proxy")
+		_, err = io.ReadFull(dst, buf)
+		assert.Nil(t, err, "connection with activity should stay open")
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Without activity, connection should be closed
+	start := time.Now()
+	dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = dst.Read(buf)
+	assert.Equal(t, io.EOF, err, "idle connection should be closed")
+	assert.True(t, time.Since(start) < 2*time.Second, "idle connection should be closed after timeout")
+}
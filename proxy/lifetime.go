@@ -0,0 +1,57 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var lifetimeCounter = metrics.GetOrRegisterCounter("conn.maxlifetime", metrics.DefaultRegistry)
+
+// connLifetime returns the maximum lifetime for a new connection, with a
+// random jitter applied (zero means no limit).
+func (p *Proxy) connLifetime() time.Duration {
+	if p.MaxConnLifetime <= 0 {
+		return 0
+	}
+	lifetime := p.MaxConnLifetime
+	if p.MaxConnLifetimeJitter > 0 && p.MaxConnLifetimeJitter < lifetime {
+		lifetime -= time.Duration(rand.Int63n(int64(p.MaxConnLifetimeJitter)))
+	}
+	return lifetime
+}
+
+// enforceLifetime closes a connection once it reaches its maximum lifetime,
+// counted from the given start time. Closing the connection also ends all
+// multiplexed streams and tunnels carried over it. Call the returned function
+// once the connection is done, to stop the timer.
+func (p *Proxy) enforceLifetime(conn net.Conn, identity string, start time.Time) (stop func()) {
+	lifetime := p.connLifetime()
+	if lifetime <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(lifetime-time.Since(start), func() {
+		lifetimeCounter.Inc(1)
+		p.logConditional(LogConnections, "closing connection from %s (%s): maximum lifetime of %s reached", conn.RemoteAddr(), identity, lifetime)
+		conn.Close()
+	})
+	return func() { timer.Stop() }
+}
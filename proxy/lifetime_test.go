@@ -0,0 +1,72 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLifetimeJitter(t *testing.T) {
+	p := &Proxy{}
+	assert.Equal(t, time.Duration(0), p.connLifetime(), "should not limit lifetime by default")
+
+	p.MaxConnLifetime = time.Minute
+	assert.Equal(t, time.Minute, p.connLifetime(), "should use lifetime without jitter")
+
+	p.MaxConnLifetimeJitter = 10 * time.Second
+	for i := 0; i < 100; i++ {
+		lifetime := p.connLifetime()
+		assert.True(t, lifetime > 50*time.Second && lifetime <= time.Minute, "should apply jitter within bounds")
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+	backend := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go echoConn(server)
+		return client, nil
+	}
+	p := New([]net.Listener{incoming}, 10*time.Second, backend, &testLogger{}, LogEverything, false)
+	p.MaxConnLifetime = 200 * time.Millisecond
+	go p.Accept()
+	defer p.Shutdown()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "should connect")
+	defer conn.Close()
+	start := time.Now()
+
+	// Keep the connection active, it should still be closed
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err = conn.Write([]byte("x")); err != nil {
+			break
+		}
+		if _, err = conn.Read(make([]byte, 1)); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 150*time.Millisecond && elapsed < 2*time.Second, "should close connection after maximum lifetime")
+}
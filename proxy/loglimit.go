@@ -0,0 +1,89 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Interval at which the number of suppressed log messages is logged.
+const logSummaryInterval = 10 * time.Second
+
+var suppressedCounter = metrics.GetOrRegisterCounter("log.suppressed", metrics.DefaultRegistry)
+
+// Names of log message classes, for summaries.
+var logClassNames = map[int]string{
+	LogConnections:      "connections",
+	LogConnectionErrors: "connection errors",
+	LogHandshakeErrors:  "handshake errors",
+}
+
+// logLimiter limits the rate of log messages for each class (LogConnections,
+// LogConnectionErrors and LogHandshakeErrors), so floods of connections (e.g.
+// from port scans) can't fill up disks. Messages over the limit are dropped
+// and counted, and a summary is logged for each class with dropped messages
+// once per logSummaryInterval. A nil logLimiter allows everything.
+type logLimiter struct {
+	rate   *rateLimiter
+	logger Logger
+
+	mu         sync.Mutex
+	suppressed map[int]int64
+}
+
+// newLogLimiter creates a limiter allowing the given number of messages per
+// second for each class. Returns nil if rate is not positive.
+func newLogLimiter(rate float64, logger Logger) *logLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &logLimiter{
+		rate:       newRateLimiter(rate),
+		logger:     logger,
+		suppressed: map[int]int64{},
+	}
+}
+
+// allow returns true if a message of the given class can be logged.
+func (l *logLimiter) allow(class int) bool {
+	if l == nil || l.rate.allow(logClassNames[class]) {
+		return true
+	}
+
+	suppressedCounter.Inc(1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.suppressed[class]++
+	if l.suppressed[class] == 1 {
+		time.AfterFunc(logSummaryInterval, func() { l.summarize(class) })
+	}
+	return false
+}
+
+func (l *logLimiter) summarize(class int) {
+	l.mu.Lock()
+	count := l.suppressed[class]
+	delete(l.suppressed, class)
+	l.mu.Unlock()
+	if count == 0 {
+		return
+	}
+	l.logger.Printf("suppressed %d log messages about %s in the last %s (log rate limit exceeded)", count, logClassNames[class], logSummaryInterval)
+}
@@ -0,0 +1,68 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestLogLimiter(t *testing.T) {
+	now := time.Now()
+	logger := &recordingLogger{}
+	p := New(nil, time.Second, nil, logger, LogEverything, false)
+	p.logLimiter = newLogLimiter(2, logger)
+	p.logLimiter.rate.now = func() time.Time { return now }
+
+	before := suppressedCounter.Count()
+	for i := 0; i < 5; i++ {
+		p.logConditional(LogHandshakeErrors, "error on TLS handshake %d", i)
+	}
+	p.logConditional(LogConnectionErrors, "error during copy")
+	assert.Equal(t, []string{"error on TLS handshake 0", "error on TLS handshake 1", "error during copy"}, logger.messages, "should limit each class separately")
+	assert.Equal(t, int64(3), suppressedCounter.Count()-before, "should count suppressed messages")
+
+	p.logLimiter.summarize(LogHandshakeErrors)
+	assert.Equal(t, "suppressed 3 log messages about handshake errors in the last 10s (log rate limit exceeded)", logger.messages[3], "should summarize suppressed messages")
+	p.logLimiter.summarize(LogHandshakeErrors)
+	assert.Len(t, logger.messages, 4, "should not summarize again without suppressed messages")
+
+	now = now.Add(time.Second)
+	p.logConditional(LogHandshakeErrors, "error on TLS handshake")
+	assert.Len(t, logger.messages, 5, "should allow messages again after a while")
+}
+
+func TestLogLimiterDisabled(t *testing.T) {
+	limiter := newLogLimiter(0, &testLogger{})
+	assert.Nil(t, limiter, "zero rate should disable limiter")
+	assert.True(t, limiter.allow(LogConnections), "disabled limiter should allow everything")
+}
@@ -0,0 +1,198 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	mirrorDroppedCounter = metrics.GetOrRegisterCounter("mirror.dropped", metrics.DefaultRegistry)
+	mirrorErrorCounter   = metrics.GetOrRegisterCounter("mirror.errors", metrics.DefaultRegistry)
+)
+
+// Directions of proxied data to mirror.
+const (
+	// MirrorFromClient mirrors data sent by clients to the target.
+	MirrorFromClient = 1
+	// MirrorFromTarget mirrors data sent by the target to clients.
+	MirrorFromTarget = 2
+	// MirrorBoth mirrors data in both directions.
+	MirrorBoth = MirrorFromClient | MirrorFromTarget
+)
+
+// Number of chunks of data (one per read) queued for each mirror connection,
+// or for the pcap file. Data is dropped once the queue is full.
+const mirrorQueueSize = 256
+
+// Timeout for writes to mirror connections, so that a stuck mirror doesn't
+// keep its connection around forever.
+const mirrorWriteTimeout = 10 * time.Second
+
+// Mirror duplicates data of proxied connections (after TLS is terminated) to
+// a secondary target or a pcap file, e.g. for an IDS that shouldn't be
+// inline. Mirroring is asynchronous and never slows down proxied
+// connections: data is queued, and dropped (counted in mirror.dropped) if
+// the mirror can't keep up.
+type Mirror struct {
+	directions int
+	dial       Dialer
+	pcap       *pcapWriter
+}
+
+// NewMirrorDialer creates a mirror that sends data to connections from dial:
+// one connection for each mirrored direction of each proxied connection,
+// opened once the proxied connection is established.
+func NewMirrorDialer(dial Dialer, directions int) *Mirror {
+	return &Mirror{directions: directions, dial: dial}
+}
+
+// NewPcapMirror creates a mirror that writes data to writer as a pcap
+// capture, with synthetic TCP segments (UDP datagrams for UDP listeners)
+// between the address of the client and the address it connected to. Close
+// must be called once all proxied connections are closed.
+func NewPcapMirror(writer io.Writer, directions int) (*Mirror, error) {
+	pcap, err := newPcapWriter(writer)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{directions: directions, pcap: pcap}, nil
+}
+
+// Close waits for queued packets to be written to the pcap file, and stops
+// writing to it. Does nothing for mirrors with a dialer.
+func (m *Mirror) Close() {
+	if m.pcap != nil {
+		m.pcap.close()
+	}
+}
+
+// mirrorStream receives mirrored data for one direction of a connection.
+// Implementations must not block, or keep a reference to the data.
+type mirrorStream interface {
+	mirror(b []byte)
+}
+
+// mirrorSession holds the streams for a proxied connection (nil for
+// directions that aren't mirrored).
+type mirrorSession struct {
+	fromClient mirrorStream
+	fromTarget mirrorStream
+	close      func()
+}
+
+// open starts mirroring a connection from a client. The id of the connection
+// may be used to tell apart connections without IP addresses.
+func (m *Mirror) open(client net.Conn, id uint64) *mirrorSession {
+	session := &mirrorSession{}
+	if m.pcap != nil {
+		conn := newPcapConn(m.pcap, client, id)
+		if m.directions&MirrorFromClient != 0 {
+			session.fromClient = &pcapStream{conn: conn, from: 0}
+		}
+		if m.directions&MirrorFromTarget != 0 {
+			session.fromTarget = &pcapStream{conn: conn, from: 1}
+		}
+		session.close = conn.close
+		return session
+	}
+
+	var conns []*mirrorConn
+	if m.directions&MirrorFromClient != 0 {
+		conn := newMirrorConn(m.dial)
+		session.fromClient = conn
+		conns = append(conns, conn)
+	}
+	if m.directions&MirrorFromTarget != 0 {
+		conn := newMirrorConn(m.dial)
+		session.fromTarget = conn
+		conns = append(conns, conn)
+	}
+	session.close = func() {
+		for _, conn := range conns {
+			conn.close()
+		}
+	}
+	return session
+}
+
+// mirrorReader passes data read from the underlying reader to a mirror
+// stream.
+type mirrorReader struct {
+	reader io.Reader
+	stream mirrorStream
+}
+
+func (r *mirrorReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		r.stream.mirror(b[:n])
+	}
+	return n, err
+}
+
+// mirrorConn sends mirrored data to a connection from a dialer, which is
+// established in the background. If dialing or writing fails, further data
+// is dropped.
+type mirrorConn struct {
+	queue chan []byte
+}
+
+func newMirrorConn(dial Dialer) *mirrorConn {
+	c := &mirrorConn{queue: make(chan []byte, mirrorQueueSize)}
+	go c.run(dial)
+	return c
+}
+
+func (c *mirrorConn) run(dial Dialer) {
+	conn, err := dial()
+	if err != nil {
+		mirrorErrorCounter.Inc(1)
+	} else {
+		defer conn.Close()
+	}
+	for data := range c.queue {
+		if conn == nil {
+			mirrorDroppedCounter.Inc(int64(len(data)))
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+		if _, err := conn.Write(data); err != nil {
+			mirrorErrorCounter.Inc(1)
+			mirrorDroppedCounter.Inc(int64(len(data)))
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (c *mirrorConn) mirror(b []byte) {
+	select {
+	case c.queue <- append([]byte(nil), b...):
+	default:
+		mirrorDroppedCounter.Inc(int64(len(b)))
+	}
+}
+
+// close closes the mirror connection once queued data is written.
+func (c *mirrorConn) close() {
+	close(c.queue)
+}
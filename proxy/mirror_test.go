@@ -0,0 +1,168 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyThroughMirror proxies one connection, on which the client sends
+// "ping" and the target answers "pong".
+func proxyThroughMirror(t *testing.T, mirror *Mirror) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.Mirror = mirror
+	go p.Accept()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+
+	src.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(dst, buf)
+	assert.Nil(t, err, "should receive data on target")
+	dst.Write([]byte("pong"))
+	_, err = io.ReadFull(src, buf)
+	assert.Nil(t, err, "should receive data from target")
+
+	src.Close()
+	dst.Close()
+	p.Shutdown()
+	p.Wait()
+}
+
+func TestMirrorDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer ln.Close()
+
+	received := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				received <- string(data)
+			}()
+		}
+	}()
+
+	mirror := NewMirrorDialer(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}, MirrorBoth)
+	proxyThroughMirror(t, mirror)
+
+	streams := []string{<-received, <-received}
+	sort.Strings(streams)
+	assert.Equal(t, []string{"ping", "pong"}, streams, "should mirror each direction on its own connection")
+}
+
+func TestPcapMirror(t *testing.T) {
+	buf := &bytes.Buffer{}
+	mirror, err := NewPcapMirror(buf, MirrorFromClient)
+	assert.Nil(t, err, "should write pcap header")
+	proxyThroughMirror(t, mirror)
+	mirror.Close()
+
+	data := buf.Bytes()
+	assert.Equal(t, uint32(pcapMagic), binary.LittleEndian.Uint32(data))
+	assert.Equal(t, uint32(pcapLinkRawIP), binary.LittleEndian.Uint32(data[20:]))
+
+	var flags []byte
+	var payloads []string
+	for rest := data[24:]; len(rest) >= 16; {
+		length := int(binary.LittleEndian.Uint32(rest[8:]))
+		packet := rest[16 : 16+length]
+		rest = rest[16+length:]
+
+		assert.Equal(t, byte(0x45), packet[0], "should write IPv4 packets")
+		assert.Equal(t, uint16(0), checksum(packet[:20]), "should have valid IP checksum")
+		segment := packet[20:]
+		pseudo := make([]byte, 12)
+		copy(pseudo, packet[12:20])
+		pseudo[9] = ipProtoTCP
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(segment)))
+		assert.Equal(t, uint16(0), checksum(append(pseudo, segment...)), "should have valid TCP checksum")
+
+		flags = append(flags, segment[13])
+		if len(segment) > 20 {
+			payloads = append(payloads, string(segment[20:]))
+		}
+	}
+	assert.Equal(t, []byte{tcpSYN, tcpSYN | tcpACK, tcpPSH | tcpACK, tcpFIN | tcpACK, tcpFIN | tcpACK}, flags, "should open and close TCP connection")
+	assert.Equal(t, []string{"ping"}, payloads, "should only mirror data from client")
+}
+
+// blockingWriter blocks writes until unblocked.
+type blockingWriter struct {
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+	return len(b), nil
+}
+
+func TestPcapMirrorDropsUnderBackpressure(t *testing.T) {
+	writer := &blockingWriter{unblock: make(chan struct{})}
+	go func() { writer.unblock <- struct{}{} }()
+	mirror, err := NewPcapMirror(writer, MirrorBoth)
+	assert.Nil(t, err, "should write pcap header")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	session := mirror.open(server, 1)
+
+	dropped := mirrorDroppedCounter.Count()
+	for i := 0; i < 2*mirrorQueueSize; i++ {
+		session.fromClient.mirror([]byte("data"))
+	}
+	assert.True(t, mirrorDroppedCounter.Count() > dropped, "should drop data once the queue is full")
+
+	close(writer.unblock)
+	session.close()
+	mirror.Close()
+}
+
+func TestChecksum(t *testing.T) {
+	// Example from RFC 1071, section 3
+	assert.Equal(t, uint16(0x220d), checksum([]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}))
+}
@@ -0,0 +1,103 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/square/ghostunnel/mux"
+	"github.com/square/ghostunnel/tracing"
+)
+
+var (
+	muxSessionCounter = metrics.GetOrRegisterCounter("mux.sessions", metrics.DefaultRegistry)
+	muxStreamCounter  = metrics.GetOrRegisterCounter("mux.streams", metrics.DefaultRegistry)
+)
+
+// serveMux accepts streams on a multiplexed connection, and forwards each of
+// them to the backend. Returns once the session is closed, or after shutdown
+// once all streams are done.
+func (p *Proxy) serveMux(conn net.Conn, identity, listenerName string, span *tracing.Span) {
+	session := mux.Server(conn)
+	defer session.Close()
+	if !p.addSession(session) {
+		return
+	}
+	defer p.removeSession(session)
+
+	muxSessionCounter.Inc(1)
+	defer muxSessionCounter.Dec(1)
+
+	wg := &sync.WaitGroup{}
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			break
+		}
+		muxStreamCounter.Inc(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer muxStreamCounter.Dec(1)
+			defer stream.Close()
+			streamSpan := p.Tracer.Start("mux-stream", tracing.KindServer, span)
+			defer streamSpan.End()
+			p.forward(stream, identity, listenerName, streamSpan, time.Now())
+		}()
+	}
+	wg.Wait()
+}
+
+// addSession tracks an open session, unless the proxy is shutting down.
+func (p *Proxy) addSession(session *mux.Session) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.LoadInt32(&p.quit) == 1 {
+		return false
+	}
+	if p.sessions == nil {
+		p.sessions = map[*mux.Session]bool{}
+	}
+	p.sessions[session] = true
+	return true
+}
+
+func (p *Proxy) removeSession(session *mux.Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, session)
+}
+
+// goAway tells clients to stop opening streams on open multiplexed sessions,
+// QUIC and HTTP/2 connections, and to stop sending requests on connections in HTTP
+// mode, so they can be drained on shutdown.
+func (p *Proxy) goAway() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for session := range p.sessions {
+		go session.GoAway()
+	}
+	for session := range p.streamSessions {
+		session.GoAway()
+	}
+	p.shutdownHTTP2()
+	p.shutdownHTTPServers()
+}
@@ -0,0 +1,90 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/square/ghostunnel/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiplex(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{NextProtos: []string{mux.Protocol}})
+
+	echoDialer := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			io.Copy(server, server)
+		}()
+		return client, nil
+	}
+	p := New([]net.Listener{incoming}, 60*time.Second, echoDialer, &testLogger{}, LogEverything, false)
+	p.Multiplex = true
+	go p.Accept()
+
+	dials := 0
+	pool := mux.NewPool(1, func() (net.Conn, error) {
+		dials++
+		return tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{mux.Protocol}})
+	})
+	defer pool.Close()
+
+	streams := []net.Conn{}
+	for i := 0; i < 3; i++ {
+		stream, err := pool.Dial()
+		assert.Nil(t, err, "should open stream")
+		_, err = stream.Write([]byte("ping"))
+		assert.Nil(t, err, "should write to stream")
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(stream, buf)
+		assert.Nil(t, err, "should read echo from backend")
+		assert.Equal(t, "ping", string(buf))
+		streams = append(streams, stream)
+	}
+	assert.Equal(t, 1, dials, "should carry all streams over one connection")
+	assert.Len(t, p.Connections(), 3, "should proxy each stream as a connection")
+
+	// Shutdown drains open streams
+	p.Shutdown()
+	assert.Eventually(t, func() bool {
+		stream, err := pool.Dial()
+		if err == nil {
+			stream.Close()
+		}
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "should not open streams after shutdown")
+
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	for _, stream := range streams {
+		stream.Close()
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("proxy should shut down once streams are closed")
+	}
+}
@@ -0,0 +1,299 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pcap file format (https://wiki.wireshark.org/Development/LibpcapFileFormat),
+// with raw IP packets (no link layer header).
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapSnapLen    = 65535
+	pcapLinkRawIP  = 101
+	pcapMaxPayload = 65000
+)
+
+// TCP flags for synthetic segments.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+// pcapWriter writes packets to a pcap file from a queue, so that slow writes
+// don't block proxied connections.
+type pcapWriter struct {
+	writer io.Writer
+	queue  chan []byte
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newPcapWriter writes the pcap file header, and starts writing packets.
+func newPcapWriter(writer io.Writer) (*pcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkRawIP)
+	if _, err := writer.Write(header); err != nil {
+		return nil, err
+	}
+
+	w := &pcapWriter{
+		writer: writer,
+		queue:  make(chan []byte, mirrorQueueSize),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *pcapWriter) run() {
+	defer close(w.done)
+	for record := range w.queue {
+		if _, err := w.writer.Write(record); err != nil {
+			mirrorErrorCounter.Inc(1)
+		}
+	}
+}
+
+// write queues a packet, with a pcap record header for the current time.
+// Returns false if the packet was dropped.
+func (w *pcapWriter) write(packet []byte) bool {
+	now := time.Now()
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	record = append(record, packet...)
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return false
+	}
+	select {
+	case w.queue <- record:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *pcapWriter) close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+// pcapEndpoint is the IP address and port of one side of a connection.
+type pcapEndpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+// pcapConn builds synthetic packets for a proxied connection, from the
+// client (0) or the address it connected to (1). For TCP, sequence numbers
+// count all mirrored data (including dropped packets, which then show up
+// as missing segments) and connections are opened and closed with SYN and
+// FIN segments.
+type pcapConn struct {
+	writer *pcapWriter
+	sides  [2]pcapEndpoint
+	udp    bool
+	// Next sequence number for each side (TCP only)
+	seq [2]uint32
+}
+
+// newPcapConn starts a connection in the pcap file. Sides without IP
+// addresses (e.g. UNIX sockets) are shown as 127.0.0.1, with client ports
+// derived from the connection id.
+func newPcapConn(writer *pcapWriter, client net.Conn, id uint64) *pcapConn {
+	c := &pcapConn{
+		writer: writer,
+		sides: [2]pcapEndpoint{
+			pcapAddr(client.RemoteAddr(), uint16(1024+id%64000)),
+			pcapAddr(client.LocalAddr(), 1),
+		},
+		udp: client.LocalAddr().Network() == "udp",
+	}
+	if !c.udp {
+		c.send(0, tcpSYN, nil)
+		c.send(1, tcpSYN|tcpACK, nil)
+	}
+	return c
+}
+
+func pcapAddr(addr net.Addr, fallbackPort uint16) pcapEndpoint {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return pcapEndpoint{ip: addr.IP, port: uint16(addr.Port)}
+	case *net.UDPAddr:
+		return pcapEndpoint{ip: addr.IP, port: uint16(addr.Port)}
+	}
+	return pcapEndpoint{ip: net.IPv4(127, 0, 0, 1), port: fallbackPort}
+}
+
+// close ends the connection in the pcap file.
+func (c *pcapConn) close() {
+	if !c.udp {
+		c.send(0, tcpFIN|tcpACK, nil)
+		c.send(1, tcpFIN|tcpACK, nil)
+	}
+}
+
+// send builds a packet from the given side and queues it, returns false if
+// it was dropped.
+func (c *pcapConn) send(from int, flags byte, payload []byte) bool {
+	src, dst := c.sides[from], c.sides[1-from]
+
+	var segment []byte
+	var proto byte
+	if c.udp {
+		proto = ipProtoUDP
+		segment = make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint16(segment[0:], src.port)
+		binary.BigEndian.PutUint16(segment[2:], dst.port)
+		binary.BigEndian.PutUint16(segment[4:], uint16(8+len(payload)))
+	} else {
+		proto = ipProtoTCP
+		length := uint32(len(payload))
+		if flags&(tcpSYN|tcpFIN) != 0 {
+			length++
+		}
+		seq := atomic.AddUint32(&c.seq[from], length) - length
+		segment = make([]byte, 20, 20+len(payload))
+		binary.BigEndian.PutUint16(segment[0:], src.port)
+		binary.BigEndian.PutUint16(segment[2:], dst.port)
+		binary.BigEndian.PutUint32(segment[4:], seq)
+		if flags&tcpACK != 0 {
+			binary.BigEndian.PutUint32(segment[8:], atomic.LoadUint32(&c.seq[1-from]))
+		}
+		segment[12] = 5 << 4
+		segment[13] = flags
+		binary.BigEndian.PutUint16(segment[14:], 65535)
+	}
+	segment = append(segment, payload...)
+	return c.writer.write(ipPacket(src.ip, dst.ip, proto, segment))
+}
+
+// ipPacket wraps a TCP segment or UDP datagram in an IPv4 packet (or IPv6,
+// unless both addresses are IPv4), and fills in its checksum.
+func ipPacket(src, dst net.IP, proto byte, segment []byte) []byte {
+	var header, pseudo []byte
+	checksumOffset := 16
+	if proto == ipProtoUDP {
+		checksumOffset = 6
+	}
+
+	if src.To4() != nil && dst.To4() != nil {
+		header = make([]byte, 20)
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:], uint16(20+len(segment)))
+		binary.BigEndian.PutUint16(header[6:], 0x4000)
+		header[8] = 64
+		header[9] = proto
+		copy(header[12:], src.To4())
+		copy(header[16:], dst.To4())
+		binary.BigEndian.PutUint16(header[10:], checksum(header))
+
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:], src.To4())
+		copy(pseudo[4:], dst.To4())
+		pseudo[9] = proto
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(segment)))
+	} else {
+		header = make([]byte, 40)
+		header[0] = 0x60
+		binary.BigEndian.PutUint16(header[4:], uint16(len(segment)))
+		header[6] = proto
+		header[7] = 64
+		copy(header[8:], src.To16())
+		copy(header[24:], dst.To16())
+
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:], src.To16())
+		copy(pseudo[16:], dst.To16())
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(segment)))
+		pseudo[39] = proto
+	}
+
+	sum := checksum(append(pseudo, segment...))
+	if sum == 0 && proto == ipProtoUDP {
+		// Zero means no checksum for UDP
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[checksumOffset:], sum)
+	return append(header, segment...)
+}
+
+// checksum computes the internet checksum (RFC 1071).
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// pcapStream mirrors one direction of a connection to the pcap file, split
+// into packets of up to pcapMaxPayload bytes.
+type pcapStream struct {
+	conn *pcapConn
+	from int
+}
+
+func (s *pcapStream) mirror(b []byte) {
+	for len(b) > 0 {
+		n := len(b)
+		if n > pcapMaxPayload {
+			n = pcapMaxPayload
+		}
+		if !s.conn.send(s.from, tcpPSH|tcpACK, b[:n]) {
+			mirrorDroppedCounter.Inc(int64(n))
+		}
+		b = b[n:]
+	}
+}
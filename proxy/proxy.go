@@ -18,15 +18,20 @@ package proxy
 
 import (
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	proxyproto "github.com/pires/go-proxyproto"
 	metrics "github.com/rcrowley/go-metrics"
+	"github.com/square/ghostunnel/mux"
+	"github.com/square/ghostunnel/tracing"
+	"github.com/square/ghostunnel/transport"
+	"golang.org/x/net/http2"
 )
 
 var (
@@ -35,10 +40,55 @@ var (
 	successCounter = metrics.GetOrRegisterCounter("accept.success", metrics.DefaultRegistry)
 	errorCounter   = metrics.GetOrRegisterCounter("accept.error", metrics.DefaultRegistry)
 	timeoutCounter = metrics.GetOrRegisterCounter("accept.timeout", metrics.DefaultRegistry)
+	limitedCounter = metrics.GetOrRegisterCounter("accept.ratelimited", metrics.DefaultRegistry)
+	overCounter    = metrics.GetOrRegisterCounter("accept.overlimit", metrics.DefaultRegistry)
+	deniedCounter  = metrics.GetOrRegisterCounter("accept.denied", metrics.DefaultRegistry)
+	idleCounter    = metrics.GetOrRegisterCounter("conn.idletimeout", metrics.DefaultRegistry)
 	handshakeTimer = metrics.GetOrRegisterTimer("conn.handshake", metrics.DefaultRegistry)
 	connTimer      = metrics.GetOrRegisterTimer("conn.lifetime", metrics.DefaultRegistry)
+	// Connections with a hybrid post-quantum key exchange (on either side)
+	postQuantumCounter = metrics.GetOrRegisterCounter("conn.postquantum", metrics.DefaultRegistry)
 )
 
+// ALPN protocol used for ACME TLS-ALPN-01 challenges (RFC 8737). Connections
+// negotiating it are unauthenticated and must never be forwarded to the backend.
+const acmeALPNProto = "acme-tls/1"
+
+var errACMEChallenge = errors.New("connection negotiated ACME TLS-ALPN-01 protocol")
+
+var (
+	errRateLimited  = errors.New("rate limit exceeded")
+	errTooManyConns = errors.New("too many open connections")
+)
+
+// Authorizer makes access decisions for connections, based on the TLS
+// connection state and connection metadata (addresses). Authorize is called
+// after the handshake completes, and should return an error to deny access.
+type Authorizer interface {
+	Authorize(conn net.Conn, state tls.ConnectionState) error
+}
+
+// Auditor records authentication decisions. Audit is called once per
+// connection, after the handshake and access checks, with the error that
+// denied access (or nil if the connection was allowed).
+type Auditor interface {
+	Audit(conn net.Conn, err error)
+}
+
+// secureConn is implemented by *tls.Conn, as well as DTLS sessions (see the
+// certloader package).
+type secureConn interface {
+	net.Conn
+	Handshake() error
+	ConnectionState() tls.ConnectionState
+}
+
+// pskConn is implemented by DTLS sessions from PSK listeners, which have an
+// identity instead of peer certificates.
+type pskConn interface {
+	PSKIdentity() string
+}
+
 const (
 	// LogConnections will log messages about open/closed connections.
 	LogConnections = 1
@@ -61,14 +111,117 @@ type Dialer func() (net.Conn, error)
 // Proxy will take incoming connections from a listener and forward them to
 // a backend through the given dialer.
 type Proxy struct {
-	// Listener to accept connetions on.
-	Listener net.Listener
+	// Listeners to accept connetions on.
+	Listeners []net.Listener
 	// ConnectTimeout after which connections are terminated.
 	ConnectTimeout time.Duration
+	// HandshakeTimeout for the TLS handshake with clients (optional, uses
+	// ConnectTimeout if not set).
+	HandshakeTimeout time.Duration
 	// Dial function to reach backend to forward connections to.
 	Dial Dialer
+	// Routes to forward connections to different backends, based on the TLS
+	// connection state (optional). The first matching route is used,
+	// connections that don't match any route go to Dial.
+	Routes []Route
+	// DialConn to reach a backend that depends on the accepted connection,
+	// e.g. its original destination in transparent mode (optional). If set,
+	// it's used instead of Routes and Dial.
+	DialConn func(conn net.Conn) (net.Conn, error)
+	// Multiplex enables accepting multiplexed connections, negotiated with
+	// ALPN (see the mux package). Each stream is forwarded to the backend
+	// like a separate connection.
+	Multiplex bool
+	// HTTP2 enables accepting tunnels as HTTP/2 CONNECT streams, on
+	// connections that negotiated h2 with ALPN (see the transport package).
+	HTTP2 bool
+	// HTTP enables parsing HTTP requests on connections, instead of
+	// forwarding them as opaque streams (optional, see HTTPConfig).
+	HTTP *HTTPConfig
+	// WebSocketPath enables accepting tunnels as WebSocket upgrade requests
+	// for the given path, on connections that negotiated http/1.1 with ALPN
+	// (see the transport package).
+	WebSocketPath string
 	// Logger is used to log information messages about connections, errors.
 	Logger Logger
+	// MaxLogRate limits the number of log messages per second for each class
+	// of messages (connections, connection errors and handshake errors), see
+	// logLimiter (zero means no limit).
+	MaxLogRate float64
+	// MaxConnRate limits the number of new connections accepted per second
+	// (zero means no limit).
+	MaxConnRate float64
+	// MaxConnRatePerClient limits the number of new connections accepted per
+	// second from a single client identity (zero means no limit).
+	MaxConnRatePerClient float64
+	// MaxConcurrentConns limits the number of open connections (zero means
+	// no limit).
+	MaxConcurrentConns int
+	// MaxConnsPerClient limits the number of open connections from a single
+	// client identity (zero means no limit).
+	MaxConnsPerClient int
+	// MaxHandshakes limits the number of TLS handshakes in flight, and
+	// MaxHandshakesPerIP the number from a single source IP (zero means no
+	// limit). Connections over the limits are reset before the handshake.
+	MaxHandshakes      int
+	MaxHandshakesPerIP int
+	// RateLimitRead and RateLimitWrite limit the bandwidth of each proxied
+	// connection, in bytes per second, for data read from and written to the
+	// client (zero means no limit). RateLimitBurst is the maximum burst size
+	// in bytes (defaults to one second worth of data).
+	RateLimitRead  int64
+	RateLimitWrite int64
+	RateLimitBurst int64
+	// IdleTimeout after which connections without data in either direction
+	// are closed (zero means no timeout).
+	IdleTimeout time.Duration
+	// MaxConnLifetime after which connections are closed regardless of
+	// activity (zero means no limit). Each connection is closed a random
+	// duration of up to MaxConnLifetimeJitter earlier, so that clients don't
+	// all reconnect at the same time.
+	MaxConnLifetime       time.Duration
+	MaxConnLifetimeJitter time.Duration
+	// EnforceCertExpiry closes connections from clients once their
+	// certificate expires.
+	EnforceCertExpiry bool
+	// DialRetries is the number of times a failed dial to the backend is
+	// retried before giving up on a connection (zero means no retries). The
+	// first retry waits DialBackoff, each further one twice as long as the
+	// previous one, up to DialMaxBackoff (if set).
+	DialRetries    int
+	DialBackoff    time.Duration
+	DialMaxBackoff time.Duration
+	// HoldTimeout enables holding connections while the backend is
+	// unavailable: if dialing fails, the connection is kept open (with data
+	// from the client left unread) and dialing is retried until the backend
+	// is back, for up to HoldTimeout. At most MaxHeldConns connections are
+	// held at a time (zero means no limit), others fail right away.
+	HoldTimeout  time.Duration
+	MaxHeldConns int
+	// Mirror to duplicate proxied data to, e.g. for an IDS (optional, not
+	// used in HTTP mode).
+	Mirror *Mirror
+	// AccessLog receives an entry for each proxied connection once it has
+	// been closed (optional).
+	AccessLog AccessLogger
+	// Tracer to record spans for the connection lifecycle (optional).
+	Tracer *tracing.Tracer
+	// Histograms to record handshake, dial and connection latencies (optional).
+	Histograms *Histograms
+	// IdentityMetrics to count connections and bytes by client identity (optional).
+	IdentityMetrics *IdentityMetrics
+	// Authorizer to consult for each TLS connection after the handshake,
+	// before dialing the backend (optional).
+	Authorizer Authorizer
+	// Auditor to record the outcome of handshakes and access checks for each
+	// connection (optional).
+	Auditor Auditor
+	// SourceFilter to restrict source addresses of connections, checked
+	// before the handshake (optional).
+	SourceFilter *SourceFilter
+	// Tarpit to delay connections from source IPs with repeated failures,
+	// before the handshake (optional).
+	Tarpit *Tarpit
 
 	// Internal state to indicate that we want to shut down.
 	quit int32
@@ -77,29 +230,42 @@ type Proxy struct {
 	// Enable HAproxy's PROXY protocol
 	// see: https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
 	proxyProtocol bool
-	// Internal wait group to keep track of outstanding handlers.
+	// Internal wait group to keep track of outstanding handlers, and number
+	// of open connections. Handlers are added under mu, to avoid adding new
+	// ones after Shutdown().
 	handlers *sync.WaitGroup
+	open     int64
+	// Number of connections held while waiting for the backend
+	held int64
+	mu   sync.Mutex
+	// Open proxied connections, and client connections that passed the
+	// handshake and access checks
+	active        activeConns
+	authenticated authenticatedConns
+	// Rate and concurrency limiters for connections and log messages, set up
+	// in Accept().
+	logLimiter     *logLimiter
+	connRate       *rateLimiter
+	clientConnRate *rateLimiter
+	conns          *connLimiter
+	clientConns    *connLimiter
+	handshakes     *connLimiter
+	ipHandshakes   *connLimiter
+	// Open multiplexed sessions and QUIC connections, and server for HTTP/2
+	// tunnels (set up on first use). Told to go away on shutdown.
+	sessions       map[*mux.Session]bool
+	streamSessions map[streamSession]bool
+	http2Server    *http2.Server
+	http2Base      *http.Server
+	// Servers for connections in HTTP mode, shut down on shutdown
+	httpServers map[*http.Server]bool
 }
 
-func proxyProtoHeader(c net.Conn) *proxyproto.Header {
-	sAddr := c.RemoteAddr().(*net.TCPAddr)
-	dAddr := c.LocalAddr().(*net.TCPAddr)
-
-	return &proxyproto.Header{
-		Version:            2,
-		Command:            proxyproto.PROXY,
-		TransportProtocol:  proxyproto.TCPv4,
-		SourceAddress:      sAddr.IP,
-		DestinationAddress: dAddr.IP,
-		SourcePort:         uint16(sAddr.Port),
-		DestinationPort:    uint16(dAddr.Port),
-	}
-}
-
-// New creates a new proxy.
-func New(listener net.Listener, timeout time.Duration, dial Dialer, logger Logger, loggerFlags int, proxyProtocol bool) *Proxy {
+// New creates a new proxy. Connections accepted on any of the given
+// listeners are forwarded to the same backend.
+func New(listeners []net.Listener, timeout time.Duration, dial Dialer, logger Logger, loggerFlags int, proxyProtocol bool) *Proxy {
 	p := &Proxy{
-		Listener:       listener,
+		Listeners:      listeners,
 		ConnectTimeout: timeout,
 		Dial:           dial,
 		Logger:         logger,
@@ -117,13 +283,45 @@ func New(listener net.Listener, timeout time.Duration, dial Dialer, logger Logge
 	return p
 }
 
-// Shutdown tells the proxy to close the listener & stop accepting connections.
+// Shutdown tells the proxy to close the listeners & stop accepting connections.
 func (p *Proxy) Shutdown() {
+	p.mu.Lock()
 	if atomic.LoadInt32(&p.quit) == 1 {
+		p.mu.Unlock()
 		return
 	}
 	atomic.StoreInt32(&p.quit, 1)
-	p.Listener.Close()
+	p.mu.Unlock()
+
+	for _, listener := range p.Listeners {
+		listener.Close()
+	}
+	p.goAway()
+	p.handlers.Done()
+}
+
+// OpenConnections returns the number of connections currently being handled
+// (including ones that are still in the handshake), e.g. to report progress
+// while draining connections on shutdown.
+func (p *Proxy) OpenConnections() int64 {
+	return atomic.LoadInt64(&p.open)
+}
+
+// track adds a handler for a new connection, unless the proxy is shutting
+// down. Call untrack when the connection is closed.
+func (p *Proxy) track() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.LoadInt32(&p.quit) == 1 {
+		return false
+	}
+	p.handlers.Add(1)
+	atomic.AddInt64(&p.open, 1)
+	return true
+}
+
+func (p *Proxy) untrack() {
+	atomic.AddInt64(&p.open, -1)
 	p.handlers.Done()
 }
 
@@ -139,9 +337,45 @@ func (p *Proxy) Wait() {
 // the data to the backend. Will stop accepting connections if Shutdown() is called.
 // Run this in a Goroutine, call Wait() to block on proxy shutdown/connection drain.
 func (p *Proxy) Accept() {
+	p.logLimiter = newLogLimiter(p.MaxLogRate, p.Logger)
+	p.connRate = newRateLimiter(p.MaxConnRate)
+	p.clientConnRate = newRateLimiter(p.MaxConnRatePerClient)
+	p.conns = newConnLimiter(p.MaxConcurrentConns)
+	p.clientConns = newConnLimiter(p.MaxConnsPerClient)
+	p.handshakes = newConnLimiter(p.MaxHandshakes)
+	p.ipHandshakes = newConnLimiter(p.MaxHandshakesPerIP)
+
+	wg := &sync.WaitGroup{}
+	for _, listener := range p.Listeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			p.accept(listener)
+		}(listener)
+	}
+	wg.Wait()
+}
+
+func (p *Proxy) audit(conn net.Conn, err error) {
+	if p.Auditor != nil {
+		p.Auditor.Audit(conn, err)
+	}
+}
+
+// reject closes and logs a connection rejected in the accept loop. It's
+// closed before logging, since looking up the remote address may block while
+// reading a PROXY protocol header, which fails right away once closed.
+func (p *Proxy) reject(conn net.Conn, reason string) {
+	conn.Close()
+	p.logConditional(LogHandshakeErrors, "rejecting connection from %s: %s", conn.RemoteAddr(), reason)
+}
+
+// Accept loop for a single listener.
+func (p *Proxy) accept(listener net.Listener) {
+	listenerName := listener.Addr().String()
 	for {
 		// Wait for new connection
-		conn, err := p.Listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			// Check if we're supposed to stop
 			if atomic.LoadInt32(&p.quit) == 1 {
@@ -152,50 +386,198 @@ func (p *Proxy) Accept() {
 			continue
 		}
 
-		openCounter.Inc(1)
 		totalCounter.Inc(1)
 
+		if !p.connRate.allow("") {
+			limitedCounter.Inc(1)
+			p.reject(conn, "rate limit exceeded")
+			continue
+		}
+
+		if !p.conns.acquire("") {
+			overCounter.Inc(1)
+			p.reject(conn, "too many open connections")
+			continue
+		}
+
+		if !p.track() {
+			p.conns.release("")
+			conn.Close()
+			return
+		}
+
+		openCounter.Inc(1)
+		acceptTime := time.Now()
+
 		go connTimer.Time(func() {
+			defer p.untrack()
 			defer conn.Close()
 			defer openCounter.Dec(1)
+			defer p.conns.release("")
+
+			span := p.Tracer.Start("connection", tracing.KindServer, nil)
+			span.SetAttribute("net.peer.addr", conn.RemoteAddr().String())
+			defer span.End()
+
+			// Checked here instead of in the accept loop, since looking up the
+			// remote address may block when parsing PROXY protocol headers.
+			if !p.SourceFilter.allows(conn.RemoteAddr()) {
+				deniedCounter.Inc(1)
+				span.SetError(errSourceDenied)
+				p.logConditional(LogHandshakeErrors, "rejecting connection from %s: source address not allowed", conn.RemoteAddr())
+				return
+			}
 
-			err := forceHandshake(p.ConnectTimeout, conn)
-			if err != nil {
-				errorCounter.Inc(1)
-				p.logConditional(LogHandshakeErrors, "error on TLS handshake from %s: %s", conn.RemoteAddr(), err)
+			ip := sourceIP(conn.RemoteAddr())
+			if !p.tarpit(ip) {
+				return
+			}
+			if _, ok := conn.(secureConn); ok && !p.acquireHandshake(ip) {
+				handshakeLimitedCounter.Inc(1)
+				span.SetError(errTooManyHandshakes)
+				p.logConditional(LogHandshakeErrors, "rejecting connection from %s: too many handshakes in progress", conn.RemoteAddr())
+				resetConn(conn)
 				return
 			}
 
-			backend, err := p.Dial()
+			handshakeSpan := p.Tracer.Start("handshake", tracing.KindInternal, span)
+			handshakeStart := time.Now()
+			err := forceHandshake(p.handshakeTimeout(), conn)
+			if _, ok := conn.(secureConn); ok {
+				p.releaseHandshake(ip)
+				p.Histograms.observeHandshake(listenerName, handshakeStart, err)
+			}
+			handshakeSpan.SetError(err)
+			handshakeSpan.End()
+			if err == errACMEChallenge {
+				return
+			}
 			if err != nil {
-				p.logConditional(LogConnectionErrors, "error on dial: %s", err)
+				errorCounter.Inc(1)
+				span.SetError(err)
+				p.Tarpit.fail(ip)
+				p.logConditional(LogHandshakeErrors, "error on TLS handshake from %s: %s", conn.RemoteAddr(), err)
+				p.audit(conn, err)
 				return
 			}
 
-			if p.proxyProtocol {
-				h := proxyProtoHeader(conn)
-				_, err = h.WriteTo(backend)
-				if err != nil {
-					p.logConditional(LogConnectionErrors, "error writing proxy header: %s", err)
+			identity := clientIdentity(conn)
+			span.SetAttribute("ghostunnel.client.identity", identity)
+			if tlsConn, ok := conn.(secureConn); ok && p.Authorizer != nil {
+				if err := p.Authorizer.Authorize(conn, tlsConn.ConnectionState()); err != nil {
+					deniedCounter.Inc(1)
+					span.SetError(err)
+					p.Tarpit.fail(ip)
+					p.logConditional(LogHandshakeErrors, "rejecting connection from %s: access denied for %s: %s", conn.RemoteAddr(), identity, err)
+					p.audit(conn, err)
 					return
 				}
 			}
+			if !p.clientConnRate.allow(identity) {
+				limitedCounter.Inc(1)
+				span.SetError(errRateLimited)
+				p.logConditional(LogHandshakeErrors, "rejecting connection from %s: rate limit exceeded for %s", conn.RemoteAddr(), identity)
+				p.audit(conn, errRateLimited)
+				return
+			}
+			if !p.clientConns.acquire(identity) {
+				overCounter.Inc(1)
+				span.SetError(errTooManyConns)
+				p.logConditional(LogHandshakeErrors, "rejecting connection from %s: too many open connections for %s", conn.RemoteAddr(), identity)
+				p.audit(conn, errTooManyConns)
+				return
+			}
+			defer p.clientConns.release(identity)
+
+			// Only record success once the connection is actually accepted
+			p.audit(conn, nil)
+			p.Tarpit.succeed(ip)
+			stopLifetime := p.enforceLifetime(conn, identity, acceptTime)
+			defer stopLifetime()
+			stopExpiry := p.enforceCertExpiry(conn, identity)
+			defer stopExpiry()
+			if _, ok := conn.(secureConn); ok {
+				p.authenticated.add(conn)
+				defer p.authenticated.remove(conn)
+			}
 
-			successCounter.Inc(1)
-			p.handlers.Add(1)
-			defer p.handlers.Done()
-			p.fuse(conn, backend)
+			if session, ok := conn.(streamSession); ok {
+				p.serveStreams(session, identity, listenerName, span)
+				return
+			}
+			if tlsConn, ok := conn.(secureConn); ok && p.Multiplex && tlsConn.ConnectionState().NegotiatedProtocol == mux.Protocol {
+				p.serveMux(conn, identity, listenerName, span)
+				return
+			}
+			if tlsConn, ok := conn.(secureConn); ok && p.HTTP2 && tlsConn.ConnectionState().NegotiatedProtocol == transport.HTTP2Protocol {
+				p.serveHTTP2(conn, identity, listenerName, span)
+				return
+			}
+			if tlsConn, ok := conn.(secureConn); ok && p.WebSocketPath != "" && tlsConn.ConnectionState().NegotiatedProtocol == transport.WebSocketProtocol {
+				p.serveWebSocket(conn, identity, listenerName, span, acceptTime)
+				return
+			}
+			p.forward(conn, identity, listenerName, span, acceptTime)
 		})
 	}
 }
 
+// forward dials the backend for a connection (or a multiplexed stream) that
+// passed the handshake and access checks, and copies data until either side
+// closes. In HTTP mode, requests are forwarded with a reverse proxy instead.
+func (p *Proxy) forward(conn net.Conn, identity, listenerName string, span *tracing.Span, acceptTime time.Time) {
+	if p.HTTP != nil {
+		p.serveHTTP(conn, identity, listenerName, span)
+		return
+	}
+	dialSpan := p.Tracer.Start("dial-backend", tracing.KindClient, span)
+	dialStart := time.Now()
+	backend, err := p.dialerFor(conn)()
+	p.Histograms.observeDial(listenerName, dialStart, err)
+	dialSpan.SetError(err)
+	dialSpan.End()
+	if err != nil {
+		span.SetError(err)
+		p.logConditional(LogConnectionErrors, "error on dial: %s", err)
+		return
+	}
+
+	if p.proxyProtocol {
+		_, err = backend.Write(proxyProtoHeader(conn))
+		if err != nil {
+			p.logConditional(LogConnectionErrors, "error writing proxy header: %s", err)
+			return
+		}
+	}
+
+	successCounter.Inc(1)
+	p.IdentityMetrics.observeConnection(identity)
+
+	streamSpan := p.Tracer.Start("stream", tracing.KindInternal, span)
+	info := p.fuse(conn, backend, identity)
+	streamSpan.SetAttribute("ghostunnel.bytes_in", info.bytesIn)
+	streamSpan.SetAttribute("ghostunnel.bytes_out", info.bytesOut)
+	streamSpan.SetAttribute("ghostunnel.close_reason", info.closeReason)
+	streamSpan.End()
+	p.Histograms.observeLifetime(listenerName, acceptTime, info.closeReason)
+	p.IdentityMetrics.observeTransfer(identity, info)
+}
+
+// handshakeTimeout returns the timeout for handshakes with clients.
+func (p *Proxy) handshakeTimeout() time.Duration {
+	if p.HandshakeTimeout > 0 {
+		return p.HandshakeTimeout
+	}
+	return p.ConnectTimeout
+}
+
 // Force handshake. Handshake usually happens on first read/write, but we want
 // to force it to make sure we can control the timeout for it. Otherwise,
 // unauthenticated clients would be able to open connections and leave them
 // hanging forever. Going through the handshake verifies that clients have a
 // valid client cert and are allowed to talk to us.
 func forceHandshake(timeout time.Duration, conn net.Conn) error {
-	if tlsConn, ok := conn.(*tls.Conn); ok {
+	if tlsConn, ok := conn.(secureConn); ok {
 		startTime := time.Now()
 		defer handshakeTimer.UpdateSince(startTime)
 
@@ -220,30 +602,106 @@ func forceHandshake(timeout time.Duration, conn net.Conn) error {
 		if err != nil {
 			return err
 		}
+
+		if tlsConn.ConnectionState().NegotiatedProtocol == acmeALPNProto {
+			return errACMEChallenge
+		}
 	}
 
 	return nil
 }
 
 // Fuse connections together
-func (p *Proxy) fuse(client, backend net.Conn) {
+func (p *Proxy) fuse(client, backend net.Conn, identity string) *connInfo {
 	// Copy from client -> backend, and from backend -> client
-	defer p.logConnectionMessage("closed", client, backend)
-	p.logConnectionMessage("opening", client, backend)
+	info := &connInfo{id: atomic.AddUint64(&connIDCounter, 1), start: time.Now()}
+	defer p.logConnectionMessage("closed", client, backend, info)
+	p.logConnectionMessage("opening", client, backend, info)
+
+	if usesPostQuantum(client) || usesPostQuantum(backend) {
+		postQuantumCounter.Inc(1)
+	}
+
+	p.active.add(&activeConn{client: client, backend: backend, identity: identity, info: info})
+	defer p.active.remove(info.id)
+
+	idle := newIdleTracker(p.IdleTimeout)
+
+	var fromClient, fromTarget mirrorStream
+	if p.Mirror != nil {
+		session := p.Mirror.open(client, info.id)
+		defer session.close()
+		fromClient, fromTarget = session.fromClient, session.fromTarget
+	}
+
+	// Whichever direction finishes first determines the close reason.
+	once := &sync.Once{}
+	finish := func(side string, err error) {
+		once.Do(func() { info.closeReason = closeReason(side, err) })
+	}
 
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	go func() { p.copyData(client, backend); wg.Done() }()
-	p.copyData(backend, client)
+	go func() {
+		p.copyData(client, backend, idle, p.RateLimitWrite, &info.bytesOut, fromTarget, func(err error) { finish("target", err) })
+		wg.Done()
+	}()
+	p.copyData(backend, client, idle, p.RateLimitRead, &info.bytesIn, fromClient, func(err error) { finish("client", err) })
 	wg.Wait()
+	info.closed = true
+
+	if idle.expired() {
+		idleCounter.Inc(1)
+		p.logConnectionMessage("idle timeout, closing", client, backend, info)
+	}
+	if p.AccessLog != nil {
+		p.AccessLog.LogAccess(connFields(client, backend, info))
+	}
+	return info
+}
+
+// closeReason describes why a connection was closed, given the side we were
+// reading from and the error we got (if any).
+func closeReason(side string, err error) string {
+	switch {
+	case err == nil:
+		return side + "_closed"
+	case errors.Is(err, errIdleTimeout):
+		return "idle_timeout"
+	case isClosedConnectionError(err):
+		return "closed"
+	default:
+		return side + "_error"
+	}
 }
 
-// Copy data between two connections
-func (p *Proxy) copyData(dst net.Conn, src net.Conn) {
+// Copy data between two connections, limited to rate bytes per second (if
+// positive). Activity is recorded on the idle tracker (if not nil). Bytes
+// copied are added to count as they are read, and passed to the mirror
+// stream (if not nil). The done callback gets the error that ended the copy
+// (if any), before connections are closed.
+func (p *Proxy) copyData(dst net.Conn, src net.Conn, idle *idleTracker, rate int64, count *int64, mirror mirrorStream, done func(error)) {
 	defer dst.Close()
 	defer src.Close()
 
-	_, err := io.Copy(dst, src)
+	var reader io.Reader = src
+	if idle != nil {
+		reader = idle.reader(src)
+	}
+	reader = &countingReader{reader: reader, count: count}
+	if mirror != nil {
+		reader = &mirrorReader{reader: reader, stream: mirror}
+	}
+	if rate > 0 {
+		reader = newThrottledReader(reader, rate, p.RateLimitBurst)
+	}
+
+	_, err := io.Copy(dst, reader)
+	done(err)
+	if errors.Is(err, errIdleTimeout) {
+		// Logged once in fuse, after both directions are closed.
+		return
+	}
 
 	if err != nil && !isClosedConnectionError(err) {
 		// We don't log individual "read from closed connection" errors, because
@@ -253,7 +711,16 @@ func (p *Proxy) copyData(dst net.Conn, src net.Conn) {
 }
 
 // Log information message about connection
-func (p *Proxy) logConnectionMessage(action string, dst net.Conn, src net.Conn) {
+func (p *Proxy) logConnectionMessage(action string, dst net.Conn, src net.Conn, info *connInfo) {
+	if (p.loggerFlags & LogConnections) == 0 {
+		return
+	}
+	if fieldLogger, ok := p.Logger.(FieldLogger); ok {
+		if p.logLimiter.allow(LogConnections) {
+			fieldLogger.LogFields(action+" pipe", connFields(dst, src, info))
+		}
+		return
+	}
 	p.logConditional(
 		LogConnections,
 		"%s pipe: %s:%s [%s] <-> %s:%s [%s]",
@@ -268,20 +735,24 @@ func (p *Proxy) logConnectionMessage(action string, dst net.Conn, src net.Conn)
 }
 
 func (p *Proxy) logConditional(flag int, msg string, args ...interface{}) {
-	if (p.loggerFlags & flag) > 0 {
+	if (p.loggerFlags&flag) > 0 && p.logLimiter.allow(flag) {
 		p.Logger.Printf(msg, args...)
 	}
 }
 
 func isClosedConnectionError(err error) bool {
 	if e, ok := err.(*net.OpError); ok {
-		return e.Op == "read" && strings.Contains(err.Error(), "closed network connection")
+		// Copying between TCP connections wraps errors as "readfrom"/"writeto".
+		return (e.Op == "read" || e.Op == "readfrom" || e.Op == "writeto") && strings.Contains(err.Error(), "closed network connection")
 	}
 	return false
 }
 
 func peerCertificatesString(conn net.Conn) string {
-	if tlsConn, ok := conn.(*tls.Conn); ok {
+	if psk, ok := conn.(pskConn); ok && psk.PSKIdentity() != "" {
+		return "psk identity " + psk.PSKIdentity()
+	}
+	if tlsConn, ok := conn.(secureConn); ok {
 		if len(tlsConn.ConnectionState().PeerCertificates) > 0 {
 			return tlsConn.ConnectionState().PeerCertificates[0].Subject.String()
 		}
@@ -291,3 +762,29 @@ func peerCertificatesString(conn net.Conn) string {
 
 	return "no tls"
 }
+
+// clientIdentity returns the identity of the client for connection limits: the
+// first URI SAN (e.g. SPIFFE ID) or common name of the client certificate, or
+// the client IP address if no certificate was presented. Clients with
+// pre-shared keys are identified by their PSK identity.
+func clientIdentity(conn net.Conn) string {
+	if psk, ok := conn.(pskConn); ok && psk.PSKIdentity() != "" {
+		return psk.PSKIdentity()
+	}
+	if tlsConn, ok := conn.(secureConn); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			if len(certs[0].URIs) > 0 {
+				return certs[0].URIs[0].String()
+			}
+			if certs[0].Subject.CommonName != "" {
+				return certs[0].Subject.CommonName
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
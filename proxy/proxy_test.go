@@ -19,11 +19,18 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -41,7 +48,7 @@ func TestMultipleShutdownCalls(t *testing.T) {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	assert.Nil(t, err, "should be able to listen on random port")
 
-	p := New(ln, 60*time.Second, nil, &testLogger{}, LogEverything, false)
+	p := New([]net.Listener{ln}, 60*time.Second, nil, &testLogger{}, LogEverything, false)
 
 	// Should not panic
 	p.Shutdown()
@@ -64,7 +71,7 @@ func TestProxySuccess(t *testing.T) {
 	}
 
 	// Start accept loop
-	p := New(incoming, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
 	go p.Accept()
 	defer p.Shutdown()
 
@@ -112,7 +119,7 @@ func TestProxyProtocolSuccess(t *testing.T) {
 	}
 
 	// Start accept loop
-	p := New(incoming, 60*time.Second, dialer, &testLogger{}, LogEverything, true)
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, true)
 	go p.Accept()
 	defer p.Shutdown()
 
@@ -166,7 +173,7 @@ func TestBackendDialError(t *testing.T) {
 		return nil, errors.New("failure for test")
 	}
 
-	p := New(ln, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p := New([]net.Listener{ln}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
 	go p.Accept()
 	defer p.Shutdown()
 
@@ -192,3 +199,412 @@ func TestBackendDialError(t *testing.T) {
 	p.Shutdown()
 	p.Wait()
 }
+
+func TestProxyProtocolRejectSilentClients(t *testing.T) {
+	// Incoming listener, expecting PROXY protocol headers (without timeout)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	incoming := &proxyproto.Listener{Listener: ln}
+
+	dialer := func() (net.Conn, error) {
+		return nil, errors.New("no target")
+	}
+
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.MaxConcurrentConns = 1
+	go p.Accept()
+	defer p.Shutdown()
+
+	// Clients that never send a header, the first one takes the only slot
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err, "should be able to dial into proxy")
+		defer conn.Close()
+		if i == 0 {
+			continue
+		}
+
+		// Rejecting a client doesn't block the accept loop on its header
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err, "should reject client over connection limit")
+	}
+}
+
+func TestProxyProtocolPassesOriginalAddress(t *testing.T) {
+	// Incoming listener, expecting PROXY protocol headers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	incoming := &proxyproto.Listener{Listener: ln}
+
+	// Target listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	// Start accept loop
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, true)
+	go p.Accept()
+	defer p.Shutdown()
+
+	// Proxy a connection, pretending to be a load balancer
+	src, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+
+	_, err = src.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 5678 443\r\nA"))
+	assert.Nil(t, err, "should be able to write to proxy")
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+
+	header, err := proxyproto.Read(bufio.NewReaderSize(dst, 12))
+	assert.Nil(t, err, "should be able to read header")
+	assert.Equal(t, net.ParseIP("192.0.2.1").To4(), header.SourceAddress, "should forward original source address")
+	assert.Equal(t, uint16(5678), header.SourcePort, "should forward original source port")
+
+	p.Shutdown()
+	dst.Close()
+	src.Close()
+	p.Wait()
+}
+
+func TestACMEChallengeNotProxied(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+
+	// Incoming listener, negotiates ACME protocol like the TLS-ALPN-01 challenge config
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	incoming := tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{acmeALPNProto},
+	})
+
+	var dialed int32
+	dialer := func() (net.Conn, error) {
+		atomic.StoreInt32(&dialed, 1)
+		return nil, errors.New("should not dial")
+	}
+
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	go p.Accept()
+	defer p.Shutdown()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{acmeALPNProto},
+	})
+	assert.Nil(t, err, "handshake for ACME challenge should succeed")
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err, "ACME challenge connection should be closed")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dialed), "ACME challenge connection should not be proxied")
+}
+
+type testAuthorizer struct {
+	calls int32
+	err   error
+}
+
+func (a *testAuthorizer) Authorize(conn net.Conn, state tls.ConnectionState) error {
+	atomic.AddInt32(&a.calls, 1)
+	return a.err
+}
+
+func TestAuthorizerDenied(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	incoming := tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+
+	var dialed int32
+	dialer := func() (net.Conn, error) {
+		atomic.StoreInt32(&dialed, 1)
+		return nil, errors.New("should not dial")
+	}
+
+	authorizer := &testAuthorizer{err: errors.New("denied for test")}
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.Authorizer = authorizer
+	go p.Accept()
+	defer p.Shutdown()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "handshake should succeed")
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err, "denied connection should be closed")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&authorizer.calls), "authorizer should be called")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dialed), "denied connection should not be proxied")
+}
+
+type testAuditor struct {
+	results chan error
+}
+
+func (a *testAuditor) Audit(conn net.Conn, err error) {
+	a.results <- err
+}
+
+func TestAuditor(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	incoming := tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+
+	dialer := func() (net.Conn, error) {
+		return nil, errors.New("no target")
+	}
+
+	authorizer := &testAuthorizer{}
+	auditor := &testAuditor{results: make(chan error, 1)}
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.Authorizer = authorizer
+	p.Auditor = auditor
+	go p.Accept()
+	defer p.Shutdown()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "handshake should succeed")
+	conn.Close()
+	assert.Nil(t, <-auditor.results, "allowed connection should be audited")
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should connect")
+	raw.Write([]byte("not a TLS handshake"))
+	raw.Close()
+	assert.NotNil(t, <-auditor.results, "failed handshake should be audited")
+
+	authorizer.err = errors.New("denied for test")
+	conn, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "handshake should succeed")
+	conn.Close()
+	assert.Equal(t, authorizer.err, <-auditor.results, "denied connection should be audited")
+}
+
+func TestAuditorRateLimited(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	incoming := tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+
+	dialer := func() (net.Conn, error) {
+		return nil, errors.New("no target")
+	}
+
+	auditor := &testAuditor{results: make(chan error, 1)}
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.Auditor = auditor
+	p.MaxConnRatePerClient = 0.001
+	go p.Accept()
+	defer p.Shutdown()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "handshake should succeed")
+	conn.Close()
+	assert.Nil(t, <-auditor.results, "allowed connection should be audited")
+
+	// Rate limited connections must not be recorded as allowed
+	conn, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "handshake should succeed")
+	conn.Close()
+	assert.Equal(t, errRateLimited, <-auditor.results, "rate limited connection should be audited")
+}
+
+type testFieldLogger struct {
+	testLogger
+	entries chan map[string]interface{}
+}
+
+func (t *testFieldLogger) LogFields(msg string, fields map[string]interface{}) {
+	fields["message"] = msg
+	t.entries <- fields
+}
+
+func TestProxyStructuredLogging(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	logger := &testFieldLogger{entries: make(chan map[string]interface{}, 10)}
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, logger, LogEverything, false)
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+
+	opening := <-logger.entries
+	assert.Equal(t, "opening pipe", opening["message"])
+	assert.Equal(t, src.LocalAddr().String(), opening["client_addr"], "should log client address")
+	assert.NotNil(t, opening["conn_id"], "should log connection ID")
+
+	_, err = src.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to write to proxy")
+	_, err = io.ReadFull(dst, make([]byte, 5))
+	assert.Nil(t, err, "should be able to read from target")
+	src.Close()
+	dst.Close()
+
+	closed := <-logger.entries
+	assert.Equal(t, "closed pipe", closed["message"])
+	assert.Equal(t, opening["conn_id"], closed["conn_id"], "should log same connection ID")
+	assert.Equal(t, int64(5), closed["bytes_in"], "should log bytes transferred")
+	assert.NotNil(t, closed["duration_ms"], "should log duration")
+}
+
+type testAccessLogger struct {
+	entries chan map[string]interface{}
+}
+
+func (t *testAccessLogger) LogAccess(fields map[string]interface{}) {
+	t.entries <- fields
+}
+
+func TestProxyAccessLog(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	accessLog := &testAccessLogger{entries: make(chan map[string]interface{}, 1)}
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, 0, false)
+	p.AccessLog = accessLog
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	_, err = dst.Write([]byte("hello world"))
+	assert.Nil(t, err, "should be able to write to target")
+	_, err = io.ReadFull(src, make([]byte, 11))
+	assert.Nil(t, err, "should be able to read from proxy")
+	src.Close()
+
+	entry := <-accessLog.entries
+	assert.Equal(t, "client_closed", entry["close_reason"], "should log close reason")
+	assert.Equal(t, int64(0), entry["bytes_in"], "should log bytes received from client")
+	assert.Equal(t, int64(11), entry["bytes_out"], "should log bytes sent to client")
+	assert.NotNil(t, entry["start_time"], "should log start time")
+}
+
+func TestProxyShutdownDrainsConnections(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	go p.Accept()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	assert.Equal(t, int64(1), p.OpenConnections(), "should count open connection")
+
+	p.Shutdown()
+
+	drained := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(drained)
+	}()
+
+	// Open connection still works while draining
+	src.Write([]byte("A"))
+	received := make([]byte, 1)
+	_, err = io.ReadFull(dst, received)
+	assert.Nil(t, err, "should forward data while draining")
+
+	select {
+	case <-drained:
+		t.Fatal("should wait for open connections on shutdown")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// New connections are refused
+	_, err = net.Dial("tcp", incoming.Addr().String())
+	assert.NotNil(t, err, "should not accept new connections while draining")
+
+	src.Close()
+	dst.Close()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("should finish draining once connections are closed")
+	}
+	assert.Equal(t, int64(0), p.OpenConnections(), "should count closed connection")
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+	p := New([]net.Listener{incoming}, 60*time.Second, nil, &testLogger{}, LogEverything, false)
+	p.HandshakeTimeout = 50 * time.Millisecond
+	go p.Accept()
+	defer p.Shutdown()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err, "should connect")
+	defer conn.Close()
+
+	// Never start the handshake, should be closed after the handshake timeout
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err, "should be closed by proxy")
+	assert.True(t, time.Since(start) < 5*time.Second, "should be closed before connect timeout")
+}
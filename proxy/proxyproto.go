@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+)
+
+// PROXY protocol v2 constants, see section 2.2 of the spec:
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+const (
+	pp2CommandLocal = 0x20
+	pp2CommandProxy = 0x21
+
+	pp2FamilyUnspec = 0x00
+	pp2FamilyTCPv4  = 0x11
+	pp2FamilyTCPv6  = 0x21
+
+	pp2TypeALPN          = 0x01
+	pp2TypeAuthority     = 0x02
+	pp2TypeSSL           = 0x20
+	pp2SubtypeSSLVersion = 0x21
+	pp2SubtypeSSLCN      = 0x22
+	pp2SubtypeSSLCipher  = 0x23
+
+	pp2ClientSSL      = 0x01
+	pp2ClientCertConn = 0x02
+)
+
+var pp2Signature = []byte{'\x0D', '\x0A', '\x0D', '\x0A', '\x00', '\x0D', '\x0A', '\x51', '\x55', '\x49', '\x54', '\x0A'}
+
+// proxyProtoHeader builds a PROXY protocol v2 header for the given connection.
+// If the connection is a TLS connection, the header will carry TLVs with the
+// SNI, ALPN protocol and TLS parameters negotiated with the client.
+func proxyProtoHeader(c net.Conn) []byte {
+	var state *tls.ConnectionState
+	if tlsConn, ok := c.(secureConn); ok {
+		cs := tlsConn.ConnectionState()
+		state = &cs
+	}
+	return formatProxyProtoHeader(c.RemoteAddr(), c.LocalAddr(), state)
+}
+
+func formatProxyProtoHeader(src, dst net.Addr, state *tls.ConnectionState) []byte {
+	var addrs bytes.Buffer
+	command, family := byte(pp2CommandLocal), byte(pp2FamilyUnspec)
+
+	sAddr, sOk := src.(*net.TCPAddr)
+	dAddr, dOk := dst.(*net.TCPAddr)
+	if sOk && dOk {
+		command = pp2CommandProxy
+		if sAddr.IP.To4() != nil && dAddr.IP.To4() != nil {
+			family = pp2FamilyTCPv4
+			addrs.Write(sAddr.IP.To4())
+			addrs.Write(dAddr.IP.To4())
+		} else {
+			family = pp2FamilyTCPv6
+			addrs.Write(sAddr.IP.To16())
+			addrs.Write(dAddr.IP.To16())
+		}
+		_ = binary.Write(&addrs, binary.BigEndian, uint16(sAddr.Port))
+		_ = binary.Write(&addrs, binary.BigEndian, uint16(dAddr.Port))
+	}
+
+	var tlvs bytes.Buffer
+	if state != nil {
+		if state.NegotiatedProtocol != "" {
+			writeTLV(&tlvs, pp2TypeALPN, []byte(state.NegotiatedProtocol))
+		}
+		if state.ServerName != "" {
+			writeTLV(&tlvs, pp2TypeAuthority, []byte(state.ServerName))
+		}
+		writeTLV(&tlvs, pp2TypeSSL, sslTLV(state))
+	}
+
+	var header bytes.Buffer
+	header.Write(pp2Signature)
+	header.WriteByte(command)
+	header.WriteByte(family)
+	_ = binary.Write(&header, binary.BigEndian, uint16(addrs.Len()+tlvs.Len()))
+	header.Write(addrs.Bytes())
+	header.Write(tlvs.Bytes())
+	return header.Bytes()
+}
+
+// sslTLV builds the value of a PP2_TYPE_SSL TLV, see section 2.2.5 of the spec.
+func sslTLV(state *tls.ConnectionState) []byte {
+	var value bytes.Buffer
+
+	client := byte(pp2ClientSSL)
+	if len(state.PeerCertificates) > 0 {
+		client |= pp2ClientCertConn
+	}
+	value.WriteByte(client)
+
+	// Verify field: zero means the client presented a certificate and it was
+	// successfully verified. Handshakes that fail verification never reach us.
+	_ = binary.Write(&value, binary.BigEndian, uint32(0))
+
+	writeTLV(&value, pp2SubtypeSSLVersion, []byte(tlsVersionName(state.Version)))
+	if len(state.PeerCertificates) > 0 && state.PeerCertificates[0].Subject.CommonName != "" {
+		writeTLV(&value, pp2SubtypeSSLCN, []byte(state.PeerCertificates[0].Subject.CommonName))
+	}
+	if name := tls.CipherSuiteName(state.CipherSuite); state.CipherSuite != 0 {
+		writeTLV(&value, pp2SubtypeSSLCipher, []byte(name))
+	}
+
+	return value.Bytes()
+}
+
+func writeTLV(buf *bytes.Buffer, typ byte, value []byte) {
+	buf.WriteByte(typ)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return "unknown"
+}
@@ -0,0 +1,106 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+)
+
+// Parse TLVs from a PROXY protocol v2 header, returns map of type to value.
+func parseTLVs(t *testing.T, header []byte) map[byte][]byte {
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	assert.Equal(t, len(header)-16, length, "header length field should match")
+
+	var addrLen int
+	switch header[13] {
+	case pp2FamilyTCPv4:
+		addrLen = 12
+	case pp2FamilyTCPv6:
+		addrLen = 36
+	}
+
+	tlvs := map[byte][]byte{}
+	rest := header[16+addrLen:]
+	for len(rest) > 0 {
+		l := int(binary.BigEndian.Uint16(rest[1:3]))
+		tlvs[rest[0]] = rest[3 : 3+l]
+		rest = rest[3+l:]
+	}
+	return tlvs
+}
+
+func TestProxyProtoHeaderIPv6(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	raw := formatProxyProtoHeader(src, dst, nil)
+	header, err := proxyproto.Read(bufio.NewReader(bytes.NewReader(raw)))
+	assert.Nil(t, err, "should be able to parse header")
+	assert.True(t, header.TransportProtocol.IsIPv6(), "should be an IPv6 header")
+	assert.True(t, header.SourceAddress.Equal(src.IP), "should have correct source address")
+	assert.True(t, header.DestinationAddress.Equal(dst.IP), "should have correct destination address")
+	assert.Equal(t, uint16(1234), header.SourcePort)
+	assert.Equal(t, uint16(443), header.DestinationPort)
+}
+
+func TestProxyProtoHeaderUnix(t *testing.T) {
+	src := &net.UnixAddr{Name: "/tmp/src", Net: "unix"}
+	dst := &net.UnixAddr{Name: "/tmp/dst", Net: "unix"}
+
+	raw := formatProxyProtoHeader(src, dst, nil)
+	assert.Equal(t, byte(pp2CommandLocal), raw[12], "non-TCP connections should be sent as LOCAL")
+	assert.Len(t, raw, 16, "LOCAL header should not carry addresses")
+}
+
+func TestProxyProtoHeaderTLVs(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+	state := &tls.ConnectionState{
+		Version:            tls.VersionTLS12,
+		CipherSuite:        tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		ServerName:         "backend.example.com",
+		NegotiatedProtocol: "h2",
+		PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: "client"}},
+		},
+	}
+
+	raw := formatProxyProtoHeader(src, dst, state)
+	header, err := proxyproto.Read(bufio.NewReader(bytes.NewReader(raw)))
+	assert.Nil(t, err, "should be able to parse header with TLVs")
+	assert.True(t, header.SourceAddress.Equal(src.IP), "should have correct source address")
+
+	tlvs := parseTLVs(t, raw)
+	assert.Equal(t, []byte("h2"), tlvs[pp2TypeALPN], "should have ALPN TLV")
+	assert.Equal(t, []byte("backend.example.com"), tlvs[pp2TypeAuthority], "should have authority TLV")
+
+	ssl := tlvs[pp2TypeSSL]
+	assert.Equal(t, byte(pp2ClientSSL|pp2ClientCertConn), ssl[0], "should have client flags set")
+	assert.True(t, bytes.Contains(ssl, []byte("TLSv1.2")), "should have TLS version sub-TLV")
+	assert.True(t, bytes.Contains(ssl, []byte("client")), "should have CN sub-TLV")
+	assert.True(t, bytes.Contains(ssl, []byte("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")), "should have cipher sub-TLV")
+}
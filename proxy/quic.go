@@ -0,0 +1,93 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/square/ghostunnel/tracing"
+)
+
+var (
+	quicSessionCounter = metrics.GetOrRegisterCounter("quic.sessions", metrics.DefaultRegistry)
+	quicStreamCounter  = metrics.GetOrRegisterCounter("quic.streams", metrics.DefaultRegistry)
+)
+
+// streamSession is implemented by connections that carry tunnels as streams,
+// instead of being a tunnel themselves (see transport.QUICConn).
+type streamSession interface {
+	net.Conn
+	AcceptStream() (net.Conn, error)
+	GoAway()
+}
+
+// serveStreams accepts streams on a QUIC connection, and forwards each of
+// them to the backend. Returns once the connection is closed, or after
+// shutdown once all streams are done.
+func (p *Proxy) serveStreams(session streamSession, identity, listenerName string, span *tracing.Span) {
+	if !p.addStreamSession(session) {
+		return
+	}
+	defer p.removeStreamSession(session)
+
+	quicSessionCounter.Inc(1)
+	defer quicSessionCounter.Dec(1)
+
+	wg := &sync.WaitGroup{}
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			break
+		}
+		quicStreamCounter.Inc(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer quicStreamCounter.Dec(1)
+			defer stream.Close()
+			streamSpan := p.Tracer.Start("quic-stream", tracing.KindServer, span)
+			defer streamSpan.End()
+			p.forward(stream, identity, listenerName, streamSpan, time.Now())
+		}()
+	}
+	wg.Wait()
+}
+
+// addStreamSession tracks an open QUIC connection, unless the proxy is
+// shutting down.
+func (p *Proxy) addStreamSession(session streamSession) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.LoadInt32(&p.quit) == 1 {
+		return false
+	}
+	if p.streamSessions == nil {
+		p.streamSessions = map[streamSession]bool{}
+	}
+	p.streamSessions[session] = true
+	return true
+}
+
+func (p *Proxy) removeStreamSession(session streamSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.streamSessions, session)
+}
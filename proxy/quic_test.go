@@ -0,0 +1,86 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/square/ghostunnel/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQUIC(t *testing.T) {
+	// Only used for its certificate
+	config := &tls.Config{}
+	ln, _ := newTestTLSListener(t, config)
+	ln.Close()
+
+	socket, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	incoming, err := transport.ListenQUIC(socket, func() *tls.Config { return config }, time.Second)
+	assert.Nil(t, err, "should be able to listen for QUIC connections")
+
+	echoDialer := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			io.Copy(server, server)
+		}()
+		return client, nil
+	}
+	p := New([]net.Listener{incoming}, 60*time.Second, echoDialer, &testLogger{}, LogEverything, false)
+	go p.Accept()
+
+	dialer := transport.NewQUICDialer(func() *tls.Config {
+		return &tls.Config{InsecureSkipVerify: true, NextProtos: []string{transport.QUICProtocol}}
+	}, time.Second)
+
+	tunnels := []net.Conn{}
+	for i := 0; i < 3; i++ {
+		tunnel, err := dialer.Dial("udp", incoming.Addr().String())
+		assert.Nil(t, err, "should open tunnel")
+		_, err = tunnel.Write([]byte("ping"))
+		assert.Nil(t, err, "should write to tunnel")
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(tunnel, buf)
+		assert.Nil(t, err, "should read echo from backend")
+		assert.Equal(t, "ping", string(buf))
+		tunnels = append(tunnels, tunnel)
+	}
+	assert.Len(t, p.Connections(), 3, "should proxy each tunnel as a connection")
+	assert.Equal(t, int64(1), quicSessionCounter.Count(), "should carry all tunnels over one connection")
+
+	// Shutdown drains open tunnels
+	p.Shutdown()
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	for _, tunnel := range tunnels {
+		tunnel.Close()
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("proxy should shut down once tunnels are closed")
+	}
+}
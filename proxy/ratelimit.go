@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Interval at which idle buckets are removed from a rate limiter.
+const rateLimiterCleanupInterval = time.Minute
+
+// rateLimiter is a token bucket rate limiter, keeping one bucket per key. The
+// burst size is one second worth of tokens (but at least one token). A nil
+// rateLimiter allows everything.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a rate limiter allowing the given number of events
+// per second for each key. Returns nil if rate is not positive.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   math.Max(rate, 1),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// allow consumes a token from the bucket for key, returns false if there
+// were no tokens left.
+func (r *rateLimiter) allow(key string) bool {
+	if r == nil {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if now.Sub(r.lastCleanup) > rateLimiterCleanupInterval {
+		r.cleanup(now)
+	}
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+	b.refill(now, r.rate, r.burst)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cleanup removes buckets that have been refilled completely, so that the
+// number of buckets doesn't grow without bounds. Caller must hold the lock.
+func (r *rateLimiter) cleanup(now time.Time) {
+	for key, b := range r.buckets {
+		b.refill(now, r.rate, r.burst)
+		if b.tokens >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastCleanup = now
+}
+
+func (b *bucket) refill(now time.Time, rate, burst float64) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
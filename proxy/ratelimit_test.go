@@ -0,0 +1,106 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(2)
+	limiter.now = func() time.Time { return now }
+
+	assert.True(t, limiter.allow("a"), "should allow burst")
+	assert.True(t, limiter.allow("a"), "should allow burst")
+	assert.False(t, limiter.allow("a"), "should reject past burst")
+	assert.True(t, limiter.allow("b"), "should track keys independently")
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, limiter.allow("a"), "should refill tokens over time")
+	assert.False(t, limiter.allow("a"), "should reject past refilled tokens")
+
+	now = now.Add(2 * rateLimiterCleanupInterval)
+	assert.True(t, limiter.allow("c"), "should allow new key")
+	assert.Len(t, limiter.buckets, 1, "should clean up full buckets")
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := newRateLimiter(0)
+	assert.Nil(t, limiter, "zero rate should disable limiter")
+	for i := 0; i < 100; i++ {
+		assert.True(t, limiter.allow("a"), "disabled limiter should allow everything")
+	}
+}
+
+func TestRateLimiterFractionalRate(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(0.5)
+	limiter.now = func() time.Time { return now }
+
+	assert.True(t, limiter.allow("a"), "should allow at least one token")
+	assert.False(t, limiter.allow("a"), "should reject past burst")
+
+	now = now.Add(time.Second)
+	assert.False(t, limiter.allow("a"), "should not have refilled yet")
+
+	now = now.Add(time.Second)
+	assert.True(t, limiter.allow("a"), "should have refilled after two seconds")
+}
+
+func TestProxyMaxConnRate(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New([]net.Listener{incoming}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.MaxConnRatePerClient = 0.001
+	go p.Accept()
+	defer p.Shutdown()
+
+	// First connection should be forwarded
+	first, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer first.Close()
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	dst.Close()
+
+	// Second connection from same client should be closed
+	second, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer second.Close()
+
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.NotNil(t, err, "connection over rate limit should be closed")
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "connection over rate limit should be closed")
+	}
+}
@@ -0,0 +1,78 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var reenforcedCounter = metrics.GetOrRegisterCounter("conn.reenforced", metrics.DefaultRegistry)
+
+// authenticatedConns tracks open client connections that passed the
+// handshake and access checks, so they can be checked again later.
+type authenticatedConns struct {
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func (a *authenticatedConns) add(conn net.Conn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conns == nil {
+		a.conns = map[net.Conn]bool{}
+	}
+	a.conns[conn] = true
+}
+
+func (a *authenticatedConns) remove(conn net.Conn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.conns, conn)
+}
+
+// Reenforce checks all open TLS connections from clients with the given
+// function, e.g. against a new trust or access control configuration after
+// a reload, and closes the ones that fail the check. Closing a connection
+// also ends all multiplexed streams and tunnels carried over it. Returns the
+// number of connections that were closed.
+func (p *Proxy) Reenforce(check func(conn net.Conn, state tls.ConnectionState) error) int {
+	p.authenticated.mu.Lock()
+	conns := make([]net.Conn, 0, len(p.authenticated.conns))
+	for conn := range p.authenticated.conns {
+		conns = append(conns, conn)
+	}
+	p.authenticated.mu.Unlock()
+
+	closed := 0
+	for _, conn := range conns {
+		tlsConn, ok := conn.(secureConn)
+		if !ok {
+			continue
+		}
+		if err := check(conn, tlsConn.ConnectionState()); err != nil {
+			reenforcedCounter.Inc(1)
+			p.logConditional(LogConnectionErrors, "closing connection from %s: access no longer allowed for %s: %s", conn.RemoteAddr(), clientIdentity(conn), err)
+			conn.Close()
+			closed++
+		}
+	}
+	return closed
+}
@@ -0,0 +1,84 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReenforce(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+	backend := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go echoConn(server)
+		return client, nil
+	}
+	p := New([]net.Listener{incoming}, 10*time.Second, backend, &testLogger{}, LogEverything, false)
+	go p.Accept()
+	defer p.Shutdown()
+
+	allowed, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "allowed"})
+	assert.Nil(t, err, "should connect")
+	defer allowed.Close()
+	denied, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "denied"})
+	assert.Nil(t, err, "should connect")
+	defer denied.Close()
+
+	for _, conn := range []net.Conn{allowed, denied} {
+		conn.Write([]byte("x"))
+		_, err := conn.Read(make([]byte, 1))
+		assert.Nil(t, err, "should proxy data")
+	}
+
+	closed := p.Reenforce(func(conn net.Conn, state tls.ConnectionState) error {
+		if state.ServerName == "denied" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+	assert.Equal(t, 1, closed, "should close one connection")
+
+	denied.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = denied.Read(make([]byte, 1))
+	assert.NotNil(t, err, "should close connection that failed the check")
+
+	allowed.Write([]byte("y"))
+	allowed.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = allowed.Read(make([]byte, 1))
+	assert.Nil(t, err, "should keep connection that passed the check")
+}
+
+// echoConn echoes data back until the connection is closed.
+func echoConn(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var dialRetryCounter = metrics.GetOrRegisterCounter("dial.retries", metrics.DefaultRegistry)
+
+// withRetries wraps a dialer to retry failed dials, with exponential backoff
+// (see DialRetries). Dials aren't retried anymore once we're shutting down.
+func (p *Proxy) withRetries(dial Dialer) Dialer {
+	if p.DialRetries <= 0 {
+		return dial
+	}
+	return func() (net.Conn, error) {
+		backoff := p.DialBackoff
+		for attempt := 0; ; attempt++ {
+			conn, err := dial()
+			if err == nil || attempt >= p.DialRetries || atomic.LoadInt32(&p.quit) == 1 {
+				return conn, err
+			}
+
+			p.logConditional(LogConnectionErrors, "error on dial (retrying in %s): %s", backoff, err)
+			dialRetryCounter.Inc(1)
+			time.Sleep(backoff)
+
+			backoff *= 2
+			if p.DialMaxBackoff > 0 && backoff > p.DialMaxBackoff {
+				backoff = p.DialMaxBackoff
+			}
+		}
+	}
+}
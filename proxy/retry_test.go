@@ -0,0 +1,77 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyDialer fails the first failures dials, then succeeds.
+func flakyDialer(failures int, attempts *int) Dialer {
+	return func() (net.Conn, error) {
+		*attempts++
+		if *attempts <= failures {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		go server.Close()
+		return client, nil
+	}
+}
+
+func TestDialRetries(t *testing.T) {
+	p := New(nil, time.Second, nil, &testLogger{}, LogEverything, false)
+	p.DialRetries = 3
+	p.DialBackoff = time.Millisecond
+	p.DialMaxBackoff = 2 * time.Millisecond
+
+	attempts := 0
+	conn, err := p.withRetries(flakyDialer(2, &attempts))()
+	assert.Nil(t, err, "should succeed after retrying")
+	conn.Close()
+	assert.Equal(t, 3, attempts, "should retry until dial succeeds")
+
+	attempts = 0
+	_, err = p.withRetries(flakyDialer(10, &attempts))()
+	assert.NotNil(t, err, "should fail once retries are exhausted")
+	assert.Equal(t, 4, attempts, "should dial once, then retry DialRetries times")
+}
+
+func TestDialRetriesDisabled(t *testing.T) {
+	p := New(nil, time.Second, nil, &testLogger{}, LogEverything, false)
+
+	attempts := 0
+	_, err := p.withRetries(flakyDialer(1, &attempts))()
+	assert.NotNil(t, err, "should not retry by default")
+	assert.Equal(t, 1, attempts)
+}
+
+func TestDialRetriesShutdown(t *testing.T) {
+	p := New(nil, time.Second, nil, &testLogger{}, LogEverything, false)
+	p.DialRetries = 3
+	p.DialBackoff = time.Millisecond
+	p.Shutdown()
+
+	attempts := 0
+	_, err := p.withRetries(flakyDialer(10, &attempts))()
+	assert.NotNil(t, err, "should fail")
+	assert.Equal(t, 1, attempts, "should not retry once shutting down")
+}
@@ -0,0 +1,72 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/square/ghostunnel/wildcard"
+)
+
+// Route forwards connections matching it to a different backend than the
+// default one. Routes are matched against the TLS connection state after the
+// handshake.
+type Route struct {
+	// ServerName is matched against the (lower-cased) SNI value sent by the
+	// client (optional).
+	ServerName wildcard.Matcher
+	// Protocol is matched against the negotiated ALPN protocol (optional).
+	Protocol string
+	// Dial function to reach the backend for this route.
+	Dial Dialer
+}
+
+// matches checks if the route matches the given connection. If both a server
+// name and a protocol are set, both have to match.
+func (r Route) matches(conn net.Conn) bool {
+	tlsConn, ok := conn.(secureConn)
+	if !ok {
+		return false
+	}
+	state := tlsConn.ConnectionState()
+	if r.ServerName != nil && !r.ServerName.Matches(strings.ToLower(state.ServerName)) {
+		return false
+	}
+	return r.Protocol == "" || r.Protocol == state.NegotiatedProtocol
+}
+
+// dialerFor returns the dialer for the given connection: DialConn if set,
+// the first matching route, or the default dialer if no routes match. Failed
+// dials are retried if DialRetries is set, and the connection is held while
+// the backend is unavailable if HoldTimeout is set.
+func (p *Proxy) dialerFor(conn net.Conn) Dialer {
+	dial := p.Dial
+	if p.DialConn != nil {
+		dial = func() (net.Conn, error) {
+			return p.DialConn(conn)
+		}
+	} else {
+		for _, route := range p.Routes {
+			if route.matches(conn) {
+				dial = route.Dial
+				break
+			}
+		}
+	}
+	return p.withHold(p.withRetries(dial))
+}
@@ -0,0 +1,150 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/square/ghostunnel/wildcard"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTLSListener listens on a random port, with a self-signed certificate.
+func newTestTLSListener(t *testing.T, config *tls.Config) (net.Listener, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	config.Certificates = []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}
+	return tls.NewListener(ln, config), ln.Addr().String()
+}
+
+// namedDialer returns a dialer that reports its name on the channel, and
+// returns a connection whose other end is discarded.
+func namedDialer(name string, dialed chan string) Dialer {
+	return func() (net.Conn, error) {
+		dialed <- name
+		client, server := net.Pipe()
+		go server.Close()
+		return client, nil
+	}
+}
+
+func TestRoutesByServerName(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+
+	pattern, err := wildcard.CompileWithSeparator("*.example.com", '.')
+	assert.Nil(t, err, "should compile pattern")
+
+	dialed := make(chan string, 10)
+	p := New([]net.Listener{incoming}, 60*time.Second, namedDialer("default", dialed), &testLogger{}, LogEverything, false)
+	p.Routes = []Route{
+		{ServerName: wildcard.MustCompile("a.example.com"), Dial: namedDialer("a", dialed)},
+		{ServerName: pattern, Dial: namedDialer("wildcard", dialed)},
+	}
+	go p.Accept()
+	defer p.Shutdown()
+
+	for serverName, expected := range map[string]string{
+		"a.example.com": "a",
+		"A.EXAMPLE.COM": "a",
+		"b.example.com": "wildcard",
+		"example.org":   "default",
+		"":              "default",
+	} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+		assert.Nil(t, err, "handshake should succeed")
+		select {
+		case name := <-dialed:
+			assert.Equal(t, expected, name, "should route sni '%s' to %s", serverName, expected)
+		case <-time.After(5 * time.Second):
+			t.Errorf("timed out waiting for dial for sni '%s'", serverName)
+		}
+		conn.Close()
+	}
+}
+
+func TestRoutesByProtocol(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{NextProtos: []string{"h2", "postgres"}})
+
+	dialed := make(chan string, 10)
+	p := New([]net.Listener{incoming}, 60*time.Second, namedDialer("default", dialed), &testLogger{}, LogEverything, false)
+	p.Routes = []Route{
+		{ServerName: wildcard.MustCompile("a.example.com"), Protocol: "h2", Dial: namedDialer("a-h2", dialed)},
+		{Protocol: "h2", Dial: namedDialer("h2", dialed)},
+		{Protocol: "postgres", Dial: namedDialer("postgres", dialed)},
+	}
+	go p.Accept()
+	defer p.Shutdown()
+
+	for _, tc := range []struct {
+		serverName string
+		protocols  []string
+		expected   string
+	}{
+		{"a.example.com", []string{"h2"}, "a-h2"},
+		{"b.example.com", []string{"h2"}, "h2"},
+		{"a.example.com", []string{"postgres"}, "postgres"},
+		{"a.example.com", []string{"http/1.1"}, "default"},
+		{"a.example.com", nil, "default"},
+	} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: tc.serverName, NextProtos: tc.protocols})
+		assert.Nil(t, err, "handshake should succeed")
+		select {
+		case name := <-dialed:
+			assert.Equal(t, tc.expected, name, "should route %s/%v to %s", tc.serverName, tc.protocols, tc.expected)
+		case <-time.After(5 * time.Second):
+			t.Errorf("timed out waiting for dial for %s/%v", tc.serverName, tc.protocols)
+		}
+		conn.Close()
+	}
+}
+
+func TestDialConn(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+
+	dialed := make(chan string, 10)
+	p := New([]net.Listener{incoming}, 60*time.Second, namedDialer("default", dialed), &testLogger{}, LogEverything, false)
+	p.Routes = []Route{{Dial: namedDialer("route", dialed)}}
+	p.DialConn = func(conn net.Conn) (net.Conn, error) {
+		return namedDialer(conn.LocalAddr().String(), dialed)()
+	}
+	go p.Accept()
+	defer p.Shutdown()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "handshake should succeed")
+	defer conn.Close()
+	select {
+	case name := <-dialed:
+		assert.Equal(t, addr, name, "should dial with connection")
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for dial")
+	}
+}
@@ -0,0 +1,74 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+var errSourceDenied = errors.New("source address not allowed")
+
+// SourceFilter restricts which source networks may connect. Connections are
+// checked before the TLS handshake. A nil SourceFilter allows everything.
+type SourceFilter struct {
+	// Allowed networks. If empty, all sources (except denied ones) are
+	// allowed. Otherwise, only sources in one of these networks are allowed.
+	Allowed []*net.IPNet
+	// Denied networks, take precedence over allowed networks.
+	Denied []*net.IPNet
+}
+
+// allows checks if the given remote address may connect. Addresses without
+// an IP (e.g. UNIX sockets) are only allowed if no allowed networks are set.
+func (f *SourceFilter) allows(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return len(f.Allowed) == 0
+	}
+	if containsIP(f.Denied, ip) {
+		return false
+	}
+	return len(f.Allowed) == 0 || containsIP(f.Allowed, ip)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
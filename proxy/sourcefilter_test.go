@@ -0,0 +1,79 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestSourceFilter(t *testing.T) {
+	var nilFilter *SourceFilter
+	assert.True(t, nilFilter.allows(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}), "nil filter should allow everything")
+
+	filter := &SourceFilter{
+		Allowed: []*net.IPNet{mustParseCIDR("10.0.0.0/8"), mustParseCIDR("2001:db8::/32")},
+		Denied:  []*net.IPNet{mustParseCIDR("10.1.0.0/16")},
+	}
+	assert.True(t, filter.allows(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}), "should allow source in allowed network")
+	assert.True(t, filter.allows(&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}), "should allow source in allowed network")
+	assert.True(t, filter.allows(&net.UDPAddr{IP: net.ParseIP("10.0.0.1")}), "should allow UDP source in allowed network")
+	assert.False(t, filter.allows(&net.TCPAddr{IP: net.ParseIP("10.1.0.1")}), "denied networks should take precedence")
+	assert.False(t, filter.allows(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}), "should reject source outside allowed networks")
+	assert.False(t, filter.allows(&net.UnixAddr{Name: "@", Net: "unix"}), "should reject non-IP source if allowed networks are set")
+
+	filter = &SourceFilter{Denied: []*net.IPNet{mustParseCIDR("192.0.2.0/24")}}
+	assert.False(t, filter.allows(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}), "should reject source in denied network")
+	assert.True(t, filter.allows(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}), "should allow source not in denied network")
+	assert.True(t, filter.allows(&net.UnixAddr{Name: "@", Net: "unix"}), "should allow non-IP source if only denied networks are set")
+}
+
+func TestSourceFilterRejectsBeforeHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	dialed := make(chan struct{}, 1)
+	dialer := func() (net.Conn, error) {
+		dialed <- struct{}{}
+		return nil, net.UnknownNetworkError("should not dial")
+	}
+
+	p := New([]net.Listener{ln}, 60*time.Second, dialer, &testLogger{}, LogEverything, false)
+	p.SourceFilter = &SourceFilter{Denied: []*net.IPNet{mustParseCIDR("127.0.0.0/8")}}
+	go p.Accept()
+	defer p.Shutdown()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err, "denied connection should be closed")
+	assert.Len(t, dialed, 0, "denied connection should not be proxied")
+}
@@ -0,0 +1,151 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Failures are pruned once we track more source IPs than this.
+const tarpitPruneThreshold = 10000
+
+var tarpitCounter = metrics.GetOrRegisterCounter("accept.tarpitted", metrics.DefaultRegistry)
+
+// Tarpit delays new connections from source IPs with repeated failed
+// handshakes or access denials, before the handshake, to slow down scanners
+// and brute-force attempts (and save the work of handshakes with them). Once
+// an IP had Threshold failures, its connections are delayed by Delay,
+// doubling with each further failure up to MaxDelay. Failures are forgotten
+// after Window without new ones, or after a successful handshake that
+// passed access checks. A nil Tarpit doesn't delay anything.
+type Tarpit struct {
+	Threshold int
+	Delay     time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*tarpitEntry
+}
+
+type tarpitEntry struct {
+	count int
+	last  time.Time
+}
+
+// NewTarpit creates a tarpit with the given settings (see Tarpit).
+func NewTarpit(threshold int, delay, maxDelay, window time.Duration) *Tarpit {
+	return &Tarpit{
+		Threshold: threshold,
+		Delay:     delay,
+		MaxDelay:  maxDelay,
+		Window:    window,
+		failures:  map[string]*tarpitEntry{},
+	}
+}
+
+// delay returns how long to delay a new connection from the given IP.
+func (t *Tarpit) delay(ip string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.failures[ip]
+	if !ok || entry.count < t.Threshold {
+		return 0
+	}
+	if time.Since(entry.last) > t.Window {
+		delete(t.failures, ip)
+		return 0
+	}
+	delay := t.Delay
+	for i := t.Threshold; i < entry.count && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.MaxDelay {
+		delay = t.MaxDelay
+	}
+	return delay
+}
+
+// fail records a failed handshake or access check from the given IP.
+func (t *Tarpit) fail(ip string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := t.failures[ip]
+	if !ok || now.Sub(entry.last) > t.Window {
+		if len(t.failures) >= tarpitPruneThreshold {
+			t.prune(now)
+		}
+		entry = &tarpitEntry{}
+		t.failures[ip] = entry
+	}
+	entry.count++
+	entry.last = now
+}
+
+// succeed forgets failures from the given IP.
+func (t *Tarpit) succeed(ip string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, ip)
+}
+
+// prune removes failures older than the window. Must be called with mu held.
+func (t *Tarpit) prune(now time.Time) {
+	for ip, entry := range t.failures {
+		if now.Sub(entry.last) > t.Window {
+			delete(t.failures, ip)
+		}
+	}
+}
+
+// tarpit delays a connection from the given IP if needed (see Tarpit).
+// Returns false if we started shutting down while waiting.
+func (p *Proxy) tarpit(ip string) bool {
+	delay := p.Tarpit.delay(ip)
+	if delay <= 0 {
+		return true
+	}
+	tarpitCounter.Inc(1)
+	p.logConditional(LogHandshakeErrors, "delaying connection from %s by %s after repeated failures", ip, delay)
+	deadline := time.Now().Add(delay)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt32(&p.quit) == 1 {
+			return false
+		}
+		wait := 100 * time.Millisecond
+		if remaining := time.Until(deadline); remaining < wait {
+			wait = remaining
+		}
+		time.Sleep(wait)
+	}
+	return atomic.LoadInt32(&p.quit) == 0
+}
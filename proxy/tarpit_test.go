@@ -0,0 +1,79 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarpitDelay(t *testing.T) {
+	tarpit := NewTarpit(2, 100*time.Millisecond, 350*time.Millisecond, time.Minute)
+
+	tarpit.fail("10.0.0.1")
+	assert.Equal(t, time.Duration(0), tarpit.delay("10.0.0.1"), "should not delay below threshold")
+	tarpit.fail("10.0.0.1")
+	assert.Equal(t, 100*time.Millisecond, tarpit.delay("10.0.0.1"), "should delay once threshold is reached")
+	tarpit.fail("10.0.0.1")
+	assert.Equal(t, 200*time.Millisecond, tarpit.delay("10.0.0.1"), "should double delay with each failure")
+	tarpit.fail("10.0.0.1")
+	assert.Equal(t, 350*time.Millisecond, tarpit.delay("10.0.0.1"), "should cap delay")
+	assert.Equal(t, time.Duration(0), tarpit.delay("10.0.0.2"), "should not delay other IPs")
+
+	tarpit.succeed("10.0.0.1")
+	assert.Equal(t, time.Duration(0), tarpit.delay("10.0.0.1"), "should forget failures after success")
+
+	var disabled *Tarpit
+	disabled.fail("10.0.0.1")
+	assert.Equal(t, time.Duration(0), disabled.delay("10.0.0.1"), "nil tarpit should not delay")
+}
+
+func TestTarpitWindow(t *testing.T) {
+	tarpit := NewTarpit(1, time.Second, time.Second, 10*time.Millisecond)
+	tarpit.fail("10.0.0.1")
+	assert.Equal(t, time.Second, tarpit.delay("10.0.0.1"), "should delay within window")
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, time.Duration(0), tarpit.delay("10.0.0.1"), "should forget failures after window")
+}
+
+func TestTarpitFailedHandshakes(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{})
+	unreachable := func() (net.Conn, error) { return nil, errors.New("unreachable") }
+	p := New([]net.Listener{incoming}, 10*time.Second, unreachable, &testLogger{}, LogEverything, false)
+	p.Tarpit = NewTarpit(1, 300*time.Millisecond, time.Second, time.Minute)
+	go p.Accept()
+	defer p.Shutdown()
+
+	// Fail a handshake by sending garbage
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err, "should connect")
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	conn.Read(make([]byte, 1024))
+	conn.Close()
+	assert.Eventually(t, func() bool { return p.Tarpit.delay("127.0.0.1") > 0 }, time.Second, time.Millisecond, "should record failure")
+
+	start := time.Now()
+	tlsConn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "should complete handshake eventually")
+	tlsConn.Close()
+	assert.True(t, time.Since(start) >= 300*time.Millisecond, "should delay handshake after failures")
+	assert.Eventually(t, func() bool { return p.Tarpit.delay("127.0.0.1") == 0 }, time.Second, time.Millisecond, "should forget failures after successful handshake")
+}
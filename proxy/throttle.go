@@ -0,0 +1,64 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"time"
+)
+
+// throttledReader limits the rate at which data can be read from the
+// underlying reader using a token bucket (one token per byte).
+type throttledReader struct {
+	reader io.Reader
+	rate   float64
+	burst  float64
+	bucket bucket
+	sleep  func(time.Duration)
+	now    func() time.Time
+}
+
+// newThrottledReader wraps reader to allow reading rate bytes per second,
+// with bursts of up to burst bytes (defaults to rate if not positive).
+func newThrottledReader(reader io.Reader, rate, burst int64) *throttledReader {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &throttledReader{
+		reader: reader,
+		rate:   float64(rate),
+		burst:  float64(burst),
+		bucket: bucket{tokens: float64(burst), last: time.Now()},
+		sleep:  time.Sleep,
+		now:    time.Now,
+	}
+}
+
+// Read reads from the underlying reader, then waits until enough tokens are
+// available. We don't limit the size of reads up front as that would split up
+// datagrams for UDP sessions, instead the bucket may go into debt.
+func (r *throttledReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		r.bucket.refill(r.now(), r.rate, r.burst)
+		r.bucket.tokens -= float64(n)
+		if r.bucket.tokens < 0 {
+			r.sleep(time.Duration(-r.bucket.tokens / r.rate * float64(time.Second)))
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,61 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottledReader(t *testing.T) {
+	now := time.Now()
+	slept := time.Duration(0)
+
+	r := newThrottledReader(bytes.NewReader(make([]byte, 3000)), 1000, 0)
+	r.bucket.last = now
+	r.now = func() time.Time { return now }
+	r.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	n, err := io.Copy(ioutil.Discard, r)
+	assert.Nil(t, err, "should read all data")
+	assert.Equal(t, int64(3000), n, "should read all data")
+
+	// First 1000 bytes are covered by burst, rest needs to wait
+	assert.Equal(t, 2*time.Second, slept, "should have waited for tokens")
+}
+
+func TestThrottledReaderBurst(t *testing.T) {
+	now := time.Now()
+	slept := time.Duration(0)
+
+	r := newThrottledReader(bytes.NewReader(make([]byte, 100)), 10, 1000)
+	r.bucket.last = now
+	r.now = func() time.Time { return now }
+	r.sleep = func(d time.Duration) { slept += d }
+
+	_, err := io.Copy(ioutil.Discard, r)
+	assert.Nil(t, err, "should read all data")
+	assert.Equal(t, time.Duration(0), slept, "should not wait within burst")
+}
@@ -0,0 +1,38 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/square/ghostunnel/tracing"
+	"github.com/square/ghostunnel/transport"
+)
+
+// serveWebSocket reads the upgrade request of a WebSocket tunnel on a
+// connection, and forwards the tunnel to the backend.
+func (p *Proxy) serveWebSocket(conn net.Conn, identity, listenerName string, span *tracing.Span, acceptTime time.Time) {
+	err := transport.ServeWebSocket(conn, p.WebSocketPath, p.handshakeTimeout(), func(tunnel net.Conn) {
+		p.forward(tunnel, identity, listenerName, span, acceptTime)
+	})
+	if err != nil {
+		errorCounter.Inc(1)
+		span.SetError(err)
+		p.logConditional(LogHandshakeErrors, "error on websocket upgrade from %s: %s", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,67 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/square/ghostunnel/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocket(t *testing.T) {
+	incoming, addr := newTestTLSListener(t, &tls.Config{NextProtos: []string{transport.WebSocketProtocol}})
+
+	echoDialer := func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			io.Copy(server, server)
+		}()
+		return client, nil
+	}
+	p := New([]net.Listener{incoming}, 60*time.Second, echoDialer, &testLogger{}, LogEverything, false)
+	p.ConnectTimeout = time.Second
+	p.WebSocketPath = "/tunnel"
+	go p.Accept()
+	defer p.Shutdown()
+
+	dial := func(path string) (net.Conn, error) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{transport.WebSocketProtocol}})
+		if err != nil {
+			return nil, err
+		}
+		return transport.DialWebSocket(conn, "backend.example.com", path)
+	}
+
+	tunnel, err := dial("/tunnel")
+	assert.Nil(t, err, "should open tunnel")
+	_, err = tunnel.Write([]byte("ping"))
+	assert.Nil(t, err, "should write to tunnel")
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(tunnel, buf)
+	assert.Nil(t, err, "should read echo from backend")
+	assert.Equal(t, "ping", string(buf))
+	tunnel.Close()
+
+	_, err = dial("/other")
+	assert.NotNil(t, err, "should reject tunnels on other paths")
+}
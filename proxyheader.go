@@ -0,0 +1,125 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+)
+
+// proxyHeaderListener wraps a listener to parse PROXY protocol headers on
+// accepted connections, like proxyproto.Listener. The header is read the
+// first time the addresses or data of a connection are used, and must arrive
+// within the given timeout. The proxyproto package doesn't enforce a timeout
+// itself, and addresses are looked up before handshake deadlines are set, so
+// clients that connect but never send anything would otherwise block the
+// connection handler forever.
+type proxyHeaderListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l *proxyHeaderListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyHeaderConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+type proxyHeaderConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *proxyproto.Header
+	err    error
+
+	mu   sync.Mutex
+	done bool
+	// Read deadline set by the user of the connection, applied once the
+	// header has been read
+	readDeadline time.Time
+}
+
+// readHeader reads the PROXY protocol header (if any). Connections without
+// a header are passed through unchanged.
+func (c *proxyHeaderConn) readHeader() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		// proxyproto.Read treats read errors as a missing header, so wait
+		// for the first byte here to catch clients that never send anything.
+		if _, c.err = c.reader.Peek(1); c.err == nil {
+			c.header, c.err = proxyproto.Read(c.reader)
+			if c.err == proxyproto.ErrNoProxyProtocol {
+				c.err = nil
+			}
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.done = true
+		if c.err == nil {
+			c.err = c.Conn.SetReadDeadline(c.readDeadline)
+		}
+	})
+	return c.err
+}
+
+func (c *proxyHeaderConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyHeaderConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.header != nil {
+		return c.header.RemoteAddr()
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyHeaderConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.header != nil {
+		return c.header.LocalAddr()
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyHeaderConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *proxyHeaderConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if !c.done {
+		// Applied once the header has been read
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
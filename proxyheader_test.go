@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProxyHeaderListener(t *testing.T, timeout time.Duration) (net.Listener, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	return &proxyHeaderListener{Listener: listener, timeout: timeout}, listener.Addr().String()
+}
+
+func TestProxyHeaderTimeout(t *testing.T) {
+	listener, addr := newTestProxyHeaderListener(t, 50*time.Millisecond)
+	defer listener.Close()
+
+	// Client connects but never writes
+	client, err := net.Dial("tcp", addr)
+	assert.Nil(t, err, "should connect")
+	defer client.Close()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept")
+	defer conn.Close()
+
+	start := time.Now()
+	assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String(), "should fall back to socket address")
+	assert.True(t, time.Since(start) < time.Second, "should stop waiting for header after timeout")
+
+	_, err = conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "should time out without header")
+}
+
+func TestProxyHeaderReceived(t *testing.T) {
+	listener, addr := newTestProxyHeaderListener(t, 50*time.Millisecond)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", addr)
+	assert.Nil(t, err, "should connect")
+	defer client.Close()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept")
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\nx"))
+	assert.Equal(t, "192.0.2.1:1234", conn.RemoteAddr().String(), "should use address from header")
+	assert.Equal(t, "192.0.2.2:443", conn.LocalAddr().String(), "should use address from header")
+
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	assert.Nil(t, err, "should read data after header")
+	assert.Equal(t, "x", string(buf))
+
+	// Deadline set by the user applies once the header was read
+	time.Sleep(100 * time.Millisecond)
+	client.Write([]byte("y"))
+	_, err = conn.Read(buf)
+	assert.Nil(t, err, "should not time out after header")
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = conn.Read(buf)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "should apply user deadline")
+}
+
+func TestProxyHeaderMissing(t *testing.T) {
+	listener, addr := newTestProxyHeaderListener(t, 50*time.Millisecond)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", addr)
+	assert.Nil(t, err, "should connect")
+	defer client.Close()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept")
+	defer conn.Close()
+
+	client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	assert.Nil(t, err, "should pass through data without header")
+	assert.Equal(t, "hello", string(buf))
+	assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+}
@@ -0,0 +1,55 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/square/ghostunnel/auth"
+	"github.com/square/ghostunnel/certloader"
+)
+
+// pskOnly returns true if clients in server mode are only allowed with
+// pre-shared keys (--allow-psk-identity without other access control flags),
+// so listeners must all be UDP.
+func pskOnly(context *Context) bool {
+	return context.psks != nil && !*serverDisableAuth && context.peerKeys == nil &&
+		context.policy == nil && !serverACLFlags().allowsAny()
+}
+
+// serverPSKCallback returns the pre-shared key for clients of UDP listeners,
+// if their identity is allowed by --allow-all or --allow-psk-identity.
+func serverPSKCallback(psks *certloader.PSKFile) certloader.PSKCallback {
+	acl := auth.ACL{
+		AllowAll:             *serverAllowAll,
+		AllowedPSKIdentities: *serverAllowedPSKs,
+	}
+	return func(identity []byte) ([]byte, error) {
+		if err := acl.VerifyPSKIdentity(string(identity)); err != nil {
+			return nil, err
+		}
+		return psks.Key(string(identity))
+	}
+}
+
+// rejectCertificates is an implementation of VerifyPeerCertificate for
+// crypto/tls.Config that rejects all certificates, if only clients with
+// pre-shared keys are allowed.
+func rejectCertificates(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return errors.New("unauthorized: only clients with pre-shared keys are allowed")
+}
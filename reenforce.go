@@ -0,0 +1,107 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+
+	"github.com/square/ghostunnel/certloader"
+	"github.com/square/ghostunnel/proxy"
+)
+
+// reverifyConnection returns a check for open connections (see
+// proxy.Reenforce), which verifies the client certificate like
+// reverifyPeerCertificates, and then checks the connection with the
+// authorizer (if any).
+func reverifyConnection(serverConfig certloader.TLSServerConfig, authorizer proxy.Authorizer) func(net.Conn, tls.ConnectionState) error {
+	return func(conn net.Conn, state tls.ConnectionState) error {
+		if err := reverifyPeerCertificates(serverConfig, conn, state); err != nil {
+			return err
+		}
+		if authorizer != nil {
+			return authorizer.Authorize(conn, state)
+		}
+		return nil
+	}
+}
+
+// reverifyPeerCertificates verifies the client certificate of a connection
+// against the current server configuration like a new handshake would: the
+// chain is verified against the current CA bundle, then
+// VerifyPeerCertificate checks access control flags, the access policy and
+// CRLs.
+func reverifyPeerCertificates(serverConfig certloader.TLSServerConfig, conn net.Conn, state tls.ConnectionState) error {
+	config := serverConfig.GetServerConfig()
+	if config.GetConfigForClient != nil {
+		hello := &tls.ClientHelloInfo{ServerName: state.ServerName, Conn: conn}
+		if state.NegotiatedProtocol != "" {
+			hello.SupportedProtos = []string{state.NegotiatedProtocol}
+		}
+		if forClient, err := config.GetConfigForClient(hello); err == nil && forClient != nil {
+			config = forClient
+		}
+	}
+
+	if certs := state.PeerCertificates; len(certs) > 0 && config.ClientAuth != tls.NoClientCert {
+		var chains [][]*x509.Certificate
+		if config.ClientAuth >= tls.VerifyClientCertIfGiven {
+			now := time.Now()
+			if config.Time != nil {
+				now = config.Time()
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			var err error
+			chains, err = certs[0].Verify(x509.VerifyOptions{
+				Roots:         config.ClientCAs,
+				Intermediates: intermediates,
+				CurrentTime:   now,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if config.VerifyPeerCertificate != nil {
+			rawCerts := make([][]byte, len(certs))
+			for i, cert := range certs {
+				rawCerts[i] = cert.Raw
+			}
+			if err := config.VerifyPeerCertificate(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyResumedConnection is an implementation of VerifyConnection for
+// crypto/tls.Config, for servers with session tickets. Resumed sessions skip
+// VerifyPeerCertificate, so clients that were allowed when the ticket was
+// issued would still get in after being denied by a reload. They are
+// verified against the current configuration instead.
+func verifyResumedConnection(serverConfig certloader.TLSServerConfig, state tls.ConnectionState) error {
+	if !state.DidResume {
+		return nil
+	}
+	return reverifyPeerCertificates(serverConfig, nil, state)
+}
@@ -0,0 +1,242 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/square/ghostunnel/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// staticServerConfig is a certloader.TLSServerConfig with a fixed config.
+type staticServerConfig struct {
+	config *tls.Config
+}
+
+func (s staticServerConfig) GetServerConfig() *tls.Config {
+	return s.config
+}
+
+// newTestClientChain returns a CA, and a client certificate with the given
+// common name issued by it (both with the returned key).
+func newTestClientChain(t *testing.T, cn string) (*x509.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should generate key")
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &key.PublicKey, key)
+	assert.Nil(t, err, "should create CA certificate")
+	ca, _ := x509.ParseCertificate(caDER)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, key)
+	assert.Nil(t, err, "should create client certificate")
+	cert, _ := x509.ParseCertificate(der)
+	return ca, cert, key
+}
+
+type denyAuthorizer struct{}
+
+func (denyAuthorizer) Authorize(conn net.Conn, state tls.ConnectionState) error {
+	return errors.New("denied by authorizer")
+}
+
+func TestReverifyConnection(t *testing.T) {
+	ca, cert, _ := newTestClientChain(t, "client1")
+	otherCA, _, _ := newTestClientChain(t, "client1")
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	trusted := x509.NewCertPool()
+	trusted.AddCert(ca)
+	acl, err := newReloadableACL(aclFlags{allowedCNs: []string{"client1"}}, false)
+	assert.Nil(t, err, "should build ACL")
+	config := &tls.Config{
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		ClientCAs:             trusted,
+		VerifyPeerCertificate: acl.VerifyPeerCertificateServer,
+	}
+	check := reverifyConnection(staticServerConfig{config}, nil)
+	assert.Nil(t, check(nil, state), "should allow trusted client")
+
+	assert.NotNil(t, reverifyConnection(staticServerConfig{config}, denyAuthorizer{})(nil, state), "should check with authorizer")
+
+	// Client removed from the allow list
+	assert.Nil(t, acl.update(map[string]interface{}{"allow-cn": "client2"}, nil), "should update ACL")
+	assert.NotNil(t, check(nil, state), "should reject client no longer allowed")
+
+	// CA removed from the CA bundle
+	untrusted := x509.NewCertPool()
+	untrusted.AddCert(otherCA)
+	config.ClientCAs = untrusted
+	config.VerifyPeerCertificate = nil
+	assert.NotNil(t, check(nil, state), "should reject client no longer trusted")
+
+	// Clients without certificates (--disable-authentication)
+	config.ClientAuth = tls.NoClientCert
+	assert.Nil(t, check(nil, tls.ConnectionState{}), "should allow connection without client certificate")
+}
+
+func TestVerifyResumedConnection(t *testing.T) {
+	ca, cert, key := newTestClientChain(t, "client1")
+	certificate := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+	trusted := x509.NewCertPool()
+	trusted.AddCert(ca)
+	acl, err := newReloadableACL(aclFlags{allowedCNs: []string{"client1"}}, false)
+	assert.Nil(t, err, "should build ACL")
+
+	var serverConfig staticServerConfig
+	serverConfig.config = &tls.Config{
+		Certificates:          []tls.Certificate{certificate},
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		ClientCAs:             trusted,
+		VerifyPeerCertificate: acl.VerifyPeerCertificateServer,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verifyResumedConnection(serverConfig, state)
+		},
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig.config)
+	assert.Nil(t, err, "should listen")
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Write after the handshake, so clients receive session tickets
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+
+	clientConfig := &tls.Config{
+		Certificates:       []tls.Certificate{certificate},
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	dial := func() (bool, error) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			return false, err
+		}
+		defer conn.Close()
+		// With TLS 1.3, the server rejects the client after the handshake
+		_, err = conn.Read(make([]byte, 1))
+		return conn.ConnectionState().DidResume, err
+	}
+
+	resumed, err := dial()
+	assert.Nil(t, err, "should allow client")
+	assert.False(t, resumed, "should not resume first connection")
+	resumed, err = dial()
+	assert.Nil(t, err, "should allow resumed client")
+	assert.True(t, resumed, "should resume session")
+
+	// Client removed from the allow list can't resume its session
+	assert.Nil(t, acl.update(map[string]interface{}{"allow-cn": "client2"}, nil), "should update ACL")
+	_, err = dial()
+	assert.NotNil(t, err, "should reject resumed client no longer allowed")
+}
+
+func TestReenforceResumedConnection(t *testing.T) {
+	ca, cert, key := newTestClientChain(t, "client1")
+	certificate := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+	trusted := x509.NewCertPool()
+	trusted.AddCert(ca)
+	acl, err := newReloadableACL(aclFlags{allowedCNs: []string{"client1"}}, false)
+	assert.Nil(t, err, "should build ACL")
+
+	var serverConfig staticServerConfig
+	serverConfig.config = &tls.Config{
+		Certificates:          []tls.Certificate{certificate},
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		ClientCAs:             trusted,
+		VerifyPeerCertificate: acl.VerifyPeerCertificateServer,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verifyResumedConnection(serverConfig, state)
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+
+	// Backend connections send a byte and stay open
+	backends := make(chan net.Conn, 10)
+	dial := func() (net.Conn, error) {
+		conn, backend := net.Pipe()
+		backends <- backend
+		go backend.Write([]byte("x"))
+		return conn, nil
+	}
+	defer func() {
+		close(backends)
+		for backend := range backends {
+			backend.Close()
+		}
+	}()
+
+	p := proxy.New([]net.Listener{tls.NewListener(listener, serverConfig.config)}, time.Second, dial, logger, 0, false)
+	go p.Accept()
+	defer p.Shutdown()
+
+	clientConfig := &tls.Config{
+		Certificates:       []tls.Certificate{certificate},
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	assert.Nil(t, err, "should connect")
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Nil(t, err, "should proxy connection")
+
+	// Connection closed after the client is denied by a reload
+	assert.Nil(t, acl.update(map[string]interface{}{"allow-cn": "client2"}, nil), "should update ACL")
+	assert.Equal(t, 1, p.Reenforce(reverifyConnection(serverConfig, nil)), "should close connection")
+
+	// Reconnecting with the session ticket from the closed connection
+	resumed, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err == nil {
+		defer resumed.Close()
+		_, err = resumed.Read(make([]byte, 1))
+		assert.True(t, resumed.ConnectionState().DidResume, "should attempt to resume session")
+	}
+	assert.NotNil(t, err, "should reject resumed client after reenforcing")
+}
@@ -0,0 +1,106 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/ghostunnel/socket"
+)
+
+// Overridden in tests.
+var lookupHost = net.LookupHost
+
+// hostDialer returns a dialer for a tcp or udp address. If --target-dns-refresh
+// is set and the address has a host name, lookups are cached (see
+// cachingDialer), otherwise the host name is resolved on every dial.
+func hostDialer(network, address string) func() (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || *serverTargetRefresh <= 0 || net.ParseIP(host) != nil {
+		return func() (net.Conn, error) {
+			return socket.Dial(network, address, *timeoutDuration)
+		}
+	}
+	d := &cachingDialer{
+		network: network,
+		host:    host,
+		port:    port,
+		refresh: *serverTargetRefresh,
+	}
+	return d.Dial
+}
+
+// cachingDialer dials a host name, caching the addresses it resolves to for a
+// fixed time. Addresses are re-resolved once they expire, or if dialing all
+// of them fails (e.g. because the host moved to a new address).
+type cachingDialer struct {
+	network string
+	host    string
+	port    string
+	refresh time.Duration
+
+	mu      sync.Mutex
+	addrs   []string
+	expires time.Time
+}
+
+// Dial tries the addresses of the host (see socket.DialAddresses), returning
+// the first successful connection.
+func (d *cachingDialer) Dial() (net.Conn, error) {
+	addrs, err := d.addresses()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := socket.DialAddresses(d.network, addrs, d.port, *timeoutDuration)
+	if err == nil {
+		return conn, nil
+	}
+
+	d.mu.Lock()
+	d.expires = time.Time{}
+	d.mu.Unlock()
+	return nil, err
+}
+
+func (d *cachingDialer) addresses() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.addrs != nil && time.Now().Before(d.expires) {
+		return d.addrs, nil
+	}
+
+	addrs, err := lookupHost(d.host)
+	if err != nil {
+		if d.addrs != nil {
+			// Keep using old addresses until DNS works again
+			logger.Printf("unable to re-resolve target %s, using previous addresses: %s", d.host, err)
+			d.expires = time.Now().Add(d.refresh)
+			return d.addrs, nil
+		}
+		return nil, err
+	}
+	if d.addrs != nil && strings.Join(addrs, ",") != strings.Join(d.addrs, ",") {
+		logger.Printf("target %s now resolves to %s", d.host, strings.Join(addrs, ", "))
+	}
+	d.addrs = addrs
+	d.expires = time.Now().Add(d.refresh)
+	return addrs, nil
+}
@@ -0,0 +1,102 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachingDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	lookups := 0
+	addrs := []string{"127.0.0.1"}
+	var lookupErr error
+	lookupHost = func(host string) ([]string, error) {
+		lookups++
+		return addrs, lookupErr
+	}
+	timeout := *timeoutDuration
+	*serverTargetRefresh = time.Minute
+	*timeoutDuration = time.Second
+	defer func() {
+		lookupHost = net.LookupHost
+		*serverTargetRefresh = 0
+		*timeoutDuration = timeout
+	}()
+
+	dial := hostDialer("tcp", net.JoinHostPort("backend.example.com", port))
+	for i := 0; i < 3; i++ {
+		conn, err := dial()
+		assert.Nil(t, err, "should dial resolved address")
+		conn.Close()
+	}
+	assert.Equal(t, 1, lookups, "should cache resolved addresses")
+
+	// Unreachable address, dial fails and next dial re-resolves
+	dialer := &cachingDialer{network: "tcp", host: "backend.example.com", port: port, refresh: time.Minute}
+	dialer.addrs = []string{"192.0.2.1"}
+	dialer.expires = time.Now().Add(time.Minute)
+	*timeoutDuration = 100 * time.Millisecond
+	_, err = dialer.Dial()
+	assert.NotNil(t, err, "should fail to dial stale address")
+	conn, err := dialer.Dial()
+	assert.Nil(t, err, "should re-resolve after failed dial")
+	conn.Close()
+
+	// Lookup errors keep previous addresses
+	dialer.expires = time.Time{}
+	lookupErr = errors.New("lookup failed for test")
+	addrs = nil
+	conn, err = dialer.Dial()
+	assert.Nil(t, err, "should use previous addresses if lookup fails")
+	conn.Close()
+}
+
+func TestHostDialerIP(t *testing.T) {
+	*serverTargetRefresh = time.Minute
+	defer func() { *serverTargetRefresh = 0 }()
+	lookupHost = func(host string) ([]string, error) {
+		t.Fatalf("should not look up IP address %s", host)
+		return nil, nil
+	}
+	defer func() { lookupHost = net.LookupHost }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	defer ln.Close()
+	conn, err := hostDialer("tcp", ln.Addr().String())()
+	assert.Nil(t, err, "should dial IP address directly")
+	conn.Close()
+}
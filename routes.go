@@ -0,0 +1,119 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/square/ghostunnel/proxy"
+	"github.com/square/ghostunnel/wildcard"
+)
+
+// routeSpec is a parsed --route flag, of the form sni=NAME,alpn=PROTO,target=ADDR
+// (with at least one of sni or alpn).
+type routeSpec struct {
+	serverName string
+	protocol   string
+	target     string
+	// Compiled pattern for serverName
+	serverNameMatcher wildcard.Matcher
+}
+
+// parseRoute parses a --route flag value.
+func parseRoute(value string) (*routeSpec, error) {
+	route := &routeSpec{}
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid route '%s', expected key=value pairs (e.g. sni=example.com,target=localhost:8080)", value)
+		}
+		switch kv[0] {
+		case "sni":
+			route.serverName = strings.ToLower(kv[1])
+		case "alpn":
+			route.protocol = kv[1]
+		case "target":
+			route.target = kv[1]
+		default:
+			return nil, fmt.Errorf("invalid route '%s', unknown key '%s'", value, kv[0])
+		}
+	}
+	if route.target == "" {
+		return nil, fmt.Errorf("invalid route '%s', missing target", value)
+	}
+	if route.serverName == "" && route.protocol == "" {
+		return nil, fmt.Errorf("invalid route '%s', missing sni or alpn", value)
+	}
+
+	if route.serverName != "" {
+		var err error
+		route.serverNameMatcher, err = wildcard.CompileWithSeparator(route.serverName, '.')
+		if err != nil {
+			return nil, fmt.Errorf("invalid route '%s', bad sni pattern: %s", value, err)
+		}
+	}
+	return route, nil
+}
+
+// serverBackendRoutes builds routes from the --route flags.
+func serverBackendRoutes(targetTLS *targetTLS) ([]proxy.Route, error) {
+	routes := []proxy.Route{}
+	for _, value := range *serverRoutes {
+		spec, err := parseRoute(value)
+		if err != nil {
+			return nil, err
+		}
+
+		route := proxy.Route{ServerName: spec.serverNameMatcher, Protocol: spec.protocol}
+		dial, err := backendDialer(spec.target)
+		if err != nil {
+			return nil, err
+		}
+		route.Dial = targetTLS.wrap(spec.target, dial)
+
+		logger.Printf("routing connections with %s to target address %s", spec, spec.target)
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// String describes the route's matching rules, for logging.
+func (r *routeSpec) String() string {
+	rules := []string{}
+	if r.serverName != "" {
+		rules = append(rules, "sni "+r.serverName)
+	}
+	if r.protocol != "" {
+		rules = append(rules, "alpn "+r.protocol)
+	}
+	return strings.Join(rules, " and ")
+}
+
+// routeProtocols returns the ALPN protocols used by routes, to advertise them
+// during handshakes (in order, without duplicates).
+func routeProtocols(routes []proxy.Route) []string {
+	protocols := []string{}
+	seen := map[string]bool{}
+	for _, route := range routes {
+		if route.Protocol != "" && !seen[route.Protocol] {
+			protocols = append(protocols, route.Protocol)
+			seen[route.Protocol] = true
+		}
+	}
+	return protocols
+}
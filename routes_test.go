@@ -0,0 +1,77 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoute(t *testing.T) {
+	route, err := parseRoute("sni=Internal.Example.com,target=10.0.0.5:443")
+	assert.Nil(t, err, "should parse valid route")
+	assert.Equal(t, "internal.example.com", route.serverName, "should parse (and lower-case) sni")
+	assert.Equal(t, "10.0.0.5:443", route.target, "should parse target")
+	assert.True(t, route.serverNameMatcher.Matches("internal.example.com"), "should compile sni pattern")
+
+	route, err = parseRoute("target=unix:/tmp/socket,sni=*.example.com")
+	assert.Nil(t, err, "should parse route with wildcard")
+	assert.True(t, route.serverNameMatcher.Matches("foo.example.com"), "should compile sni pattern")
+
+	route, err = parseRoute("alpn=h2,target=localhost:8081")
+	assert.Nil(t, err, "should parse route with alpn")
+	assert.Equal(t, "h2", route.protocol, "should parse alpn")
+	assert.Nil(t, route.serverNameMatcher, "should not match on sni if not given")
+	assert.Equal(t, "alpn h2", route.String(), "should describe route")
+
+	route, err = parseRoute("sni=example.com,alpn=postgres,target=localhost:5432")
+	assert.Nil(t, err, "should parse route with sni and alpn")
+	assert.Equal(t, "sni example.com and alpn postgres", route.String(), "should describe route")
+
+	for _, invalid := range []string{
+		"",
+		"sni=example.com",
+		"target=localhost:8080",
+		"sni=,target=localhost:8080",
+		"sni=example.com,target=localhost:8080,foo=bar",
+		"sni=example.com;target=localhost:8080",
+		"sni=foo*.example.com,target=localhost:8080",
+	} {
+		_, err := parseRoute(invalid)
+		assert.NotNil(t, err, "should reject invalid route '%s'", invalid)
+	}
+}
+
+func TestServerBackendRoutes(t *testing.T) {
+	*serverRoutes = []string{"sni=a.example.com,target=localhost:8080", "sni=b.example.com,target=unix:/tmp/b"}
+	defer func() { *serverRoutes = nil }()
+
+	routes, err := serverBackendRoutes(nil)
+	assert.Nil(t, err, "should build routes")
+	assert.Len(t, routes, 2, "should build one route per flag")
+	assert.True(t, routes[0].ServerName.Matches("a.example.com"), "should keep route order")
+}
+
+func TestRouteProtocols(t *testing.T) {
+	*serverRoutes = []string{"alpn=h2,target=localhost:8080", "sni=a.example.com,target=localhost:8081", "sni=b.example.com,alpn=h2,target=localhost:8082", "alpn=postgres,target=localhost:5432"}
+	defer func() { *serverRoutes = nil }()
+
+	routes, err := serverBackendRoutes(nil)
+	assert.Nil(t, err, "should build routes")
+	assert.Equal(t, []string{"h2", "postgres"}, routeProtocols(routes), "should advertise route protocols without duplicates")
+}
@@ -19,12 +19,23 @@ package main
 import (
 	ctx "context"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/square/ghostunnel/proxy"
+	"github.com/square/ghostunnel/socket"
 )
 
+// Delay between seeing a file change and reloading, to let writers that
+// update several files at once (e.g. cert and key) finish before we reload.
+const reloadOnChangeDelay = 1 * time.Second
+
+// How long to wait for a new process to become ready on upgrade.
+const upgradeTimeout = 1 * time.Minute
+
 // isShutdownSignal checks if the received signal is a shutdown signal
 // and returns true if that's the case. Returns false if the signal is
 // a refresh signal.
@@ -37,43 +48,92 @@ func isShutdownSignal(sig os.Signal) bool {
 	return false
 }
 
-// signalHandler listens for incoming shutdown or refresh signals. If we get
-// a shutdown signal, we stop listening for new connections and gracefully
-// terminate the process. If we get a refresh signal, reload certificates.
+// signalHandler listens for incoming shutdown, upgrade or refresh signals. If
+// we get a shutdown signal, we stop listening for new connections and
+// gracefully terminate the process. If we get an upgrade signal, we start a
+// new process that takes over our listening sockets, then shut down. If we get
+// a refresh signal, reload certificates. Shutdown signals are forwarded to
+// the child process (if any), and we shut down once it exits.
 func (context *Context) signalHandler(p *proxy.Proxy) {
 	signals := make(chan os.Signal, 3)
-	signal.Notify(signals, append(shutdownSignals, refreshSignals...)...)
+	signal.Notify(signals, append(append(shutdownSignals, upgradeSignals...), refreshSignals...)...)
 	defer signal.Stop(signals)
 
 	for {
 		// Wait for a signal
 		select {
 		case sig := <-signals:
-			if isShutdownSignal(sig) {
-				logger.Printf("received %s, shutting down", sig.String())
-
-				// Best-effort graceful shutdown of status listener
-				if context.statusHTTP != nil {
-					go context.statusHTTP.Shutdown(ctx.Background())
+			if isUpgradeSignal(sig) {
+				if context.child != nil {
+					logger.Printf("received %s, but upgrades aren't supported with a child command, ignoring", sig.String())
+					continue
 				}
+				logger.Printf("received %s, starting new process to take over listening sockets", sig.String())
+				if err := upgrade(); err != nil {
+					logger.Printf("error: upgrade failed, continuing to serve: %s", err)
+					continue
+				}
+				logger.Printf("new process is ready, shutting down")
+				context.shutdown(p)
+				return
+			}
 
-				// Force-exit after timeout
-				time.AfterFunc(context.shutdownTimeout, func() {
-					// Graceful shutdown timeout reached. If we can't drain connections
-					// to exit gracefully after this timeout, let's just exit.
-					logger.Printf("graceful shutdown timeout: forcing exit")
-					exitFunc(1)
-				})
-
-				p.Shutdown()
-				logger.Printf("shutdown proxy, waiting for drain")
+			if isShutdownSignal(sig) {
+				logger.Printf("received %s, shutting down", sig.String())
+				context.child.stop(sig)
+				context.shutdown(p)
 				return
 			}
 
 			logger.Printf("received %s, reloading TLS configuration", sig.String())
 			context.reload()
+		case <-context.child.exited():
+			logger.Printf("child process is done, shutting down")
+			context.shutdown(p)
+			return
+		}
+	}
+}
+
+// shutdown stops listening for new connections, and terminates the process
+// once open connections are drained (or the shutdown timeout is reached).
+func (context *Context) shutdown(p *proxy.Proxy) {
+	// Best-effort graceful shutdown of status listener
+	if context.statusHTTP != nil {
+		go context.statusHTTP.Shutdown(ctx.Background())
+	}
+
+	// Force-exit after timeout
+	time.AfterFunc(context.shutdownTimeout, func() {
+		// Graceful shutdown timeout reached. If we can't drain connections
+		// to exit gracefully after this timeout, let's just exit.
+		logger.Printf("graceful shutdown timeout: forcing exit with %d connection(s) still open", p.OpenConnections())
+		exitFunc(1)
+	})
+
+	p.Shutdown()
+	logger.Printf("shutdown proxy, waiting for %d open connection(s) to drain (for up to %s)", p.OpenConnections(), context.shutdownTimeout)
+}
+
+// upgrade starts a new process from the ghostunnel binary (which may have been
+// replaced on disk), with the same arguments, and hands off our listening
+// sockets to it.
+func upgrade() error {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	return socket.Upgrade(path, os.Args[1:], upgradeTimeout)
+}
+
+// isUpgradeSignal checks if the received signal is an upgrade signal.
+func isUpgradeSignal(sig os.Signal) bool {
+	for _, upgradeSignal := range upgradeSignals {
+		if sig == upgradeSignal {
+			return true
 		}
 	}
+	return false
 }
 
 func (context *Context) reloadHandler(interval time.Duration) {
@@ -85,11 +145,140 @@ func (context *Context) reloadHandler(interval time.Duration) {
 	}
 }
 
+// reloadOnChangeHandler watches the given files and reloads the TLS
+// configuration whenever one of them changes on disk. We watch the parent
+// directories rather than the files themselves so that atomic replacements
+// (via rename, or the symlink swap used by Kubernetes for mounted secrets)
+// are picked up.
+func (context *Context) reloadOnChangeHandler(files []string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := map[string]bool{}
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		dirs[dir] = true
+	}
+
+	go func() {
+		var pending <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				if pending == nil {
+					logger.Printf("detected change in %s, reloading TLS configuration", event.Name)
+					pending = time.After(reloadOnChangeDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Printf("error watching files for changes: %s", err)
+			case <-pending:
+				pending = nil
+				context.reload()
+			}
+		}
+	}()
+
+	return watcher, nil
+}
+
 func (context *Context) reload() {
 	context.status.Reloading()
 	if err := context.tlsConfigSource.Reload(); err != nil {
 		logger.Printf("error reloading TLS configuration: %s", err)
 	}
+	if context.policy != nil {
+		if err := context.policy.Reload(); err != nil {
+			logger.Printf("error reloading access policy: %s", err)
+		}
+	}
+	if context.caMetrics != nil {
+		if err := context.caMetrics.Reload(); err != nil {
+			logger.Printf("error reloading CA bundles for metrics: %s", err)
+		}
+	}
+	if context.crls != nil {
+		if err := context.crls.Reload(); err != nil {
+			logger.Printf("error reloading CRLs: %s", err)
+		}
+	}
+	if context.peerKeys != nil {
+		if err := context.peerKeys.Reload(); err != nil {
+			logger.Printf("error reloading peer keys: %s", err)
+		}
+	}
+	if context.psks != nil {
+		if err := context.psks.Reload(); err != nil {
+			logger.Printf("error reloading pre-shared keys: %s", err)
+		}
+	}
+	if context.ctLogs != nil {
+		if err := context.ctLogs.Reload(); err != nil {
+			logger.Printf("error reloading CT log list: %s", err)
+		}
+	}
+	if context.targetTrust != nil {
+		if err := context.targetTrust.Reload(); err != nil {
+			logger.Printf("error reloading target CA bundle: %s", err)
+		}
+	}
+	if context.listenerCert != nil {
+		if err := context.listenerCert.Reload(); err != nil {
+			logger.Printf("error reloading listener certificate: %s", err)
+		}
+	}
+	if context.ticketKeys != nil {
+		if err := context.ticketKeys.Reload(); err != nil {
+			logger.Printf("error reloading session ticket keys: %s", err)
+		}
+	}
+	if context.config != nil {
+		if err := context.config.Reload(); err != nil {
+			logger.Printf("error reloading config file: %s", err)
+		}
+	}
+	if context.expiry != nil {
+		context.expiry.check(time.Now())
+	}
+	if context.reenforce != nil {
+		context.reenforce()
+	}
 	logger.Printf("reloading complete")
 	context.status.Listening()
 }
+
+// reopenLogs reopens log files (e.g. after they were rotated).
+func (context *Context) reopenLogs() error {
+	if context.accessLog != nil {
+		if err := context.accessLog.Reopen(); err != nil {
+			logger.Printf("error reopening access log: %s", err)
+			return err
+		}
+		logger.Printf("reopened access log")
+	}
+	if context.auditLog != nil {
+		if err := context.auditLog.Reopen(); err != nil {
+			logger.Printf("error reopening audit log: %s", err)
+			return err
+		}
+		logger.Printf("reopened audit log")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/square/ghostunnel/certloader"
+	"github.com/square/ghostunnel/wildcard"
+)
+
+// sniKeystoreSpec is a parsed --keystore-for-sni flag, of the form
+// name=NAME,keystore=PATH.
+type sniKeystoreSpec struct {
+	serverName string
+	keystore   string
+	// Compiled pattern for serverName
+	serverNameMatcher wildcard.Matcher
+}
+
+// parseSNIKeystore parses a --keystore-for-sni flag value.
+func parseSNIKeystore(value string) (*sniKeystoreSpec, error) {
+	spec := &sniKeystoreSpec{}
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid keystore for sni '%s', expected key=value pairs (e.g. name=example.com,keystore=/path/to/keystore.p12)", value)
+		}
+		switch kv[0] {
+		case "name":
+			spec.serverName = strings.ToLower(kv[1])
+		case "keystore":
+			spec.keystore = kv[1]
+		default:
+			return nil, fmt.Errorf("invalid keystore for sni '%s', unknown key '%s'", value, kv[0])
+		}
+	}
+	if spec.serverName == "" || spec.keystore == "" {
+		return nil, fmt.Errorf("invalid keystore for sni '%s', name and keystore are required", value)
+	}
+
+	var err error
+	spec.serverNameMatcher, err = wildcard.CompileWithSeparator(spec.serverName, '.')
+	if err != nil {
+		return nil, fmt.Errorf("invalid keystore for sni '%s', bad name pattern: %s", value, err)
+	}
+	return spec, nil
+}
+
+// sniKeystorePaths returns the keystore paths from the --keystore-for-sni
+// flags, ignoring invalid flags (see serverValidateFlags).
+func sniKeystorePaths() []string {
+	paths := []string{}
+	for _, value := range *serverSNIKeystores {
+		if spec, err := parseSNIKeystore(value); err == nil {
+			paths = append(paths, spec.keystore)
+		}
+	}
+	return paths
+}
+
+// withSNICertificates wraps the default certificate to serve certificates
+// from --keystore-for-sni flags for matching server names, if any are set.
+func withSNICertificates(cert certloader.Certificate, client *http.Client) (certloader.Certificate, error) {
+	if len(*serverSNIKeystores) == 0 {
+		return cert, nil
+	}
+
+	sniCerts := []certloader.SNICertificate{}
+	for _, value := range *serverSNIKeystores {
+		spec, err := parseSNIKeystore(value)
+		if err != nil {
+			return nil, err
+		}
+		sniCert, err := buildKeystore(spec.keystore, *keystorePass, *caBundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load keystore for sni %s: %s", spec.serverName, err)
+		}
+		if client != nil {
+			sniCert = certloader.CertificateWithOCSPStapling(sniCert, client, logger)
+		}
+		logger.Printf("serving certificate from %s for sni %s", spec.keystore, spec.serverName)
+		sniCerts = append(sniCerts, certloader.SNICertificate{
+			ServerName:  spec.serverNameMatcher,
+			Certificate: sniCert,
+		})
+	}
+	return certloader.CertificateWithSNI(cert, sniCerts), nil
+}
@@ -0,0 +1,49 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSNIKeystore(t *testing.T) {
+	spec, err := parseSNIKeystore("name=Foo.Example.com,keystore=/path/to/foo.p12")
+	assert.Nil(t, err, "should parse valid flag")
+	assert.Equal(t, "foo.example.com", spec.serverName, "should parse (and lower-case) name")
+	assert.Equal(t, "/path/to/foo.p12", spec.keystore, "should parse keystore")
+	assert.True(t, spec.serverNameMatcher.Matches("foo.example.com"), "should compile name pattern")
+
+	for _, invalid := range []string{
+		"",
+		"name=foo.example.com",
+		"keystore=/path/to/foo.p12",
+		"name=foo.example.com,keystore=/path/to/foo.p12,password=secret",
+		"name=foo*.example.com,keystore=/path/to/foo.p12",
+	} {
+		_, err := parseSNIKeystore(invalid)
+		assert.NotNil(t, err, "should reject invalid flag '%s'", invalid)
+	}
+}
+
+func TestSNIKeystorePaths(t *testing.T) {
+	*serverSNIKeystores = []string{"name=a.example.com,keystore=a.p12", "invalid", "name=b.example.com,keystore=b.pem"}
+	defer func() { *serverSNIKeystores = nil }()
+
+	assert.Equal(t, []string{"a.p12", "b.pem"}, sniKeystorePaths(), "should return keystore paths")
+}
@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAbstractUnixSocket(t *testing.T) {
+	address := fmt.Sprintf("unix:@ghostunnel-test-%d", os.Getpid())
+	network, addr, _, err := ParseAddress(address)
+	assert.Nil(t, err, "should parse abstract socket address")
+	assert.Equal(t, "unix", network)
+	assert.True(t, IsAbstractUnixAddress(addr), "should be abstract socket address")
+
+	// Permissions don't apply to abstract sockets
+	UnixSocketMode = 0600
+	defer func() { UnixSocketMode = 0 }()
+
+	listener, err := ParseAndOpen(address)
+	assert.Nil(t, err, "should listen on abstract socket")
+	defer listener.Close()
+
+	conn, err := net.Dial(network, addr)
+	assert.Nil(t, err, "should connect to abstract socket")
+	conn.Close()
+}
@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// SupportsFreeBind is true if IP_FREEBIND is supported on this platform.
+const SupportsFreeBind = true
+
+// setFreeBind sets IP_FREEBIND, which also applies to IPv6 sockets.
+func setFreeBind(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_FREEBIND, 1)
+}
@@ -0,0 +1,218 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Environment variables for passing listening sockets to a new process on
+// upgrade (see Upgrade). The inherited sockets are given as URL-encoded
+// NETWORK:ADDRESS=FD pairs, the ready pipe as a file descriptor number.
+const (
+	inheritedListenersEnv = "GHOSTUNNEL_INHERITED_LISTENERS"
+	upgradeReadyEnv       = "GHOSTUNNEL_UPGRADE_READY_FD"
+)
+
+var (
+	// Listeners opened by Open, that can be handed off on upgrade.
+	openedMu sync.Mutex
+	opened   = map[string]net.Listener{}
+
+	inheritedOnce      sync.Once
+	inheritedListeners map[string]*os.File
+	upgradeReady       *os.File
+)
+
+// fileListener is implemented by *net.TCPListener and *net.UnixListener.
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+func listenerKey(network, address string) string {
+	return network + ":" + address
+}
+
+// registerListener remembers a listener, so it can be handed off on upgrade.
+func registerListener(network, address string, listener net.Listener) {
+	openedMu.Lock()
+	defer openedMu.Unlock()
+	opened[listenerKey(network, address)] = listener
+}
+
+// loadInherited reads the sockets passed to us by a parent process on upgrade
+// (if any). The environment variables are unset, so they aren't passed on to
+// child processes (e.g. on a later upgrade).
+func loadInherited() {
+	inheritedOnce.Do(func() {
+		inheritedListeners = map[string]*os.File{}
+		if values, err := url.ParseQuery(os.Getenv(inheritedListenersEnv)); err == nil {
+			for key := range values {
+				if fd, err := strconv.Atoi(values.Get(key)); err == nil {
+					inheritedListeners[key] = os.NewFile(uintptr(fd), key)
+				}
+			}
+		}
+		if fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv)); err == nil {
+			upgradeReady = os.NewFile(uintptr(fd), "upgrade-ready")
+		}
+		os.Unsetenv(inheritedListenersEnv)
+		os.Unsetenv(upgradeReadyEnv)
+	})
+}
+
+// inheritedListener returns the listener for the given network and address
+// passed on by a parent process on upgrade, or nil if there is none.
+func inheritedListener(network, address string) (net.Listener, error) {
+	loadInherited()
+
+	key := listenerKey(network, address)
+	file, ok := inheritedListeners[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(inheritedListeners, key)
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use inherited socket for %s: %s", key, err)
+	}
+	if unixListener, ok := listener.(*net.UnixListener); ok {
+		// We own the socket file now
+		unixListener.SetUnlinkOnClose(true)
+	}
+	return listener, nil
+}
+
+// Upgrade starts a new process from the given binary (and arguments), passing
+// it all TCP and UNIX listening sockets opened by Open so far, and waits for
+// it to call Ready. If the new process exits or doesn't become ready within
+// the timeout, it is killed and an error is returned. Once Upgrade returns
+// successfully, the caller should stop accepting connections, drain open
+// ones, and exit. Sockets that aren't handed off (e.g. UDP) must be opened
+// with SO_REUSEPORT by the new process.
+func Upgrade(path string, args []string, timeout time.Duration) error {
+	openedMu.Lock()
+	defer openedMu.Unlock()
+
+	files := []*os.File{}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	inherited := url.Values{}
+	for key, listener := range opened {
+		l, ok := listener.(fileListener)
+		if !ok {
+			continue
+		}
+		file, err := l.File()
+		if err != nil {
+			// Listener was closed
+			continue
+		}
+		// Passed files start at fd 3 in the new process
+		inherited.Set(key, strconv.Itoa(3+len(files)))
+		files = append(files, file)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+	readyFD := 3 + len(files)
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		inheritedListenersEnv+"="+inherited.Encode(),
+		upgradeReadyEnv+"="+strconv.Itoa(readyFD))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Close our end of the pipe, so reads fail if new process exits
+	readyWriter.Close()
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyReader.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			break
+		}
+		cmd.Process.Kill()
+		return fmt.Errorf("new process exited before becoming ready: %s", <-exited)
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return errors.New("timed out waiting for new process to become ready")
+	}
+
+	// New process owns the sockets now, so don't remove socket files when
+	// closing our listeners.
+	for _, listener := range opened {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+// Ready signals to the parent process (if we were started by Upgrade) that
+// we are ready to accept connections, so it can shut down.
+func Ready() error {
+	loadInherited()
+	if upgradeReady == nil {
+		return nil
+	}
+	defer func() {
+		upgradeReady.Close()
+		upgradeReady = nil
+	}()
+
+	// Close inherited sockets we didn't use (e.g. because flags changed)
+	for key, file := range inheritedListeners {
+		file.Close()
+		delete(inheritedListeners, key)
+	}
+
+	_, err := upgradeReady.Write([]byte{1})
+	return err
+}
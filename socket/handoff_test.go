@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestUpgradeHelperProcess is run as the new process in TestUpgrade. It opens
+// the inherited socket, signals readiness and serves a single connection.
+func TestUpgradeHelperProcess(t *testing.T) {
+	address := os.Getenv("GHOSTUNNEL_TEST_UPGRADE_ADDRESS")
+	if address == "" {
+		return
+	}
+	listener, err := Open("unix", address)
+	if err != nil {
+		os.Exit(1)
+	}
+	if err := Ready(); err != nil {
+		os.Exit(2)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		os.Exit(3)
+	}
+	conn.Write([]byte("new"))
+	conn.Close()
+	listener.Close()
+	os.Exit(0)
+}
+
+func TestUpgrade(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("upgrades are not supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "ghostunnel-upgrade")
+	assert.Nil(t, err, "should create temp dir")
+	defer os.RemoveAll(dir)
+	address := filepath.Join(dir, "socket")
+
+	listener, err := Open("unix", address)
+	assert.Nil(t, err, "should open listener")
+
+	os.Setenv("GHOSTUNNEL_TEST_UPGRADE_ADDRESS", address)
+	defer os.Unsetenv("GHOSTUNNEL_TEST_UPGRADE_ADDRESS")
+	err = Upgrade(os.Args[0], []string{"-test.run=TestUpgradeHelperProcess"}, 10*time.Second)
+	assert.Nil(t, err, "should start new process")
+
+	// Old listener is closed (as on shutdown), new process keeps serving
+	listener.Close()
+	_, err = os.Stat(address)
+	assert.Nil(t, err, "should not remove socket file after handoff")
+
+	conn, err := net.Dial("unix", address)
+	assert.Nil(t, err, "should connect to new process")
+	received, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err, "should read from new process")
+	assert.Equal(t, "new", string(received), "should be served by new process")
+}
+
+func TestUpgradeFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("upgrades are not supported on windows")
+	}
+
+	// New process exits without becoming ready
+	path, err := exec.LookPath("false")
+	if err == nil {
+		err = Upgrade(path, nil, 10*time.Second)
+		assert.NotNil(t, err, "should fail if new process exits before ready")
+	}
+
+	err = Upgrade("/does-not-exist", nil, 10*time.Second)
+	assert.NotNil(t, err, "should fail if new process can't be started")
+}
+
+func TestReadyWithoutParent(t *testing.T) {
+	assert.Nil(t, Ready(), "should do nothing if not started by upgrade")
+}
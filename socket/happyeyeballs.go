@@ -0,0 +1,130 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// Default delay before falling back to the other address family, as in
+// net.Dialer (RFC 6555 recommends 300ms).
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// DialAddresses connects to one of the given IP addresses (all on the same
+// port), using "Happy Eyeballs" (RFC 8305) for dual-stack hosts: addresses of
+// the same family as the first one are tried in turn, and if that hasn't
+// succeeded after TCPOptions.FallbackDelay, addresses of the other family are
+// tried in parallel. The first connection to be established is returned.
+func DialAddresses(network string, addrs []string, port string, timeout time.Duration) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+	var primaries, fallbacks []string
+	for _, addr := range addrs {
+		if isIPv4(addr) == isIPv4(addrs[0]) {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	if len(fallbacks) == 0 || TCPOptions.FallbackDelay < 0 || !strings.HasPrefix(network, "tcp") {
+		return dialSerial(network, addrs, port, timeout)
+	}
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result)
+	done := make(chan struct{})
+	defer close(done)
+	start := func(addrs []string, primary bool) {
+		go func() {
+			conn, err := dialSerial(network, addrs, port, timeout)
+			select {
+			case results <- result{conn, err, primary}:
+			case <-done:
+				// Lost the race
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+
+	delay := TCPOptions.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	fallback := time.NewTimer(delay)
+	defer fallback.Stop()
+
+	start(primaries, true)
+	pending, fallbackStarted := 1, false
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-fallback.C:
+			if !fallbackStarted {
+				start(fallbacks, false)
+				pending, fallbackStarted = pending+1, true
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			if !fallbackStarted {
+				// Primaries failed, no need to wait
+				start(fallbacks, false)
+				pending, fallbackStarted = pending+1, true
+			} else if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
+
+// dialSerial tries to connect to each address in turn.
+func dialSerial(network string, addrs []string, port string, timeout time.Duration) (net.Conn, error) {
+	var err error
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = Dial(network, net.JoinHostPort(addr, port), timeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func isIPv4(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() != nil
+}
@@ -0,0 +1,77 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	TCPOptions = Options{FallbackDelay: 50 * time.Millisecond}
+	defer func() { TCPOptions = Options{} }()
+
+	// Unreachable IPv6 address (documentation prefix) first, should fall
+	// back to IPv4 without waiting for the connect timeout.
+	start := time.Now()
+	conn, err := DialAddresses("tcp", []string{"2001:db8::1", "127.0.0.1"}, port, 10*time.Second)
+	assert.Nil(t, err, "should fall back to IPv4 address")
+	assert.True(t, time.Since(start) < 5*time.Second, "should dial fallback in parallel")
+	conn.Close()
+
+	conn, err = DialAddresses("tcp", []string{"127.0.0.1", "::1"}, port, time.Second)
+	assert.Nil(t, err, "should dial primary address")
+	assert.Equal(t, listener.Addr().String(), conn.RemoteAddr().String())
+	conn.Close()
+
+	listener.Close()
+	_, err = DialAddresses("tcp", []string{"::1", "127.0.0.1"}, port, time.Second)
+	assert.NotNil(t, err, "should fail if no address is reachable")
+	_, err = DialAddresses("tcp", nil, port, time.Second)
+	assert.NotNil(t, err, "should fail without addresses")
+}
+
+func TestListenFamily(t *testing.T) {
+	ListenFamily = FamilyIPv4
+	defer func() { ListenFamily = FamilyAny }()
+
+	listener, err := Open("tcp", ":0")
+	assert.Nil(t, err, "should listen on IPv4 wildcard address")
+	defer listener.Close()
+	assert.NotNil(t, listener.Addr().(*net.TCPAddr).IP.To4(), "should listen on IPv4")
+
+	ListenFamily = FamilyIPv6
+	_, err = Open("tcp", "127.0.0.1:0")
+	assert.NotNil(t, err, "should not listen on IPv4 address with IPv6 family")
+}
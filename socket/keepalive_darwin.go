@@ -0,0 +1,48 @@
+//go:build darwin
+// +build darwin
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func validateKeepAliveParams(o Options) error {
+	return nil
+}
+
+// On darwin, TCP_KEEPALIVE is the idle time before the first probe.
+func setKeepAliveParams(fd uintptr, o Options) error {
+	if o.KeepAliveIdle > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPALIVE, int(o.KeepAliveIdle/time.Second)); err != nil {
+			return err
+		}
+	}
+	if o.KeepAliveInterval > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(o.KeepAliveInterval/time.Second)); err != nil {
+			return err
+		}
+	}
+	if o.KeepAliveCount > 0 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, o.KeepAliveCount)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+//go:build windows
+// +build windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"errors"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Default keepalive idle time and interval set by Go, for parameters that
+// aren't given (windows can only set both at once).
+const defaultKeepAlivePeriod = 15 * time.Second
+
+func validateKeepAliveParams(o Options) error {
+	if o.KeepAliveCount > 0 {
+		return errors.New("keepalive count can't be changed on windows")
+	}
+	return nil
+}
+
+func setKeepAliveParams(fd uintptr, o Options) error {
+	idle, interval := o.KeepAliveIdle, o.KeepAliveInterval
+	if idle == 0 {
+		idle = defaultKeepAlivePeriod
+	}
+	if interval == 0 {
+		interval = defaultKeepAlivePeriod
+	}
+	params := syscall.TCPKeepalive{
+		OnOff:    1,
+		Time:     uint32(idle / time.Millisecond),
+		Interval: uint32(interval / time.Millisecond),
+	}
+	var returned uint32
+	size := uint32(unsafe.Sizeof(params))
+	return syscall.WSAIoctl(syscall.Handle(fd), syscall.SIO_KEEPALIVE_VALS, (*byte)(unsafe.Pointer(&params)), size, nil, 0, &returned, nil, 0)
+}
@@ -1,3 +1,4 @@
+//go:build !darwin
 // +build !darwin
 
 /*-
@@ -23,6 +24,10 @@ import (
 	"net"
 )
 
-func launchdSocket(address string) (net.Listener, error) {
+func launchdSocket(name string) (net.Listener, error) {
+	return nil, errors.New("launchd socket activation is only supported on darwin")
+}
+
+func launchdSockets(name string) ([]net.Listener, error) {
 	return nil, errors.New("launchd socket activation is only supported on darwin")
 }
@@ -1,3 +1,4 @@
+//go:build darwin
 // +build darwin
 
 /*-
@@ -31,25 +32,56 @@ import (
 	"unsafe"
 )
 
-func launchdSocket(address string) (net.Listener, error) {
-	c_name := C.CString(address)
+// launchdSockets returns all sockets configured in the launchd plist under
+// the given socket key name. If the SockFamily is not set for a socket, launchd
+// will open both an IPv4 and an IPv6 socket for the same name.
+func launchdSockets(name string) ([]net.Listener, error) {
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
 	var c_fds *C.int
 	c_cnt := C.size_t(0)
 
 	err := C.launch_activate_socket(c_name, &c_fds, &c_cnt)
 	if err != 0 {
-		return nil, fmt.Errorf("couldn't activate launchd socket: %v", err)
+		return nil, fmt.Errorf("couldn't activate launchd socket '%s': %v", name, err)
 	}
 
 	length := int(c_cnt)
-	if length != 1 {
-		return nil, fmt.Errorf("expected exactly one socket to be configured in launchd for '%s', found %d", address, length)
+	if length == 0 {
+		return nil, fmt.Errorf("expected listener with name %s configured in launchd, but found none", name)
 	}
 	ptr := unsafe.Pointer(c_fds)
 	defer C.free(ptr)
 
-	fds := (*[1]C.int)(ptr)
-	file := os.NewFile(uintptr(fds[0]), "")
+	fds := (*[1 << 20]C.int)(ptr)[:length:length]
+	listeners := []net.Listener{}
+	for _, fd := range fds {
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
 
-	return net.FileListener(file)
+func launchdSocket(name string) (net.Listener, error) {
+	listeners, err := launchdSockets(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(listeners) != 1 {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, fmt.Errorf("expected exactly one socket to be configured in launchd for '%s', found %d", name, len(listeners))
+	}
+	return listeners[0], nil
 }
@@ -17,16 +17,19 @@
 package socket
 
 import (
+	"errors"
 	"net"
+	"runtime"
 	"strings"
-
-	reuseport "github.com/kavu/go_reuseport"
+	"time"
 )
 
 // ParseAddress parses a string representing a TCP address or UNIX socket
 // for our backend target. The input can be or the form "HOST:PORT" for
-// a TCP socket, "unix:PATH" for a UNIX socket, and "systemd:NAME" or
-// "launchd:NAME" for a socket provided by launchd/systemd for socket
+// a TCP socket, "udp:HOST:PORT" for a UDP socket, "unix:PATH" for a UNIX
+// socket ("unix:@NAME" for a socket in the abstract namespace, linux only),
+// "npipe:\\.\pipe\NAME" for a named pipe (windows only), and "systemd:NAME"
+// or "launchd:NAME" for a socket provided by launchd/systemd for socket
 // activation.
 func ParseAddress(input string) (network, address, host string, err error) {
 	if strings.HasPrefix(input, "launchd:") {
@@ -44,6 +47,39 @@ func ParseAddress(input string) (network, address, host string, err error) {
 	if strings.HasPrefix(input, "unix:") {
 		network = "unix"
 		address = input[5:]
+		if IsAbstractUnixAddress(address) && runtime.GOOS != "linux" {
+			err = errors.New("abstract UNIX sockets (unix:@NAME) are only supported on linux")
+		}
+		return
+	}
+
+	if strings.HasPrefix(input, "npipe:") {
+		network = "npipe"
+		address = input[6:]
+		host, err = parsePipeAddress(address)
+		if err == nil && runtime.GOOS != "windows" {
+			err = errors.New("named pipes (npipe:PATH) are only supported on windows")
+		}
+		if host == "." {
+			host = ""
+		}
+		return
+	}
+
+	if strings.HasPrefix(input, "udp:") {
+		address = input[4:]
+		host, _, err = net.SplitHostPort(address)
+		if err != nil {
+			return
+		}
+
+		// Make sure target address resolves
+		_, err = net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return
+		}
+
+		network = "udp"
 		return
 	}
 
@@ -63,38 +99,105 @@ func ParseAddress(input string) (network, address, host string, err error) {
 }
 
 // Open a listening socket with the given network and address.
-// Supports 'unix', 'tcp', 'launchd' and 'systemd' as the network.
+// Supports 'unix', 'tcp', 'udp', 'npipe', 'launchd' and 'systemd' as the network.
 //
 // For 'tcp' sockets, the address must be a host and a port. The
-// opened socket will be bound with SO_REUSEPORT.
+// opened socket will be bound with SO_REUSEPORT (unless disabled in
+// TCPOptions), and gets the other options from TCPOptions.
+//
+// For 'udp' sockets, the address must be a host and a port. The returned
+// listener demultiplexes datagrams into one connection per remote address.
+// Connections are closed after being idle for UDPSessionTimeout.
 //
 // For 'unix' sockets, the address must be a path. The socket file
-// will be set to unlink on close automatically.
+// will be set to unlink on close automatically, and gets the permissions
+// from UnixSocketMode, UnixSocketOwner and UnixSocketGroup (if set).
+//
+// For 'npipe' sockets (windows only), the address must be a path of the form
+// \\.\pipe\NAME. Pipes get the security descriptor from PipeSecurityDescriptor
+// (if set), and don't accept remote clients.
 //
 // For 'launchd' sockets, the address must be the name of the socket
 // from the plist file. Only one socket maybe configured in the
-// plist for that name, multiple sockets per name (e.g. separate
-// IPv4/IPv4 sockets) are not supported.
+// plist for that name, use OpenAll if multiple sockets per name
+// (e.g. separate IPv4/IPv6 sockets) should be supported.
 //
 // For 'systemd' sockets, the address must be the name of the socket.
 // In the systemd unit file, the FileDescriptorName option must be
-// set and needs to match the address string.
+// set and needs to match the address string. Different sockets in the
+// same unit can be told apart by giving them distinct names.
+//
+// For 'tcp' and 'unix' sockets, sockets passed on by a parent process on
+// upgrade (see Upgrade) are used instead of opening new ones, if available.
 func Open(network, address string) (net.Listener, error) {
 	switch network {
 	case "launchd":
 		return launchdSocket(address)
 	case "systemd":
 		return systemdSocket(address)
-	case "unix":
-		listener, err := net.Listen(network, address)
+	case "udp":
+		return openUDP(address)
+	case "npipe":
+		return listenPipe(address)
+	}
+
+	listener, err := inheritedListener(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if listener == nil {
+		listener, err = openStream(network, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	registerListener(network, address, listener)
+	return listener, nil
+}
+
+// IsAbstractUnixAddress checks if the given UNIX socket address is in the
+// abstract namespace (starts with '@'). Such sockets have no file on disk.
+func IsAbstractUnixAddress(address string) bool {
+	return strings.HasPrefix(address, "@")
+}
+
+// Dial connects to the given network and address, like net.DialTimeout, but
+// also supports named pipes ('npipe'), and applies TCPOptions.
+func Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	if network == "npipe" {
+		return dialPipe(address, timeout)
+	}
+	return WrapDialer(NewDialer(timeout)).Dial(network, address)
+}
+
+func openStream(network, address string) (net.Listener, error) {
+	if network == "unix" {
+		listener, err := listenUnix(address)
 		if err != nil {
 			return nil, err
 		}
 		listener.(*net.UnixListener).SetUnlinkOnClose(true)
 		return listener, nil
-	default:
-		return reuseport.NewReusablePortListener(network, address)
 	}
+	return listenTCP(address)
+}
+
+// OpenAll opens all listening sockets for the given network and address.
+// This behaves like Open, except that for 'launchd' and 'systemd' sockets
+// all sockets with the given name are returned. This makes it possible to
+// have multiple sockets (e.g. for IPv4 and IPv6) share the same name.
+func OpenAll(network, address string) ([]net.Listener, error) {
+	switch network {
+	case "launchd":
+		return launchdSockets(address)
+	case "systemd":
+		return systemdSockets(address)
+	}
+	listener, err := Open(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{listener}, nil
 }
 
 // ParseAndOpen combines the functionality of the ParseAddress and Open methods.
@@ -105,3 +208,26 @@ func ParseAndOpen(address string) (net.Listener, error) {
 	}
 	return Open(net, addr)
 }
+
+// ParseAndOpenAll opens listening sockets for each of the given addresses,
+// combining the functionality of the ParseAddress and OpenAll methods. If any
+// of the sockets fails to open, all previously opened sockets are closed again
+// and an error is returned.
+func ParseAndOpenAll(addresses []string) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	for _, address := range addresses {
+		network, addr, _, err := ParseAddress(address)
+		if err == nil {
+			var opened []net.Listener
+			opened, err = OpenAll(network, addr)
+			listeners = append(listeners, opened...)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+	}
+	return listeners, nil
+}
@@ -17,7 +17,9 @@
 package socket
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -67,6 +69,17 @@ func TestParseAddress(t *testing.T) {
 		t.Errorf("unexpected host: %s", host)
 	}
 
+	network, address, host, _ = ParseAddress("udp:localhost:8080")
+	if network != "udp" {
+		t.Errorf("unexpected network: %s", network)
+	}
+	if address != "localhost:8080" {
+		t.Errorf("unexpected address: %s", address)
+	}
+	if host != "localhost" {
+		t.Errorf("unexpected host: %s", host)
+	}
+
 	_, _, _, err := ParseAddress("localhost")
 	assert.NotNil(t, err, "was able to parse invalid host/port")
 
@@ -78,4 +91,47 @@ func TestParseAddress(t *testing.T) {
 
 	_, _, _, err = ParseAddress("systemdfoobar")
 	assert.NotNil(t, err, "was able to parse invalid host/port")
+
+	_, _, _, err = ParseAddress("udp:localhost")
+	assert.NotNil(t, err, "was able to parse invalid host/port")
+}
+
+func TestParseAndOpenAll(t *testing.T) {
+	listeners, err := ParseAndOpenAll([]string{"127.0.0.1:0", "127.0.0.1:0"})
+	assert.Nil(t, err, "should be able to open multiple listeners")
+	assert.Len(t, listeners, 2, "should have opened two listeners")
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	_, err = ParseAndOpenAll([]string{"127.0.0.1:0", "invalid"})
+	assert.NotNil(t, err, "should fail if any address is invalid")
+}
+
+func TestUDPSessionTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { UDPSessionTimeout = timeout }(UDPSessionTimeout)
+	UDPSessionTimeout = 100 * time.Millisecond
+
+	listener, err := ParseAndOpen("udp:127.0.0.1:0")
+	assert.Nil(t, err, "should be able to open UDP listener")
+	defer listener.Close()
+
+	client, err := net.Dial("udp", listener.Addr().String())
+	assert.Nil(t, err, "should be able to dial UDP listener")
+	defer client.Close()
+
+	_, err = client.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to send datagram")
+
+	session, err := listener.Accept()
+	assert.Nil(t, err, "should accept new session")
+	defer session.Close()
+
+	buf := make([]byte, 1024)
+	n, err := session.Read(buf)
+	assert.Nil(t, err, "should be able to read datagram")
+	assert.Equal(t, "hello", string(buf[:n]), "should preserve datagram")
+
+	_, err = session.Read(buf)
+	assert.NotNil(t, err, "idle session should time out")
 }
@@ -0,0 +1,37 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"errors"
+	"strings"
+)
+
+// PipeSecurityDescriptor is the security descriptor (in SDDL format, e.g.
+// "D:P(A;;GA;;;SY)(A;;GA;;;BA)") applied to named pipes created by Open. If
+// empty, pipes get the default security descriptor of the process.
+var PipeSecurityDescriptor string
+
+// parsePipeAddress checks that the address is a named pipe path of the form
+// \\SERVER\pipe\NAME, and returns the server ("." for the local machine).
+func parsePipeAddress(address string) (server string, err error) {
+	parts := strings.SplitN(address, `\`, 5)
+	if len(parts) != 5 || parts[0] != "" || parts[1] != "" || parts[2] == "" || !strings.EqualFold(parts[3], "pipe") || parts[4] == "" {
+		return "", errors.New(`named pipe address must be of the form npipe:\\.\pipe\NAME`)
+	}
+	return parts[2], nil
+}
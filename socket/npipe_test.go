@@ -0,0 +1,44 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePipeAddress(t *testing.T) {
+	network, address, host, err := ParseAddress(`npipe:\\.\pipe\ghostunnel`)
+	assert.Equal(t, "npipe", network)
+	assert.Equal(t, `\\.\pipe\ghostunnel`, address)
+	assert.Equal(t, "", host, "local pipe should have no host")
+	if runtime.GOOS == "windows" {
+		assert.Nil(t, err, "should parse named pipe address")
+	} else {
+		assert.NotNil(t, err, "should reject named pipes on non-windows platforms")
+	}
+
+	_, _, host, _ = ParseAddress(`npipe:\\server\PIPE\ghostunnel`)
+	assert.Equal(t, "server", host, "remote pipe should have server as host")
+
+	for _, invalid := range []string{`npipe:`, `npipe:ghostunnel`, `npipe:\\.\ghostunnel`, `npipe:\\.\pipe\`, `npipe:\\.\foo\ghostunnel`} {
+		_, _, _, err := ParseAddress(invalid)
+		assert.NotNil(t, err, "should reject invalid named pipe address %s", invalid)
+	}
+}
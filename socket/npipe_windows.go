@@ -0,0 +1,390 @@
+//go:build windows
+// +build windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// Buffer size for pipe instances we create (advisory only)
+	pipeBufferSize = 64 * 1024
+	// How often to retry dialing while all instances of a pipe are busy
+	pipeBusyRetryInterval = 10 * time.Millisecond
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "npipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+type pipeTimeoutError struct{}
+
+func (pipeTimeoutError) Error() string   { return "i/o timeout" }
+func (pipeTimeoutError) Timeout() bool   { return true }
+func (pipeTimeoutError) Temporary() bool { return true }
+
+// overlappedIO runs an overlapped operation on the handle, and waits for it
+// to complete. The operation is cancelled if the deadline passes, or if the
+// close event is signalled.
+func overlappedIO(handle, closeEvent windows.Handle, deadline time.Time, op func(*windows.Overlapped) error) (uint32, error) {
+	timeout := uint32(windows.INFINITE)
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, pipeTimeoutError{}
+		}
+		if remaining < time.Duration(windows.INFINITE-1)*time.Millisecond {
+			timeout = uint32(remaining / time.Millisecond)
+		}
+	}
+
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(event)
+
+	overlapped := &windows.Overlapped{HEvent: event}
+	err = op(overlapped)
+	if err != nil && err != windows.ERROR_IO_PENDING {
+		return 0, err
+	}
+
+	var done uint32
+	if err == windows.ERROR_IO_PENDING {
+		result, _ := windows.WaitForMultipleObjects([]windows.Handle{event, closeEvent}, false, timeout)
+		if result != windows.WAIT_OBJECT_0 {
+			// Timed out or closed: cancel, and wait for the cancellation to
+			// complete. The operation might have succeeded in the meantime.
+			windows.CancelIoEx(handle, overlapped)
+			if err := windows.GetOverlappedResult(handle, overlapped, &done, true); err == nil {
+				return done, nil
+			}
+			if result == windows.WAIT_OBJECT_0+1 {
+				return 0, net.ErrClosed
+			}
+			return 0, pipeTimeoutError{}
+		}
+	}
+	err = windows.GetOverlappedResult(handle, overlapped, &done, true)
+	return done, err
+}
+
+// pipeListener accepts connections on a named pipe. Each client connects to
+// its own pipe instance, so there is always one instance waiting for the
+// next client, and a new one is created whenever a client connects.
+type pipeListener struct {
+	path       string
+	attributes *windows.SecurityAttributes
+	// Signalled on Close, to abort a pending Accept
+	closeEvent windows.Handle
+	closeOnce  sync.Once
+
+	mu     sync.Mutex
+	next   windows.Handle
+	closed bool
+}
+
+func listenPipe(address string) (net.Listener, error) {
+	server, err := parsePipeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if server != "." {
+		return nil, errors.New(`can only listen on local named pipes (npipe:\\.\pipe\NAME)`)
+	}
+
+	attributes := &windows.SecurityAttributes{}
+	attributes.Length = uint32(unsafe.Sizeof(*attributes))
+	if PipeSecurityDescriptor != "" {
+		attributes.SecurityDescriptor, err = windows.SecurityDescriptorFromString(PipeSecurityDescriptor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid security descriptor for named pipe: %s", err)
+		}
+	}
+
+	closeEvent, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	l := &pipeListener{
+		path:       address,
+		attributes: attributes,
+		closeEvent: closeEvent,
+	}
+
+	// Creating the first instance fails if the pipe already exists, so we
+	// never end up sharing a pipe (and its clients) with another process.
+	l.next, err = l.createInstance(true)
+	if err != nil {
+		windows.CloseHandle(closeEvent)
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *pipeListener) createInstance(first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(l.path)
+	if err != nil {
+		return 0, err
+	}
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	mode := uint32(windows.PIPE_TYPE_BYTE | windows.PIPE_READMODE_BYTE | windows.PIPE_WAIT | windows.PIPE_REJECT_REMOTE_CLIENTS)
+	handle, err := windows.CreateNamedPipe(name, flags, mode, windows.PIPE_UNLIMITED_INSTANCES, pipeBufferSize, pipeBufferSize, 0, l.attributes)
+	if err != nil {
+		return 0, &net.OpError{Op: "listen", Net: "npipe", Addr: pipeAddr(l.path), Err: err}
+	}
+	return handle, nil
+}
+
+// Accept waits for a client to connect to the pipe.
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, &net.OpError{Op: "accept", Net: "npipe", Addr: pipeAddr(l.path), Err: net.ErrClosed}
+	}
+
+	if l.next == 0 {
+		handle, err := l.createInstance(false)
+		if err != nil {
+			return nil, err
+		}
+		l.next = handle
+	}
+
+	handle := l.next
+	_, err := overlappedIO(handle, l.closeEvent, time.Time{}, func(overlapped *windows.Overlapped) error {
+		return windows.ConnectNamedPipe(handle, overlapped)
+	})
+	if err != nil && err != windows.ERROR_PIPE_CONNECTED {
+		// Start over with a fresh instance next time
+		windows.CloseHandle(handle)
+		l.next = 0
+		return nil, &net.OpError{Op: "accept", Net: "npipe", Addr: pipeAddr(l.path), Err: err}
+	}
+
+	conn, err := newPipeConn(handle, l.path)
+	l.next = 0
+	if err != nil {
+		return nil, err
+	}
+	// Have an instance ready for the next client right away. If this fails,
+	// we'll try again in the next call to Accept.
+	if next, err := l.createInstance(false); err == nil {
+		l.next = next
+	}
+	return conn, nil
+}
+
+// Close stops listening. Clients that are already connected are unaffected.
+func (l *pipeListener) Close() error {
+	err := error(&net.OpError{Op: "close", Net: "npipe", Addr: pipeAddr(l.path), Err: net.ErrClosed})
+	l.closeOnce.Do(func() {
+		windows.SetEvent(l.closeEvent)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.closed = true
+		if l.next != 0 {
+			windows.CloseHandle(l.next)
+			l.next = 0
+		}
+		windows.CloseHandle(l.closeEvent)
+		err = nil
+	})
+	return err
+}
+
+// Addr returns the path of the pipe.
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.path)
+}
+
+func dialPipe(address string, timeout time.Duration) (net.Conn, error) {
+	if _, err := parsePipeAddress(address); err != nil {
+		return nil, err
+	}
+	name, err := windows.UTF16PtrFromString(address)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		// Only allow the server to identify us, not to impersonate us
+		handle, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING,
+			windows.FILE_FLAG_OVERLAPPED|windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION, 0)
+		if err == nil {
+			return newPipeConn(handle, address)
+		}
+		if err == windows.ERROR_PIPE_BUSY && timeout > 0 && time.Now().After(deadline) {
+			err = pipeTimeoutError{}
+		} else if err == windows.ERROR_PIPE_BUSY {
+			// All instances are connected to other clients, wait for the
+			// server to create a new one.
+			time.Sleep(pipeBusyRetryInterval)
+			continue
+		}
+		return nil, &net.OpError{Op: "dial", Net: "npipe", Addr: pipeAddr(address), Err: err}
+	}
+}
+
+// pipeConn is a connection on a named pipe (either end), using overlapped
+// I/O so that reads and writes can be cancelled by deadlines or Close.
+// Deadlines apply to operations started after they are set.
+type pipeConn struct {
+	handle windows.Handle
+	path   string
+	// Signalled on Close, to abort pending reads and writes
+	closeEvent windows.Handle
+	// Pending reads and writes, the handle is closed once they're done
+	pending sync.WaitGroup
+
+	mu            sync.Mutex
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newPipeConn(handle windows.Handle, path string) (*pipeConn, error) {
+	closeEvent, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		windows.CloseHandle(handle)
+		return nil, err
+	}
+	return &pipeConn{handle: handle, path: path, closeEvent: closeEvent}, nil
+}
+
+// start registers a pending operation, and returns its deadline.
+func (c *pipeConn) start(read bool) (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return time.Time{}, net.ErrClosed
+	}
+	c.pending.Add(1)
+	if read {
+		return c.readDeadline, nil
+	}
+	return c.writeDeadline, nil
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	deadline, err := c.start(true)
+	if err != nil {
+		return 0, c.opError("read", err)
+	}
+	defer c.pending.Done()
+
+	n, err := overlappedIO(c.handle, c.closeEvent, deadline, func(overlapped *windows.Overlapped) error {
+		return windows.ReadFile(c.handle, b, nil, overlapped)
+	})
+	if err == windows.ERROR_BROKEN_PIPE || err == windows.ERROR_PIPE_NOT_CONNECTED {
+		// Other end closed the pipe
+		return 0, io.EOF
+	}
+	if err != nil {
+		return int(n), c.opError("read", err)
+	}
+	return int(n), nil
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	deadline, err := c.start(false)
+	if err != nil {
+		return 0, c.opError("write", err)
+	}
+	defer c.pending.Done()
+
+	written := 0
+	for written < len(b) {
+		n, err := overlappedIO(c.handle, c.closeEvent, deadline, func(overlapped *windows.Overlapped) error {
+			return windows.WriteFile(c.handle, b[written:], nil, overlapped)
+		})
+		written += int(n)
+		if err != nil {
+			return written, c.opError("write", err)
+		}
+	}
+	return written, nil
+}
+
+// Close closes the connection, aborting pending reads and writes.
+func (c *pipeConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.opError("close", net.ErrClosed)
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	windows.SetEvent(c.closeEvent)
+	c.pending.Wait()
+	windows.CloseHandle(c.closeEvent)
+	return windows.CloseHandle(c.handle)
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr(c.path)
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(c.path)
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *pipeConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "npipe", Addr: pipeAddr(c.path), Err: err}
+}
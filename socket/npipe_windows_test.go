@@ -0,0 +1,99 @@
+//go:build windows
+// +build windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamedPipeListenAndDial(t *testing.T) {
+	path := fmt.Sprintf(`\\.\pipe\ghostunnel-test-%d`, os.Getpid())
+	PipeSecurityDescriptor = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GA;;;OW)"
+	defer func() { PipeSecurityDescriptor = "" }()
+
+	listener, err := Open("npipe", path)
+	assert.Nil(t, err, "should listen on named pipe")
+	defer listener.Close()
+	assert.Equal(t, path, listener.Addr().String())
+
+	_, err = Open("npipe", path)
+	assert.NotNil(t, err, "should not listen on a pipe that already exists")
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := Dial("npipe", path, time.Second)
+	assert.Nil(t, err, "should connect to named pipe")
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err, "should write to named pipe")
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should read from named pipe")
+	assert.Equal(t, "hello", string(buf))
+
+	// Read deadlines
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(buf)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "read should time out")
+}
+
+func TestNamedPipeInvalidSecurityDescriptor(t *testing.T) {
+	PipeSecurityDescriptor = "invalid"
+	defer func() { PipeSecurityDescriptor = "" }()
+
+	_, err := Open("npipe", fmt.Sprintf(`\\.\pipe\ghostunnel-test-%d`, os.Getpid()))
+	assert.NotNil(t, err, "should reject invalid security descriptor")
+}
+
+func TestNamedPipeAcceptAfterClose(t *testing.T) {
+	listener, err := Open("npipe", fmt.Sprintf(`\\.\pipe\ghostunnel-test-close-%d`, os.Getpid()))
+	assert.Nil(t, err, "should listen on named pipe")
+
+	done := make(chan error)
+	go func() {
+		_, err := listener.Accept()
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	listener.Close()
+
+	select {
+	case err := <-done:
+		assert.NotNil(t, err, "accept should fail after close")
+	case <-time.After(time.Second):
+		t.Error("accept should return after close")
+	}
+}
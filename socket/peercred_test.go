@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPeerCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-peercred")
+	assert.Nil(t, err, "should create temp dir")
+	defer os.RemoveAll(dir)
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	assert.Nil(t, err, "should listen")
+	defer ln.Close()
+
+	client, err := net.Dial("unix", ln.Addr().String())
+	assert.Nil(t, err, "should connect")
+	defer client.Close()
+	conn, err := ln.Accept()
+	assert.Nil(t, err, "should accept")
+	defer conn.Close()
+
+	creds, err := GetPeerCredentials(conn)
+	assert.Nil(t, err, "should get peer credentials")
+	assert.Equal(t, uint32(os.Getuid()), creds.UID)
+	assert.Equal(t, uint32(os.Getgid()), creds.GID)
+	assert.Equal(t, int32(os.Getpid()), creds.PID)
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	defer tcp.Close()
+	tcpConn, err := net.Dial("tcp", tcp.Addr().String())
+	assert.Nil(t, err, "should connect")
+	defer tcpConn.Close()
+	_, err = GetPeerCredentials(tcpConn)
+	assert.NotNil(t, err, "should fail for TCP connections")
+}
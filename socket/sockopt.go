@@ -0,0 +1,253 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Options are options for TCP sockets we listen on or dial. The zero value
+// keeps the defaults: SO_REUSEPORT on listening sockets, keepalives and
+// TCP_NODELAY on connections, and buffer sizes picked by the kernel.
+type Options struct {
+	// NoReusePort disables SO_REUSEPORT on listening sockets.
+	NoReusePort bool
+	// NoKeepAlive disables TCP keepalives (SO_KEEPALIVE).
+	NoKeepAlive bool
+	// Nagle enables Nagle's algorithm (i.e. clears TCP_NODELAY).
+	Nagle bool
+	// ReceiveBuffer and SendBuffer set SO_RCVBUF/SO_SNDBUF, if non-zero.
+	ReceiveBuffer int
+	SendBuffer    int
+	// FreeBind sets IP_FREEBIND (linux only), to allow binding to addresses
+	// that aren't assigned to an interface (yet).
+	FreeBind bool
+	// Keepalive parameters: idle time before the first probe, interval
+	// between probes, and number of unanswered probes before the connection
+	// is dropped. Zero values keep the defaults (15s idle time and interval,
+	// count from the kernel).
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	// Transparent sets IP_TRANSPARENT on listening sockets (linux only), to
+	// accept connections redirected with iptables TPROXY.
+	Transparent bool
+	// FallbackDelay is the delay before falling back to the other address
+	// family when dialing dual-stack hosts (zero means 300ms, negative
+	// disables dialing in parallel), see DialAddresses.
+	FallbackDelay time.Duration
+}
+
+// Family is an IP address family for listening sockets.
+type Family int
+
+// Address families. With FamilyAny, sockets on wildcard addresses (e.g.
+// ":8443") accept both IPv4 and IPv6 connections where supported.
+const (
+	FamilyAny Family = iota
+	FamilyIPv4
+	FamilyIPv6
+)
+
+// ListenFamily is the address family for TCP and UDP sockets opened by Open.
+var ListenFamily Family
+
+// network returns the network name (e.g. "tcp4") for the family.
+func (f Family) network(base string) string {
+	switch f {
+	case FamilyIPv4:
+		return base + "4"
+	case FamilyIPv6:
+		return base + "6"
+	}
+	return base
+}
+
+// Validate checks that the options are supported on this platform.
+func (o Options) Validate() error {
+	if o.FreeBind && !SupportsFreeBind {
+		return errors.New("IP_FREEBIND is only supported on linux")
+	}
+	if o.Transparent && !SupportsTransparentProxy {
+		return errors.New("transparent proxying is only supported on linux")
+	}
+	if o.hasKeepAliveParams() {
+		if o.NoKeepAlive {
+			return errors.New("keepalive parameters can't be set if keepalives are disabled")
+		}
+		return validateKeepAliveParams(o)
+	}
+	return nil
+}
+
+func (o Options) hasKeepAliveParams() bool {
+	return o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0
+}
+
+// needsApply checks if there are options that can only be set on established
+// connections, see apply.
+func (o Options) needsApply() bool {
+	return o.Nagle || o.hasKeepAliveParams()
+}
+
+// TCPOptions are applied to TCP sockets opened by Open and Dial, and by
+// dialers from NewDialer.
+var TCPOptions Options
+
+// Dialer is an interface for dialers (e.g. net.Dialer).
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// NewDialer returns a dialer with the given timeout, that applies TCPOptions
+// to TCP sockets before connecting. Options that can only be set once the
+// connection is established are applied by WrapDialer.
+func NewDialer(timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:       timeout,
+		Control:       TCPOptions.control(false),
+		FallbackDelay: TCPOptions.FallbackDelay,
+	}
+	if TCPOptions.NoKeepAlive {
+		dialer.KeepAlive = -1
+	}
+	return dialer
+}
+
+// WrapDialer wraps a dialer (e.g. one going through a proxy), to apply
+// TCPOptions to established TCP connections.
+func WrapDialer(dialer Dialer) Dialer {
+	if !TCPOptions.needsApply() {
+		return dialer
+	}
+	return optionsDialer{dialer}
+}
+
+type optionsDialer struct {
+	Dialer
+}
+
+func (d optionsDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn, TCPOptions.apply(conn)
+}
+
+// apply sets options on an established connection. Go enables TCP_NODELAY
+// and sets keepalive parameters on all TCP connections once they're
+// established, so we can't set these before connecting.
+func (o Options) apply(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	err := o.applyTCP(tcp)
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+func (o Options) applyTCP(conn *net.TCPConn) error {
+	if o.Nagle {
+		if err := conn.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if o.hasKeepAliveParams() && !o.NoKeepAlive {
+		raw, err := conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		controlErr := raw.Control(func(fd uintptr) {
+			err = setKeepAliveParams(fd, o)
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}
+	return nil
+}
+
+// control returns a function that sets options on TCP sockets before they
+// are bound (for listeners) or connected (for dialers).
+func (o Options) control(listen bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if !strings.HasPrefix(network, "tcp") {
+			return nil
+		}
+		var err error
+		controlErr := c.Control(func(fd uintptr) {
+			err = o.setSocketOptions(fd, listen)
+			if err == nil && listen && o.Transparent {
+				err = setTransparent(fd, network)
+			}
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}
+}
+
+// listenTCP opens a TCP listener for ListenFamily, with TCPOptions applied.
+func listenTCP(address string) (net.Listener, error) {
+	config := net.ListenConfig{Control: TCPOptions.control(true)}
+	if TCPOptions.NoKeepAlive {
+		config.KeepAlive = -1
+	}
+	listener, err := config.Listen(context.Background(), ListenFamily.network("tcp"), address)
+	if err != nil {
+		return nil, err
+	}
+	if TCPOptions.needsApply() {
+		return &optionsListener{listener.(*net.TCPListener)}, nil
+	}
+	return listener, nil
+}
+
+// optionsListener applies TCPOptions to accepted connections.
+type optionsListener struct {
+	*net.TCPListener
+}
+
+func (l *optionsListener) Accept() (net.Conn, error) {
+	conn, err := l.TCPListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := TCPOptions.apply(conn); err != nil {
+		// Connection is gone, but the listener is still fine
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: temporaryError{err}}
+	}
+	return conn, nil
+}
+
+type temporaryError struct {
+	error
+}
+
+func (temporaryError) Temporary() bool { return true }
+func (temporaryError) Timeout() bool   { return false }
@@ -0,0 +1,133 @@
+//go:build linux
+// +build linux
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func getsockopt(t *testing.T, conn syscall.Conn, level, option int) int {
+	raw, err := conn.SyscallConn()
+	assert.Nil(t, err)
+	var value int
+	raw.Control(func(fd uintptr) {
+		value, err = unix.GetsockoptInt(int(fd), level, option)
+	})
+	assert.Nil(t, err)
+	return value
+}
+
+func TestReusePort(t *testing.T) {
+	listener, err := Open("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen on tcp port")
+	defer listener.Close()
+
+	second, err := Open("tcp", listener.Addr().String())
+	assert.Nil(t, err, "should listen on same port again with SO_REUSEPORT")
+	second.Close()
+
+	TCPOptions = Options{NoReusePort: true}
+	defer func() { TCPOptions = Options{} }()
+
+	_, err = Open("tcp", listener.Addr().String())
+	assert.NotNil(t, err, "should not listen on same port again without SO_REUSEPORT")
+}
+
+func TestSocketOptions(t *testing.T) {
+	TCPOptions = Options{
+		NoKeepAlive:   true,
+		Nagle:         true,
+		ReceiveBuffer: 64 * 1024,
+		SendBuffer:    32 * 1024,
+		FreeBind:      true,
+	}
+	defer func() { TCPOptions = Options{} }()
+
+	listener, err := Open("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen on tcp port")
+	defer listener.Close()
+	assert.Equal(t, 1, getsockopt(t, listener.(syscall.Conn), unix.SOL_IP, unix.IP_FREEBIND), "should set IP_FREEBIND")
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := Dial("tcp", listener.Addr().String(), 0)
+	assert.Nil(t, err, "should connect to listener")
+	defer conn.Close()
+	server := <-accepted
+	assert.NotNil(t, server, "should accept connection")
+	defer server.Close()
+
+	for _, c := range []net.Conn{conn, server} {
+		tcp := c.(*net.TCPConn)
+		assert.Equal(t, 0, getsockopt(t, tcp, unix.SOL_SOCKET, unix.SO_KEEPALIVE), "should disable keepalives")
+		assert.Equal(t, 0, getsockopt(t, tcp, unix.IPPROTO_TCP, unix.TCP_NODELAY), "should clear TCP_NODELAY")
+		// Linux doubles the requested buffer sizes
+		assert.Equal(t, 2*64*1024, getsockopt(t, tcp, unix.SOL_SOCKET, unix.SO_RCVBUF), "should set SO_RCVBUF")
+		assert.Equal(t, 2*32*1024, getsockopt(t, tcp, unix.SOL_SOCKET, unix.SO_SNDBUF), "should set SO_SNDBUF")
+	}
+}
+
+func TestKeepAliveParams(t *testing.T) {
+	TCPOptions = Options{
+		KeepAliveIdle:     30 * time.Second,
+		KeepAliveInterval: 5 * time.Second,
+		KeepAliveCount:    3,
+	}
+	defer func() { TCPOptions = Options{} }()
+	assert.Nil(t, TCPOptions.Validate(), "should accept keepalive parameters")
+
+	listener, err := Open("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen on tcp port")
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := Dial("tcp", listener.Addr().String(), 0)
+	assert.Nil(t, err, "should connect to listener")
+	defer conn.Close()
+	server := <-accepted
+	assert.NotNil(t, server, "should accept connection")
+	defer server.Close()
+
+	for _, c := range []net.Conn{conn, server} {
+		tcp := c.(*net.TCPConn)
+		assert.Equal(t, 1, getsockopt(t, tcp, unix.SOL_SOCKET, unix.SO_KEEPALIVE), "should enable keepalives")
+		assert.Equal(t, 30, getsockopt(t, tcp, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE), "should set idle time")
+		assert.Equal(t, 5, getsockopt(t, tcp, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL), "should set interval")
+		assert.Equal(t, 3, getsockopt(t, tcp, unix.IPPROTO_TCP, unix.TCP_KEEPCNT), "should set count")
+	}
+
+	TCPOptions.NoKeepAlive = true
+	assert.NotNil(t, TCPOptions.Validate(), "should reject keepalive parameters with keepalives disabled")
+}
@@ -0,0 +1,42 @@
+//go:build windows
+// +build windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"syscall"
+)
+
+// SO_REUSEPORT doesn't exist on windows, so NoReusePort has no effect.
+func (o Options) setSocketOptions(fd uintptr, listen bool) error {
+	if o.ReceiveBuffer > 0 {
+		if err := syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if o.FreeBind {
+		return setFreeBind(fd)
+	}
+	return nil
+}
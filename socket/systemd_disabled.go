@@ -1,3 +1,4 @@
+//go:build !linux
 // +build !linux
 
 /*-
@@ -26,3 +27,7 @@ import (
 func systemdSocket(name string) (net.Listener, error) {
 	return nil, errors.New("systemd socket activation is only supported on linux")
 }
+
+func systemdSockets(name string) ([]net.Listener, error) {
+	return nil, errors.New("systemd socket activation is only supported on linux")
+}
@@ -1,3 +1,4 @@
+//go:build linux
 // +build linux
 
 /*-
@@ -21,22 +22,50 @@ package socket
 import (
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/coreos/go-systemd/activation"
 )
 
-func systemdSocket(name string) (net.Listener, error) {
-	listeners, err := activation.ListenersWithNames()
+var (
+	systemdOnce      sync.Once
+	systemdListeners map[string][]net.Listener
+	systemdError     error
+)
+
+// The activation library unsets the LISTEN_* environment variables after the
+// first call, so we can only ask for our sockets once. We cache the result to
+// be able to hand out distinct named sockets (e.g. for --listen and --status).
+func systemdListenersWithNames() (map[string][]net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdListeners, systemdError = activation.ListenersWithNames()
+	})
+	return systemdListeners, systemdError
+}
+
+// systemdSockets returns all sockets passed by systemd with the given name. A
+// unit may have multiple ListenStream entries sharing a FileDescriptorName.
+func systemdSockets(name string) ([]net.Listener, error) {
+	listeners, err := systemdListenersWithNames()
 	if err != nil {
 		return nil, err
 	}
 
-	if listener, ok := listeners[name]; ok {
-		if len(listeners) != 1 {
-			return nil, fmt.Errorf("expected exactly 1 listening socket configured in systemd for name %s, found %d", name, len(listeners))
-		}
-		return listener[0], err
+	if listener, ok := listeners[name]; ok && len(listener) > 0 {
+		return listener, nil
 	}
 
 	return nil, fmt.Errorf("expected listener with name %s, but found none", name)
 }
+
+func systemdSocket(name string) (net.Listener, error) {
+	listeners, err := systemdSockets(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(listeners) != 1 {
+		return nil, fmt.Errorf("expected exactly 1 listening socket configured in systemd for name %s, found %d", name, len(listeners))
+	}
+	return listeners[0], nil
+}
@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SO_ORIGINAL_DST (and IP6T_SO_ORIGINAL_DST), from linux/netfilter_ipv4.h
+const soOriginalDst = 80
+
+// SupportsTransparentProxy is true if transparent proxying (IP_TRANSPARENT
+// and SO_ORIGINAL_DST) is supported on this platform.
+const SupportsTransparentProxy = true
+
+// setTransparent sets IP_TRANSPARENT (or IPV6_TRANSPARENT), so that the
+// socket accepts connections redirected to it with iptables TPROXY.
+func setTransparent(fd uintptr, network string) error {
+	if strings.HasSuffix(network, "6") {
+		return unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+	}
+	return unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+}
+
+// OriginalDestination returns the address a client originally connected to,
+// before the connection was redirected to us. For connections accepted on a
+// socket with IP_TRANSPARENT (iptables TPROXY), that's the local address of
+// the connection. Otherwise, it's looked up with SO_ORIGINAL_DST (iptables
+// REDIRECT or DNAT). Connections wrapped in TLS are unwrapped first.
+func OriginalDestination(conn net.Conn, transparent bool) (*net.TCPAddr, error) {
+	for {
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("original destination is only available for TCP connections")
+	}
+	if transparent {
+		return tcp.LocalAddr().(*net.TCPAddr), nil
+	}
+
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	controlErr := raw.Control(func(fd uintptr) {
+		addr, err = getOriginalDst(fd, tcp.LocalAddr().(*net.TCPAddr).IP.To4() == nil)
+	})
+	if controlErr != nil {
+		return nil, controlErr
+	}
+	return addr, err
+}
+
+// getOriginalDst reads the original destination from conntrack. The option
+// returns a sockaddr_in (or sockaddr_in6), which we read into a buffer of the
+// right size.
+func getOriginalDst(fd uintptr, ipv6 bool) (*net.TCPAddr, error) {
+	level := unix.SOL_IP
+	if ipv6 {
+		level = unix.SOL_IPV6
+	}
+	var sa unix.RawSockaddrInet6
+	size := uint32(unsafe.Sizeof(sa))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), soOriginalDst,
+		uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		if errno == syscall.ENOENT {
+			return nil, errors.New("connection wasn't redirected (no original destination)")
+		}
+		return nil, errno
+	}
+
+	// Port is in network byte order in both sockaddr_in and sockaddr_in6
+	port := int(sa.Port>>8 | sa.Port<<8)
+	if sa.Family == unix.AF_INET {
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(&sa))
+		return &net.TCPAddr{IP: net.IP(sa4.Addr[:]).To16(), Port: port}, nil
+	}
+	return &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: port}, nil
+}
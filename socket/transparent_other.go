@@ -0,0 +1,41 @@
+//go:build !linux
+// +build !linux
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentProxy = errors.New("transparent proxying is only supported on linux")
+
+// SupportsTransparentProxy is true if transparent proxying (IP_TRANSPARENT
+// and SO_ORIGINAL_DST) is supported on this platform.
+const SupportsTransparentProxy = false
+
+func setTransparent(fd uintptr, network string) error {
+	return errTransparentProxy
+}
+
+// OriginalDestination returns the address a client originally connected to,
+// before the connection was redirected to us (linux only).
+func OriginalDestination(conn net.Conn, transparent bool) (*net.TCPAddr, error) {
+	return nil, errTransparentProxy
+}
@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestTransparentListener(t *testing.T) {
+	TCPOptions = Options{Transparent: true}
+	defer func() { TCPOptions = Options{} }()
+
+	listener, err := Open("tcp", "127.0.0.1:0")
+	if err != nil && os.IsPermission(err) {
+		t.Skip("IP_TRANSPARENT requires CAP_NET_ADMIN")
+	}
+	assert.Nil(t, err, "should listen on tcp port")
+	defer listener.Close()
+	assert.Equal(t, 1, getsockopt(t, listener.(syscall.Conn), unix.SOL_IP, unix.IP_TRANSPARENT), "should set IP_TRANSPARENT")
+}
+
+func TestOriginalDestination(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen on tcp port")
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			defer conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connection")
+	defer conn.Close()
+
+	dst, err := OriginalDestination(conn, true)
+	assert.Nil(t, err, "should get original destination in transparent mode")
+	assert.Equal(t, listener.Addr().String(), dst.String(), "should be local address in transparent mode")
+
+	dst, err = OriginalDestination(tls.Server(conn, &tls.Config{}), true)
+	assert.Nil(t, err, "should unwrap TLS connection")
+	assert.Equal(t, listener.Addr().String(), dst.String(), "should be local address of TLS connection")
+
+	// Without a REDIRECT rule (or conntrack), there's either no original
+	// destination, or it's our own address.
+	dst, err = OriginalDestination(conn, false)
+	if err == nil {
+		assert.Equal(t, listener.Addr().String(), dst.String(), "should be own address if not redirected")
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	_, err = OriginalDestination(server, true)
+	assert.NotNil(t, err, "should fail for non-TCP connection")
+}
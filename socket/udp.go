@@ -0,0 +1,105 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/udp"
+)
+
+// UDPSessionTimeout is the duration after which a UDP session is closed if
+// no datagrams have been received from the remote address. UDP has no notion
+// of closing a connection, so we need to expire sessions eventually.
+var UDPSessionTimeout = 2 * time.Minute
+
+type udpListener struct {
+	net.Listener
+}
+
+func openUDP(address string) (net.Listener, error) {
+	network := ListenFamily.network("udp")
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := udp.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpListener{listener}, nil
+}
+
+// ListenPacket opens a UDP socket for protocols that handle sessions
+// themselves (e.g. QUIC), in the address family set by ListenFamily. It's not
+// bound with SO_REUSEPORT, since datagrams of a session could be delivered to
+// another process, and isn't handed off on upgrade.
+func ListenPacket(address string) (net.PacketConn, error) {
+	return net.ListenPacket(ListenFamily.network("udp"), address)
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &udpSession{Conn: c}, nil
+}
+
+// udpSession is a UDP session for a single remote address, which expires if
+// no datagrams are received for UDPSessionTimeout.
+type udpSession struct {
+	net.Conn
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *udpSession) Read(b []byte) (int, error) {
+	if err := c.refreshReadDeadline(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *udpSession) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *udpSession) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.refreshReadDeadline()
+}
+
+// refreshReadDeadline sets the read deadline on the underlying connection to
+// either the session timeout or the explicitly set deadline, whichever is first.
+func (c *udpSession) refreshReadDeadline() error {
+	deadline := time.Now().Add(UDPSessionTimeout)
+	c.mu.Lock()
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(deadline)
+}
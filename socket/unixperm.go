@@ -0,0 +1,33 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import "os"
+
+// Permissions for UNIX socket files created by Open. If UnixSocketMode is
+// zero, the mode is derived from the umask. UnixSocketOwner/UnixSocketGroup
+// are numeric IDs, -1 leaves the owner/group of the process in place. They
+// don't apply to abstract sockets.
+var (
+	UnixSocketMode  os.FileMode
+	UnixSocketOwner = -1
+	UnixSocketGroup = -1
+)
+
+func hasUnixSocketPermissions() bool {
+	return UnixSocketMode != 0 || UnixSocketOwner >= 0 || UnixSocketGroup >= 0
+}
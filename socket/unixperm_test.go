@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixSocketPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-unixperm")
+	assert.Nil(t, err, "should create temp dir")
+	defer os.RemoveAll(dir)
+
+	UnixSocketMode = 0660
+	UnixSocketGroup = os.Getgid()
+	defer func() {
+		UnixSocketMode = 0
+		UnixSocketGroup = -1
+	}()
+
+	path := filepath.Join(dir, "socket")
+	listener, err := Open("unix", path)
+	assert.Nil(t, err, "should open UNIX socket")
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err, "should create socket file")
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm(), "should set socket mode")
+	assert.Equal(t, uint32(os.Getgid()), info.Sys().(*syscall.Stat_t).Gid, "should set socket group")
+
+	// Umask should be restored
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	assert.NotEqual(t, 0177, umask, "should restore umask")
+}
@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package socket
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUnix opens a UNIX socket, and applies the configured permissions.
+// To avoid a window in which other users could connect before permissions
+// are set, the socket file is created accessible only to us, and opened up
+// afterwards.
+func listenUnix(address string) (net.Listener, error) {
+	// Abstract sockets have no file, and no permissions
+	if !hasUnixSocketPermissions() || IsAbstractUnixAddress(address) {
+		return net.Listen("unix", address)
+	}
+
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", address)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := UnixSocketMode
+	if mode == 0 {
+		mode = os.FileMode(0777 &^ umask)
+	}
+	err = os.Chown(address, UnixSocketOwner, UnixSocketGroup)
+	if err == nil {
+		err = os.Chmod(address, mode)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
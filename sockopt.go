@@ -0,0 +1,73 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/square/ghostunnel/socket"
+)
+
+var listenFamilies = map[string]socket.Family{
+	"any":  socket.FamilyAny,
+	"ipv4": socket.FamilyIPv4,
+	"ipv6": socket.FamilyIPv6,
+}
+
+// configureSocketOptions sets the options for TCP sockets we listen on and
+// dial, from --reuseport, --tcp-keepalive, --tcp-nodelay, --socket-rcvbuf,
+// --socket-sndbuf, --ip-freebind, --listen-family, --dial-fallback-delay,
+// --transparent and the --keepalive-* flags.
+func configureSocketOptions() error {
+	if *socketRcvBuf < 0 || *socketRcvBuf > math.MaxInt32 {
+		return fmt.Errorf("invalid --socket-rcvbuf %s", *socketRcvBuf)
+	}
+	if *socketSndBuf < 0 || *socketSndBuf > math.MaxInt32 {
+		return fmt.Errorf("invalid --socket-sndbuf %s", *socketSndBuf)
+	}
+	for flag, value := range map[string]time.Duration{"--keepalive-idle": *keepAliveIdle, "--keepalive-interval": *keepAliveInterval} {
+		// Keepalive parameters are set in seconds
+		if value != 0 && (value < time.Second || value%time.Second != 0) {
+			return fmt.Errorf("invalid %s %s, must be a whole number of seconds", flag, value)
+		}
+	}
+	if *keepAliveCount < 0 {
+		return fmt.Errorf("invalid --keepalive-count %d", *keepAliveCount)
+	}
+
+	options := socket.Options{
+		NoReusePort:       !*reusePort,
+		NoKeepAlive:       !*tcpKeepAlive,
+		Nagle:             !*tcpNoDelay,
+		ReceiveBuffer:     int(*socketRcvBuf),
+		SendBuffer:        int(*socketSndBuf),
+		FreeBind:          *ipFreeBind,
+		KeepAliveIdle:     *keepAliveIdle,
+		KeepAliveInterval: *keepAliveInterval,
+		KeepAliveCount:    *keepAliveCount,
+		Transparent:       *clientTransparent,
+		FallbackDelay:     *dialFallbackDelay,
+	}
+	if err := options.Validate(); err != nil {
+		return fmt.Errorf("invalid socket options: %s", err)
+	}
+	socket.TCPOptions = options
+	socket.ListenFamily = listenFamilies[*listenFamily]
+	return nil
+}
@@ -0,0 +1,79 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/square/ghostunnel/socket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureSocketOptions(t *testing.T) {
+	defer func() {
+		*reusePort = false
+		*tcpKeepAlive = false
+		*tcpNoDelay = false
+		*socketRcvBuf = 0
+		*socketSndBuf = 0
+		*keepAliveIdle = 0
+		*keepAliveInterval = 0
+		*keepAliveCount = 0
+		*listenFamily = ""
+		*dialFallbackDelay = 0
+		socket.TCPOptions = socket.Options{}
+		socket.ListenFamily = socket.FamilyAny
+	}()
+
+	*reusePort = true
+	*tcpKeepAlive = true
+	*tcpNoDelay = true
+	*dialFallbackDelay = 0
+	assert.Nil(t, configureSocketOptions(), "should accept defaults")
+	assert.Equal(t, socket.Options{}, socket.TCPOptions, "defaults should map to zero options")
+
+	*reusePort = false
+	*tcpNoDelay = false
+	*socketRcvBuf = 4 * units.MiB
+	assert.Nil(t, configureSocketOptions(), "should accept valid options")
+	assert.Equal(t, socket.Options{NoReusePort: true, Nagle: true, ReceiveBuffer: 4 << 20}, socket.TCPOptions)
+
+	*socketSndBuf = 4 * units.GiB
+	assert.NotNil(t, configureSocketOptions(), "should reject huge buffer size")
+	*socketSndBuf = 0
+
+	*tcpKeepAlive = true
+	*keepAliveIdle = time.Minute
+	*keepAliveCount = 5
+	assert.Nil(t, configureSocketOptions(), "should accept keepalive parameters")
+	assert.Equal(t, time.Minute, socket.TCPOptions.KeepAliveIdle)
+	assert.Equal(t, 5, socket.TCPOptions.KeepAliveCount)
+
+	*keepAliveInterval = 1500 * time.Millisecond
+	assert.NotNil(t, configureSocketOptions(), "should reject interval that isn't whole seconds")
+	*keepAliveInterval = 0
+
+	*tcpKeepAlive = false
+	assert.NotNil(t, configureSocketOptions(), "should reject keepalive parameters with --no-tcp-keepalive")
+	*tcpKeepAlive = true
+
+	*listenFamily = "ipv6"
+	assert.Nil(t, configureSocketOptions(), "should accept listen family")
+	assert.Equal(t, socket.FamilyIPv6, socket.ListenFamily)
+}
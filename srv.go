@@ -0,0 +1,268 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/ghostunnel/proxy"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Refresh interval for SRV records if the TTL is unknown (e.g. when
+	// falling back to the system resolver), or lookups failed.
+	defaultSRVRefresh = 30 * time.Second
+	// Lower bound for refresh intervals, for records with very short TTLs.
+	minSRVRefresh = 5 * time.Second
+	// Timeout for a single DNS query.
+	srvQueryTimeout = 5 * time.Second
+)
+
+// Overridden in tests.
+var (
+	resolveSRV     = lookupSRV
+	resolvConfPath = "/etc/resolv.conf"
+)
+
+func isSRVAddress(addr string) bool {
+	return strings.HasPrefix(addr, "srv:")
+}
+
+// srvTarget is a target given as srv:NAME. Its backends are discovered from
+// the SRV records for NAME, and refreshed when the records expire.
+type srvTarget struct {
+	name   string
+	backup bool
+	// TLS for connecting to backends (nil for plaintext)
+	tls *targetTLS
+
+	mu       sync.Mutex
+	backends []*proxy.Backend
+	ttl      time.Duration
+}
+
+// Backends returns the current backends for the target.
+func (t *srvTarget) Backends() []*proxy.Backend {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.backends
+}
+
+// resolve looks up the SRV records for the target, and updates its backends.
+// Backends for records that didn't change are kept as they are, to preserve
+// their connection counts and health.
+func (t *srvTarget) resolve() (changed bool, err error) {
+	records, ttl, err := resolveSRV(t.name)
+	if err != nil {
+		return false, fmt.Errorf("unable to resolve SRV records for '%s': %s", t.name, err)
+	}
+	if len(records) == 0 {
+		return false, fmt.Errorf("no SRV records found for '%s'", t.name)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	existing := map[string]*proxy.Backend{}
+	for _, backend := range t.backends {
+		existing[backend.Name] = backend
+	}
+
+	backends := []*proxy.Backend{}
+	for _, record := range records {
+		address := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		backend, ok := existing[address]
+		if !ok || backend.Priority != int(record.Priority) || backend.Weight != int(record.Weight) {
+			backend = proxy.NewBackend(address, t.tls.wrap(address, hostDialer("tcp", address)))
+			backend.Backup = t.backup
+			backend.Priority = int(record.Priority)
+			backend.Weight = int(record.Weight)
+			changed = true
+		}
+		delete(existing, address)
+		backends = append(backends, backend)
+	}
+	changed = changed || len(existing) > 0
+
+	t.backends = backends
+	t.ttl = ttl
+	return changed, nil
+}
+
+// refresh re-resolves the target whenever its records expire, calling update
+// if the backends changed. If resolving fails, the previous backends are kept.
+func (t *srvTarget) refresh(update func()) {
+	for {
+		t.mu.Lock()
+		wait := t.ttl
+		t.mu.Unlock()
+		if wait < minSRVRefresh {
+			wait = minSRVRefresh
+		}
+		time.Sleep(wait)
+
+		changed, err := t.resolve()
+		if err != nil {
+			logger.Printf("%s, keeping previous targets", err)
+			t.mu.Lock()
+			t.ttl = defaultSRVRefresh
+			t.mu.Unlock()
+			continue
+		}
+		if changed {
+			names := []string{}
+			for _, backend := range t.Backends() {
+				names = append(names, backend.Name)
+			}
+			logger.Printf("targets for srv:%s changed, now using: %s", t.name, strings.Join(names, ", "))
+			update()
+		}
+	}
+}
+
+// lookupSRV resolves the SRV records for a name, and returns them along with
+// their TTL. The resolver in package net doesn't expose TTLs, so we query the
+// name servers from resolv.conf directly, and only fall back to package net
+// (with a default TTL) if that doesn't work.
+func lookupSRV(name string) ([]*net.SRV, time.Duration, error) {
+	for _, server := range systemNameServers() {
+		records, ttl, err := querySRV(name, server)
+		if err == nil {
+			return records, ttl, nil
+		}
+	}
+
+	_, records, err := net.LookupSRV("", "", name)
+	return records, defaultSRVRefresh, err
+}
+
+// systemNameServers returns the addresses of the name servers in resolv.conf.
+func systemNameServers() []string {
+	file, err := os.Open(resolvConfPath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	servers := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return servers
+}
+
+// querySRV sends a query for SRV records to the given name server (over UDP).
+// The returned TTL is the lowest TTL of all records.
+func querySRV(name, server string) ([]*net.SRV, time.Duration, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id := uint16(rand.Uint32())
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: qname, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET})
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	conn, err := net.DialTimeout("udp", server, srvQueryTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(srvQueryTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(buf[:n])
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.ID != id {
+		return nil, 0, errors.New("mismatched response id")
+	}
+	if header.Truncated {
+		return nil, 0, errors.New("truncated response")
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("lookup failed: %s", header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	records := []*net.SRV{}
+	var ttl time.Duration
+	for {
+		answer, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if answer.Type != dnsmessage.TypeSRV {
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		srv, err := parser.SRVResource()
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, &net.SRV{
+			Target:   srv.Target.String(),
+			Port:     srv.Port,
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		})
+		recordTTL := time.Duration(answer.TTL) * time.Second
+		if len(records) == 1 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	return records, ttl, nil
+}
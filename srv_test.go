@@ -0,0 +1,179 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newFakeDNSServer answers SRV queries with the given records (and TTLs), or
+// NXDOMAIN for other names.
+func newFakeDNSServer(t *testing.T, name string, records []dnsmessage.SRVResource, ttls []uint32) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen for DNS queries")
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buf[:n])
+			assert.Nil(t, err, "should parse DNS query")
+			question, err := parser.Question()
+			assert.Nil(t, err, "should parse DNS question")
+
+			header.Response = true
+			builder := dnsmessage.NewBuilder(nil, header)
+			builder.StartQuestions()
+			builder.Question(question)
+			if question.Name.String() != name {
+				header.RCode = dnsmessage.RCodeNameError
+				builder = dnsmessage.NewBuilder(nil, header)
+				builder.StartQuestions()
+				builder.Question(question)
+			} else {
+				builder.StartAnswers()
+				for i, record := range records {
+					builder.SRVResource(dnsmessage.ResourceHeader{
+						Name:  question.Name,
+						Class: dnsmessage.ClassINET,
+						TTL:   ttls[i],
+					}, record)
+				}
+			}
+			response, err := builder.Finish()
+			assert.Nil(t, err, "should build DNS response")
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn
+}
+
+func TestQuerySRV(t *testing.T) {
+	server := newFakeDNSServer(t, "_backend._tcp.example.com.", []dnsmessage.SRVResource{
+		{Priority: 10, Weight: 5, Port: 8080, Target: dnsmessage.MustNewName("a.example.com.")},
+		{Priority: 20, Weight: 0, Port: 8081, Target: dnsmessage.MustNewName("b.example.com.")},
+	}, []uint32{60, 30})
+	defer server.Close()
+
+	records, ttl, err := querySRV("_backend._tcp.example.com", server.LocalAddr().String())
+	assert.Nil(t, err, "should resolve SRV records")
+	assert.Equal(t, 30*time.Second, ttl, "should return lowest TTL")
+	assert.Equal(t, []*net.SRV{
+		{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 5},
+		{Target: "b.example.com.", Port: 8081, Priority: 20, Weight: 0},
+	}, records, "should return SRV records")
+
+	_, _, err = querySRV("_other._tcp.example.com", server.LocalAddr().String())
+	assert.NotNil(t, err, "should return error for NXDOMAIN")
+}
+
+func TestSystemNameServers(t *testing.T) {
+	file, err := ioutil.TempFile("", "ghostunnel-resolv")
+	assert.Nil(t, err, "should create temp file")
+	defer os.Remove(file.Name())
+	file.WriteString("# comment\nsearch example.com\nnameserver 192.0.2.1\nnameserver 2001:db8::1\n")
+	file.Close()
+
+	defer func(path string) { resolvConfPath = path }(resolvConfPath)
+	resolvConfPath = file.Name()
+	assert.Equal(t, []string{"192.0.2.1:53", "[2001:db8::1]:53"}, systemNameServers(), "should read name servers")
+
+	resolvConfPath = "/does-not-exist"
+	assert.Empty(t, systemNameServers(), "should return no name servers for missing file")
+}
+
+func TestSRVTargetResolve(t *testing.T) {
+	defer func() { resolveSRV = lookupSRV }()
+	records := []*net.SRV{
+		{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 5},
+		{Target: "b.example.com.", Port: 8080, Priority: 20, Weight: 1},
+	}
+	resolveSRV = func(name string) ([]*net.SRV, time.Duration, error) {
+		return records, time.Minute, nil
+	}
+
+	target := &srvTarget{name: "_backend._tcp.example.com", backup: true}
+	changed, err := target.resolve()
+	assert.Nil(t, err, "should resolve target")
+	assert.True(t, changed, "initial resolution should change backends")
+	backends := target.Backends()
+	assert.Equal(t, "a.example.com:8080", backends[0].Name, "should build backend from record")
+	assert.Equal(t, 10, backends[0].Priority, "should set priority from record")
+	assert.Equal(t, 5, backends[0].Weight, "should set weight from record")
+	assert.True(t, backends[0].Backup, "should mark backends of backup targets")
+	assert.Equal(t, time.Minute, target.ttl, "should store TTL")
+
+	changed, err = target.resolve()
+	assert.Nil(t, err, "should resolve target")
+	assert.False(t, changed, "unchanged records should not change backends")
+	assert.True(t, backends[0] == target.Backends()[0], "should keep backends for unchanged records")
+
+	records = records[1:]
+	changed, err = target.resolve()
+	assert.Nil(t, err, "should resolve target")
+	assert.True(t, changed, "removed record should change backends")
+	assert.Len(t, target.Backends(), 1, "should remove backend")
+
+	resolveSRV = func(name string) ([]*net.SRV, time.Duration, error) {
+		return nil, 0, errors.New("lookup failed for test")
+	}
+	_, err = target.resolve()
+	assert.NotNil(t, err, "should return lookup errors")
+	assert.Len(t, target.Backends(), 1, "should keep previous backends on error")
+
+	resolveSRV = func(name string) ([]*net.SRV, time.Duration, error) {
+		return nil, time.Minute, nil
+	}
+	_, err = target.resolve()
+	assert.NotNil(t, err, "should fail if there are no records")
+}
+
+func TestServerBackendDialerSRV(t *testing.T) {
+	defer func() { resolveSRV = lookupSRV }()
+	resolveSRV = func(name string) ([]*net.SRV, time.Duration, error) {
+		if name != "_backend._tcp.example.com" {
+			return nil, 0, errors.New("unknown name")
+		}
+		return []*net.SRV{{Target: "localhost.", Port: 8080}}, time.Minute, nil
+	}
+	*serverForwardAddress = "srv:_backend._tcp.example.com"
+	*serverTargetBalance = "round-robin"
+	defer func() {
+		*serverForwardAddress = ""
+		*serverTargetBalance = ""
+	}()
+
+	dial, err := serverBackendDialer(nil, nil)
+	assert.Nil(t, err, "should build dialer for SRV target")
+	assert.NotNil(t, dial, "should build dialer for SRV target")
+
+	*serverForwardAddress = "srv:_other._tcp.example.com"
+	_, err = serverBackendDialer(nil, nil)
+	assert.NotNil(t, err, "should fail if SRV target doesn't resolve")
+}
@@ -0,0 +1,153 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Maximum size of a StatsD packet. Chosen to fit into a single UDP datagram
+// without fragmentation on most networks.
+const statsdMaxPacketSize = 1432
+
+// statsdReporter periodically pushes metrics from a go-metrics registry to a
+// StatsD (or DogStatsD, if tags are set) endpoint over UDP. Counters are sent
+// as deltas since the last report, gauges and timer statistics as gauges.
+type statsdReporter struct {
+	registry metrics.Registry
+	prefix   string
+	tags     string
+	out      io.Writer
+
+	// Counter values as of the last report, to compute deltas
+	last map[string]int64
+}
+
+func newStatsdReporter(registry metrics.Registry, prefix string, tags []string, out io.Writer) *statsdReporter {
+	r := &statsdReporter{
+		registry: registry,
+		prefix:   prefix,
+		out:      out,
+		last:     map[string]int64{},
+	}
+	if len(tags) > 0 {
+		r.tags = "|#" + strings.Join(tags, ",")
+	}
+	return r
+}
+
+// reportStatsd sends metrics to the StatsD endpoint at addr every interval.
+func reportStatsd(registry metrics.Registry, interval time.Duration, prefix, addr string, tags []string) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		logger.Printf("error: unable to send metrics to statsd: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	r := newStatsdReporter(registry, prefix, tags, conn)
+	for range time.Tick(interval) {
+		if err := r.report(); err != nil {
+			logger.Printf("error sending metrics to statsd: %s", err)
+		}
+	}
+}
+
+// report sends a snapshot of all metrics in the registry.
+func (r *statsdReporter) report() error {
+	lines := []string{}
+	r.registry.Each(func(name string, i interface{}) {
+		switch metric := i.(type) {
+		case metrics.Counter:
+			lines = append(lines, r.counter(name, metric.Count()))
+		case metrics.Gauge:
+			lines = append(lines, r.gauge(name, fmt.Sprint(metric.Value())))
+		case metrics.GaugeFloat64:
+			lines = append(lines, r.gauge(name, fmt.Sprint(metric.Value())))
+		case metrics.Meter:
+			lines = append(lines, r.counter(name+".count", metric.Snapshot().Count()))
+		case metrics.Histogram:
+			h := metric.Snapshot()
+			lines = append(lines, r.counter(name+".count", h.Count()))
+			lines = append(lines, r.distribution(name, float64(h.Min()), float64(h.Max()), h.Mean(), h.Percentiles([]float64{0.5, 0.95, 0.99}))...)
+		case metrics.Timer:
+			t := metric.Snapshot()
+			ms := float64(time.Millisecond)
+			percentiles := t.Percentiles([]float64{0.5, 0.95, 0.99})
+			for i := range percentiles {
+				percentiles[i] /= ms
+			}
+			lines = append(lines, r.counter(name+".count", t.Count()))
+			lines = append(lines, r.distribution(name, float64(t.Min())/ms, float64(t.Max())/ms, t.Mean()/ms, percentiles)...)
+		}
+	})
+	sort.Strings(lines)
+
+	// Batch lines into as few packets as possible
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > statsdMaxPacketSize {
+			if _, err := r.out.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := r.out.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *statsdReporter) counter(name string, count int64) string {
+	delta := count - r.last[name]
+	r.last[name] = count
+	return fmt.Sprintf("%s.%s:%d|c%s", r.prefix, name, delta, r.tags)
+}
+
+func (r *statsdReporter) gauge(name string, value string) string {
+	return fmt.Sprintf("%s.%s:%s|g%s", r.prefix, name, value, r.tags)
+}
+
+func (r *statsdReporter) distribution(name string, min, max, mean float64, percentiles []float64) []string {
+	return []string{
+		r.gauge(name+".min", formatFloat(min)),
+		r.gauge(name+".max", formatFloat(max)),
+		r.gauge(name+".mean", formatFloat(mean)),
+		r.gauge(name+".50-percentile", formatFloat(percentiles[0])),
+		r.gauge(name+".95-percentile", formatFloat(percentiles[1])),
+		r.gauge(name+".99-percentile", formatFloat(percentiles[2])),
+	}
+}
+
+func formatFloat(f float64) string {
+	return fmt.Sprintf("%.3f", f)
+}
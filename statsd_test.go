@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// packetWriter records each write as a separate packet.
+type packetWriter struct {
+	packets []string
+}
+
+func (w *packetWriter) Write(p []byte) (int, error) {
+	w.packets = append(w.packets, string(p))
+	return len(p), nil
+}
+
+func TestStatsdReporter(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := metrics.GetOrRegisterCounter("accept.total", registry)
+	gauge := metrics.GetOrRegisterGauge("conn.open", registry)
+	timer := metrics.GetOrRegisterTimer("conn.handshake", registry)
+
+	out := &packetWriter{}
+	r := newStatsdReporter(registry, "ghostunnel", nil, out)
+
+	counter.Inc(3)
+	gauge.Update(2)
+	timer.Update(20 * time.Millisecond)
+	assert.Nil(t, r.report(), "should be able to report")
+
+	counter.Inc(2)
+	assert.Nil(t, r.report(), "should be able to report")
+
+	assert.Len(t, out.packets, 2, "should send one packet per report")
+	first := strings.Split(out.packets[0], "\n")
+	assert.Contains(t, first, "ghostunnel.accept.total:3|c")
+	assert.Contains(t, first, "ghostunnel.conn.open:2|g")
+	assert.Contains(t, first, "ghostunnel.conn.handshake.count:1|c")
+	assert.Contains(t, first, "ghostunnel.conn.handshake.max:20.000|g")
+
+	second := strings.Split(out.packets[1], "\n")
+	assert.Contains(t, second, "ghostunnel.accept.total:2|c", "counters should be reported as deltas")
+	assert.Contains(t, second, "ghostunnel.conn.handshake.count:0|c", "counters should be reported as deltas")
+}
+
+func TestStatsdReporterTags(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("accept.total", registry).Inc(1)
+
+	out := &packetWriter{}
+	r := newStatsdReporter(registry, "ghostunnel", []string{"env:prod", "service:api"}, out)
+	assert.Nil(t, r.report(), "should be able to report")
+	assert.Equal(t, []string{"ghostunnel.accept.total:1|c|#env:prod,service:api"}, out.packets)
+}
+
+func TestStatsdReporterBatching(t *testing.T) {
+	registry := metrics.NewRegistry()
+	for i := 0; i < 200; i++ {
+		metrics.GetOrRegisterCounter(strings.Repeat("x", 20)+string(rune('a'+i%26))+strings.Repeat("y", i/26), registry).Inc(1)
+	}
+
+	out := &packetWriter{}
+	r := newStatsdReporter(registry, "ghostunnel", nil, out)
+	assert.Nil(t, r.report(), "should be able to report")
+
+	assert.True(t, len(out.packets) > 1, "should split metrics into multiple packets")
+	lines := 0
+	for _, packet := range out.packets {
+		assert.True(t, len(packet) <= statsdMaxPacketSize, "packets should not exceed max size")
+		lines += len(strings.Split(packet, "\n"))
+	}
+	assert.Equal(t, 200, lines, "should send all metrics")
+}
+
+func TestReportStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer conn.Close()
+
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("accept.total", registry).Inc(1)
+	go reportStatsd(registry, 10*time.Millisecond, "ghostunnel", conn.LocalAddr().String(), nil)
+
+	buf := make([]byte, statsdMaxPacketSize)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(t, err, "should receive metrics")
+	assert.True(t, bytes.HasPrefix(buf[:n], []byte("ghostunnel.accept.total:1|c")), "should receive metrics")
+}
@@ -29,28 +29,41 @@ import (
 type statusHandler struct {
 	// Mutex for locking
 	mu *sync.Mutex
-	// Backend dialer to check if target is up and running
+	// Backend dialer to check if target is up and running (nil if there's
+	// no fixed target to check, e.g. with --target original-dst)
 	dial func() (net.Conn, error)
+	// Background checks of the target, used instead of dialing the backend
+	// for each status request (nil if not enabled)
+	prober *targetProber
+	// Expiry of certificates, to warn about (nil if not checked)
+	expiry *expiryMonitor
 	// Current status
 	listening bool
 	reloading bool
 }
 
 type statusResponse struct {
-	Ok            bool      `json:"ok"`
-	Status        string    `json:"status"`
-	BackendOk     bool      `json:"backend_ok"`
-	BackendStatus string    `json:"backend_status"`
-	BackendError  string    `json:"backend_error,omitempty"`
-	Time          time.Time `json:"time"`
-	Hostname      string    `json:"hostname,omitempty"`
-	Message       string    `json:"message"`
-	Revision      string    `json:"revision"`
-	Compiler      string    `json:"compiler"`
+	Ok            bool   `json:"ok"`
+	Status        string `json:"status"`
+	BackendOk     bool   `json:"backend_ok"`
+	BackendStatus string `json:"backend_status"`
+	BackendError  string `json:"backend_error,omitempty"`
+	// Time of the last background check of the backend (if enabled)
+	BackendCheckedAt *time.Time `json:"backend_checked_at,omitempty"`
+	Time             time.Time  `json:"time"`
+	Hostname         string     `json:"hostname,omitempty"`
+	Message          string     `json:"message"`
+	Revision         string     `json:"revision"`
+	Compiler         string     `json:"compiler"`
+	FIPSModule       string     `json:"fips_module,omitempty"`
+	FIPSMode         bool       `json:"fips_mode"`
+	// Set if a certificate expires within --cert-expiry-warning
+	CertificateExpiring bool       `json:"certificate_expiring"`
+	CertificateExpiry   *time.Time `json:"certificate_expiry,omitempty"`
 }
 
 func newStatusHandler(dial func() (net.Conn, error)) *statusHandler {
-	status := &statusHandler{&sync.Mutex{}, dial, false, false}
+	status := &statusHandler{mu: &sync.Mutex{}, dial: dial}
 	return status
 }
 
@@ -67,19 +80,26 @@ func (s *statusHandler) Reloading() {
 	s.mu.Unlock()
 }
 
-func (s *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// check returns the current status, checking if the backend is up.
+func (s *statusHandler) check() statusResponse {
 	resp := statusResponse{
 		Time: time.Now(),
 	}
 
 	resp.Revision = version
 	resp.Compiler = runtime.Version()
+	resp.FIPSModule = fipsModule()
+	resp.FIPSMode = *fipsMode
 
-	conn, err := s.dial()
-	resp.BackendOk = err == nil
-
-	if resp.BackendOk {
-		conn.Close()
+	if s.prober != nil {
+		checked, _ := s.prober.Result()
+		resp.BackendCheckedAt = &checked
+	}
+	if skipped, err := s.checkBackend(); skipped {
+		resp.BackendOk = true
+		resp.BackendStatus = "skipped"
+	} else if err == nil {
+		resp.BackendOk = true
 		resp.BackendStatus = "ok"
 	} else {
 		resp.BackendError = err.Error()
@@ -97,7 +117,16 @@ func (s *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	s.mu.Unlock()
 
-	if resp.Ok && resp.BackendOk {
+	if s.expiry != nil {
+		if expiry := s.expiry.CertificateExpiry(); !expiry.IsZero() {
+			resp.CertificateExpiry = &expiry
+		}
+		resp.CertificateExpiring = s.expiry.Expiring()
+	}
+
+	if resp.Ok && resp.BackendOk && resp.CertificateExpiring {
+		resp.Status = "warning"
+	} else if resp.Ok && resp.BackendOk {
 		resp.Status = "ok"
 	} else {
 		resp.Status = "critical"
@@ -107,7 +136,30 @@ func (s *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		resp.Hostname = hostname
 	}
+	return resp
+}
+
+// checkBackend checks if the backend is up, using the result of the last
+// background check if the target is probed, or by dialing it otherwise.
+// Returns skipped if there's no backend to check.
+func (s *statusHandler) checkBackend() (skipped bool, err error) {
+	if s.prober != nil {
+		_, err := s.prober.Result()
+		return false, err
+	}
+	if s.dial == nil {
+		return true, nil
+	}
+	conn, err := s.dial()
+	if err != nil {
+		return false, err
+	}
+	conn.Close()
+	return false, nil
+}
 
+func (s *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := s.check()
 	out, err := json.Marshal(resp)
 	panicOnError(err)
 
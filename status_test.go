@@ -112,3 +112,14 @@ func TestStatusHandlerReloading(t *testing.T) {
 		t.Error("status should return 200 during reload")
 	}
 }
+
+func TestStatusHandlerNoBackend(t *testing.T) {
+	handler := newStatusHandler(nil)
+	response := httptest.NewRecorder()
+	handler.Listening()
+	handler.ServeHTTP(response, nil)
+
+	if response.Code != 200 {
+		t.Error("status should return 200 if there's no backend to check")
+	}
+}
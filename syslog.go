@@ -0,0 +1,229 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Syslog facility for our messages (daemon)
+	syslogFacility = 3
+	// Severities, for messages starting with "error" or "warning"
+	syslogError   = 3
+	syslogWarning = 4
+	syslogInfo    = 6
+	// SD-ID of the structured data element for connection fields. The
+	// enterprise number is the one reserved for documentation (RFC 5612).
+	syslogSDID = "conn@32473"
+
+	syslogWriteTimeout = 5 * time.Second
+)
+
+// syslogWriter sends log messages to a syslog server (--syslog-addr), in
+// RFC 5424 format with connection fields as structured data, or in RFC 3164
+// (BSD) format with fields appended to the message as key=value pairs.
+// Messages over TCP are framed with octet counting (RFC 6587) for RFC 5424,
+// and terminated by newlines for RFC 3164. If a message can't be sent after
+// reconnecting, it is written to stderr instead.
+type syslogWriter struct {
+	mu       sync.Mutex
+	network  string
+	address  string
+	rfc5424  bool
+	hostname string
+	pid      int
+	now      func() time.Time
+	conn     net.Conn
+	// Set for stream connections (TCP and UNIX stream sockets), which need
+	// messages to be framed
+	stream bool
+}
+
+// newSyslogWriter connects to the syslog server at the given address
+// ("HOST:PORT" for TCP, "udp:HOST:PORT" for UDP, or "unix:PATH" for a local
+// datagram or stream socket such as /dev/log).
+func newSyslogWriter(addr string, format string) (*syslogWriter, error) {
+	network, address := "tcp", addr
+	switch {
+	case strings.HasPrefix(addr, "udp:"):
+		network, address = "udp", addr[4:]
+	case strings.HasPrefix(addr, "unix:"):
+		network, address = "unix", addr[5:]
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	w := &syslogWriter{
+		network:  network,
+		address:  address,
+		rfc5424:  format == "rfc5424",
+		hostname: hostname,
+		pid:      os.Getpid(),
+		now:      time.Now,
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	if w.network != "unix" {
+		conn, err := net.DialTimeout(w.network, w.address, syslogWriteTimeout)
+		if err != nil {
+			return err
+		}
+		w.conn, w.stream = conn, w.network == "tcp"
+		return nil
+	}
+	// Local syslog daemons usually listen on datagram sockets
+	conn, err := net.Dial("unixgram", w.address)
+	if err == nil {
+		w.conn, w.stream = conn, false
+		return nil
+	}
+	conn, err = net.Dial("unix", w.address)
+	if err != nil {
+		return err
+	}
+	w.conn, w.stream = conn, true
+	return nil
+}
+
+// Write logs a free-form message (as written by log.Logger).
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	err := w.LogFields(strings.TrimSpace(string(p)), nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// LogFields logs a message with additional structured fields.
+func (w *syslogWriter) LogFields(msg string, fields map[string]interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	frame := w.format(msg, fields)
+	if w.stream {
+		if w.rfc5424 {
+			frame = append([]byte(strconv.Itoa(len(frame))+" "), frame...)
+		} else {
+			frame = append(frame, '\n')
+		}
+	}
+
+	if w.send(frame) == nil {
+		return nil
+	}
+	// Connection may have been closed by the server, try again once
+	if err := w.connect(); err == nil && w.send(frame) == nil {
+		return nil
+	}
+	_, err := fmt.Fprintln(os.Stderr, msg)
+	return err
+}
+
+func (w *syslogWriter) send(frame []byte) error {
+	if w.conn == nil {
+		return net.ErrClosed
+	}
+	if err := w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout)); err != nil {
+		return err
+	}
+	_, err := w.conn.Write(frame)
+	return err
+}
+
+// format formats a message with its header, without framing.
+func (w *syslogWriter) format(msg string, fields map[string]interface{}) []byte {
+	priority := syslogFacility*8 + syslogSeverity(msg)
+	var buf bytes.Buffer
+	if !w.rfc5424 {
+		fmt.Fprintf(&buf, "<%d>%s %s ghostunnel[%d]: %s", priority, w.now().Format(time.Stamp), w.hostname, w.pid, msg)
+		if len(fields) > 0 {
+			buf.WriteByte(' ')
+			buf.Write(formatKeyValues(fields))
+		}
+		return buf.Bytes()
+	}
+
+	fmt.Fprintf(&buf, "<%d>1 %s %s ghostunnel %d - ", priority, w.now().Format("2006-01-02T15:04:05.000000Z07:00"), w.hostname, w.pid)
+	if len(fields) == 0 {
+		buf.WriteByte('-')
+	} else {
+		buf.Write(formatStructuredData(fields))
+	}
+	if msg != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(msg)
+	}
+	return buf.Bytes()
+}
+
+func syslogSeverity(msg string) int {
+	switch {
+	case strings.HasPrefix(msg, "error"):
+		return syslogError
+	case strings.HasPrefix(msg, "warning"):
+		return syslogWarning
+	}
+	return syslogInfo
+}
+
+// formatStructuredData formats fields as an RFC 5424 structured data element,
+// with parameters sorted by name. Lists are joined with commas.
+func formatStructuredData(fields map[string]interface{}) []byte {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("[" + syslogSDID)
+	for _, name := range names {
+		value := fmt.Sprint(fields[name])
+		if list, ok := fields[name].([]string); ok {
+			value = strings.Join(list, ",")
+		}
+		fmt.Fprintf(&buf, ` %s="%s"`, name, escapeSDValue(value))
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// escapeSDValue escapes characters that must be escaped in structured data
+// parameter values.
+func escapeSDValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
@@ -0,0 +1,113 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSyslogTime = time.Date(2019, 1, 2, 3, 4, 5, 6000, time.UTC)
+
+func TestSyslogWriterRFC5424(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	defer server.Close()
+
+	w, err := newSyslogWriter("udp:"+server.LocalAddr().String(), "rfc5424")
+	assert.Nil(t, err, "should connect")
+	w.hostname = "host"
+	w.now = func() time.Time { return testSyslogTime }
+	header := fmt.Sprintf("1 2019-01-02T03:04:05.000006Z host ghostunnel %d -", w.pid)
+
+	buf := make([]byte, 1024)
+	log.New(w, "", 0).Printf("starting ghostunnel")
+	n, _, err := server.ReadFrom(buf)
+	assert.Nil(t, err, "should receive message")
+	assert.Equal(t, "<30>"+header+" - starting ghostunnel", string(buf[:n]))
+
+	assert.Nil(t, w.LogFields("error on TLS handshake", map[string]interface{}{
+		"conn_id":       1,
+		"peer_uri_sans": []string{"spiffe://a", "spiffe://b"},
+		"peer_cn":       `quoted "name" [x]\`,
+	}))
+	n, _, err = server.ReadFrom(buf)
+	assert.Nil(t, err, "should receive message")
+	assert.Equal(t, "<27>"+header+` [conn@32473 conn_id="1" peer_cn="quoted \"name\" [x\]\\" peer_uri_sans="spiffe://a,spiffe://b"] error on TLS handshake`, string(buf[:n]))
+}
+
+func TestSyslogWriterRFC3164(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	defer server.Close()
+
+	w, err := newSyslogWriter(server.Addr().String(), "rfc3164")
+	assert.Nil(t, err, "should connect")
+	w.hostname = "host"
+	w.now = func() time.Time { return testSyslogTime }
+
+	conn, err := server.Accept()
+	assert.Nil(t, err, "should accept")
+	defer conn.Close()
+	lines := bufio.NewReader(conn)
+
+	assert.Nil(t, w.LogFields("warning: certificate expires soon", nil))
+	assert.Nil(t, w.LogFields("closed pipe", map[string]interface{}{"conn_id": 2, "close_reason": "client closed"}))
+	line, err := lines.ReadString('\n')
+	assert.Nil(t, err, "should receive message")
+	assert.Equal(t, fmt.Sprintf("<28>Jan  2 03:04:05 host ghostunnel[%d]: warning: certificate expires soon\n", w.pid), line)
+	line, err = lines.ReadString('\n')
+	assert.Nil(t, err, "should receive message")
+	assert.True(t, strings.HasSuffix(line, `: closed pipe close_reason="client closed" conn_id=2`+"\n"), "should append fields to message")
+}
+
+func TestSyslogWriterOctetCounting(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	defer server.Close()
+
+	w, err := newSyslogWriter(server.Addr().String(), "rfc5424")
+	assert.Nil(t, err, "should connect")
+	w.now = func() time.Time { return testSyslogTime }
+	conn, err := server.Accept()
+	assert.Nil(t, err, "should accept")
+	defer conn.Close()
+
+	assert.Nil(t, w.LogFields("listening", nil))
+	frame := w.format("listening", nil)
+	buf := make([]byte, len(frame)+8)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err, "should receive message")
+	assert.Equal(t, fmt.Sprintf("%d %s", len(frame), frame), string(buf[:n]), "should frame message with its length")
+}
+
+func TestSyslogWriterUnreachable(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	addr := server.Addr().String()
+	server.Close()
+
+	_, err = newSyslogWriter(addr, "rfc5424")
+	assert.NotNil(t, err, "should fail if syslog server can't be reached")
+}
@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	targetUpGauge    = metrics.GetOrRegisterGauge("target.up", metrics.DefaultRegistry)
+	targetProbeTimer = metrics.GetOrRegisterTimer("target.probe", metrics.DefaultRegistry)
+)
+
+var errProbeTimeout = errors.New("timed out connecting to target")
+
+// targetProber periodically checks if the target can be reached, independent
+// of client traffic, so outages show up on the status port and in metrics
+// (target.up is 1 if the last probe succeeded, 0 otherwise) before clients
+// notice. Changes in reachability are logged.
+type targetProber struct {
+	dial    func() (net.Conn, error)
+	timeout time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func newTargetProber(dial func() (net.Conn, error), timeout time.Duration) *targetProber {
+	return &targetProber{dial: dial, timeout: timeout}
+}
+
+// start runs the first probe right away, and then probes every interval.
+func (p *targetProber) start(interval time.Duration) {
+	p.probe()
+	go func() {
+		for range time.Tick(interval) {
+			p.probe()
+		}
+	}()
+}
+
+// probe checks once if the target can be reached, and records the result.
+func (p *targetProber) probe() error {
+	start := time.Now()
+	err := p.dialWithTimeout()
+	if err == nil {
+		targetProbeTimer.UpdateSince(start)
+		targetUpGauge.Update(1)
+	} else {
+		targetUpGauge.Update(0)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil && p.err == nil {
+		logger.Printf("target is unreachable: %s", err)
+	}
+	if err == nil && p.err != nil {
+		logger.Printf("target is reachable again")
+	}
+	p.checked = start
+	p.err = err
+	return err
+}
+
+func (p *targetProber) dialWithTimeout() error {
+	result := make(chan error, 1)
+	go func() {
+		conn, err := p.dial()
+		if err == nil {
+			conn.Close()
+		}
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(p.timeout):
+		return errProbeTimeout
+	}
+}
+
+// Result returns the time and result of the last probe.
+func (p *targetProber) Result() (time.Time, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.checked, p.err
+}
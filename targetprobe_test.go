@@ -0,0 +1,75 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetProber(t *testing.T) {
+	up := true
+	prober := newTargetProber(func() (net.Conn, error) {
+		if up {
+			return dummyDial()
+		}
+		return dummyDialError()
+	}, time.Second)
+
+	assert.Nil(t, prober.probe(), "should reach target")
+	checked, err := prober.Result()
+	assert.Nil(t, err, "should record successful probe")
+	assert.False(t, checked.IsZero(), "should record time of probe")
+	assert.Equal(t, int64(1), targetUpGauge.Value(), "should report target as up")
+
+	up = false
+	assert.NotNil(t, prober.probe(), "should fail to reach target")
+	_, err = prober.Result()
+	assert.NotNil(t, err, "should record failed probe")
+	assert.Equal(t, int64(0), targetUpGauge.Value(), "should report target as down")
+}
+
+func TestTargetProberTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	prober := newTargetProber(func() (net.Conn, error) {
+		<-block
+		return dummyDial()
+	}, 10*time.Millisecond)
+
+	assert.Equal(t, errProbeTimeout, prober.probe(), "should time out if target doesn't answer")
+}
+
+func TestStatusHandlerProber(t *testing.T) {
+	dials := 0
+	handler := newStatusHandler(func() (net.Conn, error) {
+		dials++
+		return dummyDialError()
+	})
+	handler.Listening()
+	handler.prober = newTargetProber(handler.dial, time.Second)
+	handler.prober.probe()
+
+	resp := handler.check()
+	assert.False(t, resp.BackendOk, "should report result of last probe")
+	assert.Equal(t, "critical", resp.BackendStatus)
+	assert.NotNil(t, resp.BackendCheckedAt, "should report time of last probe")
+	handler.check()
+	assert.Equal(t, 1, dials, "should not dial target on status requests")
+}
@@ -0,0 +1,128 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/square/ghostunnel/auth"
+	"github.com/square/ghostunnel/certloader"
+	"github.com/square/ghostunnel/wildcard"
+)
+
+// targetTLS holds the TLS configuration for connecting to targets in server
+// mode with --target-tls. A nil *targetTLS means targets are plaintext.
+type targetTLS struct {
+	config  certloader.TLSClientConfig
+	timeout time.Duration
+}
+
+// buildTargetCertificate loads the CA bundle (and client certificate, if
+// any) for talking to targets over TLS: --cacert-target with the keystore
+// from --target-keystore. Returns nil if neither --target-tls nor
+// --cacert-target is set.
+func buildTargetCertificate() (certloader.Certificate, error) {
+	if !*serverTargetTLS && *serverTargetCA == "" {
+		return nil, nil
+	}
+	path := *serverTargetCA
+	if path == "" {
+		path = *caBundlePath
+	}
+	path = withSystemTrust(path)
+	if *serverTargetKeystore != "" {
+		return buildKeystore(*serverTargetKeystore, *keystorePass, path)
+	}
+	return certloader.NoCertificate(path)
+}
+
+// buildTargetTLS builds the TLS configuration for targets, verifying them
+// against the trust store of the given certificate (and presenting its
+// client certificate, if any). Returns nil unless --target-tls is set.
+func buildTargetTLS(cert certloader.Certificate) (*targetTLS, error) {
+	if !*serverTargetTLS {
+		return nil, nil
+	}
+
+	config, err := buildClientConfig(*enabledCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedURIs, err := wildcard.CompileList(*serverTargetURIs)
+	if err != nil {
+		logger.Printf("invalid URI pattern in --target-verify-uri flag (%s)", err)
+		return nil, err
+	}
+	allowedCNs, allowedCNPatterns, err := auth.SplitPatterns(*serverTargetCNs, '.')
+	if err != nil {
+		logger.Printf("invalid CN pattern in --target-verify-cn flag (%s)", err)
+		return nil, err
+	}
+	allowedDNSs, allowedDNSPatterns, err := auth.SplitPatternsFold(*serverTargetDNSs, '.')
+	if err != nil {
+		logger.Printf("invalid DNS pattern in --target-verify-dns flag (%s)", err)
+		return nil, err
+	}
+	targetACL := auth.ACL{
+		AllowedCNs:         allowedCNs,
+		AllowedCNPatterns:  allowedCNPatterns,
+		AllowedDNSs:        allowedDNSs,
+		AllowedDNSPatterns: allowedDNSPatterns,
+		AllowedURIs:        allowedURIs,
+		Logger:             logger,
+	}
+	config.VerifyPeerCertificate = targetACL.VerifyPeerCertificateClient
+
+	clientConfig, err := certloader.TLSConfigSourceFromCertificate(cert).GetClientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &targetTLS{config: clientConfig, timeout: *timeoutDuration}, nil
+}
+
+// wrap returns a dialer that completes a TLS handshake with the target at
+// address after connecting. The handshake happens before the connection is
+// returned, so that failing targets are detected when dialing.
+func (t *targetTLS) wrap(address string, dial func() (net.Conn, error)) func() (net.Conn, error) {
+	if t == nil {
+		return dial
+	}
+	return func() (net.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+
+		config := t.config.GetClientConfig()
+		config.ServerName = *serverTargetName
+		if config.ServerName == "" {
+			config.ServerName = targetHost(address)
+		}
+
+		tlsConn := tls.Client(conn, config)
+		tlsConn.SetDeadline(time.Now().Add(t.timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+}
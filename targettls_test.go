@@ -0,0 +1,126 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTLSTarget starts a TLS target that requires client certificates
+// issued by the test CA, and reports the common name of each client.
+func startTLSTarget(t *testing.T) (net.Listener, chan string) {
+	cert, err := tls.LoadX509KeyPair("test-keys/server-cert.pem", "test-keys/server-key.pem")
+	assert.Nil(t, err, "should load server certificate")
+	caCert, err := ioutil.ReadFile("test-keys/cacert.pem")
+	assert.Nil(t, err, "should read CA bundle")
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caCert)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	assert.Nil(t, err, "should listen")
+
+	clients := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if tlsConn.Handshake() == nil {
+				clients <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			conn.Close()
+		}
+	}()
+	return ln, clients
+}
+
+func resetTargetTLSFlags() {
+	*serverTargetTLS = false
+	*serverTargetCA = ""
+	*serverTargetKeystore = ""
+	*serverTargetName = ""
+	*serverTargetCNs = nil
+	*enabledCipherSuites = ""
+	*timeoutDuration = 0
+}
+
+func TestTargetTLS(t *testing.T) {
+	ln, clients := startTLSTarget(t)
+	defer ln.Close()
+	defer resetTargetTLSFlags()
+
+	*serverTargetTLS = true
+	*serverTargetCA = "test-keys/cacert.pem"
+	*serverTargetKeystore = "test-keys/client-combined.pem"
+	*enabledCipherSuites = "AES,CHACHA"
+	*timeoutDuration = 5 * time.Second
+
+	cert, err := buildTargetCertificate()
+	assert.Nil(t, err, "should load target certificates")
+	targetTLS, err := buildTargetTLS(cert)
+	assert.Nil(t, err, "should build target TLS config")
+
+	address := ln.Addr().String()
+	plain, err := backendDialer(address)
+	assert.Nil(t, err, "should build backend dialer")
+	conn, err := targetTLS.wrap(address, plain)()
+	assert.Nil(t, err, "should complete handshake with target")
+	conn.Close()
+	assert.Equal(t, "client", <-clients, "should present client certificate to target")
+
+	*serverTargetCNs = []string{"other"}
+	targetTLS, err = buildTargetTLS(cert)
+	assert.Nil(t, err, "should build target TLS config")
+	_, err = targetTLS.wrap(address, plain)()
+	assert.NotNil(t, err, "should reject target with other common name")
+
+	*serverTargetCNs = []string{"server"}
+	*serverTargetName = "wrong.example.com"
+	targetTLS, err = buildTargetTLS(cert)
+	assert.Nil(t, err, "should build target TLS config")
+	_, err = targetTLS.wrap(address, plain)()
+	assert.NotNil(t, err, "should verify target against --target-server-name")
+}
+
+func TestTargetTLSDisabled(t *testing.T) {
+	defer resetTargetTLSFlags()
+
+	cert, err := buildTargetCertificate()
+	assert.Nil(t, err)
+	assert.Nil(t, cert, "should not load certificates without --target-tls or --cacert-target")
+	targetTLS, err := buildTargetTLS(cert)
+	assert.Nil(t, err)
+	assert.Nil(t, targetTLS, "should not build TLS config without --target-tls")
+
+	dial := func() (net.Conn, error) { return nil, nil }
+	conn, err := targetTLS.wrap("localhost:8080", dial)()
+	assert.Nil(t, conn)
+	assert.Nil(t, err, "should dial plaintext without --target-tls")
+}
@@ -0,0 +1,123 @@
+#!/usr/bin/env python3
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, TlsServer, print_ok, run_ghostunnel, terminate
+import socketserver
+import struct
+import threading
+import select
+
+
+def recv_exactly(conn, n):
+    data = b''
+    while len(data) < n:
+        chunk = conn.recv(n - len(data))
+        if not chunk:
+            raise Exception('unexpected EOF from SOCKS5 client')
+        data += chunk
+    return data
+
+
+class FakeSocks5ProxyHandler(socketserver.BaseRequestHandler):
+    def handle(self):
+        conn = self.request
+        socket = None
+        try:
+            # greeting: client must offer username/password auth (0x02)
+            version, nmethods = recv_exactly(conn, 2)
+            methods = recv_exactly(conn, nmethods)
+            if version != 5 or 2 not in methods:
+                raise Exception('client did not offer username/password auth')
+            conn.sendall(b'\x05\x02')
+
+            # username/password sub-negotiation (RFC 1929)
+            _, ulen = recv_exactly(conn, 2)
+            user = recv_exactly(conn, ulen)
+            plen, = recv_exactly(conn, 1)
+            password = recv_exactly(conn, plen)
+            if user != b'user' or password != b'secret':
+                conn.sendall(b'\x01\x01')
+                raise Exception('invalid credentials: ' + str(user))
+            conn.sendall(b'\x01\x00')
+
+            # connect request
+            _, cmd, _, atyp = recv_exactly(conn, 4)
+            if cmd != 1:
+                raise Exception('expected CONNECT command')
+            if atyp == 1:
+                host = '.'.join(str(b) for b in recv_exactly(conn, 4))
+            elif atyp == 3:
+                hlen, = recv_exactly(conn, 1)
+                host = recv_exactly(conn, hlen).decode('utf-8')
+            else:
+                raise Exception('unexpected address type: ' + str(atyp))
+            port, = struct.unpack('>H', recv_exactly(conn, 2))
+            if host != '127.0.0.1':
+                raise Exception('proxy target must be localhost, but was: ' + host)
+            print_ok("got SOCKS5 request, with proxy target: {0}:{1}".format(host, port))
+
+            socket = TcpClient(port)
+            socket.connect(attempts=5)
+            conn.sendall(b'\x05\x00\x00\x01\x7f\x00\x00\x01' + struct.pack('>H', port))
+
+            remote = socket.get_socket()
+            rlist = [conn, remote]
+            for _ in range(0, 1000):
+                reads, _, errs = select.select(rlist, [], rlist, 10)
+                if errs:
+                    print_ok("got error in select(): " + str(errs))
+                    break
+                for s in reads:
+                    data = s.recv(8192)
+                    if data:
+                        print_ok("proxy is sending/receiving " +
+                                 str(len(data)) + " bytes")
+                        (conn if s == remote else remote).send(data)
+        finally:
+            print_ok("SOCKS5 proxy is done")
+            try:
+                socket.cleanup()
+                conn.close()
+            except BaseException:
+                pass
+
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        socksd = socketserver.TCPServer(
+            (LOCALHOST, 13080), FakeSocks5ProxyHandler)
+        server = threading.Thread(target=socksd.handle_request)
+        server.start()
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['client',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target={0}:13002'.format(LOCALHOST),
+                                     '--cert=client.crt',
+                                     '--key=client.key',
+                                     '--cacert=root.crt',
+                                     '--socks5-proxy={0}:13080'.format(LOCALHOST),
+                                     '--socks5-proxy-user=user',
+                                     '--socks5-proxy-pass=secret',
+                                     '--connect-timeout=30s',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # connect to server, confirm that the tunnel is up
+        pair = SocketPair(TcpClient(13001), TlsServer('server', 'root', 13002))
+        pair.validate_can_send_from_client(
+            'hello world', '1: client -> server')
+        pair.validate_can_send_from_server(
+            'hello world', '1: server -> client')
+        pair.validate_closing_client_closes_server('closing client')
+        pair.cleanup()
+        socksd.server_close()
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
@@ -0,0 +1,68 @@
+#!/usr/bin/env python3
+
+"""
+Ensures that --log-format=json produces JSON log lines, with connection fields.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TcpClient, TlsClient, TcpServer, print_ok, run_ghostunnel, terminate, SocketPair
+import subprocess
+import json
+
+if __name__ == '__main__':
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['server',
+                                     '--log-format=json',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target={0}:13002'.format(LOCALHOST),
+                                     '--cert=server.crt',
+                                     '--key=server.key',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)],
+                                     stdout=subprocess.PIPE,
+                                     stderr=subprocess.PIPE)
+
+        # block until ghostunnel is up
+        TcpClient(STATUS_PORT).connect(20)
+
+        # send some data through proxy
+        pair1 = SocketPair(
+                TlsClient('client', 'root', 13001), TcpServer(13002))
+        pair1.validate_can_send_from_client('toto', 'works')
+        pair1.validate_can_send_from_server('toto', 'works')
+        pair1.cleanup()
+
+        terminate(ghostunnel)
+        _, err = ghostunnel.communicate()
+
+        # every line of output from ghostunnel should be valid JSON (test
+        # runner output is printed as text, so we filter that out first)
+        entries = []
+        for line in err.decode('utf-8').splitlines():
+            if line.startswith('{'):
+                entries.append(json.loads(line))
+            else:
+                print(line)
+
+        closed = [e for e in entries if e['message'] == 'closed pipe']
+        if len(closed) != 1:
+            raise Exception('expected one closed pipe entry, got: {0}'.format(entries))
+        print_ok('got log entry: {0}'.format(closed[0]))
+
+        for field in ['conn_id', 'client_addr', 'tls_version', 'tls_cipher_suite', 'bytes_in', 'bytes_out', 'duration_ms']:
+            if field not in closed[0]:
+                raise Exception('missing field {0} in log entry'.format(field))
+        if closed[0]['bytes_in'] != 4:
+            raise Exception('unexpected bytes_in in log entry')
+
+        print_ok('OK')
+    finally:
+        terminate(ghostunnel)
@@ -4,7 +4,7 @@
 Test that ensures that metrics endpoint works.
 """
 
-from common import LOCALHOST, RootCert, STATUS_PORT, TcpClient, print_ok, run_ghostunnel, terminate
+from common import LOCALHOST, RootCert, STATUS_PORT, TcpClient, TlsClient, TcpServer, SocketPair, print_ok, run_ghostunnel, terminate
 import urllib.request
 import urllib.error
 import urllib.parse
@@ -17,6 +17,7 @@ if __name__ == "__main__":
         # create certs
         root = RootCert('root')
         root.create_signed_cert('server')
+        root.create_signed_cert('client')
 
         # start ghostunnel
         ghostunnel = run_ghostunnel(['server',
@@ -88,6 +89,27 @@ if __name__ == "__main__":
         metrics = str(urlopen(
             "https://{0}:{1}/_metrics/prometheus".format(LOCALHOST, STATUS_PORT)).read(), 'utf-8')
 
+        # Histograms are labeled, and only show up once we've seen a connection
+        pair = SocketPair(
+            TlsClient('client', 'root', 13001), TcpServer(13002))
+        pair.validate_can_send_from_client('toto', 'works')
+        pair.cleanup()
+
+        expected_histograms = [
+            'ghostunnel_handshake_duration_seconds_count{{listener="{0}:13001",result="success"}} 1'.format(LOCALHOST),
+            'ghostunnel_dial_duration_seconds_count{{listener="{0}:13001",result="success"}} 1'.format(LOCALHOST),
+            'ghostunnel_connection_lifetime_seconds_count{{listener="{0}:13001",result='.format(LOCALHOST),
+        ]
+        for _ in range(0, 20):
+            metrics = str(urlopen(
+                "https://{0}:{1}/_metrics/prometheus".format(LOCALHOST, STATUS_PORT)).read(), 'utf-8')
+            missing_histograms = [h for h in expected_histograms if h not in metrics]
+            if not missing_histograms:
+                break
+            time.sleep(0.5)
+        if missing_histograms:
+            raise Exception('missing histograms from ghostunnel instance: %s' % missing_histograms)
+
         print_ok("OK")
     finally:
         terminate(ghostunnel)
@@ -0,0 +1,42 @@
+#!/usr/bin/env python3
+
+"""
+Ensures that ghostunnel can listen on multiple addresses at once.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpServer, TlsClient, print_ok, run_ghostunnel, terminate
+
+if __name__ == "__main__":
+    ghostunnel = None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--listen={0}:13003'.format(LOCALHOST),
+                                     '--target={0}:13002'.format(LOCALHOST),
+                                     '--cert=server.crt',
+                                     '--key=server.key',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # connect to both listeners, confirm that the tunnel is up
+        for port in [13001, 13003]:
+            pair = SocketPair(
+                TlsClient('client', 'root', port), TcpServer(13002))
+            pair.validate_can_send_from_client(
+                "hello world", "{0}: client -> server".format(port))
+            pair.validate_can_send_from_server(
+                "hello world", "{0}: server -> client".format(port))
+            pair.validate_closing_client_closes_server(
+                "{0}: client closed -> server closed".format(port))
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
@@ -0,0 +1,80 @@
+#!/usr/bin/env python3
+
+"""
+Ensures that --otel-endpoint exports a trace for each proxied connection.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TcpClient, TlsClient, TcpServer, print_ok, run_ghostunnel, terminate, SocketPair
+from http.server import BaseHTTPRequestHandler, HTTPServer
+import threading
+import json
+
+COLLECTOR_PORT = 13003
+spans = []
+
+
+class CollectorHandler(BaseHTTPRequestHandler):
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers['Content-Length']))
+        req = json.loads(body.decode('utf-8'))
+        for rs in req['resourceSpans']:
+            for ss in rs['scopeSpans']:
+                spans.extend(ss['spans'])
+        self.send_response(200)
+        self.end_headers()
+
+    def log_message(self, format, *args):
+        pass
+
+
+if __name__ == '__main__':
+    ghostunnel = None
+    collector = HTTPServer((LOCALHOST, COLLECTOR_PORT), CollectorHandler)
+    threading.Thread(target=collector.serve_forever, daemon=True).start()
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel(['server',
+                                     '--listen={0}:13001'.format(LOCALHOST),
+                                     '--target={0}:13002'.format(LOCALHOST),
+                                     '--otel-endpoint=http://{0}:{1}'.format(LOCALHOST, COLLECTOR_PORT),
+                                     '--cert=server.crt',
+                                     '--key=server.key',
+                                     '--cacert=root.crt',
+                                     '--allow-ou=client',
+                                     '--status={0}:{1}'.format(LOCALHOST,
+                                                               STATUS_PORT)])
+
+        # block until ghostunnel is up
+        TcpClient(STATUS_PORT).connect(20)
+
+        # send some data through proxy
+        pair1 = SocketPair(
+                TlsClient('client', 'root', 13001), TcpServer(13002))
+        pair1.validate_can_send_from_client('toto', 'works')
+        pair1.validate_can_send_from_server('toto', 'works')
+        pair1.cleanup()
+
+        # spans are flushed on shutdown
+        terminate(ghostunnel)
+
+        names = sorted(s['name'] for s in spans)
+        if names != ['connection', 'dial-backend', 'handshake', 'stream']:
+            raise Exception('unexpected spans: {0}'.format(spans))
+        print_ok('got spans: {0}'.format(names))
+
+        root_span = [s for s in spans if s['name'] == 'connection'][0]
+        for s in spans:
+            if s['traceId'] != root_span['traceId']:
+                raise Exception('span {0} not part of trace'.format(s['name']))
+            if s is not root_span and s.get('parentSpanId') != root_span['spanId']:
+                raise Exception('span {0} has wrong parent'.format(s['name']))
+
+        print_ok('OK')
+    finally:
+        terminate(ghostunnel)
+        collector.shutdown()
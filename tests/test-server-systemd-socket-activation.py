@@ -0,0 +1,60 @@
+#!/usr/bin/env python3
+
+"""
+Spins up a server and tests systemd socket activation with multiple sockets,
+two of which share the same name.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, SocketPair, TcpClient, TcpServer, TlsClient, print_ok, run_ghostunnel, terminate
+from distutils.spawn import find_executable
+import sys
+
+if __name__ == "__main__":
+    ghostunnel = None
+
+    if not find_executable('systemd-socket-activate'):
+        print_ok('skipping systemd socket activation test, no systemd-socket-activate binary found')
+        sys.exit(0)
+
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # start ghostunnel
+        ghostunnel = run_ghostunnel([
+                'server',
+                '--listen=systemd:server',
+                '--target={0}:13002'.format(LOCALHOST),
+                '--cert=server.crt',
+                '--key=server.key',
+                '--cacert=root.crt',
+                '--allow-ou=client',
+                '--status=systemd:status'],
+                prefix=[
+                'systemd-socket-activate',
+                '--listen={0}:13001'.format(LOCALHOST),
+                '--listen={0}:13003'.format(LOCALHOST),
+                '--listen={0}:{1}'.format(LOCALHOST, STATUS_PORT),
+                '--fdname=server:server:status',
+                '--setenv=GHOSTUNNEL_INTEGRATION_TEST',
+                '--setenv=GHOSTUNNEL_INTEGRATION_ARGS',
+                ])
+
+        # Connect on status port to trigger socket activation
+        # so it will spin up the ghostunnel instance
+        TcpClient(STATUS_PORT).connect(20)
+
+        # Both sockets named 'server' should be proxying connections
+        for port in [13001, 13003]:
+            pair = SocketPair(
+                TlsClient('client', 'root', port), TcpServer(13002))
+            pair.validate_can_send_from_client(
+                "hello world", "{0}: client -> server".format(port))
+            pair.validate_closing_client_closes_server(
+                "{0}: client closed -> server closed".format(port))
+
+        print_ok("OK")
+    finally:
+        terminate(ghostunnel)
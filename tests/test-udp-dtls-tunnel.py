@@ -0,0 +1,78 @@
+#!/usr/bin/env python3
+
+"""
+Runs a client and a server in UDP mode, and checks that datagrams are
+forwarded through the DTLS tunnel in both directions.
+"""
+
+from common import LOCALHOST, RootCert, STATUS_PORT, TIMEOUT, print_ok, run_ghostunnel, terminate
+import socket
+import time
+
+if __name__ == "__main__":
+    client, server = None, None
+    try:
+        # create certs
+        root = RootCert('root')
+        root.create_signed_cert('server')
+        root.create_signed_cert('client')
+
+        # backend
+        backend = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        backend.settimeout(TIMEOUT)
+        backend.bind((LOCALHOST, 13003))
+
+        # start ghostunnel server and client
+        server = run_ghostunnel(['server',
+                                 '--listen=udp:{0}:13002'.format(LOCALHOST),
+                                 '--target=udp:{0}:13003'.format(LOCALHOST),
+                                 '--cert=server.crt',
+                                 '--key=server.key',
+                                 '--cacert=root.crt',
+                                 '--allow-ou=client',
+                                 '--status={0}:{1}'.format(LOCALHOST, STATUS_PORT)])
+        client = run_ghostunnel(['client',
+                                 '--listen=udp:{0}:13001'.format(LOCALHOST),
+                                 '--target=udp:{0}:13002'.format(LOCALHOST),
+                                 '--cert=client.crt',
+                                 '--key=client.key',
+                                 '--cacert=root.crt',
+                                 '--status={0}:{1}'.format(LOCALHOST, STATUS_PORT + 1)])
+
+        app = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        app.settimeout(1)
+
+        # instances may still be starting up, retry first datagram
+        for i in range(0, 10):
+            app.sendto(b'hello 0', (LOCALHOST, 13001))
+            try:
+                data, peer = backend.recvfrom(1024)
+                break
+            except socket.timeout:
+                print_ok("no datagram yet, retrying")
+                time.sleep(1)
+        else:
+            raise Exception('did not receive datagram through tunnel')
+        if data != b'hello 0':
+            raise Exception('unexpected datagram: {0}'.format(data))
+        print_ok("got datagram client -> server")
+
+        # datagram boundaries should be preserved
+        for i in range(1, 5):
+            app.sendto('hello {0}'.format(i).encode(), (LOCALHOST, 13001))
+            data, _ = backend.recvfrom(1024)
+            if data != 'hello {0}'.format(i).encode():
+                raise Exception('unexpected datagram: {0}'.format(data))
+
+        backend.sendto(b'world', peer)
+        data, _ = app.recvfrom(1024)
+        if data != b'world':
+            raise Exception('unexpected datagram: {0}'.format(data))
+        print_ok("got datagram server -> client")
+
+        app.close()
+        backend.close()
+        print_ok("OK")
+    finally:
+        terminate(client)
+        terminate(server)
@@ -0,0 +1,135 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// sessionTicketKeys manages the keys for encrypting TLS session tickets, and
+// rotates them periodically. The newest key is used to encrypt new tickets,
+// older keys are kept for decrypting (resuming) existing tickets until they
+// are rotated out. Keys are either generated in memory, or read from a file
+// (so they can be shared across instances) that is re-read on every rotation.
+type sessionTicketKeys struct {
+	config *tls.Config
+	count  int
+	path   string
+
+	mu   sync.Mutex
+	keys [][32]byte
+}
+
+// newSessionTicketKeys sets up session ticket keys on the given config (which
+// should be the base config that per-connection configs are cloned from).
+func newSessionTicketKeys(config *tls.Config, count int, path string) (*sessionTicketKeys, error) {
+	s := &sessionTicketKeys{
+		config: config,
+		count:  count,
+		path:   path,
+	}
+	if err := s.Rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Rotate adds a new key (or re-reads the key file). If reading the key file
+// fails, the current keys are kept.
+func (s *sessionTicketKeys) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path != "" {
+		keys, err := readSessionTicketKeys(s.path)
+		if err != nil {
+			return fmt.Errorf("unable to read session ticket keys from '%s': %s", s.path, err)
+		}
+		s.keys = keys
+	} else {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		s.keys = append([][32]byte{key}, s.keys...)
+		if len(s.keys) > s.count {
+			s.keys = s.keys[:s.count]
+		}
+	}
+
+	s.config.SetSessionTicketKeys(s.keys)
+	return nil
+}
+
+// Reload re-reads the key file, if keys are read from a file. Generated keys
+// are only changed on rotation.
+func (s *sessionTicketKeys) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	return s.Rotate()
+}
+
+// rotateEvery rotates keys at the given interval, forever.
+func (s *sessionTicketKeys) rotateEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.Rotate(); err != nil {
+			logger.Printf("error rotating session ticket keys: %s", err)
+		}
+	}
+}
+
+// readSessionTicketKeys reads session ticket keys from a file, with one
+// 32-byte key per line in hex or base64 encoding. The first key is used to
+// encrypt new tickets. Empty lines and lines starting with '#' are ignored.
+func readSessionTicketKeys(path string) ([][32]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := [][32]byte{}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		decoded, err := hex.DecodeString(string(line))
+		if err != nil {
+			decoded, err = base64.StdEncoding.DecodeString(string(line))
+		}
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("invalid key on line %d, must be 32 bytes in hex or base64 encoding", i+1)
+		}
+		var key [32]byte
+		copy(key[:], decoded)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys in file")
+	}
+	return keys, nil
+}
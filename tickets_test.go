@@ -0,0 +1,142 @@
+/*-
+ * Copyright 2015 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// resumes connects to a server using the given config (cloned per connection,
+// like certloader does), and returns whether the session was resumed.
+func resumes(t *testing.T, config *tls.Config, cache tls.ClientSessionCache) bool {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server := tls.Server(conn, config.Clone())
+		server.Write([]byte{1})
+		server.Close()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		// Sessions are cached by server name, listener addresses differ
+		ServerName:         "localhost",
+		InsecureSkipVerify: true,
+		ClientSessionCache: cache,
+	})
+	assert.Nil(t, err, "should connect")
+	defer conn.Close()
+	// Read to process session tickets sent after the handshake
+	conn.Read(make([]byte, 1))
+	return conn.ConnectionState().DidResume
+}
+
+// testServerConfig returns a config with a self-signed certificate (clients
+// don't resume sessions with expired certificates, like the test keystore).
+func testServerConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestSessionTicketKeysRotate(t *testing.T) {
+	config := testServerConfig(t)
+	keys, err := newSessionTicketKeys(config, 2, "")
+	assert.Nil(t, err, "should generate keys")
+	assert.Equal(t, 1, len(keys.keys), "should start with one key")
+
+	cache := tls.NewLRUClientSessionCache(0)
+	assert.False(t, resumes(t, config, cache), "first connection should not resume")
+	assert.True(t, resumes(t, config, cache), "should resume across cloned configs")
+
+	// Old keys can still decrypt tickets until they are rotated out
+	cache = tls.NewLRUClientSessionCache(0)
+	resumes(t, config, cache)
+	assert.Nil(t, keys.Rotate(), "should rotate keys")
+	assert.Equal(t, 2, len(keys.keys), "should keep old key")
+	assert.Nil(t, keys.Reload(), "reload should be no-op for generated keys")
+	assert.Equal(t, 2, len(keys.keys), "reload should not rotate generated keys")
+	assert.True(t, resumes(t, config, cache), "should resume with old key")
+
+	cache = tls.NewLRUClientSessionCache(0)
+	resumes(t, config, cache)
+	keys.Rotate()
+	keys.Rotate()
+	assert.Equal(t, 2, len(keys.keys), "should limit number of keys")
+	assert.False(t, resumes(t, config, cache), "should not resume after key was rotated out")
+}
+
+func TestSessionTicketKeysFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "ghostunnel-tickets")
+	assert.Nil(t, err, "should create temp file")
+	defer os.Remove(file.Name())
+
+	first := hex.EncodeToString([]byte(strings.Repeat("a", 32)))
+	second := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32)))
+	file.WriteString("# session ticket keys\n" + first + "\n\n" + second + "\n")
+	file.Close()
+
+	config := testServerConfig(t)
+	keys, err := newSessionTicketKeys(config, 3, file.Name())
+	assert.Nil(t, err, "should read keys from file")
+	assert.Equal(t, 2, len(keys.keys), "should read all keys")
+	assert.Equal(t, byte('a'), keys.keys[0][0], "should use first key for new tickets")
+
+	// Instances sharing the key file can resume each others sessions
+	other := testServerConfig(t)
+	_, err = newSessionTicketKeys(other, 3, file.Name())
+	assert.Nil(t, err, "should read keys from file")
+	cache := tls.NewLRUClientSessionCache(0)
+	resumes(t, config, cache)
+	assert.True(t, resumes(t, other, cache), "should resume on other instance")
+
+	// Invalid file keeps old keys
+	ioutil.WriteFile(file.Name(), []byte("invalid\n"), 0600)
+	assert.NotNil(t, keys.Reload(), "should fail to reload invalid keys")
+	assert.Equal(t, 2, len(keys.keys), "should keep old keys")
+
+	for _, contents := range []string{"", "# only comments\n", hex.EncodeToString([]byte("short")) + "\n"} {
+		ioutil.WriteFile(file.Name(), []byte(contents), 0600)
+		_, err = readSessionTicketKeys(file.Name())
+		assert.NotNil(t, err, "should reject key file: %q", contents)
+	}
+	_, err = readSessionTicketKeys("/does-not-exist")
+	assert.NotNil(t, err, "should fail for missing file")
+}
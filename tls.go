@@ -18,7 +18,10 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 
 	"github.com/square/ghostunnel/certloader"
@@ -49,6 +52,82 @@ var cipherSuites = map[string][]uint16{
 	},
 }
 
+// Individual cipher suites that can be selected by name (TLS 1.2 only, TLS 1.3
+// cipher suites are not configurable).
+var cipherSuiteNames = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// Curves that can be selected for ECDH key exchange.
+var curveNames = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// FIPS 140-approved cipher suites and curves, see --fips.
+var (
+	fipsCipherSuites = map[uint16]bool{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: true,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   true,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: true,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   true,
+	}
+	fipsCurves = map[tls.CurveID]bool{
+		tls.CurveP256: true,
+		tls.CurveP384: true,
+		tls.CurveP521: true,
+	}
+)
+
+// parseCipherSuites parses a comma-separated list of cipher suite groups
+// (e.g. AES) or individual cipher suite names.
+func parseCipherSuites(enabledCipherSuites string) ([]uint16, error) {
+	suites := []uint16{}
+	for _, suite := range strings.Split(enabledCipherSuites, ",") {
+		name := strings.TrimSpace(suite)
+		ciphers, ok := cipherSuites[name]
+		if !ok && *allowUnsafeCipherSuites {
+			ciphers, ok = unsafeCipherSuites[name]
+		}
+		if !ok {
+			var id uint16
+			id, ok = cipherSuiteNames[name]
+			ciphers = []uint16{id}
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid cipher suite '%s' selected", name)
+		}
+
+		suites = append(suites, ciphers...)
+	}
+	return suites, nil
+}
+
+// parseCurves parses a comma-separated list of curve names (e.g. X25519,P256).
+// An empty list selects the default curves.
+func parseCurves(enabledCurves string) ([]tls.CurveID, error) {
+	if enabledCurves == "" {
+		return nil, nil
+	}
+	curves := []tls.CurveID{}
+	for _, curve := range strings.Split(enabledCurves, ",") {
+		name := strings.TrimSpace(curve)
+		id, ok := curveNames[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid curve '%s' selected", name)
+		}
+		curves = append(curves, id)
+	}
+	return curves, nil
+}
+
 // Build reloadable certificate
 func buildCertificate(keystorePath, certPath, keyPath, keystorePass, caBundlePath string) (certloader.Certificate, error) {
 	if hasPKCS11() {
@@ -58,26 +137,94 @@ func buildCertificate(keystorePath, certPath, keyPath, keystorePass, caBundlePat
 			return buildCertificateFromPKCS11(certPath, caBundlePath)
 		}
 	}
+	if *keystoreTPM != "" {
+		handle, err := certloader.ParseTPMHandle(*keystoreTPM)
+		if err != nil {
+			return nil, err
+		}
+		return certloader.CertificateFromTPM(certPath, caBundlePath, *tpmDevice, handle, *tpmKeyPassword, logger)
+	}
+	if *keystoreKMS != "" {
+		return buildCertificateFromKMS(certPath, caBundlePath)
+	}
+	if *vaultPath != "" {
+		return buildCertificateFromVault(caBundlePath)
+	}
 	if hasKeychainIdentity() {
 		return certloader.CertificateFromKeychainIdentity(*keychainIdentity, caBundlePath)
 	}
 	if keyPath != "" && certPath != "" {
-		return certloader.CertificateFromPEMFiles(certPath, keyPath, caBundlePath)
+		return certloader.CertificateFromPEMFilesWithPassword(certPath, keyPath, keystorePass, caBundlePath)
 	}
 	if keystorePath != "" {
-		return certloader.CertificateFromKeystore(keystorePath, keystorePass, caBundlePath)
+		return buildKeystore(keystorePath, keystorePass, caBundlePath)
 	}
 	return certloader.NoCertificate(caBundlePath)
 }
 
+// buildKeystore loads a keystore file, or an identity from the OS certificate
+// store if the path is of the form keychain:... or certstore:...
+func buildKeystore(keystorePath, keystorePass, caBundlePath string) (certloader.Certificate, error) {
+	if certloader.IsIdentityKeystore(keystorePath) {
+		selector, err := certloader.ParseIdentitySelector(keystorePath)
+		if err != nil {
+			return nil, err
+		}
+		return certloader.CertificateFromIdentity(selector, caBundlePath)
+	}
+	return certloader.CertificateFromKeystore(keystorePath, keystorePass, caBundlePath)
+}
+
 func buildCertificateFromPKCS11(certificatePath, caBundlePath string) (certloader.Certificate, error) {
-	return certloader.CertificateFromPKCS11Module(certificatePath, caBundlePath, *pkcs11Module, *pkcs11TokenLabel, *pkcs11PIN)
+	return certloader.CertificateFromPKCS11Module(certificatePath, caBundlePath, *pkcs11Module, *pkcs11TokenLabel, *pkcs11KeyLabel, *pkcs11PIN, logger)
+}
+
+func buildCertificateFromKMS(certificatePath, caBundlePath string) (certloader.Certificate, error) {
+	client := &http.Client{
+		Timeout: *timeoutDuration,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		},
+	}
+	return certloader.CertificateFromKMS(certificatePath, caBundlePath, certloader.KMSConfig{
+		Key:    *keystoreKMS,
+		Client: client,
+	}, logger)
+}
+
+func buildCertificateFromVault(caBundlePath string) (certloader.Certificate, error) {
+	vaultRoots, err := certloader.LoadTrustStore(*vaultCACert)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Timeout: *timeoutDuration,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: vaultRoots},
+		},
+	}
+	return certloader.CertificateFromVault(certloader.VaultConfig{
+		Addr:       *vaultAddr,
+		Path:       *vaultPath,
+		CommonName: *vaultCommonName,
+		AltNames:   *vaultAltNames,
+		TTL:        *vaultTTL,
+		Token:      *vaultToken,
+		RoleID:     *vaultRoleID,
+		SecretID:   *vaultSecretID,
+		Client:     client,
+	}, caBundlePath, logger)
 }
 
 func hasPKCS11() bool {
 	return pkcs11Module != nil && *pkcs11Module != ""
 }
 
+func hasPKCS11KeyLabel() bool {
+	return hasPKCS11() && pkcs11KeyLabel != nil && *pkcs11KeyLabel != ""
+}
+
 func hasKeychainIdentity() bool {
 	return keychainIdentity != nil && *keychainIdentity != ""
 }
@@ -88,32 +235,56 @@ func buildConfig(enabledCipherSuites string) (*tls.Config, error) {
 	// * We list ECDSA ahead of RSA to prefer ECDSA for multi-cert setups.
 	// * We list AES-128 ahead of AES-256 for performance reasons.
 
-	suites := []uint16{}
-	for _, suite := range strings.Split(enabledCipherSuites, ",") {
-		name := strings.TrimSpace(suite)
-		ciphers, ok := cipherSuites[name]
-		if !ok && *allowUnsafeCipherSuites {
-			ciphers, ok = unsafeCipherSuites[name]
+	suites, err := parseCipherSuites(enabledCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	curves, err := parseCurves(*enabledCurves)
+	if err != nil {
+		return nil, err
+	}
+	if *postQuantum {
+		pqCurves := append([]tls.CurveID{}, postQuantumCurves...)
+		if len(curves) == 0 {
+			curves = []tls.CurveID{tls.X25519, tls.CurveP256}
 		}
-		if !ok {
-			return nil, fmt.Errorf("invalid cipher suite '%s' selected", name)
+		for _, curve := range curves {
+			if !containsCurve(postQuantumCurves, curve) {
+				pqCurves = append(pqCurves, curve)
+			}
+		}
+		curves = pqCurves
+	}
+	if *fipsMode {
+		suites, curves, err = fipsOnly(suites, curves)
+		if err != nil {
+			return nil, err
 		}
-
-		suites = append(suites, ciphers...)
 	}
 
 	return &tls.Config{
 		PreferServerCipherSuites: true,
 		MinVersion:               tls.VersionTLS12,
 		CipherSuites:             suites,
+		CurvePreferences:         curves,
+		KeyLogWriter:             keyLog,
 	}, nil
 }
 
 // buildClientConfig builds a tls.Config for clients
 func buildClientConfig(enabledCipherSuites string) (*tls.Config, error) {
-	// At the moment, we don't apply any extra settings on top of the generic
-	// config for client contexts
-	return buildConfig(enabledCipherSuites)
+	config, err := buildConfig(enabledCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache sessions to resume them with session tickets. The cache is
+	// shared by all configs cloned from this one.
+	if *sessionTickets {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	return config, nil
 }
 
 // buildServerConfig builds a tls.Config for servers
@@ -127,10 +298,81 @@ func buildServerConfig(enabledCipherSuites string) (*tls.Config, error) {
 	config.ClientAuth = tls.RequireAndVerifyClientCert
 
 	// P-256/X25519 have an ASM implementation, others do not (at least on x86-64).
-	config.CurvePreferences = []tls.CurveID{
-		tls.X25519,
-		tls.CurveP256,
+	if len(config.CurvePreferences) == 0 {
+		config.CurvePreferences = []tls.CurveID{
+			tls.X25519,
+			tls.CurveP256,
+		}
 	}
 
 	return config, nil
 }
+
+func containsCurve(curves []tls.CurveID, curve tls.CurveID) bool {
+	for _, c := range curves {
+		if c == curve {
+			return true
+		}
+	}
+	return false
+}
+
+// fipsOnly removes cipher suites and curves that are not FIPS-approved. If
+// no curves are given, the approved curves are returned.
+func fipsOnly(suites []uint16, curves []tls.CurveID) ([]uint16, []tls.CurveID, error) {
+	approvedSuites := []uint16{}
+	for _, suite := range suites {
+		if fipsCipherSuites[suite] {
+			approvedSuites = append(approvedSuites, suite)
+		}
+	}
+	if len(approvedSuites) == 0 {
+		return nil, nil, errors.New("no FIPS-approved cipher suites selected")
+	}
+
+	if len(curves) == 0 {
+		return approvedSuites, []tls.CurveID{tls.CurveP256, tls.CurveP384}, nil
+	}
+	approvedCurves := []tls.CurveID{}
+	for _, curve := range curves {
+		if fipsCurves[curve] {
+			approvedCurves = append(approvedCurves, curve)
+		}
+	}
+	if len(approvedCurves) == 0 {
+		return nil, nil, errors.New("no FIPS-approved curves selected")
+	}
+	return approvedSuites, approvedCurves, nil
+}
+
+type verifyPeerCertificateFunc func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+// chainVerifyPeerCertificate returns a VerifyPeerCertificate callback that
+// runs the given callbacks in order, failing on the first error.
+func chainVerifyPeerCertificate(funcs ...verifyPeerCertificateFunc) verifyPeerCertificateFunc {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, f := range funcs {
+			if f == nil {
+				continue
+			}
+			if err := f(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// anyVerifyPeerCertificate returns a VerifyPeerCertificate callback that
+// succeeds if at least one of the given callbacks succeeds.
+func anyVerifyPeerCertificate(funcs ...verifyPeerCertificateFunc) verifyPeerCertificateFunc {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		var err error
+		for _, f := range funcs {
+			if err = f(rawCerts, verifiedChains); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+}
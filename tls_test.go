@@ -18,7 +18,9 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"io/ioutil"
 	"os"
 	"runtime"
@@ -266,6 +268,44 @@ func TestCipherSuitePreference(t *testing.T) {
 	*allowUnsafeCipherSuites = false
 }
 
+func TestCipherSuiteNames(t *testing.T) {
+	conf, err := buildConfig("TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	assert.Nil(t, err, "should be able to build TLS config with cipher suite names")
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, conf.CipherSuites, "should use exactly the given cipher suites")
+
+	conf, err = buildConfig("CHACHA,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	assert.Nil(t, err, "should be able to mix cipher suite groups and names")
+	assert.Equal(t, 3, len(conf.CipherSuites), "should include group and named cipher suite")
+
+	_, err = buildConfig("TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256")
+	assert.NotNil(t, err, "should not be able to select unsafe cipher suite by name")
+}
+
+func TestCurvePreferences(t *testing.T) {
+	conf, err := buildServerConfig("AES")
+	assert.Nil(t, err, "should be able to build TLS config")
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, conf.CurvePreferences, "server should default to X25519,P256")
+
+	conf, err = buildClientConfig("AES")
+	assert.Nil(t, err, "should be able to build TLS config")
+	assert.Nil(t, conf.CurvePreferences, "client should use default curves")
+
+	*enabledCurves = "P384, X25519"
+	defer func() { *enabledCurves = "" }()
+	conf, err = buildServerConfig("AES")
+	assert.Nil(t, err, "should be able to build TLS config")
+	assert.Equal(t, []tls.CurveID{tls.CurveP384, tls.X25519}, conf.CurvePreferences, "should use given curves")
+	conf, err = buildClientConfig("AES")
+	assert.Nil(t, err, "should be able to build TLS config")
+	assert.Equal(t, []tls.CurveID{tls.CurveP384, tls.X25519}, conf.CurvePreferences, "should use given curves")
+
+	*enabledCurves = "P224"
+	_, err = buildServerConfig("AES")
+	assert.NotNil(t, err, "should reject unsupported curve")
+	_, err = parseCurves("X25519,")
+	assert.NotNil(t, err, "should reject empty curve name")
+}
+
 func TestReload(t *testing.T) {
 	tmpKeystore, err := ioutil.TempFile("", "ghostunnel-test")
 	panicOnError(err)
@@ -308,3 +348,76 @@ func TestBuildConfigSystemRoots(t *testing.T) {
 
 	c.Reload()
 }
+
+func TestChainVerifyPeerCertificate(t *testing.T) {
+	calls := []string{}
+	ok := func(name string) verifyPeerCertificateFunc {
+		return func([][]byte, [][]*x509.Certificate) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+	fail := func([][]byte, [][]*x509.Certificate) error {
+		calls = append(calls, "fail")
+		return errors.New("failure")
+	}
+
+	err := chainVerifyPeerCertificate(ok("a"), nil, ok("b"))(nil, nil)
+	assert.Nil(t, err, "should succeed if all callbacks succeed")
+	assert.Equal(t, []string{"a", "b"}, calls, "should call callbacks in order")
+
+	calls = nil
+	err = chainVerifyPeerCertificate(ok("a"), fail, ok("b"))(nil, nil)
+	assert.NotNil(t, err, "should fail if a callback fails")
+	assert.Equal(t, []string{"a", "fail"}, calls, "should stop at first failure")
+}
+
+func TestAnyVerifyPeerCertificate(t *testing.T) {
+	ok := func([][]byte, [][]*x509.Certificate) error { return nil }
+	fail := func([][]byte, [][]*x509.Certificate) error { return errors.New("failure") }
+
+	assert.Nil(t, anyVerifyPeerCertificate(fail, ok)(nil, nil), "should succeed if any callback succeeds")
+	assert.NotNil(t, anyVerifyPeerCertificate(fail, fail)(nil, nil), "should fail if all callbacks fail")
+}
+
+func TestFIPSOnly(t *testing.T) {
+	*fipsMode = true
+	defer func() { *fipsMode = false }()
+
+	conf, err := buildServerConfig("AES,CHACHA")
+	assert.Nil(t, err, "should be able to build TLS config")
+	for _, suite := range conf.CipherSuites {
+		assert.True(t, fipsCipherSuites[suite], "should only enable FIPS-approved cipher suites")
+	}
+	assert.Equal(t, []tls.CurveID{tls.CurveP256, tls.CurveP384}, conf.CurvePreferences, "should only enable FIPS-approved curves")
+
+	*enabledCurves = "X25519,P384"
+	defer func() { *enabledCurves = "" }()
+	conf, err = buildClientConfig("AES")
+	assert.Nil(t, err, "should be able to build TLS config")
+	assert.Equal(t, []tls.CurveID{tls.CurveP384}, conf.CurvePreferences, "should remove non-approved curves")
+
+	_, err = buildConfig("CHACHA")
+	assert.NotNil(t, err, "should fail without FIPS-approved cipher suites")
+	*enabledCurves = "X25519"
+	_, err = buildConfig("AES")
+	assert.NotNil(t, err, "should fail without FIPS-approved curves")
+}
+
+func TestPostQuantum(t *testing.T) {
+	if len(postQuantumCurves) == 0 {
+		t.Skip("post-quantum key exchange requires Go 1.24+")
+	}
+	*postQuantum = true
+	defer func() { *postQuantum = false }()
+
+	conf, err := buildServerConfig("AES")
+	assert.Nil(t, err, "should be able to build TLS config")
+	assert.Equal(t, append(postQuantumCurves, tls.X25519, tls.CurveP256), conf.CurvePreferences, "should prefer post-quantum key exchange")
+
+	*enabledCurves = "P384,X25519MLKEM768"
+	defer func() { *enabledCurves = "" }()
+	conf, err = buildClientConfig("AES")
+	assert.Nil(t, err, "should be able to build TLS config")
+	assert.Equal(t, append(postQuantumCurves, tls.CurveP384), conf.CurvePreferences, "should not repeat post-quantum key exchange")
+}
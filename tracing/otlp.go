@@ -0,0 +1,233 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximum number of spans sent in a single export request.
+	exportBatchSize = 512
+	// Maximum time spans are buffered before being exported.
+	exportInterval = 5 * time.Second
+	// Maximum number of spans waiting for export, new spans are dropped
+	// if the queue is full (e.g. if the collector is unavailable).
+	exportQueueSize = 4096
+	// OTLP status code for errors
+	statusCodeError = 2
+)
+
+// Tracer creates spans and exports them to an OTLP collector in batches.
+type Tracer struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	logger      Logger
+
+	spans chan *Span
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+// NewTracer creates a tracer that exports spans to the OTLP/HTTP collector at
+// the given endpoint (e.g. http://localhost:4318). Call Close to flush
+// buffered spans before exiting.
+func NewTracer(endpoint, serviceName string, client *http.Client, logger Logger) *Tracer {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	t := &Tracer{
+		url:         strings.TrimRight(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      client,
+		logger:      logger,
+		spans:       make(chan *Span, exportQueueSize),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Close flushes buffered spans and stops the exporter.
+func (t *Tracer) Close() error {
+	close(t.quit)
+	<-t.done
+	return nil
+}
+
+func (t *Tracer) export(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+		// Queue is full, drop span
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				t.flush(batch)
+				batch = []*Span{}
+			}
+		case <-ticker.C:
+			t.flush(batch)
+			batch = []*Span{}
+		case <-t.quit:
+			for {
+				select {
+				case span := <-t.spans:
+					batch = append(batch, span)
+				default:
+					t.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *Tracer) flush(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(t.encode(batch))
+	if err != nil {
+		t.logger.Printf("error encoding spans: %s", err)
+		return
+	}
+
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.logger.Printf("error exporting spans: %s", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		t.logger.Printf("error exporting spans: collector returned status %d", resp.StatusCode)
+	}
+}
+
+// OTLP/HTTP JSON encoding, see opentelemetry-proto (trace/v1/trace.proto).
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func (t *Tracer) encode(batch []*Span) map[string]interface{} {
+	spans := []otlpSpan{}
+	for _, span := range batch {
+		spans = append(spans, span.encode())
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{encodeAttribute("service.name", t.serviceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "ghostunnel"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func (s *Span) encode() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for key, value := range s.attributes {
+		out.Attributes = append(out.Attributes, encodeAttribute(key, value))
+	}
+	if s.err != "" {
+		out.Status = otlpStatus{Code: statusCodeError, Message: s.err}
+	}
+	return out
+}
+
+func encodeAttribute(key string, value interface{}) otlpKeyValue {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(int64(value), 10)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case uint64:
+		v = map[string]interface{}{"intValue": strconv.FormatUint(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
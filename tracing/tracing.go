@@ -0,0 +1,110 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tracing implements a minimal OpenTelemetry tracer, exporting spans
+// to an OTLP collector via HTTP (using the JSON encoding). Spans and tracers
+// are nil-safe, so callers don't need to check whether tracing is enabled.
+package tracing
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// Span kinds, as defined by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Logger is used by this package to log messages
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Span represents a single operation in a trace.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	err        string
+}
+
+// Start creates a new span. If parent is nil, the span starts a new trace.
+// Returns nil if the tracer is nil.
+func (t *Tracer) Start(name string, kind int, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(span.traceID[:])
+	}
+	_, _ = rand.Read(span.spanID[:])
+	return span
+}
+
+// SetAttribute sets an attribute on the span. Values should be strings,
+// integers or booleans.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed with the given error.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.export(s)
+}
@@ -0,0 +1,117 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCollector struct {
+	mu       sync.Mutex
+	requests []map[string]interface{}
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	var req map[string]interface{}
+	if r.URL.Path != "/v1/traces" || json.Unmarshal(body, &req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+}
+
+func (c *testCollector) spans() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := []map[string]interface{}{}
+	for _, req := range c.requests {
+		for _, rs := range req["resourceSpans"].([]interface{}) {
+			for _, ss := range rs.(map[string]interface{})["scopeSpans"].([]interface{}) {
+				for _, span := range ss.(map[string]interface{})["spans"].([]interface{}) {
+					out = append(out, span.(map[string]interface{}))
+				}
+			}
+		}
+	}
+	return out
+}
+
+func TestTracerExport(t *testing.T) {
+	collector := &testCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	tracer := NewTracer(server.URL, "test", nil, log.New(ioutil.Discard, "", 0))
+
+	root := tracer.Start("connection", KindServer, nil)
+	root.SetAttribute("peer", "client")
+	child := tracer.Start("dial-backend", KindClient, root)
+	child.SetAttribute("bytes", int64(42))
+	child.SetError(errors.New("connection refused"))
+	child.End()
+	root.End()
+
+	assert.Nil(t, tracer.Close(), "close should flush spans")
+
+	spans := collector.spans()
+	if !assert.Len(t, spans, 2, "collector should receive both spans") {
+		return
+	}
+
+	dial, conn := spans[0], spans[1]
+	assert.Equal(t, "dial-backend", dial["name"])
+	assert.Equal(t, "connection", conn["name"])
+	assert.Len(t, conn["traceId"], 32, "trace id should be hex-encoded 16 bytes")
+	assert.Len(t, conn["spanId"], 16, "span id should be hex-encoded 8 bytes")
+	assert.Equal(t, conn["traceId"], dial["traceId"], "child should share trace id with parent")
+	assert.Equal(t, conn["spanId"], dial["parentSpanId"], "child should reference parent span")
+	assert.Nil(t, conn["parentSpanId"], "root span should not have a parent")
+	assert.Equal(t, float64(KindServer), conn["kind"])
+
+	assert.Equal(t, map[string]interface{}{"code": float64(statusCodeError), "message": "connection refused"}, dial["status"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "bytes", "value": map[string]interface{}{"intValue": "42"}},
+	}, dial["attributes"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "peer", "value": map[string]interface{}{"stringValue": "client"}},
+	}, conn["attributes"])
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start("connection", KindServer, nil)
+	assert.Nil(t, span, "nil tracer should create nil spans")
+
+	// Should not panic
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("error"))
+	span.End()
+}
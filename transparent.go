@@ -0,0 +1,116 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/square/ghostunnel/certloader"
+	"github.com/square/ghostunnel/socket"
+)
+
+// With --target original-dst, connections are forwarded to the address they
+// were originally sent to before being redirected to us by iptables.
+const originalDstTarget = "original-dst"
+
+func validateOriginalDst() error {
+	if *clientForwardAddress != originalDstTarget {
+		if *clientTransparent {
+			return errors.New("--transparent requires --target original-dst")
+		}
+		if len(*clientPortMap) > 0 {
+			return errors.New("--original-dst-port-map requires --target original-dst")
+		}
+		return nil
+	}
+	if !socket.SupportsTransparentProxy {
+		return errors.New("--target original-dst is only supported on linux")
+	}
+	if *clientConnectProxy != nil || *clientSocks5Proxy != "" {
+		return errors.New("proxy flags can't be used with --target original-dst")
+	}
+	if network, _, _, _ := socket.ParseAddress(*clientListenAddress); network != "tcp" && network != "systemd" && network != "launchd" {
+		return errors.New("--target original-dst requires --listen to be a TCP socket")
+	}
+	if _, err := parsePortMap(*clientPortMap); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parsePortMap parses --original-dst-port-map entries (ORIGINAL=MAPPED).
+func parsePortMap(entries []string) (map[int]int, error) {
+	portMap := map[int]int{}
+	for _, entry := range entries {
+		parts := strings.Split(entry, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --original-dst-port-map '%s', must be PORT=PORT", entry)
+		}
+		from, err := parsePort(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --original-dst-port-map '%s': %s", entry, err)
+		}
+		to, err := parsePort(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --original-dst-port-map '%s': %s", entry, err)
+		}
+		if _, ok := portMap[from]; ok {
+			return nil, fmt.Errorf("duplicate --original-dst-port-map for port %d", from)
+		}
+		portMap[from] = to
+	}
+	return portMap, nil
+}
+
+func parsePort(port string) (int, error) {
+	value, err := strconv.Atoi(port)
+	if err != nil || value < 1 || value > 65535 {
+		return 0, fmt.Errorf("invalid port '%s'", port)
+	}
+	return value, nil
+}
+
+// originalDstDialer returns a dialer that connects to the original
+// destination of each connection, with TLS. If the original port has an entry
+// in portMap, the mapped port is used instead (e.g. to reach a service's mTLS
+// port for connections sent to its plaintext port). Connections that were
+// sent to our listening port directly (or with a rule that matches our own
+// outgoing connections) are refused, since forwarding them would loop.
+func originalDstDialer(dialer certloader.Dialer, listenAddr net.Addr, transparent bool, portMap map[int]int) func(net.Conn) (net.Conn, error) {
+	listenPort := 0
+	if addr, ok := listenAddr.(*net.TCPAddr); ok {
+		listenPort = addr.Port
+	}
+
+	return func(conn net.Conn) (net.Conn, error) {
+		dst, err := socket.OriginalDestination(conn, transparent)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get original destination: %s", err)
+		}
+		if dst.Port == listenPort {
+			return nil, fmt.Errorf("refusing to forward connection to %s, would loop back to our listening port", dst)
+		}
+		if port, ok := portMap[dst.Port]; ok {
+			dst = &net.TCPAddr{IP: dst.IP, Port: port, Zone: dst.Zone}
+		}
+		return dialer.Dial("tcp", dst.String())
+	}
+}
@@ -0,0 +1,124 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/square/ghostunnel/socket"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingDialer struct {
+	dialed []string
+}
+
+func (d *recordingDialer) Dial(network, address string) (net.Conn, error) {
+	d.dialed = append(d.dialed, address)
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func TestValidateOriginalDst(t *testing.T) {
+	defer func() {
+		*clientForwardAddress = ""
+		*clientListenAddress = ""
+		*clientTransparent = false
+		*clientSocks5Proxy = ""
+		*clientPortMap = nil
+	}()
+
+	*clientForwardAddress = "localhost:8443"
+	*clientTransparent = false
+	*clientSocks5Proxy = ""
+	assert.Nil(t, validateOriginalDst(), "should accept regular target")
+
+	*clientTransparent = true
+	assert.NotNil(t, validateOriginalDst(), "should reject --transparent without --target original-dst")
+	*clientTransparent = false
+	*clientPortMap = []string{"80=8443"}
+	assert.NotNil(t, validateOriginalDst(), "should reject --original-dst-port-map without --target original-dst")
+
+	*clientForwardAddress = originalDstTarget
+	*clientListenAddress = "0.0.0.0:15001"
+	if !socket.SupportsTransparentProxy {
+		assert.NotNil(t, validateOriginalDst(), "should reject original-dst on unsupported platform")
+		return
+	}
+	assert.Nil(t, validateOriginalDst(), "should accept original-dst with TCP listener")
+
+	*clientPortMap = []string{"80"}
+	assert.NotNil(t, validateOriginalDst(), "should reject invalid port map")
+	*clientPortMap = nil
+
+	*clientSocks5Proxy = "localhost:1080"
+	assert.NotNil(t, validateOriginalDst(), "should reject original-dst with proxy")
+	*clientSocks5Proxy = ""
+
+	*clientListenAddress = "unix:/tmp/ghostunnel.sock"
+	assert.NotNil(t, validateOriginalDst(), "should reject original-dst with UNIX socket listener")
+}
+
+func TestOriginalDstDialer(t *testing.T) {
+	if !socket.SupportsTransparentProxy {
+		t.Skip("transparent proxying not supported on this platform")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen on tcp port")
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			defer conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connection")
+	defer conn.Close()
+
+	// In transparent mode, the original destination is the local address
+	dialer := &recordingDialer{}
+	backend, err := originalDstDialer(dialer, &net.TCPAddr{Port: 15001}, true, nil)(conn)
+	assert.Nil(t, err, "should dial original destination")
+	backend.Close()
+	assert.Equal(t, []string{listener.Addr().String()}, dialer.dialed, "should dial original destination")
+
+	_, err = originalDstDialer(dialer, listener.Addr(), true, nil)(conn)
+	assert.NotNil(t, err, "should refuse to dial our own listening port")
+	assert.Len(t, dialer.dialed, 1, "should not dial our own listening port")
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	backend, err = originalDstDialer(dialer, &net.TCPAddr{Port: 15001}, true, map[int]int{port: 8443})(conn)
+	assert.Nil(t, err, "should dial mapped port")
+	backend.Close()
+	assert.Equal(t, "127.0.0.1:8443", dialer.dialed[1], "should dial mapped port on original destination")
+}
+
+func TestParsePortMap(t *testing.T) {
+	portMap, err := parsePortMap([]string{"80=8443", "5432=15432"})
+	assert.Nil(t, err, "should parse port map")
+	assert.Equal(t, map[int]int{80: 8443, 5432: 15432}, portMap)
+
+	for _, invalid := range [][]string{{"80"}, {"80=8443=1"}, {"http=8443"}, {"80=0"}, {"80=70000"}, {"80=8443", "80=9443"}} {
+		_, err := parsePortMap(invalid)
+		assert.NotNil(t, err, "should reject invalid port map %v", invalid)
+	}
+}
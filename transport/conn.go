@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package transport implements tunnels between ghostunnel in client and
+// server mode that are carried over HTTP, for networks where raw TLS
+// connections get blocked or reset by HTTP-aware middleboxes, or as streams
+// of QUIC connections.
+package transport
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamConn is a tunnel carried over a stream of an HTTP connection. Streams
+// over TLS expose the connection state of the underlying connection, like
+// a *tls.Conn. Deadlines can't be set on streams and are ignored.
+type streamConn struct {
+	io.Reader
+	io.Writer
+	// Underlying connection, for addresses and connection state
+	conn net.Conn
+
+	close     func() error
+	closeOnce sync.Once
+	closeErr  error
+	closed    int32
+}
+
+// Read reads from the stream. Errors after Close are reported like errors on
+// a closed network connection.
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.Reader.Read(b)
+	if err != nil && err != io.EOF && atomic.LoadInt32(&c.closed) == 1 {
+		err = &net.OpError{Op: "read", Net: c.conn.LocalAddr().Network(), Err: net.ErrClosed}
+	}
+	return n, err
+}
+
+// Write writes to the stream. Errors after Close are reported like errors
+// on a closed network connection.
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.Writer.Write(b)
+	if err != nil && atomic.LoadInt32(&c.closed) == 1 {
+		err = &net.OpError{Op: "write", Net: c.conn.LocalAddr().Network(), Err: net.ErrClosed}
+	}
+	return n, err
+}
+
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		c.closeErr = c.close()
+	})
+	return c.closeErr
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Handshake is a no-op, the underlying connection is established before
+// streams are opened.
+func (c *streamConn) Handshake() error {
+	return nil
+}
+
+// ConnectionState returns the TLS connection state of the underlying
+// connection (empty if it isn't TLS).
+func (c *streamConn) ConnectionState() tls.ConnectionState {
+	if conn, ok := c.conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
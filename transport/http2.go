@@ -0,0 +1,159 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP2Protocol is the ALPN protocol name for HTTP/2 tunnels.
+const HTTP2Protocol = "h2"
+
+var errHTTP2NotNegotiated = errors.New("server doesn't support HTTP/2 tunnels (needs --transport h2 in server mode)")
+
+// HTTP2Dialer opens tunnels as HTTP/2 CONNECT streams (RFC 7540, section
+// 8.3). Streams share one connection, a new one is established once it can't
+// take new streams (e.g. after the server sent GOAWAY).
+type HTTP2Dialer struct {
+	authority string
+	dial      func() (net.Conn, error)
+	transport *http2.Transport
+
+	mu   sync.Mutex
+	conn *http2.ClientConn
+	tls  net.Conn
+}
+
+// NewHTTP2Dialer creates a dialer for tunnels to the given authority
+// (HOST:PORT, sent as :authority of CONNECT requests), over connections from
+// the given dial function, which must have negotiated HTTP2Protocol with ALPN.
+func NewHTTP2Dialer(authority string, dial func() (net.Conn, error)) *HTTP2Dialer {
+	return &HTTP2Dialer{
+		authority: authority,
+		dial:      dial,
+		transport: &http2.Transport{},
+	}
+}
+
+func (d *HTTP2Dialer) clientConn() (*http2.ClientConn, net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil && d.conn.CanTakeNewRequest() {
+		return d.conn, d.tls, nil
+	}
+
+	conn, err := d.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); !ok || tlsConn.ConnectionState().NegotiatedProtocol != HTTP2Protocol {
+		conn.Close()
+		return nil, nil, errHTTP2NotNegotiated
+	}
+	cc, err := d.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	d.conn, d.tls = cc, conn
+	return cc, conn, nil
+}
+
+// Dial opens a new tunnel.
+func (d *HTTP2Dialer) Dial() (net.Conn, error) {
+	cc, conn, err := d.clientConn()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: d.authority},
+		Host:   d.authority,
+		Header: http.Header{},
+		Body:   reader,
+	}
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		writer.Close()
+		return nil, fmt.Errorf("tunnel rejected by server: %s", resp.Status)
+	}
+	return &streamConn{
+		Reader: resp.Body,
+		Writer: writer,
+		conn:   conn,
+		close: func() error {
+			writer.Close()
+			return resp.Body.Close()
+		},
+	}, nil
+}
+
+// HTTP2Handler returns a handler for HTTP/2 connections over conn, which
+// accepts CONNECT requests and calls serve with each tunnel. The tunnel is
+// closed when serve returns.
+func HTTP2Handler(conn net.Conn, serve func(tunnel net.Conn)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		tunnel := &streamConn{
+			Reader: r.Body,
+			Writer: &flushWriter{writer: w, flusher: flusher},
+			conn:   conn,
+			close:  r.Body.Close,
+		}
+		defer tunnel.Close()
+		serve(tunnel)
+	})
+}
+
+// flushWriter flushes after each write, so data isn't held back in buffers.
+type flushWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	n, err := w.writer.Write(b)
+	w.flusher.Flush()
+	return n, err
+}
@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+// newTestCertificate creates a self-signed certificate.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTestTLSListener listens on a random port, with a self-signed certificate.
+func newTestTLSListener(t *testing.T, protocols ...string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	return tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t)},
+		NextProtos:   protocols,
+	})
+}
+
+func tlsDialer(addr string, protocols ...string) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: protocols})
+	}
+}
+
+func TestHTTP2Tunnel(t *testing.T) {
+	listener := newTestTLSListener(t, HTTP2Protocol)
+	defer listener.Close()
+
+	accepted := 0
+	go func() {
+		server := &http2.Server{}
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted++
+			conn.(*tls.Conn).Handshake()
+			go server.ServeConn(conn, &http2.ServeConnOpts{
+				Handler: HTTP2Handler(conn, func(tunnel net.Conn) {
+					assert.Equal(t, conn.RemoteAddr(), tunnel.RemoteAddr(), "tunnel should have address of connection")
+					io.Copy(tunnel, tunnel)
+				}),
+			})
+		}
+	}()
+
+	dialer := NewHTTP2Dialer("backend:8080", tlsDialer(listener.Addr().String(), HTTP2Protocol))
+	for i := 0; i < 3; i++ {
+		tunnel, err := dialer.Dial()
+		assert.Nil(t, err, "should open tunnel")
+		_, err = tunnel.Write([]byte("ping"))
+		assert.Nil(t, err, "should write to tunnel")
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(tunnel, buf)
+		assert.Nil(t, err, "should read echo from tunnel")
+		assert.Equal(t, "ping", string(buf))
+		tunnel.Close()
+	}
+	assert.Equal(t, 1, accepted, "should carry tunnels over one connection")
+}
+
+func TestHTTP2NotNegotiated(t *testing.T) {
+	listener := newTestTLSListener(t)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	dialer := NewHTTP2Dialer("backend:8080", tlsDialer(listener.Addr().String(), HTTP2Protocol))
+	_, err := dialer.Dial()
+	assert.Equal(t, errHTTP2NotNegotiated, err, "should fail if server didn't negotiate h2")
+}
@@ -0,0 +1,385 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICProtocol is the ALPN protocol name for QUIC tunnels.
+const QUICProtocol = "ghostunnel-quic"
+
+const (
+	// Idle connections are kept alive with pings, so tunnels that don't send
+	// anything for a while aren't torn down.
+	quicIdleTimeout = 60 * time.Second
+	quicKeepAlive   = 15 * time.Second
+	// Maximum number of concurrent tunnels on one connection.
+	quicMaxStreams = 1000
+	// Streams start with a version byte, sent by the client right after
+	// opening, since QUIC streams can't be accepted before data is sent.
+	// Otherwise tunnels to backends that talk first would hang.
+	quicStreamVersion = 1
+)
+
+var (
+	errQUICStreamsOnly = errors.New("tunnels on QUIC connections are carried as streams")
+	errQUICGoingAway   = errors.New("QUIC connection is going away")
+	errQUICBadStream   = errors.New("invalid QUIC stream header")
+)
+
+func quicConfig(handshakeTimeout time.Duration) *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: handshakeTimeout,
+		MaxIdleTimeout:       quicIdleTimeout,
+		KeepAlivePeriod:      quicKeepAlive,
+		MaxIncomingStreams:   quicMaxStreams,
+	}
+}
+
+// QUICListener accepts QUIC connections, which carry tunnels as streams.
+// Connections are returned after the handshake completed, as *QUICConn.
+type QUICListener struct {
+	conn      net.PacketConn
+	transport *quic.Transport
+	listener  *quic.Listener
+
+	mu     sync.Mutex
+	open   int
+	closed bool
+}
+
+// ListenQUIC accepts QUIC connections on the given socket, with TLS configs
+// from the given function (called for each handshake, so certificates can be
+// reloaded). Only TLS 1.3 is supported by QUIC, and ALPN is set to
+// QUICProtocol. Takes ownership of the socket.
+func ListenQUIC(conn net.PacketConn, config func() *tls.Config, handshakeTimeout time.Duration) (*QUICListener, error) {
+	tr := &quic.Transport{Conn: conn}
+	ln, err := tr.Listen(&tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			return quicServerConfig(config(), hello)
+		},
+	}, quicConfig(handshakeTimeout))
+	if err != nil {
+		return nil, err
+	}
+	return &QUICListener{conn: conn, transport: tr, listener: ln}, nil
+}
+
+// quicServerConfig resolves the config for a handshake. crypto/tls doesn't
+// call GetConfigForClient of a config returned by GetConfigForClient, so it's
+// applied here.
+func quicServerConfig(config *tls.Config, hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if config.GetConfigForClient != nil {
+		forClient, err := config.GetConfigForClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		if forClient != nil {
+			config = forClient
+		}
+	}
+	config = config.Clone()
+	config.GetConfigForClient = nil
+	config.NextProtos = []string{QUICProtocol}
+	return config, nil
+}
+
+// Accept waits for the next connection.
+func (l *QUICListener) Accept() (net.Conn, error) {
+	conn, err := l.listener.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		conn.CloseWithError(0, "")
+		return nil, net.ErrClosed
+	}
+	l.open++
+	return newQUICConn(conn, l.release), nil
+}
+
+// Close stops accepting connections. The socket stays open until accepted
+// connections are closed, so their tunnels can finish.
+func (l *QUICListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	err := l.listener.Close()
+	if l.open == 0 {
+		l.closeTransport()
+	}
+	return err
+}
+
+func (l *QUICListener) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open--
+	if l.closed && l.open == 0 {
+		l.closeTransport()
+	}
+}
+
+func (l *QUICListener) closeTransport() {
+	l.transport.Close()
+	l.conn.Close()
+}
+
+// Addr returns the address of the socket.
+func (l *QUICListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// QUICConn is an established QUIC connection. It carries tunnels as streams,
+// and can't be read or written directly. Like a *tls.Conn, it exposes the
+// TLS connection state, and closing it closes all of its streams.
+type QUICConn struct {
+	conn    quic.Connection
+	release func()
+
+	goAway     chan struct{}
+	goAwayOnce sync.Once
+	closeOnce  sync.Once
+}
+
+func newQUICConn(conn quic.Connection, release func()) *QUICConn {
+	return &QUICConn{
+		conn:    conn,
+		release: release,
+		goAway:  make(chan struct{}),
+	}
+}
+
+// AcceptStream waits for the next tunnel opened by the peer. Fails once the
+// connection is closed, or after GoAway.
+func (c *QUICConn) AcceptStream() (net.Conn, error) {
+	ctx, cancel := context.WithCancel(c.conn.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.goAway:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stream, err := c.conn.AcceptStream(ctx)
+	if err != nil {
+		select {
+		case <-c.goAway:
+			return nil, errQUICGoingAway
+		default:
+			return nil, err
+		}
+	}
+	return c.streamConn(stream, &quicStreamReader{stream: stream}), nil
+}
+
+// OpenStream opens a new tunnel to the peer, waiting until the peer allows
+// another stream, or until the given context is done.
+func (c *QUICConn) OpenStream(ctx context.Context) (net.Conn, error) {
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write([]byte{quicStreamVersion}); err != nil {
+		stream.CancelWrite(0)
+		stream.CancelRead(0)
+		return nil, err
+	}
+	return c.streamConn(stream, stream), nil
+}
+
+func (c *QUICConn) streamConn(stream quic.Stream, reader io.Reader) net.Conn {
+	return &streamConn{
+		Reader: reader,
+		Writer: stream,
+		conn:   c,
+		close: func() error {
+			stream.CancelRead(0)
+			return stream.Close()
+		},
+	}
+}
+
+// quicStreamReader checks the header of accepted streams on first read, so
+// the accept loop doesn't wait for it.
+type quicStreamReader struct {
+	stream quic.Stream
+	header bool
+}
+
+func (r *quicStreamReader) Read(b []byte) (int, error) {
+	if !r.header {
+		var header [1]byte
+		if _, err := io.ReadFull(r.stream, header[:]); err != nil {
+			return 0, err
+		}
+		if header[0] != quicStreamVersion {
+			return 0, errQUICBadStream
+		}
+		r.header = true
+	}
+	return r.stream.Read(b)
+}
+
+// GoAway stops accepting new streams, open streams are unaffected.
+func (c *QUICConn) GoAway() {
+	c.goAwayOnce.Do(func() { close(c.goAway) })
+}
+
+// Done returns a channel that's closed once the connection is closed.
+func (c *QUICConn) Done() <-chan struct{} {
+	return c.conn.Context().Done()
+}
+
+// Read always fails, tunnels are carried as streams.
+func (c *QUICConn) Read(b []byte) (int, error) {
+	return 0, errQUICStreamsOnly
+}
+
+// Write always fails, tunnels are carried as streams.
+func (c *QUICConn) Write(b []byte) (int, error) {
+	return 0, errQUICStreamsOnly
+}
+
+// Close closes the connection, and all of its streams.
+func (c *QUICConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.CloseWithError(0, "")
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return err
+}
+
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *QUICConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *QUICConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *QUICConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Handshake is a no-op, connections are only returned once the handshake
+// completed.
+func (c *QUICConn) Handshake() error {
+	return nil
+}
+
+// ConnectionState returns the TLS connection state.
+func (c *QUICConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// QUICDialer opens tunnels as streams of a QUIC connection. Streams share one
+// connection per address, a new one is established once it's closed.
+type QUICDialer struct {
+	config  func() *tls.Config
+	timeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*QUICConn
+}
+
+// NewQUICDialer creates a dialer for tunnels over QUIC, with TLS configs from
+// the given function (called for each new connection). NextProtos must be set
+// to QUICProtocol. The timeout applies to handshakes, and to waiting for the
+// server to allow another stream.
+func NewQUICDialer(config func() *tls.Config, timeout time.Duration) *QUICDialer {
+	return &QUICDialer{
+		config:  config,
+		timeout: timeout,
+		conns:   map[string]*QUICConn{},
+	}
+}
+
+// Dial opens a tunnel to the given address (the network is ignored, QUIC is
+// always carried over UDP).
+func (d *QUICDialer) Dial(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	conn, err := d.conn(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStream(ctx)
+	if err != nil {
+		// Connection may be broken, don't reuse it
+		d.drop(address, conn)
+		conn.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// conn returns the open connection to address, or establishes a new one.
+func (d *QUICDialer) conn(ctx context.Context, address string) (*QUICConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if conn, ok := d.conns[address]; ok {
+		select {
+		case <-conn.Done():
+		default:
+			return conn, nil
+		}
+	}
+	raw, err := quic.DialAddr(ctx, address, d.config(), quicConfig(d.timeout))
+	if err != nil {
+		return nil, err
+	}
+	conn := newQUICConn(raw, nil)
+	d.conns[address] = conn
+	return conn, nil
+}
+
+func (d *QUICDialer) drop(address string, conn *QUICConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conns[address] == conn {
+		delete(d.conns, address)
+	}
+}
@@ -0,0 +1,164 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestQUICListener listens on a random UDP port, with a self-signed
+// certificate.
+func newTestQUICListener(t *testing.T) *QUICListener {
+	cert := newTestCertificate(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	listener, err := ListenQUIC(conn, func() *tls.Config {
+		return &tls.Config{Certificates: []tls.Certificate{cert}}
+	}, time.Second)
+	assert.Nil(t, err, "should be able to listen for QUIC connections")
+	return listener
+}
+
+func newTestQUICDialer() *QUICDialer {
+	return NewQUICDialer(func() *tls.Config {
+		return &tls.Config{InsecureSkipVerify: true, NextProtos: []string{QUICProtocol}}
+	}, time.Second)
+}
+
+// serveQUIC accepts connections, and calls handle for each stream.
+func serveQUIC(listener *QUICListener, handle func(conn, stream net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				stream, err := conn.(*QUICConn).AcceptStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					handle(conn, stream)
+				}()
+			}
+		}()
+	}
+}
+
+func TestQUICTunnel(t *testing.T) {
+	listener := newTestQUICListener(t)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go serveQUIC(listener, func(conn, stream net.Conn) {
+		accepted <- conn
+		assert.Equal(t, conn.RemoteAddr(), stream.RemoteAddr(), "stream should have address of connection")
+		assert.Equal(t, QUICProtocol, stream.(interface{ ConnectionState() tls.ConnectionState }).ConnectionState().NegotiatedProtocol)
+		io.Copy(stream, stream)
+	})
+
+	dialer := newTestQUICDialer()
+	for i := 0; i < 3; i++ {
+		tunnel, err := dialer.Dial("udp", listener.Addr().String())
+		assert.Nil(t, err, "should open tunnel")
+		_, err = tunnel.Write([]byte("ping"))
+		assert.Nil(t, err, "should write to tunnel")
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(tunnel, buf)
+		assert.Nil(t, err, "should read echo from tunnel")
+		assert.Equal(t, "ping", string(buf))
+		tunnel.Close()
+	}
+	first := <-accepted
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, first, <-accepted, "should carry tunnels over one connection")
+	}
+}
+
+func TestQUICServerTalksFirst(t *testing.T) {
+	listener := newTestQUICListener(t)
+	defer listener.Close()
+
+	go serveQUIC(listener, func(conn, stream net.Conn) {
+		stream.Write([]byte("hello"))
+	})
+
+	tunnel, err := newTestQUICDialer().Dial("udp", listener.Addr().String())
+	assert.Nil(t, err, "should open tunnel")
+	defer tunnel.Close()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(tunnel, buf)
+	assert.Nil(t, err, "should read from tunnel before writing to it")
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestQUICGoAway(t *testing.T) {
+	listener := newTestQUICListener(t)
+
+	conns := make(chan *QUICConn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conns <- conn.(*QUICConn)
+		}
+	}()
+
+	dialer := newTestQUICDialer()
+	tunnel, err := dialer.Dial("udp", listener.Addr().String())
+	assert.Nil(t, err, "should open tunnel")
+	defer tunnel.Close()
+	_, err = tunnel.Write([]byte("ping"))
+	assert.Nil(t, err, "should write to tunnel")
+
+	conn := <-conns
+	defer conn.Close()
+	stream, err := conn.AcceptStream()
+	assert.Nil(t, err, "should accept stream")
+
+	// Open streams keep working after the listener is closed
+	listener.Close()
+	conn.GoAway()
+	_, err = conn.AcceptStream()
+	assert.Equal(t, errQUICGoingAway, err, "should stop accepting streams after GoAway")
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(stream, buf)
+	assert.Nil(t, err, "should read from open stream")
+	_, err = stream.Write(buf)
+	assert.Nil(t, err, "should write to open stream")
+	_, err = io.ReadFull(tunnel, buf)
+	assert.Nil(t, err, "should read echo from tunnel")
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestQUICNotServing(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer conn.Close()
+
+	_, err = newTestQUICDialer().Dial("udp", conn.LocalAddr().String())
+	assert.NotNil(t, err, "should fail if nothing is serving QUIC")
+}
@@ -0,0 +1,139 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketProtocol is the ALPN protocol name for WebSocket tunnels, which
+// start out as HTTP/1.1 requests.
+const WebSocketProtocol = "http/1.1"
+
+var errWebSocketHandshake = errors.New("invalid websocket handshake")
+
+// DialWebSocket opens a tunnel as a WebSocket (RFC 6455) over conn, with
+// an upgrade request for the given Host header and path.
+func DialWebSocket(conn net.Conn, host, path string) (net.Conn, error) {
+	config, err := websocket.NewConfig("wss://"+host+path, "https://"+host)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return &webSocketConn{Conn: ws, conn: conn}, nil
+}
+
+// ServeWebSocket reads a WebSocket upgrade request for the given path from
+// conn, and calls serve with the tunnel. The upgrade request must arrive
+// within the given timeout. The connection is closed when serve returns.
+func ServeWebSocket(conn net.Conn, path string, timeout time.Duration, serve func(tunnel net.Conn)) error {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if req.URL.Path != path {
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return fmt.Errorf("websocket request for unknown path %s", req.URL.Path)
+	}
+
+	served := false
+	server := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			served = true
+			ws.PayloadType = websocket.BinaryFrame
+			serve(&webSocketConn{Conn: ws, conn: conn})
+		},
+	}
+	server.ServeHTTP(&hijackWriter{conn: conn, reader: reader}, req)
+	if !served {
+		return errWebSocketHandshake
+	}
+	return nil
+}
+
+// webSocketConn is a tunnel carried over a WebSocket. It reports addresses
+// and connection state of the underlying connection, like a *tls.Conn.
+type webSocketConn struct {
+	*websocket.Conn
+	conn net.Conn
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Handshake is a no-op, the underlying connection is established before
+// the upgrade request.
+func (c *webSocketConn) Handshake() error {
+	return nil
+}
+
+// ConnectionState returns the TLS connection state of the underlying
+// connection (empty if it isn't TLS).
+func (c *webSocketConn) ConnectionState() tls.ConnectionState {
+	if conn, ok := c.conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// hijackWriter hands the connection to the websocket server, which hijacks
+// it right away and writes responses (including errors) itself.
+type hijackWriter struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	header http.Header
+}
+
+func (w *hijackWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *hijackWriter) Write(b []byte) (int, error) {
+	return w.conn.Write(b)
+}
+
+func (w *hijackWriter) WriteHeader(status int) {
+	fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(w.reader, bufio.NewWriter(w.conn)), nil
+}
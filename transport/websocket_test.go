@@ -0,0 +1,88 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketTunnel(t *testing.T) {
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ServeWebSocket(server, "/tunnel", time.Second, func(tunnel net.Conn) {
+			assert.Equal(t, server.RemoteAddr(), tunnel.RemoteAddr(), "tunnel should have address of connection")
+			io.Copy(tunnel, tunnel)
+		})
+	}()
+
+	tunnel, err := DialWebSocket(client, "backend.example.com", "/tunnel")
+	assert.Nil(t, err, "should open tunnel")
+
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go tunnel.Write(data)
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(tunnel, received)
+	assert.Nil(t, err, "should read echo over tunnel")
+	assert.Equal(t, data, received)
+
+	tunnel.Close()
+	assert.Nil(t, <-errs, "should serve tunnel until closed")
+}
+
+func TestWebSocketWrongPath(t *testing.T) {
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ServeWebSocket(server, "/tunnel", time.Second, func(tunnel net.Conn) {
+			t.Error("should not serve tunnel on wrong path")
+		})
+		server.Close()
+	}()
+
+	_, err := DialWebSocket(client, "backend.example.com", "/other")
+	assert.NotNil(t, err, "should reject upgrade request for wrong path")
+	assert.NotNil(t, <-errs, "should fail serving wrong path")
+}
+
+func TestWebSocketNotUpgrade(t *testing.T) {
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ServeWebSocket(server, "/", time.Second, func(tunnel net.Conn) {
+			t.Error("should not serve tunnel without upgrade")
+		})
+	}()
+
+	go io.Copy(io.Discard, client)
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	assert.Equal(t, errWebSocketHandshake, <-errs, "should reject plain HTTP requests")
+}
+
+func TestWebSocketTimeout(t *testing.T) {
+	_, server := net.Pipe()
+	err := ServeWebSocket(server, "/", 50*time.Millisecond, func(tunnel net.Conn) {})
+	assert.NotNil(t, err, "should time out waiting for upgrade request")
+}
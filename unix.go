@@ -1,3 +1,4 @@
+//go:build !windows
 // +build !windows
 
 /*-
@@ -25,7 +26,8 @@ import (
 
 var (
 	shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
-	refreshSignals  = []os.Signal{syscall.SIGUSR1}
+	refreshSignals  = []os.Signal{syscall.SIGUSR1, syscall.SIGHUP}
+	upgradeSignals  = []os.Signal{syscall.SIGUSR2}
 	syslogFlag      = app.Flag("syslog", "Send logs to syslog instead of stderr.").Bool()
 )
 
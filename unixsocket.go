@@ -0,0 +1,96 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+
+	"github.com/square/ghostunnel/socket"
+)
+
+// configureUnixSockets sets the permissions for UNIX socket files we listen
+// on, from --unix-socket-mode, --unix-socket-owner and --unix-socket-group,
+// and the security descriptor for named pipes from --pipe-security-descriptor.
+func configureUnixSockets() error {
+	if *unixSocketMode != "" {
+		mode, err := strconv.ParseUint(*unixSocketMode, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			return fmt.Errorf("invalid --unix-socket-mode '%s', must be an octal file mode (e.g. 0660)", *unixSocketMode)
+		}
+		socket.UnixSocketMode = os.FileMode(mode)
+	}
+	if *unixSocketOwner != "" {
+		uid, err := lookupUID(*unixSocketOwner)
+		if err != nil {
+			return fmt.Errorf("invalid --unix-socket-owner '%s': %s", *unixSocketOwner, err)
+		}
+		socket.UnixSocketOwner = int(uid)
+	}
+	if *unixSocketGroup != "" {
+		gid, err := lookupGID(*unixSocketGroup)
+		if err != nil {
+			return fmt.Errorf("invalid --unix-socket-group '%s': %s", *unixSocketGroup, err)
+		}
+		socket.UnixSocketGroup = int(gid)
+	}
+	if *pipeSecurity != "" && runtime.GOOS != "windows" {
+		return errors.New("--pipe-security-descriptor is only supported on windows")
+	}
+	socket.PipeSecurityDescriptor = *pipeSecurity
+	return nil
+}
+
+// lookupUID returns the ID of a user given by name or numeric ID.
+func lookupUID(name string) (uint32, error) {
+	return lookupID(name, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+}
+
+// lookupGID returns the ID of a group given by name or numeric ID.
+func lookupGID(name string) (uint32, error) {
+	return lookupID(name, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+}
+
+// lookupID parses a numeric ID, or looks up the ID for a name.
+func lookupID(name string, lookup func(string) (string, error)) (uint32, error) {
+	id, err := strconv.ParseUint(name, 10, 32)
+	if err == nil {
+		return uint32(id), nil
+	}
+	value, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err = strconv.ParseUint(value, 10, 32)
+	return uint32(id), err
+}
@@ -0,0 +1,52 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/square/ghostunnel/socket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureUnixSockets(t *testing.T) {
+	defer func() {
+		*unixSocketMode = ""
+		*unixSocketOwner = ""
+		*unixSocketGroup = ""
+		socket.UnixSocketMode = 0
+		socket.UnixSocketOwner = -1
+		socket.UnixSocketGroup = -1
+	}()
+
+	*unixSocketMode = "0660"
+	*unixSocketOwner = "0"
+	assert.Nil(t, configureUnixSockets(), "should accept valid mode and owner")
+	assert.Equal(t, os.FileMode(0660), socket.UnixSocketMode)
+	assert.Equal(t, 0, socket.UnixSocketOwner)
+	assert.Equal(t, -1, socket.UnixSocketGroup, "should leave group unchanged")
+
+	*unixSocketMode = "rw-rw----"
+	assert.NotNil(t, configureUnixSockets(), "should reject non-octal mode")
+	*unixSocketMode = "01777"
+	assert.NotNil(t, configureUnixSockets(), "should reject mode with special bits")
+	*unixSocketMode = ""
+
+	*unixSocketGroup = "no-such-group-ghostunnel"
+	assert.NotNil(t, configureUnixSockets(), "should reject unknown group")
+}
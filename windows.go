@@ -1,3 +1,4 @@
+//go:build windows
 // +build windows
 
 /*-
@@ -25,6 +26,7 @@ import (
 var (
 	shutdownSignals = []os.Signal{os.Interrupt}
 	refreshSignals  = []os.Signal{ /* Not supported on Windows */ }
+	upgradeSignals  = []os.Signal{ /* Not supported on Windows */ }
 )
 
 func useSyslog() bool {